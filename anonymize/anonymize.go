@@ -0,0 +1,201 @@
+// Package anonymize replaces the IP addresses of the published events by
+// pseudonyms, so that the real addresses of the clients are not stored.
+// The same address always gets the same pseudonym.
+package anonymize
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/johann8384/libbeat/common"
+)
+
+// Modes of the anonymization.
+const (
+	// The addresses are replaced by a keyed hash of them.
+	ModeHash = "hash"
+
+	// The addresses are encrypted with Crypto-PAn: two addresses
+	// sharing a prefix of n bits get pseudonyms sharing a prefix of n
+	// bits, so that the subnets can still be told apart.
+	ModePrefixPreserving = "prefix_preserving"
+)
+
+type AnonymizeConfig struct {
+	// hash or prefix_preserving. The addresses are published as they
+	// are when it is empty.
+	Mode string
+
+	// Secret from which the pseudonyms are computed. The same salt
+	// gives the same pseudonyms, across restarts and shippers.
+	Salt string
+}
+
+type Anonymizer struct {
+	mode string
+
+	// key of the hashes
+	key []byte
+
+	// cipher and pad of Crypto-PAn
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+}
+
+// New creates the anonymizer from the configuration. The key is derived
+// from the salt.
+func New(config AnonymizeConfig) (*Anonymizer, error) {
+	if len(config.Salt) == 0 {
+		return nil, errors.New("anonymize_ips needs a salt")
+	}
+	key := sha256.Sum256([]byte(config.Salt))
+	anonymizer := &Anonymizer{mode: config.Mode, key: key[:]}
+
+	switch config.Mode {
+	case ModeHash:
+	case ModePrefixPreserving:
+		// the first half of the key is the AES key, the second one
+		// is encrypted to get the pad
+		block, err := aes.NewCipher(key[:aes.BlockSize])
+		if err != nil {
+			return nil, err
+		}
+		anonymizer.block = block
+		block.Encrypt(anonymizer.pad[:], key[aes.BlockSize:])
+	default:
+		return nil, fmt.Errorf("Unknown anonymize_ips mode: %s", config.Mode)
+	}
+	return anonymizer, nil
+}
+
+// AnonymizeIp returns the pseudonym of the address, of the same family.
+func (anonymizer *Anonymizer) AnonymizeIp(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if anonymizer.mode == ModeHash {
+		return anonymizer.hash(ip)
+	}
+	return anonymizer.cryptoPan(ip)
+}
+
+func (anonymizer *Anonymizer) hash(ip net.IP) net.IP {
+	mac := hmac.New(sha256.New, anonymizer.key)
+	mac.Write(ip)
+	return net.IP(mac.Sum(nil)[:len(ip)])
+}
+
+func bit(b []byte, i int) byte {
+	return (b[i/8] >> uint(7-i%8)) & 1
+}
+
+// cryptoPan flips each bit of the address depending on the bits before
+// it: the bit i is xored with the first bit of the encryption of the i
+// first bits of the address, completed with the pad.
+func (anonymizer *Anonymizer) cryptoPan(ip net.IP) net.IP {
+	var input, output [aes.BlockSize]byte
+	res := make(net.IP, len(ip))
+	copy(res, ip)
+
+	for i := 0; i < len(ip)*8; i++ {
+		input = anonymizer.pad
+		for j := 0; j < i/8; j++ {
+			input[j] = ip[j]
+		}
+		if i%8 != 0 {
+			mask := byte(0xff) << uint(8-i%8)
+			input[i/8] = ip[i/8]&mask | anonymizer.pad[i/8]&^mask
+		}
+
+		anonymizer.block.Encrypt(output[:], input[:])
+		res[i/8] ^= bit(output[:], 0) << uint(7-i%8)
+	}
+	return res
+}
+
+func (anonymizer *Anonymizer) anonymizeEndpoint(event common.MapStr, key string) {
+	endpoint, ok := event[key].(*common.Endpoint)
+	if !ok {
+		return
+	}
+	ip := net.ParseIP(endpoint.Ip)
+	if ip == nil {
+		return
+	}
+
+	// the endpoint can be shared with other events
+	anonymized := *endpoint
+	anonymized.Ip = anonymizer.AnonymizeIp(ip).String()
+	event[key] = &anonymized
+}
+
+// anonymizeList replaces the addresses of a comma separated list, like
+// the X-Forwarded-For header.
+func (anonymizer *Anonymizer) anonymizeList(list string) string {
+	addresses := strings.Split(list, ",")
+	for i, address := range addresses {
+		addresses[i] = strings.TrimSpace(address)
+		ip := net.ParseIP(addresses[i])
+		if ip != nil {
+			addresses[i] = anonymizer.AnonymizeIp(ip).String()
+		}
+	}
+	return strings.Join(addresses, ", ")
+}
+
+// anonymizeField replaces the address of a string field, which can be
+// followed by a port, like the resource of ICMP.
+func (anonymizer *Anonymizer) anonymizeField(fields common.MapStr, key string) {
+	value, ok := fields[key].(string)
+	if !ok {
+		return
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		fields[key] = anonymizer.AnonymizeIp(ip).String()
+		return
+	}
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if _, err := strconv.Atoi(port); err == nil {
+			fields[key] = net.JoinHostPort(anonymizer.AnonymizeIp(ip).String(), port)
+		}
+	}
+}
+
+// AnonymizeEvent replaces every address of the event: the source and the
+// destination, the real_ip and client.ip fields of HTTP, and the
+// resource and the original packet of ICMP.
+func (anonymizer *Anonymizer) AnonymizeEvent(event common.MapStr) {
+	anonymizer.anonymizeEndpoint(event, "src")
+	anonymizer.anonymizeEndpoint(event, "dst")
+
+	if event["type"] == "icmp" {
+		anonymizer.anonymizeField(event, "resource")
+		if icmp, ok := event["icmp"].(common.MapStr); ok {
+			if original, ok := icmp["original"].(common.MapStr); ok {
+				// the details are built for this event only
+				anonymizer.anonymizeField(original, "src_ip")
+				anonymizer.anonymizeField(original, "dst_ip")
+			}
+		}
+	}
+
+	if realIp, ok := event["real_ip"].(string); ok {
+		event["real_ip"] = anonymizer.anonymizeList(realIp)
+	}
+	if client, ok := event["client"].(common.MapStr); ok {
+		if ip, ok := client["ip"].(string); ok {
+			client["ip"] = anonymizer.anonymizeList(ip)
+		}
+	}
+}
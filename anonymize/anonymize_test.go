@@ -0,0 +1,146 @@
+package anonymize
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// commonPrefix returns the number of leading bits shared by the addresses.
+func commonPrefix(a net.IP, b net.IP) int {
+	for i := 0; i < len(a)*8; i++ {
+		if bit(a, i) != bit(b, i) {
+			return i
+		}
+	}
+	return len(a) * 8
+}
+
+func TestAnonymize_consistent(t *testing.T) {
+	for _, mode := range []string{ModeHash, ModePrefixPreserving} {
+		anonymizer, err := New(AnonymizeConfig{Mode: mode, Salt: "secret"})
+		assert.Nil(t, err)
+
+		ip := net.ParseIP("10.1.2.3")
+		anonymized := anonymizer.AnonymizeIp(ip)
+		assert.Len(t, anonymized, net.IPv4len, mode)
+		assert.NotEqual(t, ip.To4(), anonymized, mode)
+		assert.Equal(t, anonymized, anonymizer.AnonymizeIp(net.ParseIP("10.1.2.3")), mode)
+		assert.NotEqual(t, anonymized, anonymizer.AnonymizeIp(net.ParseIP("10.1.2.4")), mode)
+
+		assert.Len(t, anonymizer.AnonymizeIp(net.ParseIP("2001:db8::1")), net.IPv6len, mode)
+
+		// another salt gives other pseudonyms
+		other, err := New(AnonymizeConfig{Mode: mode, Salt: "other secret"})
+		assert.Nil(t, err)
+		assert.NotEqual(t, anonymized, other.AnonymizeIp(ip), mode)
+	}
+}
+
+func TestAnonymize_prefixPreserving(t *testing.T) {
+	anonymizer, err := New(AnonymizeConfig{Mode: ModePrefixPreserving, Salt: "secret"})
+	assert.Nil(t, err)
+
+	a := anonymizer.AnonymizeIp(net.ParseIP("192.168.1.10"))
+	b := anonymizer.AnonymizeIp(net.ParseIP("192.168.1.200"))
+	c := anonymizer.AnonymizeIp(net.ParseIP("192.168.2.10"))
+
+	// 10 and 200 differ from the first bit of the last byte
+	assert.Equal(t, 24, commonPrefix(a, b))
+	assert.Equal(t, 22, commonPrefix(a, c))
+	assert.NotEqual(t, "192.168.1", a.String()[:9])
+
+	v6a := anonymizer.AnonymizeIp(net.ParseIP("2001:db8:1::1"))
+	v6b := anonymizer.AnonymizeIp(net.ParseIP("2001:db8:1::2"))
+	assert.Equal(t, 126, commonPrefix(v6a, v6b))
+}
+
+func TestAnonymize_event(t *testing.T) {
+	anonymizer, err := New(AnonymizeConfig{Mode: ModeHash, Salt: "secret"})
+	assert.Nil(t, err)
+
+	src := &common.Endpoint{Ip: "10.0.0.1", Port: 41234, Proc: "curl"}
+	event := common.MapStr{
+		"type":    "http",
+		"src":     src,
+		"dst":     &common.Endpoint{Ip: "10.0.0.2", Port: 80},
+		"real_ip": "10.0.0.1, unknown",
+		"client":  common.MapStr{"ip": "10.0.0.1"},
+	}
+	anonymizer.AnonymizeEvent(event)
+
+	anonymized := anonymizer.AnonymizeIp(net.ParseIP("10.0.0.1")).String()
+	assert.Equal(t, &common.Endpoint{Ip: anonymized, Port: 41234, Proc: "curl"}, event["src"])
+	assert.Equal(t, anonymizer.AnonymizeIp(net.ParseIP("10.0.0.2")).String(),
+		event["dst"].(*common.Endpoint).Ip)
+	assert.Equal(t, anonymized+", unknown", event["real_ip"])
+	assert.Equal(t, common.MapStr{"ip": anonymized}, event["client"])
+
+	// the endpoint given by the plugin is left untouched
+	assert.Equal(t, "10.0.0.1", src.Ip)
+}
+
+func TestAnonymize_protocols(t *testing.T) {
+	anonymizer, err := New(AnonymizeConfig{Mode: ModePrefixPreserving, Salt: "secret"})
+	assert.Nil(t, err)
+
+	endpoints := func(event common.MapStr) common.MapStr {
+		event["src"] = &common.Endpoint{Ip: "10.0.0.1", Port: 41234}
+		event["dst"] = &common.Endpoint{Ip: "2001:db8::2", Port: 53}
+		return event
+	}
+	events := []common.MapStr{
+		endpoints(common.MapStr{"type": "http", "real_ip": "10.0.0.1", "client": common.MapStr{"ip": "10.0.0.1"}}),
+		endpoints(common.MapStr{"type": "mysql"}),
+		endpoints(common.MapStr{"type": "pgsql"}),
+		endpoints(common.MapStr{"type": "redis"}),
+		endpoints(common.MapStr{"type": "mongodb"}),
+		endpoints(common.MapStr{"type": "thrift"}),
+		endpoints(common.MapStr{"type": "memcache"}),
+		endpoints(common.MapStr{"type": "dns"}),
+		endpoints(common.MapStr{"type": "flow"}),
+		endpoints(common.MapStr{
+			"type":     "icmp",
+			"resource": "2001:db8::2",
+		}),
+		endpoints(common.MapStr{
+			"type":     "icmp",
+			"resource": "[2001:db8::2]:53",
+			"icmp": common.MapStr{
+				"original": common.MapStr{
+					"transport": "udp",
+					"src_ip":    "10.0.0.1",
+					"dst_ip":    "2001:db8::2",
+				},
+			},
+		}),
+	}
+
+	for _, event := range events {
+		anonymizer.AnonymizeEvent(event)
+		published, err := json.Marshal(event)
+		assert.Nil(t, err)
+		for _, ip := range []string{"10.0.0.1", "2001:db8::2"} {
+			assert.False(t, strings.Contains(string(published), ip),
+				"%s leaks %s: %s", event["type"], ip, published)
+		}
+	}
+
+	anonymized := anonymizer.AnonymizeIp(net.ParseIP("2001:db8::2")).String()
+	assert.Equal(t, anonymized, events[9]["resource"])
+	assert.Equal(t, "["+anonymized+"]:53", events[10]["resource"])
+	assert.Equal(t, anonymized, events[10]["icmp"].(common.MapStr)["original"].(common.MapStr)["dst_ip"])
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New(AnonymizeConfig{Mode: "hash"})
+	assert.NotNil(t, err)
+
+	_, err = New(AnonymizeConfig{Mode: "rot13", Salt: "secret"})
+	assert.NotNil(t, err)
+}
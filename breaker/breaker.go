@@ -0,0 +1,138 @@
+// Package breaker protects the capture from a slow output. When the queue
+// of the publisher stays full, the events are either dropped and counted,
+// or held back so that the protocol plugins stop feeding new transactions,
+// until the queue is drained below a low-water mark.
+package breaker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+)
+
+// Policies applied while the output queue is saturated.
+const (
+	// The events are dropped and counted.
+	PolicyDrop = "drop"
+
+	// The events are held back, which blocks the protocol plugins.
+	PolicyBlock = "block"
+)
+
+// Defaults of the water marks, for the queue of 1000 events of the
+// publisher.
+const (
+	DefaultHighWaterMark = 900
+	DefaultLowWaterMark  = 500
+)
+
+// How often the queue length is checked while the events are held back.
+const pollInterval = 10 * time.Millisecond
+
+type BreakerConfig struct {
+	// drop or block. The breaker is disabled when it is empty.
+	Policy string
+
+	// The breaker opens when the output queue holds this many events,
+	// and closes again when it holds this many events or less.
+	High_water_mark *int
+	Low_water_mark  *int
+}
+
+type Breaker struct {
+	policy string
+	high   int
+	low    int
+
+	lock      sync.Mutex
+	saturated bool
+	dropped   uint64
+	since     time.Time
+}
+
+// New creates the breaker from the configuration.
+func New(config BreakerConfig) (*Breaker, error) {
+	breaker := &Breaker{
+		policy: config.Policy,
+		high:   DefaultHighWaterMark,
+		low:    DefaultLowWaterMark,
+	}
+	switch config.Policy {
+	case PolicyDrop, PolicyBlock:
+	default:
+		return nil, fmt.Errorf("unknown output_breaker policy: %s", config.Policy)
+	}
+	if config.High_water_mark != nil {
+		breaker.high = *config.High_water_mark
+	}
+	if config.Low_water_mark != nil {
+		breaker.low = *config.Low_water_mark
+	}
+	if breaker.high <= 0 || breaker.low < 0 || breaker.low >= breaker.high {
+		return nil, fmt.Errorf("output_breaker needs 0 <= low_water_mark < high_water_mark, got %d and %d",
+			breaker.low, breaker.high)
+	}
+	return breaker, nil
+}
+
+// Dropped returns the number of events dropped while the output queue
+// was saturated.
+func (breaker *Breaker) Dropped() uint64 {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	return breaker.dropped
+}
+
+// Saturated tells whether the breaker is open.
+func (breaker *Breaker) Saturated() bool {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	return breaker.saturated
+}
+
+// update opens the breaker when the queue length reaches the high-water
+// mark and closes it when it is back to the low-water mark. It returns
+// whether the breaker is open.
+func (breaker *Breaker) update(length int) bool {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	if !breaker.saturated && length >= breaker.high {
+		breaker.saturated = true
+		breaker.since = time.Now()
+		if breaker.policy == PolicyDrop {
+			logp.Warn("Output queue saturated (%d events), dropping the events", length)
+		} else {
+			logp.Warn("Output queue saturated (%d events), pausing the transactions", length)
+		}
+	} else if breaker.saturated && length <= breaker.low {
+		breaker.saturated = false
+		logp.Info("Output queue drained (%d events) after %v, resuming. %d events dropped so far",
+			length, time.Since(breaker.since), breaker.dropped)
+	}
+	return breaker.saturated
+}
+
+// Guard returns the processor of the events published in output, the
+// queue of the publisher. While the queue is saturated, the processor
+// drops the events, or holds them back until it is drained.
+func (breaker *Breaker) Guard(output chan common.MapStr) func(event common.MapStr) bool {
+	return func(event common.MapStr) bool {
+		if !breaker.update(len(output)) {
+			return true
+		}
+		if breaker.policy == PolicyDrop {
+			breaker.lock.Lock()
+			breaker.dropped++
+			breaker.lock.Unlock()
+			return false
+		}
+		for breaker.update(len(output)) {
+			time.Sleep(pollInterval)
+		}
+		return true
+	}
+}
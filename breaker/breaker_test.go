@@ -0,0 +1,103 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/packetbeat/pipeline"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newBreaker(t *testing.T, policy string, high int, low int) *Breaker {
+	breaker, err := New(BreakerConfig{
+		Policy:          policy,
+		High_water_mark: &high,
+		Low_water_mark:  &low,
+	})
+	assert.Nil(t, err)
+	return breaker
+}
+
+// waitFor polls the condition, as the events are forwarded by a goroutine.
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBreaker_config(t *testing.T) {
+	_, err := New(BreakerConfig{Policy: "retry"})
+	assert.NotNil(t, err)
+
+	high, low := 10, 10
+	_, err = New(BreakerConfig{Policy: PolicyDrop, High_water_mark: &high, Low_water_mark: &low})
+	assert.NotNil(t, err)
+
+	breaker, err := New(BreakerConfig{Policy: PolicyBlock})
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultHighWaterMark, breaker.high)
+	assert.Equal(t, DefaultLowWaterMark, breaker.low)
+}
+
+func TestBreaker_drop(t *testing.T) {
+	breaker := newBreaker(t, PolicyDrop, 5, 2)
+
+	// nobody reads the output queue
+	output := make(chan common.MapStr, 10)
+	queue := pipeline.Chain{breaker.Guard(output)}.Queue(output)
+	for i := 0; i < 8; i++ {
+		queue <- common.MapStr{"i": i}
+	}
+	waitFor(t, func() bool { return breaker.Dropped() == 3 })
+	assert.Equal(t, 5, len(output))
+	assert.True(t, breaker.Saturated())
+
+	// still saturated above the low-water mark
+	<-output
+	<-output
+	queue <- common.MapStr{"i": 8}
+	waitFor(t, func() bool { return breaker.Dropped() == 4 })
+	assert.Equal(t, 3, len(output))
+
+	// resumes below it
+	<-output
+	queue <- common.MapStr{"i": 9}
+	waitFor(t, func() bool { return len(output) == 3 })
+	assert.False(t, breaker.Saturated())
+	assert.Equal(t, uint64(4), breaker.Dropped())
+}
+
+func TestBreaker_block(t *testing.T) {
+	breaker := newBreaker(t, PolicyBlock, 5, 2)
+
+	output := make(chan common.MapStr, 10)
+	queue := pipeline.Chain{breaker.Guard(output)}.Queue(output)
+	for i := 0; i < 8; i++ {
+		queue <- common.MapStr{"i": i}
+	}
+	waitFor(t, func() bool { return breaker.Saturated() })
+	time.Sleep(5 * pollInterval)
+	assert.Equal(t, 5, len(output))
+	assert.Equal(t, uint64(0), breaker.Dropped())
+
+	// held back until the output is drained to the low-water mark
+	<-output
+	<-output
+	time.Sleep(5 * pollInterval)
+	assert.Equal(t, 3, len(output))
+
+	<-output
+	waitFor(t, func() bool { return len(output) == 5 })
+	assert.Equal(t, uint64(0), breaker.Dropped())
+
+	// no event is lost
+	for i := 3; i < 8; i++ {
+		assert.Equal(t, i, (<-output)["i"])
+	}
+}
@@ -1,36 +1,72 @@
 package config
 
 import (
+	"reflect"
+	"strings"
+
 	"github.com/johann8384/libbeat/common/droppriv"
 	"github.com/johann8384/libbeat/outputs"
 	"github.com/johann8384/libbeat/publisher"
+	"github.com/johann8384/packetbeat/anonymize"
+	"github.com/johann8384/packetbeat/breaker"
+	"github.com/johann8384/packetbeat/flows"
+	"github.com/johann8384/packetbeat/metrics"
+	"github.com/johann8384/packetbeat/observer"
 	"github.com/johann8384/packetbeat/procs"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/responsetimes"
+	"github.com/johann8384/packetbeat/timestamps"
 )
 
 type Config struct {
-	Interfaces InterfacesConfig
-	Protocols  Protocols
-	Output     map[string]outputs.MothershipConfig
-	Shipper    publisher.ShipperConfig
-	Procs      procs.ProcsConfig
-	RunOptions droppriv.RunOptions
-	Logging    Logging
-	Filter     map[string]interface{}
+	Interfaces     InterfacesConfig
+	Tcp            TcpConfig
+	Flows          flows.FlowsConfig
+	Networks       []string
+	Protocols      Protocols
+	Anonymize_ips  anonymize.AnonymizeConfig
+	Output         map[string]outputs.MothershipConfig
+	Shipper        publisher.ShipperConfig
+	Procs          procs.ProcsConfig
+	RunOptions     droppriv.RunOptions
+	Logging        Logging
+	Filter         map[string]interface{}
+	Metrics        metrics.MetricsConfig
+	Output_breaker breaker.BreakerConfig
+	Timestamps     timestamps.TimestampsConfig
+	Response_times responsetimes.ResponseTimesConfig
+	Observer       observer.ObserverConfig
+	Parse_errors   protos.ParseErrorsConfig
 }
 
 type InterfacesConfig struct {
-	Device         string
-	Devices        []string
-	Type           string
-	File           string
-	With_vlans     bool
-	Bpf_filter     string
-	Snaplen        int
-	Buffer_size_mb int
-	TopSpeed       bool
-	Dumpfile       string
-	OneAtATime     bool
-	Loop           int
+	Device                string
+	Devices               []string
+	Type                  string
+	File                  string
+	With_vlans            bool
+	With_tunnels          bool
+	Bpf_filter            string
+	Snaplen               int
+	Promiscuous           *bool
+	Buffer_size_mb        int
+	Fanout_group          *int
+	TopSpeed              bool
+	Dumpfile              string
+	Dump_max_size_mb      int
+	Dump_max_files        int
+	Dump_rotate_every_min int
+	Stats_address         string
+	Drop_warning_percent  float64
+	OneAtATime            bool
+	Loop                  int
+}
+
+type TcpConfig struct {
+	Stream_expiry      *int
+	Reaper_interval    *int
+	Max_data_in_stream *int
+	Auto_detect        bool
 }
 
 type Logging struct {
@@ -38,44 +74,83 @@ type Logging struct {
 }
 
 type Protocols struct {
-	Http   Http
-	Mysql  Mysql
-	Pgsql  Pgsql
-	Redis  Redis
-	Thrift Thrift
+	Http     Http
+	Mysql    Mysql
+	Pgsql    Pgsql
+	Redis    Redis
+	Thrift   Thrift
+	Dns      Dns
+	Mongodb  Mongodb
+	Memcache Memcache
+	Tls      Tls
+	Icmp     Icmp
 }
 
 type Http struct {
-	Ports               []int
-	Send_all_headers    *bool
-	Send_headers        []string
-	Split_cookie        *bool
-	Real_ip_header      *string
-	Include_body_for    []string
-	Hide_keywords       []string
-	Strip_authorization *bool
-	Send_request        *bool
-	Send_response       *bool
+	Enabled                *bool
+	Ports                  []int
+	Max_transactions       *int
+	Transaction_timeout    *int
+	Send_all_headers       *bool
+	Send_headers           []string
+	Split_cookie           *bool
+	Real_ip_header         *string
+	Trusted_proxies        []string
+	Include_body_for       []string
+	Exclude_body_for       []string
+	Max_body_size          *int
+	Parse_json_bodies      *bool
+	Json_max_depth         *int
+	Hide_keywords          []string
+	Strip_authorization    *bool
+	Redact_headers         []string
+	Redact_query_params    []string
+	Ignore_urls            []string
+	Send_request           *bool
+	Send_response          *bool
+	Split_request_response *bool
+	Payload_sample_rate    *float64
+	Retention              *string
 }
 
 type Mysql struct {
-	Ports          []int
-	Max_row_length *int
-	Max_rows       *int
-	Send_request   *bool
-	Send_response  *bool
+	Enabled                *bool
+	Ports                  []int
+	Max_transactions       *int
+	Transaction_timeout    *int
+	Max_row_length         *int
+	Max_rows               *int
+	Max_query_length       *int
+	Normalize_queries      *bool
+	Redact_queries         *bool
+	Rows_sample            *int
+	Send_request           *bool
+	Send_response          *bool
+	Split_request_response *bool
+	Capture_direction      *string
+	Payload_sample_rate    *float64
+	Retention              *string
 }
 
 type Pgsql struct {
-	Ports          []int
-	Max_row_length *int
-	Max_rows       *int
-	Send_request   *bool
-	Send_response  *bool
+	Enabled             *bool
+	Ports               []int
+	Max_transactions    *int
+	Transaction_timeout *int
+	Max_row_length      *int
+	Max_rows            *int
+	Max_param_length    *int
+	Send_request        *bool
+	Send_response       *bool
+	Payload_sample_rate *float64
+	Retention           *string
 }
 
 type Thrift struct {
+	Enabled                    *bool
 	Ports                      []int
+	Max_transactions           *int
+	Transaction_timeout        *int
 	String_max_size            *int
 	Collection_max_size        *int
 	Drop_after_n_struct_fields *int
@@ -86,12 +161,117 @@ type Thrift struct {
 	Idl_files                  []string
 	Send_request               *bool
 	Send_response              *bool
+	Payload_sample_rate        *float64
+	Retention                  *string
 }
 
 type Redis struct {
-	Ports         []int
-	Send_request  *bool
-	Send_response *bool
+	Enabled             *bool
+	Ports               []int
+	Max_transactions    *int
+	Transaction_timeout *int
+	Send_request        *bool
+	Send_response       *bool
+	Payload_sample_rate *float64
+	Retention           *string
+}
+
+type Dns struct {
+	Enabled             *bool
+	Ports               []int
+	Max_transactions    *int
+	Transaction_timeout *int
+	Send_request        *bool
+	Send_response       *bool
+	Payload_sample_rate *float64
+	Retention           *string
+}
+
+type Mongodb struct {
+	Enabled             *bool
+	Ports               []int
+	Max_transactions    *int
+	Transaction_timeout *int
+	Max_doc_length      *int
+	Max_docs            *int
+	Send_request        *bool
+	Send_response       *bool
+	Payload_sample_rate *float64
+	Retention           *string
+}
+
+type Memcache struct {
+	Enabled             *bool
+	Ports               []int
+	Transaction_timeout *int
+	Hash_keys           *bool
+	Send_request        *bool
+	Send_response       *bool
+	Payload_sample_rate *float64
+	Retention           *string
+}
+
+type Tls struct {
+	Enabled   *bool
+	Ports     []int
+	Retention *string
+}
+
+type Icmp struct {
+	Enabled             *bool
+	Max_transactions    *int
+	Transaction_timeout *int
+	Retention           *string
+}
+
+// IsEnabled returns false if the protocol, named like its section, is
+// disabled with `enabled: false`.
+func (protocols *Protocols) IsEnabled(name string) bool {
+	value := reflect.ValueOf(protocols).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if strings.ToLower(value.Type().Field(i).Name) != name {
+			continue
+		}
+		enabled := value.Field(i).FieldByName("Enabled")
+		if !enabled.IsValid() || enabled.IsNil() {
+			return true
+		}
+		return enabled.Elem().Bool()
+	}
+	return true
+}
+
+// Option returns the values of an option of the protocols that set it,
+// like their Retention, by protocol name.
+func (protocols *Protocols) Option(field string) map[string]interface{} {
+	values := map[string]interface{}{}
+	value := reflect.ValueOf(protocols).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		option := value.Field(i).FieldByName(field)
+		if !option.IsValid() || option.IsNil() {
+			continue
+		}
+		values[strings.ToLower(value.Type().Field(i).Name)] = option.Elem().Interface()
+	}
+	return values
+}
+
+// EnableSampledPayloads sets send_request and send_response for the
+// protocols with a payload_sample_rate: the payloads are captured for
+// all the transactions, and removed from the ones not sampled.
+func (protocols *Protocols) EnableSampledPayloads() {
+	value := reflect.ValueOf(protocols).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		protocol := value.Field(i)
+		rate := protocol.FieldByName("Payload_sample_rate")
+		if !rate.IsValid() || rate.IsNil() {
+			continue
+		}
+		for _, name := range []string{"Send_request", "Send_response"} {
+			enabled := true
+			protocol.FieldByName(name).Set(reflect.ValueOf(&enabled))
+		}
+	}
 }
 
 // Config Singleton
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProtocolsIsEnabled(t *testing.T) {
+	disabled := false
+	protocols := Protocols{
+		Dns: Dns{Enabled: &disabled},
+	}
+
+	assert.False(t, protocols.IsEnabled("dns"))
+	assert.True(t, protocols.IsEnabled("http"))
+	assert.True(t, protocols.IsEnabled("unknown"))
+}
+
+func TestProtocolsOption(t *testing.T) {
+	short := "short"
+	protocols := Protocols{
+		Redis: Redis{Retention: &short},
+		Icmp:  Icmp{Retention: &short},
+	}
+
+	assert.Equal(t, map[string]interface{}{"redis": "short", "icmp": "short"},
+		protocols.Option("Retention"))
+	assert.Equal(t, map[string]interface{}{}, new(Protocols).Option("Retention"))
+}
+
+func TestProtocolsSampledPayloads(t *testing.T) {
+	rate := 0.01
+	disabled := false
+	protocols := Protocols{
+		Http:  Http{Payload_sample_rate: &rate, Send_request: &disabled},
+		Mysql: Mysql{Send_request: &disabled},
+	}
+
+	assert.Equal(t, map[string]interface{}{"http": 0.01}, protocols.Option("Payload_sample_rate"))
+
+	protocols.EnableSampledPayloads()
+	assert.True(t, *protocols.Http.Send_request)
+	assert.True(t, *protocols.Http.Send_response)
+	assert.False(t, *protocols.Mysql.Send_request)
+	assert.Nil(t, protocols.Mysql.Send_response)
+}
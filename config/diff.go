@@ -0,0 +1,81 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// The sections applied when the configuration is reloaded: the protocol
+// plugins are initialized again and the filters are loaded again. The
+// changes to the other sections need a restart.
+var reloadableSections = map[string]bool{
+	"protocols": true,
+	"filter":    true,
+}
+
+// Changes lists the sections of the configuration that differ between two
+// configurations, named like in the configuration file. The protocols
+// are listed one by one, for example protocols.http.
+type Changes struct {
+	Reloadable []string
+	Restart    []string
+}
+
+func (changes *Changes) Empty() bool {
+	return len(changes.Reloadable) == 0 && len(changes.Restart) == 0
+}
+
+// Contains returns true if the section, or one of its subsections, changed.
+func (changes *Changes) Contains(section string) bool {
+	for _, changed := range changes.Reloadable {
+		if changed == section || strings.HasPrefix(changed, section+".") {
+			return true
+		}
+	}
+	for _, changed := range changes.Restart {
+		if changed == section || strings.HasPrefix(changed, section+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff compares the sections of the running configuration with the ones
+// of a newly read configuration.
+func Diff(running *Config, loaded *Config) Changes {
+	var changes Changes
+
+	runningValue := reflect.ValueOf(running).Elem()
+	loadedValue := reflect.ValueOf(loaded).Elem()
+	for i := 0; i < runningValue.NumField(); i++ {
+		section := strings.ToLower(runningValue.Type().Field(i).Name)
+		before := runningValue.Field(i)
+		after := loadedValue.Field(i)
+		if reflect.DeepEqual(before.Interface(), after.Interface()) {
+			continue
+		}
+
+		names := []string{section}
+		if section == "protocols" {
+			names = changedFields(section, before, after)
+		}
+		if reloadableSections[section] {
+			changes.Reloadable = append(changes.Reloadable, names...)
+		} else {
+			changes.Restart = append(changes.Restart, names...)
+		}
+	}
+
+	return changes
+}
+
+func changedFields(section string, before, after reflect.Value) []string {
+	names := []string{}
+	for i := 0; i < before.NumField(); i++ {
+		if !reflect.DeepEqual(before.Field(i).Interface(), after.Field(i).Interface()) {
+			name := strings.ToLower(before.Type().Field(i).Name)
+			names = append(names, section+"."+name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func loadConfig(t *testing.T, content string) *Config {
+	var config Config
+	if err := yaml.Unmarshal([]byte(content), &config); err != nil {
+		t.Fatalf("YAML config parsing failed: %s", err)
+	}
+	return &config
+}
+
+const runningConfig = `
+interfaces:
+  device: any
+protocols:
+  http:
+    ports: [80, 8080]
+    send_request: true
+  mysql:
+    ports: [3306]
+output:
+  elasticsearch:
+    enabled: true
+    host: localhost
+filter:
+  filters: ["sample"]
+`
+
+func TestDiff_noChange(t *testing.T) {
+	changes := Diff(loadConfig(t, runningConfig), loadConfig(t, runningConfig))
+
+	assert.True(t, changes.Empty())
+}
+
+func TestDiff_reloadable(t *testing.T) {
+	changes := Diff(loadConfig(t, runningConfig), loadConfig(t, `
+interfaces:
+  device: any
+protocols:
+  http:
+    ports: [80, 8080]
+    send_request: false
+  mysql:
+    ports: [3306, 3307]
+output:
+  elasticsearch:
+    enabled: true
+    host: localhost
+filter:
+  filters: ["sample", "fields"]
+`))
+
+	assert.Equal(t, []string{"protocols.http", "protocols.mysql", "filter"},
+		changes.Reloadable)
+	assert.Empty(t, changes.Restart)
+	assert.True(t, changes.Contains("protocols"))
+	assert.True(t, changes.Contains("protocols.mysql"))
+	assert.False(t, changes.Contains("protocols.pgsql"))
+}
+
+func TestDiff_restartRequired(t *testing.T) {
+	changes := Diff(loadConfig(t, runningConfig), loadConfig(t, `
+interfaces:
+  device: eth0
+protocols:
+  http:
+    ports: [80, 8080]
+    send_request: true
+  mysql:
+    ports: [3306]
+output:
+  elasticsearch:
+    enabled: true
+    host: es1
+filter:
+  filters: ["sample"]
+procs:
+  enabled: true
+`))
+
+	assert.Empty(t, changes.Reloadable)
+	assert.Equal(t, []string{"interfaces", "output", "procs"}, changes.Restart)
+	assert.False(t, changes.Contains("protocols"))
+}
@@ -0,0 +1,283 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ExpandEnv replaces the ${VAR} and ${VAR:-default} references in the
+// content of the configuration file by the values of the environment
+// variables, before the YAML is parsed. The default is used if the
+// variable is missing or empty, like in the shell. A missing variable
+// without default is replaced by an empty string. $$ is a literal $.
+//
+// The values are escaped for the scalar they are written in, so that a
+// password containing "#" or ": " is not cut or taken for a mapping. The
+// comments are left as they are.
+func ExpandEnv(content []byte) []byte {
+	return expandEnv(content, lookupEnv)
+}
+
+// lookupEnv is os.LookupEnv, which is not available before Go 1.5.
+func lookupEnv(name string) (string, bool) {
+	prefix := name + "="
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, prefix) {
+			return variable[len(prefix):], true
+		}
+	}
+	return "", false
+}
+
+// envScanner walks the YAML content just enough to know the kind of
+// scalar each reference is written in.
+type envScanner struct {
+	content []byte
+	lookup  func(string) (string, bool)
+	buf     bytes.Buffer
+	pos     int
+
+	// depth of the [] and {} flow collections
+	flow int
+
+	// indentation of the line introducing a | or > block scalar, -1
+	// out of the block scalars
+	blockIndent int
+}
+
+func expandEnv(content []byte, lookup func(string) (string, bool)) []byte {
+	scanner := &envScanner{content: content, lookup: lookup, blockIndent: -1}
+	for scanner.pos < len(content) {
+		scanner.line()
+	}
+	return scanner.buf.Bytes()
+}
+
+// line copies the line starting at the current position, with the
+// references expanded.
+func (s *envScanner) line() {
+	end := s.pos
+	for end < len(s.content) && s.content[end] != '\n' {
+		end++
+	}
+	indent := 0
+	for s.pos+indent < end && s.content[s.pos+indent] == ' ' {
+		indent++
+	}
+
+	if s.blockIndent >= 0 {
+		if s.pos+indent == end || indent > s.blockIndent {
+			// the content of a block scalar is taken literally
+			value, _ := s.expand(s.content[s.pos:end], noEscape)
+			s.buf.WriteString(value)
+			s.newline(end)
+			return
+		}
+		s.blockIndent = -1
+	}
+
+	tokenStart := true
+	for s.pos < len(s.content) && s.content[s.pos] != '\n' {
+		c := s.content[s.pos]
+		switch {
+		case c == ' ' || c == '\t':
+			s.copyByte()
+			tokenStart = true
+			continue
+		case !tokenStart:
+			s.copyByte()
+		case c == '#':
+			s.buf.Write(s.content[s.pos:end])
+			s.pos = end
+		case c == '-' && s.pos+1 < len(s.content) && isBlank(s.content[s.pos+1]):
+			s.copyByte()
+		case c == '[' || c == '{':
+			s.flow++
+			s.copyByte()
+		case c == ']' || c == '}':
+			if s.flow > 0 {
+				s.flow--
+			}
+			s.copyByte()
+		case c == ',' || c == ':':
+			s.copyByte()
+		case c == '|' || c == '>':
+			s.buf.Write(s.content[s.pos:end])
+			s.pos = end
+			s.blockIndent = indent
+		case c == '"':
+			s.doubleQuoted()
+		case c == '\'':
+			s.singleQuoted()
+		default:
+			s.plain()
+		}
+		tokenStart = s.pos < len(s.content) && isIndicator(s.content[s.pos-1])
+	}
+	s.newline(s.pos)
+}
+
+func (s *envScanner) newline(end int) {
+	s.pos = end
+	if s.pos < len(s.content) {
+		s.copyByte()
+	}
+}
+
+func (s *envScanner) copyByte() {
+	s.buf.WriteByte(s.content[s.pos])
+	s.pos++
+}
+
+// doubleQuoted copies a double quoted scalar, which can span lines. The
+// values are escaped like in a Go string.
+func (s *envScanner) doubleQuoted() {
+	end := s.pos + 1
+	for end < len(s.content) && s.content[end] != '"' {
+		if s.content[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end < len(s.content) {
+		end++
+	}
+	value, _ := s.expand(s.content[s.pos:end], func(value string) string {
+		quoted := strconv.Quote(value)
+		return quoted[1 : len(quoted)-1]
+	})
+	s.buf.WriteString(value)
+	s.pos = end
+}
+
+// singleQuoted copies a single quoted scalar, in which a quote is doubled.
+func (s *envScanner) singleQuoted() {
+	end := s.pos + 1
+	for end < len(s.content) {
+		if s.content[end] == '\'' {
+			if end+1 < len(s.content) && s.content[end+1] == '\'' {
+				end += 2
+				continue
+			}
+			end++
+			break
+		}
+		end++
+	}
+	value, _ := s.expand(s.content[s.pos:end], func(value string) string {
+		return strings.Replace(value, "'", "''", -1)
+	})
+	s.buf.WriteString(value)
+	s.pos = end
+}
+
+// plain copies a plain scalar, which ends at the end of the line, at a
+// comment, at the ": " of a key or at the separators of a flow
+// collection. The scalar is quoted if an expanded value would change
+// its meaning.
+func (s *envScanner) plain() {
+	end := s.pos
+	for end < len(s.content) {
+		c := s.content[end]
+		if c == '$' && end+1 < len(s.content) && s.content[end+1] == '{' {
+			// the default of a reference can hold separators
+			if ref := bytes.IndexByte(s.content[end:], '}'); ref > 0 {
+				end += ref + 1
+				continue
+			}
+		}
+		if c == '\n' ||
+			c == ':' && (end+1 == len(s.content) || isBlank(s.content[end+1])) ||
+			c == '#' && isBlank(s.content[end-1]) ||
+			s.flow > 0 && (c == ',' || c == ']' || c == '}') {
+			break
+		}
+		end++
+	}
+	for end > s.pos && isBlank(s.content[end-1]) {
+		end--
+	}
+
+	value, expanded := s.expand(s.content[s.pos:end], noEscape)
+	if expanded && s.needsQuotes(value) {
+		value = strconv.Quote(value)
+	}
+	s.buf.WriteString(value)
+	s.pos = end
+}
+
+// needsQuotes returns true if the value can't be written as a plain
+// scalar.
+func (s *envScanner) needsQuotes(value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+	if strings.ContainsAny(value, "\n\r\t") ||
+		strings.Contains(value, ": ") || strings.Contains(value, " #") ||
+		strings.HasSuffix(value, ":") ||
+		strings.ContainsRune("-?:,[]{}#&*!|>'\"%@`", rune(value[0])) ||
+		isBlank(value[0]) || isBlank(value[len(value)-1]) {
+		return true
+	}
+	return s.flow > 0 && strings.ContainsAny(value, ",[]{}:")
+}
+
+func noEscape(value string) string {
+	return value
+}
+
+// expand replaces the references of text by their values, escaped. It
+// returns true if text has references.
+func (s *envScanner) expand(text []byte, escape func(string) string) (string, bool) {
+	var buf bytes.Buffer
+	expanded := false
+
+	for i := 0; i < len(text); i++ {
+		if text[i] != '$' || i+1 == len(text) {
+			buf.WriteByte(text[i])
+			continue
+		}
+
+		switch text[i+1] {
+		case '$':
+			buf.WriteByte('$')
+			i++
+
+		case '{':
+			end := bytes.IndexByte(text[i+2:], '}')
+			if end < 0 {
+				// not a reference, left as is
+				buf.WriteByte(text[i])
+				continue
+			}
+			reference := string(text[i+2 : i+2+end])
+			name, def := reference, ""
+			if sep := strings.Index(reference, ":-"); sep >= 0 {
+				name, def = reference[:sep], reference[sep+2:]
+			}
+			value, exists := s.lookup(name)
+			if !exists || value == "" {
+				value = def
+			}
+			buf.WriteString(escape(value))
+			expanded = true
+			i += 2 + end
+
+		default:
+			buf.WriteByte(text[i])
+		}
+	}
+
+	return buf.String(), expanded
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// isIndicator returns true if a new token can start after c.
+func isIndicator(c byte) bool {
+	return isBlank(c) || c == '[' || c == '{' || c == ','
+}
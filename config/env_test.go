@@ -0,0 +1,92 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func testLookup(name string) (string, bool) {
+	env := map[string]string{
+		"ES_PASSWORD": "s3cr3t",
+		"EMPTY":       "",
+	}
+	value, exists := env[name]
+	return value, exists
+}
+
+func TestExpandEnv_presentVar(t *testing.T) {
+	content := "password: ${ES_PASSWORD}\nuser: ${ES_PASSWORD:-admin}"
+
+	assert.Equal(t, "password: s3cr3t\nuser: s3cr3t",
+		string(expandEnv([]byte(content), testLookup)))
+}
+
+func TestExpandEnv_missingVar(t *testing.T) {
+	content := "host: ${ES_HOST:-localhost}\nport: ${ES_PORT}\nname: ${EMPTY:-shipper}"
+
+	assert.Equal(t, "host: localhost\nport: \nname: shipper",
+		string(expandEnv([]byte(content), testLookup)))
+}
+
+func TestExpandEnv_escape(t *testing.T) {
+	content := "password: pa$$word\nliteral: $${ES_PASSWORD}\nprice: 5$ ${unterminated"
+
+	assert.Equal(t, "password: pa$word\nliteral: ${ES_PASSWORD}\nprice: 5$ ${unterminated",
+		string(expandEnv([]byte(content), testLookup)))
+}
+
+func TestExpandEnv_specialCharacters(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		return map[string]string{
+			"PASSWORD": "p#ss: w0rd",
+			"QUOTES":   `it's "quoted" \ `,
+			"HOST":     "es.local",
+		}[name], true
+	}
+	content := `output:
+  elasticsearch:
+    # the password is ${PASSWORD}
+    password: ${PASSWORD} # secret
+    username: "${QUOTES}"
+    path: '${QUOTES}'
+    hosts: ["${HOST}:9200", "${PASSWORD}", ${PASSWORD}, ${HOST}]
+    template: |
+      ${PASSWORD}
+`
+	var config struct {
+		Output map[string]struct {
+			Password string
+			Username string
+			Path     string
+			Hosts    []string
+			Template string
+		}
+	}
+	err := yaml.Unmarshal(expandEnv([]byte(content), lookup), &config)
+	assert.Nil(t, err)
+
+	es := config.Output["elasticsearch"]
+	assert.Equal(t, "p#ss: w0rd", es.Password)
+	assert.Equal(t, `it's "quoted" \ `, es.Username)
+	assert.Equal(t, `it's "quoted" \ `, es.Path)
+	assert.Equal(t, []string{"es.local:9200", "p#ss: w0rd", "p#ss: w0rd", "es.local"}, es.Hosts)
+	assert.Equal(t, "p#ss: w0rd\n", es.Template)
+
+	// the comments are not expanded
+	assert.Contains(t, string(expandEnv([]byte(content), lookup)), "# the password is ${PASSWORD}")
+}
+
+func TestLookupEnv(t *testing.T) {
+	os.Setenv("PACKETBEAT_TEST_ENV", "value")
+	defer os.Unsetenv("PACKETBEAT_TEST_ENV")
+
+	value, exists := lookupEnv("PACKETBEAT_TEST_ENV")
+	assert.True(t, exists)
+	assert.Equal(t, "value", value)
+
+	_, exists = lookupEnv("PACKETBEAT_TEST")
+	assert.False(t, exists)
+}
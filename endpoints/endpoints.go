@@ -0,0 +1,94 @@
+// Package endpoints publishes the fields added to the source and to the
+// destination of the events, like their location, in the src and dst
+// objects. The publisher replaces the src and dst endpoints by the
+// client_ip, client_port, client_proc, client_server, ip, port, proc and
+// server fields and removes them, so the endpoints having fields are
+// replaced here the same way before the events reach it.
+package endpoints
+
+import (
+	"strings"
+
+	"github.com/johann8384/libbeat/common"
+)
+
+// The endpoints of the events.
+const (
+	Source      = "src"
+	Destination = "dst"
+)
+
+// The fields of the endpoints are kept in the event under the dotted
+// "src.<name>" and "dst.<name>" keys until it is published, so that the
+// stages expecting src and dst to be a *common.Endpoint see no change.
+func key(endpoint string, name string) string {
+	return endpoint + "." + name
+}
+
+// Set adds the field name to the endpoint of the event, Source or
+// Destination.
+func Set(event common.MapStr, endpoint string, name string, value interface{}) {
+	event[key(endpoint, name)] = value
+}
+
+// Get returns the field name of the endpoint of the event.
+func Get(event common.MapStr, endpoint string, name string) (interface{}, bool) {
+	value, exists := event[key(endpoint, name)]
+	return value, exists
+}
+
+// the names the publisher gives to the endpoint fields
+var publishedNames = map[string][4]string{
+	Source:      {"client_ip", "client_port", "client_proc", "client_server"},
+	Destination: {"ip", "port", "proc", "server"},
+}
+
+type Endpoints struct {
+	// Name of the shipper, and whether the transactions between two
+	// shippers are only published by the one seeing the server, like
+	// the publisher.
+	Shipper        string
+	IgnoreOutgoing bool
+
+	// ServerName returns the shipper running on the address, see
+	// publisher.GetServerName.
+	ServerName func(ip string) string
+}
+
+// Publish replaces the endpoints having fields by the src and dst
+// objects holding the fields, and the fields the publisher adds for
+// them. It returns false if the event must be ignored, because it is
+// published by the shipper of the server.
+func (endpoints *Endpoints) Publish(event common.MapStr) bool {
+	publish := true
+	for _, endpoint := range []string{Source, Destination} {
+		prefix := endpoint + "."
+		fields := common.MapStr{}
+		for name, value := range event {
+			if strings.HasPrefix(name, prefix) {
+				fields[name[len(prefix):]] = value
+				delete(event, name)
+			}
+		}
+		if len(fields) == 0 {
+			// left to the publisher
+			continue
+		}
+
+		if addr, ok := event[endpoint].(*common.Endpoint); ok {
+			names := publishedNames[endpoint]
+			server := endpoints.ServerName(addr.Ip)
+			event[names[0]] = addr.Ip
+			event[names[1]] = addr.Port
+			event[names[2]] = addr.Proc
+			event[names[3]] = server
+
+			if endpoint == Destination && endpoints.IgnoreOutgoing &&
+				server != "" && server != endpoints.Shipper {
+				publish = false
+			}
+		}
+		event[endpoint] = fields
+	}
+	return publish
+}
@@ -0,0 +1,63 @@
+package endpoints
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func serverName(ip string) string {
+	if ip == "10.0.0.2" {
+		return "other-shipper"
+	}
+	return ""
+}
+
+func TestPublish(t *testing.T) {
+	endpoints := &Endpoints{Shipper: "shipper", ServerName: serverName}
+
+	event := common.MapStr{
+		"type": "http",
+		"src":  &common.Endpoint{Ip: "8.8.8.8", Port: 41234, Proc: "curl"},
+		"dst":  &common.Endpoint{Ip: "10.0.0.1", Port: 80},
+	}
+	Set(event, Source, "geo", common.MapStr{"country_code": "US"})
+	geo, exists := Get(event, Source, "geo")
+	assert.True(t, exists)
+	assert.Equal(t, common.MapStr{"country_code": "US"}, geo)
+
+	assert.True(t, endpoints.Publish(event))
+	assert.Equal(t, common.MapStr{
+		"type":          "http",
+		"client_ip":     "8.8.8.8",
+		"client_port":   uint16(41234),
+		"client_proc":   "curl",
+		"client_server": "",
+		"src":           common.MapStr{"geo": common.MapStr{"country_code": "US"}},
+		// left to the publisher
+		"dst": &common.Endpoint{Ip: "10.0.0.1", Port: 80},
+	}, event)
+}
+
+func TestPublish_ignoreOutgoing(t *testing.T) {
+	endpoints := &Endpoints{Shipper: "shipper", IgnoreOutgoing: true, ServerName: serverName}
+
+	event := common.MapStr{
+		"src": &common.Endpoint{Ip: "10.0.0.1"},
+		"dst": &common.Endpoint{Ip: "10.0.0.2", Port: 3306},
+	}
+	Set(event, Destination, "geo", common.MapStr{"country_code": "US"})
+	assert.False(t, endpoints.Publish(event))
+
+	event = common.MapStr{
+		"src": &common.Endpoint{Ip: "10.0.0.1"},
+		"dst": &common.Endpoint{Ip: "10.0.0.3", Port: 3306},
+	}
+	Set(event, Destination, "geo", common.MapStr{"country_code": "US"})
+	assert.True(t, endpoints.Publish(event))
+	assert.Equal(t, "10.0.0.3", event["ip"])
+	assert.Equal(t, uint16(3306), event["port"])
+	assert.Equal(t, common.MapStr{"geo": common.MapStr{"country_code": "US"}}, event["dst"])
+}
@@ -0,0 +1,190 @@
+// Package drop implements a Packetbeat filter that drops the events
+// matching any of a list of conditions, for example the health checks of
+// a load balancer. Nested fields are referenced by their dotted path, like
+// http.code or src.ip.
+package drop
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/filters"
+
+	pbfilters "github.com/johann8384/packetbeat/filters"
+)
+
+type Drop struct {
+	name       string
+	conditions []condition
+}
+
+// A condition compares the value of a field with the operator of the
+// configuration, for example:
+//
+//   - field: path
+//     equals: /health
+type condition struct {
+	path     []string
+	operator string
+	str      string
+	number   float64
+	regexp   *regexp.Regexp
+}
+
+var operators = []string{"equals", "contains", "regexp", "greater_than", "less_than"}
+
+func (drop *Drop) New(name string, config map[string]interface{}) (filters.FilterPlugin, error) {
+	plugin := &Drop{name: name}
+
+	value, exists := config["conditions"]
+	if !exists {
+		return nil, fmt.Errorf("The conditions option is required for %s", name)
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected the conditions of %s to be an array", name)
+	}
+
+	for _, item := range list {
+		cond, err := newCondition(toStringMap(item))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid condition for %s: %v", name, err)
+		}
+		plugin.conditions = append(plugin.conditions, cond)
+	}
+
+	return plugin, nil
+}
+
+// toStringMap converts the maps read from the YAML configuration.
+func toStringMap(value interface{}) map[string]interface{} {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m
+	case map[interface{}]interface{}:
+		res := map[string]interface{}{}
+		for key, value := range m {
+			if str, ok := key.(string); ok {
+				res[str] = value
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+func newCondition(config map[string]interface{}) (condition, error) {
+	var cond condition
+
+	field, ok := config["field"].(string)
+	if !ok || len(field) == 0 {
+		return cond, fmt.Errorf("Expected a field name, got %v", config["field"])
+	}
+	cond.path = strings.Split(field, ".")
+
+	for _, operator := range operators {
+		value, exists := config[operator]
+		if !exists {
+			continue
+		}
+		if len(cond.operator) > 0 {
+			return cond, fmt.Errorf("More than one operator for %s", field)
+		}
+		cond.operator = operator
+
+		var err error
+		switch operator {
+		case "equals", "contains":
+			cond.str = fmt.Sprint(value)
+		case "regexp":
+			cond.regexp, err = regexp.Compile(fmt.Sprint(value))
+		case "greater_than", "less_than":
+			var ok bool
+			cond.number, ok = toNumber(value)
+			if !ok {
+				err = fmt.Errorf("Expected a number for %s, got %v", operator, value)
+			}
+		}
+		if err != nil {
+			return cond, err
+		}
+	}
+
+	if len(cond.operator) == 0 {
+		return cond, fmt.Errorf("No operator for %s, expected one of %v", field, operators)
+	}
+	return cond, nil
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func (cond *condition) match(event common.MapStr) bool {
+	value, exists := pbfilters.Lookup(event, cond.path)
+	if !exists {
+		return false
+	}
+
+	switch cond.operator {
+	case "equals":
+		return fmt.Sprint(value) == cond.str
+	case "contains":
+		return strings.Contains(fmt.Sprint(value), cond.str)
+	case "regexp":
+		return cond.regexp.MatchString(fmt.Sprint(value))
+	case "greater_than":
+		number, ok := toNumber(value)
+		return ok && number > cond.number
+	case "less_than":
+		number, ok := toNumber(value)
+		return ok && number < cond.number
+	}
+	return false
+}
+
+// Filter returns nil for the events matching one of the conditions.
+func (drop *Drop) Filter(event common.MapStr) (common.MapStr, error) {
+	for i := range drop.conditions {
+		if drop.conditions[i].match(event) {
+			return nil, nil
+		}
+	}
+	return event, nil
+}
+
+func (drop *Drop) String() string {
+	return drop.name
+}
+
+func (drop *Drop) Type() filters.Filter {
+	return pbfilters.DropFilter
+}
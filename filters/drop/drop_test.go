@@ -0,0 +1,116 @@
+package drop
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/filters"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEvent(path string, responsetime int32) common.MapStr {
+	return common.MapStr{
+		"timestamp":    "2015-05-20T12:00:00.000Z",
+		"type":         "http",
+		"path":         path,
+		"responsetime": responsetime,
+		"http": common.MapStr{
+			"code":   uint16(200),
+			"phrase": "OK",
+		},
+		"src": &common.Endpoint{Ip: "10.0.0.5", Port: 41234},
+	}
+}
+
+func newFilter(t *testing.T, conditions ...map[interface{}]interface{}) filters.FilterPlugin {
+	list := []interface{}{}
+	for _, cond := range conditions {
+		list = append(list, cond)
+	}
+	plugin, err := new(Drop).New("test", map[string]interface{}{"conditions": list})
+	assert.Nil(t, err)
+	return plugin
+}
+
+func dropped(t *testing.T, plugin filters.FilterPlugin, event common.MapStr) bool {
+	res, err := plugin.Filter(event)
+	assert.Nil(t, err)
+	return res == nil
+}
+
+func TestDropEquals(t *testing.T) {
+	plugin := newFilter(t,
+		map[interface{}]interface{}{"field": "path", "equals": "/health"},
+		map[interface{}]interface{}{"field": "src.ip", "equals": "10.0.0.9"},
+		map[interface{}]interface{}{"field": "http.code", "equals": 404})
+
+	assert.True(t, dropped(t, plugin, newEvent("/health", 1)))
+	assert.False(t, dropped(t, plugin, newEvent("/health/db", 1)))
+
+	event := newEvent("/", 1)
+	event["src"].(*common.Endpoint).Ip = "10.0.0.9"
+	assert.True(t, dropped(t, plugin, event))
+
+	// the numbers are compared whatever their type
+	event = newEvent("/", 1)
+	event["http"].(common.MapStr)["code"] = uint16(404)
+	assert.True(t, dropped(t, plugin, event))
+
+	// missing fields never match
+	event = newEvent("/", 1)
+	delete(event, "http")
+	assert.False(t, dropped(t, plugin, event))
+}
+
+func TestDropRegexp(t *testing.T) {
+	plugin := newFilter(t,
+		map[interface{}]interface{}{"field": "path", "regexp": "^/(health|ping)$"},
+		map[interface{}]interface{}{"field": "http.phrase", "contains": "Teapot"})
+
+	assert.True(t, dropped(t, plugin, newEvent("/ping", 1)))
+	assert.True(t, dropped(t, plugin, newEvent("/health", 1)))
+	assert.False(t, dropped(t, plugin, newEvent("/pingpong", 1)))
+
+	event := newEvent("/", 1)
+	event["http"].(common.MapStr)["phrase"] = "I'm a Teapot"
+	assert.True(t, dropped(t, plugin, event))
+}
+
+func TestDropResponsetime(t *testing.T) {
+	plugin := newFilter(t,
+		map[interface{}]interface{}{"field": "responsetime", "greater_than": 1000})
+
+	event := newEvent("/", 1500)
+	assert.True(t, dropped(t, plugin, event))
+
+	event = newEvent("/", 1000)
+	res, err := plugin.Filter(event)
+	assert.Nil(t, err)
+	assert.Equal(t, event, res)
+
+	plugin = newFilter(t,
+		map[interface{}]interface{}{"field": "responsetime", "less_than": 0.5})
+	assert.True(t, dropped(t, plugin, newEvent("/", 0)))
+	assert.False(t, dropped(t, plugin, newEvent("/", 1)))
+}
+
+func TestDropInvalidConfig(t *testing.T) {
+	tests := []map[string]interface{}{
+		{},
+		{"conditions": "path"},
+		{"conditions": []interface{}{map[interface{}]interface{}{"equals": "/"}}},
+		{"conditions": []interface{}{map[interface{}]interface{}{"field": "path"}}},
+		{"conditions": []interface{}{map[interface{}]interface{}{
+			"field": "path", "equals": "/", "contains": "/"}}},
+		{"conditions": []interface{}{map[interface{}]interface{}{
+			"field": "path", "regexp": "("}}},
+		{"conditions": []interface{}{map[interface{}]interface{}{
+			"field": "responsetime", "greater_than": "slow"}}},
+	}
+
+	for _, config := range tests {
+		_, err := new(Drop).New("test", config)
+		assert.NotNil(t, err, "%v", config)
+	}
+}
@@ -0,0 +1,127 @@
+// Package fields implements a Packetbeat filter that removes fields from
+// the events, or keeps only a given list of them. Nested fields are
+// referenced by their dotted path, like mysql.error_message.
+package fields
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/filters"
+
+	pbfilters "github.com/johann8384/packetbeat/filters"
+)
+
+// The fields without which the publisher refuses an event.
+var mandatoryFields = []string{"timestamp", "type"}
+
+type Fields struct {
+	name    string
+	drop    [][]string
+	include [][]string
+}
+
+func (fields *Fields) New(name string, config map[string]interface{}) (filters.FilterPlugin, error) {
+	plugin := &Fields{name: name}
+
+	var err error
+	plugin.drop, err = readPaths(config, "drop_fields")
+	if err != nil {
+		return nil, err
+	}
+	plugin.include, err = readPaths(config, "include_fields")
+	if err != nil {
+		return nil, err
+	}
+	if len(plugin.include) > 0 {
+		for _, field := range mandatoryFields {
+			plugin.include = append(plugin.include, []string{field})
+		}
+	}
+
+	return plugin, nil
+}
+
+func readPaths(config map[string]interface{}, option string) ([][]string, error) {
+	value, exists := config[option]
+	if !exists {
+		return nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected %s to be an array of strings", option)
+	}
+
+	paths := [][]string{}
+	for _, item := range list {
+		path, ok := item.(string)
+		if !ok || len(path) == 0 {
+			return nil, fmt.Errorf("Expected %s to only contain field names", option)
+		}
+		paths = append(paths, strings.Split(path, "."))
+	}
+	return paths, nil
+}
+
+// Filter first applies the include_fields whitelist, if any, and then
+// removes the drop_fields from the result.
+func (fields *Fields) Filter(event common.MapStr) (common.MapStr, error) {
+	if len(fields.include) > 0 {
+		included := common.MapStr{}
+		for _, path := range fields.include {
+			copyPath(included, event, path)
+		}
+		event = included
+	}
+
+	for _, path := range fields.drop {
+		pbfilters.Delete(event, path)
+	}
+
+	return event, nil
+}
+
+func (fields *Fields) String() string {
+	return fields.name
+}
+
+func (fields *Fields) Type() filters.Filter {
+	return pbfilters.FieldsFilter
+}
+
+func copyPath(dst common.MapStr, src map[string]interface{}, path []string) {
+	value, exists := src[path[0]]
+	if !exists {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = value
+		return
+	}
+	if _, ok := value.(*common.Endpoint); ok {
+		// the endpoint keeps only the included fields
+		field, exists := pbfilters.Lookup(src, path)
+		if !exists {
+			return
+		}
+		if _, ok := dst[path[0]].(*common.Endpoint); !ok {
+			dst[path[0]] = &common.Endpoint{}
+		}
+		pbfilters.Set(dst, path, field)
+		return
+	}
+
+	nested, ok := pbfilters.ToMap(value)
+	if !ok {
+		return
+	}
+	dstNested, ok := dst[path[0]].(common.MapStr)
+	if !ok {
+		dstNested = common.MapStr{}
+	}
+	copyPath(dstNested, nested, path[1:])
+	if len(dstNested) > 0 {
+		dst[path[0]] = dstNested
+	}
+}
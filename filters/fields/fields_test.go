@@ -0,0 +1,116 @@
+package fields
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/filters"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEvent() common.MapStr {
+	return common.MapStr{
+		"timestamp": "2015-05-20T12:00:00.000Z",
+		"type":      "mysql",
+		"request":   "SELECT * FROM users",
+		"response":  "ERROR",
+		"status":    "Error",
+		"mysql": common.MapStr{
+			"error_code":    1045,
+			"error_message": "Access denied for user 'root'",
+		},
+	}
+}
+
+func newFilter(t *testing.T, config map[string]interface{}) filters.FilterPlugin {
+	plugin, err := new(Fields).New("test", config)
+	assert.Nil(t, err)
+	return plugin
+}
+
+func TestFieldsDropTopLevel(t *testing.T) {
+	plugin := newFilter(t, map[string]interface{}{
+		"drop_fields": []interface{}{"request", "response", "missing"},
+	})
+
+	res, err := plugin.Filter(newEvent())
+	assert.Nil(t, err)
+
+	expected := newEvent()
+	delete(expected, "request")
+	delete(expected, "response")
+	assert.Equal(t, expected, res)
+}
+
+func TestFieldsDropNested(t *testing.T) {
+	plugin := newFilter(t, map[string]interface{}{
+		"drop_fields": []interface{}{"mysql.error_message", "status.missing"},
+	})
+
+	res, err := plugin.Filter(newEvent())
+	assert.Nil(t, err)
+
+	assert.Equal(t, common.MapStr{"error_code": 1045}, res["mysql"])
+	assert.Equal(t, "Error", res["status"])
+}
+
+func TestFieldsIncludeOnly(t *testing.T) {
+	plugin := newFilter(t, map[string]interface{}{
+		"include_fields": []interface{}{"status", "mysql.error_code", "missing.field"},
+	})
+
+	res, err := plugin.Filter(newEvent())
+	assert.Nil(t, err)
+
+	assert.Equal(t, common.MapStr{
+		"timestamp": "2015-05-20T12:00:00.000Z",
+		"type":      "mysql",
+		"status":    "Error",
+		"mysql": common.MapStr{
+			"error_code": 1045,
+		},
+	}, res)
+}
+
+func TestFieldsInvalidConfig(t *testing.T) {
+	tests := []map[string]interface{}{
+		{"drop_fields": "request"},
+		{"include_fields": []interface{}{1}},
+		{"drop_fields": []interface{}{""}},
+	}
+
+	for _, config := range tests {
+		_, err := new(Fields).New("test", config)
+		assert.NotNil(t, err, "config %v", config)
+	}
+}
+
+func TestFieldsEndpoints(t *testing.T) {
+	newEndpoints := func() common.MapStr {
+		event := newEvent()
+		event["src"] = &common.Endpoint{Ip: "10.0.0.2", Port: 34567, Proc: "mysql"}
+		event["dst"] = &common.Endpoint{Ip: "10.0.0.1", Port: 3306, Proc: "mysqld"}
+		return event
+	}
+
+	plugin := newFilter(t, map[string]interface{}{
+		"drop_fields": []interface{}{"src.ip", "dst.proc"},
+	})
+	res, err := plugin.Filter(newEndpoints())
+	assert.Nil(t, err)
+	assert.Equal(t, &common.Endpoint{Port: 34567, Proc: "mysql"}, res["src"])
+	assert.Equal(t, &common.Endpoint{Ip: "10.0.0.1", Port: 3306}, res["dst"])
+
+	plugin = newFilter(t, map[string]interface{}{
+		"include_fields": []interface{}{"src.ip", "dst.ip", "dst.port"},
+	})
+	res, err = plugin.Filter(newEndpoints())
+	assert.Nil(t, err)
+	assert.Equal(t, common.MapStr{
+		"timestamp": "2015-05-20T12:00:00.000Z",
+		"type":      "mysql",
+		"src":       &common.Endpoint{Ip: "10.0.0.2"},
+		"dst":       &common.Endpoint{Ip: "10.0.0.1", Port: 3306},
+	}, res)
+}
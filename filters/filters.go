@@ -0,0 +1,22 @@
+// Package filters declares the types of the filter plugins implemented in
+// Packetbeat, in addition to the ones already known by libbeat.
+package filters
+
+import (
+	"github.com/johann8384/libbeat/filters"
+)
+
+var (
+	FieldsFilter = newFilterType("fields")
+	GeoipFilter  = newFilterType("geoip")
+	DropFilter   = newFilterType("drop")
+	MutateFilter = newFilterType("mutate")
+	HashFilter   = newFilterType("hash")
+)
+
+// newFilterType appends the name to the libbeat list of filter names, so
+// that the new type can be referenced from the configuration file.
+func newFilterType(name string) filters.Filter {
+	filters.FilterPluginNames = append(filters.FilterPluginNames, name)
+	return filters.Filter(len(filters.FilterPluginNames) - 1)
+}
@@ -0,0 +1,21 @@
+package filters
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/filters"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterTypesByName(t *testing.T) {
+	filter, err := filters.FilterFromName("fields")
+	assert.Nil(t, err)
+	assert.Equal(t, FieldsFilter, filter)
+	assert.Equal(t, "fields", FieldsFilter.String())
+
+	// the libbeat types are left untouched
+	filter, err = filters.FilterFromName("sample")
+	assert.Nil(t, err)
+	assert.Equal(t, filters.SampleFilter, filter)
+}
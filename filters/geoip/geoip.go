@@ -0,0 +1,140 @@
+// Package geoip implements a Packetbeat filter that adds the location of
+// the source and of the destination to the events, as found in a MaxMind
+// GeoLite2 (or GeoIP2) City or Country database.
+package geoip
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/filters"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/endpoints"
+	pbfilters "github.com/johann8384/packetbeat/filters"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type Geoip struct {
+	name string
+	db   *maxminddb.Reader
+}
+
+// The fields read from the records of the City and Country databases.
+// The Country databases have no city and no location.
+type geoipRecord struct {
+	Country struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// The address ranges that are never found in the GeoIP databases.
+var unroutableNets = []net.IPNet{
+	parseCIDR("0.0.0.0/8"),
+	parseCIDR("10.0.0.0/8"),
+	parseCIDR("100.64.0.0/10"),
+	parseCIDR("127.0.0.0/8"),
+	parseCIDR("169.254.0.0/16"),
+	parseCIDR("172.16.0.0/12"),
+	parseCIDR("192.168.0.0/16"),
+	parseCIDR("224.0.0.0/4"),
+	parseCIDR("240.0.0.0/4"),
+	parseCIDR("::/127"),
+	parseCIDR("fc00::/7"),
+	parseCIDR("fe80::/10"),
+	parseCIDR("ff00::/8"),
+}
+
+func parseCIDR(cidr string) net.IPNet {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return *ipnet
+}
+
+func (geoip *Geoip) New(name string, config map[string]interface{}) (filters.FilterPlugin, error) {
+	path, ok := config["database"].(string)
+	if !ok || len(path) == 0 {
+		return nil, fmt.Errorf("The database option is required for %s", name)
+	}
+
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load GeoIP database %s: %v", path, err)
+	}
+	logp.Info("Loaded GeoIP data for %s from: %s (%s)", name, path, db.Metadata.DatabaseType)
+
+	return &Geoip{name: name, db: db}, nil
+}
+
+// Filter adds the src.geo and dst.geo fields for the source and the
+// destination of the transaction. Addresses that are private or not found
+// in the database are skipped.
+func (geoip *Geoip) Filter(event common.MapStr) (common.MapStr, error) {
+	for _, endpoint := range []string{endpoints.Source, endpoints.Destination} {
+		addr, ok := event[endpoint].(*common.Endpoint)
+		if !ok {
+			continue
+		}
+		if geo := geoip.lookup(addr.Ip); geo != nil {
+			endpoints.Set(event, endpoint, "geo", geo)
+		}
+	}
+	return event, nil
+}
+
+func (geoip *Geoip) lookup(addr string) common.MapStr {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	for _, ipnet := range unroutableNets {
+		if ipnet.Contains(ip) {
+			return nil
+		}
+	}
+
+	var record geoipRecord
+	if err := geoip.db.Lookup(ip, &record); err != nil {
+		logp.Debug("geoip", "Failed to look up %s: %v", addr, err)
+		return nil
+	}
+
+	geo := common.MapStr{}
+	if len(record.Country.IsoCode) > 0 {
+		geo["country_code"] = record.Country.IsoCode
+	}
+	if name := record.Country.Names["en"]; len(name) > 0 {
+		geo["country_name"] = name
+	}
+	if name := record.City.Names["en"]; len(name) > 0 {
+		geo["city"] = name
+	}
+	if record.Location.Latitude != nil && record.Location.Longitude != nil {
+		geo["location"] = fmt.Sprintf("%f, %f", *record.Location.Latitude,
+			*record.Location.Longitude)
+	}
+	if len(geo) == 0 {
+		return nil
+	}
+	return geo
+}
+
+func (geoip *Geoip) String() string {
+	return geoip.name
+}
+
+func (geoip *Geoip) Type() filters.Filter {
+	return pbfilters.GeoipFilter
+}
@@ -0,0 +1,252 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/filters"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The metadata of a MaxMind DB file follow this marker, at its end.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Types of the values of the data section.
+const (
+	mmdbString = 2
+	mmdbDouble = 3
+	mmdbUint16 = 5
+	mmdbUint32 = 6
+	mmdbMap    = 7
+)
+
+// mmdbValue encodes a value of the data section: the strings, the
+// doubles, the uint32 and the maps of them used by the databases.
+func mmdbValue(value interface{}) []byte {
+	control := func(typ byte, size int) []byte {
+		if size >= 29 {
+			panic("value too large for the test database")
+		}
+		if typ > 7 {
+			return []byte{byte(size), typ - 7}
+		}
+		return []byte{typ<<5 | byte(size)}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return append(control(mmdbString, len(v)), v...)
+	case float64:
+		buf := control(mmdbDouble, 8)
+		bits := make([]byte, 8)
+		binary.BigEndian.PutUint64(bits, math.Float64bits(v))
+		return append(buf, bits...)
+	case uint32:
+		bits := make([]byte, 4)
+		binary.BigEndian.PutUint32(bits, v)
+		return append(control(mmdbUint32, 4), bits...)
+	case uint16:
+		return append(control(mmdbUint16, 2), byte(v>>8), byte(v))
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf := control(mmdbMap, len(v))
+		for _, key := range keys {
+			buf = append(buf, mmdbValue(key)...)
+			buf = append(buf, mmdbValue(v[key])...)
+		}
+		return buf
+	}
+	panic("unsupported value")
+}
+
+type mmdbNetwork struct {
+	cidr   string
+	record map[string]interface{}
+}
+
+// mmdbDatabase builds an IPv6 MaxMind DB file with 24 bits records,
+// the IPv4 networks being under ::/96.
+func mmdbDatabase(t *testing.T, networks []mmdbNetwork) string {
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	data := []byte{}
+	leaves := map[[2]int]int{}
+
+	for _, network := range networks {
+		_, ipnet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			t.Fatalf("Invalid network %s: %v", network.cidr, err)
+		}
+		ones, bits := ipnet.Mask.Size()
+		ip := ipnet.IP.To16()
+		if bits == 32 {
+			ip = append(make(net.IP, 12), ipnet.IP.To4()...)
+			ones += 96
+		}
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>uint(7-i%8)) & 1
+			if i == ones-1 {
+				leaves[[2]int{node, bit}] = len(data)
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		data = append(data, mmdbValue(network.record)...)
+	}
+
+	content := []byte{}
+	for i, node := range nodes {
+		for bit, child := range node {
+			record := len(nodes)
+			if offset, isLeaf := leaves[[2]int{i, bit}]; isLeaf {
+				record = len(nodes) + 16 + offset
+			} else if child != empty {
+				record = child
+			}
+			content = append(content, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+	content = append(content, make([]byte, 16)...)
+	content = append(content, data...)
+	content = append(content, mmdbMetadataMarker...)
+	content = append(content, mmdbValue(map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"database_type":               "GeoLite2-City",
+		"ip_version":                  uint16(6),
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+	})...)
+
+	f, err := ioutil.TempFile("", "geoip")
+	if err != nil {
+		t.Fatalf("Failed to create the database: %v", err)
+	}
+	defer f.Close()
+	f.Write(content)
+	return f.Name()
+}
+
+func cityRecord(countryCode, country, city string, lat, lon float64) map[string]interface{} {
+	return map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": countryCode,
+			"names":    map[string]interface{}{"en": country},
+		},
+		"city": map[string]interface{}{
+			"names": map[string]interface{}{"en": city},
+		},
+		"location": map[string]interface{}{
+			"latitude":  lat,
+			"longitude": lon,
+		},
+	}
+}
+
+func newFilter(t *testing.T) (filters.FilterPlugin, func()) {
+	path := mmdbDatabase(t, []mmdbNetwork{
+		{"8.8.8.0/24", cityRecord("US", "United States", "Mountain View", 37.386, -122.0838)},
+		{"2001:4860::/32", cityRecord("US", "United States", "Mountain View", 37.386, -122.0838)},
+		{"81.2.69.0/24", map[string]interface{}{
+			"country": map[string]interface{}{
+				"iso_code": "GB",
+				"names":    map[string]interface{}{"en": "United Kingdom"},
+			},
+		}},
+	})
+	plugin, err := new(Geoip).New("test", map[string]interface{}{"database": path})
+	if err != nil {
+		t.Fatalf("Failed to load the database: %v", err)
+	}
+	return plugin, func() { os.Remove(path) }
+}
+
+func TestGeoipPublicIp(t *testing.T) {
+	plugin, cleanup := newFilter(t)
+	defer cleanup()
+
+	event := common.MapStr{
+		"src": &common.Endpoint{Ip: "192.168.0.10", Port: 34567},
+		"dst": &common.Endpoint{Ip: "8.8.8.8", Port: 53},
+	}
+	res, err := plugin.Filter(event)
+	assert.Nil(t, err)
+
+	geo, ok := res["dst.geo"].(common.MapStr)
+	if !ok {
+		t.Fatalf("Expected the dst.geo field, got %v", res)
+	}
+	assert.Equal(t, "US", geo["country_code"])
+	assert.Equal(t, "United States", geo["country_name"])
+	assert.Equal(t, "Mountain View", geo["city"])
+	assert.Equal(t, "37.386000, -122.083800", geo["location"])
+
+	// private addresses are not enriched
+	_, exists := res["src.geo"]
+	assert.False(t, exists)
+}
+
+func TestGeoipIpv6(t *testing.T) {
+	plugin, cleanup := newFilter(t)
+	defer cleanup()
+
+	res, err := plugin.Filter(common.MapStr{
+		"src": &common.Endpoint{Ip: "2001:4860:4860::8888"},
+		"dst": &common.Endpoint{Ip: "81.2.69.160"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "Mountain View", res["src.geo"].(common.MapStr)["city"])
+	assert.Equal(t, common.MapStr{"country_code": "GB", "country_name": "United Kingdom"},
+		res["dst.geo"])
+}
+
+func TestGeoipUnknownIp(t *testing.T) {
+	plugin, cleanup := newFilter(t)
+	defer cleanup()
+
+	res, err := plugin.Filter(common.MapStr{
+		"src": &common.Endpoint{Ip: "8.8.4.4"},
+		"dst": &common.Endpoint{Ip: "::1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+
+	res, err = plugin.Filter(common.MapStr{
+		"src": &common.Endpoint{Ip: "2a00:1450::1"},
+		"dst": &common.Endpoint{Ip: "fe80::1"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+}
+
+func TestGeoipInvalidDatabase(t *testing.T) {
+	_, err := new(Geoip).New("test", map[string]interface{}{})
+	assert.NotNil(t, err)
+
+	_, err = new(Geoip).New("test", map[string]interface{}{"database": "/nonexistent/GeoLite2-City.mmdb"})
+	assert.NotNil(t, err)
+
+	f, err := ioutil.TempFile("", "geoip")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.Write([]byte("not a database"))
+	f.Close()
+	_, err = new(Geoip).New("test", map[string]interface{}{"database": f.Name()})
+	assert.NotNil(t, err)
+}
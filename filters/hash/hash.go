@@ -0,0 +1,120 @@
+// Package hash implements a Packetbeat filter that replaces fields by the
+// hex digest of their value, so that sensitive values like session cookies
+// can still be correlated without being stored in clear text. Nested
+// fields are referenced by their dotted path, like http.request_headers.cookie.
+package hash
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	h "hash"
+	"strings"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/filters"
+	"github.com/johann8384/libbeat/logp"
+
+	pbfilters "github.com/johann8384/packetbeat/filters"
+)
+
+// DefaultAlgorithm of the digests.
+const DefaultAlgorithm = "sha256"
+
+var algorithms = map[string]func() h.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+}
+
+type Hash struct {
+	name   string
+	paths  [][]string
+	newFn  func() h.Hash
+	salt   []byte
+	salted bool
+}
+
+func (hash *Hash) New(name string, config map[string]interface{}) (filters.FilterPlugin, error) {
+	plugin := &Hash{name: name}
+
+	value, exists := config["fields"]
+	if !exists {
+		return nil, fmt.Errorf("The fields option is required for %s", name)
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected the fields of %s to be an array of strings", name)
+	}
+	for _, item := range list {
+		path, ok := item.(string)
+		if !ok || len(path) == 0 {
+			return nil, fmt.Errorf("Expected the fields of %s to only contain field names", name)
+		}
+		plugin.paths = append(plugin.paths, strings.Split(path, "."))
+	}
+
+	algorithm := DefaultAlgorithm
+	if value, exists := config["algorithm"]; exists {
+		algorithm = strings.ToLower(fmt.Sprint(value))
+	}
+	plugin.newFn, ok = algorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("Unknown algorithm %s for %s, expected sha256 or sha1", algorithm, name)
+	}
+
+	if value, exists := config["salt"]; exists {
+		salt := fmt.Sprint(value)
+		if len(salt) == 0 {
+			return nil, fmt.Errorf("The salt of %s is empty", name)
+		}
+		plugin.salt = []byte(salt)
+		plugin.salted = true
+	}
+
+	return plugin, nil
+}
+
+// digest returns the hex digest of the value, an HMAC keyed with the salt
+// when there is one.
+func (hash *Hash) digest(value string) string {
+	var mac h.Hash
+	if hash.salted {
+		mac = hmac.New(hash.newFn, hash.salt)
+	} else {
+		mac = hash.newFn()
+	}
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Filter replaces the fields by their digest. The missing fields are
+// skipped, as are the objects and the arrays.
+func (hash *Hash) Filter(event common.MapStr) (common.MapStr, error) {
+	for _, path := range hash.paths {
+		pbfilters.Update(event, path, hash.hashValue)
+	}
+	return event, nil
+}
+
+// hashValue returns the digest of the value, and false for the objects
+// and the arrays.
+func (hash *Hash) hashValue(value interface{}) (interface{}, bool) {
+	switch value.(type) {
+	case common.MapStr, map[string]interface{}, []interface{}, []string:
+		logp.Debug("filters", "%s: not hashing an object or an array", hash.name)
+		return nil, false
+	case nil:
+		return nil, false
+	}
+	return hash.digest(fmt.Sprint(value)), true
+}
+
+func (hash *Hash) String() string {
+	return hash.name
+}
+
+func (hash *Hash) Type() filters.Filter {
+	return pbfilters.HashFilter
+}
@@ -0,0 +1,106 @@
+package hash
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/filters"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFilter(t *testing.T, config map[string]interface{}) filters.FilterPlugin {
+	plugin, err := new(Hash).New("test", config)
+	assert.Nil(t, err)
+	return plugin
+}
+
+func TestHashNested(t *testing.T) {
+	plugin := newFilter(t, map[string]interface{}{
+		"fields": []interface{}{"http.request_headers.cookie", "user", "missing", "http.missing.field"},
+	})
+
+	event := common.MapStr{
+		"type": "http",
+		"user": "abc",
+		"http": common.MapStr{
+			"request_headers": map[string]interface{}{"cookie": "abc"},
+		},
+	}
+	res, err := plugin.Filter(event)
+	assert.Nil(t, err)
+
+	digest := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	assert.Equal(t, common.MapStr{
+		"type": "http",
+		"user": digest,
+		"http": common.MapStr{
+			"request_headers": map[string]interface{}{"cookie": digest},
+		},
+	}, res)
+}
+
+func TestHashSha1(t *testing.T) {
+	plugin := newFilter(t, map[string]interface{}{
+		"fields":    []interface{}{"user", "port", "http"},
+		"algorithm": "SHA1",
+	})
+
+	res, err := plugin.Filter(common.MapStr{
+		"user": "abc",
+		"port": 443,
+		"http": common.MapStr{"code": 200},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "a9993e364706816aba3e25717850c26c9cd0d89d", res["user"])
+	// sha1("443")
+	assert.Equal(t, "ac3e7b007d7ab0ba379faa8ab62d9da35c5444f4", res["port"])
+	// the objects are not hashed
+	assert.Equal(t, common.MapStr{"code": 200}, res["http"])
+}
+
+func TestHashSalt(t *testing.T) {
+	plugin := newFilter(t, map[string]interface{}{
+		"fields": []interface{}{"message"},
+		"salt":   "key",
+	})
+
+	res, err := plugin.Filter(common.MapStr{
+		"message": "The quick brown fox jumps over the lazy dog",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8", res["message"])
+}
+
+func TestHashConfigErrors(t *testing.T) {
+	configs := []map[string]interface{}{
+		{},
+		{"fields": "user"},
+		{"fields": []interface{}{""}},
+		{"fields": []interface{}{"user"}, "algorithm": "md5"},
+		{"fields": []interface{}{"user"}, "salt": ""},
+	}
+	for _, config := range configs {
+		_, err := new(Hash).New("test", config)
+		assert.NotNil(t, err, "%v", config)
+	}
+}
+
+func TestHashEndpoints(t *testing.T) {
+	plugin := newFilter(t, map[string]interface{}{
+		"fields": []interface{}{"src.ip", "dst.port"},
+	})
+
+	res, err := plugin.Filter(common.MapStr{
+		"src": &common.Endpoint{Ip: "abc", Port: 34567},
+		"dst": &common.Endpoint{Ip: "10.0.0.1", Port: 80},
+	})
+	assert.Nil(t, err)
+
+	// the port stays a number
+	assert.Equal(t, &common.Endpoint{
+		Ip:   "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		Port: 34567,
+	}, res["src"])
+	assert.Equal(t, &common.Endpoint{Ip: "10.0.0.1", Port: 80}, res["dst"])
+}
@@ -0,0 +1,170 @@
+// Package mutate implements a Packetbeat filter that renames fields, adds
+// static fields and changes the case of string fields, to match the
+// schema expected downstream. Nested fields are referenced by their dotted
+// path, like http.code.
+package mutate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/filters"
+
+	pbfilters "github.com/johann8384/packetbeat/filters"
+)
+
+type rename struct {
+	from []string
+	to   []string
+}
+
+type staticField struct {
+	path  []string
+	value interface{}
+}
+
+type Mutate struct {
+	name string
+
+	// sorted by source field, so that they are always applied in the
+	// same order
+	rename    []rename
+	addFields []staticField
+	lowercase [][]string
+	uppercase [][]string
+}
+
+func (mutate *Mutate) New(name string, config map[string]interface{}) (filters.FilterPlugin, error) {
+	plugin := &Mutate{name: name}
+
+	renames, err := readMap(config, "rename")
+	if err != nil {
+		return nil, err
+	}
+	for _, from := range sortedKeys(renames) {
+		to, ok := renames[from].(string)
+		if !ok || len(to) == 0 {
+			return nil, fmt.Errorf("Expected a field name to rename %s to, got %v", from, renames[from])
+		}
+		plugin.rename = append(plugin.rename,
+			rename{from: strings.Split(from, "."), to: strings.Split(to, ".")})
+	}
+
+	static, err := readMap(config, "add_fields")
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range sortedKeys(static) {
+		plugin.addFields = append(plugin.addFields,
+			staticField{path: strings.Split(field, "."), value: static[field]})
+	}
+
+	plugin.lowercase, err = readPaths(config, "lowercase")
+	if err != nil {
+		return nil, err
+	}
+	plugin.uppercase, err = readPaths(config, "uppercase")
+	if err != nil {
+		return nil, err
+	}
+
+	return plugin, nil
+}
+
+// readMap reads a map of field names from the YAML configuration.
+func readMap(config map[string]interface{}, option string) (map[string]interface{}, error) {
+	value, exists := config[option]
+	if !exists {
+		return nil, nil
+	}
+	m, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected %s to be a map of field names", option)
+	}
+
+	res := map[string]interface{}{}
+	for key, value := range m {
+		field, ok := key.(string)
+		if !ok || len(field) == 0 {
+			return nil, fmt.Errorf("Expected %s to only contain field names, got %v", option, key)
+		}
+		res[field] = value
+	}
+	return res, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func readPaths(config map[string]interface{}, option string) ([][]string, error) {
+	value, exists := config[option]
+	if !exists {
+		return nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected %s to be an array of strings", option)
+	}
+
+	paths := [][]string{}
+	for _, item := range list {
+		path, ok := item.(string)
+		if !ok || len(path) == 0 {
+			return nil, fmt.Errorf("Expected %s to only contain field names", option)
+		}
+		paths = append(paths, strings.Split(path, "."))
+	}
+	return paths, nil
+}
+
+// Filter applies the renames first, then adds the static fields and
+// changes the case of the fields last. The missing fields are skipped.
+func (mutate *Mutate) Filter(event common.MapStr) (common.MapStr, error) {
+	for _, rename := range mutate.rename {
+		value, exists := pbfilters.Delete(event, rename.from)
+		if exists {
+			pbfilters.Set(event, rename.to, value)
+		}
+	}
+
+	for _, field := range mutate.addFields {
+		pbfilters.Set(event, field.path, field.value)
+	}
+
+	for _, path := range mutate.lowercase {
+		pbfilters.Update(event, path, changeCase(strings.ToLower))
+	}
+	for _, path := range mutate.uppercase {
+		pbfilters.Update(event, path, changeCase(strings.ToUpper))
+	}
+
+	return event, nil
+}
+
+func (mutate *Mutate) String() string {
+	return mutate.name
+}
+
+func (mutate *Mutate) Type() filters.Filter {
+	return pbfilters.MutateFilter
+}
+
+// changeCase returns the string with its case changed, and false for the
+// other values.
+func changeCase(fn func(string) string) func(value interface{}) (interface{}, bool) {
+	return func(value interface{}) (interface{}, bool) {
+		str, ok := value.(string)
+		if !ok {
+			return nil, false
+		}
+		return fn(str), true
+	}
+}
@@ -0,0 +1,120 @@
+package mutate
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/filters"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEvent() common.MapStr {
+	return common.MapStr{
+		"timestamp": "2015-05-20T12:00:00.000Z",
+		"type":      "http",
+		"method":    "get",
+		"path":      "/Index.html",
+		"http": common.MapStr{
+			"code":   200,
+			"phrase": "OK",
+		},
+	}
+}
+
+func newFilter(t *testing.T, config map[string]interface{}) filters.FilterPlugin {
+	plugin, err := new(Mutate).New("test", config)
+	assert.Nil(t, err)
+	return plugin
+}
+
+func TestMutateRenameNested(t *testing.T) {
+	plugin := newFilter(t, map[string]interface{}{
+		"rename": map[interface{}]interface{}{
+			"http.code": "http.response.status_code",
+			"path":      "url.path",
+			"missing":   "still.missing",
+		},
+	})
+
+	res, err := plugin.Filter(newEvent())
+	assert.Nil(t, err)
+
+	assert.Equal(t, common.MapStr{
+		"timestamp": "2015-05-20T12:00:00.000Z",
+		"type":      "http",
+		"method":    "get",
+		"url":       common.MapStr{"path": "/Index.html"},
+		"http": common.MapStr{
+			"phrase":   "OK",
+			"response": common.MapStr{"status_code": 200},
+		},
+	}, res)
+}
+
+func TestMutateAddFieldsAndCase(t *testing.T) {
+	plugin := newFilter(t, map[string]interface{}{
+		"rename": map[interface{}]interface{}{
+			"method": "http.method",
+		},
+		"add_fields": map[interface{}]interface{}{
+			"environment":  "production",
+			"service.name": "frontend",
+			"http.version": 1.1,
+		},
+		"uppercase": []interface{}{"http.method", "http.code"},
+		"lowercase": []interface{}{"path", "missing"},
+	})
+
+	res, err := plugin.Filter(newEvent())
+	assert.Nil(t, err)
+
+	assert.Equal(t, "production", res["environment"])
+	assert.Equal(t, common.MapStr{"name": "frontend"}, res["service"])
+	assert.Equal(t, "/index.html", res["path"])
+	assert.Nil(t, res["method"])
+
+	// the renamed field is upper cased, the number is left untouched
+	assert.Equal(t, common.MapStr{
+		"code":    200,
+		"phrase":  "OK",
+		"method":  "GET",
+		"version": 1.1,
+	}, res["http"])
+}
+
+func TestMutateInvalidConfig(t *testing.T) {
+	tests := []map[string]interface{}{
+		{"rename": []interface{}{"path"}},
+		{"rename": map[interface{}]interface{}{"path": 1}},
+		{"rename": map[interface{}]interface{}{"path": ""}},
+		{"add_fields": "environment"},
+		{"add_fields": map[interface{}]interface{}{1: "production"}},
+		{"lowercase": "path"},
+		{"uppercase": []interface{}{1}},
+	}
+
+	for _, config := range tests {
+		_, err := new(Mutate).New("test", config)
+		assert.NotNil(t, err, "%v", config)
+	}
+}
+
+func TestMutateEndpoints(t *testing.T) {
+	plugin := newFilter(t, map[string]interface{}{
+		"rename":    map[interface{}]interface{}{"src.proc": "client.process"},
+		"uppercase": []interface{}{"dst.proc"},
+	})
+
+	res, err := plugin.Filter(common.MapStr{
+		"src": &common.Endpoint{Ip: "10.0.0.2", Proc: "curl"},
+		"dst": &common.Endpoint{Ip: "10.0.0.1", Proc: "nginx"},
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, common.MapStr{
+		"src":    &common.Endpoint{Ip: "10.0.0.2"},
+		"dst":    &common.Endpoint{Ip: "10.0.0.1", Proc: "NGINX"},
+		"client": common.MapStr{"process": "curl"},
+	}, res)
+}
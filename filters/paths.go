@@ -0,0 +1,166 @@
+package filters
+
+import (
+	"reflect"
+
+	"github.com/johann8384/libbeat/common"
+)
+
+// ToMap returns the nested map, as both common.MapStr and plain maps can
+// be found in the events.
+func ToMap(value interface{}) (map[string]interface{}, bool) {
+	switch m := value.(type) {
+	case common.MapStr:
+		return m, true
+	case map[string]interface{}:
+		return m, true
+	}
+	return nil, false
+}
+
+// endpointFields returns the fields of the endpoint, which is seen as a
+// map with the ip, port and proc keys.
+func endpointFields(endpoint *common.Endpoint) map[string]interface{} {
+	return map[string]interface{}{
+		"ip":   endpoint.Ip,
+		"port": endpoint.Port,
+		"proc": endpoint.Proc,
+	}
+}
+
+// setEndpointField sets the field of the endpoint, ip, port or proc. It
+// returns false when the value doesn't fit the field.
+func setEndpointField(endpoint *common.Endpoint, name string, value interface{}) bool {
+	switch name {
+	case "ip", "proc":
+		str, ok := value.(string)
+		if !ok {
+			return false
+		}
+		if name == "ip" {
+			endpoint.Ip = str
+		} else {
+			endpoint.Proc = str
+		}
+		return true
+	case "port":
+		port, ok := value.(uint16)
+		if ok {
+			endpoint.Port = port
+		}
+		return ok
+	}
+	return false
+}
+
+// Lookup returns the value of the field at the path, like
+// ["http", "code"]. The endpoints are seen as maps with the ip, port and
+// proc keys.
+func Lookup(event map[string]interface{}, path []string) (interface{}, bool) {
+	value, exists := event[path[0]]
+	if !exists {
+		return nil, false
+	}
+	if len(path) == 1 {
+		return value, true
+	}
+
+	switch nested := value.(type) {
+	case common.MapStr:
+		return Lookup(nested, path[1:])
+	case map[string]interface{}:
+		return Lookup(nested, path[1:])
+	case *common.Endpoint:
+		return Lookup(endpointFields(nested), path[1:])
+	}
+	return nil, false
+}
+
+// Update replaces the value of the field at the path by the one returned
+// by update, unless update returns false. The missing fields are skipped.
+// The fields of the endpoints are set on a copy, as an endpoint can be
+// shared by several events, and only when the new value has the same
+// type.
+func Update(event map[string]interface{}, path []string,
+	update func(value interface{}) (interface{}, bool)) {
+
+	value, exists := event[path[0]]
+	if !exists {
+		return
+	}
+	if len(path) == 1 {
+		if updated, ok := update(value); ok {
+			event[path[0]] = updated
+		}
+		return
+	}
+
+	if endpoint, ok := value.(*common.Endpoint); ok && len(path) == 2 {
+		current, exists := endpointFields(endpoint)[path[1]]
+		if !exists {
+			return
+		}
+		updated, ok := update(current)
+		if !ok {
+			return
+		}
+		copied := *endpoint
+		if setEndpointField(&copied, path[1], updated) {
+			event[path[0]] = &copied
+		}
+		return
+	}
+	if nested, ok := ToMap(value); ok {
+		Update(nested, path[1:], update)
+	}
+}
+
+// Delete removes the field at the path and returns its value. The fields
+// of the endpoints can't be removed, they are reset to their zero value on
+// a copy of the endpoint instead.
+func Delete(event map[string]interface{}, path []string) (interface{}, bool) {
+	if len(path) == 1 {
+		value, exists := event[path[0]]
+		delete(event, path[0])
+		return value, exists
+	}
+	if endpoint, ok := event[path[0]].(*common.Endpoint); ok && len(path) == 2 {
+		value, exists := endpointFields(endpoint)[path[1]]
+		if exists {
+			copied := *endpoint
+			setEndpointField(&copied, path[1], reflect.Zero(reflect.TypeOf(value)).Interface())
+			event[path[0]] = &copied
+		}
+		return value, exists
+	}
+	nested, ok := ToMap(event[path[0]])
+	if !ok {
+		return nil, false
+	}
+	return Delete(nested, path[1:])
+}
+
+// Set sets the field at the path, creating the missing parents. A parent
+// that is not a map is replaced, except the endpoints, of which the ip,
+// port and proc fields are set on a copy when the value has the same
+// type.
+func Set(event map[string]interface{}, path []string, value interface{}) {
+	if len(path) == 1 {
+		event[path[0]] = value
+		return
+	}
+	if endpoint, ok := event[path[0]].(*common.Endpoint); ok && len(path) == 2 {
+		copied := *endpoint
+		if setEndpointField(&copied, path[1], value) {
+			event[path[0]] = &copied
+		}
+		return
+	}
+	nested, ok := ToMap(event[path[0]])
+	if !ok {
+		created := common.MapStr{}
+		event[path[0]] = created
+		nested = created
+	}
+	Set(nested, path[1:], value)
+}
@@ -0,0 +1,70 @@
+package filters
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookup(t *testing.T) {
+	event := common.MapStr{
+		"http": common.MapStr{"request_headers": map[string]interface{}{"host": "example.com"}},
+		"src":  &common.Endpoint{Ip: "10.0.0.1", Port: 34567, Proc: "curl"},
+	}
+
+	value, exists := Lookup(event, []string{"http", "request_headers", "host"})
+	assert.True(t, exists)
+	assert.Equal(t, "example.com", value)
+
+	value, exists = Lookup(event, []string{"src", "port"})
+	assert.True(t, exists)
+	assert.Equal(t, uint16(34567), value)
+
+	_, exists = Lookup(event, []string{"src", "missing"})
+	assert.False(t, exists)
+	_, exists = Lookup(event, []string{"http", "missing", "field"})
+	assert.False(t, exists)
+}
+
+func TestPaths_endpoints(t *testing.T) {
+	shared := &common.Endpoint{Ip: "10.0.0.1", Port: 34567, Proc: "curl"}
+	event := common.MapStr{"src": shared}
+
+	Update(event, []string{"src", "proc"}, func(value interface{}) (interface{}, bool) {
+		return "CURL", true
+	})
+	Set(event, []string{"src", "ip"}, "10.0.0.2")
+	// the types of the fields are kept
+	Set(event, []string{"src", "port"}, "80")
+	value, exists := Delete(event, []string{"src", "port"})
+	assert.True(t, exists)
+	assert.Equal(t, uint16(34567), value)
+
+	assert.Equal(t, &common.Endpoint{Ip: "10.0.0.2", Proc: "CURL"}, event["src"])
+	// the endpoint of the other events is left unchanged
+	assert.Equal(t, &common.Endpoint{Ip: "10.0.0.1", Port: 34567, Proc: "curl"}, shared)
+}
+
+func TestPaths_maps(t *testing.T) {
+	event := common.MapStr{"http": map[string]interface{}{"code": 200}, "status": "OK"}
+
+	Set(event, []string{"http", "phrase"}, "OK")
+	Set(event, []string{"status", "code"}, 200)
+	Set(event, []string{"new", "field"}, true)
+	value, exists := Delete(event, []string{"http", "code"})
+	assert.True(t, exists)
+	assert.Equal(t, 200, value)
+	_, exists = Delete(event, []string{"missing", "field"})
+	assert.False(t, exists)
+	Update(event, []string{"http", "phrase"}, func(value interface{}) (interface{}, bool) {
+		return nil, false
+	})
+
+	assert.Equal(t, common.MapStr{
+		"http":   map[string]interface{}{"phrase": "OK"},
+		"status": common.MapStr{"code": 200},
+		"new":    common.MapStr{"field": true},
+	}, event)
+}
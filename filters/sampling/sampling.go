@@ -0,0 +1,99 @@
+// Package sampling implements a Packetbeat filter that keeps only
+// a fraction of the events, to reduce the volume of data stored
+// for high traffic servers.
+package sampling
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/filters"
+
+	"github.com/johann8384/packetbeat/protos"
+)
+
+type Sampling struct {
+	name string
+
+	// A rate between 0 and 1 is the probability of keeping an
+	// event. A rate greater than 1 keeps one event out of every
+	// rate events.
+	rate float64
+
+	// the filters can be executed by more than one worker
+	lock  sync.Mutex
+	count uint64
+	rand  *rand.Rand
+}
+
+func (sampling *Sampling) New(name string, config map[string]interface{}) (filters.FilterPlugin, error) {
+	plugin := &Sampling{
+		name: name,
+		rate: 1,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if value, exists := config["rate"]; exists {
+		switch rate := value.(type) {
+		case int:
+			plugin.rate = float64(rate)
+		case float64:
+			plugin.rate = rate
+		default:
+			return nil, fmt.Errorf("Expected a number for the rate of %s, got %v", name, value)
+		}
+	}
+
+	if plugin.rate <= 0 {
+		return nil, fmt.Errorf("The rate of %s must be greater than 0", name)
+	}
+	if plugin.rate > 1 && plugin.rate != float64(uint64(plugin.rate)) {
+		return nil, fmt.Errorf("A rate greater than 1 must be an integer (1 in N), got %v", plugin.rate)
+	}
+
+	return plugin, nil
+}
+
+// Filter returns nil for the events that are not sampled. The request and
+// the response of a split transaction are sampled by their transaction.id,
+// so that they are kept or dropped together, with the probability given by
+// the rate, 1/rate for the rates greater than 1.
+func (sampling *Sampling) Filter(event common.MapStr) (common.MapStr, error) {
+	if fraction, ok := protos.TransactionFraction(event); ok {
+		rate := sampling.rate
+		if rate > 1 {
+			rate = 1 / rate
+		}
+		if fraction >= rate {
+			return nil, nil
+		}
+		return event, nil
+	}
+
+	sampling.lock.Lock()
+	defer sampling.lock.Unlock()
+
+	if sampling.rate > 1 {
+		sampling.count++
+		if sampling.count%uint64(sampling.rate) != 1 {
+			return nil, nil
+		}
+		return event, nil
+	}
+
+	if sampling.rate < 1 && sampling.rand.Float64() >= sampling.rate {
+		return nil, nil
+	}
+	return event, nil
+}
+
+func (sampling *Sampling) String() string {
+	return sampling.name
+}
+
+func (sampling *Sampling) Type() filters.Filter {
+	return filters.SampleFilter
+}
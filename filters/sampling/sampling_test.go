@@ -0,0 +1,71 @@
+package sampling
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func countKept(t *testing.T, config map[string]interface{}, events int) int {
+	plugin, err := new(Sampling).New("test", config)
+	assert.Nil(t, err)
+
+	kept := 0
+	for i := 0; i < events; i++ {
+		res, err := plugin.Filter(common.MapStr{"count": i})
+		assert.Nil(t, err)
+		if res != nil {
+			kept++
+		}
+	}
+	return kept
+}
+
+func TestSamplingProbability(t *testing.T) {
+	kept := countKept(t, map[string]interface{}{"rate": 0.1}, 10000)
+
+	// the standard deviation is 30, so this is very unlikely to fail
+	assert.True(t, kept > 800 && kept < 1200, "kept %d events", kept)
+}
+
+func TestSamplingOneInN(t *testing.T) {
+	assert.Equal(t, 1000, countKept(t, map[string]interface{}{"rate": 10}, 10000))
+}
+
+func TestSamplingSplitTransactions(t *testing.T) {
+	for _, rate := range []interface{}{0.1, 10} {
+		plugin, err := new(Sampling).New("test", map[string]interface{}{"rate": rate})
+		assert.Nil(t, err)
+
+		kept := 0
+		for i := 0; i < 10000; i++ {
+			events := protos.SplitTransaction(common.MapStr{"count": i}, true, true)
+			request, _ := plugin.Filter(events[0])
+			response, _ := plugin.Filter(events[1])
+			if (request == nil) != (response == nil) {
+				t.Fatalf("Only one half of the transaction kept with the rate %v", rate)
+			}
+			if request != nil {
+				kept++
+			}
+		}
+		assert.True(t, kept > 800 && kept < 1200, "kept %d transactions with the rate %v", kept, rate)
+	}
+}
+
+func TestSamplingDefaultKeepsAll(t *testing.T) {
+	assert.Equal(t, 100, countKept(t, map[string]interface{}{}, 100))
+}
+
+func TestSamplingInvalidRate(t *testing.T) {
+	tests := []interface{}{0, -1, 2.5, "often"}
+
+	for _, rate := range tests {
+		_, err := new(Sampling).New("test", map[string]interface{}{"rate": rate})
+		assert.NotNil(t, err, "rate %v", rate)
+	}
+}
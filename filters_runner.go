@@ -2,51 +2,366 @@ package main
 
 import (
 	"fmt"
+	"hash/fnv"
+	"sync"
 
 	"github.com/johann8384/libbeat/common"
 	"github.com/johann8384/libbeat/filters"
 	"github.com/johann8384/libbeat/logp"
 )
 
+// What to do with an event on which a filter fails, set by the on_error
+// option of the filter section.
+const (
+	// the event is not published
+	FilterOnErrorDrop = "drop"
+
+	// the event goes on to the next filters, as the failing filter
+	// left it
+	FilterOnErrorSkip = "skip"
+)
+
+// What to do when the queue of the filters is full, set by the
+// queue_policy option of the filter section.
+const (
+	// the protocol plugins wait for the filters
+	FilterQueueBlock = "block"
+
+	// the oldest event of the queue is dropped and counted, so that a
+	// slow filter doesn't stall the capture
+	FilterQueueDropOldest = "drop_oldest"
+)
+
+// DefaultFiltersQueueSize is the default number of events waiting for the
+// filters.
+const DefaultFiltersQueueSize = 1000
+
+// FilterStats counts what happened to the events passed to the filters.
+type FilterStats struct {
+	Received  uint64
+	Published uint64
+
+	// dropped by a filter returning a nil event, or after an error
+	Dropped uint64
+
+	// dropped by the drop_oldest policy, the queue being full
+	QueueDropped uint64
+
+	// errors returned by the filters, in total and by filter name
+	Errors       uint64
+	FilterErrors map[string]uint64
+}
+
 // Executes the filters
 type FilterRunner struct {
 	FiltersQueue chan common.MapStr
 	results      chan common.MapStr
 
+	// With the drop_oldest policy, the events of the FiltersQueue are
+	// moved to this bounded queue, read by the workers.
+	queue      chan common.MapStr
+	dropOldest bool
+
 	// The order in which the plugins are
 	// executed. A filter plugin can be loaded
 	// more than once.
-	order []filters.FilterPlugin
+	order       []filters.FilterPlugin
+	dropOnError bool
+	orderLock   sync.Mutex
+
+	// Number of goroutines executing the filters, set before Run.
+	// The events of a flow are always executed by the same one, so
+	// they keep their order.
+	Workers int
+
+	stats     FilterStats
+	statsLock sync.Mutex
 }
 
 // Goroutine that reads the objects from the FiltersQueue,
 // executes all filters on them and writes the modified objects
 // int he results channel.
 func (runner *FilterRunner) Run() error {
+	queue := runner.FiltersQueue
+	if runner.dropOldest {
+		go runner.forward()
+		queue = runner.queue
+	}
+
+	if runner.Workers <= 1 {
+		runner.work(queue)
+		return nil
+	}
+
+	// The queues of the workers are not buffered, so that at most one
+	// event per worker is in flight when the FiltersQueue is drained.
+	queues := make([]chan common.MapStr, runner.Workers)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan common.MapStr)
+		wg.Add(1)
+		go func(queue chan common.MapStr) {
+			defer wg.Done()
+			runner.work(queue)
+		}(queues[i])
+	}
+
+	for event := range queue {
+		queues[flowHash(event)%uint32(len(queues))] <- event
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	return nil
+}
+
+// forward moves the events of the FiltersQueue to the bounded queue. When
+// it is full, its oldest event is dropped to make room, so forward never
+// blocks the protocol plugins.
+func (runner *FilterRunner) forward() {
 	for event := range runner.FiltersQueue {
-		for _, plugin := range runner.order {
-			var err error
-			event, err = plugin.Filter(event)
-			if err != nil {
+		runner.enqueue(event)
+	}
+	close(runner.queue)
+}
+
+func (runner *FilterRunner) enqueue(event common.MapStr) {
+	for {
+		select {
+		case runner.queue <- event:
+			return
+		default:
+		}
+		select {
+		case <-runner.queue:
+			runner.count(func(stats *FilterStats) { stats.QueueDropped++ })
+		default:
+		}
+	}
+}
+
+func (runner *FilterRunner) work(queue chan common.MapStr) {
+	for event := range queue {
+		event = runner.filter(event)
+		if event != nil {
+			runner.results <- event
+		}
+	}
+}
+
+// flowHash returns the same hash for the events between two endpoints,
+// whatever their direction.
+func flowHash(event common.MapStr) uint32 {
+	src := endpointKey(event["src"])
+	dst := endpointKey(event["dst"])
+	if src > dst {
+		src, dst = dst, src
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(src))
+	hash.Write([]byte{0})
+	hash.Write([]byte(dst))
+	return hash.Sum32()
+}
+
+func endpointKey(value interface{}) string {
+	endpoint, ok := value.(*common.Endpoint)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", endpoint.Ip, endpoint.Port)
+}
+
+// filter executes the filters on the event. A filter returning a nil
+// event drops it and the next filters are not executed. A filter
+// returning an error drops the event, or is skipped if on_error is set to
+// skip.
+func (runner *FilterRunner) filter(event common.MapStr) common.MapStr {
+	runner.orderLock.Lock()
+	order := runner.order
+	dropOnError := runner.dropOnError
+	runner.orderLock.Unlock()
+
+	runner.count(func(stats *FilterStats) { stats.Received++ })
+
+	for _, plugin := range order {
+		filtered, err := plugin.Filter(event)
+		if err != nil {
+			runner.count(func(stats *FilterStats) {
+				stats.Errors++
+				stats.FilterErrors[plugin.String()]++
+			})
+			if dropOnError {
 				logp.Err("Error executing filter %s: %v. Dropping event.", plugin, err)
-				break // drop event in case of errors
+				runner.count(func(stats *FilterStats) { stats.Dropped++ })
+				return nil
 			}
+			logp.Err("Error executing filter %s: %v. Skipping the filter.", plugin, err)
+			continue
+		}
+		if filtered == nil {
+			// the filter decided to drop the event
+			runner.count(func(stats *FilterStats) { stats.Dropped++ })
+			return nil
 		}
+		event = filtered
+	}
+
+	runner.count(func(stats *FilterStats) { stats.Published++ })
+	return event
+}
 
-		runner.results <- event
+func (runner *FilterRunner) count(update func(stats *FilterStats)) {
+	runner.statsLock.Lock()
+	defer runner.statsLock.Unlock()
+	update(&runner.stats)
+}
+
+// Stats returns a copy of the counters.
+func (runner *FilterRunner) Stats() FilterStats {
+	runner.statsLock.Lock()
+	defer runner.statsLock.Unlock()
+
+	stats := runner.stats
+	stats.FilterErrors = map[string]uint64{}
+	for name, errors := range runner.stats.FilterErrors {
+		stats.FilterErrors[name] = errors
 	}
-	return nil
+	return stats
+}
+
+// SetOrder replaces the filters executed on the next objects, when the
+// configuration is reloaded.
+func (runner *FilterRunner) SetOrder(order []filters.FilterPlugin) {
+	runner.orderLock.Lock()
+	defer runner.orderLock.Unlock()
+	runner.order = order
+}
+
+// SetOnError sets what to do with the events on which a filter fails,
+// FilterOnErrorDrop or FilterOnErrorSkip.
+func (runner *FilterRunner) SetOnError(onError string) {
+	runner.orderLock.Lock()
+	defer runner.orderLock.Unlock()
+	runner.dropOnError = onError != FilterOnErrorSkip
+}
+
+// SetQueue sets the number of events waiting for the filters and the
+// policy applied when they are that many, FilterQueueBlock or
+// FilterQueueDropOldest. It is called before Run and before the
+// FiltersQueue is used.
+func (runner *FilterRunner) SetQueue(size int, policy string) {
+	runner.dropOldest = policy == FilterQueueDropOldest
+	if runner.dropOldest {
+		// the events are taken right away by forward
+		runner.FiltersQueue = make(chan common.MapStr)
+		runner.queue = make(chan common.MapStr, size)
+	} else {
+		runner.FiltersQueue = make(chan common.MapStr, size)
+		runner.queue = nil
+	}
+}
+
+// QueueSize returns the number of events that can wait for the filters.
+func (runner *FilterRunner) QueueSize() int {
+	if runner.dropOldest {
+		return cap(runner.queue)
+	}
+	return cap(runner.FiltersQueue)
+}
+
+// QueuePolicy returns the policy applied when the queue is full.
+func (runner *FilterRunner) QueuePolicy() string {
+	if runner.dropOldest {
+		return FilterQueueDropOldest
+	}
+	return FilterQueueBlock
 }
 
-// Create a new FilterRunner
+// Queues returns the queues of the events waiting for the filters, to
+// drain them on shutdown.
+func (runner *FilterRunner) Queues() []chan common.MapStr {
+	if runner.dropOldest {
+		return []chan common.MapStr{runner.FiltersQueue, runner.queue}
+	}
+	return []chan common.MapStr{runner.FiltersQueue}
+}
+
+// Create a new FilterRunner. The events on which a filter fails are
+// dropped.
 func NewFilterRunner(results chan common.MapStr, order []filters.FilterPlugin) *FilterRunner {
 	runner := new(FilterRunner)
 	runner.results = results
 	runner.order = order
-	runner.FiltersQueue = make(chan common.MapStr, 1000)
+	runner.dropOnError = true
+	runner.stats.FilterErrors = map[string]uint64{}
+	runner.FiltersQueue = make(chan common.MapStr, DefaultFiltersQueueSize)
 	return runner
 }
 
+// LoadFiltersOnError reads the on_error option of the [filters]
+// configuration. The default is to drop the events.
+func LoadFiltersOnError(config map[string]interface{}) (string, error) {
+	value, exists := config["on_error"]
+	if !exists {
+		return FilterOnErrorDrop, nil
+	}
+	onError, ok := value.(string)
+	if !ok || (onError != FilterOnErrorDrop && onError != FilterOnErrorSkip) {
+		return "", fmt.Errorf("Expected on_error to be %s or %s, got %v",
+			FilterOnErrorDrop, FilterOnErrorSkip, value)
+	}
+	return onError, nil
+}
+
+// LoadFiltersWorkers reads the workers option of the [filters]
+// configuration, the number of goroutines executing the filters. The
+// default is 1.
+func LoadFiltersWorkers(config map[string]interface{}) (int, error) {
+	value, exists := config["workers"]
+	if !exists {
+		return 1, nil
+	}
+	workers, ok := value.(int)
+	if !ok || workers < 1 {
+		return 0, fmt.Errorf("Expected workers to be a positive number, got %v", value)
+	}
+	return workers, nil
+}
+
+// LoadFiltersQueueSize reads the queue_size option of the [filters]
+// configuration, the number of events waiting for the filters. The
+// default is DefaultFiltersQueueSize.
+func LoadFiltersQueueSize(config map[string]interface{}) (int, error) {
+	value, exists := config["queue_size"]
+	if !exists {
+		return DefaultFiltersQueueSize, nil
+	}
+	size, ok := value.(int)
+	if !ok || size < 1 {
+		return 0, fmt.Errorf("Expected queue_size to be a positive number, got %v", value)
+	}
+	return size, nil
+}
+
+// LoadFiltersQueuePolicy reads the queue_policy option of the [filters]
+// configuration. The default is to block.
+func LoadFiltersQueuePolicy(config map[string]interface{}) (string, error) {
+	value, exists := config["queue_policy"]
+	if !exists {
+		return FilterQueueBlock, nil
+	}
+	policy, ok := value.(string)
+	if !ok || (policy != FilterQueueBlock && policy != FilterQueueDropOldest) {
+		return "", fmt.Errorf("Expected queue_policy to be %s or %s, got %v",
+			FilterQueueBlock, FilterQueueDropOldest, value)
+	}
+	return policy, nil
+}
+
 // LoadConfiguredFilters interprets the [filters] configuration, loads the configured
 // plugins and returns the order in which they need to be executed.
 func LoadConfiguredFilters(config map[string]interface{}) ([]filters.FilterPlugin, error) {
@@ -78,10 +393,18 @@ func LoadConfiguredFilters(config map[string]interface{}) ([]filters.FilterPlugi
 			}
 		} else {
 			logp.Debug("filters", "%v", cfg)
-			plugin_config, ok := cfg.(map[interface{}]interface{})
+			cfg_map, ok := cfg.(map[interface{}]interface{})
 			if !ok {
 				return nil, fmt.Errorf("Invalid configuration for: %s", filter)
 			}
+			plugin_config = map[string]interface{}{}
+			for key, value := range cfg_map {
+				key_str, ok := key.(string)
+				if !ok {
+					return nil, fmt.Errorf("Invalid configuration key for %s: %v", filter, key)
+				}
+				plugin_config[key_str] = value
+			}
 			type_str, ok := plugin_config["type"].(string)
 			if !ok {
 				return nil, fmt.Errorf("Couldn't get type for filter: %s", filter)
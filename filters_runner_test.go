@@ -1,17 +1,22 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/johann8384/libbeat/common"
 	"github.com/johann8384/libbeat/filters"
 	"github.com/johann8384/libbeat/filters/nop"
+	"github.com/johann8384/packetbeat/filters/sampling"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func loadPlugins() {
 	filters.Filters.Register(filters.NopFilter, new(nop.Nop))
+	filters.Filters.Register(filters.SampleFilter, new(sampling.Sampling))
 }
 
 func TestFilterRunner(t *testing.T) {
@@ -40,6 +45,125 @@ func TestFilterRunner(t *testing.T) {
 	assert.Equal(t, common.MapStr{"foo": "bar"}, res)
 }
 
+func TestFilterRunnerDropsNilEvents(t *testing.T) {
+	loadPlugins()
+
+	output := make(chan common.MapStr, 10)
+
+	filter, err := new(sampling.Sampling).New("sample", map[string]interface{}{"rate": 2})
+	assert.Nil(t, err)
+
+	runner := NewFilterRunner(output, []filters.FilterPlugin{filter})
+	go runner.Run()
+
+	runner.FiltersQueue <- common.MapStr{"count": 1}
+	runner.FiltersQueue <- common.MapStr{"count": 2}
+	runner.FiltersQueue <- common.MapStr{"count": 3}
+
+	res := <-output
+	assert.Equal(t, common.MapStr{"count": 1}, res)
+
+	res = <-output
+	assert.Equal(t, common.MapStr{"count": 3}, res)
+
+	stats := runner.Stats()
+	assert.Equal(t, uint64(3), stats.Received)
+	assert.Equal(t, uint64(2), stats.Published)
+	assert.Equal(t, uint64(1), stats.Dropped)
+	assert.Equal(t, uint64(0), stats.Errors)
+}
+
+// Fails on the events with the fail field, after marking them.
+type failingFilter struct {
+	name string
+}
+
+func (f *failingFilter) New(name string, config map[string]interface{}) (filters.FilterPlugin, error) {
+	return &failingFilter{name: name}, nil
+}
+
+func (f *failingFilter) Filter(event common.MapStr) (common.MapStr, error) {
+	event[f.name] = true
+	if _, fail := event["fail"]; fail {
+		return nil, errors.New("failed")
+	}
+	return event, nil
+}
+
+func (f *failingFilter) String() string {
+	return f.name
+}
+
+func (f *failingFilter) Type() filters.Filter {
+	return filters.NopFilter
+}
+
+func TestFilterRunnerErrorDropsEvent(t *testing.T) {
+	runner := NewFilterRunner(make(chan common.MapStr, 10), []filters.FilterPlugin{
+		&failingFilter{name: "first"},
+		&failingFilter{name: "second"},
+	})
+
+	assert.Nil(t, runner.filter(common.MapStr{"fail": 1}))
+	assert.Equal(t, common.MapStr{"first": true, "second": true},
+		runner.filter(common.MapStr{}))
+
+	stats := runner.Stats()
+	assert.Equal(t, uint64(2), stats.Received)
+	assert.Equal(t, uint64(1), stats.Published)
+	assert.Equal(t, uint64(1), stats.Dropped)
+	assert.Equal(t, uint64(1), stats.Errors)
+	assert.Equal(t, map[string]uint64{"first": 1}, stats.FilterErrors)
+}
+
+func TestFilterRunnerErrorSkipsFilter(t *testing.T) {
+	runner := NewFilterRunner(make(chan common.MapStr, 10), []filters.FilterPlugin{
+		&failingFilter{name: "first"},
+		&failingFilter{name: "second"},
+	})
+	runner.SetOnError(FilterOnErrorSkip)
+
+	// both filters fail, the event is published as they left it
+	assert.Equal(t, common.MapStr{"fail": 1, "first": true, "second": true},
+		runner.filter(common.MapStr{"fail": 1}))
+
+	stats := runner.Stats()
+	assert.Equal(t, uint64(1), stats.Published)
+	assert.Equal(t, uint64(0), stats.Dropped)
+	assert.Equal(t, uint64(2), stats.Errors)
+	assert.Equal(t, map[string]uint64{"first": 1, "second": 1}, stats.FilterErrors)
+
+	// the copy isn't updated
+	runner.filter(common.MapStr{"fail": 1})
+	assert.Equal(t, uint64(1), stats.FilterErrors["first"])
+}
+
+func TestLoadFiltersOnError(t *testing.T) {
+	onError, err := LoadFiltersOnError(map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, FilterOnErrorDrop, onError)
+
+	onError, err = LoadFiltersOnError(map[string]interface{}{"on_error": "skip"})
+	assert.Nil(t, err)
+	assert.Equal(t, FilterOnErrorSkip, onError)
+
+	_, err = LoadFiltersOnError(map[string]interface{}{"on_error": "ignore"})
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfiguredFiltersPassesConfig(t *testing.T) {
+	loadPlugins()
+
+	_, err := LoadConfiguredFilters(map[string]interface{}{
+		"filters": []interface{}{"sample1"},
+		"sample1": map[interface{}]interface{}{
+			"type": "sample",
+			"rate": 2.5,
+		},
+	})
+	assert.NotNil(t, err)
+}
+
 func TestLoadConfiguredFilters(t *testing.T) {
 	loadPlugins()
 
@@ -154,3 +278,192 @@ func TestLoadConfiguredFiltersNegative(t *testing.T) {
 		assert.Equal(t, test.Err, err.Error())
 	}
 }
+
+// Sleeps, to simulate an expensive filter.
+type slowFilter struct {
+	delay time.Duration
+}
+
+func (f *slowFilter) New(name string, config map[string]interface{}) (filters.FilterPlugin, error) {
+	return f, nil
+}
+
+func (f *slowFilter) Filter(event common.MapStr) (common.MapStr, error) {
+	time.Sleep(f.delay)
+	return event, nil
+}
+
+func (f *slowFilter) String() string {
+	return "slow"
+}
+
+func (f *slowFilter) Type() filters.Filter {
+	return filters.NopFilter
+}
+
+func flowEvent(flow int, seq int) common.MapStr {
+	return common.MapStr{
+		"seq": seq,
+		"src": &common.Endpoint{Ip: "10.0.0.1", Port: uint16(40000 + flow)},
+		"dst": &common.Endpoint{Ip: "10.0.0.2", Port: 80},
+	}
+}
+
+// runFlows filters 8 events for each of 8 flows and returns the time it
+// took and the sequence numbers of the events of each flow, in the order
+// in which they were published.
+func runFlows(workers int) (time.Duration, map[string][]int) {
+	const flows, events = 8, 8
+
+	output := make(chan common.MapStr, flows*events)
+	runner := NewFilterRunner(output, []filters.FilterPlugin{
+		&slowFilter{delay: 2 * time.Millisecond},
+	})
+	runner.Workers = workers
+
+	start := time.Now()
+	go runner.Run()
+	for seq := 0; seq < events; seq++ {
+		for flow := 0; flow < flows; flow++ {
+			runner.FiltersQueue <- flowEvent(flow, seq)
+		}
+	}
+
+	published := map[string][]int{}
+	for i := 0; i < flows*events; i++ {
+		event := <-output
+		key := endpointKey(event["src"])
+		published[key] = append(published[key], event["seq"].(int))
+	}
+	close(runner.FiltersQueue)
+	return time.Since(start), published
+}
+
+func TestFilterRunnerWorkers(t *testing.T) {
+	sequential, _ := runFlows(1)
+	parallel, published := runFlows(8)
+
+	// the flows don't all hash to different workers, but most do
+	assert.True(t, parallel < sequential/2,
+		"sequential %v, parallel %v", sequential, parallel)
+
+	assert.Equal(t, 8, len(published))
+	for flow, seqs := range published {
+		assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7}, seqs, flow)
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	request := flowEvent(1, 0)
+	response := common.MapStr{"src": request["dst"], "dst": request["src"]}
+	assert.Equal(t, flowHash(request), flowHash(response))
+
+	assert.NotEqual(t, flowHash(flowEvent(1, 0)), flowHash(flowEvent(2, 0)))
+	assert.Equal(t, flowHash(common.MapStr{}), flowHash(common.MapStr{"type": "http"}))
+}
+
+func TestLoadFiltersWorkers(t *testing.T) {
+	workers, err := LoadFiltersWorkers(map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, workers)
+
+	workers, err = LoadFiltersWorkers(map[string]interface{}{"workers": 4})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, workers)
+
+	for _, value := range []interface{}{0, "4", 2.5} {
+		_, err = LoadFiltersWorkers(map[string]interface{}{"workers": value})
+		assert.NotNil(t, err, fmt.Sprint(value))
+	}
+}
+
+// Holds the events until it is released.
+type blockingFilter struct {
+	release chan struct{}
+}
+
+func (f *blockingFilter) New(name string, config map[string]interface{}) (filters.FilterPlugin, error) {
+	return f, nil
+}
+
+func (f *blockingFilter) Filter(event common.MapStr) (common.MapStr, error) {
+	<-f.release
+	return event, nil
+}
+
+func (f *blockingFilter) String() string {
+	return "blocking"
+}
+
+func (f *blockingFilter) Type() filters.Filter {
+	return filters.NopFilter
+}
+
+func TestFilterRunnerQueueDropOldest(t *testing.T) {
+	output := make(chan common.MapStr, 10)
+	filter := &blockingFilter{release: make(chan struct{})}
+
+	runner := NewFilterRunner(output, []filters.FilterPlugin{filter})
+	runner.SetQueue(2, FilterQueueDropOldest)
+	assert.Equal(t, 2, runner.QueueSize())
+	assert.Equal(t, FilterQueueDropOldest, runner.QueuePolicy())
+	go runner.Run()
+
+	// the filter holds one event and the queue two, the others are dropped
+	sent := make(chan bool)
+	go func() {
+		for i := 1; i <= 10; i++ {
+			runner.FiltersQueue <- common.MapStr{"count": i}
+		}
+		sent <- true
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("sending to the full queue blocked")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runner.Stats().QueueDropped < 7 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, uint64(7), runner.Stats().QueueDropped)
+
+	close(filter.release)
+	close(runner.FiltersQueue)
+	received := []interface{}{}
+	for i := 0; i < 3; i++ {
+		select {
+		case event := <-output:
+			received = append(received, event["count"])
+		case <-time.After(time.Second):
+			t.Fatal("the events were not published")
+		}
+	}
+	// the newest events are kept
+	assert.Equal(t, []interface{}{9, 10}, received[1:])
+}
+
+func TestLoadFiltersQueue(t *testing.T) {
+	size, err := LoadFiltersQueueSize(map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultFiltersQueueSize, size)
+
+	size, err = LoadFiltersQueueSize(map[string]interface{}{"queue_size": 50})
+	assert.Nil(t, err)
+	assert.Equal(t, 50, size)
+
+	_, err = LoadFiltersQueueSize(map[string]interface{}{"queue_size": 0})
+	assert.NotNil(t, err)
+
+	policy, err := LoadFiltersQueuePolicy(map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, FilterQueueBlock, policy)
+
+	policy, err = LoadFiltersQueuePolicy(map[string]interface{}{"queue_policy": "drop_oldest"})
+	assert.Nil(t, err)
+	assert.Equal(t, FilterQueueDropOldest, policy)
+
+	_, err = LoadFiltersQueuePolicy(map[string]interface{}{"queue_policy": "drop_newest"})
+	assert.NotNil(t, err)
+}
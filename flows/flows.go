@@ -0,0 +1,264 @@
+// Package flows counts the packets and the bytes exchanged between two
+// endpoints, for each transport, and periodically publishes the totals as
+// flow events, like the NetFlow or IPFIX exporters.
+package flows
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/protos"
+)
+
+// Defaults of the flows section of the configuration.
+const (
+	DefaultPeriod   = 10 * time.Second
+	DefaultTimeout  = 30 * time.Second
+	DefaultMaxFlows = 100000
+)
+
+type FlowsConfig struct {
+	Enabled bool
+
+	// Interval between the reports of the flows, in seconds.
+	Period *int
+
+	// The flows without packets for this long are removed, in seconds.
+	Timeout *int
+
+	// The maximum number of flows kept, 0 for no limit.
+	Max_flows *int
+}
+
+// The key doesn't depend on the direction. The tuple is the one of the
+// first packet of the flow.
+type flowKey struct {
+	transport string
+	tuple     common.HashableIpPortTuple
+	link      protos.Link
+}
+
+type flow struct {
+	key       flowKey
+	transport string
+	tuple     common.IpPortTuple
+	link      protos.Link
+
+	// last packet seen, at the time of its capture, and when it was
+	// received, for the expiry, as the packets read from a pcap file
+	// keep their capture time
+	last time.Time
+	seen time.Time
+
+	// counters since the last report, indexed by direction: 0 for
+	// the packets sent by the source of the flow, 1 for its replies
+	reportStart time.Time
+	packets     [2]uint64
+	bytes       [2]uint64
+
+	// position in the flows ordered by their last packet
+	element *list.Element
+}
+
+type Flows struct {
+	Enabled  bool
+	Period   time.Duration
+	Timeout  time.Duration
+	MaxFlows int
+
+	lock  sync.Mutex
+	flows map[flowKey]*flow
+
+	// the flows from the least recently active, to evict them when
+	// there are more than MaxFlows, like during a port scan
+	order   *list.List
+	evicted uint64
+
+	results chan common.MapStr
+}
+
+var FlowAccounting Flows
+
+func (flows *Flows) Init(config FlowsConfig, results chan common.MapStr) error {
+	flows.Enabled = config.Enabled
+	flows.Period = DefaultPeriod
+	if config.Period != nil {
+		flows.Period = time.Duration(*config.Period) * time.Second
+	}
+	flows.Timeout = DefaultTimeout
+	if config.Timeout != nil {
+		flows.Timeout = time.Duration(*config.Timeout) * time.Second
+	}
+	if flows.Period <= 0 || flows.Timeout <= 0 {
+		return fmt.Errorf("The period and the timeout of the flows must be positive")
+	}
+	flows.MaxFlows = DefaultMaxFlows
+	if config.Max_flows != nil {
+		if *config.Max_flows < 0 {
+			return fmt.Errorf("The max_flows of the flows can't be negative")
+		}
+		flows.MaxFlows = *config.Max_flows
+	}
+
+	flows.flows = make(map[flowKey]*flow)
+	flows.order = list.New()
+	flows.results = results
+	return nil
+}
+
+// Start publishes the flows every Period.
+func (flows *Flows) Start() {
+	if !flows.Enabled {
+		return
+	}
+	logp.Info("Flows reported every %v", flows.Period)
+
+	go func() {
+		ticker := time.NewTicker(flows.Period)
+		for now := range ticker.C {
+			flows.Report(now)
+		}
+	}()
+}
+
+// Record counts a packet. The hashables of the tuple must be computed.
+func (flows *Flows) Record(transport string, tuple *common.IpPortTuple, link protos.Link,
+	size int, ts time.Time) {
+
+	if !flows.Enabled {
+		return
+	}
+
+	flows.lock.Lock()
+
+	dir := 0
+	f := flows.flows[flowKey{transport, tuple.Hashable(), link.Key()}]
+	if f == nil {
+		f = flows.flows[flowKey{transport, tuple.RevHashable(), link.Key()}]
+		dir = 1
+	}
+	if f == nil {
+		// the addresses point into the capture buffers
+		f = &flow{
+			key:       flowKey{transport, tuple.Hashable(), link.Key()},
+			transport: transport,
+			tuple: common.NewIpPortTuple(tuple.Ip_length,
+				append(net.IP{}, tuple.Src_ip...), tuple.Src_port,
+				append(net.IP{}, tuple.Dst_ip...), tuple.Dst_port),
+			link: link,
+		}
+		flows.flows[f.key] = f
+		f.element = flows.order.PushBack(f)
+		dir = 0
+	} else {
+		flows.order.MoveToBack(f.element)
+	}
+
+	if f.packets[0] == 0 && f.packets[1] == 0 {
+		f.reportStart = ts
+	}
+	f.last = ts
+	f.seen = time.Now()
+	f.packets[dir]++
+	f.bytes[dir] += uint64(size)
+
+	events := flows.evictFlows()
+	flows.lock.Unlock()
+
+	flows.publish(events)
+}
+
+// evictFlows removes the least recently active flows while there are more
+// than MaxFlows. The ones with packets since the last report are returned
+// to be published. The lock must be held.
+func (flows *Flows) evictFlows() []common.MapStr {
+	events := []common.MapStr{}
+	for flows.MaxFlows > 0 && len(flows.flows) > flows.MaxFlows {
+		f := flows.order.Front().Value.(*flow)
+		flows.remove(f)
+		flows.evicted++
+		if f.packets[0] > 0 || f.packets[1] > 0 {
+			events = append(events, f.toMapStr())
+		}
+	}
+	return events
+}
+
+func (flows *Flows) remove(f *flow) {
+	delete(flows.flows, f.key)
+	flows.order.Remove(f.element)
+}
+
+// Evicted returns the number of flows removed because there were more
+// than MaxFlows.
+func (flows *Flows) Evicted() uint64 {
+	flows.lock.Lock()
+	defer flows.lock.Unlock()
+	return flows.evicted
+}
+
+func (flows *Flows) publish(events []common.MapStr) {
+	if flows.results == nil {
+		return
+	}
+	for _, event := range events {
+		flows.results <- event
+	}
+}
+
+// Report publishes the flows that had packets since the last report, and
+// removes the ones inactive for longer than Timeout.
+func (flows *Flows) Report(now time.Time) {
+	flows.lock.Lock()
+	events := []common.MapStr{}
+	for _, f := range flows.flows {
+		if f.packets[0] > 0 || f.packets[1] > 0 {
+			events = append(events, f.toMapStr())
+			f.packets = [2]uint64{}
+			f.bytes = [2]uint64{}
+		}
+		if now.Sub(f.seen) > flows.Timeout {
+			flows.remove(f)
+		}
+	}
+	flows.lock.Unlock()
+
+	logp.Debug("flows", "Reporting %d flows", len(events))
+	flows.publish(events)
+}
+
+func (f *flow) toMapStr() common.MapStr {
+	event := common.MapStr{
+		"type":      "flow",
+		"status":    common.OK_STATUS,
+		"transport": f.transport,
+		"timestamp": common.Time(f.last),
+		"src": &common.Endpoint{
+			Ip:   f.tuple.Src_ip.String(),
+			Port: f.tuple.Src_port,
+		},
+		"dst": &common.Endpoint{
+			Ip:   f.tuple.Dst_ip.String(),
+			Port: f.tuple.Dst_port,
+		},
+		"flow": common.MapStr{
+			"start_time":  common.Time(f.reportStart),
+			"end_time":    common.Time(f.last),
+			"duration":    int32(f.last.Sub(f.reportStart).Nanoseconds() / 1e6),
+			"packets":     f.packets[0] + f.packets[1],
+			"bytes":       f.bytes[0] + f.bytes[1],
+			"src_packets": f.packets[0],
+			"src_bytes":   f.bytes[0],
+			"dst_packets": f.packets[1],
+			"dst_bytes":   f.bytes[1],
+		},
+	}
+	f.link.AddFields(event)
+	return event
+}
@@ -0,0 +1,177 @@
+package flows
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFlows(t *testing.T) *Flows {
+	var flows Flows
+	err := flows.Init(FlowsConfig{Enabled: true}, make(chan common.MapStr, 10))
+	assert.Nil(t, err)
+	return &flows
+}
+
+func newTuple(srcIp string, srcPort uint16, dstIp string, dstPort uint16) *common.IpPortTuple {
+	tuple := common.NewIpPortTuple(4,
+		net.ParseIP(srcIp).To4(), srcPort,
+		net.ParseIP(dstIp).To4(), dstPort)
+	return &tuple
+}
+
+// reported returns the flow events published, by transport and source
+// port.
+func reported(flows *Flows) map[string]common.MapStr {
+	events := map[string]common.MapStr{}
+	for len(flows.results) > 0 {
+		event := <-flows.results
+		key := fmt.Sprintf("%s:%d", event["transport"], event["src"].(*common.Endpoint).Port)
+		events[key] = event
+	}
+	return events
+}
+
+func TestFlows_totals(t *testing.T) {
+	flows := newFlows(t)
+	ts := time.Now()
+
+	request := newTuple("192.168.0.1", 6512, "192.168.0.2", 80)
+	response := newTuple("192.168.0.2", 80, "192.168.0.1", 6512)
+	query := newTuple("192.168.0.1", 53535, "8.8.8.8", 53)
+
+	flows.Record("tcp", request, protos.Link{}, 100, ts)
+	flows.Record("tcp", response, protos.Link{}, 1500, ts.Add(10*time.Millisecond))
+	flows.Record("tcp", response, protos.Link{}, 1500, ts.Add(20*time.Millisecond))
+	flows.Record("tcp", request, protos.Link{}, 60, ts.Add(30*time.Millisecond))
+	flows.Record("udp", query, protos.Link{}, 70, ts.Add(5*time.Millisecond))
+
+	// same ports, other transport
+	flows.Record("udp", request, protos.Link{}, 10, ts)
+
+	flows.Report(ts.Add(time.Second))
+	events := reported(flows)
+	if len(events) != 3 {
+		t.Fatalf("Expected three flows, got %d", len(events))
+	}
+
+	http := events["tcp:6512"]
+	assert.Equal(t, "flow", http["type"])
+	assert.Equal(t, "192.168.0.2", http["dst"].(*common.Endpoint).Ip)
+	assert.Equal(t, common.Time(ts.Add(30*time.Millisecond)), http["timestamp"])
+	assert.Equal(t, common.MapStr{
+		"start_time":  common.Time(ts),
+		"end_time":    common.Time(ts.Add(30 * time.Millisecond)),
+		"duration":    int32(30),
+		"packets":     uint64(4),
+		"bytes":       uint64(3160),
+		"src_packets": uint64(2),
+		"src_bytes":   uint64(160),
+		"dst_packets": uint64(2),
+		"dst_bytes":   uint64(3000),
+	}, http["flow"])
+
+	dns := events["udp:53535"]
+	assert.Equal(t, "udp", dns["transport"])
+	assert.Equal(t, uint64(1), dns["flow"].(common.MapStr)["packets"])
+	assert.Equal(t, uint64(70), dns["flow"].(common.MapStr)["bytes"])
+}
+
+func TestFlows_intervalsAndExpiry(t *testing.T) {
+	flows := newFlows(t)
+	ts := time.Now()
+
+	tuple := newTuple("192.168.0.1", 6512, "192.168.0.2", 80)
+	flows.Record("tcp", tuple, protos.Link{}, 100, ts)
+	flows.Report(ts.Add(time.Second))
+	assert.Equal(t, 1, len(reported(flows)))
+
+	// only the packets since the last report are counted
+	flows.Record("tcp", tuple, protos.Link{}, 200, ts.Add(2*time.Second))
+	flows.Record("tcp", tuple, protos.Link{}, 300, ts.Add(3*time.Second))
+	flows.Report(ts.Add(4 * time.Second))
+	event := reported(flows)["tcp:6512"]
+	details := event["flow"].(common.MapStr)
+	assert.Equal(t, uint64(500), details["bytes"])
+	assert.Equal(t, int32(1000), details["duration"])
+
+	// inactive, nothing to report
+	flows.Report(ts.Add(5 * time.Second))
+	assert.Equal(t, 0, len(reported(flows)))
+	assert.Equal(t, 1, len(flows.flows))
+
+	// expired
+	flows.Report(ts.Add(3*time.Second + DefaultTimeout + time.Second))
+	assert.Equal(t, 0, len(flows.flows))
+}
+
+func TestFlows_tunnels(t *testing.T) {
+	flows := newFlows(t)
+	ts := time.Now()
+
+	// the same addresses in two tunnels are two flows
+	tuple := newTuple("10.0.0.1", 6512, "10.0.0.2", 80)
+	flows.Record("tcp", tuple, protos.Link{Tunneled: true, TunnelId: 1}, 100, ts)
+	flows.Record("tcp", tuple, protos.Link{Tunneled: true, TunnelId: 2}, 200, ts)
+	flows.Report(ts.Add(time.Second))
+
+	tunnels := map[uint32]uint64{}
+	for len(flows.results) > 0 {
+		event := <-flows.results
+		tunnels[event["tunnel_id"].(uint32)] = event["flow"].(common.MapStr)["bytes"].(uint64)
+	}
+	assert.Equal(t, map[uint32]uint64{1: 100, 2: 200}, tunnels)
+}
+
+func TestFlows_maxFlows(t *testing.T) {
+	var flows Flows
+	maxFlows := 2
+	err := flows.Init(FlowsConfig{Enabled: true, Max_flows: &maxFlows}, make(chan common.MapStr, 10))
+	assert.Nil(t, err)
+	ts := time.Now()
+
+	first := newTuple("192.168.0.1", 1001, "192.168.0.2", 80)
+	second := newTuple("192.168.0.1", 1002, "192.168.0.2", 80)
+	third := newTuple("192.168.0.1", 1003, "192.168.0.2", 80)
+	flows.Record("tcp", first, protos.Link{}, 100, ts)
+	flows.Record("tcp", second, protos.Link{}, 100, ts.Add(time.Millisecond))
+	// the reply keeps the first flow active
+	flows.Record("tcp", newTuple("192.168.0.2", 80, "192.168.0.1", 1001), protos.Link{}, 100,
+		ts.Add(2*time.Millisecond))
+
+	// the least recently active flow is evicted, and published with its
+	// packets
+	flows.Record("tcp", third, protos.Link{}, 100, ts.Add(3*time.Millisecond))
+	assert.Equal(t, 2, len(flows.flows))
+	assert.Equal(t, uint64(1), flows.Evicted())
+	events := reported(&flows)
+	assert.Equal(t, 1, len(events))
+	assert.NotNil(t, events["tcp:1002"])
+
+	flows.Report(ts.Add(time.Second))
+	events = reported(&flows)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, uint64(2), events["tcp:1001"]["flow"].(common.MapStr)["packets"])
+	assert.NotNil(t, events["tcp:1003"])
+
+	maxFlows = -1
+	assert.NotNil(t, flows.Init(FlowsConfig{Max_flows: &maxFlows}, nil))
+}
+
+func TestFlows_disabled(t *testing.T) {
+	var flows Flows
+	assert.Nil(t, flows.Init(FlowsConfig{}, nil))
+
+	flows.Record("tcp", newTuple("192.168.0.1", 6512, "192.168.0.2", 80), protos.Link{}, 100, time.Now())
+	assert.Equal(t, 0, len(flows.flows))
+
+	period := 0
+	assert.NotNil(t, flows.Init(FlowsConfig{Period: &period}, nil))
+}
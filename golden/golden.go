@@ -0,0 +1,186 @@
+// Package golden compares the events produced from a capture file with
+// the expected events of a JSON file, so that the parsing of a
+// representative capture can be checked in CI after code changes.
+package golden
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+)
+
+// Load reads the expected events, a JSON array of objects. Each object
+// lists only the fields to compare.
+func Load(path string) ([]map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var expected []map[string]interface{}
+	if err = json.Unmarshal(content, &expected); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, expected an array of objects: %v", path, err)
+	}
+	return expected, nil
+}
+
+// Compare matches the events with the expected ones and returns the
+// mismatches, empty if all the events are expected. An event matches an
+// expected one if it has all its fields with the same values, the other
+// fields are ignored. The order of the events doesn't matter, each
+// expected event is matched with the first event not matched yet.
+func Compare(expected []map[string]interface{}, events []common.MapStr) []string {
+	actual := make([]interface{}, len(events))
+	for i, event := range events {
+		// the values of the events as in the published JSON
+		actual[i] = normalize(event)
+	}
+
+	mismatches := []string{}
+	matched := make([]bool, len(actual))
+	for i, fields := range expected {
+		found := false
+		for j, event := range actual {
+			if !matched[j] && matches(fields, event) {
+				matched[j] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			mismatches = append(mismatches,
+				fmt.Sprintf("Expected event %d not found: %s", i, encode(fields)))
+		}
+	}
+	for j, event := range actual {
+		if !matched[j] {
+			mismatches = append(mismatches,
+				fmt.Sprintf("Unexpected event: %s", encode(summary(event))))
+		}
+	}
+	return mismatches
+}
+
+func normalize(event common.MapStr) interface{} {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	var value interface{}
+	json.Unmarshal(content, &value)
+	return value
+}
+
+// matches tells whether the actual value has the expected fields, for the
+// objects, or is equal to the expected value.
+func matches(expected interface{}, actual interface{}) bool {
+	switch exp := expected.(type) {
+	case map[string]interface{}:
+		act, ok := actual.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, value := range exp {
+			field, exists := act[key]
+			if !exists || !matches(value, field) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		act, ok := actual.([]interface{})
+		if !ok || len(act) != len(exp) {
+			return false
+		}
+		for i := range exp {
+			if !matches(exp[i], act[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(expected, actual)
+}
+
+// summary keeps the fields identifying an unexpected event in the
+// mismatches.
+func summary(event interface{}) interface{} {
+	fields, ok := event.(map[string]interface{})
+	if !ok {
+		return event
+	}
+	res := map[string]interface{}{}
+	for _, key := range []string{"type", "status", "method", "path", "query", "src", "dst"} {
+		if value, exists := fields[key]; exists {
+			res[key] = value
+		}
+	}
+	return res
+}
+
+func encode(value interface{}) string {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(content)
+}
+
+// Recorder keeps a copy of the published events.
+type Recorder struct {
+	lock   sync.Mutex
+	events []common.MapStr
+	last   time.Time
+}
+
+// Record keeps a copy of the event, as it is published.
+func (recorder *Recorder) Record(event common.MapStr) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.events = append(recorder.events, copyMapStr(event))
+	recorder.last = time.Now()
+}
+
+// Wait returns once no event was recorded for the idle duration, or at
+// the deadline.
+func (recorder *Recorder) Wait(idle time.Duration, deadline time.Time) {
+	for time.Now().Before(deadline) {
+		recorder.lock.Lock()
+		last := recorder.last
+		recorder.lock.Unlock()
+		if time.Since(last) >= idle {
+			return
+		}
+		time.Sleep(idle / 10)
+	}
+}
+
+// Events returns the recorded events.
+func (recorder *Recorder) Events() []common.MapStr {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	return append([]common.MapStr{}, recorder.events...)
+}
+
+// the outputs can modify the events, like adding the shipper name
+func copyMapStr(event common.MapStr) common.MapStr {
+	res := common.MapStr{}
+	for key, value := range event {
+		res[key] = value
+	}
+	return res
+}
+
+// Report writes the result of the comparison, one line by mismatch.
+func Report(path string, events int, mismatches []string) string {
+	if len(mismatches) == 0 {
+		return fmt.Sprintf("%d events match %s\n", events, path)
+	}
+	return fmt.Sprintf("%d events don't match %s:\n%s\n", events, path,
+		strings.Join(mismatches, "\n"))
+}
@@ -0,0 +1,92 @@
+package golden
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/pipeline"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/mysql"
+	"github.com/johann8384/packetbeat/protos/tcp"
+	"github.com/johann8384/packetbeat/sniffer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// replay reads the capture file with the MySQL plugin and returns the
+// recorded events.
+func replay(t *testing.T, file string) []common.MapStr {
+	published := make(chan common.MapStr, 100)
+	recorder := new(Recorder)
+	events := pipeline.Chain{pipeline.Update(recorder.Record)}.Queue(published)
+
+	mysqlMod := &mysql.Mysql{}
+	mysqlMod.Init(true, events)
+	mysqlMod.Ports = []int{3306}
+	protos.Protos.Register(protos.MysqlProtocol, mysqlMod)
+	defer protos.Protos.Unregister(protos.MysqlProtocol)
+	if err := tcp.TcpInit(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := config.ConfigSingleton.Interfaces
+	defer func() { config.ConfigSingleton.Interfaces = saved }()
+	config.ConfigSingleton.Interfaces = config.InterfacesConfig{File: file, TopSpeed: true, Loop: 1}
+
+	sniff := new(sniffer.SnifferSetup)
+	if err := sniff.Init(false, events); err != nil {
+		t.Fatal(err)
+	}
+	defer sniff.Close()
+	if err := sniff.Run(); err != nil {
+		t.Fatalf("Replaying %s failed: %v", file, err)
+	}
+
+	recorder.Wait(50*time.Millisecond, time.Now().Add(2*time.Second))
+	return recorder.Events()
+}
+
+func TestGolden_pcap(t *testing.T) {
+	expected, err := Load("../tests/golden/mysql_affected_rows.json")
+	assert.Nil(t, err)
+
+	events := replay(t, "../tests/pcaps/mysql_affected_rows.pcap")
+	assert.Equal(t, []string{}, Compare(expected, events))
+
+	// a changed parser gives other values
+	expected[0]["mysql"].(map[string]interface{})["affected_rows"] = 315.0
+	mismatches := Compare(expected, events)
+	if len(mismatches) != 2 {
+		t.Fatalf("Expected two mismatches, got %v", mismatches)
+	}
+	assert.Contains(t, mismatches[0], "Expected event 0 not found")
+	assert.Contains(t, mismatches[1], "Unexpected event")
+}
+
+func TestGolden_compare(t *testing.T) {
+	events := []common.MapStr{
+		{"type": "http", "status": "OK", "http": common.MapStr{"code": 200},
+			"dst": &common.Endpoint{Ip: "10.0.0.1", Port: 80}},
+		{"type": "dns", "dns": common.MapStr{"answers": []common.MapStr{{"name": "a"}}}},
+	}
+
+	expected := []map[string]interface{}{
+		{"type": "dns", "dns": map[string]interface{}{
+			"answers": []interface{}{map[string]interface{}{"name": "a"}}}},
+		{"http": map[string]interface{}{"code": 200.0}, "dst": map[string]interface{}{"Port": 80.0}},
+	}
+	assert.Equal(t, []string{}, Compare(expected, events))
+
+	// a missing field and a missing event
+	expected = []map[string]interface{}{
+		{"type": "http", "http": map[string]interface{}{"phrase": "OK"}},
+	}
+	assert.Equal(t, 3, len(Compare(expected, events)))
+
+	// too many expected events
+	expected = []map[string]interface{}{{"type": "dns"}, {"type": "dns"}}
+	assert.Equal(t, []string{`Expected event 1 not found: {"type":"dns"}`},
+		Compare(expected, events[1:]))
+}
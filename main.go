@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -22,42 +23,174 @@ import (
 	"github.com/johann8384/libbeat/logp"
 	"github.com/johann8384/libbeat/publisher"
 
+	"github.com/johann8384/packetbeat/anonymize"
+	"github.com/johann8384/packetbeat/breaker"
 	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/endpoints"
+	pbfilters "github.com/johann8384/packetbeat/filters"
+	"github.com/johann8384/packetbeat/filters/drop"
+	"github.com/johann8384/packetbeat/filters/fields"
+	"github.com/johann8384/packetbeat/filters/geoip"
+	"github.com/johann8384/packetbeat/filters/hash"
+	"github.com/johann8384/packetbeat/filters/mutate"
+	"github.com/johann8384/packetbeat/filters/sampling"
+	"github.com/johann8384/packetbeat/flows"
+	"github.com/johann8384/packetbeat/golden"
+	"github.com/johann8384/packetbeat/metrics"
+	"github.com/johann8384/packetbeat/networks"
+	"github.com/johann8384/packetbeat/observer"
+	"github.com/johann8384/packetbeat/payloads"
+	"github.com/johann8384/packetbeat/pipeline"
 	"github.com/johann8384/packetbeat/procs"
 	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/dns"
 	"github.com/johann8384/packetbeat/protos/http"
+	"github.com/johann8384/packetbeat/protos/icmp"
+	"github.com/johann8384/packetbeat/protos/memcache"
+	"github.com/johann8384/packetbeat/protos/mongodb"
 	"github.com/johann8384/packetbeat/protos/mysql"
 	"github.com/johann8384/packetbeat/protos/pgsql"
 	"github.com/johann8384/packetbeat/protos/redis"
 	"github.com/johann8384/packetbeat/protos/tcp"
 	"github.com/johann8384/packetbeat/protos/thrift"
+	"github.com/johann8384/packetbeat/protos/tls"
+	"github.com/johann8384/packetbeat/protos/udp"
+	"github.com/johann8384/packetbeat/responsetimes"
+	"github.com/johann8384/packetbeat/retention"
 	"github.com/johann8384/packetbeat/sniffer"
+	"github.com/johann8384/packetbeat/timestamps"
 )
 
 const Version = "1.0.0.Beta1"
 
 var EnabledProtocolPlugins map[protos.Protocol]protos.ProtocolPlugin = map[protos.Protocol]protos.ProtocolPlugin{
-	protos.HttpProtocol:   new(http.Http),
-	protos.MysqlProtocol:  new(mysql.Mysql),
-	protos.PgsqlProtocol:  new(pgsql.Pgsql),
-	protos.RedisProtocol:  new(redis.Redis),
-	protos.ThriftProtocol: new(thrift.Thrift),
+	protos.HttpProtocol:     new(http.Http),
+	protos.MysqlProtocol:    new(mysql.Mysql),
+	protos.PgsqlProtocol:    new(pgsql.Pgsql),
+	protos.RedisProtocol:    new(redis.Redis),
+	protos.ThriftProtocol:   new(thrift.Thrift),
+	protos.DnsProtocol:      new(dns.Dns),
+	protos.MongodbProtocol:  new(mongodb.Mongodb),
+	protos.MemcacheProtocol: new(memcache.Memcache),
+	protos.TlsProtocol:      new(tls.Tls),
+	protos.IcmpProtocol:     new(icmp.Icmp),
 }
 
 var EnabledFilterPlugins map[filters.Filter]filters.FilterPlugin = map[filters.Filter]filters.FilterPlugin{
-	filters.NopFilter: new(nop.Nop),
+	filters.NopFilter:    new(nop.Nop),
+	filters.SampleFilter: new(sampling.Sampling),
+
+	pbfilters.FieldsFilter: new(fields.Fields),
+	pbfilters.GeoipFilter:  new(geoip.Geoip),
+	pbfilters.DropFilter:   new(drop.Drop),
+	pbfilters.MutateFilter: new(mutate.Mutate),
+	pbfilters.HashFilter:   new(hash.Hash),
 }
 
-func writeHeapProfile(filename string) {
+func writeHeapProfile(filename string) error {
 	f, err := os.Create(filename)
 	if err != nil {
 		logp.Err("Failed creating file %s: %s", filename, err)
-		return
+		return err
 	}
-	pprof.WriteHeapProfile(f)
+	err = pprof.WriteHeapProfile(f)
 	f.Close()
+	if err != nil {
+		logp.Err("Failed writing memory profile file %s: %s", filename, err)
+		return err
+	}
 
 	logp.Info("Created memory profile file %s.", filename)
+	return nil
+}
+
+// enabledProtocols returns the plugins of the protocols that are not
+// disabled in the configuration.
+func enabledProtocols(plugins map[protos.Protocol]protos.ProtocolPlugin,
+	protocols *config.Protocols) map[protos.Protocol]protos.ProtocolPlugin {
+
+	enabled := map[protos.Protocol]protos.ProtocolPlugin{}
+	for proto, plugin := range plugins {
+		if !protocols.IsEnabled(proto.String()) {
+			logp.Info("Protocol %s disabled", proto)
+			continue
+		}
+		enabled[proto] = plugin
+	}
+	return enabled
+}
+
+// captureDevices returns the devices the packets are captured on, with
+// the defaults of the sniffer. It is empty when a file is read.
+func captureDevices(interfaces config.InterfacesConfig) []string {
+	if len(interfaces.File) > 0 {
+		return nil
+	}
+	if len(interfaces.Devices) > 0 {
+		return interfaces.Devices
+	}
+	if len(interfaces.Device) > 0 {
+		return []string{interfaces.Device}
+	}
+	return []string{"any"}
+}
+
+// registerMetrics adds the transactions waiting for their response, the
+// TCP streams and the libpcap counters to the metrics.
+func registerMetrics(registry *metrics.Metrics, sniff *sniffer.SnifferSetup) {
+	registry.Register("packetbeat_transactions_in_flight",
+		"Transactions waiting for their response, by protocol.", metrics.Gauge, "protocol",
+		func() map[string]float64 {
+			values := map[string]float64{}
+			sniffer.PauseDecoding(func() {
+				for proto, plugin := range protos.Protos.GetAll() {
+					if counter, ok := plugin.(protos.InFlightProtocolPlugin); ok {
+						values[proto.String()] = float64(counter.TransactionsInFlight())
+					}
+				}
+			})
+			return values
+		})
+
+	registry.Register("packetbeat_tcp_streams",
+		"TCP streams tracked by the reassembly.", metrics.Gauge, "",
+		func() map[string]float64 {
+			var streams int
+			sniffer.PauseDecoding(func() { streams = tcp.Streams() })
+			return map[string]float64{"": float64(streams)}
+		})
+	registry.Register("packetbeat_tcp_streams_reaped_total",
+		"Idle TCP streams released by the reaper.", metrics.Counter, "",
+		func() map[string]float64 {
+			var reaped uint64
+			sniffer.PauseDecoding(func() { reaped = tcp.ReapedStreams() })
+			return map[string]float64{"": float64(reaped)}
+		})
+
+	registry.Register("packetbeat_flows_evicted_total",
+		"Flows removed because there were more than max_flows.", metrics.Counter, "",
+		func() map[string]float64 {
+			return map[string]float64{"": float64(flows.FlowAccounting.Evicted())}
+		})
+
+	captureCounter := func(value func(stats sniffer.CaptureStats) int) metrics.Values {
+		return func() map[string]float64 {
+			values := map[string]float64{}
+			for device, stats := range sniff.CaptureStats() {
+				values[device] = float64(value(stats))
+			}
+			return values
+		}
+	}
+	registry.Register("packetbeat_pcap_packets_received_total",
+		"Packets received by libpcap, by device.", metrics.Counter, "device",
+		captureCounter(func(stats sniffer.CaptureStats) int { return stats.Received }))
+	registry.Register("packetbeat_pcap_packets_dropped_total",
+		"Packets dropped by libpcap, by device.", metrics.Counter, "device",
+		captureCounter(func(stats sniffer.CaptureStats) int { return stats.Dropped }))
+	registry.Register("packetbeat_pcap_packets_if_dropped_total",
+		"Packets dropped by the network interface, by device.", metrics.Counter, "device",
+		captureCounter(func(stats sniffer.CaptureStats) int { return stats.IfDropped }))
 }
 
 func debugMemStats() {
@@ -73,7 +206,7 @@ func main() {
 	var cmdLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 
 	configfile := cmdLine.String("c", "/etc/packetbeat/packetbeat.yml", "Configuration file")
-	file := cmdLine.String("I", "", "file")
+	file := cmdLine.String("I", "", "Read packets from this libpcap or pcapng file, which can be gzipped, or from stdin with -")
 	loop := cmdLine.Int("l", 1, "Loop file. 0 - loop forever")
 	debugSelectorsStr := cmdLine.String("d", "", "Enable certain debug selectors")
 	oneAtAtime := cmdLine.Bool("O", false, "Read packets one at a time (press Enter)")
@@ -84,8 +217,11 @@ func main() {
 	printVersion := cmdLine.Bool("version", false, "Print version and exit")
 	memprofile := cmdLine.String("memprofile", "", "Write memory profile to this file")
 	cpuprofile := cmdLine.String("cpuprofile", "", "Write cpu profile to file")
+	profiledir := cmdLine.String("profiledir", os.TempDir(), "Write a heap profile and a goroutine dump to this directory on SIGUSR1")
 	dumpfile := cmdLine.String("dump", "", "Write all captured packets to this libpcap file.")
 	testConfig := cmdLine.Bool("test", false, "Test configuration and exit.")
+	parseStats := cmdLine.Bool("stats", false, "Print the packets, transactions and dropped streams by protocol after reading the file given with -I.")
+	goldenFile := cmdLine.String("golden", "", "Compare the events produced from the file given with -I with the expected events of this JSON file, and exit with 1 on a mismatch.")
 
 	cmdLine.Parse(os.Args[1:])
 
@@ -114,6 +250,7 @@ func main() {
 		fmt.Printf("Fail to read %s: %s. Exiting.\n", *configfile, err)
 		return
 	}
+	filecontent = config.ExpandEnv(filecontent)
 	if err = yaml.Unmarshal(filecontent, &config.ConfigSingleton); err != nil {
 		fmt.Printf("YAML config parsing failed on %s: %s. Exiting.\n", *configfile, err)
 		return
@@ -129,17 +266,50 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	// CLI flags over-riding config
-	if *topSpeed {
-		config.ConfigSingleton.Interfaces.TopSpeed = true
+	// CLI flags over-riding config, also applied to the reloaded
+	// configuration
+	overrideConfig := func(cfg *config.Config) {
+		if *topSpeed {
+			cfg.Interfaces.TopSpeed = true
+		}
+		if len(*file) > 0 {
+			cfg.Interfaces.File = *file
+		}
+		cfg.Interfaces.Loop = *loop
+		cfg.Interfaces.OneAtATime = *oneAtAtime
+		if len(*dumpfile) > 0 {
+			cfg.Interfaces.Dumpfile = *dumpfile
+		}
+		// the payloads of the sampled transactions are captured by
+		// the plugins
+		cfg.Protocols.EnableSampledPayloads()
 	}
-	if len(*file) > 0 {
-		config.ConfigSingleton.Interfaces.File = *file
+	overrideConfig(&config.ConfigSingleton)
+
+	if *parseStats {
+		if len(config.ConfigSingleton.Interfaces.File) == 0 {
+			logp.Critical("The -stats flag needs a file to read, given with -I")
+			os.Exit(1)
+		}
+		// dry run, the events are only counted
+		*publishDisabled = true
 	}
-	config.ConfigSingleton.Interfaces.Loop = *loop
-	config.ConfigSingleton.Interfaces.OneAtATime = *oneAtAtime
-	if len(*dumpfile) > 0 {
-		config.ConfigSingleton.Interfaces.Dumpfile = *dumpfile
+
+	var expected []map[string]interface{}
+	var recorder *golden.Recorder
+	if len(*goldenFile) > 0 {
+		if len(config.ConfigSingleton.Interfaces.File) == 0 {
+			logp.Critical("The -golden flag needs a file to read, given with -I")
+			os.Exit(1)
+		}
+		expected, err = golden.Load(*goldenFile)
+		if err != nil {
+			logp.Critical(err.Error())
+			os.Exit(1)
+		}
+		// dry run, the events are only compared
+		*publishDisabled = true
+		recorder = new(golden.Recorder)
 	}
 
 	logp.Debug("main", "Configuration %s", config.ConfigSingleton)
@@ -156,23 +326,6 @@ func main() {
 		os.Exit(1)
 	}
 
-	logp.Debug("main", "Initializing protocol plugins")
-	for proto, plugin := range EnabledProtocolPlugins {
-		err = plugin.Init(false, publisher.Publisher.Queue)
-		if err != nil {
-			logp.Critical("Initializing plugin %s failed: %v", proto, err)
-			os.Exit(1)
-		}
-		protos.Protos.Register(proto, plugin)
-	}
-
-	if err = tcp.TcpInit(); err != nil {
-		logp.Critical(err.Error())
-		os.Exit(1)
-	}
-
-	over := make(chan bool)
-
 	logp.Debug("main", "Initializing filters plugins")
 	for filter, plugin := range EnabledFilterPlugins {
 		filters.Filters.Register(filter, plugin)
@@ -183,10 +336,146 @@ func main() {
 		logp.Critical("Error loading filters plugins: %v", err)
 		os.Exit(1)
 	}
+	filtersOnError, err := LoadFiltersOnError(config.ConfigSingleton.Filter)
+	if err != nil {
+		logp.Critical("Error loading filters plugins: %v", err)
+		os.Exit(1)
+	}
+	filtersWorkers, err := LoadFiltersWorkers(config.ConfigSingleton.Filter)
+	if err != nil {
+		logp.Critical("Error loading filters plugins: %v", err)
+		os.Exit(1)
+	}
+	filtersQueueSize, err := LoadFiltersQueueSize(config.ConfigSingleton.Filter)
+	if err != nil {
+		logp.Critical("Error loading filters plugins: %v", err)
+		os.Exit(1)
+	}
+	filtersQueuePolicy, err := LoadFiltersQueuePolicy(config.ConfigSingleton.Filter)
+	if err != nil {
+		logp.Critical("Error loading filters plugins: %v", err)
+		os.Exit(1)
+	}
 	logp.Debug("main", "Filters plugins order: %v", filters_plugins)
-	var afterInputsQueue chan common.MapStr
+
+	var registry *metrics.Metrics
+	if len(config.ConfigSingleton.Metrics.Address) > 0 {
+		registry = metrics.New()
+		publisher.Publisher.Output = registry.WrapOutputs(publisher.Publisher.Output)
+	}
+
+	// The events published by the protocol plugins go through the
+	// processors counting them, recording their response times, adding
+	// the containers, sampling the payloads and adding the retention and
+	// the direction, then through the filters, then through the
+	// processors adding the observer and the timestamps, anonymizing the
+	// addresses, holding the events back while the output is saturated,
+	// counting them and replacing the endpoints by the src and dst
+	// objects, before reaching the publisher. The processors run in order
+	// in a single stage, or in one stage on each side of the filters.
+	processors := pipeline.Chain{}
+	if *parseStats {
+		processors = append(processors, pipeline.Update(protos.Stats.CountTransaction))
+	}
+	responseTimes := new(responsetimes.ResponseTimes)
+	if config.ConfigSingleton.Response_times.Enabled {
+		processors = append(processors, pipeline.Update(responseTimes.Record))
+	}
+	if procs.ProcWatcher.Containers {
+		processors = append(processors, pipeline.Update(procs.ProcWatcher.AddContainers))
+	}
+	sampler, err := payloads.New(config.ConfigSingleton.Protocols.Option("Payload_sample_rate"))
+	if err != nil {
+		logp.Critical(err.Error())
+		os.Exit(1)
+	}
+	retentions, err := retention.New(config.ConfigSingleton.Protocols.Option("Retention"))
+	if err != nil {
+		logp.Critical(err.Error())
+		os.Exit(1)
+	}
+	processors = append(processors, pipeline.Update(sampler.Sample),
+		pipeline.Update(retentions.AddRetention))
+	if len(config.ConfigSingleton.Networks) > 0 {
+		internal, err := networks.New(config.ConfigSingleton.Networks)
+		if err != nil {
+			logp.Critical(err.Error())
+			os.Exit(1)
+		}
+		processors = append(processors, pipeline.Update(internal.AddDirection))
+	}
+
+	obs, err := observer.New(config.ConfigSingleton.Observer,
+		captureDevices(config.ConfigSingleton.Interfaces))
+	if err != nil {
+		logp.Critical(err.Error())
+		os.Exit(1)
+	}
+	published := pipeline.Chain{pipeline.Update(obs.AddObserver)}
+	var stamps *timestamps.Timestamps
+	if len(config.ConfigSingleton.Timestamps.Mode) > 0 {
+		stamps, err = timestamps.New(config.ConfigSingleton.Timestamps)
+		if err != nil {
+			logp.Critical(err.Error())
+			os.Exit(1)
+		}
+		published = append(published, stamps.StampEvent)
+	}
+	if len(config.ConfigSingleton.Anonymize_ips.Mode) > 0 {
+		anonymizer, err := anonymize.New(config.ConfigSingleton.Anonymize_ips)
+		if err != nil {
+			logp.Critical(err.Error())
+			os.Exit(1)
+		}
+		published = append(published, pipeline.Update(anonymizer.AnonymizeEvent))
+	}
+	var outputBreaker *breaker.Breaker
+	if len(config.ConfigSingleton.Output_breaker.Policy) > 0 {
+		outputBreaker, err = breaker.New(config.ConfigSingleton.Output_breaker)
+		if err != nil {
+			logp.Critical(err.Error())
+			os.Exit(1)
+		}
+		published = append(published, outputBreaker.Guard(publisher.Publisher.Queue))
+		if registry != nil {
+			registry.Register("packetbeat_output_breaker_dropped_total",
+				"Events dropped while the output queue was saturated.", metrics.Counter, "",
+				func() map[string]float64 {
+					return map[string]float64{"": float64(outputBreaker.Dropped())}
+				})
+		}
+	}
+	if registry != nil {
+		published = append(published, pipeline.Update(registry.CountPublished))
+	}
+	if recorder != nil {
+		published = append(published, pipeline.Update(recorder.Record))
+	}
+	shipperName := config.ConfigSingleton.Shipper.Name
+	if len(shipperName) == 0 {
+		shipperName, _ = os.Hostname()
+	}
+	published = append(published, (&endpoints.Endpoints{
+		Shipper:        shipperName,
+		IgnoreOutgoing: publisher.Publisher.IgnoreOutgoing,
+		ServerName:     publisher.Publisher.GetServerName,
+	}).Publish)
+
+	var results, filtered chan common.MapStr
+	var runner *FilterRunner
 	if len(filters_plugins) > 0 {
-		runner := NewFilterRunner(publisher.Publisher.Queue, filters_plugins)
+		filtered = published.Queue(publisher.Publisher.Queue)
+		runner = NewFilterRunner(filtered, filters_plugins)
+		runner.SetOnError(filtersOnError)
+		runner.Workers = filtersWorkers
+		runner.SetQueue(filtersQueueSize, filtersQueuePolicy)
+		if registry != nil {
+			registry.Register("packetbeat_filters_queue_dropped_total",
+				"Events dropped because the queue of the filters was full.", metrics.Counter, "",
+				func() map[string]float64 {
+					return map[string]float64{"": float64(runner.Stats().QueueDropped)}
+				})
+		}
 		go func() {
 			err := runner.Run()
 			if err != nil {
@@ -195,14 +484,64 @@ func main() {
 				sniff.Stop()
 			}
 		}()
-		afterInputsQueue = runner.FiltersQueue
+		results = processors.Queue(runner.FiltersQueue)
 	} else {
-		// short-circuit the runner
-		afterInputsQueue = publisher.Publisher.Queue
+		results = append(processors, published...).Queue(publisher.Publisher.Queue)
+	}
+
+	err = responseTimes.Init(config.ConfigSingleton.Response_times, results)
+	if err != nil {
+		logp.Critical(err.Error())
+		os.Exit(1)
+	}
+
+	if err = protos.ParseErrors.Init(config.ConfigSingleton.Parse_errors, results); err != nil {
+		logp.Critical(err.Error())
+		os.Exit(1)
+	}
+
+	if err = flows.FlowAccounting.Init(config.ConfigSingleton.Flows, results); err != nil {
+		logp.Critical(err.Error())
+		os.Exit(1)
+	}
+
+	logp.Debug("main", "Initializing protocol plugins")
+	active := []string{}
+	for proto, plugin := range enabledProtocols(EnabledProtocolPlugins, &config.ConfigSingleton.Protocols) {
+		err = plugin.Init(false, results)
+		if err != nil {
+			logp.Critical("Initializing plugin %s failed: %v", proto, err)
+			os.Exit(1)
+		}
+		protos.Protos.Register(proto, plugin)
+		active = append(active, proto.String())
+	}
+	sort.Strings(active)
+	logp.Info("Active protocols: %s", strings.Join(active, ", "))
+
+	if err = tcp.TcpInit(); err != nil {
+		logp.Critical(err.Error())
+		os.Exit(1)
+	}
+
+	if err = udp.UdpInit(); err != nil {
+		logp.Critical(err.Error())
+		os.Exit(1)
+	}
+
+	over := make(chan bool)
+
+	reloader := &configReloader{
+		configfile:   *configfile,
+		override:     overrideConfig,
+		bpfGenerated: len(config.ConfigSingleton.Interfaces.Bpf_filter) == 0,
+		results:      results,
+		runner:       runner,
+		options:      []*pipeline.Options{sampler.Options, retentions.Options},
 	}
 
 	logp.Debug("main", "Initializing sniffer")
-	err = sniff.Init(false, afterInputsQueue)
+	err = sniff.Init(false, results)
 	if err != nil {
 		logp.Critical("Initializing sniffer failed: %v", err)
 		os.Exit(1)
@@ -221,6 +560,11 @@ func main() {
 		os.Exit(0)
 	}
 
+	if registry != nil {
+		registerMetrics(registry, sniff)
+		go registry.Serve(config.ConfigSingleton.Metrics.Address)
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -230,6 +574,10 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	flows.FlowAccounting.Start()
+	responseTimes.Start()
+	tcp.StartReaper(sniffer.PauseDecoding)
+
 	// run the sniffer in background
 	go func() {
 		err := sniff.Run()
@@ -243,12 +591,29 @@ func main() {
 	// On ^C or SIGTERM, gracefully stop the sniffer
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan bool, 1)
 	go func() {
 		<-sigc
 		logp.Debug("signal", "Received sigterm/sigint, stopping")
+		stopped <- true
 		sniff.Stop()
 	}()
 
+	// On SIGHUP, reload the configuration without stopping the sniffer
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for _ = range sighup {
+			logp.Info("Received sighup, reloading %s", *configfile)
+			if err := reloader.Reload(); err != nil {
+				logp.Err("Reloading the configuration failed: %v", err)
+			}
+		}
+	}()
+
+	// On SIGUSR1, write the profiles without stopping the sniffer
+	notifyProfiles(*profiledir)
+
 	if !*toStderr {
 		logp.Info("Startup successful, sending output only to syslog from now on")
 		logp.SetToStderr(false)
@@ -263,11 +628,75 @@ func main() {
 		}
 	}
 
+	select {
+	case <-stopped:
+		logp.Debug("main", "Draining the in-flight transactions")
+		queues := []chan common.MapStr{results}
+		if runner != nil {
+			queues = append(queues, runner.Queues()...)
+			queues = append(queues, filtered)
+		}
+		queues = append(queues, publisher.Publisher.Queue)
+		sniffer.PauseDecoding(func() {
+			if flows.FlowAccounting.Enabled {
+				flows.FlowAccounting.Report(time.Now())
+			}
+			if responseTimes.Enabled {
+				responseTimes.Report(time.Now())
+			}
+			drainEvents(protos.Protos.GetAll(), config.ConfigSingleton.Output,
+				queues...)
+		})
+	default:
+	}
+
+	if *parseStats {
+		drainQueues(time.Now().Add(shutdownTimeout), results)
+		printParseStats(os.Stdout, sniff.Packets(), protos.Protos.GetAll(),
+			protos.Stats.Get(), transactionsInFlight(protos.Protos.GetAll()))
+	}
+
+	if recorder != nil {
+		drainQueues(time.Now().Add(shutdownTimeout), results)
+		recorder.Wait(goldenIdleTime, time.Now().Add(shutdownTimeout))
+		events := recorder.Events()
+		mismatches := golden.Compare(expected, events)
+		fmt.Print(golden.Report(*goldenFile, len(events), mismatches))
+		if len(mismatches) > 0 {
+			os.Exit(1)
+		}
+	}
+
+	if outputBreaker != nil && outputBreaker.Dropped() > 0 {
+		logp.Info("Output breaker: %d events dropped while the output queue was saturated",
+			outputBreaker.Dropped())
+	}
+
+	if flows.FlowAccounting.Evicted() > 0 {
+		logp.Info("Flows: %d flows evicted because there were more than max_flows",
+			flows.FlowAccounting.Evicted())
+	}
+
+	if stamps != nil && stamps.Dropped() > 0 {
+		logp.Info("Timestamps: %d events dropped for being older than max_age",
+			stamps.Dropped())
+	}
+
+	if runner != nil {
+		stats := runner.Stats()
+		logp.Info("Filters: %d events received, %d published, %d dropped, %d errors %v",
+			stats.Received, stats.Published, stats.Dropped, stats.Errors, stats.FilterErrors)
+		if stats.QueueDropped > 0 {
+			logp.Info("Filters: %d events dropped because the queue was full",
+				stats.QueueDropped)
+		}
+	}
+
 	logp.Debug("main", "Cleanup")
 
 	if *memprofile != "" {
 		// wait for all TCP streams to expire
-		time.Sleep(tcp.TCP_STREAM_EXPIRY * 1.2)
+		time.Sleep((tcp.StreamExpiry + tcp.ReaperInterval) * 12 / 10)
 		tcp.PrintTcpMap()
 		runtime.GC()
 
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnabledProtocols(t *testing.T) {
+	disabled := false
+	enabled := true
+	protocols := config.Protocols{
+		Http:  config.Http{Enabled: &enabled, Ports: []int{80}},
+		Mysql: config.Mysql{Enabled: &disabled, Ports: []int{3306}},
+		Redis: config.Redis{Enabled: &disabled},
+		Icmp:  config.Icmp{Enabled: &disabled},
+	}
+
+	plugins := enabledProtocols(EnabledProtocolPlugins, &protocols)
+
+	assert.NotNil(t, plugins[protos.HttpProtocol])
+	assert.Nil(t, plugins[protos.MysqlProtocol])
+	assert.Nil(t, plugins[protos.RedisProtocol])
+	assert.Nil(t, plugins[protos.IcmpProtocol])
+
+	// enabled unless disabled explicitly
+	assert.NotNil(t, plugins[protos.PgsqlProtocol])
+	assert.NotNil(t, plugins[protos.DnsProtocol])
+	assert.Equal(t, len(EnabledProtocolPlugins)-3, len(plugins))
+}
+
+// Test that every protocol publishes its in-flight transactions on
+// shutdown.
+func TestEnabledProtocols_flushable(t *testing.T) {
+	for proto, plugin := range EnabledProtocolPlugins {
+		_, ok := plugin.(protos.FlushableProtocolPlugin)
+		assert.True(t, ok, "%s doesn't flush its transactions on shutdown", proto)
+	}
+}
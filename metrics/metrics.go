@@ -0,0 +1,234 @@
+// Package metrics serves counters and gauges about the shipper, like the
+// events published per protocol or the packets dropped by libpcap, in the
+// Prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+	"github.com/johann8384/libbeat/outputs"
+)
+
+type MetricsConfig struct {
+	// The metrics are served on the /metrics path of this address, like
+	// localhost:9479. Nothing is served when it is empty.
+	Address string
+}
+
+// Types of the metrics.
+const (
+	Counter = "counter"
+	Gauge   = "gauge"
+)
+
+// ContentType of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4"
+
+// Values returns the current values of a metric, by value of its label.
+// The metrics without label have a single value, for the empty string.
+type Values func() map[string]float64
+
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	label  string
+	values Values
+}
+
+type Metrics struct {
+	lock    sync.Mutex
+	metrics map[string]*metric
+
+	// counted by CountPublished and the outputs
+	published    map[string]uint64
+	outputErrors uint64
+}
+
+// New creates the metrics with the counters of the published events and
+// of the output errors, and the memory gauges.
+func New() *Metrics {
+	m := &Metrics{
+		metrics:   map[string]*metric{},
+		published: map[string]uint64{},
+	}
+
+	m.Register("packetbeat_events_published_total",
+		"Events sent to the outputs, by protocol.", Counter, "protocol",
+		m.publishedValues)
+	m.Register("packetbeat_output_errors_total",
+		"Errors returned by the outputs when publishing an event.", Counter, "",
+		m.outputErrorsValues)
+
+	m.Register("packetbeat_memory_alloc_bytes",
+		"Bytes allocated and not yet freed.", Gauge, "",
+		memStat(func(stats *runtime.MemStats) uint64 { return stats.Alloc }))
+	m.Register("packetbeat_memory_sys_bytes",
+		"Bytes obtained from the system.", Gauge, "",
+		memStat(func(stats *runtime.MemStats) uint64 { return stats.Sys }))
+	m.Register("packetbeat_memory_heap_objects",
+		"Number of allocated objects.", Gauge, "",
+		memStat(func(stats *runtime.MemStats) uint64 { return stats.HeapObjects }))
+	m.Register("packetbeat_goroutines",
+		"Number of goroutines.", Gauge, "",
+		func() map[string]float64 {
+			return map[string]float64{"": float64(runtime.NumGoroutine())}
+		})
+
+	return m
+}
+
+func memStat(value func(stats *runtime.MemStats) uint64) Values {
+	return func() map[string]float64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return map[string]float64{"": float64(value(&stats))}
+	}
+}
+
+// Register adds a metric. The label is the name of the label telling apart
+// the values, or empty if the metric has a single value. A metric
+// registered again is replaced.
+func (m *Metrics) Register(name string, help string, kind string, label string, values Values) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.metrics[name] = &metric{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		label:  label,
+		values: values,
+	}
+}
+
+// CountPublished counts an event sent to the outputs, by its type.
+func (m *Metrics) CountPublished(event common.MapStr) {
+	protocol, ok := event["type"].(string)
+	if !ok {
+		protocol = "unknown"
+	}
+
+	m.lock.Lock()
+	m.published[protocol]++
+	m.lock.Unlock()
+}
+
+func (m *Metrics) publishedValues() map[string]float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	values := map[string]float64{}
+	for protocol, count := range m.published {
+		values[protocol] = float64(count)
+	}
+	return values
+}
+
+func (m *Metrics) outputErrorsValues() map[string]float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return map[string]float64{"": float64(m.outputErrors)}
+}
+
+// countingOutput counts the errors returned by an output.
+type countingOutput struct {
+	outputs.OutputInterface
+	metrics *Metrics
+}
+
+func (out *countingOutput) PublishEvent(ts time.Time, event common.MapStr) error {
+	err := out.OutputInterface.PublishEvent(ts, event)
+	if err != nil {
+		out.metrics.lock.Lock()
+		out.metrics.outputErrors++
+		out.metrics.lock.Unlock()
+	}
+	return err
+}
+
+// WrapOutputs returns the outputs counting their errors. The errors of
+// the outputs sending the events asynchronously, like the bulk requests
+// of the Elasticsearch output, are only logged by them.
+func (m *Metrics) WrapOutputs(outs []outputs.OutputInterface) []outputs.OutputInterface {
+	wrapped := []outputs.OutputInterface{}
+	for _, out := range outs {
+		wrapped = append(wrapped, &countingOutput{OutputInterface: out, metrics: m})
+	}
+	return wrapped
+}
+
+// WriteText writes the metrics, sorted by name, in the Prometheus text
+// format.
+func (m *Metrics) WriteText(buf *bytes.Buffer) {
+	m.lock.Lock()
+	names := []string{}
+	metrics := map[string]*metric{}
+	for name, metric := range m.metrics {
+		names = append(names, name)
+		metrics[name] = metric
+	}
+	m.lock.Unlock()
+	sort.Strings(names)
+
+	// the values are read without the lock, as they can take it
+	for _, name := range names {
+		metric := metrics[name]
+		values := metric.values()
+
+		fmt.Fprintf(buf, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", metric.name, metric.kind)
+
+		labels := []string{}
+		for label := range values {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			value := strconv.FormatFloat(values[label], 'f', -1, 64)
+			if len(metric.label) == 0 {
+				fmt.Fprintf(buf, "%s %s\n", metric.name, value)
+			} else {
+				fmt.Fprintf(buf, "%s{%s=\"%s\"} %s\n", metric.name, metric.label,
+					escapeLabel(label), value)
+			}
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	m.WriteText(&buf)
+
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(buf.Bytes())
+}
+
+// Serve exposes the metrics on the /metrics path of the address.
+func (m *Metrics) Serve(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	logp.Info("Serving the metrics on http://%s/metrics", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		logp.Err("Serving the metrics failed: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/outputs"
+	"github.com/johann8384/packetbeat/pipeline"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, ContentType, w.Header().Get("Content-Type"))
+	return w.Body.String()
+}
+
+// publish sends the events through the counting stage and waits for them
+// to be forwarded.
+func publish(m *Metrics, events ...common.MapStr) {
+	results := make(chan common.MapStr, len(events))
+	queue := pipeline.Chain{pipeline.Update(m.CountPublished)}.Queue(results)
+	for _, event := range events {
+		queue <- event
+	}
+	for _ = range events {
+		<-results
+	}
+	close(queue)
+}
+
+func TestMetrics_handler(t *testing.T) {
+	m := New()
+	m.Register("packetbeat_transactions_in_flight", "Transactions waiting for their response.",
+		Gauge, "protocol", func() map[string]float64 {
+			return map[string]float64{"http": 2, "mysql": 0}
+		})
+
+	body := scrape(t, m)
+	for _, name := range []string{
+		"packetbeat_events_published_total",
+		"packetbeat_output_errors_total",
+		"packetbeat_memory_alloc_bytes",
+		"packetbeat_memory_sys_bytes",
+		"packetbeat_goroutines",
+	} {
+		assert.Contains(t, body, "# TYPE "+name+" ")
+	}
+	assert.Contains(t, body, "# TYPE packetbeat_events_published_total counter\n")
+	assert.Contains(t, body, "# TYPE packetbeat_transactions_in_flight gauge\n"+
+		"packetbeat_transactions_in_flight{protocol=\"http\"} 2\n"+
+		"packetbeat_transactions_in_flight{protocol=\"mysql\"} 0\n")
+	assert.Contains(t, body, "packetbeat_output_errors_total 0\n")
+	assert.NotContains(t, body, "packetbeat_events_published_total{")
+}
+
+func TestMetrics_publishedEvents(t *testing.T) {
+	m := New()
+
+	publish(m, common.MapStr{"type": "http"}, common.MapStr{"type": "dns"},
+		common.MapStr{"type": "http"})
+	body := scrape(t, m)
+	assert.Contains(t, body, "packetbeat_events_published_total{protocol=\"dns\"} 1\n"+
+		"packetbeat_events_published_total{protocol=\"http\"} 2\n")
+
+	publish(m, common.MapStr{"type": "http"}, common.MapStr{})
+	body = scrape(t, m)
+	assert.Contains(t, body, "packetbeat_events_published_total{protocol=\"dns\"} 1\n"+
+		"packetbeat_events_published_total{protocol=\"http\"} 3\n"+
+		"packetbeat_events_published_total{protocol=\"unknown\"} 1\n")
+}
+
+type failingOutput struct {
+	outputs.OutputInterface
+	fail bool
+}
+
+func (out *failingOutput) PublishEvent(ts time.Time, event common.MapStr) error {
+	if out.fail {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestMetrics_outputErrors(t *testing.T) {
+	m := New()
+	outs := m.WrapOutputs([]outputs.OutputInterface{
+		&failingOutput{fail: false},
+		&failingOutput{fail: true},
+	})
+
+	for i := 0; i < 3; i++ {
+		for _, out := range outs {
+			out.PublishEvent(time.Now(), common.MapStr{"type": "http"})
+		}
+	}
+	assert.Contains(t, scrape(t, m), "packetbeat_output_errors_total 3\n")
+}
+
+func TestMetrics_escapeLabel(t *testing.T) {
+	m := New()
+	m.Register("test_values", "Values.", Gauge, "name", func() map[string]float64 {
+		return map[string]float64{`a"b\c`: 1.5}
+	})
+
+	lines := strings.Split(scrape(t, m), "\n")
+	assert.Contains(t, lines, `test_values{name="a\"b\\c"} 1.5`)
+}
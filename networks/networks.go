@@ -0,0 +1,85 @@
+// Package networks tells apart the internal addresses, in the networks
+// listed in the configuration, from the remote ones, and adds the
+// direction of the traffic to the events.
+package networks
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/johann8384/libbeat/common"
+)
+
+// Values of the direction field.
+const (
+	DirectionInbound  = "inbound"
+	DirectionOutbound = "outbound"
+	DirectionInternal = "internal"
+	DirectionExternal = "external"
+)
+
+type Networks struct {
+	nets []*net.IPNet
+}
+
+// New parses the CIDRs of the internal networks, like 10.0.0.0/8.
+func New(cidrs []string) (*Networks, error) {
+	networks := &Networks{}
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %s: %v", cidr, err)
+		}
+		networks.nets = append(networks.nets, ipnet)
+	}
+	return networks, nil
+}
+
+func (networks *Networks) IsInternal(ip net.IP) bool {
+	for _, ipnet := range networks.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (networks *Networks) isInternalEndpoint(value interface{}) (internal bool, ok bool) {
+	endpoint, ok := value.(*common.Endpoint)
+	if !ok {
+		return false, false
+	}
+	ip := net.ParseIP(endpoint.Ip)
+	if ip == nil {
+		return false, false
+	}
+	return networks.IsInternal(ip), true
+}
+
+// AddDirection adds client_is_internal and server_is_internal for the
+// source and the destination of the event, and the direction of the
+// traffic: inbound from a remote client to an internal server, outbound
+// from an internal client to a remote server, internal or external.
+func (networks *Networks) AddDirection(event common.MapStr) {
+	client, ok := networks.isInternalEndpoint(event["src"])
+	if !ok {
+		return
+	}
+	server, ok := networks.isInternalEndpoint(event["dst"])
+	if !ok {
+		return
+	}
+
+	event["client_is_internal"] = client
+	event["server_is_internal"] = server
+	switch {
+	case client && server:
+		event["direction"] = DirectionInternal
+	case client:
+		event["direction"] = DirectionOutbound
+	case server:
+		event["direction"] = DirectionInbound
+	default:
+		event["direction"] = DirectionExternal
+	}
+}
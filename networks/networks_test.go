@@ -0,0 +1,66 @@
+package networks
+
+import (
+	"net"
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEvent(src string, dst string) common.MapStr {
+	return common.MapStr{
+		"type": "http",
+		"src":  &common.Endpoint{Ip: src, Port: 41234},
+		"dst":  &common.Endpoint{Ip: dst, Port: 80},
+	}
+}
+
+func TestIsInternal(t *testing.T) {
+	networks, err := New([]string{"10.0.0.0/8", "192.168.0.0/16", "fd00::/8"})
+	assert.Nil(t, err)
+
+	assert.True(t, networks.IsInternal(net.ParseIP("10.1.2.3")))
+	assert.True(t, networks.IsInternal(net.ParseIP("192.168.0.1")))
+	assert.True(t, networks.IsInternal(net.ParseIP("fd12::1")))
+
+	// RFC1918, but not configured
+	assert.False(t, networks.IsInternal(net.ParseIP("172.16.0.1")))
+	assert.False(t, networks.IsInternal(net.ParseIP("8.8.8.8")))
+	assert.False(t, networks.IsInternal(net.ParseIP("2001:db8::1")))
+}
+
+func TestAddDirection(t *testing.T) {
+	networks, err := New([]string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		src, dst       string
+		client, server bool
+		direction      string
+	}{
+		{"192.168.0.1", "10.0.0.2", true, true, DirectionInternal},
+		{"172.20.0.1", "93.184.216.34", true, false, DirectionOutbound},
+		{"93.184.216.34", "10.0.0.2", false, true, DirectionInbound},
+		{"8.8.8.8", "93.184.216.34", false, false, DirectionExternal},
+	}
+
+	for _, test := range tests {
+		event := newEvent(test.src, test.dst)
+		networks.AddDirection(event)
+		assert.Equal(t, test.client, event["client_is_internal"], test.src)
+		assert.Equal(t, test.server, event["server_is_internal"], test.dst)
+		assert.Equal(t, test.direction, event["direction"], test.src+" "+test.dst)
+	}
+
+	// events without endpoints are left untouched
+	event := common.MapStr{"type": "flow"}
+	networks.AddDirection(event)
+	assert.Equal(t, common.MapStr{"type": "flow"}, event)
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New([]string{"10.0.0.0/8", "10.0.0.1"})
+	assert.NotNil(t, err)
+}
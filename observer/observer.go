@@ -0,0 +1,74 @@
+// Package observer adds to the published events the host and the network
+// interface that captured their packets, so that the events of a fleet of
+// shippers tell which sensor produced them.
+package observer
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/johann8384/libbeat/common"
+)
+
+type ObserverConfig struct {
+	// Default is the hostname of the OS.
+	Hostname string
+
+	// Default is the device that captured the packets of the event. Not
+	// set when the packets are read from a file.
+	Interface string
+}
+
+type Observer struct {
+	Hostname  string
+	Interface string
+}
+
+// hostname of the OS, replaced by the tests
+var hostname = os.Hostname
+
+// The capturing device is kept in the event under this key until the
+// observer is added.
+const interfaceKey = "observer.interface"
+
+// SetInterface records the device that captured the packets of the event,
+// when they are captured on several devices.
+func SetInterface(event common.MapStr, device string) {
+	event[interfaceKey] = device
+}
+
+// New creates the observer from the configuration. devices are the
+// capturing devices, empty when the packets are read from a file. With
+// several devices, the interface of each event is the device given by
+// SetInterface.
+func New(config ObserverConfig, devices []string) (*Observer, error) {
+	observer := &Observer{
+		Hostname:  config.Hostname,
+		Interface: config.Interface,
+	}
+	if len(observer.Hostname) == 0 {
+		name, err := hostname()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get the hostname: %v", err)
+		}
+		observer.Hostname = name
+	}
+	if len(observer.Interface) == 0 && len(devices) == 1 {
+		observer.Interface = devices[0]
+	}
+	return observer, nil
+}
+
+// AddObserver adds observer.hostname and observer.interface to the event.
+// The configured interface replaces the capturing device.
+func (observer *Observer) AddObserver(event common.MapStr) {
+	fields := common.MapStr{"hostname": observer.Hostname}
+	device, _ := event[interfaceKey].(string)
+	delete(event, interfaceKey)
+	if len(observer.Interface) > 0 {
+		fields["interface"] = observer.Interface
+	} else if len(device) > 0 {
+		fields["interface"] = device
+	}
+	event["observer"] = fields
+}
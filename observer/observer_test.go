@@ -0,0 +1,90 @@
+package observer
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/packetbeat/pipeline"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserver_defaults(t *testing.T) {
+	hostname = func() (string, error) { return "sensor1", nil }
+	defer func() { hostname = os.Hostname }()
+
+	observer, err := New(ObserverConfig{}, []string{"eth0"})
+	assert.Nil(t, err)
+	assert.Equal(t, "sensor1", observer.Hostname)
+	assert.Equal(t, "eth0", observer.Interface)
+
+	// the device of each event
+	observer, err = New(ObserverConfig{}, []string{"eth0", "eth1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", observer.Interface)
+
+	observer, err = New(ObserverConfig{Hostname: "dmz", Interface: "span"}, []string{"eth0"})
+	assert.Nil(t, err)
+	assert.Equal(t, "dmz", observer.Hostname)
+	assert.Equal(t, "span", observer.Interface)
+
+	hostname = func() (string, error) { return "", errors.New("no hostname") }
+	_, err = New(ObserverConfig{}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestObserver_queue(t *testing.T) {
+	observer, err := New(ObserverConfig{Hostname: "sensor1"}, []string{"eth0"})
+	assert.Nil(t, err)
+
+	published := make(chan common.MapStr, 10)
+	queue := pipeline.Chain{pipeline.Update(observer.AddObserver)}.Queue(published)
+	queue <- common.MapStr{"type": "http"}
+
+	select {
+	case event := <-published:
+		assert.Equal(t, common.MapStr{"hostname": "sensor1", "interface": "eth0"},
+			event["observer"])
+	case <-time.After(time.Second):
+		t.Fatal("the event was not forwarded")
+	}
+
+	// read from a file
+	observer, err = New(ObserverConfig{Hostname: "sensor1"}, nil)
+	assert.Nil(t, err)
+	event := common.MapStr{}
+	observer.AddObserver(event)
+	assert.Equal(t, common.MapStr{"hostname": "sensor1"}, event["observer"])
+}
+
+func TestObserver_capturingDevice(t *testing.T) {
+	observer, err := New(ObserverConfig{Hostname: "sensor1"}, []string{"eth0", "eth1"})
+	assert.Nil(t, err)
+
+	event := common.MapStr{"type": "http"}
+	SetInterface(event, "eth1")
+	observer.AddObserver(event)
+	assert.Equal(t, common.MapStr{
+		"type":     "http",
+		"observer": common.MapStr{"hostname": "sensor1", "interface": "eth1"},
+	}, event)
+
+	// the events without a device, like the reports
+	event = common.MapStr{"type": "metrics"}
+	observer.AddObserver(event)
+	assert.Equal(t, common.MapStr{"hostname": "sensor1"}, event["observer"])
+
+	// the configured interface wins
+	observer, err = New(ObserverConfig{Hostname: "sensor1", Interface: "span"}, []string{"eth0", "eth1"})
+	assert.Nil(t, err)
+	event = common.MapStr{"type": "http"}
+	SetInterface(event, "eth1")
+	observer.AddObserver(event)
+	assert.Equal(t, common.MapStr{
+		"type":     "http",
+		"observer": common.MapStr{"hostname": "sensor1", "interface": "span"},
+	}, event)
+}
@@ -0,0 +1,78 @@
+// Package payloads keeps the raw request and response of a sampled
+// fraction of the transactions of a protocol. Capturing them for all the
+// transactions is expensive to store, capturing none leaves nothing to
+// debug with: the plugins capture them and the events that are not
+// sampled lose them before being published.
+package payloads
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/johann8384/packetbeat/pipeline"
+	"github.com/johann8384/packetbeat/protos"
+)
+
+// Sampler holds the fraction of the transactions keeping their payloads,
+// by protocol name. The rates are replaced with Set when the
+// configuration is reloaded.
+type Sampler struct {
+	*pipeline.Options
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+// New creates the sampler from the rates, by protocol name.
+func New(rates map[string]interface{}) (*Sampler, error) {
+	sampler := &Sampler{
+		Options: pipeline.NewOptions("Payload_sample_rate", checkRate),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if err := sampler.Set(rates); err != nil {
+		return nil, err
+	}
+	return sampler, nil
+}
+
+// checkRate checks that the rate of a protocol is between 0 and 1.
+func checkRate(protocol string, value interface{}) error {
+	rate, ok := value.(float64)
+	if !ok || rate < 0 || rate > 1 {
+		return fmt.Errorf("Invalid payload_sample_rate %v for %s, expected a fraction between 0 and 1",
+			value, protocol)
+	}
+	return nil
+}
+
+// Sample removes the request and the response from the event, unless it
+// is sampled. The sampled events are marked with payload_sampled. The
+// events of the protocols without a rate, and the other events, like the
+// flows, are left unchanged. The request and the response events of a
+// split transaction are sampled by their transaction.id, so that both or
+// none keep their payload.
+func (sampler *Sampler) Sample(event common.MapStr) {
+	rate, exists := sampler.Lookup(event)
+	if !exists {
+		return
+	}
+
+	fraction, ok := protos.TransactionFraction(event)
+	if !ok {
+		sampler.lock.Lock()
+		fraction = sampler.rand.Float64()
+		sampler.lock.Unlock()
+	}
+	sampled := fraction < rate.(float64)
+
+	if sampled {
+		event["payload_sampled"] = true
+	} else {
+		delete(event, "request")
+		delete(event, "response")
+	}
+}
@@ -0,0 +1,88 @@
+package payloads
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampler_fraction(t *testing.T) {
+	sampler, err := New(map[string]interface{}{"http": 0.01})
+	assert.Nil(t, err)
+
+	sampled := 0
+	for i := 0; i < 100000; i++ {
+		event := common.MapStr{"type": "http", "request": "GET /", "response": "HTTP/1.1 200 OK"}
+		sampler.Sample(event)
+		if event["payload_sampled"] == true {
+			assert.Equal(t, "GET /", event["request"])
+			assert.Equal(t, "HTTP/1.1 200 OK", event["response"])
+			sampled++
+		} else {
+			assert.Nil(t, event["request"])
+			assert.Nil(t, event["response"])
+		}
+	}
+
+	// the standard deviation is about 31, so this is very unlikely to fail
+	assert.True(t, sampled > 850 && sampled < 1150, "sampled %d events", sampled)
+}
+
+func TestSampler_splitTransactions(t *testing.T) {
+	sampler, err := New(map[string]interface{}{"http": 0.1})
+	assert.Nil(t, err)
+
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		events := protos.SplitTransaction(common.MapStr{
+			"type":     "http",
+			"request":  "GET /",
+			"response": "HTTP/1.1 200 OK",
+		}, true, true)
+		sampler.Sample(events[0])
+		sampler.Sample(events[1])
+
+		if events[0]["payload_sampled"] != events[1]["payload_sampled"] {
+			t.Fatalf("Only one half of the transaction sampled: %v", events)
+		}
+		if events[0]["payload_sampled"] == true {
+			assert.Equal(t, "GET /", events[0]["request"])
+			assert.Equal(t, "HTTP/1.1 200 OK", events[1]["response"])
+			sampled++
+		}
+	}
+	assert.True(t, sampled > 800 && sampled < 1200, "sampled %d transactions", sampled)
+}
+
+func TestSampler_protocols(t *testing.T) {
+	sampler, err := New(map[string]interface{}{"redis": 0.0, "mysql": 1.0})
+	assert.Nil(t, err)
+
+	events := []common.MapStr{
+		{"type": "redis", "request": "GET key"},
+		{"type": "mysql", "request": "SELECT 1"},
+		{"type": "dns", "request": "example.com"},
+		{"type": "flow"},
+	}
+	for _, event := range events {
+		sampler.Sample(event)
+	}
+
+	assert.Equal(t, []common.MapStr{
+		{"type": "redis"},
+		{"type": "mysql", "request": "SELECT 1", "payload_sampled": true},
+		{"type": "dns", "request": "example.com"},
+		{"type": "flow"},
+	}, events)
+}
+
+func TestSampler_invalidRates(t *testing.T) {
+	for _, rate := range []interface{}{-0.1, 1.5, 100.0, "0.1"} {
+		_, err := New(map[string]interface{}{"http": rate})
+		assert.NotNil(t, err, "rate %v", rate)
+	}
+}
@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"sync"
+
+	"github.com/johann8384/libbeat/common"
+)
+
+// Options holds the values of an option of the protocols, like their
+// retention, by protocol name. The events get the value of their
+// protocol, given by their type. The values are replaced when the
+// configuration is reloaded.
+type Options struct {
+	// Name of the option in the configuration of the protocols, like
+	// Retention.
+	Field string
+
+	check  func(protocol string, value interface{}) error
+	lock   sync.RWMutex
+	values map[string]interface{}
+}
+
+// NewOptions creates the options with no values. The check function
+// validates the value of a protocol.
+func NewOptions(field string, check func(protocol string, value interface{}) error) *Options {
+	return &Options{
+		Field:  field,
+		check:  check,
+		values: map[string]interface{}{},
+	}
+}
+
+// Validate checks the values, by protocol name.
+func (options *Options) Validate(values map[string]interface{}) error {
+	for protocol, value := range values {
+		if err := options.check(protocol, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set replaces the values, by protocol name, when they are valid.
+func (options *Options) Set(values map[string]interface{}) error {
+	if err := options.Validate(values); err != nil {
+		return err
+	}
+
+	options.lock.Lock()
+	defer options.lock.Unlock()
+	options.values = values
+	return nil
+}
+
+// Lookup returns the value of the protocol of the event. The events of
+// the protocols without a value and the other events, like the flows,
+// have none.
+func (options *Options) Lookup(event common.MapStr) (interface{}, bool) {
+	protocol, ok := event["type"].(string)
+	if !ok {
+		return nil, false
+	}
+
+	options.lock.RLock()
+	defer options.lock.RUnlock()
+	value, exists := options.values[protocol]
+	return value, exists
+}
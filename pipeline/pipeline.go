@@ -0,0 +1,57 @@
+// Package pipeline runs the processors of the published events, the
+// functions adding fields to them, counting them or dropping them. The
+// processors run in order in a single stage between the protocol plugins
+// and the publisher, instead of a goroutine and a queue each.
+package pipeline
+
+import (
+	"github.com/johann8384/libbeat/common"
+)
+
+// The size of the queue of a stage.
+const QueueSize = 1000
+
+// A Processor updates the event in place. It returns false when the
+// event is dropped.
+type Processor func(event common.MapStr) bool
+
+// Update makes the processor of a function updating the events without
+// dropping any.
+func Update(update func(event common.MapStr)) Processor {
+	return func(event common.MapStr) bool {
+		update(event)
+		return true
+	}
+}
+
+// Chain is the list of the processors, in the order they run.
+type Chain []Processor
+
+// Process runs the processors on the event, until one of them drops it.
+// It returns whether the event is kept.
+func (chain Chain) Process(event common.MapStr) bool {
+	for _, processor := range chain {
+		if !processor(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// Queue returns the queue in which the events are sent. The processors
+// are run on the events before they are forwarded to results. Without
+// processors, results is returned as is.
+func (chain Chain) Queue(results chan common.MapStr) chan common.MapStr {
+	if len(chain) == 0 {
+		return results
+	}
+	queue := make(chan common.MapStr, QueueSize)
+	go func() {
+		for event := range queue {
+			if chain.Process(event) {
+				results <- event
+			}
+		}
+	}()
+	return queue
+}
@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChain_order(t *testing.T) {
+	calls := []string{}
+	chain := Chain{
+		Update(func(event common.MapStr) {
+			calls = append(calls, "first")
+			event["first"] = true
+		}),
+		func(event common.MapStr) bool {
+			calls = append(calls, "drop")
+			return event["drop"] != true
+		},
+		Update(func(event common.MapStr) {
+			calls = append(calls, "last")
+		}),
+	}
+
+	event := common.MapStr{}
+	assert.True(t, chain.Process(event))
+	assert.Equal(t, common.MapStr{"first": true}, event)
+	assert.Equal(t, []string{"first", "drop", "last"}, calls)
+
+	calls = []string{}
+	assert.False(t, chain.Process(common.MapStr{"drop": true}))
+	assert.Equal(t, []string{"first", "drop"}, calls)
+}
+
+func TestChain_queue(t *testing.T) {
+	results := make(chan common.MapStr, 10)
+	assert.Equal(t, results, Chain{}.Queue(results))
+
+	queue := Chain{func(event common.MapStr) bool {
+		return event["i"] != 1
+	}}.Queue(results)
+	for i := 0; i < 3; i++ {
+		queue <- common.MapStr{"i": i}
+	}
+	for _, i := range []int{0, 2} {
+		select {
+		case event := <-results:
+			assert.Equal(t, i, event["i"])
+		case <-time.After(time.Second):
+			t.Fatal("the event was not forwarded")
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	options := NewOptions("Retention", func(protocol string, value interface{}) error {
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("invalid value for %s", protocol)
+		}
+		return nil
+	})
+
+	_, exists := options.Lookup(common.MapStr{"type": "http"})
+	assert.False(t, exists)
+
+	assert.Nil(t, options.Set(map[string]interface{}{"http": "long"}))
+	value, exists := options.Lookup(common.MapStr{"type": "http"})
+	assert.True(t, exists)
+	assert.Equal(t, "long", value)
+	_, exists = options.Lookup(common.MapStr{"type": "mysql"})
+	assert.False(t, exists)
+	_, exists = options.Lookup(common.MapStr{})
+	assert.False(t, exists)
+
+	// the invalid values don't replace the current ones
+	assert.NotNil(t, options.Set(map[string]interface{}{"http": 1.0}))
+	value, _ = options.Lookup(common.MapStr{"type": "http"})
+	assert.Equal(t, "long", value)
+}
@@ -0,0 +1,182 @@
+package procs
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+	"github.com/johann8384/packetbeat/endpoints"
+)
+
+// Docker keeps the configuration of the containers, with their names,
+// in this directory.
+const dockerContainersDir = "/var/lib/docker/containers"
+
+var containerIdRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Container is the container in which a process runs.
+type Container struct {
+	Id   string
+	Name string
+}
+
+func (c *Container) toMapStr() common.MapStr {
+	container := common.MapStr{"id": c.Id}
+	if c.Name != "" {
+		container["name"] = c.Name
+	}
+	return container
+}
+
+// pidContainer is the container of a process, read from its cgroups at
+// the given time. It is read again once the pids of the processes are
+// refreshed, as the pid can be reused by another process.
+type pidContainer struct {
+	container *Container
+	read      time.Time
+}
+
+// the containers are looked up by the local port of the sockets
+type containerKey struct {
+	transport string
+	port      uint16
+}
+
+// FindContainerOfPid reads the cgroups of the process and returns the
+// container in which it runs, or nil if it runs on the host. The name of
+// the container is set if Docker knows it.
+func FindContainerOfPid(prefix string, pid int) (*Container, error) {
+	file, err := os.Open(filepath.Join(prefix, "/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// hierarchy-ID:controllers:path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		id := containerIdFromCgroup(fields[2])
+		if id == "" {
+			continue
+		}
+		container := &Container{Id: id}
+		container.Name = dockerContainerName(prefix, id)
+		return container, nil
+	}
+	return nil, scanner.Err()
+}
+
+// containerIdFromCgroup extracts the container id of a cgroup path, like
+// /docker/<id> with cgroupfs, /system.slice/docker-<id>.scope with systemd
+// or .../cri-containerd-<id>.scope and ...:cri-containerd:<id> with
+// containerd.
+func containerIdFromCgroup(path string) string {
+	parts := strings.Split(path, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		name := strings.TrimSuffix(parts[i], ".scope")
+		if sep := strings.LastIndexAny(name, "-:"); sep >= 0 {
+			name = name[sep+1:]
+		}
+		if containerIdRegexp.MatchString(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// dockerContainerName returns the name of the container in the
+// configuration kept by Docker, or an empty string if it can't be read.
+func dockerContainerName(prefix string, id string) string {
+	data, err := ioutil.ReadFile(filepath.Join(prefix, dockerContainersDir, id, "config.v2.json"))
+	if err != nil {
+		logp.Debug("procs", "No Docker configuration for container %s: %s", id, err)
+		return ""
+	}
+
+	var config struct {
+		Name string
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		logp.Debug("procs", "Invalid Docker configuration for container %s: %s", id, err)
+		return ""
+	}
+	return strings.TrimPrefix(config.Name, "/")
+}
+
+// updateContainer records the container of the process owning the port.
+func (proc *ProcessesWatcher) updateContainer(transport string, port uint16, pid int) {
+	cached, exists := proc.pidContainers[pid]
+	if !exists || time.Since(cached.read) >= proc.RefreshPidsFreq {
+		container, err := FindContainerOfPid(proc.proc_prefix, pid)
+		if err != nil {
+			logp.Debug("procs", "FindContainerOfPid: %s", err)
+		}
+		cached = pidContainer{container: container, read: time.Now()}
+		proc.pidContainers[pid] = cached
+	}
+	container := cached.container
+
+	key := containerKey{transport, port}
+	proc.containersLock.Lock()
+	defer proc.containersLock.Unlock()
+	if container == nil {
+		delete(proc.containers, key)
+	} else {
+		proc.containers[key] = container
+	}
+}
+
+// expireContainers forgets the containers of the pids read before the
+// last refresh of the pids, so that the cache only holds the running
+// processes.
+func (proc *ProcessesWatcher) expireContainers() {
+	for pid, cached := range proc.pidContainers {
+		if time.Since(cached.read) >= proc.RefreshPidsFreq {
+			delete(proc.pidContainers, pid)
+		}
+	}
+}
+
+func (proc *ProcessesWatcher) findContainer(transport string, endpoint *common.Endpoint) *Container {
+	ip := net.ParseIP(endpoint.Ip)
+	if ip == nil || !proc.IsLocalIp(ip) {
+		return nil
+	}
+
+	proc.containersLock.Lock()
+	defer proc.containersLock.Unlock()
+	return proc.containers[containerKey{transport, endpoint.Port}]
+}
+
+// AddContainers adds the containers of the local endpoints to the event,
+// in the container field of the src and dst objects.
+func (proc *ProcessesWatcher) AddContainers(event common.MapStr) {
+	transport, ok := event["transport"].(string)
+	if !ok {
+		transport = "tcp"
+	}
+
+	if src, ok := event["src"].(*common.Endpoint); ok {
+		if container := proc.findContainer(transport, src); container != nil {
+			endpoints.Set(event, endpoints.Source, "container", container.toMapStr())
+		}
+	}
+	if dst, ok := event["dst"].(*common.Endpoint); ok {
+		if container := proc.findContainer(transport, dst); container != nil {
+			endpoints.Set(event, endpoints.Destination, "container", container.toMapStr())
+		}
+	}
+}
@@ -3,6 +3,7 @@ package procs
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -13,6 +14,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/johann8384/libbeat/common"
@@ -46,13 +48,26 @@ type Process struct {
 type ProcessesWatcher struct {
 	PortProcMap   map[uint16]PortProcMapping
 	LastMapUpdate time.Time
-	Processes     []*Process
-	LocalAddrs    []net.IP
+
+	// the ports of the UDP sockets, kept apart since the same port can
+	// be used by different processes for TCP and UDP
+	PortProcMapUdp   map[uint16]PortProcMapping
+	LastMapUpdateUdp time.Time
+
+	Processes  []*Process
+	LocalAddrs []net.IP
+
+	// the containers of the processes owning the ports, read by the
+	// stage of the processors
+	containers     map[containerKey]*Container
+	containersLock sync.Mutex
+	pidContainers  map[int]pidContainer
 
 	// config
 	ReadFromProc    bool
 	MaxReadFreq     time.Duration
 	RefreshPidsFreq time.Duration
+	Containers      bool
 
 	// test helpers
 	proc_prefix string
@@ -64,6 +79,7 @@ type ProcsConfig struct {
 	Max_proc_read_freq int
 	Monitored          []ProcConfig
 	Refresh_pids_freq  int
+	Containers         bool
 }
 
 type ProcConfig struct {
@@ -78,6 +94,8 @@ func (proc *ProcessesWatcher) Init(config ProcsConfig) error {
 	proc.proc_prefix = ""
 	proc.PortProcMap = make(map[uint16]PortProcMapping)
 	proc.LastMapUpdate = time.Now()
+	proc.PortProcMapUdp = make(map[uint16]PortProcMapping)
+	proc.LastMapUpdateUdp = time.Now()
 
 	proc.ReadFromProc = config.Enabled
 	if proc.ReadFromProc {
@@ -89,6 +107,10 @@ func (proc *ProcessesWatcher) Init(config ProcsConfig) error {
 		}
 	}
 
+	proc.Containers = proc.ReadFromProc && config.Containers
+	proc.containers = make(map[containerKey]*Container)
+	proc.pidContainers = make(map[int]pidContainer)
+
 	if config.Max_proc_read_freq == 0 {
 		proc.MaxReadFreq = 10 * time.Millisecond
 	} else {
@@ -193,7 +215,19 @@ func FindPidsByCmdlineGrep(prefix string, process string) ([]int, error) {
 	return pids, nil
 }
 
-func (proc *ProcessesWatcher) FindProcessesTuple(tuple *common.IpPortTuple) (proc_tuple *common.CmdlineTuple) {
+func (proc *ProcessesWatcher) FindProcessesTuple(tuple *common.IpPortTuple) *common.CmdlineTuple {
+	return proc.findProcessesTuple(tuple, proc.FindProc)
+}
+
+// FindProcessesTupleUDP is FindProcessesTuple for the UDP flows. The ports
+// are looked up in the UDP sockets of the monitored processes.
+func (proc *ProcessesWatcher) FindProcessesTupleUDP(tuple *common.IpPortTuple) *common.CmdlineTuple {
+	return proc.findProcessesTuple(tuple, proc.FindProcUDP)
+}
+
+func (proc *ProcessesWatcher) findProcessesTuple(tuple *common.IpPortTuple,
+	findProc func(port uint16) string) (proc_tuple *common.CmdlineTuple) {
+
 	proc_tuple = &common.CmdlineTuple{}
 
 	if !proc.ReadFromProc {
@@ -202,7 +236,7 @@ func (proc *ProcessesWatcher) FindProcessesTuple(tuple *common.IpPortTuple) (pro
 
 	if proc.IsLocalIp(tuple.Src_ip) {
 		logp.Debug("procs", "Looking for port %d", tuple.Src_port)
-		proc_tuple.Src = []byte(proc.FindProc(tuple.Src_port))
+		proc_tuple.Src = []byte(findProc(tuple.Src_port))
 		if len(proc_tuple.Src) > 0 {
 			logp.Debug("procs", "Found device %s for port %d", proc_tuple.Src, tuple.Src_port)
 		}
@@ -210,7 +244,7 @@ func (proc *ProcessesWatcher) FindProcessesTuple(tuple *common.IpPortTuple) (pro
 
 	if proc.IsLocalIp(tuple.Dst_ip) {
 		logp.Debug("procs", "Looking for port %d", tuple.Dst_port)
-		proc_tuple.Dst = []byte(proc.FindProc(tuple.Dst_port))
+		proc_tuple.Dst = []byte(findProc(tuple.Dst_port))
 		if len(proc_tuple.Dst) > 0 {
 			logp.Debug("procs", "Found device %s for port %d", proc_tuple.Dst, tuple.Dst_port)
 		}
@@ -244,15 +278,49 @@ func (proc *ProcessesWatcher) FindProc(port uint16) (procname string) {
 	return ""
 }
 
+func (proc *ProcessesWatcher) FindProcUDP(port uint16) (procname string) {
+	procname = ""
+	defer logp.Recover("FindProcUDP exception")
+
+	p, exists := proc.PortProcMapUdp[port]
+	if exists {
+		return p.Proc.Name
+	}
+
+	now := time.Now()
+
+	if now.Sub(proc.LastMapUpdateUdp) > proc.MaxReadFreq {
+		proc.LastMapUpdateUdp = now
+		proc.UpdateMapUDP()
+
+		// try again
+		p, exists := proc.PortProcMapUdp[port]
+		if exists {
+			return p.Proc.Name
+		}
+	}
+
+	return ""
+}
+
 func hex_to_ip_port(str []byte) (uint32, uint16, error) {
 	words := bytes.Split(str, []byte(":"))
 	if len(words) < 2 {
 		return 0, 0, errors.New("Didn't find ':' as a separator")
 	}
 
-	ip, err := strconv.ParseInt(string(words[0]), 16, 64)
-	if err != nil {
-		return 0, 0, err
+	var ip int64
+	if len(words[0]) > 8 {
+		// IPv6 address, only the port is used
+		if _, err := hex.DecodeString(string(words[0])); err != nil {
+			return 0, 0, err
+		}
+	} else {
+		var err error
+		ip, err = strconv.ParseInt(string(words[0]), 16, 64)
+		if err != nil {
+			return 0, 0, err
+		}
 	}
 
 	port, err := strconv.ParseInt(string(words[1]), 16, 32)
@@ -276,6 +344,43 @@ func (proc *ProcessesWatcher) UpdateMap() {
 		logp.Err("Parse_Proc_Net_Tcp: %s", err)
 		return
 	}
+	proc.updateMappings(proc.PortProcMap, "tcp", socks)
+}
+
+// UpdateMapUDP maps the ports of the UDP sockets to the monitored
+// processes. The kernel lists the IPv4 and the IPv6 sockets in separate
+// tables.
+func (proc *ProcessesWatcher) UpdateMapUDP() {
+
+	logp.Debug("procs", "UpdateMapUDP()")
+	socks := []*SocketInfo{}
+	for _, name := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		file, err := os.Open(filepath.Join(proc.proc_prefix, name))
+		if err != nil {
+			// the kernel can be built without IPv6
+			logp.Debug("procs", "Open: %s", err)
+			continue
+		}
+		table, err := Parse_Proc_Net_Udp(file)
+		file.Close()
+		if err != nil {
+			logp.Err("Parse_Proc_Net_Udp: %s", err)
+			continue
+		}
+		socks = append(socks, table...)
+	}
+	proc.updateMappings(proc.PortProcMapUdp, "udp", socks)
+}
+
+// updateMappings maps the local ports of the sockets owned by the
+// monitored processes.
+func (proc *ProcessesWatcher) updateMappings(portMap map[uint16]PortProcMapping,
+	transport string, socks []*SocketInfo) {
+
+	if proc.Containers {
+		proc.expireContainers()
+	}
+
 	socks_map := map[int64]*SocketInfo{}
 	for _, s := range socks {
 		socks_map[s.Inode] = s
@@ -292,7 +397,7 @@ func (proc *ProcessesWatcher) UpdateMap() {
 			for _, inode := range inodes {
 				sockInfo, exists := socks_map[inode]
 				if exists {
-					proc.UpdateMappingEntry(sockInfo.Src_port, pid, p)
+					proc.setMappingEntry(portMap, transport, sockInfo.Src_port, pid, p)
 				}
 			}
 
@@ -346,14 +451,30 @@ func Parse_Proc_Net_Tcp(input io.Reader) ([]*SocketInfo, error) {
 	return sockets, nil
 }
 
+// Parses the /proc/net/udp and /proc/net/udp6 files, which have the
+// columns of /proc/net/tcp
+func Parse_Proc_Net_Udp(input io.Reader) ([]*SocketInfo, error) {
+	return Parse_Proc_Net_Tcp(input)
+}
+
 func (proc *ProcessesWatcher) UpdateMappingEntry(port uint16, pid int, p *Process) {
+	proc.setMappingEntry(proc.PortProcMap, "tcp", port, pid, p)
+}
+
+func (proc *ProcessesWatcher) setMappingEntry(portMap map[uint16]PortProcMapping,
+	transport string, port uint16, pid int, p *Process) {
+
 	entry := PortProcMapping{Port: port, Pid: pid, Proc: p}
 
 	// Simply overwrite old entries for now.
 	// We never expire entries from this map. Since there are 65k possible
 	// ports, the size of the dict can be max 1.5 MB, which we consider
 	// reasonable.
-	proc.PortProcMap[port] = entry
+	portMap[port] = entry
+
+	if proc.Containers {
+		proc.updateContainer(transport, port, pid)
+	}
 
 	logp.Debug("procsdetailed", "UpdateMappingEntry(): port=%d pid=%d", port, p.Name)
 }
@@ -3,11 +3,14 @@ package procs
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/johann8384/libbeat/common"
 	"github.com/johann8384/libbeat/logp"
 )
 
@@ -204,3 +207,167 @@ func TestFindSocketsOfPid(t *testing.T) {
 
 	AssertInt64ArraysAreEqual(t, []int64{7619, 7620}, inodes)
 }
+
+func TestFindProcessesTupleUDP(t *testing.T) {
+	logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{})
+
+	proc := []TestProcFile{
+		{Path: "/proc/net/udp", Contents: "" +
+			"  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops\n" +
+			"  112: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 7619 2 0000000000000000 0\n" +
+			"  130: 0100007F:1F90 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 8012 2 0000000000000000 0\n"},
+		{Path: "/proc/net/udp6", Contents: "" +
+			"  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops\n" +
+			"  20: 00000000000000000000000000000000:14E9 00000000000000000000000000000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 7620 2 0000000000000000 0\n"},
+		{Path: "/proc/net/tcp", Contents: ""},
+		{Path: "/proc/766/fd/0", IsLink: true, Contents: "/dev/null"},
+		{Path: "/proc/766/fd/14", IsLink: true, Contents: "socket:[7619]"},
+		{Path: "/proc/766/fd/15", IsLink: true, Contents: "socket:[7620]"},
+	}
+
+	// Create fake proc file system
+	path_prefix, err := ioutil.TempDir("/tmp", "")
+	if err != nil {
+		t.Error("TempDir failed:", err)
+		return
+	}
+	defer os.RemoveAll(path_prefix)
+
+	err = CreateFakeDirectoryStructure(path_prefix, proc)
+	if err != nil {
+		t.Error("CreateFakeDirectoryStructure failed:", err)
+		return
+	}
+
+	procs := ProcessesWatcher{
+		proc_prefix:    path_prefix,
+		ReadFromProc:   true,
+		PortProcMap:    make(map[uint16]PortProcMapping),
+		PortProcMapUdp: make(map[uint16]PortProcMapping),
+	}
+	procs.Processes = []*Process{{Name: "dnsmasq", Pids: []int{766}, proc: &procs}}
+
+	// a DNS query and a mDNS answer, the server is local
+	tuple := common.NewIpPortTuple(4,
+		net.IPv4(10, 0, 0, 5), 34567, net.IPv4(127, 0, 0, 1), 53)
+	cmdline := procs.FindProcessesTupleUDP(&tuple)
+	if string(cmdline.Src) != "" || string(cmdline.Dst) != "dnsmasq" {
+		t.Errorf("Expected dnsmasq as destination, got %q -> %q", cmdline.Src, cmdline.Dst)
+	}
+
+	tuple = common.NewIpPortTuple(4,
+		net.IPv4(127, 0, 0, 1), 5353, net.IPv4(10, 0, 0, 5), 5353)
+	cmdline = procs.FindProcessesTupleUDP(&tuple)
+	if string(cmdline.Src) != "dnsmasq" {
+		t.Errorf("Expected dnsmasq as source, got %q", cmdline.Src)
+	}
+
+	// the UDP sockets are not used for the TCP flows
+	if _, exists := procs.PortProcMap[53]; exists {
+		t.Error("Port 53 mapped for TCP")
+	}
+	if _, exists := procs.PortProcMapUdp[8080]; exists {
+		t.Error("Port 8080 of another process mapped")
+	}
+}
+
+func TestFindContainerOfPid(t *testing.T) {
+	logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{})
+
+	id := "3f4e4b7c26d5b3a1b9b8e6f7a1d2c3b4a5968778695a4b3c2d1e0f9e8d7c6b5a"
+	proc := []TestProcFile{
+		{Path: "/proc/766/cgroup", Contents: "" +
+			"12:pids:/docker/" + id + "\n" +
+			"11:memory:/docker/" + id + "\n" +
+			"1:name=systemd:/docker/" + id + "\n"},
+		{Path: "/proc/780/cgroup", Contents: "" +
+			"0::/system.slice/containerd.service/kubepods-besteffort.slice:cri-containerd:" +
+			"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef\n"},
+		{Path: "/proc/1/cgroup", Contents: "" +
+			"12:pids:/init.scope\n" +
+			"0::/init.scope\n"},
+		{Path: "/var/lib/docker/containers/" + id + "/config.v2.json",
+			Contents: `{"ID":"` + id + `","Name":"/web","State":{"Running":true}}`},
+	}
+
+	// Create fake proc file system
+	path_prefix, err := ioutil.TempDir("/tmp", "")
+	if err != nil {
+		t.Error("TempDir failed:", err)
+		return
+	}
+	defer os.RemoveAll(path_prefix)
+
+	err = CreateFakeDirectoryStructure(path_prefix, proc)
+	if err != nil {
+		t.Error("CreateFakeDirectoryStructure failed:", err)
+		return
+	}
+
+	container, err := FindContainerOfPid(path_prefix, 766)
+	if err != nil {
+		t.Fatalf("FindContainerOfPid: %s", err)
+	}
+	if container == nil || container.Id != id || container.Name != "web" {
+		t.Errorf("Expected the container web, got %v", container)
+	}
+
+	// the name of the containerd containers is unknown
+	container, err = FindContainerOfPid(path_prefix, 780)
+	if err != nil {
+		t.Fatalf("FindContainerOfPid: %s", err)
+	}
+	if container == nil || container.Id != "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef" ||
+		container.Name != "" {
+		t.Errorf("Expected an unnamed container, got %v", container)
+	}
+
+	container, err = FindContainerOfPid(path_prefix, 1)
+	if err != nil {
+		t.Fatalf("FindContainerOfPid: %s", err)
+	}
+	if container != nil {
+		t.Errorf("Expected no container, got %v", container)
+	}
+
+	// the container is added to the events for the local server
+	procs := ProcessesWatcher{
+		proc_prefix:     path_prefix,
+		Containers:      true,
+		RefreshPidsFreq: time.Hour,
+		containers:      make(map[containerKey]*Container),
+		pidContainers:   make(map[int]pidContainer),
+	}
+	procs.setMappingEntry(make(map[uint16]PortProcMapping), "tcp", 80, 766,
+		&Process{Name: "nginx"})
+
+	event := common.MapStr{
+		"src": &common.Endpoint{Ip: "10.0.0.5", Port: 34567},
+		"dst": &common.Endpoint{Ip: "127.0.0.1", Port: 80},
+	}
+	procs.AddContainers(event)
+	if event["src.container"] != nil {
+		t.Errorf("Unexpected client container %v", event["src.container"])
+	}
+	expected := common.MapStr{"id": id, "name": "web"}
+	if !reflect.DeepEqual(event["dst.container"], expected) {
+		t.Errorf("Expected container %v, got %v", expected, event["dst.container"])
+	}
+
+	// the containers read before the refresh of the pids are forgotten,
+	// the pid can be reused by a process of another container
+	procs.pidContainers[766] = pidContainer{
+		container: &Container{Id: "stale"},
+		read:      time.Now().Add(-2 * time.Hour),
+	}
+	procs.pidContainers[1] = pidContainer{read: time.Now().Add(-2 * time.Hour)}
+	procs.setMappingEntry(make(map[uint16]PortProcMapping), "tcp", 80, 766,
+		&Process{Name: "nginx"})
+	if container := procs.findContainer("tcp", &common.Endpoint{Ip: "127.0.0.1", Port: 80}); container == nil || container.Id != id {
+		t.Errorf("Expected the container web, got %v", container)
+	}
+	procs.expireContainers()
+	if _, exists := procs.pidContainers[1]; exists || len(procs.pidContainers) != 1 {
+		t.Errorf("Expected only the container of pid 766, got %v", procs.pidContainers)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"time"
+
+	"github.com/johann8384/libbeat/logp"
+)
+
+// writeProfiles writes a heap profile and a dump of the stacks of all the
+// goroutines of the running process to dir. The files are named after ts,
+// so that the dumps taken while a leak grows can be compared. It returns
+// the names of the files.
+func writeProfiles(dir string, ts time.Time) (string, string, error) {
+	stamp := ts.Format("20060102T150405.000")
+	heap := filepath.Join(dir, fmt.Sprintf("packetbeat-heap-%s.pprof", stamp))
+	goroutines := filepath.Join(dir, fmt.Sprintf("packetbeat-goroutines-%s.txt", stamp))
+
+	if err := writeHeapProfile(heap); err != nil {
+		return "", "", err
+	}
+
+	f, err := os.Create(goroutines)
+	if err != nil {
+		logp.Err("Failed creating file %s: %s", goroutines, err)
+		return "", "", err
+	}
+	// the stacks in the format of a panic
+	err = pprof.Lookup("goroutine").WriteTo(f, 2)
+	f.Close()
+	if err != nil {
+		logp.Err("Failed writing goroutine dump file %s: %s", goroutines, err)
+		return "", "", err
+	}
+	logp.Info("Created goroutine dump file %s.", goroutines)
+
+	return heap, goroutines, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ts := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	heap, goroutines, err := writeProfiles(dir, ts)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "packetbeat-heap-20151021T072800.000.pprof"), heap)
+	assert.Equal(t, filepath.Join(dir, "packetbeat-goroutines-20151021T072800.000.txt"), goroutines)
+
+	// the heap profile is a gzipped protocol buffer
+	f, err := os.Open(heap)
+	assert.Nil(t, err)
+	defer f.Close()
+	reader, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	profile, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, profile)
+
+	dump, err := ioutil.ReadFile(goroutines)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(dump), "goroutine "), "%s", dump)
+	assert.Contains(t, string(dump), "TestWriteProfiles")
+
+	// a second dump doesn't overwrite the first one
+	heap2, _, err := writeProfiles(dir, ts.Add(time.Second))
+	assert.Nil(t, err)
+	assert.NotEqual(t, heap, heap2)
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(files))
+}
@@ -0,0 +1,27 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/johann8384/libbeat/logp"
+)
+
+// notifyProfiles writes the profiles to dir each time SIGUSR1 is
+// received, to diagnose a running process.
+func notifyProfiles(dir string) {
+	sigusr1 := make(chan os.Signal, 1)
+	signal.Notify(sigusr1, syscall.SIGUSR1)
+	go func() {
+		for _ = range sigusr1 {
+			logp.Info("Received sigusr1, writing the profiles to %s", dir)
+			if _, _, err := writeProfiles(dir, time.Now()); err != nil {
+				logp.Err("Writing the profiles failed: %v", err)
+			}
+		}
+	}()
+}
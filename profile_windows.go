@@ -0,0 +1,5 @@
+package main
+
+// notifyProfiles does nothing, there is no SIGUSR1 on Windows.
+func notifyProfiles(dir string) {
+}
@@ -0,0 +1,632 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/procs"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/tcp"
+
+	"github.com/tsg/gopacket"
+	"github.com/tsg/gopacket/layers"
+)
+
+const (
+	TransactionsHashSize = 2 ^ 16
+	TransactionTimeout   = 10 * 1e9
+)
+
+// Size of the length prefix of the DNS messages sent over TCP
+const DnsTcpLengthSize = 2
+
+// Response code of the successful responses, missing from gopacket
+const DnsResponseCodeNoError layers.DNSResponseCode = 0
+
+var dnsTypeNames = map[layers.DNSType]string{
+	layers.DNSTypeA:     "A",
+	layers.DNSTypeNS:    "NS",
+	layers.DNSTypeMD:    "MD",
+	layers.DNSTypeMF:    "MF",
+	layers.DNSTypeCNAME: "CNAME",
+	layers.DNSTypeSOA:   "SOA",
+	layers.DNSTypeMB:    "MB",
+	layers.DNSTypeMG:    "MG",
+	layers.DNSTypeMR:    "MR",
+	layers.DNSTypeNULL:  "NULL",
+	layers.DNSTypeWKS:   "WKS",
+	layers.DNSTypePTR:   "PTR",
+	layers.DNSTypeHINFO: "HINFO",
+	layers.DNSTypeMINFO: "MINFO",
+	layers.DNSTypeMX:    "MX",
+	layers.DNSTypeTXT:   "TXT",
+	layers.DNSTypeAAAA:  "AAAA",
+	layers.DNSTypeSRV:   "SRV",
+	41:                  "OPT",
+	252:                 "AXFR",
+	255:                 "ANY",
+}
+
+var dnsClassNames = map[layers.DNSClass]string{
+	layers.DNSClassIN:  "IN",
+	layers.DNSClassCS:  "CS",
+	layers.DNSClassCH:  "CH",
+	layers.DNSClassHS:  "HS",
+	layers.DNSClassAny: "ANY",
+}
+
+var dnsOpCodeNames = map[layers.DNSOpCode]string{
+	layers.DNSOpCodeQuery:  "QUERY",
+	layers.DNSOpCodeIQuery: "IQUERY",
+	layers.DNSOpCodeStatus: "STATUS",
+	layers.DNSOpCodeNotify: "NOTIFY",
+	layers.DNSOpCodeUpdate: "UPDATE",
+}
+
+var dnsResponseCodeNames = map[layers.DNSResponseCode]string{
+	DnsResponseCodeNoError:         "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+	layers.DNSResponseCodeYXDomain: "YXDOMAIN",
+	layers.DNSResponseCodeYXRRSet:  "YXRRSET",
+	layers.DNSResponseCodeNXRRSet:  "NXRRSET",
+	layers.DNSResponseCodeNotAuth:  "NOTAUTH",
+	layers.DNSResponseCodeNotZone:  "NOTZONE",
+}
+
+func dnsTypeString(t layers.DNSType) string {
+	if name, exists := dnsTypeNames[t]; exists {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
+
+func dnsClassString(c layers.DNSClass) string {
+	if name, exists := dnsClassNames[c]; exists {
+		return name
+	}
+	return strconv.Itoa(int(c))
+}
+
+func dnsOpCodeString(op layers.DNSOpCode) string {
+	if name, exists := dnsOpCodeNames[op]; exists {
+		return name
+	}
+	return strconv.Itoa(int(op))
+}
+
+func dnsResponseCodeString(code layers.DNSResponseCode) string {
+	if name, exists := dnsResponseCodeNames[code]; exists {
+		return name
+	}
+	return strconv.Itoa(int(code))
+}
+
+type DnsMessage struct {
+	Ts           time.Time
+	Link         protos.Link
+	Tuple        common.IpPortTuple // the source is the sender of the message
+	CmdlineTuple *common.CmdlineTuple
+	Transport    string
+	Length       int
+	Data         *layers.DNS
+}
+
+// Requests are matched with the responses by the IP/port tuple, the
+// DNS id and the VLANs and tunnel of the packets.
+type DnsTransactionKey struct {
+	tuple common.HashableIpPortTuple
+	id    uint16
+	link  protos.Link
+}
+
+type DnsTransaction struct {
+	Type         string
+	key          DnsTransactionKey
+	Transport    string
+	Src          common.Endpoint
+	Dst          common.Endpoint
+	ResponseTime int32
+	Ts           int64
+	JsTs         time.Time
+	ts           time.Time
+	BytesIn      int
+	BytesOut     int
+	Status       string
+
+	Request  *layers.DNS
+	Response *layers.DNS
+
+	// the link of the request, with its capturing device
+	link protos.Link
+
+	timer *time.Timer
+}
+
+type DnsStream struct {
+	tcptuple *common.TcpTuple
+
+	data []byte
+}
+
+type dnsPrivateData struct {
+	Data [2]*DnsStream
+}
+
+type Dns struct {
+	// config
+	Ports              []int
+	Send_request       bool
+	Send_response      bool
+	maxTransactions    int
+	transactionTimeout time.Duration
+
+	transactionsMap   map[DnsTransactionKey]*DnsTransaction
+	transactionsOrder *protos.TransactionsOrder
+
+	results chan common.MapStr
+}
+
+func (dns *Dns) InitDefaults() {
+	dns.Send_request = false
+	dns.Send_response = false
+	dns.maxTransactions = protos.DefaultMaxTransactions
+	dns.transactionTimeout = TransactionTimeout
+}
+
+func (dns *Dns) setFromConfig(config config.Dns) error {
+
+	dns.Ports = config.Ports
+
+	if config.Send_request != nil {
+		dns.Send_request = *config.Send_request
+	}
+	if config.Send_response != nil {
+		dns.Send_response = *config.Send_response
+	}
+	if config.Max_transactions != nil {
+		dns.maxTransactions = *config.Max_transactions
+	}
+	if config.Transaction_timeout != nil {
+		dns.transactionTimeout = time.Duration(*config.Transaction_timeout) * time.Second
+	}
+	return nil
+}
+
+func (dns *Dns) GetPorts() []int {
+	return dns.Ports
+}
+
+func (dns *Dns) Init(test_mode bool, results chan common.MapStr) error {
+	dns.InitDefaults()
+	if !test_mode {
+		dns.setFromConfig(config.ConfigSingleton.Protocols.Dns)
+	}
+
+	dns.transactionsMap = make(map[DnsTransactionKey]*DnsTransaction, TransactionsHashSize)
+	dns.transactionsOrder = protos.NewTransactionsOrder()
+	dns.results = results
+
+	return nil
+}
+
+// Decodes a DNS message. The gopacket decoder doesn't check all
+// the lengths, so a malformed message can make it panic.
+func decodeDnsData(data []byte) (dns *layers.DNS, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Malformed DNS message: %v", r)
+		}
+	}()
+
+	dns = &layers.DNS{}
+	err = dns.DecodeFromBytes(data, gopacket.NilDecodeFeedback)
+	if err != nil {
+		return nil, err
+	}
+	return dns, nil
+}
+
+func (dns *Dns) ParseUdp(pkt *protos.Packet) {
+
+	defer logp.Recover("ParseUdpDns exception")
+
+	data, err := decodeDnsData(pkt.Payload)
+	if err != nil {
+		logp.Debug("dns", "Ignore DNS datagram: %s", err)
+		return
+	}
+
+	dns.handleDns(&DnsMessage{
+		Ts:        pkt.Ts,
+		Link:      pkt.Link,
+		Tuple:     pkt.Tuple,
+		Transport: "udp",
+		Length:    len(pkt.Payload),
+		Data:      data,
+	})
+}
+
+// Over TCP, each DNS message is prefixed by its length.
+func (dns *Dns) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
+	dir uint8, private protos.ProtocolData) protos.ProtocolData {
+
+	defer logp.Recover("ParseDns exception")
+
+	priv := dnsPrivateData{}
+	if private != nil {
+		var ok bool
+		priv, ok = private.(dnsPrivateData)
+		if !ok {
+			priv = dnsPrivateData{}
+		}
+	}
+
+	if priv.Data[dir] == nil {
+		priv.Data[dir] = &DnsStream{
+			tcptuple: tcptuple,
+			data:     pkt.Payload,
+		}
+	} else {
+		// concatenate bytes
+		priv.Data[dir].data = append(priv.Data[dir].data, pkt.Payload...)
+		if len(priv.Data[dir].data) > tcp.MaxDataInStream {
+			logp.Debug("dns", "Stream data too large, dropping TCP stream")
+			protos.Stats.CountTooLarge(protos.DnsProtocol)
+			priv.Data[dir] = nil
+			return priv
+		}
+	}
+
+	stream := priv.Data[dir]
+	for len(stream.data) >= DnsTcpLengthSize {
+		length := int(binary.BigEndian.Uint16(stream.data))
+		if len(stream.data) < DnsTcpLengthSize+length {
+			// wait for more data
+			break
+		}
+		payload := stream.data[DnsTcpLengthSize : DnsTcpLengthSize+length]
+		stream.data = stream.data[DnsTcpLengthSize+length:]
+
+		data, err := decodeDnsData(payload)
+		if err != nil {
+			// drop this tcp stream. Will retry parsing with the next
+			// segment in it
+			logp.Debug("dns", "Ignore DNS message: %s. Drop tcp stream.", err)
+			protos.ReportParseError(protos.DnsProtocol, tcptuple, pkt, err.Error())
+			priv.Data[dir] = nil
+			return priv
+		}
+
+		tuple := *tcptuple.IpPort()
+		if dir == tcp.TcpDirectionReverse {
+			tuple = common.NewIpPortTuple(tuple.Ip_length,
+				tuple.Dst_ip, tuple.Dst_port, tuple.Src_ip, tuple.Src_port)
+		}
+
+		dns.handleDns(&DnsMessage{
+			Ts:        pkt.Ts,
+			Link:      pkt.Link,
+			Tuple:     tuple,
+			Transport: "tcp",
+			Length:    length,
+			Data:      data,
+		})
+	}
+
+	return priv
+}
+
+func (dns *Dns) GapInStream(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	if private == nil {
+		return private
+	}
+	dnsData, ok := private.(dnsPrivateData)
+	if !ok {
+		return private
+	}
+
+	// the message boundaries are lost, drop the data in
+	// this direction
+	dnsData.Data[dir] = nil
+	return dnsData
+}
+
+func (dns *Dns) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	return private
+}
+
+func (dns *Dns) handleDns(msg *DnsMessage) {
+
+	if msg.Transport == "udp" {
+		msg.CmdlineTuple = procs.ProcWatcher.FindProcessesTupleUDP(&msg.Tuple)
+	} else {
+		msg.CmdlineTuple = procs.ProcWatcher.FindProcessesTuple(&msg.Tuple)
+	}
+
+	if !msg.Data.QR {
+		dns.receivedDnsRequest(msg)
+	} else {
+		dns.receivedDnsResponse(msg)
+	}
+}
+
+func (dns *Dns) receivedDnsRequest(msg *DnsMessage) {
+
+	key := DnsTransactionKey{tuple: msg.Tuple.Hashable(), id: msg.Data.ID, link: msg.Link.Key()}
+
+	trans := dns.transactionsMap[key]
+	if trans != nil {
+		logp.Debug("dns", "Two requests without a Response. Dropping old request")
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		dns.transactionsOrder.Remove(trans)
+	}
+	trans = &DnsTransaction{Type: "dns", key: key, Transport: msg.Transport, link: msg.Link}
+	dns.transactionsMap[key] = trans
+
+	trans.ts = msg.Ts
+	trans.Ts = int64(trans.ts.UnixNano() / 1000) // transactions have microseconds resolution
+	trans.JsTs = msg.Ts
+	trans.Src = common.Endpoint{
+		Ip:   msg.Tuple.Src_ip.String(),
+		Port: msg.Tuple.Src_port,
+		Proc: string(msg.CmdlineTuple.Src),
+	}
+	trans.Dst = common.Endpoint{
+		Ip:   msg.Tuple.Dst_ip.String(),
+		Port: msg.Tuple.Dst_port,
+		Proc: string(msg.CmdlineTuple.Dst),
+	}
+	trans.Request = msg.Data
+	trans.BytesIn = msg.Length
+
+	trans.timer = time.AfterFunc(dns.transactionTimeout, func() { dns.expireTransaction(trans) })
+
+	dns.transactionsOrder.Add(trans)
+	dns.evictTransactions()
+}
+
+// evictTransactions publishes the oldest requests, without their
+// response, while more than maxTransactions are waiting.
+func (dns *Dns) evictTransactions() {
+	for dns.maxTransactions > 0 && dns.transactionsOrder.Len() > dns.maxTransactions {
+		trans, ok := dns.transactionsOrder.Oldest().(*DnsTransaction)
+		if !ok {
+			break
+		}
+		dns.removeTransaction(trans)
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+
+		trans.Status = protos.OVERFLOW_STATUS
+		dns.publishTransaction(trans)
+	}
+}
+
+func (dns *Dns) removeTransaction(trans *DnsTransaction) {
+	delete(dns.transactionsMap, trans.key)
+	dns.transactionsOrder.Remove(trans)
+}
+
+func (dns *Dns) receivedDnsResponse(msg *DnsMessage) {
+
+	key := DnsTransactionKey{tuple: msg.Tuple.RevHashable(), id: msg.Data.ID, link: msg.Link.Key()}
+
+	trans := dns.transactionsMap[key]
+	if trans == nil {
+		logp.Warn("Response from unknown transaction. Ignoring.")
+		return
+	}
+
+	trans.Response = msg.Data
+	trans.BytesOut = msg.Length
+	trans.ResponseTime = int32(msg.Ts.Sub(trans.ts).Nanoseconds() / 1e6) // resp_time in milliseconds
+
+	dns.publishTransaction(trans)
+
+	logp.Debug("dns", "DNS transaction completed: id %d", trans.Response.ID)
+
+	// remove from map
+	dns.removeTransaction(trans)
+	if trans.timer != nil {
+		trans.timer.Stop()
+	}
+}
+
+// TransactionsInFlight returns the number of requests waiting for their
+// response.
+func (dns *Dns) TransactionsInFlight() int {
+	return len(dns.transactionsMap)
+}
+
+// Flush publishes the requests still waiting for their response.
+func (dns *Dns) Flush() {
+	for _, trans := range dns.transactionsMap {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		dns.removeTransaction(trans)
+
+		trans.Status = protos.SHUTDOWN_STATUS
+		dns.publishTransaction(trans)
+	}
+}
+
+func (dns *Dns) expireTransaction(trans *DnsTransaction) {
+
+	// remove from map
+	dns.removeTransaction(trans)
+}
+
+func dnsQuestionToMapStr(q *layers.DNSQuestion) common.MapStr {
+	return common.MapStr{
+		"name":  string(q.Name),
+		"type":  dnsTypeString(q.Type),
+		"class": dnsClassString(q.Class),
+	}
+}
+
+// Returns the data of a resource record in the zone file format.
+func dnsRecordData(rr *layers.DNSResourceRecord) string {
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		return rr.IP.String()
+	case layers.DNSTypeNS:
+		return string(rr.NS)
+	case layers.DNSTypeCNAME:
+		return string(rr.CNAME)
+	case layers.DNSTypePTR:
+		return string(rr.PTR)
+	case layers.DNSTypeMX:
+		return fmt.Sprintf("%d %s", rr.MX.Preference, rr.MX.Name)
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", rr.SRV.Priority, rr.SRV.Weight,
+			rr.SRV.Port, rr.SRV.Name)
+	case layers.DNSTypeSOA:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", rr.SOA.MName, rr.SOA.RName,
+			rr.SOA.Serial, rr.SOA.Refresh, rr.SOA.Retry, rr.SOA.Expire,
+			rr.SOA.Minimum)
+	case layers.DNSTypeTXT:
+		return string(rr.TXT)
+	}
+	return fmt.Sprintf("%x", rr.Data)
+}
+
+func dnsRecordToMapStr(rr *layers.DNSResourceRecord) common.MapStr {
+	return common.MapStr{
+		"name":  string(rr.Name),
+		"type":  dnsTypeString(rr.Type),
+		"class": dnsClassString(rr.Class),
+		"ttl":   rr.TTL,
+		"data":  dnsRecordData(rr),
+	}
+}
+
+// Returns a text representation of the message, similar to the
+// output of dig.
+func dnsToString(d *layers.DNS) string {
+	var lines []string
+
+	flags := []string{}
+	if d.QR {
+		flags = append(flags, "qr")
+	}
+	if d.AA {
+		flags = append(flags, "aa")
+	}
+	if d.TC {
+		flags = append(flags, "tc")
+	}
+	if d.RD {
+		flags = append(flags, "rd")
+	}
+	if d.RA {
+		flags = append(flags, "ra")
+	}
+	lines = append(lines, fmt.Sprintf("opcode: %s, status: %s, id: %d, flags: %s",
+		dnsOpCodeString(d.OpCode), dnsResponseCodeString(d.ResponseCode),
+		d.ID, strings.Join(flags, " ")))
+
+	for _, q := range d.Questions {
+		lines = append(lines, fmt.Sprintf("%s %s %s", q.Name,
+			dnsClassString(q.Class), dnsTypeString(q.Type)))
+	}
+	for _, records := range [][]layers.DNSResourceRecord{d.Answers, d.Authorities, d.Additionals} {
+		for i := range records {
+			rr := &records[i]
+			lines = append(lines, fmt.Sprintf("%s %d %s %s %s", rr.Name, rr.TTL,
+				dnsClassString(rr.Class), dnsTypeString(rr.Type), dnsRecordData(rr)))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (dns *Dns) publishTransaction(t *DnsTransaction) {
+
+	if dns.results == nil {
+		return
+	}
+
+	request := t.Request
+	response := t.Response
+
+	event := common.MapStr{}
+	event["type"] = "dns"
+	if len(t.Status) > 0 {
+		event["status"] = t.Status
+	} else if response.ResponseCode == DnsResponseCodeNoError {
+		event["status"] = common.OK_STATUS
+	} else {
+		event["status"] = common.ERROR_STATUS
+	}
+	event["responsetime"] = t.ResponseTime
+	if dns.Send_request {
+		event["request"] = dnsToString(request)
+	}
+	if dns.Send_response && response != nil {
+		event["response"] = dnsToString(response)
+	}
+	event["method"] = dnsOpCodeString(request.OpCode)
+	event["transport"] = t.Transport
+	event["bytes_in"] = uint64(t.BytesIn)
+	event["bytes_out"] = uint64(t.BytesOut)
+
+	details := common.MapStr{
+		"id":                request.ID,
+		"op_code":           dnsOpCodeString(request.OpCode),
+		"recursion_desired": request.RD,
+	}
+	if response != nil {
+		details["id"] = response.ID
+		details["op_code"] = dnsOpCodeString(response.OpCode)
+		details["response_code"] = dnsResponseCodeString(response.ResponseCode)
+		details["answers_count"] = len(response.Answers)
+		details["authorities_count"] = len(response.Authorities)
+		details["additionals_count"] = len(response.Additionals)
+		details["authoritative"] = response.AA
+		details["recursion_desired"] = response.RD
+		details["recursion_available"] = response.RA
+		details["truncated_response"] = response.TC
+	}
+	if len(request.Questions) > 0 {
+		q := &request.Questions[0]
+		details["question"] = dnsQuestionToMapStr(q)
+
+		event["resource"] = string(q.Name)
+		event["query"] = fmt.Sprintf("class %s, type %s, %s",
+			dnsClassString(q.Class), dnsTypeString(q.Type), q.Name)
+	}
+	if response != nil && len(response.Answers) > 0 {
+		answers := make([]common.MapStr, 0, len(response.Answers))
+		for i := range response.Answers {
+			answers = append(answers, dnsRecordToMapStr(&response.Answers[i]))
+		}
+		details["answers"] = answers
+	}
+	event["dns"] = details
+
+	event["timestamp"] = common.Time(t.ts)
+	event["src"] = &t.Src
+	event["dst"] = &t.Dst
+	t.link.AddFields(event)
+
+	dns.results <- event
+}
@@ -0,0 +1,211 @@
+package dns
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func DnsModForTests() *Dns {
+	var dns Dns
+	dns.Init(true, nil)
+	dns.results = make(chan common.MapStr, 10)
+	return &dns
+}
+
+var clientTuple = common.NewIpPortTuple(4,
+	net.ParseIP("192.168.0.10"), 34567,
+	net.ParseIP("8.8.8.8"), 53)
+
+var serverTuple = common.NewIpPortTuple(4,
+	net.ParseIP("8.8.8.8"), 53,
+	net.ParseIP("192.168.0.10"), 34567)
+
+func newPacket(t *testing.T, tuple common.IpPortTuple, payload string, ts time.Time) *protos.Packet {
+	data, err := hex.DecodeString(payload)
+	if err != nil {
+		t.Fatalf("Failed to decode hex string")
+	}
+	return &protos.Packet{Ts: ts, Tuple: tuple, Payload: data}
+}
+
+func TestParseUdp_ARecord(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"dns"})
+	}
+
+	dns := DnsModForTests()
+	ts := time.Now()
+
+	// www.elastic.co, type A
+	dns.ParseUdp(newPacket(t, clientTuple,
+		"8d3c010000010000000000000377777707656c617374696302636f0000010001", ts))
+	assert.Equal(t, 1, len(dns.transactionsMap))
+
+	// CNAME elastic.map.fastly.net, A 151.101.2.217
+	dns.ParseUdp(newPacket(t, serverTuple,
+		"8d3c818000010002000000000377777707656c617374696302636f0000010001"+
+			"c00c000500010000012c001807656c6173746963036d617006666173746c7903"+
+			"6e657400c02c000100010000001e0004976502d9",
+		ts.Add(12*time.Millisecond)))
+
+	if len(dns.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(dns.results))
+	}
+	assert.Equal(t, 0, len(dns.transactionsMap))
+
+	event := <-dns.results
+	assert.Equal(t, "dns", event["type"])
+	assert.Equal(t, common.OK_STATUS, event["status"])
+	assert.Equal(t, int32(12), event["responsetime"])
+	assert.Equal(t, "QUERY", event["method"])
+	assert.Equal(t, "udp", event["transport"])
+	assert.Equal(t, "www.elastic.co", event["resource"])
+	assert.Equal(t, "class IN, type A, www.elastic.co", event["query"])
+	assert.Equal(t, "192.168.0.10", event["src"].(*common.Endpoint).Ip)
+	assert.Equal(t, "8.8.8.8", event["dst"].(*common.Endpoint).Ip)
+
+	details := event["dns"].(common.MapStr)
+	assert.Equal(t, uint16(0x8d3c), details["id"])
+	assert.Equal(t, "NOERROR", details["response_code"])
+	assert.Equal(t, 2, details["answers_count"])
+	assert.Equal(t, common.MapStr{
+		"name":  "www.elastic.co",
+		"type":  "A",
+		"class": "IN",
+	}, details["question"])
+
+	answers := details["answers"].([]common.MapStr)
+	assert.Equal(t, "CNAME", answers[0]["type"])
+	assert.Equal(t, "elastic.map.fastly.net", answers[0]["data"])
+	assert.Equal(t, "A", answers[1]["type"])
+	assert.Equal(t, "151.101.2.217", answers[1]["data"])
+	assert.Equal(t, uint32(30), answers[1]["ttl"])
+}
+
+func TestParseUdp_NXDomain(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"dns"})
+	}
+
+	dns := DnsModForTests()
+	ts := time.Now()
+
+	// nothere.elastic.co, type A
+	dns.ParseUdp(newPacket(t, clientTuple,
+		"22f101000001000000000000076e6f746865726507656c617374696302636f0000010001", ts))
+
+	// NXDOMAIN with the SOA of elastic.co in the authority section
+	dns.ParseUdp(newPacket(t, serverTuple,
+		"22f181830001000000010000076e6f746865726507656c617374696302636f00"+
+			"00010001c014000600010000012c003b036e733107656c617374696302636f00"+
+			"0a686f73746d617374657207656c617374696302636f00781b640900000e1000"+
+			"000258000151800000012c",
+		ts))
+
+	if len(dns.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(dns.results))
+	}
+	event := <-dns.results
+	assert.Equal(t, common.ERROR_STATUS, event["status"])
+	assert.Equal(t, "nothere.elastic.co", event["resource"])
+
+	details := event["dns"].(common.MapStr)
+	assert.Equal(t, "NXDOMAIN", details["response_code"])
+	assert.Equal(t, 0, details["answers_count"])
+	assert.Equal(t, 1, details["authorities_count"])
+	_, exists := details["answers"]
+	assert.False(t, exists)
+}
+
+func TestParseUdp_responseWithoutRequest(t *testing.T) {
+
+	dns := DnsModForTests()
+
+	dns.ParseUdp(newPacket(t, serverTuple,
+		"8d3c818000010002000000000377777707656c617374696302636f0000010001"+
+			"c00c000500010000012c001807656c6173746963036d617006666173746c7903"+
+			"6e657400c02c000100010000001e0004976502d9",
+		time.Now()))
+
+	assert.Equal(t, 0, len(dns.results))
+}
+
+func TestParseUdp_malformed(t *testing.T) {
+
+	dns := DnsModForTests()
+
+	// header announcing one question, but the name is cut
+	dns.ParseUdp(newPacket(t, clientTuple, "8d3c0100000100000000000003777777", time.Now()))
+
+	assert.Equal(t, 0, len(dns.transactionsMap))
+}
+
+func TestParseTcp_ARecord(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"dns"})
+	}
+
+	dns := DnsModForTests()
+	tcptuple := common.TcpTupleFromIpPort(&clientTuple, 1)
+	ts := time.Now()
+
+	// the request split in two segments
+	var private protos.ProtocolData
+	private = dns.Parse(newPacket(t, clientTuple, "00208d3c", ts), &tcptuple, 1, private)
+	private = dns.Parse(newPacket(t, clientTuple,
+		"010000010000000000000377777707656c617374696302636f0000010001", ts),
+		&tcptuple, 1, private)
+	assert.Equal(t, 1, len(dns.transactionsMap))
+
+	dns.Parse(newPacket(t, serverTuple,
+		"00488d3c818000010002000000000377777707656c617374696302636f000001"+
+			"0001c00c000500010000012c001807656c6173746963036d617006666173746c"+
+			"79036e657400c02c000100010000001e0004976502d9",
+		ts), &tcptuple, 0, private)
+
+	if len(dns.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(dns.results))
+	}
+	event := <-dns.results
+	assert.Equal(t, "tcp", event["transport"])
+	assert.Equal(t, "www.elastic.co", event["resource"])
+	assert.Equal(t, "192.168.0.10", event["src"].(*common.Endpoint).Ip)
+}
+
+// Test that the requests without response are published when the plugin
+// is flushed on shutdown.
+func TestDns_flushPendingTransactions(t *testing.T) {
+	dns := DnsModForTests()
+
+	// www.elastic.co, type A
+	dns.ParseUdp(newPacket(t, clientTuple,
+		"8d3c010000010000000000000377777707656c617374696302636f0000010001", time.Now()))
+	if len(dns.transactionsMap) != 1 {
+		t.Fatalf("Expected the request to be in the transactions map")
+	}
+	var timer *time.Timer
+	for _, trans := range dns.transactionsMap {
+		timer = trans.timer
+	}
+
+	dns.Flush()
+
+	if len(dns.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(dns.results))
+	}
+	event := <-dns.results
+	assert.Equal(t, protos.SHUTDOWN_STATUS, event["status"])
+	assert.Equal(t, "www.elastic.co", event["resource"])
+	assert.Equal(t, 0, len(dns.transactionsMap))
+	assert.Equal(t, 0, dns.transactionsOrder.Len())
+	assert.False(t, timer.Stop(), "transaction timer still running")
+}
@@ -0,0 +1,41 @@
+package http
+
+import (
+	"net"
+	"strings"
+)
+
+// clientIp returns the address of the client that sent the request through
+// the trusted proxies. The addresses of the X-Forwarded-For header, or
+// else of the X-Real-IP header, are followed from the peer back to the
+// client, and the first one that is not a trusted proxy is returned. The
+// headers are ignored when the peer itself is not a trusted proxy, as
+// anyone can set them.
+func (http *Http) clientIp(m *HttpMessage, peer net.IP) string {
+	if peer == nil {
+		return ""
+	}
+	if !http.Trusted_proxies.IsInternal(peer) {
+		return peer.String()
+	}
+
+	header := m.forwardedFor
+	if len(header) == 0 {
+		header = m.xRealIp
+	}
+
+	client := peer
+	addresses := strings.Split(header, ",")
+	for i := len(addresses) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(addresses[i]))
+		if ip == nil {
+			// can't tell who added it, stop at the last proxy
+			break
+		}
+		client = ip
+		if !http.Trusted_proxies.IsInternal(ip) {
+			break
+		}
+	}
+	return client.String()
+}
@@ -0,0 +1,78 @@
+package http
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/stretchr/testify/assert"
+)
+
+// parseForwardedRequest replays a request from 192.168.0.2 with the given
+// headers and returns its event.
+func parseForwardedRequest(t *testing.T, trusted []string, headers string) common.MapStr {
+	http := HttpModForTests()
+	http.results = make(chan common.MapStr, 10)
+	err := http.SetFromConfig(config.Http{Trusted_proxies: trusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcptuple := testTcpTuple()
+	req := []byte("GET / HTTP/1.1\r\n" +
+		"Host: www.example.com\r\n" +
+		headers +
+		"\r\n")
+	resp := []byte("HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 0\r\n" +
+		"\r\n")
+
+	var private protos.ProtocolData
+	private = http.Parse(&protos.Packet{Ts: time.Now(), Payload: req}, tcptuple, 0, private)
+	http.Parse(&protos.Packet{Ts: time.Now(), Payload: resp}, tcptuple, 1, private)
+
+	if len(http.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(http.results))
+	}
+	return <-http.results
+}
+
+func TestHttpParser_clientIpForwardedChain(t *testing.T) {
+	trusted := []string{"192.168.0.0/24", "10.0.0.0/8"}
+
+	// the first address is set by the client, anyone can put anything
+	event := parseForwardedRequest(t, trusted,
+		"X-Forwarded-For: 1.2.3.4, 203.0.113.7\r\n"+
+			"X-Forwarded-For: 10.1.2.3\r\n")
+	assert.Equal(t, common.MapStr{"ip": "203.0.113.7"}, event["client"])
+
+	event = parseForwardedRequest(t, trusted, "X-Real-IP: 198.51.100.1\r\n")
+	assert.Equal(t, common.MapStr{"ip": "198.51.100.1"}, event["client"])
+
+	// only trusted proxies, the client is the first one
+	event = parseForwardedRequest(t, trusted, "X-Forwarded-For: 10.0.0.1, 10.1.2.3\r\n")
+	assert.Equal(t, common.MapStr{"ip": "10.0.0.1"}, event["client"])
+
+	event = parseForwardedRequest(t, trusted, "")
+	assert.Equal(t, common.MapStr{"ip": "192.168.0.2"}, event["client"])
+}
+
+func TestHttpParser_clientIpSpoofedHeader(t *testing.T) {
+	// the peer is not a proxy
+	event := parseForwardedRequest(t, []string{"10.0.0.0/8"},
+		"X-Forwarded-For: 203.0.113.7\r\n")
+	assert.Equal(t, common.MapStr{"ip": "192.168.0.2"}, event["client"])
+}
+
+func TestHttpParser_clientIpDisabled(t *testing.T) {
+	event := parseForwardedRequest(t, nil, "X-Forwarded-For: 203.0.113.7\r\n")
+	assert.Nil(t, event["client"])
+}
+
+func TestHttpParser_invalidTrustedProxies(t *testing.T) {
+	http := HttpModForTests()
+	err := http.SetFromConfig(config.Http{Trusted_proxies: []string{"10.0.0.0"}})
+	assert.NotNil(t, err)
+}
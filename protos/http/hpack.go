@@ -0,0 +1,277 @@
+package http
+
+import (
+	"errors"
+)
+
+// HPACK (RFC 7541) decoding of the HTTP/2 header blocks.
+
+type hpackHeaderField struct {
+	name  string
+	value string
+}
+
+// size of the entry in the dynamic table, as defined in section 4.1
+func (f hpackHeaderField) size() int {
+	return len(f.name) + len(f.value) + 32
+}
+
+const hpackDefaultTableSize = 4096
+
+var (
+	errHpackTruncated      = errors.New("hpack: truncated header block")
+	errHpackIntOverflow    = errors.New("hpack: integer overflow")
+	errHpackInvalidIndex   = errors.New("hpack: invalid index")
+	errHpackInvalidHuffman = errors.New("hpack: invalid huffman code")
+	errHpackHuffmanEOS     = errors.New("hpack: huffman EOS symbol in a string")
+	errHpackTableSize      = errors.New("hpack: dynamic table size update too large")
+)
+
+// hpackDecoder decodes the header blocks sent in one direction of a
+// connection. The dynamic table is shared by all the blocks, so every
+// block must be decoded, in order.
+type hpackDecoder struct {
+	// newest entry first
+	dynamic []hpackHeaderField
+	size    int
+	maxSize int
+	// upper limit of maxSize, the SETTINGS_HEADER_TABLE_SIZE
+	allowedMaxSize int
+}
+
+func newHpackDecoder() *hpackDecoder {
+	return &hpackDecoder{
+		maxSize:        hpackDefaultTableSize,
+		allowedMaxSize: hpackDefaultTableSize,
+	}
+}
+
+func (d *hpackDecoder) decode(block []byte) ([]hpackHeaderField, error) {
+	var fields []hpackHeaderField
+
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0:
+			// indexed header field
+			idx, n, err := hpackReadInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			field, err := d.at(idx)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+			block = block[n:]
+
+		case b&0xc0 == 0x40:
+			// literal with incremental indexing
+			field, n, err := d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.add(field)
+			fields = append(fields, field)
+			block = block[n:]
+
+		case b&0xe0 == 0x20:
+			// dynamic table size update
+			size, n, err := hpackReadInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > d.allowedMaxSize {
+				return nil, errHpackTableSize
+			}
+			d.maxSize = size
+			d.evict(0)
+			block = block[n:]
+
+		default:
+			// literal without indexing (0000) or never indexed (0001)
+			field, n, err := d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+			block = block[n:]
+		}
+	}
+
+	return fields, nil
+}
+
+// at returns the entry of the static or dynamic table at the given index.
+func (d *hpackDecoder) at(idx int) (hpackHeaderField, error) {
+	if idx < 1 {
+		return hpackHeaderField{}, errHpackInvalidIndex
+	}
+	if idx <= len(hpackStaticTable) {
+		return hpackStaticTable[idx-1], nil
+	}
+	idx -= len(hpackStaticTable) + 1
+	if idx >= len(d.dynamic) {
+		return hpackHeaderField{}, errHpackInvalidIndex
+	}
+	return d.dynamic[idx], nil
+}
+
+func (d *hpackDecoder) add(field hpackHeaderField) {
+	d.evict(field.size())
+	if field.size() > d.maxSize {
+		// an entry larger than the table empties it
+		return
+	}
+	d.dynamic = append([]hpackHeaderField{field}, d.dynamic...)
+	d.size += field.size()
+}
+
+// evict removes the oldest entries until there is room for an
+// entry of the given size.
+func (d *hpackDecoder) evict(room int) {
+	for len(d.dynamic) > 0 && d.size+room > d.maxSize {
+		last := len(d.dynamic) - 1
+		d.size -= d.dynamic[last].size()
+		d.dynamic = d.dynamic[:last]
+	}
+}
+
+// readLiteral reads a literal header field whose name is indexed with
+// the given prefix, or follows as a string when the index is 0.
+func (d *hpackDecoder) readLiteral(block []byte, prefix uint) (hpackHeaderField, int, error) {
+	var field hpackHeaderField
+
+	idx, offset, err := hpackReadInt(block, prefix)
+	if err != nil {
+		return field, 0, err
+	}
+	if idx > 0 {
+		name, err := d.at(idx)
+		if err != nil {
+			return field, 0, err
+		}
+		field.name = name.name
+	} else {
+		name, n, err := hpackReadString(block[offset:])
+		if err != nil {
+			return field, 0, err
+		}
+		field.name = name
+		offset += n
+	}
+
+	value, n, err := hpackReadString(block[offset:])
+	if err != nil {
+		return field, 0, err
+	}
+	field.value = value
+
+	return field, offset + n, nil
+}
+
+// hpackReadInt decodes an integer with an N-bit prefix (section 5.1). It
+// returns the value and the number of bytes used.
+func hpackReadInt(data []byte, prefix uint) (int, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errHpackTruncated
+	}
+
+	mask := 1<<prefix - 1
+	value := int(data[0]) & mask
+	if value < mask {
+		return value, 1, nil
+	}
+
+	var shift uint
+	for i := 1; i < len(data); i++ {
+		b := data[i]
+		value += int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, i + 1, nil
+		}
+		shift += 7
+		if shift > 28 {
+			return 0, 0, errHpackIntOverflow
+		}
+	}
+	return 0, 0, errHpackTruncated
+}
+
+// hpackReadString decodes a string literal (section 5.2).
+func hpackReadString(data []byte) (string, int, error) {
+	if len(data) == 0 {
+		return "", 0, errHpackTruncated
+	}
+
+	huffman := data[0]&0x80 != 0
+	length, n, err := hpackReadInt(data, 7)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(data) < n+length {
+		return "", 0, errHpackTruncated
+	}
+
+	raw := data[n : n+length]
+	if !huffman {
+		return string(raw), n + length, nil
+	}
+
+	s, err := hpackHuffmanDecode(raw)
+	if err != nil {
+		return "", 0, err
+	}
+	return s, n + length, nil
+}
+
+// The EOS symbol, 30 bits set, only pads the strings. Decoding it is an
+// error, RFC 7541 section 5.2.
+const (
+	hpackHuffmanEOS    = 0x3fffffff
+	hpackHuffmanEOSLen = 30
+)
+
+// maps the length and the code of each symbol to the symbol
+var hpackHuffmanSymbols map[uint64]byte
+
+func init() {
+	hpackHuffmanSymbols = make(map[uint64]byte, len(hpackHuffmanCodes))
+	for sym, code := range hpackHuffmanCodes {
+		key := uint64(hpackHuffmanCodeLen[sym])<<32 | uint64(code)
+		hpackHuffmanSymbols[key] = byte(sym)
+	}
+}
+
+func hpackHuffmanDecode(data []byte) (string, error) {
+	out := make([]byte, 0, len(data)*8/5)
+
+	var code uint32
+	var length uint8
+	for _, b := range data {
+		for bit := 7; bit >= 0; bit-- {
+			code = code<<1 | uint32(b>>uint(bit))&1
+			length++
+			if length < 5 {
+				continue
+			}
+			if sym, found := hpackHuffmanSymbols[uint64(length)<<32|uint64(code)]; found {
+				out = append(out, sym)
+				code, length = 0, 0
+			} else if length == hpackHuffmanEOSLen && code == hpackHuffmanEOS {
+				return "", errHpackHuffmanEOS
+			} else if length >= hpackHuffmanEOSLen {
+				// longer than the longest code
+				return "", errHpackInvalidHuffman
+			}
+		}
+	}
+
+	// the padding is made of the most significant bits of the EOS
+	// symbol, so it is all ones and shorter than a byte
+	if length > 7 || code != 1<<length-1 {
+		return "", errHpackInvalidHuffman
+	}
+
+	return string(out), nil
+}
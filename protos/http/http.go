@@ -2,9 +2,16 @@ package http
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -13,6 +20,7 @@ import (
 	"github.com/johann8384/libbeat/logp"
 
 	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/networks"
 	"github.com/johann8384/packetbeat/procs"
 	"github.com/johann8384/packetbeat/protos"
 	"github.com/johann8384/packetbeat/protos/tcp"
@@ -26,19 +34,24 @@ const (
 	BODY_CHUNKED_START
 	BODY_CHUNKED
 	BODY_CHUNKED_WAIT_FINAL_CRLF
+	BODY_CHUNKED_TRAILER
 )
 
 // Http Message
 type HttpMessage struct {
 	Ts               time.Time
+	Link             protos.Link
 	hasContentLength bool
 	headerOffset     int
 	bodyOffset       int
 	version_major    uint8
 	version_minor    uint8
 	connection       string
+	upgrade          string
 	chunked_length   int
 	chunked_body     []byte
+	// set when the bytes of the body past Max_body_size were dropped
+	bodyTruncated bool
 
 	IsRequest    bool
 	TcpTuple     common.TcpTuple
@@ -51,9 +64,12 @@ type HttpMessage struct {
 	StatusCode   uint16
 	StatusPhrase string
 	Real_ip      string
+	forwardedFor string
+	xRealIp      string
 	// Http Headers
 	ContentLength    int
 	ContentType      string
+	ContentEncoding  string
 	TransferEncoding string
 	Headers          map[string]string
 	Body             string
@@ -74,14 +90,20 @@ type HttpStream struct {
 	bodyReceived int
 
 	message *HttpMessage
+
+	// set after a request to upgrade the connection to WebSocket, the
+	// data that follows is kept unparsed until the response
+	upgrading bool
 }
 
 type HttpTransaction struct {
 	Type         string
 	tuple        common.TcpTuple
+	link         protos.Link
 	Src          common.Endpoint
 	Dst          common.Endpoint
 	Real_ip      string
+	Client_ip    string
 	ResponseTime int32
 	Ts           int64
 	JsTs         time.Time
@@ -96,24 +118,49 @@ type HttpTransaction struct {
 
 	Request_raw  string
 	Response_raw string
+	Notes        []string
+
+	// set when published without the response
+	Status string
 
 	timer *time.Timer
 }
 
 type Http struct {
 	// config
-	Ports               []int
-	Send_request        bool
-	Send_response       bool
-	Send_headers        bool
-	Send_all_headers    bool
-	Headers_whitelist   map[string]bool
-	Split_cookie        bool
-	Real_ip_header      string
-	Hide_keywords       []string
-	Strip_authorization bool
-
-	transactionsMap map[common.HashableTcpTuple]*HttpTransaction
+	Ports                  []int
+	Send_request           bool
+	Send_response          bool
+	Split_request_response bool
+	Send_headers           bool
+	Send_all_headers       bool
+	Headers_whitelist      map[string]bool
+	Split_cookie           bool
+	Real_ip_header         string
+	Hide_keywords          []string
+	Strip_authorization    bool
+	Redact_headers         map[string]bool
+	Redact_query_params    map[string]bool
+	Ignore_urls            map[string]bool
+	Ignore_urls_regexps    []*regexp.Regexp
+	Include_body_for       []string
+	Exclude_body_for       []string
+	Max_body_size          int
+	Max_transactions       int
+	Transaction_timeout    time.Duration
+	Parse_json_bodies      bool
+	Json_max_depth         int
+	Trusted_proxies        *networks.Networks
+
+	// requests waiting for their response, in the order in which they
+	// were sent, as the responses to pipelined requests come in the
+	// same order
+	transactionsMap   map[common.HashableTcpTuple][]*HttpTransaction
+	transactionsOrder *protos.TransactionsOrder
+
+	// the connections upgraded to WebSocket whose event is not
+	// published yet
+	websockets map[*websocketConnection]common.TcpTuple
 
 	results chan common.MapStr
 }
@@ -122,6 +169,10 @@ func (http *Http) InitDefaults() {
 	http.Send_request = false
 	http.Send_response = false
 	http.Strip_authorization = false
+	http.Max_body_size = DefaultMaxBodySize
+	http.Max_transactions = protos.DefaultMaxTransactions
+	http.Transaction_timeout = TransactionTimeout
+	http.Json_max_depth = DefaultJsonMaxDepth
 }
 
 func (http *Http) SetFromConfig(config config.Http) (err error) {
@@ -134,12 +185,15 @@ func (http *Http) SetFromConfig(config config.Http) (err error) {
 	if config.Send_response != nil {
 		http.Send_response = *config.Send_response
 	}
+	if config.Split_request_response != nil {
+		http.Split_request_response = *config.Split_request_response
+	}
 	http.Hide_keywords = config.Hide_keywords
 	if config.Strip_authorization != nil {
 		http.Strip_authorization = *config.Strip_authorization
 	}
 
-	if config.Send_all_headers != nil {
+	if config.Send_all_headers != nil && *config.Send_all_headers {
 		http.Send_headers = true
 		http.Send_all_headers = true
 	} else {
@@ -153,6 +207,34 @@ func (http *Http) SetFromConfig(config config.Http) (err error) {
 		}
 	}
 
+	if len(config.Redact_headers) > 0 {
+		http.Redact_headers = map[string]bool{}
+		for _, hdr := range config.Redact_headers {
+			http.Redact_headers[strings.ToLower(hdr)] = true
+		}
+	}
+	if len(config.Redact_query_params) > 0 {
+		http.Redact_query_params = map[string]bool{}
+		for _, param := range config.Redact_query_params {
+			http.Redact_query_params[strings.ToLower(param)] = true
+		}
+	}
+
+	if len(config.Ignore_urls) > 0 {
+		http.Ignore_urls = map[string]bool{}
+		for _, ignored := range config.Ignore_urls {
+			if !strings.HasPrefix(ignored, "^") {
+				http.Ignore_urls[ignored] = true
+				continue
+			}
+			re, err := regexp.Compile(ignored)
+			if err != nil {
+				return fmt.Errorf("invalid ignore_urls regexp %s: %v", ignored, err)
+			}
+			http.Ignore_urls_regexps = append(http.Ignore_urls_regexps, re)
+		}
+	}
+
 	if config.Split_cookie != nil {
 		http.Split_cookie = *config.Split_cookie
 	}
@@ -160,6 +242,34 @@ func (http *Http) SetFromConfig(config config.Http) (err error) {
 	if config.Real_ip_header != nil {
 		http.Real_ip_header = strings.ToLower(*config.Real_ip_header)
 	}
+	if len(config.Trusted_proxies) > 0 {
+		http.Trusted_proxies, err = networks.New(config.Trusted_proxies)
+		if err != nil {
+			return err
+		}
+	}
+
+	http.Include_body_for = lowerAll(config.Include_body_for)
+	http.Exclude_body_for = lowerAll(config.Exclude_body_for)
+	if config.Max_body_size != nil {
+		if *config.Max_body_size < 0 {
+			return fmt.Errorf("invalid max_body_size %d, must be positive or 0",
+				*config.Max_body_size)
+		}
+		http.Max_body_size = *config.Max_body_size
+	}
+	if config.Max_transactions != nil {
+		http.Max_transactions = *config.Max_transactions
+	}
+	if config.Transaction_timeout != nil {
+		http.Transaction_timeout = time.Duration(*config.Transaction_timeout) * time.Second
+	}
+	if config.Parse_json_bodies != nil {
+		http.Parse_json_bodies = *config.Parse_json_bodies
+	}
+	if config.Json_max_depth != nil {
+		http.Json_max_depth = *config.Json_max_depth
+	}
 
 	return nil
 }
@@ -171,6 +281,17 @@ func (http *Http) GetPorts() []int {
 const (
 	TransactionsHashSize = 2 ^ 16
 	TransactionTimeout   = 10 * 1e9
+
+	// Compressed bodies are decoded up to this size, to protect
+	// against decompression bombs.
+	MaxDecodedBodySize = 1024 * 1024
+
+	// The bodies included in the request and response fields are
+	// truncated to this size by default.
+	DefaultMaxBodySize = 10 * 1024
+
+	// Replaces the values of the redacted headers and query parameters.
+	RedactedValue = "[redacted]"
 )
 
 func (http *Http) Init(test_mode bool, results chan common.MapStr) error {
@@ -184,7 +305,9 @@ func (http *Http) Init(test_mode bool, results chan common.MapStr) error {
 		}
 	}
 
-	http.transactionsMap = make(map[common.HashableTcpTuple]*HttpTransaction, TransactionsHashSize)
+	http.transactionsMap = make(map[common.HashableTcpTuple][]*HttpTransaction, TransactionsHashSize)
+	http.transactionsOrder = protos.NewTransactionsOrder()
+	http.websockets = make(map[*websocketConnection]common.TcpTuple)
 
 	logp.Debug("http", "transactionsMap: %p http: %p", http.transactionsMap, &http)
 
@@ -252,35 +375,7 @@ func (http *Http) parseHeader(m *HttpMessage, data []byte) (bool, bool, int) {
 			headerVal := string(bytes.Trim(data[i+1:p], " \t"))
 			logp.Debug("http", "Header: '%s' Value: '%s'\n", headerName, headerVal)
 
-			// Headers we need for parsing. Make sure we always
-			// capture their value
-			if headerName == "content-length" {
-				m.ContentLength, _ = strconv.Atoi(headerVal)
-				m.hasContentLength = true
-			} else if headerName == "content-type" {
-				m.ContentType = headerVal
-			} else if headerName == "transfer-encoding" {
-				m.TransferEncoding = headerVal
-			} else if headerName == "connection" {
-				m.connection = headerVal
-			}
-			if len(http.Real_ip_header) > 0 && headerName == http.Real_ip_header {
-				m.Real_ip = headerVal
-			}
-
-			if http.Send_headers {
-				if !http.Send_all_headers {
-					_, exists := http.Headers_whitelist[headerName]
-					if !exists {
-						return true, true, p + 2
-					}
-				}
-				if val, ok := m.Headers[headerName]; ok {
-					m.Headers[headerName] = val + ", " + headerVal
-				} else {
-					m.Headers[headerName] = headerVal
-				}
-			}
+			http.collectHeader(m, headerName, headerVal)
 
 			return true, true, p + 2
 		}
@@ -289,6 +384,58 @@ func (http *Http) parseHeader(m *HttpMessage, data []byte) (bool, bool, int) {
 	return true, false, len(data)
 }
 
+// collectHeader saves the value of a header, if it is needed for parsing
+// or if it is configured to be sent. The name must be in lower case.
+func (http *Http) collectHeader(m *HttpMessage, headerName string, headerVal string) {
+	if m.Headers == nil {
+		m.Headers = make(map[string]string)
+	}
+
+	// Headers we need for parsing. Make sure we always
+	// capture their value
+	if headerName == "content-length" {
+		m.ContentLength, _ = strconv.Atoi(headerVal)
+		m.hasContentLength = true
+	} else if headerName == "content-type" {
+		m.ContentType = headerVal
+	} else if headerName == "content-encoding" {
+		m.ContentEncoding = strings.ToLower(headerVal)
+	} else if headerName == "transfer-encoding" {
+		m.TransferEncoding = headerVal
+	} else if headerName == "connection" {
+		m.connection = headerVal
+	} else if headerName == "upgrade" {
+		m.upgrade = headerVal
+	}
+	if len(http.Real_ip_header) > 0 && headerName == http.Real_ip_header {
+		m.Real_ip = headerVal
+	}
+	if http.Trusted_proxies != nil {
+		if headerName == "x-forwarded-for" {
+			if len(m.forwardedFor) > 0 {
+				m.forwardedFor += ", "
+			}
+			m.forwardedFor += headerVal
+		} else if headerName == "x-real-ip" {
+			m.xRealIp = headerVal
+		}
+	}
+
+	if http.Send_headers {
+		if !http.Send_all_headers {
+			_, exists := http.Headers_whitelist[headerName]
+			if !exists {
+				return
+			}
+		}
+		if val, ok := m.Headers[headerName]; ok {
+			m.Headers[headerName] = val + ", " + headerVal
+		} else {
+			m.Headers[headerName] = headerVal
+		}
+	}
+}
+
 func (http *Http) messageParser(s *HttpStream) (bool, bool) {
 
 	var cont, ok, complete bool
@@ -434,7 +581,28 @@ func (http *Http) messageParser(s *HttpStream) (bool, bool) {
 			}
 
 		case BODY_CHUNKED_WAIT_FINAL_CRLF:
-			return state_body_chunked_wait_final_crlf(s, m)
+			ok, complete = state_body_chunked_wait_final_crlf(s, m)
+			if s.parseState != BODY_CHUNKED_TRAILER {
+				return ok, complete
+			}
+
+		case BODY_CHUNKED_TRAILER:
+			// the header fields sent after the last chunk, ended by
+			// an empty line
+			if len(s.data)-s.parseOffset >= 2 &&
+				bytes.Equal(s.data[s.parseOffset:s.parseOffset+2], []byte("\r\n")) {
+				s.parseOffset += 2
+				m.end = s.parseOffset
+				return true, true
+			}
+			ok, hfcomplete, offset := http.parseHeader(m, s.data[s.parseOffset:])
+			if !ok {
+				return false, false
+			}
+			if !hfcomplete {
+				return true, false
+			}
+			s.parseOffset += offset
 		}
 
 	}
@@ -447,8 +615,9 @@ func state_body_chunked_wait_final_crlf(s *HttpStream, m *HttpMessage) (ok bool,
 		return true, false
 	} else {
 		if s.data[s.parseOffset] != '\r' || s.data[s.parseOffset+1] != '\n' {
-			logp.Warn("Expected CRLF sequence at end of message")
-			return false, false
+			// the last chunk is followed by a trailer
+			s.parseState = BODY_CHUNKED_TRAILER
+			return true, false
 		}
 		s.parseOffset += 2 // skip final CRLF
 		m.end = s.parseOffset
@@ -476,8 +645,9 @@ func state_body_chunked_start(s *HttpStream, m *HttpMessage) (cont bool, ok bool
 			return false, true, false
 		}
 		if s.data[s.parseOffset] != '\r' || s.data[s.parseOffset+1] != '\n' {
-			logp.Warn("Expected CRLF sequence at end of message")
-			return false, false, false
+			// the last chunk is followed by a trailer
+			s.parseState = BODY_CHUNKED_TRAILER
+			return true, true, false
 		}
 		s.parseOffset += 2 // skip final CRLF
 
@@ -512,6 +682,37 @@ func state_body_chunked(s *HttpStream, m *HttpMessage) (cont bool, ok bool, comp
 	}
 }
 
+// dropBodyPastLimit removes from the stream the bytes of the message
+// body, already parsed, past Max_body_size, so that a large body is not
+// buffered until its end. Only the content length is kept.
+func (http *Http) dropBodyPastLimit(s *HttpStream) {
+	m := s.message
+	if m == nil || m.bodyOffset == 0 {
+		// the headers are not complete yet
+		return
+	}
+
+	if len(m.chunked_body) > http.Max_body_size {
+		m.chunked_body = append([]byte{}, m.chunked_body[:http.Max_body_size]...)
+		m.bodyTruncated = true
+	}
+
+	limit := m.bodyOffset + http.Max_body_size
+	if s.parseOffset <= limit {
+		return
+	}
+	dropped := s.parseOffset - limit
+	s.data = append(s.data[:limit:limit], s.data[s.parseOffset:]...)
+	s.parseOffset = limit
+	if m.end > limit {
+		m.end -= dropped
+	}
+	if m.TransferEncoding != "chunked" {
+		// the body of the chunked messages is kept apart
+		m.bodyTruncated = true
+	}
+}
+
 func (stream *HttpStream) PrepareForNewMessage() {
 	stream.data = stream.data[stream.message.end:]
 	stream.parseState = START
@@ -522,6 +723,12 @@ func (stream *HttpStream) PrepareForNewMessage() {
 
 type httpPrivateData struct {
 	Data [2]*HttpStream
+
+	// set once the client connection preface of HTTP/2 is seen
+	Http2 *http2Connection
+
+	// set once the connection is upgraded to WebSocket
+	WebSocket *websocketConnection
 }
 
 func (http *Http) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
@@ -540,49 +747,123 @@ func (http *Http) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
 		}
 	}
 
+	if priv.Http2 == nil && priv.Data[dir] == nil &&
+		bytes.HasPrefix(pkt.Payload, []byte(http2Preface)) {
+
+		logp.Debug("http", "HTTP/2 connection preface received")
+		priv.Http2 = newHttp2Connection(dir)
+		pkt.Payload = pkt.Payload[len(http2Preface):]
+	}
+	if priv.Http2 != nil {
+		http.parseHttp2(priv.Http2, pkt, tcptuple, dir)
+		return priv
+	}
+	if priv.WebSocket != nil {
+		http.parseWebsocket(priv.WebSocket, pkt.Payload, dir)
+		return priv
+	}
+
 	if priv.Data[dir] == nil {
 		priv.Data[dir] = &HttpStream{
 			tcptuple: tcptuple,
 			data:     pkt.Payload,
-			message:  &HttpMessage{Ts: pkt.Ts},
+			message:  &HttpMessage{Ts: pkt.Ts, Link: pkt.Link},
 		}
 
 	} else {
 		// concatenate bytes
 		priv.Data[dir].data = append(priv.Data[dir].data, pkt.Payload...)
-		if len(priv.Data[dir].data) > tcp.TCP_MAX_DATA_IN_STREAM {
+		if len(priv.Data[dir].data) > tcp.MaxDataInStream {
 			logp.Debug("http", "Stream data too large, dropping TCP stream")
+			protos.Stats.CountTooLarge(protos.HttpProtocol)
 			priv.Data[dir] = nil
 			return priv
 		}
+		if priv.Data[dir].upgrading {
+			// WebSocket frames sent before the upgrade is accepted
+			return priv
+		}
 	}
+	// the segment can contain several messages, e.g. pipelined requests
 	stream := priv.Data[dir]
-	if stream.message == nil {
-		stream.message = &HttpMessage{Ts: pkt.Ts}
-	}
-	ok, complete := http.messageParser(stream)
+	for len(stream.data) > 0 {
+		if stream.message == nil {
+			stream.message = &HttpMessage{Ts: pkt.Ts, Link: pkt.Link}
+		}
+		ok, complete := http.messageParser(stream)
 
-	if !ok {
-		// drop this tcp stream. Will retry parsing with the next
-		// segment in it
-		priv.Data[dir] = nil
-		return priv
-	}
+		if !ok {
+			// drop this tcp stream. Will retry parsing with the next
+			// segment in it
+			protos.ReportParseError(protos.HttpProtocol, tcptuple, pkt,
+				"Invalid HTTP message")
+			priv.Data[dir] = nil
+			return priv
+		}
+		http.dropBodyPastLimit(stream)
+
+		if !complete {
+			break
+		}
 
-	if complete {
 		// all ok, ship it
 		msg := stream.data[stream.message.start:stream.message.end]
 		http.hideHeaders(stream.message, msg)
+		msg = http.redact(stream.message, msg)
+
+		var websocket *websocketConnection
+		if isWebsocketUpgrade(stream.message) {
+			websocket = http.newWebsocket(stream.message, tcptuple, dir)
+		}
 
 		http.handleHttp(stream.message, tcptuple, dir, msg)
 
+		if websocket != nil {
+			// the rest of the connection is made of WebSocket frames,
+			// including the client frames received before the response
+			logp.Debug("http", "Connection upgraded to WebSocket")
+			http.parseWebsocket(websocket, stream.data[stream.parseOffset:], dir)
+			if client := priv.Data[1-dir]; client != nil && client.upgrading {
+				http.parseWebsocket(websocket, client.data, 1-dir)
+			}
+			priv.WebSocket = websocket
+			priv.Data = [2]*HttpStream{}
+			return priv
+		}
+
+		upgrading := stream.message.IsRequest && isWebsocketRequest(stream.message)
+		if !stream.message.IsRequest && priv.Data[1-dir] != nil {
+			// the upgrade is refused, the client stream is HTTP again
+			priv.Data[1-dir].upgrading = false
+		}
+
 		// and reset message
 		stream.PrepareForNewMessage()
+
+		if upgrading {
+			stream.upgrading = true
+			break
+		}
 	}
 
 	return priv
 }
 
+// newWebsocket starts the accounting of a connection upgraded by the
+// response, with the path of its request.
+func (http *Http) newWebsocket(response *HttpMessage, tcptuple *common.TcpTuple,
+	dir uint8) *websocketConnection {
+
+	ts, path := response.Ts, ""
+	if pending := http.transactionsMap[tcptuple.Hashable()]; len(pending) > 0 {
+		ts, path = pending[0].ts, pending[0].Path
+	}
+	conn := newWebsocketConnection(ts, 1-dir, path)
+	conn.link = response.Link
+	http.websockets[conn] = *tcptuple
+	return conn
+}
+
 func (http *Http) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 	private protos.ProtocolData) protos.ProtocolData {
 
@@ -593,7 +874,11 @@ func (http *Http) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 	if !ok {
 		return private
 	}
-	if httpData.Data[dir] == nil {
+	if httpData.WebSocket != nil {
+		http.publishWebsocket(httpData.WebSocket, tcptuple)
+		return httpData
+	}
+	if httpData.Http2 != nil || httpData.Data[dir] == nil {
 		return httpData
 	}
 
@@ -608,6 +893,7 @@ func (http *Http) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 
 		msg := stream.data[stream.message.start:]
 		http.hideHeaders(stream.message, msg)
+		msg = http.redact(stream.message, msg)
 
 		http.handleHttp(stream.message, tcptuple, dir, msg)
 
@@ -621,9 +907,25 @@ func (http *Http) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 func (http *Http) GapInStream(tcptuple *common.TcpTuple, dir uint8,
 	private protos.ProtocolData) protos.ProtocolData {
 
+	if httpData, ok := private.(httpPrivateData); ok && httpData.WebSocket != nil {
+		// the frames can't be followed past the gap, publish what was
+		// counted so far
+		logp.Debug("http", "Gap in the WebSocket stream, publishing it")
+		http.publishWebsocket(httpData.WebSocket, tcptuple)
+	}
 	return private
 }
 
+// FlushStream publishes the WebSocket connection of the idle stream.
+func (http *Http) FlushStream(tcptuple *common.TcpTuple, private protos.ProtocolData) {
+	httpData, ok := private.(httpPrivateData)
+	if !ok || httpData.WebSocket == nil || httpData.WebSocket.done {
+		return
+	}
+	httpData.WebSocket.status = protos.EXPIRED_STATUS
+	http.publishWebsocket(httpData.WebSocket, tcptuple)
+}
+
 func (http *Http) handleHttp(m *HttpMessage, tcptuple *common.TcpTuple,
 	dir uint8, raw_msg []byte) {
 
@@ -641,18 +943,45 @@ func (http *Http) handleHttp(m *HttpMessage, tcptuple *common.TcpTuple,
 
 func (http *Http) receivedHttpRequest(msg *HttpMessage) {
 
-	trans := http.transactionsMap[msg.TcpTuple.Hashable()]
-	if trans != nil {
-		if len(trans.Http) != 0 {
-			logp.Warn("Two requests without a response. Dropping old request")
+	logp.Debug("http", "Received request with tuple: %s", msg.TcpTuple)
+
+	trans := http.newTransaction(msg)
+	logp.Debug("http", "transactionsMap %p http %p", http.transactionsMap, http)
+
+	// the request may be pipelined behind others still waiting for
+	// their response
+	key := msg.TcpTuple.Hashable()
+	http.transactionsMap[key] = append(http.transactionsMap[key], trans)
+	http.transactionsOrder.Add(trans)
+
+	trans.timer = time.AfterFunc(http.Transaction_timeout, func() { http.expireTransaction(trans) })
+
+	http.evictTransactions()
+}
+
+// evictTransactions publishes the oldest requests, without their
+// response, while more than Max_transactions are waiting.
+func (http *Http) evictTransactions() {
+	for http.Max_transactions > 0 && http.transactionsOrder.Len() > http.Max_transactions {
+		trans, ok := http.transactionsOrder.Oldest().(*HttpTransaction)
+		if !ok {
+			break
 		}
-	} else {
-		trans = &HttpTransaction{Type: "http", tuple: msg.TcpTuple}
-		logp.Debug("http", "transactionsMap %p http %p", http.transactionsMap, http)
-		http.transactionsMap[msg.TcpTuple.Hashable()] = trans
+		http.removeTransaction(trans)
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+
+		trans.Status = protos.OVERFLOW_STATUS
+		trans.Notes = append(trans.Notes, protos.OverflowNote)
+		http.PublishTransaction(trans)
 	}
+}
 
-	logp.Debug("http", "Received request with tuple: %s", msg.TcpTuple)
+// newTransaction creates the transaction started by the request.
+func (http *Http) newTransaction(msg *HttpMessage) *HttpTransaction {
+
+	trans := &HttpTransaction{Type: "http", tuple: msg.TcpTuple, link: msg.Link}
 
 	trans.ts = msg.Ts
 	trans.Ts = int64(trans.ts.UnixNano() / 1000)
@@ -671,16 +1000,20 @@ func (http *Http) receivedHttpRequest(msg *HttpMessage) {
 		trans.Src, trans.Dst = trans.Dst, trans.Src
 	}
 
-	// save Raw message
-	if http.Send_request {
-		trans.Request_raw = string(http.cutMessageBody(msg))
-	}
-
-	trans.Method = msg.Method
+	trans.Method = strings.ToUpper(msg.Method)
 	trans.RequestUri = msg.RequestUri
 
 	trans.Http = common.MapStr{}
 
+	// save Raw message
+	if http.Send_request {
+		raw, truncated := http.cutMessageBody(msg)
+		trans.Request_raw = string(raw)
+		if truncated {
+			trans.Http["request_body_truncated"] = true
+		}
+	}
+
 	if http.Send_headers {
 		if !http.Split_cookie {
 			trans.Http["request_headers"] = msg.Headers
@@ -698,7 +1031,14 @@ func (http *Http) receivedHttpRequest(msg *HttpMessage) {
 		}
 	}
 
+	if http.Parse_json_bodies {
+		http.addJsonBody(msg, "request", trans.Http)
+	}
+
 	trans.Real_ip = msg.Real_ip
+	if http.Trusted_proxies != nil {
+		trans.Client_ip = http.clientIp(msg, net.ParseIP(trans.Src.Ip))
+	}
 
 	var err error
 	trans.Path, trans.Params, err = http.extractParameters(msg, msg.Raw)
@@ -706,40 +1046,136 @@ func (http *Http) receivedHttpRequest(msg *HttpMessage) {
 		logp.Warn("http", "Fail to parse HTTP parameters: %v", err)
 	}
 
-	if trans.timer != nil {
-		trans.timer.Stop()
+	return trans
+}
+
+// newResponseOnlyTransaction creates the transaction of a response whose
+// request was not seen, e.g. because the capture started in between or
+// the request expired.
+func (http *Http) newResponseOnlyTransaction(msg *HttpMessage) *HttpTransaction {
+
+	trans := &HttpTransaction{Type: "http", tuple: msg.TcpTuple}
+
+	trans.ts = msg.Ts
+	trans.Ts = int64(trans.ts.UnixNano() / 1000)
+	trans.JsTs = msg.Ts
+
+	// the response is sent by the server
+	trans.Src = common.Endpoint{
+		Ip:   msg.TcpTuple.Dst_ip.String(),
+		Port: msg.TcpTuple.Dst_port,
+		Proc: string(msg.CmdlineTuple.Dst),
+	}
+	trans.Dst = common.Endpoint{
+		Ip:   msg.TcpTuple.Src_ip.String(),
+		Port: msg.TcpTuple.Src_port,
+		Proc: string(msg.CmdlineTuple.Src),
+	}
+	if msg.Direction == tcp.TcpDirectionReverse {
+		trans.Src, trans.Dst = trans.Dst, trans.Src
+	}
+
+	trans.Http = common.MapStr{}
+	trans.Notes = append(trans.Notes, "Response without a matching request")
+
+	return trans
+}
+
+// TransactionsInFlight returns the number of requests waiting for their
+// response.
+func (http *Http) TransactionsInFlight() int {
+	count := 0
+	for _, pending := range http.transactionsMap {
+		count += len(pending)
 	}
-	trans.timer = time.AfterFunc(TransactionTimeout, func() { http.expireTransaction(trans) })
+	return count
+}
 
+// Flush publishes the requests still waiting for their response,
+// including the pipelined ones.
+func (http *Http) Flush() {
+	for key, pending := range http.transactionsMap {
+		for _, trans := range pending {
+			if trans.timer != nil {
+				trans.timer.Stop()
+			}
+			http.transactionsOrder.Remove(trans)
+
+			trans.Status = protos.SHUTDOWN_STATUS
+			http.PublishTransaction(trans)
+		}
+		delete(http.transactionsMap, key)
+	}
+	for conn, tcptuple := range http.websockets {
+		conn.status = protos.SHUTDOWN_STATUS
+		http.publishWebsocket(conn, &tcptuple)
+	}
 }
 
 func (http *Http) expireTransaction(trans *HttpTransaction) {
 	// remove from map
-	delete(http.transactionsMap, trans.tuple.Hashable())
+	http.removeTransaction(trans)
+}
+
+// removeTransaction removes the transaction from the requests waiting
+// for their response on the connection.
+func (http *Http) removeTransaction(trans *HttpTransaction) {
+	http.transactionsOrder.Remove(trans)
+
+	key := trans.tuple.Hashable()
+	pending := http.transactionsMap[key]
+	for i, t := range pending {
+		if t == trans {
+			pending = append(pending[:i], pending[i+1:]...)
+			break
+		}
+	}
+	if len(pending) == 0 {
+		delete(http.transactionsMap, key)
+	} else {
+		http.transactionsMap[key] = pending
+	}
 }
 
 func (http *Http) receivedHttpResponse(msg *HttpMessage) {
 
-	// we need to search the request first.
+	// we need to search the request first. The responses come in the
+	// order of the requests, so this is the oldest one pending.
 	tuple := msg.TcpTuple
 
 	logp.Debug("http", "Received response with tuple: %s", tuple)
 
-	trans := http.transactionsMap[tuple.Hashable()]
-	if trans == nil {
-		logp.Warn("Response from unknown transaction. Ignoring: %v", tuple)
+	if msg.StatusCode >= 100 && msg.StatusCode < 200 && msg.StatusCode != 101 {
+		// interim response, like the 100 Continue sent before the
+		// body of the request. The request waits for the final one.
+		logp.Debug("http", "Interim response %d ignored", msg.StatusCode)
 		return
 	}
 
-	if trans.Http == nil {
-		logp.Warn("Response without a known request. Ignoring.")
-		return
+	var trans *HttpTransaction
+	if pending := http.transactionsMap[tuple.Hashable()]; len(pending) > 0 {
+		trans = pending[0]
+		http.removeTransaction(trans)
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+	} else {
+		logp.Debug("http", "Response without a known request: %v", tuple)
+		trans = http.newResponseOnlyTransaction(msg)
 	}
 
+	http.completeTransaction(trans, msg)
+}
+
+// completeTransaction adds the response to the transaction and publishes it.
+func (http *Http) completeTransaction(trans *HttpTransaction, msg *HttpMessage) {
+
 	response := common.MapStr{
 		"phrase":         msg.StatusPhrase,
 		"code":           msg.StatusCode,
 		"content_length": msg.ContentLength,
+		"status_class":   statusClass(msg.StatusCode),
+		"error":          msg.StatusCode >= 400,
 	}
 
 	if http.Send_headers {
@@ -759,24 +1195,30 @@ func (http *Http) receivedHttpResponse(msg *HttpMessage) {
 		}
 	}
 
+	if isWebsocketUpgrade(msg) {
+		response["websocket"] = true
+	}
+
+	if http.Parse_json_bodies {
+		http.addJsonBody(msg, "response", response)
+	}
+
 	trans.Http.Update(response)
 
 	trans.ResponseTime = int32(msg.Ts.Sub(trans.ts).Nanoseconds() / 1e6) // resp_time in milliseconds
 
 	// save Raw message
 	if http.Send_response {
-		trans.Response_raw = string(http.cutMessageBody(msg))
+		raw, truncated := http.cutMessageBody(msg)
+		trans.Response_raw = string(raw)
+		if truncated {
+			trans.Http["response_body_truncated"] = true
+		}
 	}
 
 	http.PublishTransaction(trans)
 
 	logp.Debug("http", "HTTP transaction completed: %s\n", trans.Http)
-
-	// remove from map
-	delete(http.transactionsMap, trans.tuple.Hashable())
-	if trans.timer != nil {
-		trans.timer.Stop()
-	}
 }
 
 func (http *Http) PublishTransaction(t *HttpTransaction) {
@@ -784,12 +1226,17 @@ func (http *Http) PublishTransaction(t *HttpTransaction) {
 	if http.results == nil {
 		return
 	}
+	if http.isIgnoredUrl(t.Path) {
+		logp.Debug("http", "Ignoring the transaction of %s", t.Path)
+		return
+	}
 
 	event := common.MapStr{}
 
 	event["type"] = "http"
-	code := t.Http["code"].(uint16)
-	if code < 400 {
+	if len(t.Status) > 0 {
+		event["status"] = t.Status
+	} else if t.Http["code"].(uint16) < 400 {
 		event["status"] = common.OK_STATUS
 	} else {
 		event["status"] = common.ERROR_STATUS
@@ -802,21 +1249,44 @@ func (http *Http) PublishTransaction(t *HttpTransaction) {
 		event["response"] = t.Response_raw
 	}
 	event["http"] = t.Http
+	t.link.AddFields(event)
 	if len(t.Real_ip) > 0 {
 		event["real_ip"] = t.Real_ip
 	}
-	event["method"] = t.Method
-	event["path"] = t.Path
-	event["query"] = fmt.Sprintf("%s %s", t.Method, t.Path)
-	event["params"] = t.Params
+	if len(t.Client_ip) > 0 {
+		event["client"] = common.MapStr{"ip": t.Client_ip}
+	}
+	if len(t.Notes) > 0 {
+		event["notes"] = t.Notes
+	}
+	if len(t.Method) > 0 {
+		event["method"] = t.Method
+		event["path"] = t.Path
+		event["query"] = fmt.Sprintf("%s %s", t.Method, t.Path)
+		event["params"] = t.Params
+	}
 
 	event["timestamp"] = common.Time(t.ts)
 	event["src"] = &t.Src
 	event["dst"] = &t.Dst
 
+	if http.Split_request_response {
+		// the transactions published without their response have a
+		// status, the responses without request have no method
+		for _, part := range protos.SplitTransaction(event, len(t.Method) > 0, len(t.Status) == 0) {
+			http.results <- part
+		}
+		return
+	}
+
 	http.results <- event
 }
 
+// statusClass returns the class of the status code, like 4xx for 404.
+func statusClass(code uint16) string {
+	return fmt.Sprintf("%dxx", code/100)
+}
+
 func parseCookieValue(raw string) string {
 	// Strip the quotes, if present.
 	if len(raw) > 1 && raw[0] == '"' && raw[len(raw)-1] == '"' {
@@ -840,37 +1310,146 @@ func splitCookiesHeader(headerVal string) map[string]string {
 	return cookies
 }
 
-func (http *Http) cutMessageBody(m *HttpMessage) []byte {
+// cutMessageBody returns the headers of the message, followed by the body
+// if its content type is to be included. The body is truncated to
+// Max_body_size bytes, in which case true is returned as well.
+func (http *Http) cutMessageBody(m *HttpMessage) ([]byte, bool) {
 	raw_msg_cut := []byte{}
+	truncated := m.bodyTruncated
 
 	// add headers always
 	raw_msg_cut = m.Raw[:m.bodyOffset]
 
 	// add body
 	if len(m.ContentType) == 0 || http.shouldIncludeInBody(m.ContentType) {
-		if len(m.chunked_body) > 0 {
-			raw_msg_cut = append(raw_msg_cut, m.chunked_body...)
+		body := messageBody(m)
+		if len(body) > http.Max_body_size {
+			logp.Debug("http", "Body larger than %d bytes, truncating", http.Max_body_size)
+			body = body[:http.Max_body_size]
+			truncated = true
+		}
+
+		logp.Debug("http", "Body to include: [%s]", body)
+		raw_msg_cut = append(raw_msg_cut, body...)
+	}
+
+	return raw_msg_cut, truncated
+}
+
+// messageBody returns the body of the message, put back together when
+// chunked and uncompressed when encoded.
+func messageBody(m *HttpMessage) []byte {
+	body := m.Raw[m.bodyOffset:]
+	if len(m.chunked_body) > 0 {
+		body = m.chunked_body
+	}
+
+	if len(m.ContentEncoding) > 0 && len(body) > 0 {
+		decoded, err := decodeBody(m.ContentEncoding, body)
+		if err != nil {
+			logp.Debug("http", "Failed to decode the %s body: %v", m.ContentEncoding, err)
 		} else {
-			logp.Debug("http", "Body to include: [%s]", m.Raw[m.bodyOffset:])
-			raw_msg_cut = append(raw_msg_cut, m.Raw[m.bodyOffset:]...)
+			body = decoded
+		}
+	}
+	return body
+}
+
+// decodeBody uncompresses a gzip or deflate encoded body. The result is
+// truncated to MaxDecodedBodySize.
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	var err error
+
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
 		}
+	case "deflate":
+		// deflate should be sent with the zlib wrapper, but some
+		// servers send the raw deflate data
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader = flate.NewReader(bytes.NewReader(body))
+		}
+	default:
+		return body, nil
 	}
 
-	return raw_msg_cut
+	decoded, err := ioutil.ReadAll(io.LimitReader(reader, MaxDecodedBodySize+1))
+	if err == io.ErrUnexpectedEOF && len(decoded) > 0 {
+		// the body past Max_body_size was not kept, the beginning is
+		// decoded
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > MaxDecodedBodySize {
+		logp.Debug("http", "Decoded body larger than %d bytes, truncating", MaxDecodedBodySize)
+		decoded = decoded[:MaxDecodedBodySize]
+	}
+	return decoded, nil
 }
 
+// shouldIncludeInBody returns true if the body of the content type is
+// captured: its media type is in Include_body_for, or Include_body_for is
+// empty and Exclude_body_for is not, and it is not in Exclude_body_for.
 func (http *Http) shouldIncludeInBody(contenttype string) bool {
-	include_body := config.ConfigSingleton.Protocols.Http.Include_body_for
-	for _, include := range include_body {
-		if strings.Contains(contenttype, include) {
-			logp.Debug("http", "Should Include Body = true Content-Type "+contenttype+" include_body "+include)
+	mediatype := mediaType(contenttype)
+	if matchMediaTypes(mediatype, http.Exclude_body_for) {
+		logp.Debug("http", "Body excluded for Content-Type %s", contenttype)
+		return false
+	}
+	if len(http.Include_body_for) == 0 {
+		return len(http.Exclude_body_for) > 0
+	}
+	include := matchMediaTypes(mediatype, http.Include_body_for)
+	logp.Debug("http", "Should include body = %v for Content-Type %s", include, contenttype)
+	return include
+}
+
+// mediaType returns the media type of the content type, lowercased and
+// without its parameters, like the charset.
+func mediaType(contenttype string) string {
+	if i := strings.IndexByte(contenttype, ';'); i >= 0 {
+		contenttype = contenttype[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contenttype))
+}
+
+// matchMediaTypes returns true if the media type is one of the patterns,
+// which are media types like application/json, or wildcards like text/*.
+// The patterns without a slash, like json, match the media types
+// containing them, as in the previous versions.
+func matchMediaTypes(mediatype string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == mediatype {
+			return true
+		}
+		if !strings.Contains(pattern, "/") && strings.Contains(mediatype, pattern) {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediatype, pattern[:len(pattern)-1]) {
 			return true
 		}
-		logp.Debug("http", "Should Include Body = false Content-Type"+contenttype+" include_body "+include)
 	}
 	return false
 }
 
+func lowerAll(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	lowered := make([]string, len(values))
+	for i, value := range values {
+		lowered[i] = strings.ToLower(strings.TrimSpace(value))
+	}
+	return lowered
+}
+
 func (http *Http) hideHeaders(m *HttpMessage, msg []byte) {
 
 	if m.IsRequest {
@@ -898,6 +1477,95 @@ func (http *Http) hideHeaders(m *HttpMessage, msg []byte) {
 	}
 }
 
+// redact replaces the values of the configured headers and of the query
+// parameters, both in the parsed message and in the raw message. As the
+// length of the message changes, a copy is returned and the header and
+// body offsets of the message are updated.
+func (http *Http) redact(m *HttpMessage, msg []byte) []byte {
+	if len(http.Redact_headers) == 0 && len(http.Redact_query_params) == 0 {
+		return msg
+	}
+
+	headersEnd := m.bodyOffset
+	if headersEnd < m.headerOffset {
+		// the headers were not completely received
+		headersEnd = len(msg)
+	}
+
+	res := make([]byte, 0, len(msg))
+
+	firstLine := msg[:m.headerOffset]
+	if m.IsRequest && len(http.Redact_query_params) > 0 {
+		uri := http.redactQuery(m.RequestUri)
+		if uri != m.RequestUri {
+			firstLine = bytes.Replace(firstLine, []byte(m.RequestUri), []byte(uri), 1)
+			m.RequestUri = uri
+		}
+	}
+	res = append(res, firstLine...)
+
+	redacting := false
+	for _, line := range bytes.SplitAfter(msg[m.headerOffset:headersEnd], []byte("\r\n")) {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			// folded line of the previous header
+			if !redacting {
+				res = append(res, line...)
+			}
+			continue
+		}
+
+		redacting = false
+		i := bytes.IndexByte(line, ':')
+		if i > 0 && http.Redact_headers[strings.ToLower(string(line[:i]))] {
+			redacting = true
+			res = append(res, line[:i+1]...)
+			res = append(res, " "+RedactedValue...)
+			if bytes.HasSuffix(line, []byte("\r\n")) {
+				res = append(res, "\r\n"...)
+			}
+			continue
+		}
+		res = append(res, line...)
+	}
+
+	for name := range m.Headers {
+		if http.Redact_headers[name] {
+			m.Headers[name] = RedactedValue
+		}
+	}
+
+	m.headerOffset = len(firstLine)
+	if m.bodyOffset >= headersEnd {
+		m.bodyOffset = len(res)
+	}
+	res = append(res, msg[headersEnd:]...)
+
+	return res
+}
+
+// redactQuery replaces the values of the configured query parameters in
+// the request URI. The rest of the URI is kept as it is.
+func (http *Http) redactQuery(uri string) string {
+	i := strings.Index(uri, "?")
+	if i == -1 {
+		return uri
+	}
+
+	params := strings.Split(uri[i+1:], "&")
+	for j, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		key, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			key = kv[0]
+		}
+		if http.Redact_query_params[strings.ToLower(key)] {
+			params[j] = kv[0] + "=" + RedactedValue
+		}
+	}
+
+	return uri[:i+1] + strings.Join(params, "&")
+}
+
 func (http *Http) hideSecrets(values url.Values) url.Values {
 
 	params := url.Values{}
@@ -945,6 +1613,23 @@ func (http *Http) extractParameters(m *HttpMessage, msg []byte) (path string, pa
 	return
 }
 
+// isIgnoredUrl tells whether the path of a request, without its query
+// string, matches the ignore_urls option.
+func (http *Http) isIgnoredUrl(path string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	if http.Ignore_urls[path] {
+		return true
+	}
+	for _, re := range http.Ignore_urls_regexps {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
 func (http *Http) isSecretParameter(key string) bool {
 
 	for _, keyword := range http.Hide_keywords {
@@ -0,0 +1,369 @@
+package http
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	nethttp "net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/procs"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/tcp"
+)
+
+// HTTP/2 (RFC 7540) support. Only the cleartext connections can be
+// decoded, which start with the client connection preface.
+
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const http2FrameHeaderSize = 9
+
+// Number of streams tracked per connection, the minimum value RFC 7540
+// recommends for SETTINGS_MAX_CONCURRENT_STREAMS. Past it, the streams
+// idle for longer than the transaction timeout, then the oldest, are
+// dropped.
+const http2MaxStreams = 100
+
+// frame types
+const (
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FrameRstStream    = 0x3
+	http2FramePushPromise  = 0x5
+	http2FrameContinuation = 0x9
+)
+
+// frame flags
+const (
+	http2FlagEndStream  = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+)
+
+// http2Connection is the state of an HTTP/2 connection, kept in the
+// private data of the TCP stream. The arrays are indexed by direction.
+type http2Connection struct {
+	clientDir uint8
+
+	data     [2][]byte
+	decoders [2]*hpackDecoder
+
+	// header block split in CONTINUATION frames
+	headerBlock     [2][]byte
+	headerStream    [2]uint32
+	headerEndStream [2]bool
+	headerIgnore    [2]bool
+
+	streams map[uint32]*http2Stream
+
+	// the VLANs and tunnel of the connection
+	link protos.Link
+}
+
+// http2Stream holds the request and the response exchanged on
+// one stream of the connection.
+type http2Stream struct {
+	// last frame received on the stream
+	lastSeen time.Time
+
+	messages [2]*HttpMessage
+	fields   [2][]hpackHeaderField
+	body     [2][]byte
+	complete [2]bool
+}
+
+func newHttp2Connection(clientDir uint8) *http2Connection {
+	return &http2Connection{
+		clientDir: clientDir,
+		decoders:  [2]*hpackDecoder{newHpackDecoder(), newHpackDecoder()},
+		streams:   make(map[uint32]*http2Stream),
+	}
+}
+
+func (http *Http) parseHttp2(conn *http2Connection, pkt *protos.Packet,
+	tcptuple *common.TcpTuple, dir uint8) {
+
+	conn.link = pkt.Link
+	conn.data[dir] = append(conn.data[dir], pkt.Payload...)
+	if len(conn.data[dir]) > tcp.MaxDataInStream {
+		logp.Debug("http", "HTTP/2 frame too large, dropping data")
+		protos.Stats.CountTooLarge(protos.HttpProtocol)
+		conn.data[dir] = nil
+		return
+	}
+
+	for len(conn.data[dir]) >= http2FrameHeaderSize {
+		data := conn.data[dir]
+
+		length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+		if len(data) < http2FrameHeaderSize+length {
+			// wait for the rest of the frame
+			return
+		}
+		frameType := data[3]
+		flags := data[4]
+		streamId := binary.BigEndian.Uint32(data[5:9]) & 0x7fffffff
+		payload := data[http2FrameHeaderSize : http2FrameHeaderSize+length]
+
+		conn.data[dir] = data[http2FrameHeaderSize+length:]
+
+		err := http.handleHttp2Frame(conn, frameType, flags, streamId, payload,
+			pkt.Ts, tcptuple, dir)
+		if err != nil {
+			logp.Debug("http", "Failed to parse HTTP/2 frame: %v", err)
+		}
+	}
+}
+
+func (http *Http) handleHttp2Frame(conn *http2Connection, frameType uint8,
+	flags uint8, streamId uint32, payload []byte, ts time.Time,
+	tcptuple *common.TcpTuple, dir uint8) error {
+
+	switch frameType {
+	case http2FrameHeaders, http2FramePushPromise:
+		payload, err := http2StripPadding(flags, payload)
+		if err != nil {
+			return err
+		}
+		if frameType == http2FrameHeaders && flags&http2FlagPriority != 0 {
+			if len(payload) < 5 {
+				return fmt.Errorf("HEADERS frame too short for the priority")
+			}
+			payload = payload[5:]
+		}
+		if frameType == http2FramePushPromise {
+			if len(payload) < 4 {
+				return fmt.Errorf("PUSH_PROMISE frame too short")
+			}
+			payload = payload[4:]
+		}
+
+		conn.headerBlock[dir] = append([]byte{}, payload...)
+		conn.headerStream[dir] = streamId
+		conn.headerEndStream[dir] = flags&http2FlagEndStream != 0
+		// the promised requests are only decoded to keep the
+		// dynamic table in sync
+		conn.headerIgnore[dir] = frameType == http2FramePushPromise
+		if flags&http2FlagEndHeaders != 0 {
+			return http.endHttp2HeaderBlock(conn, ts, tcptuple, dir)
+		}
+
+	case http2FrameContinuation:
+		if conn.headerBlock[dir] == nil || conn.headerStream[dir] != streamId {
+			return fmt.Errorf("unexpected CONTINUATION frame on stream %d", streamId)
+		}
+		conn.headerBlock[dir] = append(conn.headerBlock[dir], payload...)
+		if flags&http2FlagEndHeaders != 0 {
+			return http.endHttp2HeaderBlock(conn, ts, tcptuple, dir)
+		}
+
+	case http2FrameData:
+		payload, err := http2StripPadding(flags, payload)
+		if err != nil {
+			return err
+		}
+		stream := conn.streams[streamId]
+		if stream == nil || stream.messages[dir] == nil {
+			return fmt.Errorf("DATA frame without headers on stream %d", streamId)
+		}
+		stream.lastSeen = ts
+		m := stream.messages[dir]
+		if !m.hasContentLength {
+			m.ContentLength += len(payload)
+		}
+		if room := http.Max_body_size - len(stream.body[dir]); len(payload) > room {
+			// only the size of the rest of the body is kept
+			payload = payload[:room]
+			m.bodyTruncated = true
+		}
+		stream.body[dir] = append(stream.body[dir], payload...)
+		if flags&http2FlagEndStream != 0 {
+			http.http2MessageComplete(conn, streamId, tcptuple, dir)
+		}
+
+	case http2FrameRstStream:
+		delete(conn.streams, streamId)
+	}
+
+	return nil
+}
+
+func http2StripPadding(flags uint8, payload []byte) ([]byte, error) {
+	if flags&http2FlagPadded == 0 {
+		return payload, nil
+	}
+	if len(payload) < 1 || int(payload[0]) >= len(payload) {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+// endHttp2HeaderBlock decodes a complete header block and adds its
+// headers to the message of the stream.
+func (http *Http) endHttp2HeaderBlock(conn *http2Connection, ts time.Time,
+	tcptuple *common.TcpTuple, dir uint8) error {
+
+	block := conn.headerBlock[dir]
+	streamId := conn.headerStream[dir]
+	conn.headerBlock[dir] = nil
+
+	fields, err := conn.decoders[dir].decode(block)
+	if err != nil {
+		return err
+	}
+	if conn.headerIgnore[dir] {
+		return nil
+	}
+
+	stream := conn.streams[streamId]
+	if stream == nil {
+		http.evictHttp2Streams(conn, ts)
+		stream = &http2Stream{}
+		conn.streams[streamId] = stream
+	}
+	stream.lastSeen = ts
+
+	m := stream.messages[dir]
+	if m == nil {
+		m = &HttpMessage{
+			Ts:            ts,
+			Link:          conn.link,
+			IsRequest:     dir == conn.clientDir,
+			version_major: 2,
+			Headers:       make(map[string]string),
+		}
+		stream.messages[dir] = m
+	}
+
+	for _, field := range fields {
+		switch field.name {
+		case ":method":
+			m.Method = field.value
+		case ":path":
+			m.RequestUri = field.value
+		case ":status":
+			code, _ := strconv.Atoi(field.value)
+			m.StatusCode = uint16(code)
+			m.StatusPhrase = nethttp.StatusText(code)
+		case ":authority":
+			// what the Host header is in HTTP/1
+			field.name = "host"
+			fallthrough
+		default:
+			if len(field.name) > 0 && field.name[0] == ':' {
+				// other pseudo-headers, like :scheme
+				continue
+			}
+			http.collectHeader(m, field.name, field.value)
+			stream.fields[dir] = append(stream.fields[dir], field)
+		}
+	}
+
+	if !m.IsRequest && m.StatusCode >= 100 && m.StatusCode < 200 {
+		// informational response, the final one follows
+		stream.messages[dir] = nil
+		stream.fields[dir] = nil
+		return nil
+	}
+
+	if conn.headerEndStream[dir] {
+		http.http2MessageComplete(conn, streamId, tcptuple, dir)
+	}
+	return nil
+}
+
+// evictHttp2Streams makes room for a new stream once http2MaxStreams are
+// tracked: the streams idle for longer than the transaction timeout are
+// dropped, or else the oldest one.
+func (http *Http) evictHttp2Streams(conn *http2Connection, ts time.Time) {
+	if len(conn.streams) < http2MaxStreams {
+		return
+	}
+
+	var oldest uint32
+	for id, stream := range conn.streams {
+		if ts.Sub(stream.lastSeen) > http.Transaction_timeout {
+			delete(conn.streams, id)
+		} else if oldest == 0 || id < oldest {
+			// the stream identifiers increase with each new stream
+			oldest = id
+		}
+	}
+	if len(conn.streams) >= http2MaxStreams {
+		delete(conn.streams, oldest)
+	}
+	logp.Debug("http", "Too many HTTP/2 streams, %d left", len(conn.streams))
+}
+
+// http2MessageComplete is called when the request or the response of a
+// stream is complete. The transaction is published when both are.
+func (http *Http) http2MessageComplete(conn *http2Connection, streamId uint32,
+	tcptuple *common.TcpTuple, dir uint8) {
+
+	stream := conn.streams[streamId]
+	if stream == nil {
+		return
+	}
+
+	m := stream.messages[dir]
+	m.TcpTuple = *tcptuple
+	m.Direction = dir
+	m.CmdlineTuple = procs.ProcWatcher.FindProcessesTuple(tcptuple.IpPort())
+	msg := http2RawMessage(m, stream.fields[dir], stream.body[dir])
+	http.hideHeaders(m, msg)
+	m.Raw = http.redact(m, msg)
+	stream.complete[dir] = true
+
+	requ := stream.messages[conn.clientDir]
+	resp := stream.messages[1-conn.clientDir]
+	if requ == nil && dir != conn.clientDir {
+		// the stream is closed, but its request was not captured
+		delete(conn.streams, streamId)
+		return
+	}
+	if !stream.complete[conn.clientDir] || !stream.complete[1-conn.clientDir] {
+		return
+	}
+	delete(conn.streams, streamId)
+
+	logp.Debug("http", "HTTP/2 stream %d completed", streamId)
+
+	trans := http.newTransaction(requ)
+	http.completeTransaction(trans, resp)
+}
+
+// http2RawMessage formats the message as in HTTP/1, so that it can be
+// published like the other ones.
+func http2RawMessage(m *HttpMessage, fields []hpackHeaderField, body []byte) []byte {
+	var buf bytes.Buffer
+
+	if m.IsRequest {
+		m.FirstLine = fmt.Sprintf("%s %s HTTP/2", m.Method, m.RequestUri)
+	} else {
+		m.FirstLine = fmt.Sprintf("HTTP/2 %d %s", m.StatusCode, m.StatusPhrase)
+	}
+	buf.WriteString(m.FirstLine)
+	buf.WriteString("\r\n")
+	m.headerOffset = buf.Len()
+
+	for _, field := range fields {
+		buf.WriteString(textproto.CanonicalMIMEHeaderKey(field.name))
+		buf.WriteString(": ")
+		buf.WriteString(field.value)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	m.bodyOffset = buf.Len()
+
+	buf.Write(body)
+	m.end = buf.Len()
+
+	return buf.Bytes()
+}
@@ -0,0 +1,238 @@
+package http
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Failed to decode hex string: %v", err)
+	}
+	return data
+}
+
+func http2Frame(frameType uint8, flags uint8, streamId uint32, payload []byte) []byte {
+	frame := []byte{
+		byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)),
+		frameType, flags,
+		byte(streamId >> 24), byte(streamId >> 16), byte(streamId >> 8), byte(streamId),
+	}
+	return append(frame, payload...)
+}
+
+func TestHpack_requestsWithHuffman(t *testing.T) {
+	// the examples of the appendix C.4 of RFC 7541
+	d := newHpackDecoder()
+
+	fields, err := d.decode(decodeHex(t, "828684418cf1e3c2e5f23a6ba0ab90f4ff"))
+	assert.Nil(t, err)
+	assert.Equal(t, []hpackHeaderField{
+		{":method", "GET"},
+		{":scheme", "http"},
+		{":path", "/"},
+		{":authority", "www.example.com"},
+	}, fields)
+	assert.Equal(t, 57, d.size)
+
+	fields, err = d.decode(decodeHex(t, "828684be5886a8eb10649cbf"))
+	assert.Nil(t, err)
+	assert.Equal(t, []hpackHeaderField{
+		{":method", "GET"},
+		{":scheme", "http"},
+		{":path", "/"},
+		{":authority", "www.example.com"},
+		{"cache-control", "no-cache"},
+	}, fields)
+	assert.Equal(t, 110, d.size)
+
+	fields, err = d.decode(decodeHex(t,
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf"))
+	assert.Nil(t, err)
+	assert.Equal(t, []hpackHeaderField{
+		{":method", "GET"},
+		{":scheme", "https"},
+		{":path", "/index.html"},
+		{":authority", "www.example.com"},
+		{"custom-key", "custom-value"},
+	}, fields)
+	assert.Equal(t, 164, d.size)
+}
+
+func TestHpack_invalidIndex(t *testing.T) {
+	d := newHpackDecoder()
+
+	// index 62 while the dynamic table is empty
+	_, err := d.decode([]byte{0xbe})
+	assert.NotNil(t, err)
+}
+
+func TestHpack_huffmanEOS(t *testing.T) {
+	// the 30 bits of the EOS symbol
+	_, err := hpackHuffmanDecode([]byte{0xff, 0xff, 0xff, 0xfc})
+	assert.Equal(t, errHpackHuffmanEOS, err)
+
+	// "a", padded with ones
+	value, err := hpackHuffmanDecode([]byte{0x1f})
+	assert.Nil(t, err)
+	assert.Equal(t, "a", value)
+}
+
+func TestHttp2_headersFrame(t *testing.T) {
+	http := HttpModForTests()
+
+	conn := newHttp2Connection(0)
+	headers := http2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1,
+		decodeHex(t, "828684418cf1e3c2e5f23a6ba0ab90f4ff"))
+	http.parseHttp2(conn, &protos.Packet{Ts: time.Now(), Payload: headers},
+		testTcpTuple(), 0)
+
+	stream := conn.streams[1]
+	if stream == nil || stream.messages[0] == nil {
+		t.Fatalf("Expected a request on stream 1")
+	}
+	m := stream.messages[0]
+	assert.True(t, m.IsRequest)
+	assert.Equal(t, "GET", m.Method)
+	assert.Equal(t, "/", m.RequestUri)
+	assert.True(t, stream.complete[0])
+	assert.Equal(t, "GET / HTTP/2\r\nHost: www.example.com\r\n\r\n", string(m.Raw))
+}
+
+func TestHttp2_getExchange(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"http"})
+	}
+
+	http := HttpModForTests()
+	http.results = make(chan common.MapStr, 10)
+	sendResponse := true
+	http.SetFromConfig(config.Http{
+		Send_response:    &sendResponse,
+		Send_all_headers: &sendResponse,
+	})
+
+	tcptuple := testTcpTuple()
+	ts := time.Now()
+
+	// preface, SETTINGS and two requests, on the streams 1 and 3
+	var req []byte
+	req = append(req, []byte(http2Preface)...)
+	req = append(req, http2Frame(0x4, 0, 0, nil)...)
+	req = append(req, http2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1,
+		decodeHex(t, "828684418cf1e3c2e5f23a6ba0ab90f4ff"))...)
+	req = append(req, http2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 3,
+		decodeHex(t, "828684be5886a8eb10649cbf"))...)
+
+	// the responses, the one of stream 3 first
+	var resp []byte
+	resp = append(resp, http2Frame(0x4, 0, 0, nil)...)
+	resp = append(resp, http2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 3,
+		[]byte{0x8d})...)
+	// :status 200, content-type: text/plain
+	resp = append(resp, http2Frame(http2FrameHeaders, http2FlagEndHeaders, 1,
+		append(decodeHex(t, "880f100a"), []byte("text/plain")...))...)
+	resp = append(resp, http2Frame(http2FrameData, http2FlagEndStream, 1,
+		[]byte("hello"))...)
+
+	var private protos.ProtocolData
+	private = http.Parse(&protos.Packet{Ts: ts, Payload: req}, tcptuple, 0, private)
+	http.Parse(&protos.Packet{Ts: ts.Add(5 * time.Millisecond), Payload: resp},
+		tcptuple, 1, private)
+
+	if len(http.results) != 2 {
+		t.Fatalf("Expected two events, got %d", len(http.results))
+	}
+
+	event := <-http.results
+	assert.Equal(t, "http", event["type"])
+	assert.Equal(t, common.ERROR_STATUS, event["status"])
+	assert.Equal(t, "GET /", event["query"])
+	details := event["http"].(common.MapStr)
+	assert.Equal(t, uint16(404), details["code"])
+	assert.Equal(t, "Not Found", details["phrase"])
+	assert.Equal(t, map[string]string{
+		"host":          "www.example.com",
+		"cache-control": "no-cache",
+	}, details["request_headers"])
+
+	event = <-http.results
+	assert.Equal(t, common.OK_STATUS, event["status"])
+	assert.Equal(t, "GET", event["method"])
+	assert.Equal(t, "/", event["path"])
+	assert.Equal(t, int32(5), event["responsetime"])
+	details = event["http"].(common.MapStr)
+	assert.Equal(t, uint16(200), details["code"])
+	assert.Equal(t, 5, details["content_length"])
+	assert.Equal(t, map[string]string{"content-type": "text/plain"}, details["response_headers"])
+	// text/plain is not in include_body_for
+	assert.Equal(t, "HTTP/2 200 OK\r\nContent-Type: text/plain\r\n\r\n", event["response"])
+}
+
+func TestHttp2_streamsLimit(t *testing.T) {
+	http := HttpModForTests()
+	tcptuple := testTcpTuple()
+	ts := time.Now()
+
+	// requests whose body never comes, GET http /
+	conn := newHttp2Connection(0)
+	for id := uint32(1); id <= 2*http2MaxStreams+1; id += 2 {
+		headers := http2Frame(http2FrameHeaders, http2FlagEndHeaders, id,
+			decodeHex(t, "828684"))
+		http.parseHttp2(conn, &protos.Packet{Ts: ts, Payload: headers}, tcptuple, 0)
+	}
+	assert.Equal(t, http2MaxStreams, len(conn.streams))
+	assert.Nil(t, conn.streams[1])
+	assert.NotNil(t, conn.streams[3])
+	assert.NotNil(t, conn.streams[2*http2MaxStreams+1])
+
+	// the idle streams are dropped first
+	headers := http2Frame(http2FrameHeaders, http2FlagEndHeaders, 1001,
+		decodeHex(t, "828684"))
+	http.parseHttp2(conn, &protos.Packet{
+		Ts:      ts.Add(http.Transaction_timeout + time.Second),
+		Payload: headers,
+	}, tcptuple, 0)
+	assert.Equal(t, 1, len(conn.streams))
+	assert.NotNil(t, conn.streams[1001])
+}
+
+func TestHttp2_responseWithoutRequest(t *testing.T) {
+	http := HttpModForTests()
+
+	// :status 404, the request was sent before the capture started
+	conn := newHttp2Connection(0)
+	headers := http2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 5,
+		[]byte{0x8d})
+	http.parseHttp2(conn, &protos.Packet{Ts: time.Now(), Payload: headers},
+		testTcpTuple(), 1)
+
+	assert.Equal(t, 0, len(conn.streams))
+}
+
+func TestHttp2_maxBodySize(t *testing.T) {
+	http := HttpModForTests()
+	http.Max_body_size = 4
+
+	conn := newHttp2Connection(0)
+	frames := http2Frame(http2FrameHeaders, http2FlagEndHeaders, 1, decodeHex(t, "838684"))
+	frames = append(frames, http2Frame(http2FrameData, 0, 1, []byte("abc"))...)
+	frames = append(frames, http2Frame(http2FrameData, 0, 1, []byte("defgh"))...)
+	http.parseHttp2(conn, &protos.Packet{Ts: time.Now(), Payload: frames}, testTcpTuple(), 0)
+
+	stream := conn.streams[1]
+	if stream == nil || stream.messages[0] == nil {
+		t.Fatalf("Expected a request on stream 1")
+	}
+	assert.Equal(t, "abcd", string(stream.body[0]))
+	assert.Equal(t, 8, stream.messages[0].ContentLength)
+	assert.True(t, stream.messages[0].bodyTruncated)
+}
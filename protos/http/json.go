@@ -0,0 +1,85 @@
+package http
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+)
+
+// By default, the JSON bodies are parsed up to this depth. The deeper
+// values are kept as JSON strings.
+const DefaultJsonMaxDepth = 5
+
+// isJsonContentType returns true for application/json and for the types
+// with the +json suffix, like application/vnd.api+json.
+func isJsonContentType(contentType string) bool {
+	mediaType := strings.SplitN(contentType, ";", 2)[0]
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// addJsonBody parses the JSON body of the message into the <kind>_json
+// field. Only the objects of at most Max_body_size bytes are parsed. When
+// the body can't be parsed, it is added as it is in the <kind>_body field
+// instead, truncated to Max_body_size bytes.
+func (http *Http) addJsonBody(m *HttpMessage, kind string, fields common.MapStr) {
+	if !isJsonContentType(m.ContentType) {
+		return
+	}
+	body := messageBody(m)
+	if len(body) == 0 {
+		return
+	}
+
+	if !m.bodyTruncated && len(body) <= http.Max_body_size {
+		var object map[string]interface{}
+		err := json.Unmarshal(body, &object)
+		if err == nil && object != nil {
+			fields[kind+"_json"] = limitJsonDepth(object, http.Json_max_depth)
+			return
+		}
+		logp.Debug("http", "Failed to parse the JSON body: %v", err)
+	} else {
+		logp.Debug("http", "JSON body larger than %d bytes, not parsed", http.Max_body_size)
+		if len(body) > http.Max_body_size {
+			body = body[:http.Max_body_size]
+		}
+	}
+	fields[kind+"_body"] = string(body)
+}
+
+// limitJsonDepth converts the objects to MapStr, down to depth levels of
+// objects and arrays. The deeper values are replaced by their JSON
+// encoding.
+func limitJsonDepth(value interface{}, depth int) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if depth <= 0 {
+			return encodeJson(v)
+		}
+		object := common.MapStr{}
+		for key, elem := range v {
+			object[key] = limitJsonDepth(elem, depth-1)
+		}
+		return object
+	case []interface{}:
+		if depth <= 0 {
+			return encodeJson(v)
+		}
+		for i, elem := range v {
+			v[i] = limitJsonDepth(elem, depth-1)
+		}
+		return v
+	}
+	return value
+}
+
+func encodeJson(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
@@ -0,0 +1,124 @@
+package http
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/stretchr/testify/assert"
+)
+
+// parseJsonTransaction replays a request and its response with the given
+// JSON bodies and returns the http details of the event.
+func parseJsonTransaction(t *testing.T, http *Http, reqBody string, respBody string) common.MapStr {
+	http.results = make(chan common.MapStr, 10)
+
+	tcptuple := testTcpTuple()
+	req := []byte("POST /api/users HTTP/1.1\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-Length: " + strconv.Itoa(len(reqBody)) + "\r\n" +
+		"\r\n" + reqBody)
+	resp := []byte("HTTP/1.1 201 Created\r\n" +
+		"Content-Type: application/json; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(respBody)) + "\r\n" +
+		"\r\n" + respBody)
+
+	var private protos.ProtocolData
+	private = http.Parse(&protos.Packet{Ts: time.Now(), Payload: req}, tcptuple, 0, private)
+	http.Parse(&protos.Packet{Ts: time.Now(), Payload: resp}, tcptuple, 1, private)
+
+	if len(http.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(http.results))
+	}
+	event := <-http.results
+	return event["http"].(common.MapStr)
+}
+
+func TestHttpParser_jsonBodies(t *testing.T) {
+	http := HttpModForTests()
+	parseJson := true
+	http.SetFromConfig(config.Http{Parse_json_bodies: &parseJson})
+
+	details := parseJsonTransaction(t, http,
+		`{"name": "alice", "roles": ["admin"], "age": 42}`,
+		`{"id": 7, "user": {"name": "alice"}}`)
+
+	assert.Equal(t, common.MapStr{
+		"name":  "alice",
+		"roles": []interface{}{"admin"},
+		"age":   float64(42),
+	}, details["request_json"])
+	assert.Equal(t, common.MapStr{
+		"id":   float64(7),
+		"user": common.MapStr{"name": "alice"},
+	}, details["response_json"])
+	assert.Nil(t, details["request_body"])
+	assert.Nil(t, details["response_body"])
+}
+
+func TestHttpParser_malformedJsonBody(t *testing.T) {
+	http := HttpModForTests()
+	parseJson := true
+	http.SetFromConfig(config.Http{Parse_json_bodies: &parseJson})
+
+	details := parseJsonTransaction(t, http, `{"name": "alice"`, `[1, 2]`)
+
+	// kept as they are
+	assert.Nil(t, details["request_json"])
+	assert.Equal(t, `{"name": "alice"`, details["request_body"])
+	assert.Nil(t, details["response_json"])
+	assert.Equal(t, `[1, 2]`, details["response_body"])
+}
+
+func TestHttpParser_largeJsonBody(t *testing.T) {
+	http := HttpModForTests()
+	parseJson, maxBodySize := true, 12
+	http.SetFromConfig(config.Http{
+		Parse_json_bodies: &parseJson,
+		Max_body_size:     &maxBodySize,
+	})
+
+	details := parseJsonTransaction(t, http, `{"name": "al"}`, `{"id": 7}`)
+
+	// the request body past max_body_size was not kept
+	assert.Nil(t, details["request_json"])
+	assert.Equal(t, `{"name": "al`, details["request_body"])
+	assert.Equal(t, common.MapStr{"id": float64(7)}, details["response_json"])
+}
+
+func TestHttpParser_jsonBodiesDisabled(t *testing.T) {
+	http := HttpModForTests()
+
+	details := parseJsonTransaction(t, http, `{"name": "alice"}`, `{"id": 7}`)
+
+	assert.Nil(t, details["request_json"])
+	assert.Nil(t, details["response_json"])
+}
+
+func TestLimitJsonDepth(t *testing.T) {
+	object := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": map[string]interface{}{"c": 1.0},
+			"d": []interface{}{map[string]interface{}{"e": true}},
+		},
+	}
+
+	// the arrays count as a level
+	assert.Equal(t, common.MapStr{
+		"a": common.MapStr{
+			"b": `{"c":1}`,
+			"d": `[{"e":true}]`,
+		},
+	}, limitJsonDepth(object, 2))
+}
+
+func TestIsJsonContentType(t *testing.T) {
+	assert.True(t, isJsonContentType("application/json"))
+	assert.True(t, isJsonContentType("Application/JSON; charset=utf-8"))
+	assert.True(t, isJsonContentType("application/vnd.api+json"))
+	assert.False(t, isJsonContentType("text/html"))
+	assert.False(t, isJsonContentType(""))
+}
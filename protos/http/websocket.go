@@ -0,0 +1,194 @@
+package http
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/procs"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/tcp"
+)
+
+// WebSocket (RFC 6455) support. After the upgrade handshake, the frames
+// are counted but their payload is not decoded.
+
+// opcode of the close frame
+const websocketOpcodeClose = 0x8
+
+// websocketConnection is the state of a connection upgraded to WebSocket,
+// kept in the private data of the TCP stream. The arrays are indexed by
+// direction.
+type websocketConnection struct {
+	ts        time.Time
+	clientDir uint8
+	path      string
+	link      protos.Link
+
+	// the frame header split between segments
+	header [2][]byte
+
+	// payload bytes of the current frame not received yet
+	remaining [2]uint64
+
+	frames [2]int
+	bytes  [2]uint64
+	closed [2]bool
+
+	// set when the connection is published before it is closed
+	status string
+
+	// set once the event is published
+	done bool
+}
+
+func newWebsocketConnection(ts time.Time, clientDir uint8, path string) *websocketConnection {
+	return &websocketConnection{ts: ts, clientDir: clientDir, path: path}
+}
+
+// isWebsocketRequest returns true for the requests asking the upgrade of
+// the connection to WebSocket.
+func isWebsocketRequest(m *HttpMessage) bool {
+	return strings.ToLower(m.upgrade) == "websocket"
+}
+
+// isWebsocketUpgrade returns true for the responses accepting the upgrade
+// of the connection to WebSocket.
+func isWebsocketUpgrade(m *HttpMessage) bool {
+	return !m.IsRequest && m.StatusCode == 101 &&
+		strings.ToLower(m.upgrade) == "websocket"
+}
+
+// parseWebsocket counts the frames and the bytes of a segment.
+func (http *Http) parseWebsocket(conn *websocketConnection, data []byte, dir uint8) {
+
+	conn.bytes[dir] += uint64(len(data))
+
+	for len(data) > 0 {
+		if conn.remaining[dir] > 0 {
+			// skip the payload
+			if uint64(len(data)) < conn.remaining[dir] {
+				conn.remaining[dir] -= uint64(len(data))
+				return
+			}
+			data = data[conn.remaining[dir]:]
+			conn.remaining[dir] = 0
+			continue
+		}
+
+		header := data
+		if len(conn.header[dir]) > 0 {
+			header = append(conn.header[dir], data...)
+			conn.header[dir] = nil
+		}
+		size, opcode, length, complete := readWebsocketHeader(header)
+		if !complete {
+			// wait for the rest of the header
+			conn.header[dir] = append([]byte{}, header...)
+			return
+		}
+		data = header[size:]
+
+		conn.frames[dir]++
+		conn.remaining[dir] = length
+		if opcode == websocketOpcodeClose {
+			logp.Debug("http", "WebSocket close frame received")
+			conn.closed[dir] = true
+		}
+	}
+}
+
+// readWebsocketHeader returns the size of the frame header, the opcode
+// and the payload length. complete is false if the header is truncated.
+func readWebsocketHeader(data []byte) (size int, opcode uint8, length uint64, complete bool) {
+	if len(data) < 2 {
+		return 0, 0, 0, false
+	}
+
+	opcode = data[0] & 0x0f
+	masked := data[1]&0x80 != 0
+	length = uint64(data[1] & 0x7f)
+	size = 2
+
+	switch length {
+	case 126:
+		if len(data) < size+2 {
+			return 0, 0, 0, false
+		}
+		length = uint64(binary.BigEndian.Uint16(data[size:]))
+		size += 2
+	case 127:
+		if len(data) < size+8 {
+			return 0, 0, 0, false
+		}
+		length = binary.BigEndian.Uint64(data[size:])
+		size += 8
+	}
+
+	if masked {
+		// the masking key
+		size += 4
+		if len(data) < size {
+			return 0, 0, 0, false
+		}
+	}
+
+	return size, opcode, length, true
+}
+
+// publishWebsocket publishes the frames and bytes counted on the
+// connection, once.
+func (http *Http) publishWebsocket(conn *websocketConnection, tcptuple *common.TcpTuple) {
+	if conn.done {
+		return
+	}
+	conn.done = true
+	delete(http.websockets, conn)
+
+	if http.results == nil {
+		return
+	}
+
+	cmdline := procs.ProcWatcher.FindProcessesTuple(tcptuple.IpPort())
+	src := &common.Endpoint{
+		Ip:   tcptuple.Src_ip.String(),
+		Port: tcptuple.Src_port,
+		Proc: string(cmdline.Src),
+	}
+	dst := &common.Endpoint{
+		Ip:   tcptuple.Dst_ip.String(),
+		Port: tcptuple.Dst_port,
+		Proc: string(cmdline.Dst),
+	}
+	client, server := conn.clientDir, 1-conn.clientDir
+	if conn.clientDir == tcp.TcpDirectionReverse {
+		src, dst = dst, src
+	}
+
+	status := common.OK_STATUS
+	if conn.status != "" {
+		status = conn.status
+	}
+
+	event := common.MapStr{
+		"type":   "websocket",
+		"status": status,
+		"path":   conn.path,
+		"websocket": common.MapStr{
+			"client_frames": conn.frames[client],
+			"client_bytes":  conn.bytes[client],
+			"server_frames": conn.frames[server],
+			"server_bytes":  conn.bytes[server],
+			"closed":        conn.closed[client] || conn.closed[server],
+		},
+		"timestamp": common.Time(conn.ts),
+		"src":       src,
+		"dst":       dst,
+	}
+	conn.link.AddFields(event)
+
+	http.results <- event
+}
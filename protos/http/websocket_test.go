@@ -0,0 +1,195 @@
+package http
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebsocket_upgradeAndFrames(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"http"})
+	}
+
+	http := HttpModForTests()
+	http.results = make(chan common.MapStr, 10)
+
+	tcptuple := testTcpTuple()
+	ts := time.Now()
+
+	req := []byte("GET /chat HTTP/1.1\r\n" +
+		"Host: www.example.com\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"\r\n")
+
+	// the handshake response, followed by a text frame
+	resp := []byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n" +
+		"\r\n")
+	resp = append(resp, 0x81, 0x08)
+	resp = append(resp, []byte("Hi there")...)
+
+	// masked text frame from the client
+	hello := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+
+	// binary frame of 200 bytes, the header split between two segments
+	binary := append([]byte{0x82, 0x7e, 0x00, 0xc8}, make([]byte, 200)...)
+
+	// masked close frame from the client
+	closeFrame := []byte{0x88, 0x82, 0x01, 0x02, 0x03, 0x04, 0x02, 0xea}
+
+	var private protos.ProtocolData
+	private = http.Parse(&protos.Packet{Ts: ts, Payload: req}, tcptuple, 0, private)
+	private = http.Parse(&protos.Packet{Ts: ts.Add(2 * time.Millisecond), Payload: resp},
+		tcptuple, 1, private)
+
+	// the handshake is published as an HTTP transaction
+	if len(http.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(http.results))
+	}
+	event := <-http.results
+	assert.Equal(t, "http", event["type"])
+	assert.Equal(t, "/chat", event["path"])
+	details := event["http"].(common.MapStr)
+	assert.Equal(t, uint16(101), details["code"])
+	assert.Equal(t, true, details["websocket"])
+	client := event["src"].(*common.Endpoint).Ip
+
+	private = http.Parse(&protos.Packet{Ts: ts, Payload: hello}, tcptuple, 0, private)
+	private = http.Parse(&protos.Packet{Ts: ts, Payload: binary[:3]}, tcptuple, 1, private)
+	private = http.Parse(&protos.Packet{Ts: ts, Payload: binary[3:]}, tcptuple, 1, private)
+	private = http.Parse(&protos.Packet{Ts: ts, Payload: closeFrame}, tcptuple, 0, private)
+	assert.Equal(t, 0, len(http.results))
+
+	http.ReceivedFin(tcptuple, 0, private)
+	http.ReceivedFin(tcptuple, 1, private)
+
+	if len(http.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(http.results))
+	}
+	event = <-http.results
+	assert.Equal(t, "websocket", event["type"])
+	assert.Equal(t, "/chat", event["path"])
+	assert.Equal(t, common.Time(ts), event["timestamp"])
+	assert.Equal(t, client, event["src"].(*common.Endpoint).Ip)
+	assert.Equal(t, common.MapStr{
+		"client_frames": 2,
+		"client_bytes":  uint64(19),
+		"server_frames": 2,
+		"server_bytes":  uint64(214),
+		"closed":        true,
+	}, event["websocket"])
+}
+
+func TestWebsocket_notUpgraded(t *testing.T) {
+	http := HttpModForTests()
+	http.results = make(chan common.MapStr, 10)
+
+	tcptuple := testTcpTuple()
+
+	// the server refuses the upgrade, the connection stays HTTP
+	req := []byte("GET /chat HTTP/1.1\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"\r\n")
+	resp := []byte("HTTP/1.1 400 Bad Request\r\n" +
+		"Content-Length: 0\r\n" +
+		"\r\n")
+
+	var private protos.ProtocolData
+	private = http.Parse(&protos.Packet{Ts: time.Now(), Payload: req}, tcptuple, 0, private)
+	private = http.Parse(&protos.Packet{Ts: time.Now(), Payload: resp}, tcptuple, 1, private)
+
+	assert.Nil(t, private.(httpPrivateData).WebSocket)
+	event := <-http.results
+	assert.Nil(t, event["http"].(common.MapStr)["websocket"])
+}
+
+func websocketHandshake() (req []byte, resp []byte) {
+	req = []byte("GET /chat HTTP/1.1\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"\r\n")
+	resp = []byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"\r\n")
+	return req, resp
+}
+
+// Test that the client frames sent before the upgrade is accepted are
+// counted.
+func TestWebsocket_framesBeforeUpgrade(t *testing.T) {
+	http := HttpModForTests()
+	http.results = make(chan common.MapStr, 10)
+
+	tcptuple := testTcpTuple()
+	req, resp := websocketHandshake()
+	hello := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+
+	var private protos.ProtocolData
+	private = http.Parse(&protos.Packet{Ts: time.Now(), Payload: append(req, hello...)},
+		tcptuple, 0, private)
+	private = http.Parse(&protos.Packet{Ts: time.Now(), Payload: hello}, tcptuple, 0, private)
+	private = http.Parse(&protos.Packet{Ts: time.Now(), Payload: resp}, tcptuple, 1, private)
+	<-http.results
+
+	http.ReceivedFin(tcptuple, 0, private)
+	if len(http.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(http.results))
+	}
+	event := <-http.results
+	websocket := event["websocket"].(common.MapStr)
+	assert.Equal(t, 2, websocket["client_frames"])
+	assert.Equal(t, uint64(2*len(hello)), websocket["client_bytes"])
+}
+
+// Test that the WebSocket connections not closed are published when their
+// stream is released, after a gap and on shutdown.
+func TestWebsocket_flush(t *testing.T) {
+	http := HttpModForTests()
+	http.results = make(chan common.MapStr, 10)
+	req, resp := websocketHandshake()
+
+	upgrade := func(tcptuple *common.TcpTuple) protos.ProtocolData {
+		private := http.Parse(&protos.Packet{Ts: time.Now(), Payload: req}, tcptuple, 0, nil)
+		private = http.Parse(&protos.Packet{Ts: time.Now(), Payload: resp}, tcptuple, 1, private)
+		<-http.results
+		return private
+	}
+
+	tcptuple := testTcpTuple()
+	http.FlushStream(tcptuple, upgrade(tcptuple))
+	if len(http.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(http.results))
+	}
+	event := <-http.results
+	assert.Equal(t, "websocket", event["type"])
+	assert.Equal(t, protos.EXPIRED_STATUS, event["status"])
+
+	http.GapInStream(tcptuple, 0, upgrade(tcptuple))
+	if len(http.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(http.results))
+	}
+	event = <-http.results
+	assert.Equal(t, common.OK_STATUS, event["status"])
+
+	upgrade(tcptuple)
+	http.Flush()
+	if len(http.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(http.results))
+	}
+	event = <-http.results
+	assert.Equal(t, protos.SHUTDOWN_STATUS, event["status"])
+	assert.Equal(t, 0, len(http.websockets))
+}
@@ -0,0 +1,299 @@
+package icmp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/protos"
+)
+
+// Time to wait for the reply to an echo request
+const TransactionTimeout = 10 * 1e9
+
+// The echo replies are matched with the requests by the addresses, the
+// identifier, the sequence number and the VLANs and tunnel of the packets.
+type echoKey struct {
+	tuple common.HashableIpPortTuple
+	id    uint16
+	seq   uint16
+	link  protos.Link
+}
+
+type icmpTransaction struct {
+	key     echoKey
+	request *icmpMessage
+	timer   *time.Timer
+}
+
+type Icmp struct {
+	// config
+	Enabled            bool
+	maxTransactions    int
+	transactionTimeout time.Duration
+
+	// the expired transactions are removed from the timers goroutines
+	transactionsLock  sync.Mutex
+	transactionsMap   map[echoKey]*icmpTransaction
+	transactionsOrder *protos.TransactionsOrder
+
+	results chan common.MapStr
+}
+
+func (icmp *Icmp) InitDefaults() {
+	icmp.Enabled = false
+	icmp.maxTransactions = protos.DefaultMaxTransactions
+	icmp.transactionTimeout = TransactionTimeout
+}
+
+func (icmp *Icmp) setFromConfig(config config.Icmp) error {
+
+	if config.Enabled != nil {
+		icmp.Enabled = *config.Enabled
+	}
+	if config.Max_transactions != nil {
+		icmp.maxTransactions = *config.Max_transactions
+	}
+	if config.Transaction_timeout != nil {
+		icmp.transactionTimeout = time.Duration(*config.Transaction_timeout) * time.Second
+	}
+	return nil
+}
+
+// ICMP has no ports, the messages are passed to ParseIcmp.
+func (icmp *Icmp) GetPorts() []int {
+	return []int{}
+}
+
+func (icmp *Icmp) IcmpEnabled() bool {
+	return icmp.Enabled
+}
+
+func (icmp *Icmp) Init(test_mode bool, results chan common.MapStr) error {
+	icmp.InitDefaults()
+	if !test_mode {
+		icmp.setFromConfig(config.ConfigSingleton.Protocols.Icmp)
+	}
+
+	icmp.transactionsMap = make(map[echoKey]*icmpTransaction)
+	icmp.transactionsOrder = protos.NewTransactionsOrder()
+	icmp.results = results
+
+	return nil
+}
+
+// The ICMP messages are not sent over TCP.
+func (icmp *Icmp) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
+	dir uint8, private protos.ProtocolData) protos.ProtocolData {
+
+	return private
+}
+
+func (icmp *Icmp) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	return private
+}
+
+func (icmp *Icmp) GapInStream(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	return private
+}
+
+func (icmp *Icmp) ParseIcmp(pkt *protos.Packet) {
+
+	defer logp.Recover("ParseIcmp exception")
+
+	var version uint8 = 4
+	if pkt.Tuple.Ip_length == 16 {
+		version = 6
+	}
+
+	msg, err := parseIcmp(version, pkt.Payload)
+	if err != nil {
+		logp.Debug("icmp", "Ignore ICMP message: %s", err)
+		return
+	}
+	msg.ts = pkt.Ts
+	msg.tuple = pkt.Tuple
+	msg.link = pkt.Link
+
+	switch {
+	case msg.isEchoRequest():
+		icmp.receivedEchoRequest(msg)
+	case msg.isEchoReply():
+		icmp.receivedEchoReply(msg)
+	case msg.isError():
+		icmp.publishError(msg)
+	default:
+		logp.Debug("icmp", "Ignore ICMP message %s", msg.typeCodeString())
+	}
+}
+
+func (icmp *Icmp) receivedEchoRequest(msg *icmpMessage) {
+
+	key := echoKey{tuple: msg.tuple.Hashable(), id: msg.id, seq: msg.seq, link: msg.link.Key()}
+
+	icmp.transactionsLock.Lock()
+
+	trans := icmp.transactionsMap[key]
+	if trans != nil {
+		logp.Debug("icmp", "Two echo requests without a reply. Dropping old request")
+		trans.timer.Stop()
+		icmp.transactionsOrder.Remove(trans)
+	}
+	trans = &icmpTransaction{key: key, request: msg}
+	icmp.transactionsMap[key] = trans
+	icmp.transactionsOrder.Add(trans)
+
+	trans.timer = time.AfterFunc(icmp.transactionTimeout, func() { icmp.expireTransaction(trans) })
+
+	evicted := icmp.evictTransactions()
+	icmp.transactionsLock.Unlock()
+
+	for _, trans := range evicted {
+		icmp.publishEcho(trans.request, nil, protos.OVERFLOW_STATUS)
+	}
+}
+
+// evictTransactions removes the oldest echo requests while more than
+// maxTransactions are waiting for their reply, and returns them to be
+// published without the lock.
+func (icmp *Icmp) evictTransactions() []*icmpTransaction {
+	evicted := []*icmpTransaction{}
+	for icmp.maxTransactions > 0 && icmp.transactionsOrder.Len() > icmp.maxTransactions {
+		trans, ok := icmp.transactionsOrder.Oldest().(*icmpTransaction)
+		if !ok {
+			break
+		}
+		trans.timer.Stop()
+		icmp.transactionsOrder.Remove(trans)
+		delete(icmp.transactionsMap, trans.key)
+		evicted = append(evicted, trans)
+	}
+	return evicted
+}
+
+func (icmp *Icmp) receivedEchoReply(msg *icmpMessage) {
+
+	key := echoKey{tuple: msg.tuple.RevHashable(), id: msg.id, seq: msg.seq, link: msg.link.Key()}
+
+	icmp.transactionsLock.Lock()
+	trans := icmp.transactionsMap[key]
+	if trans != nil {
+		trans.timer.Stop()
+		delete(icmp.transactionsMap, key)
+		icmp.transactionsOrder.Remove(trans)
+	}
+	icmp.transactionsLock.Unlock()
+
+	if trans == nil {
+		logp.Debug("icmp", "Echo reply without request. Ignoring.")
+		return
+	}
+
+	icmp.publishEcho(trans.request, msg, common.OK_STATUS)
+}
+
+// TransactionsInFlight returns the number of echo requests waiting for
+// their reply.
+func (icmp *Icmp) TransactionsInFlight() int {
+	icmp.transactionsLock.Lock()
+	defer icmp.transactionsLock.Unlock()
+
+	return len(icmp.transactionsMap)
+}
+
+// The requests without reply are published, the lost pings are the
+// interesting ones.
+func (icmp *Icmp) expireTransaction(trans *icmpTransaction) {
+
+	icmp.transactionsLock.Lock()
+	if icmp.transactionsMap[trans.key] != trans {
+		// already replied, or replaced by a new request
+		icmp.transactionsLock.Unlock()
+		return
+	}
+	delete(icmp.transactionsMap, trans.key)
+	icmp.transactionsOrder.Remove(trans)
+	icmp.transactionsLock.Unlock()
+
+	icmp.publishEcho(trans.request, nil, common.ERROR_STATUS)
+}
+
+// Flush publishes the echo requests still waiting for their reply.
+func (icmp *Icmp) Flush() {
+
+	icmp.transactionsLock.Lock()
+	pending := icmp.transactionsMap
+	icmp.transactionsMap = make(map[echoKey]*icmpTransaction)
+	icmp.transactionsOrder = protos.NewTransactionsOrder()
+	icmp.transactionsLock.Unlock()
+
+	for _, trans := range pending {
+		trans.timer.Stop()
+		icmp.publishEcho(trans.request, nil, protos.SHUTDOWN_STATUS)
+	}
+}
+
+func (icmp *Icmp) newEvent(msg *icmpMessage, status string) (common.MapStr, common.MapStr) {
+	details := common.MapStr{
+		"version": msg.version,
+		"type":    msg.typ,
+		"code":    msg.code,
+		"message": msg.typeCodeString(),
+	}
+	event := common.MapStr{
+		"type":      "icmp",
+		"status":    status,
+		"method":    msg.typeString(),
+		"query":     msg.typeCodeString(),
+		"bytes_in":  uint64(msg.length),
+		"icmp":      details,
+		"timestamp": common.Time(msg.ts),
+		"src":       &common.Endpoint{Ip: msg.tuple.Src_ip.String()},
+		"dst":       &common.Endpoint{Ip: msg.tuple.Dst_ip.String()},
+	}
+	msg.link.AddFields(event)
+	return event, details
+}
+
+// publishEcho publishes a ping, with its latency if the reply is known.
+func (icmp *Icmp) publishEcho(request *icmpMessage, reply *icmpMessage, status string) {
+
+	if icmp.results == nil {
+		return
+	}
+
+	event, details := icmp.newEvent(request, status)
+	event["resource"] = request.tuple.Dst_ip.String()
+	details["id"] = request.id
+	details["seq"] = request.seq
+	if reply != nil {
+		event["responsetime"] = int32(reply.ts.Sub(request.ts).Nanoseconds() / 1e6)
+		event["bytes_out"] = uint64(reply.length)
+	}
+
+	icmp.results <- event
+}
+
+// publishError publishes an error message, sent by the host or router
+// that couldn't deliver the original packet back to its source.
+func (icmp *Icmp) publishError(msg *icmpMessage) {
+
+	if icmp.results == nil {
+		return
+	}
+
+	event, details := icmp.newEvent(msg, common.ERROR_STATUS)
+	if msg.original != nil {
+		details["original"] = msg.original.toMapStr()
+		event["resource"] = msg.original.destination()
+	}
+
+	icmp.results <- event
+}
@@ -0,0 +1,162 @@
+package icmp
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func IcmpModForTests() *Icmp {
+	var icmp Icmp
+	icmp.Init(true, nil)
+	icmp.Enabled = true
+	icmp.results = make(chan common.MapStr, 10)
+	return &icmp
+}
+
+var clientTuple = common.NewIpPortTuple(4,
+	net.ParseIP("192.168.0.10"), 0,
+	net.ParseIP("192.168.0.1"), 0)
+
+var serverTuple = common.NewIpPortTuple(4,
+	net.ParseIP("192.168.0.1"), 0,
+	net.ParseIP("192.168.0.10"), 0)
+
+func newPacket(t *testing.T, tuple common.IpPortTuple, payload string, ts time.Time) *protos.Packet {
+	data, err := hex.DecodeString(payload)
+	if err != nil {
+		t.Fatalf("Failed to decode hex string")
+	}
+	return &protos.Packet{Ts: ts, Tuple: tuple, Payload: data}
+}
+
+func TestParseIcmp_destinationUnreachable(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"icmp"})
+	}
+
+	icmp := IcmpModForTests()
+
+	// port unreachable, for a UDP datagram from 192.168.0.10:34567
+	// to 192.168.0.1:5353
+	icmp.ParseIcmp(newPacket(t, serverTuple,
+		"0303000000000000"+
+			"450000201234000040110000c0a8000ac0a80001"+
+			"870714e9000c0000",
+		time.Now()))
+
+	if len(icmp.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(icmp.results))
+	}
+	event := <-icmp.results
+	assert.Equal(t, "icmp", event["type"])
+	assert.Equal(t, common.ERROR_STATUS, event["status"])
+	assert.Equal(t, "DestinationUnreachable", event["method"])
+	assert.Equal(t, "DestinationUnreachable(Port)", event["query"])
+	assert.Equal(t, "192.168.0.1:5353", event["resource"])
+	assert.Equal(t, uint64(36), event["bytes_in"])
+	assert.Equal(t, "192.168.0.1", event["src"].(*common.Endpoint).Ip)
+	assert.Equal(t, "192.168.0.10", event["dst"].(*common.Endpoint).Ip)
+
+	details := event["icmp"].(common.MapStr)
+	assert.Equal(t, uint8(4), details["version"])
+	assert.Equal(t, uint8(3), details["type"])
+	assert.Equal(t, uint8(3), details["code"])
+	assert.Equal(t, common.MapStr{
+		"transport": "udp",
+		"src_ip":    "192.168.0.10",
+		"src_port":  uint16(34567),
+		"dst_ip":    "192.168.0.1",
+		"dst_port":  uint16(5353),
+	}, details["original"])
+}
+
+func TestParseIcmp_echo(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"icmp"})
+	}
+
+	icmp := IcmpModForTests()
+	ts := time.Now()
+
+	icmp.ParseIcmp(newPacket(t, clientTuple,
+		"080000001c2f0001000102030405060708090a0b0c0d0e0f", ts))
+	assert.Equal(t, 1, len(icmp.transactionsMap))
+
+	// reply to another sequence number, ignored
+	icmp.ParseIcmp(newPacket(t, serverTuple,
+		"000000001c2f0002000102030405060708090a0b0c0d0e0f",
+		ts.Add(5*time.Millisecond)))
+	assert.Equal(t, 0, len(icmp.results))
+
+	icmp.ParseIcmp(newPacket(t, serverTuple,
+		"000000001c2f0001000102030405060708090a0b0c0d0e0f",
+		ts.Add(7*time.Millisecond)))
+
+	if len(icmp.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(icmp.results))
+	}
+	assert.Equal(t, 0, len(icmp.transactionsMap))
+
+	event := <-icmp.results
+	assert.Equal(t, common.OK_STATUS, event["status"])
+	assert.Equal(t, "EchoRequest", event["method"])
+	assert.Equal(t, "192.168.0.1", event["resource"])
+	assert.Equal(t, int32(7), event["responsetime"])
+	assert.Equal(t, uint64(24), event["bytes_in"])
+	assert.Equal(t, uint64(24), event["bytes_out"])
+	assert.Equal(t, "192.168.0.10", event["src"].(*common.Endpoint).Ip)
+	assert.Equal(t, "192.168.0.1", event["dst"].(*common.Endpoint).Ip)
+
+	details := event["icmp"].(common.MapStr)
+	assert.Equal(t, uint16(0x1c2f), details["id"])
+	assert.Equal(t, uint16(1), details["seq"])
+}
+
+func TestParseIcmp_echoV6WithoutReply(t *testing.T) {
+	icmp := IcmpModForTests()
+
+	tuple := common.NewIpPortTuple(16,
+		net.ParseIP("fe80::1"), 0,
+		net.ParseIP("fe80::2"), 0)
+	icmp.ParseIcmp(newPacket(t, tuple, "800000000042000761626364", time.Now()))
+	assert.Equal(t, 1, len(icmp.transactionsMap))
+
+	icmp.Flush()
+
+	if len(icmp.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(icmp.results))
+	}
+	event := <-icmp.results
+	assert.Equal(t, protos.SHUTDOWN_STATUS, event["status"])
+	assert.Equal(t, "EchoRequest(0)", event["query"])
+	assert.Nil(t, event["responsetime"])
+
+	details := event["icmp"].(common.MapStr)
+	assert.Equal(t, uint8(6), details["version"])
+	assert.Equal(t, uint16(7), details["seq"])
+}
+
+func TestParseIcmp_truncated(t *testing.T) {
+	icmp := IcmpModForTests()
+
+	icmp.ParseIcmp(newPacket(t, serverTuple, "0303000000", time.Now()))
+
+	// the original packet is unknown, the error is still published
+	icmp.ParseIcmp(newPacket(t, serverTuple, "0b000000000000004500", time.Now()))
+
+	if len(icmp.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(icmp.results))
+	}
+	event := <-icmp.results
+	assert.Equal(t, "TimeExceeded(TTLExceeded)", event["query"])
+	assert.Nil(t, event["resource"])
+}
@@ -0,0 +1,224 @@
+package icmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/tsg/gopacket/layers"
+)
+
+// Size of the ICMP header, including the id and sequence number of the
+// echo messages
+const IcmpHeaderSize = 8
+
+var errTooShort = errors.New("ICMP message too short")
+
+// Types of the ICMPv4 and ICMPv6 messages that are analyzed
+const (
+	icmp4EchoReply              = 0
+	icmp4DestinationUnreachable = 3
+	icmp4SourceQuench           = 4
+	icmp4Redirect               = 5
+	icmp4EchoRequest            = 8
+	icmp4TimeExceeded           = 11
+	icmp4ParameterProblem       = 12
+
+	icmp6DestinationUnreachable = 1
+	icmp6PacketTooBig           = 2
+	icmp6TimeExceeded           = 3
+	icmp6ParameterProblem       = 4
+	icmp6EchoRequest            = 128
+	icmp6EchoReply              = 129
+)
+
+type icmpMessage struct {
+	ts      time.Time
+	tuple   common.IpPortTuple
+	link    protos.Link
+	version uint8
+	typ     uint8
+	code    uint8
+	length  int
+
+	// identifier and sequence number of the echo messages
+	id  uint16
+	seq uint16
+
+	// header of the packet that caused an error message
+	original *originalPacket
+}
+
+// The beginning of the packet that caused an error is sent back in
+// the ICMP message: the IP header and at least the ports.
+type originalPacket struct {
+	transport string
+	srcIp     net.IP
+	dstIp     net.IP
+	srcPort   uint16
+	dstPort   uint16
+}
+
+// parseIcmp reads the header of an ICMP message. The version is the one
+// of IP, 4 or 6.
+func parseIcmp(version uint8, data []byte) (*icmpMessage, error) {
+	if len(data) < IcmpHeaderSize {
+		return nil, errTooShort
+	}
+
+	msg := &icmpMessage{
+		version: version,
+		typ:     data[0],
+		code:    data[1],
+		length:  len(data),
+	}
+	if msg.isEcho() {
+		msg.id = binary.BigEndian.Uint16(data[4:6])
+		msg.seq = binary.BigEndian.Uint16(data[6:8])
+	}
+	if msg.isError() {
+		msg.original = parseOriginalPacket(data[IcmpHeaderSize:])
+	}
+	return msg, nil
+}
+
+func (msg *icmpMessage) isEchoRequest() bool {
+	if msg.version == 4 {
+		return msg.typ == icmp4EchoRequest
+	}
+	return msg.typ == icmp6EchoRequest
+}
+
+func (msg *icmpMessage) isEchoReply() bool {
+	if msg.version == 4 {
+		return msg.typ == icmp4EchoReply
+	}
+	return msg.typ == icmp6EchoReply
+}
+
+func (msg *icmpMessage) isEcho() bool {
+	return msg.isEchoRequest() || msg.isEchoReply()
+}
+
+// The error messages carry the beginning of the packet that caused them.
+func (msg *icmpMessage) isError() bool {
+	if msg.version == 4 {
+		switch msg.typ {
+		case icmp4DestinationUnreachable, icmp4SourceQuench, icmp4Redirect,
+			icmp4TimeExceeded, icmp4ParameterProblem:
+			return true
+		}
+		return false
+	}
+	switch msg.typ {
+	case icmp6DestinationUnreachable, icmp6PacketTooBig, icmp6TimeExceeded,
+		icmp6ParameterProblem:
+		return true
+	}
+	return false
+}
+
+// Returns the type and code, e.g. DestinationUnreachable(Port).
+func (msg *icmpMessage) typeCodeString() string {
+	typeCode := uint16(msg.typ)<<8 | uint16(msg.code)
+	if msg.version == 4 {
+		return layers.ICMPv4TypeCode(typeCode).String()
+	}
+	return layers.ICMPv6TypeCode(typeCode).String()
+}
+
+// Returns the type only, e.g. DestinationUnreachable.
+func (msg *icmpMessage) typeString() string {
+	typeCode := msg.typeCodeString()
+	if i := strings.IndexByte(typeCode, '('); i >= 0 {
+		return typeCode[:i]
+	}
+	return typeCode
+}
+
+var transportNames = map[layers.IPProtocol]string{
+	layers.IPProtocolTCP:    "tcp",
+	layers.IPProtocolUDP:    "udp",
+	layers.IPProtocolICMPv4: "icmp",
+	layers.IPProtocolICMPv6: "icmpv6",
+}
+
+func transportString(proto layers.IPProtocol) string {
+	if name, exists := transportNames[proto]; exists {
+		return name
+	}
+	return strconv.Itoa(int(proto))
+}
+
+// parseOriginalPacket reads the IP header, and the ports for TCP and UDP,
+// of the packet included in an error message. It returns nil if the
+// header is truncated. The IPv6 extension headers are not followed.
+func parseOriginalPacket(data []byte) *originalPacket {
+	if len(data) < 1 {
+		return nil
+	}
+
+	var orig originalPacket
+	var proto layers.IPProtocol
+	var headerSize int
+
+	switch data[0] >> 4 {
+	case 4:
+		headerSize = int(data[0]&0x0f) * 4
+		if headerSize < 20 || len(data) < headerSize {
+			return nil
+		}
+		proto = layers.IPProtocol(data[9])
+		orig.srcIp = net.IP(data[12:16])
+		orig.dstIp = net.IP(data[16:20])
+
+	case 6:
+		headerSize = 40
+		if len(data) < headerSize {
+			return nil
+		}
+		proto = layers.IPProtocol(data[6])
+		orig.srcIp = net.IP(data[8:24])
+		orig.dstIp = net.IP(data[24:40])
+
+	default:
+		return nil
+	}
+
+	orig.transport = transportString(proto)
+	if (proto == layers.IPProtocolTCP || proto == layers.IPProtocolUDP) &&
+		len(data) >= headerSize+4 {
+
+		orig.srcPort = binary.BigEndian.Uint16(data[headerSize:])
+		orig.dstPort = binary.BigEndian.Uint16(data[headerSize+2:])
+	}
+	return &orig
+}
+
+func (orig *originalPacket) toMapStr() common.MapStr {
+	details := common.MapStr{
+		"transport": orig.transport,
+		"src_ip":    orig.srcIp.String(),
+		"dst_ip":    orig.dstIp.String(),
+	}
+	if orig.srcPort != 0 || orig.dstPort != 0 {
+		details["src_port"] = orig.srcPort
+		details["dst_port"] = orig.dstPort
+	}
+	return details
+}
+
+// Returns the destination of the original packet, with the port if known.
+func (orig *originalPacket) destination() string {
+	if orig.dstPort == 0 {
+		return orig.dstIp.String()
+	}
+	return net.JoinHostPort(orig.dstIp.String(), strconv.Itoa(int(orig.dstPort)))
+}
@@ -0,0 +1,157 @@
+package memcache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Parsing of the binary protocol. All the messages start with a
+// header of 24 bytes, followed by the extras, the key and the value.
+
+const memcacheBinaryHeaderSize = 24
+
+const (
+	memcacheMagicRequest  = 0x80
+	memcacheMagicResponse = 0x81
+)
+
+// The values of a single item are limited to 1MB by default, but the
+// limit can be raised.
+const maxBinaryBodySize = 128 * 1024 * 1024
+
+type binaryCommand struct {
+	name  string
+	quiet bool
+}
+
+var binaryCommands = map[uint8]binaryCommand{
+	0x00: {"get", false},
+	0x01: {"set", false},
+	0x02: {"add", false},
+	0x03: {"replace", false},
+	0x04: {"delete", false},
+	0x05: {"incr", false},
+	0x06: {"decr", false},
+	0x07: {"quit", false},
+	0x08: {"flush_all", false},
+	0x09: {"get", true},
+	0x0a: {"noop", false},
+	0x0b: {"version", false},
+	0x0c: {"getk", false},
+	0x0d: {"getk", true},
+	0x0e: {"append", false},
+	0x0f: {"prepend", false},
+	0x10: {"stats", false},
+	0x11: {"set", true},
+	0x12: {"add", true},
+	0x13: {"replace", true},
+	0x14: {"delete", true},
+	0x15: {"incr", true},
+	0x16: {"decr", true},
+	0x17: {"quit", true},
+	0x18: {"flush_all", true},
+	0x19: {"append", true},
+	0x1a: {"prepend", true},
+	0x1b: {"verbosity", false},
+	0x1c: {"touch", false},
+	0x1d: {"gat", false},
+	0x1e: {"gat", true},
+}
+
+// Response status
+const (
+	binaryStatusNoError     = 0x00
+	binaryStatusKeyNotFound = 0x01
+	binaryStatusKeyExists   = 0x02
+	binaryStatusNotStored   = 0x05
+)
+
+var binaryStatusNames = map[uint16]string{
+	0x00: "NO_ERROR",
+	0x01: "KEY_NOT_FOUND",
+	0x02: "KEY_EXISTS",
+	0x03: "VALUE_TOO_LARGE",
+	0x04: "INVALID_ARGUMENTS",
+	0x05: "ITEM_NOT_STORED",
+	0x06: "NON_NUMERIC_VALUE",
+	0x07: "WRONG_VBUCKET",
+	0x08: "AUTH_ERROR",
+	0x09: "AUTH_CONTINUE",
+	0x81: "UNKNOWN_COMMAND",
+	0x82: "OUT_OF_MEMORY",
+	0x83: "NOT_SUPPORTED",
+	0x84: "INTERNAL_ERROR",
+	0x85: "BUSY",
+	0x86: "TEMPORARY_FAILURE",
+}
+
+func binaryStatusString(status uint16) string {
+	if name, exists := binaryStatusNames[status]; exists {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", status)
+}
+
+func isBinaryMessage(data []byte) bool {
+	return len(data) > 0 &&
+		(data[0] == memcacheMagicRequest || data[0] == memcacheMagicResponse)
+}
+
+func parseBinaryMessage(data []byte) (*memcacheMessage, error) {
+	if len(data) < memcacheBinaryHeaderSize {
+		return nil, errIncompleteMessage
+	}
+
+	bodyLen := int(binary.BigEndian.Uint32(data[8:]))
+	if bodyLen > maxBinaryBodySize {
+		return nil, fmt.Errorf("body too large: %d bytes", bodyLen)
+	}
+	keyLen := int(binary.BigEndian.Uint16(data[2:]))
+	extLen := int(data[4])
+	if extLen+keyLen > bodyLen {
+		return nil, errors.New("invalid key and extras lengths")
+	}
+	total := memcacheBinaryHeaderSize + bodyLen
+	if len(data) < total {
+		return nil, errIncompleteMessage
+	}
+
+	opcode := data[1]
+	cmd, known := binaryCommands[opcode]
+	if !known {
+		cmd.name = fmt.Sprintf("0x%02x", opcode)
+	}
+
+	msg := &memcacheMessage{
+		IsRequest:  data[0] == memcacheMagicRequest,
+		isBinary:   true,
+		command:    cmd.name,
+		quiet:      cmd.quiet,
+		opaque:     binary.BigEndian.Uint32(data[12:]),
+		valueBytes: bodyLen - extLen - keyLen,
+		Size:       total,
+	}
+
+	keyStart := memcacheBinaryHeaderSize + extLen
+	if keyLen > 0 {
+		msg.keys = []string{string(data[keyStart : keyStart+keyLen])}
+	}
+
+	if !msg.IsRequest {
+		status := binary.BigEndian.Uint16(data[6:])
+		msg.status = binaryStatusString(status)
+		switch status {
+		case binaryStatusNoError:
+			if isRetrieval(msg.command) {
+				msg.hits = 1
+			}
+		case binaryStatusKeyNotFound, binaryStatusKeyExists, binaryStatusNotStored:
+			// expected outcomes, not errors
+		default:
+			msg.isError = true
+		}
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,553 @@
+package memcache
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/procs"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/tcp"
+)
+
+const (
+	TransactionsHashSize = 2 ^ 16
+	TransactionTimeout   = 10 * 1e9
+)
+
+// Maximum number of requests waiting for a response on a connection
+const MaxPendingRequests = 1000
+
+// Size of the frame header of the UDP datagrams
+const MemcacheUdpHeaderSize = 8
+
+type memcacheMessage struct {
+	Ts           time.Time
+	Link         protos.Link
+	Tuple        common.IpPortTuple // the source is the sender of the message
+	CmdlineTuple *common.CmdlineTuple
+	Transport    string
+	Size         int
+
+	IsRequest bool
+	isBinary  bool
+
+	// request info
+	command string
+	keys    []string
+	line    string
+	noreply bool
+	quiet   bool
+	opaque  uint32
+
+	// response info
+	status  string
+	isError bool
+	hits    int
+	lines   []string
+
+	valueBytes int
+}
+
+type memcacheStream struct {
+	tcptuple *common.TcpTuple
+
+	data []byte
+}
+
+// The requests and the responses are matched in order, except for the
+// binary protocol where the quiet requests may have no response.
+type memcacheConnection struct {
+	Data [2]*memcacheStream
+
+	pending []*memcacheMessage
+}
+
+// Over UDP, the requests are matched with the responses by the IP/port
+// tuple, the request id of the frame header and the VLANs and tunnel of
+// the packets.
+type memcacheUdpKey struct {
+	tuple common.HashableIpPortTuple
+	id    uint16
+	link  protos.Link
+}
+
+type memcacheUdpTransaction struct {
+	key     memcacheUdpKey
+	request *memcacheMessage
+	timer   *time.Timer
+}
+
+type Memcache struct {
+	// config
+	Ports         []int
+	Send_request  bool
+	Send_response bool
+	Hash_keys     bool
+
+	transactionTimeout time.Duration
+
+	udpTransactions map[memcacheUdpKey]*memcacheUdpTransaction
+
+	// the TCP connections with requests waiting for their response
+	pendingConns map[*memcacheConnection]bool
+
+	results chan common.MapStr
+}
+
+func (mc *Memcache) InitDefaults() {
+	mc.Send_request = false
+	mc.Send_response = false
+	mc.Hash_keys = false
+	mc.transactionTimeout = TransactionTimeout
+}
+
+func (mc *Memcache) setFromConfig(config config.Memcache) error {
+
+	mc.Ports = config.Ports
+
+	if config.Send_request != nil {
+		mc.Send_request = *config.Send_request
+	}
+	if config.Send_response != nil {
+		mc.Send_response = *config.Send_response
+	}
+	if config.Hash_keys != nil {
+		mc.Hash_keys = *config.Hash_keys
+	}
+	if config.Transaction_timeout != nil {
+		mc.transactionTimeout = time.Duration(*config.Transaction_timeout) * time.Second
+	}
+	return nil
+}
+
+func (mc *Memcache) GetPorts() []int {
+	return mc.Ports
+}
+
+func (mc *Memcache) Init(test_mode bool, results chan common.MapStr) error {
+	mc.InitDefaults()
+	if !test_mode {
+		mc.setFromConfig(config.ConfigSingleton.Protocols.Memcache)
+	}
+
+	mc.udpTransactions = make(map[memcacheUdpKey]*memcacheUdpTransaction, TransactionsHashSize)
+	mc.pendingConns = make(map[*memcacheConnection]bool)
+	mc.results = results
+
+	return nil
+}
+
+// parseMessage parses the message at the start of data, be it a text or
+// a binary one.
+func parseMessage(data []byte) (*memcacheMessage, error) {
+	if isBinaryMessage(data) {
+		return parseBinaryMessage(data)
+	}
+	if isTextResponse(data) {
+		return parseTextResponse(data)
+	}
+	return parseTextRequest(data)
+}
+
+func (mc *Memcache) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
+	dir uint8, private protos.ProtocolData) protos.ProtocolData {
+
+	defer logp.Recover("ParseMemcache exception")
+
+	conn, ok := private.(*memcacheConnection)
+	if !ok || conn == nil {
+		conn = &memcacheConnection{}
+	}
+
+	if conn.Data[dir] == nil {
+		conn.Data[dir] = &memcacheStream{
+			tcptuple: tcptuple,
+			data:     pkt.Payload,
+		}
+	} else {
+		// concatenate bytes
+		conn.Data[dir].data = append(conn.Data[dir].data, pkt.Payload...)
+		if len(conn.Data[dir].data) > tcp.MaxDataInStream {
+			logp.Debug("memcache", "Stream data too large, dropping TCP stream")
+			protos.Stats.CountTooLarge(protos.MemcacheProtocol)
+			conn.Data[dir] = nil
+			return conn
+		}
+	}
+
+	tuple := *tcptuple.IpPort()
+	if dir == tcp.TcpDirectionReverse {
+		tuple = common.NewIpPortTuple(tuple.Ip_length,
+			tuple.Dst_ip, tuple.Dst_port, tuple.Src_ip, tuple.Src_port)
+	}
+
+	stream := conn.Data[dir]
+	for len(stream.data) > 0 {
+		msg, err := parseMessage(stream.data)
+		if err == errIncompleteMessage {
+			// wait for more data
+			break
+		}
+		if err != nil {
+			// drop this tcp stream. Will retry parsing with the next
+			// segment in it
+			logp.Debug("memcache", "Ignore memcache message: %s. Drop tcp stream.", err)
+			protos.ReportParseError(protos.MemcacheProtocol, tcptuple, pkt, err.Error())
+			conn.Data[dir] = nil
+			return conn
+		}
+		stream.data = stream.data[msg.Size:]
+
+		msg.Ts = pkt.Ts
+		msg.Link = pkt.Link
+		msg.Tuple = tuple
+		msg.Transport = "tcp"
+		msg.CmdlineTuple = procs.ProcWatcher.FindProcessesTuple(&msg.Tuple)
+
+		if msg.IsRequest {
+			mc.receivedRequest(conn, msg)
+		} else {
+			mc.receivedResponse(conn, msg)
+		}
+	}
+	mc.trackPending(conn)
+
+	return conn
+}
+
+func (mc *Memcache) GapInStream(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	conn, ok := private.(*memcacheConnection)
+	if !ok || conn == nil {
+		return private
+	}
+
+	// the message boundaries are lost, drop the data in this direction
+	// and the requests that can't be matched anymore
+	conn.Data[dir] = nil
+	conn.pending = nil
+	mc.trackPending(conn)
+	return conn
+}
+
+func (mc *Memcache) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	return private
+}
+
+func (mc *Memcache) receivedRequest(conn *memcacheConnection, msg *memcacheMessage) {
+	if msg.noreply {
+		mc.publishTransaction(msg, nil, "")
+		return
+	}
+
+	if len(conn.pending) >= MaxPendingRequests {
+		logp.Debug("memcache", "Too many requests without a response. Dropping old request")
+		conn.pending = conn.pending[1:]
+	}
+	conn.pending = append(conn.pending, msg)
+}
+
+func (mc *Memcache) receivedResponse(conn *memcacheConnection, msg *memcacheMessage) {
+	if !msg.isBinary {
+		if len(conn.pending) == 0 || conn.pending[0].isBinary {
+			logp.Debug("memcache", "Response without a known request. Ignoring.")
+			return
+		}
+		requ := conn.pending[0]
+		conn.pending = conn.pending[1:]
+		mc.publishTransaction(requ, msg, "")
+		return
+	}
+
+	for i, requ := range conn.pending {
+		if !requ.isBinary || requ.opaque != msg.opaque {
+			continue
+		}
+
+		// the quiet requests sent before got no response, which
+		// means a miss for the gets and a success for the others
+		for _, quiet := range conn.pending[:i] {
+			if quiet.isBinary && quiet.quiet {
+				mc.publishTransaction(quiet, nil, "")
+			}
+		}
+
+		if requ.command == "stats" && len(msg.keys) > 0 {
+			// one response per statistic, until one without key
+			conn.pending = conn.pending[i:]
+			return
+		}
+
+		conn.pending = conn.pending[i+1:]
+		mc.publishTransaction(requ, msg, "")
+		return
+	}
+
+	logp.Debug("memcache", "Response without a known request. Ignoring.")
+}
+
+// Over UDP, each datagram starts with a frame header. Only the text
+// messages sent in a single datagram are analyzed.
+func (mc *Memcache) ParseUdp(pkt *protos.Packet) {
+
+	defer logp.Recover("ParseUdpMemcache exception")
+
+	if len(pkt.Payload) < MemcacheUdpHeaderSize {
+		logp.Debug("memcache", "Ignore datagram shorter than the frame header")
+		return
+	}
+	id := binary.BigEndian.Uint16(pkt.Payload)
+	total := binary.BigEndian.Uint16(pkt.Payload[4:])
+	if total != 1 {
+		logp.Debug("memcache", "Ignore message sent in %d datagrams", total)
+		return
+	}
+
+	payload := pkt.Payload[MemcacheUdpHeaderSize:]
+	var msg *memcacheMessage
+	var err error
+	if isTextResponse(payload) {
+		msg, err = parseTextResponse(payload)
+	} else {
+		msg, err = parseTextRequest(payload)
+	}
+	if err != nil {
+		logp.Debug("memcache", "Ignore memcache datagram: %s", err)
+		return
+	}
+
+	msg.Ts = pkt.Ts
+	msg.Link = pkt.Link
+	msg.Tuple = pkt.Tuple
+	msg.Transport = "udp"
+	msg.CmdlineTuple = procs.ProcWatcher.FindProcessesTupleUDP(&msg.Tuple)
+	msg.Size = len(payload)
+
+	if msg.IsRequest {
+		if msg.noreply {
+			mc.publishTransaction(msg, nil, "")
+			return
+		}
+		key := memcacheUdpKey{tuple: msg.Tuple.Hashable(), id: id, link: msg.Link.Key()}
+		if old := mc.udpTransactions[key]; old != nil && old.timer != nil {
+			old.timer.Stop()
+		}
+		trans := &memcacheUdpTransaction{key: key, request: msg}
+		mc.udpTransactions[key] = trans
+		trans.timer = time.AfterFunc(mc.transactionTimeout, func() { mc.expireUdpTransaction(trans) })
+		return
+	}
+
+	key := memcacheUdpKey{tuple: msg.Tuple.RevHashable(), id: id, link: msg.Link.Key()}
+	trans := mc.udpTransactions[key]
+	if trans == nil {
+		logp.Debug("memcache", "Response without a known request. Ignoring.")
+		return
+	}
+	delete(mc.udpTransactions, key)
+	if trans.timer != nil {
+		trans.timer.Stop()
+	}
+	mc.publishTransaction(trans.request, msg, "")
+}
+
+// trackPending records whether the connection has requests waiting for
+// their response, for them to be flushed.
+func (mc *Memcache) trackPending(conn *memcacheConnection) {
+	if len(conn.pending) > 0 {
+		mc.pendingConns[conn] = true
+	} else {
+		delete(mc.pendingConns, conn)
+	}
+}
+
+// Flush publishes the requests still waiting for their response.
+func (mc *Memcache) Flush() {
+	for conn := range mc.pendingConns {
+		mc.flushPending(conn, protos.SHUTDOWN_STATUS)
+	}
+	for key, trans := range mc.udpTransactions {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		delete(mc.udpTransactions, key)
+		mc.publishTransaction(trans.request, nil, protos.SHUTDOWN_STATUS)
+	}
+}
+
+// FlushStream publishes the requests of the idle stream still waiting
+// for their response.
+func (mc *Memcache) FlushStream(tcptuple *common.TcpTuple, private protos.ProtocolData) {
+	conn, ok := private.(*memcacheConnection)
+	if !ok || conn == nil {
+		return
+	}
+	mc.flushPending(conn, protos.EXPIRED_STATUS)
+}
+
+func (mc *Memcache) flushPending(conn *memcacheConnection, status string) {
+	for _, requ := range conn.pending {
+		mc.publishTransaction(requ, nil, status)
+	}
+	conn.pending = nil
+	delete(mc.pendingConns, conn)
+}
+
+func (mc *Memcache) expireUdpTransaction(trans *memcacheUdpTransaction) {
+
+	// remove from map
+	delete(mc.udpTransactions, trans.key)
+}
+
+func isRetrieval(command string) bool {
+	switch command {
+	case "get", "gets", "gat", "gats", "getk":
+		return true
+	}
+	return false
+}
+
+func (mc *Memcache) hideKey(key string) string {
+	if !mc.Hash_keys {
+		return key
+	}
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (mc *Memcache) hideKeys(keys []string) []string {
+	hidden := make([]string, 0, len(keys))
+	for _, key := range keys {
+		hidden = append(hidden, mc.hideKey(key))
+	}
+	return hidden
+}
+
+// requestString returns the command line, without the data block.
+func (mc *Memcache) requestString(requ *memcacheMessage) string {
+	if requ.isBinary || mc.Hash_keys {
+		return strings.Join(append([]string{requ.command}, mc.hideKeys(requ.keys)...), " ")
+	}
+	return requ.line
+}
+
+// responseString returns the response lines, without the data blocks.
+func (mc *Memcache) responseString(resp *memcacheMessage) string {
+	if resp.isBinary {
+		return resp.status
+	}
+	lines := make([]string, 0, len(resp.lines))
+	for _, line := range resp.lines {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "VALUE" {
+			fields[1] = mc.hideKey(fields[1])
+			line = strings.Join(fields, " ")
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// publishTransaction publishes the request and its response, if any. The
+// status, if not empty, replaces the one of the response.
+func (mc *Memcache) publishTransaction(requ *memcacheMessage, resp *memcacheMessage, status string) {
+
+	if mc.results == nil {
+		return
+	}
+
+	keys := mc.hideKeys(requ.keys)
+
+	event := common.MapStr{}
+	event["type"] = "memcache"
+	if len(status) > 0 {
+		event["status"] = status
+	} else if resp != nil && resp.isError {
+		event["status"] = common.ERROR_STATUS
+	} else {
+		event["status"] = common.OK_STATUS
+	}
+	event["method"] = strings.ToUpper(requ.command)
+	event["transport"] = requ.Transport
+	event["query"] = strings.Join(append([]string{requ.command}, keys...), " ")
+	if len(keys) > 0 {
+		event["resource"] = keys[0]
+	}
+	event["bytes_in"] = uint64(requ.Size)
+	if mc.Send_request {
+		event["request"] = mc.requestString(requ)
+	}
+
+	details := common.MapStr{
+		"keys":        keys,
+		"value_bytes": requ.valueBytes,
+	}
+	if requ.isBinary {
+		details["protocol_type"] = "binary"
+	} else {
+		details["protocol_type"] = "text"
+	}
+	if requ.noreply {
+		details["noreply"] = true
+	}
+
+	if resp != nil {
+		event["responsetime"] = int32(resp.Ts.Sub(requ.Ts).Nanoseconds() / 1e6) // resp_time in milliseconds
+		event["bytes_out"] = uint64(resp.Size)
+		if mc.Send_response {
+			event["response"] = mc.responseString(resp)
+		}
+		details["status"] = resp.status
+		details["value_bytes"] = requ.valueBytes + resp.valueBytes
+	} else if requ.quiet {
+		// no response to a quiet request means a miss for the gets
+		// and a success for the other commands
+		if isRetrieval(requ.command) {
+			details["status"] = binaryStatusString(binaryStatusKeyNotFound)
+		} else {
+			details["status"] = binaryStatusString(binaryStatusNoError)
+		}
+	}
+
+	if isRetrieval(requ.command) {
+		hits := 0
+		if resp != nil {
+			hits = resp.hits
+		}
+		misses := len(requ.keys) - hits
+		if misses < 0 {
+			misses = 0
+		}
+		details["hit"] = misses == 0 && hits > 0
+		details["hits"] = hits
+		details["misses"] = misses
+	}
+	event["memcache"] = details
+
+	src := common.Endpoint{
+		Ip:   requ.Tuple.Src_ip.String(),
+		Port: requ.Tuple.Src_port,
+		Proc: string(requ.CmdlineTuple.Src),
+	}
+	dst := common.Endpoint{
+		Ip:   requ.Tuple.Dst_ip.String(),
+		Port: requ.Tuple.Dst_port,
+		Proc: string(requ.CmdlineTuple.Dst),
+	}
+	event["timestamp"] = common.Time(requ.Ts)
+	event["src"] = &src
+	event["dst"] = &dst
+	requ.Link.AddFields(event)
+
+	mc.results <- event
+}
@@ -0,0 +1,271 @@
+package memcache
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func MemcacheModForTests() *Memcache {
+	var mc Memcache
+	mc.Init(true, nil)
+	mc.results = make(chan common.MapStr, 10)
+	return &mc
+}
+
+func testTcpTuple() *common.TcpTuple {
+	t := &common.TcpTuple{
+		Ip_length: 4,
+		Src_ip:    net.IPv4(192, 168, 0, 1), Dst_ip: net.IPv4(192, 168, 0, 2),
+		Src_port: 6512, Dst_port: 11211,
+	}
+	t.ComputeHashebles()
+	return t
+}
+
+// exchange sends the request from the client and then the response
+// from the server, on the same connection.
+func exchange(mc *Memcache, requ []byte, resp []byte) {
+	tcptuple := testTcpTuple()
+	ts := time.Now()
+
+	private := mc.Parse(&protos.Packet{Ts: ts, Payload: requ}, tcptuple, 0, nil)
+	mc.Parse(&protos.Packet{Ts: ts.Add(2 * time.Millisecond), Payload: resp},
+		tcptuple, 1, private)
+}
+
+func TestMemcacheParser_textGetMiss(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"memcache"})
+	}
+
+	mc := MemcacheModForTests()
+	exchange(mc, []byte("get user:42\r\n"), []byte("END\r\n"))
+
+	if len(mc.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mc.results))
+	}
+	event := <-mc.results
+	assert.Equal(t, "memcache", event["type"])
+	assert.Equal(t, common.OK_STATUS, event["status"])
+	assert.Equal(t, "GET", event["method"])
+	assert.Equal(t, "user:42", event["resource"])
+	assert.Equal(t, "get user:42", event["query"])
+	assert.Equal(t, int32(2), event["responsetime"])
+	assert.Equal(t, uint64(13), event["bytes_in"])
+	assert.Equal(t, uint64(5), event["bytes_out"])
+
+	details := event["memcache"].(common.MapStr)
+	assert.Equal(t, "text", details["protocol_type"])
+	assert.Equal(t, false, details["hit"])
+	assert.Equal(t, 0, details["hits"])
+	assert.Equal(t, 1, details["misses"])
+	assert.Equal(t, "END", details["status"])
+}
+
+func TestMemcacheParser_textGetHit(t *testing.T) {
+
+	mc := MemcacheModForTests()
+	mc.Send_response = true
+	exchange(mc, []byte("get user:42\r\n"),
+		[]byte("VALUE user:42 0 5\r\nalice\r\nEND\r\n"))
+
+	if len(mc.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mc.results))
+	}
+	event := <-mc.results
+	assert.Equal(t, "VALUE user:42 0 5\nEND", event["response"])
+	assert.Equal(t, uint64(31), event["bytes_out"])
+
+	details := event["memcache"].(common.MapStr)
+	assert.Equal(t, true, details["hit"])
+	assert.Equal(t, 1, details["hits"])
+	assert.Equal(t, 0, details["misses"])
+	assert.Equal(t, 5, details["value_bytes"])
+}
+
+func TestMemcacheParser_textPipelined(t *testing.T) {
+
+	mc := MemcacheModForTests()
+	exchange(mc,
+		[]byte("set a 0 0 2\r\nhi\r\nget a b\r\ndelete c noreply\r\n"),
+		[]byte("STORED\r\nVALUE a 0 2\r\nhi\r\nEND\r\n"))
+
+	if len(mc.results) != 3 {
+		t.Fatalf("Expected three events, got %d", len(mc.results))
+	}
+
+	// the noreply request is published as soon as it is seen
+	event := <-mc.results
+	assert.Equal(t, "DELETE", event["method"])
+	assert.Equal(t, true, event["memcache"].(common.MapStr)["noreply"])
+
+	event = <-mc.results
+	assert.Equal(t, "SET", event["method"])
+	details := event["memcache"].(common.MapStr)
+	assert.Equal(t, "STORED", details["status"])
+	assert.Equal(t, 2, details["value_bytes"])
+
+	event = <-mc.results
+	assert.Equal(t, "GET", event["method"])
+	details = event["memcache"].(common.MapStr)
+	assert.Equal(t, []string{"a", "b"}, details["keys"])
+	assert.Equal(t, false, details["hit"])
+	assert.Equal(t, 1, details["hits"])
+	assert.Equal(t, 1, details["misses"])
+}
+
+func TestMemcacheParser_textError(t *testing.T) {
+
+	mc := MemcacheModForTests()
+	exchange(mc, []byte("bogus\r\n"), []byte("ERROR\r\n"))
+
+	if len(mc.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mc.results))
+	}
+	event := <-mc.results
+	assert.Equal(t, common.ERROR_STATUS, event["status"])
+	assert.Equal(t, "BOGUS", event["method"])
+}
+
+func TestMemcacheParser_hashKeys(t *testing.T) {
+
+	mc := MemcacheModForTests()
+	mc.Hash_keys = true
+	mc.Send_request = true
+	mc.Send_response = true
+	exchange(mc, []byte("get secret\r\n"),
+		[]byte("VALUE secret 0 1\r\nx\r\nEND\r\n"))
+
+	if len(mc.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mc.results))
+	}
+	hashed := "e5e9fa1ba31ecd1ae84f75caaa474f3a663f05f4"
+	event := <-mc.results
+	assert.Equal(t, hashed, event["resource"])
+	assert.Equal(t, "get "+hashed, event["request"])
+	assert.Equal(t, "VALUE "+hashed+" 0 1\nEND", event["response"])
+}
+
+func TestMemcacheParser_binaryGet(t *testing.T) {
+
+	mc := MemcacheModForTests()
+
+	// getq of a missing key, get of "Hello" and their responses, with
+	// the opaques 1 and 2
+	requ, _ := hex.DecodeString(
+		"800900030000000000000003000000010000000000000000" + "666f6f" +
+			"80000005000000000000000500000002000000000000000048656c6c6f")
+	resp, _ := hex.DecodeString(
+		"81000000040000000000000900000002000000000000000100000000576f726c64")
+	exchange(mc, requ, resp)
+
+	if len(mc.results) != 2 {
+		t.Fatalf("Expected two events, got %d", len(mc.results))
+	}
+
+	event := <-mc.results
+	assert.Equal(t, "GET", event["method"])
+	assert.Equal(t, "foo", event["resource"])
+	details := event["memcache"].(common.MapStr)
+	assert.Equal(t, "binary", details["protocol_type"])
+	assert.Equal(t, "KEY_NOT_FOUND", details["status"])
+	assert.Equal(t, false, details["hit"])
+
+	event = <-mc.results
+	assert.Equal(t, common.OK_STATUS, event["status"])
+	assert.Equal(t, "Hello", event["resource"])
+	details = event["memcache"].(common.MapStr)
+	assert.Equal(t, "NO_ERROR", details["status"])
+	assert.Equal(t, true, details["hit"])
+	assert.Equal(t, 5, details["value_bytes"])
+}
+
+func TestMemcacheParser_udpGet(t *testing.T) {
+
+	mc := MemcacheModForTests()
+	client := common.NewIpPortTuple(4,
+		net.ParseIP("192.168.0.1"), 34567,
+		net.ParseIP("192.168.0.2"), 11211)
+	server := common.NewIpPortTuple(4,
+		net.ParseIP("192.168.0.2"), 11211,
+		net.ParseIP("192.168.0.1"), 34567)
+
+	mc.ParseUdp(&protos.Packet{Ts: time.Now(), Tuple: client,
+		Payload: append([]byte{0, 7, 0, 0, 0, 1, 0, 0}, "get k\r\n"...)})
+	assert.Equal(t, 1, len(mc.udpTransactions))
+	mc.ParseUdp(&protos.Packet{Ts: time.Now(), Tuple: server,
+		Payload: append([]byte{0, 7, 0, 0, 0, 1, 0, 0}, "VALUE k 0 1\r\nv\r\nEND\r\n"...)})
+
+	if len(mc.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mc.results))
+	}
+	assert.Equal(t, 0, len(mc.udpTransactions))
+	event := <-mc.results
+	assert.Equal(t, "udp", event["transport"])
+	assert.Equal(t, true, event["memcache"].(common.MapStr)["hit"])
+}
+
+// Test that the TCP and UDP requests without response are published when
+// the plugin is flushed on shutdown.
+func TestMemcache_flushPendingRequests(t *testing.T) {
+	mc := MemcacheModForTests()
+
+	mc.Parse(&protos.Packet{Ts: time.Now(), Payload: []byte("get a\r\nget b\r\n")},
+		testTcpTuple(), 0, nil)
+	assert.Equal(t, 1, len(mc.pendingConns))
+
+	client := common.NewIpPortTuple(4,
+		net.ParseIP("192.168.0.1"), 34567,
+		net.ParseIP("192.168.0.2"), 11211)
+	mc.ParseUdp(&protos.Packet{Ts: time.Now(), Tuple: client,
+		Payload: append([]byte{0, 7, 0, 0, 0, 1, 0, 0}, "get c\r\n"...)})
+	var timer *time.Timer
+	for _, trans := range mc.udpTransactions {
+		timer = trans.timer
+	}
+
+	mc.Flush()
+
+	if len(mc.results) != 3 {
+		t.Fatalf("Expected three events, got %d", len(mc.results))
+	}
+	resources := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		event := <-mc.results
+		assert.Equal(t, protos.SHUTDOWN_STATUS, event["status"])
+		_, hasResponseTime := event["responsetime"]
+		assert.False(t, hasResponseTime)
+		resources[event["resource"].(string)] = true
+	}
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": true}, resources)
+	assert.Equal(t, 0, len(mc.pendingConns))
+	assert.Equal(t, 0, len(mc.udpTransactions))
+	assert.False(t, timer.Stop(), "transaction timer still running")
+}
+
+// Test that the requests of an idle stream are published before its
+// state is released.
+func TestMemcache_flushStream(t *testing.T) {
+	mc := MemcacheModForTests()
+	tcptuple := testTcpTuple()
+
+	private := mc.Parse(&protos.Packet{Ts: time.Now(), Payload: []byte("get a\r\n")},
+		tcptuple, 0, nil)
+	mc.FlushStream(tcptuple, private)
+
+	if len(mc.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mc.results))
+	}
+	event := <-mc.results
+	assert.Equal(t, protos.EXPIRED_STATUS, event["status"])
+	assert.Equal(t, 0, len(mc.pendingConns))
+}
@@ -0,0 +1,197 @@
+package memcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parsing of the text protocol. The messages are made of lines, the
+// data blocks of the storage requests and of the retrieval responses
+// follow the line announcing their size.
+
+// The commands and the keys are limited to 250 bytes, so a line without
+// data is never this long.
+const maxTextLineLength = 2048
+
+var errIncompleteMessage = errors.New("incomplete message")
+
+// The first word of the text responses. A request never starts with
+// one of them.
+var textResponses = map[string]bool{
+	"VALUE":        true,
+	"END":          true,
+	"STORED":       true,
+	"NOT_STORED":   true,
+	"EXISTS":       true,
+	"NOT_FOUND":    true,
+	"DELETED":      true,
+	"TOUCHED":      true,
+	"OK":           true,
+	"ERROR":        true,
+	"CLIENT_ERROR": true,
+	"SERVER_ERROR": true,
+	"STAT":         true,
+	"VERSION":      true,
+}
+
+var textErrors = map[string]bool{
+	"ERROR":        true,
+	"CLIENT_ERROR": true,
+	"SERVER_ERROR": true,
+}
+
+func isTextResponse(data []byte) bool {
+	end := bytes.IndexAny(data, " \r")
+	if end == -1 {
+		end = len(data)
+	}
+	word := string(data[:end])
+	if textResponses[word] {
+		return true
+	}
+	// the responses of incr and decr are the new value
+	_, err := strconv.ParseUint(word, 10, 64)
+	return err == nil
+}
+
+// readTextLine returns the line at the start of data, without the CRLF,
+// and the offset of the next line.
+func readTextLine(data []byte) (string, int, error) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end == -1 {
+		if len(data) > maxTextLineLength {
+			return "", 0, errors.New("line too long")
+		}
+		return "", 0, errIncompleteMessage
+	}
+	return string(data[:end]), end + 2, nil
+}
+
+// readTextData skips a data block of the given size and its CRLF.
+func readTextData(data []byte, size int) (int, error) {
+	if size < 0 {
+		return 0, errors.New("invalid data block size")
+	}
+	if len(data) < size+2 {
+		return 0, errIncompleteMessage
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		return 0, errors.New("data block not terminated by CRLF")
+	}
+	return size + 2, nil
+}
+
+func parseTextRequest(data []byte) (*memcacheMessage, error) {
+	line, offset, err := readTextLine(data)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	msg := &memcacheMessage{
+		IsRequest: true,
+		command:   strings.ToLower(fields[0]),
+		line:      line,
+	}
+	args := fields[1:]
+
+	switch msg.command {
+	case "get", "gets":
+		msg.keys = args
+
+	case "gat", "gats":
+		if len(args) > 1 {
+			msg.keys = args[1:]
+		}
+
+	case "set", "add", "replace", "append", "prepend", "cas":
+		// <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+		if len(args) < 4 {
+			return nil, fmt.Errorf("missing arguments for %s", msg.command)
+		}
+		size, err := strconv.Atoi(args[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid data block size: %s", args[3])
+		}
+		n, err := readTextData(data[offset:], size)
+		if err != nil {
+			return nil, err
+		}
+		offset += n
+		msg.keys = args[:1]
+		msg.valueBytes = size
+		msg.noreply = args[len(args)-1] == "noreply"
+
+	case "delete", "incr", "decr", "touch":
+		if len(args) < 1 {
+			return nil, fmt.Errorf("missing key for %s", msg.command)
+		}
+		msg.keys = args[:1]
+		msg.noreply = args[len(args)-1] == "noreply"
+
+	case "flush_all", "verbosity":
+		msg.noreply = len(args) > 0 && args[len(args)-1] == "noreply"
+
+	case "quit":
+		// the connection is closed, without response
+		msg.noreply = true
+	}
+
+	msg.Size = offset
+	return msg, nil
+}
+
+func parseTextResponse(data []byte) (*memcacheMessage, error) {
+	msg := &memcacheMessage{}
+
+	offset := 0
+	for {
+		line, n, err := readTextLine(data[offset:])
+		if err != nil {
+			return nil, err
+		}
+		offset += n
+
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "VALUE" {
+			// VALUE <key> <flags> <bytes> [<cas unique>]
+			if len(fields) < 4 {
+				return nil, errors.New("missing arguments for VALUE")
+			}
+			size, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("invalid data block size: %s", fields[3])
+			}
+			n, err := readTextData(data[offset:], size)
+			if err != nil {
+				return nil, err
+			}
+			offset += n
+			msg.hits++
+			msg.valueBytes += size
+			msg.lines = append(msg.lines, line)
+			continue
+		}
+		if len(fields) > 0 && fields[0] == "STAT" {
+			msg.lines = append(msg.lines, line)
+			continue
+		}
+
+		// the last line
+		msg.status = line
+		if len(fields) > 0 && textErrors[fields[0]] {
+			msg.isError = true
+		}
+		msg.lines = append(msg.lines, line)
+		break
+	}
+
+	msg.Size = offset
+	return msg, nil
+}
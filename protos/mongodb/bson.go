@@ -0,0 +1,343 @@
+package mongodb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimal BSON (http://bsonspec.org) decoder. The documents are decoded
+// in order, so that the name of the command can be taken from the first
+// element.
+
+type bsonElement struct {
+	Key   string
+	Value interface{}
+}
+
+type bsonDocument []bsonElement
+
+type bsonObjectId [12]byte
+
+type bsonTimestamp struct {
+	T uint32
+	I uint32
+}
+
+type bsonBinary struct {
+	Subtype byte
+	Data    []byte
+}
+
+type bsonRegex struct {
+	Pattern string
+	Options string
+}
+
+// values only shown, like the JavaScript code or decimal128
+type bsonOther struct {
+	Name string
+	Data string
+}
+
+type bsonMinKey struct{}
+type bsonMaxKey struct{}
+
+var errBsonTruncated = errors.New("bson: truncated document")
+
+// The documents and arrays nested deeper are not decoded, like the MongoDB
+// servers do, so that a crafted message can't exhaust the stack.
+const bsonMaxDepth = 100
+
+var errBsonTooDeep = fmt.Errorf("bson: more than %d nested documents", bsonMaxDepth)
+
+// Get returns the value of the first element with the given key.
+func (doc bsonDocument) Get(key string) (interface{}, bool) {
+	for _, elem := range doc {
+		if elem.Key == key {
+			return elem.Value, true
+		}
+	}
+	return nil, false
+}
+
+// decodeBsonDocument decodes the document at the start of data. It returns
+// the document and its size.
+func decodeBsonDocument(data []byte) (bsonDocument, int, error) {
+	return decodeBsonNested(data, 0)
+}
+
+// decodeBsonNested decodes a document nested in depth others.
+func decodeBsonNested(data []byte, depth int) (bsonDocument, int, error) {
+	if depth >= bsonMaxDepth {
+		return nil, 0, errBsonTooDeep
+	}
+	if len(data) < 5 {
+		return nil, 0, errBsonTruncated
+	}
+	size := int(int32(binary.LittleEndian.Uint32(data)))
+	if size < 5 || size > len(data) {
+		return nil, 0, errBsonTruncated
+	}
+	if data[size-1] != 0 {
+		return nil, 0, errors.New("bson: document not terminated")
+	}
+
+	doc := bsonDocument{}
+	offset := 4
+	for offset < size-1 {
+		elemType := data[offset]
+		offset++
+
+		key, n, err := readCString(data[offset : size-1])
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+
+		value, n, err := decodeBsonValue(elemType, data[offset:size-1], depth)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+
+		doc = append(doc, bsonElement{Key: key, Value: value})
+	}
+
+	return doc, size, nil
+}
+
+// decodeBsonValue decodes the value of an element of a document nested in
+// depth others.
+func decodeBsonValue(elemType byte, data []byte, depth int) (interface{}, int, error) {
+	switch elemType {
+	case 0x01: // double
+		if len(data) < 8 {
+			return nil, 0, errBsonTruncated
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), 8, nil
+
+	case 0x02, 0x0D, 0x0E: // string, JavaScript code, symbol
+		s, n, err := readBsonString(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if elemType == 0x0D {
+			return bsonOther{"Code", strconv.Quote(s)}, n, nil
+		}
+		return s, n, nil
+
+	case 0x03: // embedded document
+		return decodeBsonNested(data, depth+1)
+
+	case 0x04: // array
+		doc, n, err := decodeBsonNested(data, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		values := make([]interface{}, 0, len(doc))
+		for _, elem := range doc {
+			values = append(values, elem.Value)
+		}
+		return values, n, nil
+
+	case 0x05: // binary
+		if len(data) < 5 {
+			return nil, 0, errBsonTruncated
+		}
+		length := int(int32(binary.LittleEndian.Uint32(data)))
+		if length < 0 || len(data) < 5+length {
+			return nil, 0, errBsonTruncated
+		}
+		return bsonBinary{Subtype: data[4], Data: data[5 : 5+length]}, 5 + length, nil
+
+	case 0x06, 0x0A: // undefined, null
+		return nil, 0, nil
+
+	case 0x07: // ObjectId
+		if len(data) < 12 {
+			return nil, 0, errBsonTruncated
+		}
+		var id bsonObjectId
+		copy(id[:], data)
+		return id, 12, nil
+
+	case 0x08: // boolean
+		if len(data) < 1 {
+			return nil, 0, errBsonTruncated
+		}
+		return data[0] != 0, 1, nil
+
+	case 0x09: // UTC datetime, in milliseconds
+		if len(data) < 8 {
+			return nil, 0, errBsonTruncated
+		}
+		ms := int64(binary.LittleEndian.Uint64(data))
+		return time.Unix(ms/1000, ms%1000*int64(time.Millisecond)).UTC(), 8, nil
+
+	case 0x0B: // regular expression
+		pattern, n, err := readCString(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		options, m, err := readCString(data[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		return bsonRegex{Pattern: pattern, Options: options}, n + m, nil
+
+	case 0x0C: // DBPointer
+		ns, n, err := readBsonString(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(data) < n+12 {
+			return nil, 0, errBsonTruncated
+		}
+		return bsonOther{"DBPointer", fmt.Sprintf("%s, %x", strconv.Quote(ns), data[n:n+12])}, n + 12, nil
+
+	case 0x0F: // JavaScript code with scope
+		if len(data) < 4 {
+			return nil, 0, errBsonTruncated
+		}
+		length := int(int32(binary.LittleEndian.Uint32(data)))
+		if length < 4 || len(data) < length {
+			return nil, 0, errBsonTruncated
+		}
+		code, _, err := readBsonString(data[4:length])
+		if err != nil {
+			return nil, 0, err
+		}
+		return bsonOther{"Code", strconv.Quote(code)}, length, nil
+
+	case 0x10: // int32
+		if len(data) < 4 {
+			return nil, 0, errBsonTruncated
+		}
+		return int32(binary.LittleEndian.Uint32(data)), 4, nil
+
+	case 0x11: // timestamp
+		if len(data) < 8 {
+			return nil, 0, errBsonTruncated
+		}
+		return bsonTimestamp{
+			I: binary.LittleEndian.Uint32(data),
+			T: binary.LittleEndian.Uint32(data[4:]),
+		}, 8, nil
+
+	case 0x12: // int64
+		if len(data) < 8 {
+			return nil, 0, errBsonTruncated
+		}
+		return int64(binary.LittleEndian.Uint64(data)), 8, nil
+
+	case 0x13: // decimal128, shown as it is
+		if len(data) < 16 {
+			return nil, 0, errBsonTruncated
+		}
+		return bsonOther{"NumberDecimal", hex.EncodeToString(data[:16])}, 16, nil
+
+	case 0xFF:
+		return bsonMinKey{}, 0, nil
+
+	case 0x7F:
+		return bsonMaxKey{}, 0, nil
+	}
+
+	return nil, 0, fmt.Errorf("bson: unknown element type 0x%02x", elemType)
+}
+
+func readCString(data []byte) (string, int, error) {
+	end := bytes.IndexByte(data, 0)
+	if end == -1 {
+		return "", 0, errBsonTruncated
+	}
+	return string(data[:end]), end + 1, nil
+}
+
+// strings are prefixed by their length, including the terminating 0
+func readBsonString(data []byte) (string, int, error) {
+	if len(data) < 4 {
+		return "", 0, errBsonTruncated
+	}
+	length := int(int32(binary.LittleEndian.Uint32(data)))
+	if length < 1 || len(data) < 4+length {
+		return "", 0, errBsonTruncated
+	}
+	return string(data[4 : 4+length-1]), 4 + length, nil
+}
+
+// bsonToString formats a value like the mongo shell does.
+func bsonToString(value interface{}) string {
+	var buf bytes.Buffer
+	writeBsonValue(&buf, value)
+	return buf.String()
+}
+
+func writeBsonValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bsonDocument:
+		if len(v) == 0 {
+			buf.WriteString("{}")
+			return
+		}
+		buf.WriteString("{")
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(" ")
+			buf.WriteString(strconv.Quote(elem.Key))
+			buf.WriteString(": ")
+			writeBsonValue(buf, elem.Value)
+		}
+		buf.WriteString(" }")
+	case []interface{}:
+		buf.WriteString("[")
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			writeBsonValue(buf, elem)
+		}
+		buf.WriteString("]")
+	case string:
+		buf.WriteString(strconv.Quote(v))
+	case float64:
+		buf.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	case int32:
+		buf.WriteString(strconv.Itoa(int(v)))
+	case int64:
+		fmt.Fprintf(buf, "NumberLong(%d)", v)
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case bsonObjectId:
+		fmt.Fprintf(buf, "ObjectId(\"%x\")", v[:])
+	case time.Time:
+		fmt.Fprintf(buf, "ISODate(\"%s\")", v.Format("2006-01-02T15:04:05.000Z"))
+	case bsonTimestamp:
+		fmt.Fprintf(buf, "Timestamp(%d, %d)", v.T, v.I)
+	case bsonBinary:
+		fmt.Fprintf(buf, "BinData(%d, \"%s\")", v.Subtype,
+			base64.StdEncoding.EncodeToString(v.Data))
+	case bsonRegex:
+		fmt.Fprintf(buf, "/%s/%s", strings.Replace(v.Pattern, "/", "\\/", -1), v.Options)
+	case bsonOther:
+		fmt.Fprintf(buf, "%s(%s)", v.Name, v.Data)
+	case bsonMinKey:
+		buf.WriteString("MinKey")
+	case bsonMaxKey:
+		buf.WriteString("MaxKey")
+	default:
+		fmt.Fprintf(buf, "%v", v)
+	}
+}
@@ -0,0 +1,780 @@
+package mongodb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/procs"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/tcp"
+)
+
+const (
+	TransactionsHashSize = 2 ^ 16
+	TransactionTimeout   = 10 * 1e9
+)
+
+// Size of the header of all the messages of the wire protocol
+const MongodbHeaderSize = 16
+
+// Operation codes
+const (
+	OP_REPLY        = 1
+	OP_UPDATE       = 2001
+	OP_INSERT       = 2002
+	OP_QUERY        = 2004
+	OP_GET_MORE     = 2005
+	OP_DELETE       = 2006
+	OP_KILL_CURSORS = 2007
+	OP_COMPRESSED   = 2012
+	OP_MSG          = 2013
+)
+
+// OP_MSG flags
+const (
+	OP_MSG_CHECKSUM_PRESENT = 1 << 0
+	OP_MSG_MORE_TO_COME     = 1 << 1
+)
+
+// OP_REPLY flag set when the query failed
+const OP_REPLY_QUERY_FAILURE = 1 << 1
+
+type MongodbMessage struct {
+	Ts           time.Time
+	Link         protos.Link
+	TcpTuple     common.TcpTuple
+	CmdlineTuple *common.CmdlineTuple
+	Direction    uint8
+	Size         int
+
+	RequestId  int32
+	ResponseTo int32
+	OpCode     int32
+	IsResponse bool
+
+	// Request info
+	Method          string
+	Database        string
+	Collection      string
+	ExpectsResponse bool
+
+	// Response info
+	DocumentsReturned int
+	IsError           bool
+	ErrorMessage      string
+
+	Documents []bsonDocument
+}
+
+// Requests are matched with the responses by the TCP tuple and the
+// request id.
+type MongodbTransactionKey struct {
+	tuple common.HashableTcpTuple
+	id    int32
+}
+
+type MongodbTransaction struct {
+	Type         string
+	key          MongodbTransactionKey
+	link         protos.Link
+	Src          common.Endpoint
+	Dst          common.Endpoint
+	ResponseTime int32
+	Ts           int64
+	JsTs         time.Time
+	ts           time.Time
+	BytesIn      int
+	BytesOut     int
+	Status       string
+
+	Request  *MongodbMessage
+	Response *MongodbMessage
+
+	timer *time.Timer
+}
+
+type MongodbStream struct {
+	tcptuple *common.TcpTuple
+
+	data []byte
+}
+
+type mongodbPrivateData struct {
+	Data [2]*MongodbStream
+}
+
+type Mongodb struct {
+	// config
+	Ports         []int
+	Send_request  bool
+	Send_response bool
+
+	maxDocLength       int
+	maxDocs            int
+	maxTransactions    int
+	transactionTimeout time.Duration
+
+	transactionsMap   map[MongodbTransactionKey]*MongodbTransaction
+	transactionsOrder *protos.TransactionsOrder
+
+	results chan common.MapStr
+}
+
+func (mongodb *Mongodb) InitDefaults() {
+	mongodb.maxDocLength = 5000
+	mongodb.maxDocs = 10
+	mongodb.Send_request = false
+	mongodb.Send_response = false
+	mongodb.maxTransactions = protos.DefaultMaxTransactions
+	mongodb.transactionTimeout = TransactionTimeout
+}
+
+func (mongodb *Mongodb) setFromConfig(config config.Mongodb) error {
+
+	mongodb.Ports = config.Ports
+
+	if config.Max_transactions != nil {
+		mongodb.maxTransactions = *config.Max_transactions
+	}
+	if config.Transaction_timeout != nil {
+		mongodb.transactionTimeout = time.Duration(*config.Transaction_timeout) * time.Second
+	}
+	if config.Max_doc_length != nil {
+		mongodb.maxDocLength = *config.Max_doc_length
+	}
+	if config.Max_docs != nil {
+		mongodb.maxDocs = *config.Max_docs
+	}
+	if config.Send_request != nil {
+		mongodb.Send_request = *config.Send_request
+	}
+	if config.Send_response != nil {
+		mongodb.Send_response = *config.Send_response
+	}
+	return nil
+}
+
+func (mongodb *Mongodb) GetPorts() []int {
+	return mongodb.Ports
+}
+
+func (mongodb *Mongodb) Init(test_mode bool, results chan common.MapStr) error {
+	mongodb.InitDefaults()
+	if !test_mode {
+		mongodb.setFromConfig(config.ConfigSingleton.Protocols.Mongodb)
+	}
+
+	mongodb.transactionsMap = make(map[MongodbTransactionKey]*MongodbTransaction, TransactionsHashSize)
+	mongodb.transactionsOrder = protos.NewTransactionsOrder()
+	mongodb.results = results
+
+	return nil
+}
+
+func (mongodb *Mongodb) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
+	dir uint8, private protos.ProtocolData) protos.ProtocolData {
+
+	defer logp.Recover("ParseMongodb exception")
+
+	priv := mongodbPrivateData{}
+	if private != nil {
+		var ok bool
+		priv, ok = private.(mongodbPrivateData)
+		if !ok {
+			priv = mongodbPrivateData{}
+		}
+	}
+
+	if priv.Data[dir] == nil {
+		priv.Data[dir] = &MongodbStream{
+			tcptuple: tcptuple,
+			data:     pkt.Payload,
+		}
+	} else {
+		// concatenate bytes
+		priv.Data[dir].data = append(priv.Data[dir].data, pkt.Payload...)
+		if len(priv.Data[dir].data) > tcp.MaxDataInStream {
+			logp.Debug("mongodb", "Stream data too large, dropping TCP stream")
+			protos.Stats.CountTooLarge(protos.MongodbProtocol)
+			priv.Data[dir] = nil
+			return priv
+		}
+	}
+
+	stream := priv.Data[dir]
+	for len(stream.data) >= MongodbHeaderSize {
+		length := int(int32(binary.LittleEndian.Uint32(stream.data)))
+		if length < MongodbHeaderSize || length > tcp.MaxDataInStream {
+			logp.Debug("mongodb", "Invalid message length %d. Drop tcp stream.", length)
+			protos.ReportParseError(protos.MongodbProtocol, tcptuple, pkt,
+				fmt.Sprintf("Invalid message length %d", length))
+			priv.Data[dir] = nil
+			return priv
+		}
+		if len(stream.data) < length {
+			// wait for more data
+			break
+		}
+		data := stream.data[:length]
+		stream.data = stream.data[length:]
+
+		msg, err := parseMongodbMessage(data)
+		if err != nil {
+			// drop this tcp stream. Will retry parsing with the next
+			// segment in it
+			logp.Debug("mongodb", "Ignore MongoDB message: %s. Drop tcp stream.", err)
+			protos.ReportParseError(protos.MongodbProtocol, tcptuple, pkt, err.Error())
+			priv.Data[dir] = nil
+			return priv
+		}
+		if msg == nil {
+			// not supported, like the compressed messages
+			continue
+		}
+
+		msg.Ts = pkt.Ts
+		msg.Link = pkt.Link
+		msg.TcpTuple = *tcptuple
+		msg.Direction = dir
+		msg.CmdlineTuple = procs.ProcWatcher.FindProcessesTuple(tcptuple.IpPort())
+		mongodb.handleMongodb(msg)
+	}
+
+	return priv
+}
+
+func (mongodb *Mongodb) GapInStream(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	if private == nil {
+		return private
+	}
+	mongodbData, ok := private.(mongodbPrivateData)
+	if !ok {
+		return private
+	}
+
+	// the message boundaries are lost, drop the data in
+	// this direction
+	mongodbData.Data[dir] = nil
+	return mongodbData
+}
+
+func (mongodb *Mongodb) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	return private
+}
+
+// parseMongodbMessage decodes a complete message. It returns nil if the
+// operation is not supported.
+func parseMongodbMessage(data []byte) (*MongodbMessage, error) {
+	msg := &MongodbMessage{
+		Size:       len(data),
+		RequestId:  int32(binary.LittleEndian.Uint32(data[4:])),
+		ResponseTo: int32(binary.LittleEndian.Uint32(data[8:])),
+		OpCode:     int32(binary.LittleEndian.Uint32(data[12:])),
+	}
+	body := data[MongodbHeaderSize:]
+
+	var err error
+	switch msg.OpCode {
+	case OP_MSG:
+		err = msg.parseOpMsg(body)
+	case OP_QUERY:
+		err = msg.parseOpQuery(body)
+	case OP_REPLY:
+		err = msg.parseOpReply(body)
+	case OP_GET_MORE:
+		err = msg.parseOpGetMore(body)
+	case OP_INSERT, OP_UPDATE, OP_DELETE:
+		err = msg.parseLegacyWrite(body)
+	case OP_KILL_CURSORS:
+		msg.Method = "killCursors"
+	default:
+		logp.Debug("mongodb", "Ignore message with op code %d", msg.OpCode)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (msg *MongodbMessage) parseOpMsg(body []byte) error {
+	if len(body) < 4 {
+		return errBsonTruncated
+	}
+	flags := binary.LittleEndian.Uint32(body)
+	body = body[4:]
+	if flags&OP_MSG_CHECKSUM_PRESENT != 0 {
+		if len(body) < 4 {
+			return errBsonTruncated
+		}
+		body = body[:len(body)-4]
+	}
+
+	msg.IsResponse = msg.ResponseTo != 0
+	msg.ExpectsResponse = flags&OP_MSG_MORE_TO_COME == 0
+
+	var command bsonDocument
+	for len(body) > 0 {
+		kind := body[0]
+		body = body[1:]
+
+		switch kind {
+		case 0:
+			// the body of the command
+			doc, n, err := decodeBsonDocument(body)
+			if err != nil {
+				return err
+			}
+			command = doc
+			msg.Documents = append(msg.Documents, doc)
+			body = body[n:]
+
+		case 1:
+			// a sequence of documents, like the ones to insert
+			if len(body) < 4 {
+				return errBsonTruncated
+			}
+			size := int(int32(binary.LittleEndian.Uint32(body)))
+			if size < 4 || size > len(body) {
+				return errBsonTruncated
+			}
+			_, n, err := readCString(body[4:size])
+			if err != nil {
+				return err
+			}
+			for seq := body[4+n : size]; len(seq) > 0; {
+				doc, n, err := decodeBsonDocument(seq)
+				if err != nil {
+					return err
+				}
+				msg.Documents = append(msg.Documents, doc)
+				seq = seq[n:]
+			}
+			body = body[size:]
+
+		default:
+			return fmt.Errorf("unknown OP_MSG section kind %d", kind)
+		}
+	}
+
+	if command == nil {
+		return errors.New("OP_MSG without a body")
+	}
+	if msg.IsResponse {
+		msg.setReplyInfo(command)
+	} else {
+		msg.setCommandInfo(command)
+		if db, ok := command.Get("$db"); ok {
+			msg.Database, _ = db.(string)
+		}
+	}
+	return nil
+}
+
+func (msg *MongodbMessage) parseOpQuery(body []byte) error {
+	if len(body) < 4 {
+		return errBsonTruncated
+	}
+	fullName, n, err := readCString(body[4:])
+	if err != nil {
+		return err
+	}
+	body = body[4+n:]
+	if len(body) < 8 {
+		return errBsonTruncated
+	}
+	// skip numberToSkip and numberToReturn
+	query, _, err := decodeBsonDocument(body[8:])
+	if err != nil {
+		return err
+	}
+	msg.Documents = []bsonDocument{query}
+	msg.ExpectsResponse = true
+
+	// the query can be wrapped, to add modifiers like $orderby
+	if wrapped, ok := query.Get("$query"); ok {
+		if doc, ok := wrapped.(bsonDocument); ok {
+			query = doc
+		}
+	}
+
+	msg.Database, msg.Collection = splitNamespace(fullName)
+	if msg.Collection == "$cmd" {
+		msg.Collection = ""
+		msg.setCommandInfo(query)
+	} else {
+		msg.Method = "find"
+	}
+	return nil
+}
+
+func (msg *MongodbMessage) parseOpReply(body []byte) error {
+	if len(body) < 20 {
+		return errBsonTruncated
+	}
+	flags := binary.LittleEndian.Uint32(body)
+	numberReturned := int(int32(binary.LittleEndian.Uint32(body[16:])))
+	msg.IsResponse = true
+
+	for docs := body[20:]; len(docs) > 0; {
+		doc, n, err := decodeBsonDocument(docs)
+		if err != nil {
+			return err
+		}
+		msg.Documents = append(msg.Documents, doc)
+		docs = docs[n:]
+	}
+
+	msg.DocumentsReturned = numberReturned
+	if len(msg.Documents) == 1 {
+		// the reply of a command
+		msg.setReplyInfo(msg.Documents[0])
+	}
+	if flags&OP_REPLY_QUERY_FAILURE != 0 {
+		msg.IsError = true
+		msg.DocumentsReturned = 0
+		if len(msg.Documents) > 0 {
+			if errmsg, ok := msg.Documents[0].Get("$err"); ok {
+				msg.ErrorMessage, _ = errmsg.(string)
+			}
+		}
+	}
+	return nil
+}
+
+func (msg *MongodbMessage) parseOpGetMore(body []byte) error {
+	if len(body) < 4 {
+		return errBsonTruncated
+	}
+	fullName, _, err := readCString(body[4:])
+	if err != nil {
+		return err
+	}
+	msg.Method = "getMore"
+	msg.Database, msg.Collection = splitNamespace(fullName)
+	msg.ExpectsResponse = true
+	return nil
+}
+
+// The legacy write operations have no reply.
+func (msg *MongodbMessage) parseLegacyWrite(body []byte) error {
+	if len(body) < 4 {
+		return errBsonTruncated
+	}
+	fullName, n, err := readCString(body[4:])
+	if err != nil {
+		return err
+	}
+	body = body[4+n:]
+	if msg.OpCode != OP_INSERT {
+		// skip the flags
+		if len(body) < 4 {
+			return errBsonTruncated
+		}
+		body = body[4:]
+	}
+	for len(body) > 0 {
+		doc, n, err := decodeBsonDocument(body)
+		if err != nil {
+			return err
+		}
+		msg.Documents = append(msg.Documents, doc)
+		body = body[n:]
+	}
+
+	switch msg.OpCode {
+	case OP_INSERT:
+		msg.Method = "insert"
+	case OP_UPDATE:
+		msg.Method = "update"
+	case OP_DELETE:
+		msg.Method = "delete"
+	}
+	msg.Database, msg.Collection = splitNamespace(fullName)
+	return nil
+}
+
+// The name of the command is the key of the first element. For the
+// commands working on a collection, its value is the collection name.
+func (msg *MongodbMessage) setCommandInfo(command bsonDocument) {
+	if len(command) == 0 {
+		return
+	}
+	msg.Method = command[0].Key
+	if collection, ok := command[0].Value.(string); ok {
+		msg.Collection = collection
+	} else if collection, ok := command.Get("collection"); ok {
+		// getMore
+		msg.Collection, _ = collection.(string)
+	}
+}
+
+func (msg *MongodbMessage) setReplyInfo(reply bsonDocument) {
+	if ok, exists := reply.Get("ok"); exists && !bsonIsTrue(ok) {
+		msg.IsError = true
+		if errmsg, exists := reply.Get("errmsg"); exists {
+			msg.ErrorMessage, _ = errmsg.(string)
+		}
+	}
+	if writeErrors, exists := reply.Get("writeErrors"); exists {
+		msg.IsError = true
+		if errs, ok := writeErrors.([]interface{}); ok && len(errs) > 0 {
+			if first, ok := errs[0].(bsonDocument); ok {
+				errmsg, _ := first.Get("errmsg")
+				msg.ErrorMessage, _ = errmsg.(string)
+			}
+		}
+	}
+
+	if cursor, exists := reply.Get("cursor"); exists {
+		if cursor, ok := cursor.(bsonDocument); ok {
+			for _, key := range []string{"firstBatch", "nextBatch"} {
+				if batch, ok := cursor.Get(key); ok {
+					docs, _ := batch.([]interface{})
+					msg.DocumentsReturned = len(docs)
+				}
+			}
+		}
+	}
+}
+
+func bsonIsTrue(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case int32:
+		return v != 0
+	case int64:
+		return v != 0
+	}
+	return false
+}
+
+// splits a namespace like "db.collection"
+func splitNamespace(fullName string) (string, string) {
+	i := strings.Index(fullName, ".")
+	if i == -1 {
+		return fullName, ""
+	}
+	return fullName[:i], fullName[i+1:]
+}
+
+func (mongodb *Mongodb) handleMongodb(msg *MongodbMessage) {
+
+	if !msg.IsResponse {
+		mongodb.receivedMongodbRequest(msg)
+	} else {
+		mongodb.receivedMongodbResponse(msg)
+	}
+}
+
+func (mongodb *Mongodb) receivedMongodbRequest(msg *MongodbMessage) {
+
+	key := MongodbTransactionKey{tuple: msg.TcpTuple.Hashable(), id: msg.RequestId}
+
+	trans := &MongodbTransaction{Type: "mongodb", key: key, link: msg.Link}
+
+	trans.ts = msg.Ts
+	trans.Ts = int64(trans.ts.UnixNano() / 1000) // transactions have microseconds resolution
+	trans.JsTs = msg.Ts
+	trans.Src = common.Endpoint{
+		Ip:   msg.TcpTuple.Src_ip.String(),
+		Port: msg.TcpTuple.Src_port,
+		Proc: string(msg.CmdlineTuple.Src),
+	}
+	trans.Dst = common.Endpoint{
+		Ip:   msg.TcpTuple.Dst_ip.String(),
+		Port: msg.TcpTuple.Dst_port,
+		Proc: string(msg.CmdlineTuple.Dst),
+	}
+	if msg.Direction == tcp.TcpDirectionReverse {
+		trans.Src, trans.Dst = trans.Dst, trans.Src
+	}
+	trans.Request = msg
+	trans.BytesIn = msg.Size
+
+	if !msg.ExpectsResponse {
+		// no reply is sent, publish it right away
+		mongodb.publishTransaction(trans)
+		return
+	}
+
+	if old := mongodb.transactionsMap[key]; old != nil {
+		logp.Debug("mongodb", "Two requests with the same id. Dropping old request")
+		if old.timer != nil {
+			old.timer.Stop()
+		}
+		mongodb.transactionsOrder.Remove(old)
+	}
+	mongodb.transactionsMap[key] = trans
+
+	trans.timer = time.AfterFunc(mongodb.transactionTimeout, func() { mongodb.expireTransaction(trans) })
+
+	mongodb.transactionsOrder.Add(trans)
+	mongodb.evictTransactions()
+}
+
+// evictTransactions publishes the oldest requests, without their
+// response, while more than maxTransactions are waiting.
+func (mongodb *Mongodb) evictTransactions() {
+	for mongodb.maxTransactions > 0 && mongodb.transactionsOrder.Len() > mongodb.maxTransactions {
+		trans, ok := mongodb.transactionsOrder.Oldest().(*MongodbTransaction)
+		if !ok {
+			break
+		}
+		mongodb.removeTransaction(trans)
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+
+		trans.Status = protos.OVERFLOW_STATUS
+		mongodb.publishTransaction(trans)
+	}
+}
+
+func (mongodb *Mongodb) removeTransaction(trans *MongodbTransaction) {
+	delete(mongodb.transactionsMap, trans.key)
+	mongodb.transactionsOrder.Remove(trans)
+}
+
+func (mongodb *Mongodb) receivedMongodbResponse(msg *MongodbMessage) {
+
+	key := MongodbTransactionKey{tuple: msg.TcpTuple.Hashable(), id: msg.ResponseTo}
+
+	trans := mongodb.transactionsMap[key]
+	if trans == nil {
+		logp.Warn("Response from unknown transaction. Ignoring.")
+		return
+	}
+
+	trans.Response = msg
+	trans.BytesOut = msg.Size
+	trans.ResponseTime = int32(msg.Ts.Sub(trans.ts).Nanoseconds() / 1e6) // resp_time in milliseconds
+
+	mongodb.publishTransaction(trans)
+
+	logp.Debug("mongodb", "MongoDB transaction completed: id %d", msg.ResponseTo)
+
+	// remove from map
+	mongodb.removeTransaction(trans)
+	if trans.timer != nil {
+		trans.timer.Stop()
+	}
+}
+
+// Flush publishes the requests still waiting for their response.
+func (mongodb *Mongodb) Flush() {
+	for key, trans := range mongodb.transactionsMap {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		delete(mongodb.transactionsMap, key)
+		mongodb.transactionsOrder.Remove(trans)
+
+		if trans.Request == nil {
+			continue
+		}
+		trans.Status = protos.SHUTDOWN_STATUS
+		mongodb.publishTransaction(trans)
+	}
+}
+
+// TransactionsInFlight returns the number of requests waiting for their
+// response.
+func (mongodb *Mongodb) TransactionsInFlight() int {
+	return len(mongodb.transactionsMap)
+}
+
+func (mongodb *Mongodb) expireTransaction(trans *MongodbTransaction) {
+
+	// remove from map
+	mongodb.removeTransaction(trans)
+}
+
+// Formats the documents, one per line. Both their number and their
+// length are limited.
+func (mongodb *Mongodb) documentsToString(docs []bsonDocument) string {
+	lines := make([]string, 0, len(docs))
+	for i, doc := range docs {
+		if i >= mongodb.maxDocs {
+			lines = append(lines, fmt.Sprintf("[%d more documents]", len(docs)-i))
+			break
+		}
+		s := bsonToString(doc)
+		if mongodb.maxDocLength > 0 && len(s) > mongodb.maxDocLength {
+			s = s[:mongodb.maxDocLength] + "..."
+		}
+		lines = append(lines, s)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (mongodb *Mongodb) publishTransaction(t *MongodbTransaction) {
+
+	if mongodb.results == nil {
+		return
+	}
+
+	request := t.Request
+	response := t.Response
+
+	event := common.MapStr{}
+	event["type"] = "mongodb"
+	if len(t.Status) > 0 {
+		event["status"] = t.Status
+	} else if response != nil && response.IsError {
+		event["status"] = common.ERROR_STATUS
+	} else {
+		event["status"] = common.OK_STATUS
+	}
+	event["responsetime"] = t.ResponseTime
+	if mongodb.Send_request {
+		event["request"] = mongodb.documentsToString(request.Documents)
+	}
+	if mongodb.Send_response && response != nil {
+		event["response"] = mongodb.documentsToString(response.Documents)
+	}
+	event["method"] = request.Method
+	event["bytes_in"] = uint64(t.BytesIn)
+	event["bytes_out"] = uint64(t.BytesOut)
+
+	resource := request.Database
+	if len(request.Collection) > 0 {
+		resource = request.Database + "." + request.Collection
+	}
+	event["resource"] = resource
+	event["query"] = fmt.Sprintf("%s.%s()", resource, request.Method)
+
+	details := common.MapStr{
+		"database":   request.Database,
+		"collection": request.Collection,
+	}
+	if response != nil {
+		details["documents_returned"] = response.DocumentsReturned
+		if len(response.ErrorMessage) > 0 {
+			details["error"] = response.ErrorMessage
+		}
+	}
+	event["mongodb"] = details
+
+	event["timestamp"] = common.Time(t.ts)
+	event["src"] = &t.Src
+	event["dst"] = &t.Dst
+	t.link.AddFields(event)
+
+	mongodb.results <- event
+}
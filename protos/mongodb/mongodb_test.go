@@ -0,0 +1,246 @@
+package mongodb
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func MongodbModForTests() *Mongodb {
+	var mongodb Mongodb
+	mongodb.Init(true, nil)
+	mongodb.results = make(chan common.MapStr, 10)
+	return &mongodb
+}
+
+func testTcpTuple() *common.TcpTuple {
+	t := &common.TcpTuple{
+		Ip_length: 4,
+		Src_ip:    net.IPv4(192, 168, 0, 1), Dst_ip: net.IPv4(192, 168, 0, 2),
+		Src_port: 6512, Dst_port: 27017,
+	}
+	t.ComputeHashebles()
+	return t
+}
+
+func newPacket(t *testing.T, payload string, ts time.Time) *protos.Packet {
+	data, err := hex.DecodeString(payload)
+	if err != nil {
+		t.Fatalf("Failed to decode hex string")
+	}
+	return &protos.Packet{Ts: ts, Payload: data}
+}
+
+// db.users.find({name: "alice"})
+const findRequest = "550000000500000000000000dd0700000000000000400000000266696e640006" +
+	"0000007573657273000366696c7465720015000000026e616d65000600000061" +
+	"6c6963650000022464620005000000746573740000"
+
+const findResponse = "950000004700000005000000dd07000000000000008000000003637572736f72" +
+	"0067000000046669727374426174636800370000000330002f000000075f6964" +
+	"005f1d7e2a9c8b4a0012345678026e616d650006000000616c69636500106167" +
+	"65001e0000000000126964000000000000000000026e73000b00000074657374" +
+	"2e75736572730000016f6b00000000000000f03f00"
+
+// db.users.insert({name: "bob"}), the document is sent in a
+// sequence section
+const insertRequest = "770000000600000000000000dd07000000000000002f00000002696e73657274" +
+	"0006000000757365727300086f72646572656400010224646200050000007465" +
+	"737400000132000000646f63756d656e74730024000000075f6964005f1d7e2a" +
+	"9c8b4a0012345679026e616d650004000000626f620000"
+
+const insertResponse = "2d0000004800000006000000dd070000000000000018000000106e0001000000" +
+	"016f6b00000000000000f03f00"
+
+func TestMongodbParser_opMsgFind(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mongodb"})
+	}
+
+	mongodb := MongodbModForTests()
+	mongodb.Send_request = true
+	mongodb.Send_response = true
+	tcptuple := testTcpTuple()
+	ts := time.Now()
+
+	var private protos.ProtocolData
+	private = mongodb.Parse(newPacket(t, findRequest, ts), tcptuple, 0, private)
+	assert.Equal(t, 1, len(mongodb.transactionsMap))
+	mongodb.Parse(newPacket(t, findResponse, ts.Add(3*time.Millisecond)), tcptuple, 1, private)
+
+	if len(mongodb.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mongodb.results))
+	}
+	assert.Equal(t, 0, len(mongodb.transactionsMap))
+
+	event := <-mongodb.results
+	assert.Equal(t, "mongodb", event["type"])
+	assert.Equal(t, common.OK_STATUS, event["status"])
+	assert.Equal(t, int32(3), event["responsetime"])
+	assert.Equal(t, "find", event["method"])
+	assert.Equal(t, "test.users", event["resource"])
+	assert.Equal(t, "test.users.find()", event["query"])
+	assert.Equal(t, uint64(85), event["bytes_in"])
+	assert.Equal(t, uint64(149), event["bytes_out"])
+	assert.Equal(t, `{ "find": "users", "filter": { "name": "alice" }, "$db": "test" }`,
+		event["request"])
+	assert.Equal(t, `{ "cursor": { "firstBatch": [{ "_id": ObjectId("5f1d7e2a9c8b4a0012345678"),`+
+		` "name": "alice", "age": 30 }], "id": NumberLong(0), "ns": "test.users" }, "ok": 1 }`,
+		event["response"])
+
+	details := event["mongodb"].(common.MapStr)
+	assert.Equal(t, "test", details["database"])
+	assert.Equal(t, "users", details["collection"])
+	assert.Equal(t, 1, details["documents_returned"])
+}
+
+func TestMongodbParser_opMsgInsert(t *testing.T) {
+
+	mongodb := MongodbModForTests()
+	mongodb.Send_request = true
+	tcptuple := testTcpTuple()
+	ts := time.Now()
+
+	// the request split in two segments
+	var private protos.ProtocolData
+	private = mongodb.Parse(newPacket(t, insertRequest[:40], ts), tcptuple, 0, private)
+	assert.Equal(t, 0, len(mongodb.transactionsMap))
+	private = mongodb.Parse(newPacket(t, insertRequest[40:], ts), tcptuple, 0, private)
+	assert.Equal(t, 1, len(mongodb.transactionsMap))
+	mongodb.Parse(newPacket(t, insertResponse, ts), tcptuple, 1, private)
+
+	if len(mongodb.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mongodb.results))
+	}
+	event := <-mongodb.results
+	assert.Equal(t, common.OK_STATUS, event["status"])
+	assert.Equal(t, "insert", event["method"])
+	assert.Equal(t, "test.users", event["resource"])
+	assert.Equal(t, `{ "insert": "users", "ordered": true, "$db": "test" }`+"\n"+
+		`{ "_id": ObjectId("5f1d7e2a9c8b4a0012345679"), "name": "bob" }`, event["request"])
+
+	details := event["mongodb"].(common.MapStr)
+	assert.Equal(t, 0, details["documents_returned"])
+}
+
+func TestMongodbParser_commandError(t *testing.T) {
+
+	mongodb := MongodbModForTests()
+	tcptuple := testTcpTuple()
+
+	// db.missing.drop()
+	var private protos.ProtocolData
+	private = mongodb.Parse(newPacket(t,
+		"3a0000000700000000000000dd0700000000000000250000000264726f700008"+
+			"0000006d697373696e6700022464620005000000746573740000",
+		time.Now()), tcptuple, 0, private)
+	mongodb.Parse(newPacket(t,
+		"690000004900000007000000dd070000000000000054000000016f6b00000000"+
+			"0000000000026572726d7367000d0000006e73206e6f7420666f756e64001063"+
+			"6f6465001a00000002636f64654e616d6500120000004e616d6573706163654e"+
+			"6f74466f756e640000",
+		time.Now()), tcptuple, 1, private)
+
+	if len(mongodb.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mongodb.results))
+	}
+	event := <-mongodb.results
+	assert.Equal(t, common.ERROR_STATUS, event["status"])
+	assert.Equal(t, "drop", event["method"])
+	assert.Equal(t, "test.missing", event["resource"])
+	details := event["mongodb"].(common.MapStr)
+	assert.Equal(t, "ns not found", details["error"])
+}
+
+func TestMongodbParser_opQueryCommand(t *testing.T) {
+
+	mongodb := MongodbModForTests()
+	tcptuple := testTcpTuple()
+
+	// isMaster, sent on the admin.$cmd collection
+	var private protos.ProtocolData
+	private = mongodb.Parse(newPacket(t,
+		"3a0000000800000000000000d40700000000000061646d696e2e24636d640000"+
+			"000000ffffffff130000001069734d6173746572000100000000",
+		time.Now()), tcptuple, 0, private)
+	mongodb.Parse(newPacket(t,
+		"540000004a000000080000000100000008000000000000000000000000000000"+
+			"01000000300000000869736d61737465720001106d6178576972655665727369"+
+			"6f6e0006000000016f6b00000000000000f03f00",
+		time.Now()), tcptuple, 1, private)
+
+	if len(mongodb.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mongodb.results))
+	}
+	event := <-mongodb.results
+	assert.Equal(t, common.OK_STATUS, event["status"])
+	assert.Equal(t, "isMaster", event["method"])
+	assert.Equal(t, "admin", event["resource"])
+	details := event["mongodb"].(common.MapStr)
+	assert.Equal(t, "", details["collection"])
+	assert.Equal(t, 1, details["documents_returned"])
+}
+
+func TestMongodbParser_truncateDocuments(t *testing.T) {
+
+	mongodb := MongodbModForTests()
+	mongodb.maxDocLength = 10
+
+	doc := bsonDocument{{"name", "a long string value"}}
+	assert.Equal(t, `{ "name": ...`, mongodb.documentsToString([]bsonDocument{doc}))
+
+	mongodb.maxDocLength = 0
+	mongodb.maxDocs = 1
+	assert.Equal(t, `{ "name": "a long string value" }`+"\n[1 more documents]",
+		mongodb.documentsToString([]bsonDocument{doc, doc}))
+}
+
+func TestMongodbParser_invalidLength(t *testing.T) {
+
+	mongodb := MongodbModForTests()
+	tcptuple := testTcpTuple()
+
+	private := mongodb.Parse(newPacket(t, "0400000000000000000000000000000000", time.Now()),
+		tcptuple, 0, nil)
+
+	priv := private.(mongodbPrivateData)
+	assert.Nil(t, priv.Data[0])
+	assert.Equal(t, 0, len(mongodb.results))
+}
+
+// nestedDocuments returns a document with depth documents nested in it,
+// alternating embedded documents and arrays.
+func nestedDocuments(depth int) []byte {
+	doc := []byte{5, 0, 0, 0, 0}
+	for i := 0; i < depth; i++ {
+		elemType := byte(0x03)
+		if i%2 == 1 {
+			elemType = 0x04
+		}
+		nested := append([]byte{0, 0, 0, 0, elemType, 'a', 0}, doc...)
+		nested = append(nested, 0)
+		binary.LittleEndian.PutUint32(nested, uint32(len(nested)))
+		doc = nested
+	}
+	return doc
+}
+
+func TestBson_maxDepth(t *testing.T) {
+
+	data := nestedDocuments(bsonMaxDepth - 1)
+	_, n, err := decodeBsonDocument(data)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), n)
+
+	_, _, err = decodeBsonDocument(nestedDocuments(bsonMaxDepth))
+	assert.Equal(t, errBsonTooDeep, err)
+}
@@ -0,0 +1,218 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Column types of the field definitions
+const (
+	MYSQL_TYPE_DECIMAL    = 0x00
+	MYSQL_TYPE_TINY       = 0x01
+	MYSQL_TYPE_SHORT      = 0x02
+	MYSQL_TYPE_LONG       = 0x03
+	MYSQL_TYPE_FLOAT      = 0x04
+	MYSQL_TYPE_DOUBLE     = 0x05
+	MYSQL_TYPE_NULL       = 0x06
+	MYSQL_TYPE_TIMESTAMP  = 0x07
+	MYSQL_TYPE_LONGLONG   = 0x08
+	MYSQL_TYPE_INT24      = 0x09
+	MYSQL_TYPE_DATE       = 0x0a
+	MYSQL_TYPE_TIME       = 0x0b
+	MYSQL_TYPE_DATETIME   = 0x0c
+	MYSQL_TYPE_YEAR       = 0x0d
+	MYSQL_TYPE_NEWDATE    = 0x0e
+	MYSQL_TYPE_VAR_STRING = 0xfd
+	MYSQL_TYPE_STRING     = 0xfe
+)
+
+// Flag of the field definitions set for the unsigned integers
+const UNSIGNED_FLAG = 0x0020
+
+// mysqlColumn is the type of a column of a result set, from its field
+// definition, needed to decode the rows of the binary protocol.
+type mysqlColumn struct {
+	typ   uint8
+	flags uint16
+}
+
+var errBinaryRowTruncated = errors.New("binary row truncated")
+
+// decodeBinaryRow decodes a row of the binary protocol, sent in the
+// result sets of the prepared statements: a 0x00 header, a bitmap of the
+// NULL values, then the values in an encoding depending on the type of
+// their column. The values are returned in the text form of the text
+// protocol, "NULL" for the NULL values.
+func decodeBinaryRow(data []byte, columns []mysqlColumn) ([]string, error) {
+	// the first two bits of the bitmap are not used
+	bitmapLen := (len(columns) + 7 + 2) / 8
+	if len(data) < 1+bitmapLen {
+		return nil, errBinaryRowTruncated
+	}
+	if data[0] != 0x00 {
+		return nil, fmt.Errorf("unexpected binary row header %#x", data[0])
+	}
+	bitmap := data[1 : 1+bitmapLen]
+	off := 1 + bitmapLen
+
+	row := make([]string, 0, len(columns))
+	for i, column := range columns {
+		bit := i + 2
+		if bitmap[bit/8]&(1<<uint(bit%8)) != 0 {
+			row = append(row, "NULL")
+			continue
+		}
+		value, n, err := decodeBinaryValue(data[off:], column)
+		if err != nil {
+			return row, err
+		}
+		row = append(row, value)
+		off += n
+	}
+	return row, nil
+}
+
+// decodeBinaryValue decodes the value of the column at the beginning of
+// data. It returns the value and the number of bytes it used.
+func decodeBinaryValue(data []byte, column mysqlColumn) (string, int, error) {
+	unsigned := column.flags&UNSIGNED_FLAG != 0
+
+	switch column.typ {
+	case MYSQL_TYPE_NULL:
+		return "NULL", 0, nil
+
+	case MYSQL_TYPE_TINY:
+		if len(data) < 1 {
+			return "", 0, errBinaryRowTruncated
+		}
+		if unsigned {
+			return strconv.FormatUint(uint64(data[0]), 10), 1, nil
+		}
+		return strconv.FormatInt(int64(int8(data[0])), 10), 1, nil
+
+	case MYSQL_TYPE_SHORT, MYSQL_TYPE_YEAR:
+		if len(data) < 2 {
+			return "", 0, errBinaryRowTruncated
+		}
+		v := binary.LittleEndian.Uint16(data)
+		if unsigned || column.typ == MYSQL_TYPE_YEAR {
+			return strconv.FormatUint(uint64(v), 10), 2, nil
+		}
+		return strconv.FormatInt(int64(int16(v)), 10), 2, nil
+
+	case MYSQL_TYPE_LONG, MYSQL_TYPE_INT24:
+		if len(data) < 4 {
+			return "", 0, errBinaryRowTruncated
+		}
+		v := binary.LittleEndian.Uint32(data)
+		if unsigned {
+			return strconv.FormatUint(uint64(v), 10), 4, nil
+		}
+		return strconv.FormatInt(int64(int32(v)), 10), 4, nil
+
+	case MYSQL_TYPE_LONGLONG:
+		if len(data) < 8 {
+			return "", 0, errBinaryRowTruncated
+		}
+		v := binary.LittleEndian.Uint64(data)
+		if unsigned {
+			return strconv.FormatUint(v, 10), 8, nil
+		}
+		return strconv.FormatInt(int64(v), 10), 8, nil
+
+	case MYSQL_TYPE_FLOAT:
+		if len(data) < 4 {
+			return "", 0, errBinaryRowTruncated
+		}
+		v := math.Float32frombits(binary.LittleEndian.Uint32(data))
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), 4, nil
+
+	case MYSQL_TYPE_DOUBLE:
+		if len(data) < 8 {
+			return "", 0, errBinaryRowTruncated
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(data))
+		return strconv.FormatFloat(v, 'g', -1, 64), 8, nil
+
+	case MYSQL_TYPE_DATE, MYSQL_TYPE_NEWDATE, MYSQL_TYPE_DATETIME, MYSQL_TYPE_TIMESTAMP:
+		return decodeBinaryDatetime(data, column.typ)
+
+	case MYSQL_TYPE_TIME:
+		return decodeBinaryTime(data)
+	}
+
+	// the strings, the decimals, the blobs, the enums, the sets, the
+	// bits, JSON and the geometries are length encoded strings
+	value, off, complete, err := read_lstring(data, 0)
+	if err != nil {
+		return "", 0, err
+	}
+	if !complete {
+		return "", 0, errBinaryRowTruncated
+	}
+	return string(value), off, nil
+}
+
+// decodeBinaryDatetime decodes a date, a datetime or a timestamp: its
+// length, 0, 4, 7 or 11, then the fields that are not zero.
+func decodeBinaryDatetime(data []byte, typ uint8) (string, int, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", 0, errBinaryRowTruncated
+	}
+	length := int(data[0])
+	v := data[1 : 1+length]
+
+	var year, month, day, hour, minute, second, micro int
+	if length >= 4 {
+		year = int(binary.LittleEndian.Uint16(v))
+		month, day = int(v[2]), int(v[3])
+	}
+	if length >= 7 {
+		hour, minute, second = int(v[4]), int(v[5]), int(v[6])
+	}
+	if length >= 11 {
+		micro = int(binary.LittleEndian.Uint32(v[7:]))
+	}
+
+	text := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if typ != MYSQL_TYPE_DATE && typ != MYSQL_TYPE_NEWDATE {
+		text += fmt.Sprintf(" %02d:%02d:%02d", hour, minute, second)
+		if micro > 0 {
+			text += fmt.Sprintf(".%06d", micro)
+		}
+	}
+	return text, 1 + length, nil
+}
+
+// decodeBinaryTime decodes a time: its length, 0, 8 or 12, the sign, the
+// days, the time and the microseconds.
+func decodeBinaryTime(data []byte) (string, int, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", 0, errBinaryRowTruncated
+	}
+	length := int(data[0])
+	v := data[1 : 1+length]
+
+	var negative bool
+	var days, hour, minute, second, micro int
+	if length >= 8 {
+		negative = v[0] == 1
+		days = int(binary.LittleEndian.Uint32(v[1:]))
+		hour, minute, second = int(v[5]), int(v[6]), int(v[7])
+	}
+	if length >= 12 {
+		micro = int(binary.LittleEndian.Uint32(v[8:]))
+	}
+
+	text := fmt.Sprintf("%02d:%02d:%02d", days*24+hour, minute, second)
+	if micro > 0 {
+		text += fmt.Sprintf(".%06d", micro)
+	}
+	if negative {
+		text = "-" + text
+	}
+	return text, 1 + length, nil
+}
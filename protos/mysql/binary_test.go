@@ -0,0 +1,61 @@
+package mysql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeBinaryRow(t *testing.T) {
+	columns := []mysqlColumn{
+		{typ: MYSQL_TYPE_LONG},
+		{typ: MYSQL_TYPE_VAR_STRING},
+		{typ: MYSQL_TYPE_LONGLONG, flags: UNSIGNED_FLAG},
+		{typ: MYSQL_TYPE_DATETIME},
+	}
+	row := []byte{
+		0x00,
+		// the third column is NULL, its bit is the fifth one
+		0x10,
+		// int<4> -42
+		0xd6, 0xff, 0xff, 0xff,
+		// string<lenenc> alice
+		5, 'a', 'l', 'i', 'c', 'e',
+		// 2015-10-21 07:28:00
+		7, 0xdf, 0x07, 10, 21, 7, 28, 0,
+	}
+
+	values, err := decodeBinaryRow(row, columns)
+	if err != nil {
+		t.Fatalf("Failed to decode the row: %s", err)
+	}
+	expected := []string{"-42", "alice", "NULL", "2015-10-21 07:28:00"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Expected %v, got %v", expected, values)
+	}
+
+	if _, err := decodeBinaryRow(row[:8], columns); err == nil {
+		t.Errorf("Expected an error for a truncated row")
+	}
+}
+
+func TestDecodeBinaryValue(t *testing.T) {
+	tests := []struct {
+		column mysqlColumn
+		data   []byte
+		value  string
+	}{
+		{mysqlColumn{typ: MYSQL_TYPE_TINY}, []byte{0xff}, "-1"},
+		{mysqlColumn{typ: MYSQL_TYPE_TINY, flags: UNSIGNED_FLAG}, []byte{0xff}, "255"},
+		{mysqlColumn{typ: MYSQL_TYPE_YEAR}, []byte{0xdf, 0x07}, "2015"},
+		{mysqlColumn{typ: MYSQL_TYPE_DOUBLE}, []byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f}, "1.5"},
+		{mysqlColumn{typ: MYSQL_TYPE_DATE}, []byte{4, 0xdf, 0x07, 10, 21}, "2015-10-21"},
+		{mysqlColumn{typ: MYSQL_TYPE_TIME}, []byte{8, 1, 1, 0, 0, 0, 2, 30, 0}, "-26:30:00"},
+		{mysqlColumn{typ: MYSQL_TYPE_DECIMAL}, []byte{4, '3', '.', '1', '4'}, "3.14"},
+	}
+	for _, test := range tests {
+		value, n, err := decodeBinaryValue(test.data, test.column)
+		if err != nil || value != test.value || n != len(test.data) {
+			t.Errorf("Expected %s for %v, got %s (%d bytes, %v)", test.value, test.data, value, n, err)
+		}
+	}
+}
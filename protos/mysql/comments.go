@@ -0,0 +1,129 @@
+package mysql
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/johann8384/libbeat/common"
+)
+
+// isExecutableComment tells whether the body of a block comment is run by
+// the server, like the version specific code /*!50100 ... */ and the
+// optimizer hints /*+ ... */. They are part of the query.
+func isExecutableComment(body string) bool {
+	return strings.HasPrefix(body, "!") || strings.HasPrefix(body, "+")
+}
+
+// extractComments returns the block comments at the beginning and at the
+// end of the query, without their delimiters, and the query without them.
+// The comments in the middle of the query are left in place.
+func extractComments(query string) ([]string, string) {
+	var leading, trailing []string
+
+	rest := strings.TrimLeft(query, " \n\t\r")
+	for strings.HasPrefix(rest, "/*") {
+		end := strings.Index(rest[2:], "*/")
+		if end < 0 || isExecutableComment(rest[2:]) {
+			break
+		}
+		leading = append(leading, rest[2:2+end])
+		rest = strings.TrimLeft(rest[2+end+2:], " \n\t\r")
+	}
+
+	rest = strings.TrimRight(rest, " \n\t\r;")
+	for strings.HasSuffix(rest, "*/") {
+		start := strings.LastIndex(rest[:len(rest)-2], "/*")
+		if start < 0 {
+			break
+		}
+		body := rest[start+2 : len(rest)-2]
+		if isExecutableComment(body) {
+			break
+		}
+		trailing = append([]string{body}, trailing...)
+		rest = strings.TrimRight(rest[:start], " \n\t\r;")
+	}
+
+	return append(leading, trailing...), rest
+}
+
+// pathUnescape decodes the %XX escapes, leaving the + as they are, like
+// url.PathUnescape which needs Go 1.8.
+func pathUnescape(s string) (string, error) {
+	return url.QueryUnescape(strings.Replace(s, "+", "%2B", -1))
+}
+
+// parseSqlcommenter parses a comment made of key='value' pairs separated
+// by commas, as added by sqlcommenter. The keys and the values are URL
+// encoded and the quotes in the values are escaped by a backslash. It
+// returns false if the comment is not in this format.
+func parseSqlcommenter(comment string) (common.MapStr, bool) {
+	text := strings.TrimSpace(comment)
+	if len(text) == 0 {
+		return nil, false
+	}
+
+	fields := common.MapStr{}
+	for {
+		eq := strings.IndexByte(text, '=')
+		if eq <= 0 {
+			return nil, false
+		}
+		key, err := pathUnescape(strings.TrimSpace(text[:eq]))
+		if err != nil || len(key) == 0 || strings.ContainsAny(key, " '") {
+			return nil, false
+		}
+
+		text = strings.TrimLeft(text[eq+1:], " ")
+		if len(text) == 0 || text[0] != '\'' {
+			return nil, false
+		}
+		var value []byte
+		i := 1
+		for ; i < len(text) && text[i] != '\''; i++ {
+			if text[i] == '\\' && i+1 < len(text) {
+				i++
+			}
+			value = append(value, text[i])
+		}
+		if i == len(text) {
+			// the value is not closed
+			return nil, false
+		}
+		unescaped, err := pathUnescape(string(value))
+		if err != nil {
+			return nil, false
+		}
+		fields[key] = unescaped
+
+		text = strings.TrimLeft(text[i+1:], " ")
+		if len(text) == 0 {
+			return fields, true
+		}
+		if text[0] != ',' {
+			return nil, false
+		}
+		text = strings.TrimLeft(text[1:], " ")
+	}
+}
+
+// addComments adds the comments of the query to the mysql fields of its
+// transaction. The sqlcommenter key-value pairs are added to comments,
+// the other comments are joined in comment, unless withRaw is false.
+func addComments(fields common.MapStr, comments []string, withRaw bool) {
+	structured := common.MapStr{}
+	var raw []string
+	for _, comment := range comments {
+		if pairs, ok := parseSqlcommenter(comment); ok {
+			structured.Update(pairs)
+		} else if text := strings.TrimSpace(comment); len(text) > 0 {
+			raw = append(raw, text)
+		}
+	}
+	if len(structured) > 0 {
+		fields["comments"] = structured
+	}
+	if withRaw && len(raw) > 0 {
+		fields["comment"] = strings.Join(raw, " ")
+	}
+}
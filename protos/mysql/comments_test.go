@@ -0,0 +1,93 @@
+package mysql
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/tcp"
+)
+
+func TestExtractComments(t *testing.T) {
+	tests := []struct {
+		query     string
+		comments  []string
+		statement string
+	}{
+		{"SELECT 1", nil, "SELECT 1"},
+		{"/* app */ SELECT 1 /*route='x'*/;", []string{" app ", "route='x'"}, "SELECT 1"},
+		{"SELECT /* kept */ 1", nil, "SELECT /* kept */ 1"},
+		{"SELECT /*+ MAX_EXECUTION_TIME(1000) */ 1 /*a='b'*/ /*c='d'*/",
+			[]string{"a='b'", "c='d'"}, "SELECT /*+ MAX_EXECUTION_TIME(1000) */ 1"},
+		{"/*!40101 SET NAMES utf8 */", nil, "/*!40101 SET NAMES utf8 */"},
+	}
+
+	for _, test := range tests {
+		comments, statement := extractComments(test.query)
+		if !reflect.DeepEqual(comments, test.comments) || statement != test.statement {
+			t.Errorf("Extracting from %q: expected %q and %q, got %q and %q", test.query,
+				test.comments, test.statement, comments, statement)
+		}
+	}
+}
+
+func TestParseSqlcommenter(t *testing.T) {
+	fields, ok := parseSqlcommenter(
+		`action='%2Fparam*d',controller='index', framework='spring', traceparent='00-5bd66ef5095369c7b0d1f8f4bd33716a-c532cb4098ac3dd2-01', tag='it\'s', db_driver='go%2Fmysql+v1%20'`)
+	if !ok {
+		t.Fatalf("The comment was not parsed")
+	}
+	expected := common.MapStr{
+		"action":      "/param*d",
+		"controller":  "index",
+		"framework":   "spring",
+		"traceparent": "00-5bd66ef5095369c7b0d1f8f4bd33716a-c532cb4098ac3dd2-01",
+		"tag":         "it's",
+		"db_driver":   "go/mysql+v1 ",
+	}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected %v, got %v", expected, fields)
+	}
+
+	for _, comment := range []string{"", " generated by the ORM ", "route=x", "a='b' c='d'",
+		"a='b',", "a='unclosed", "='empty key'"} {
+		if _, ok := parseSqlcommenter(comment); ok {
+			t.Errorf("Expected %q not to be parsed", comment)
+		}
+	}
+}
+
+func TestParseMySQL_sqlcommenter(t *testing.T) {
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	query := "/* nightly report */ SELECT * FROM post /*controller='index',route='%2Fposts'*/"
+	req := append([]byte{byte(len(query) + 1), 0, 0, 0, MYSQL_CMD_QUERY}, query...)
+	resp := []byte{7, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0}
+
+	tuple := common.TcpTuple{Src_port: 3306}
+	tuple.ComputeHashebles()
+	var private protos.ProtocolData
+	private = mysql.Parse(&protos.Packet{Payload: req, Ts: time.Now()}, &tuple,
+		tcp.TcpDirectionOriginal, private)
+	mysql.Parse(&protos.Packet{Payload: resp, Ts: time.Now()}, &tuple,
+		tcp.TcpDirectionReverse, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mysql.results))
+	}
+	event := <-mysql.results
+	fields := event["mysql"].(common.MapStr)
+	expected := common.MapStr{"controller": "index", "route": "/posts"}
+	if !reflect.DeepEqual(fields["comments"], expected) {
+		t.Errorf("Expected the comments %v, got %v", expected, fields["comments"])
+	}
+	if fields["comment"] != "nightly report" {
+		t.Errorf("Wrong raw comment: %v", fields["comment"])
+	}
+	if event["method"] != "SELECT" || event["query"] != query {
+		t.Errorf("Wrong method or query: %v %v", event["method"], event["query"])
+	}
+}
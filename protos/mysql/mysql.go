@@ -1,9 +1,15 @@
 package mysql
 
 import (
+	"bytes"
+	"compress/zlib"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/johann8384/libbeat/common"
 	"github.com/johann8384/libbeat/logp"
@@ -16,16 +22,44 @@ import (
 
 // Packet types
 const (
-	MYSQL_CMD_QUERY = 3
+	MYSQL_CMD_QUIT         = 1
+	MYSQL_CMD_QUERY        = 3
+	MYSQL_CMD_STMT_PREPARE = 22
+	MYSQL_CMD_STMT_EXECUTE = 23
+	MYSQL_CMD_STMT_CLOSE   = 25
 )
 
+// Protocol version sent in the initial handshake packet
+const MYSQL_HANDSHAKE_V10 = 10
+
+// Capability flags
+const (
+	CLIENT_COMPRESS    = 0x00000020
+	CLIENT_PROTOCOL_41 = 0x00000200
+	CLIENT_SSL         = 0x00000800
+)
+
+// Status flag of the OK and EOF packets, set when the response to a
+// query with several statements has more result sets
+const SERVER_MORE_RESULTS_EXISTS = 0x0008
+
+// Size of the header preceding each packet when the compressed
+// protocol is used
+const MYSQL_COMPRESSED_HEADER_SIZE = 7
+
 const MAX_PAYLOAD_SIZE = 100 * 1024
 
+// Maximum number of prepared statements tracked by connection. The
+// statements are freed by COM_STMT_CLOSE, this limits the memory used
+// when the close is not captured or the client never sends it.
+const MAX_PREPARED_STATEMENTS = 1000
+
 type MysqlMessage struct {
 	start int
 	end   int
 
 	Ts             time.Time
+	Link           protos.Link
 	IsRequest      bool
 	PacketLength   uint32
 	Seq            uint8
@@ -37,24 +71,55 @@ type MysqlMessage struct {
 	Rows           [][]string
 	Tables         string
 	IsOK           bool
+	MoreResults    bool
+	StatusFlags    uint16
+	Warnings       uint16
 	AffectedRows   uint64
 	InsertId       uint64
 	IsError        bool
 	ErrorCode      uint16
 	ErrorInfo      string
+	SqlState       string
 	Query          string
 	IgnoreMessage  bool
+	IsQuit         bool
+	IsHandshake    bool
+	ServerVersion  string
+
+	IsHandshakeResponse bool
+	ClientCapabilities  uint32
+
+	// the server asks for the file of a LOAD DATA LOCAL INFILE query
+	IsLocalInfileRequest bool
+
+	// prepared statements: the COM_STMT_PREPARE request, its OK
+	// response, the COM_STMT_EXECUTE and COM_STMT_CLOSE requests, with
+	// the statement id
+	IsStmtPrepare   bool
+	IsStmtPrepareOK bool
+	IsStmtExecute   bool
+	IsStmtClose     bool
+	StatementId     uint32
+
+	// the rows of the result set are in the binary protocol
+	IsBinary bool
 
 	Direction    uint8
 	IsTruncated  bool
 	TcpTuple     common.TcpTuple
 	CmdlineTuple *common.CmdlineTuple
 	Raw          []byte
+	Notes        []string
+
+	// in the response capture direction, the transaction of the last
+	// request of the connection
+	transaction *MysqlTransaction
 }
 
 type MysqlTransaction struct {
 	Type         string
 	tuple        common.TcpTuple
+	link         protos.Link
 	Src          common.Endpoint
 	Dst          common.Endpoint
 	ResponseTime int32
@@ -71,6 +136,14 @@ type MysqlTransaction struct {
 	Request_raw  string
 	Response_raw string
 
+	IsRequestTruncated bool
+
+	// results of the statements, when the query has several
+	results []common.MapStr
+
+	Notes  []string
+	Status string
+
 	timer *time.Timer
 }
 
@@ -83,6 +156,16 @@ type MysqlStream struct {
 	parseState  int
 	isClient    bool
 
+	// set when the next message in this stream is the client's
+	// answer to the server handshake
+	handshakeResponse bool
+
+	// set when the next response in this stream answers a
+	// COM_STMT_PREPARE, or a COM_STMT_EXECUTE whose rows are in the
+	// binary protocol
+	stmtPrepareResponse bool
+	binaryRows          bool
+
 	message *MysqlMessage
 }
 
@@ -101,24 +184,40 @@ const (
 type Mysql struct {
 
 	// config
-	Ports         []int
-	maxStoreRows  int
-	maxRowLength  int
-	Send_request  bool
-	Send_response bool
-
-	transactionsMap map[common.HashableTcpTuple]*MysqlTransaction
+	Ports                []int
+	maxStoreRows         int
+	maxRowLength         int
+	maxQueryLength       int
+	maxTransactions      int
+	transactionTimeout   time.Duration
+	normalizeQueries     bool
+	redactQueries        bool
+	rowsSample           int
+	splitRequestResponse bool
+	captureDirection     string
+	Send_request         bool
+	Send_response        bool
+
+	transactionsMap   map[common.HashableTcpTuple]*MysqlTransaction
+	transactionsOrder *protos.TransactionsOrder
 
 	results chan common.MapStr
 
 	// function pointer for mocking
 	handleMysql func(mysql *Mysql, m *MysqlMessage, tcp *common.TcpTuple,
 		dir uint8, raw_msg []byte)
+
+	// starts the expiry timers, replaced in the tests
+	afterFunc func(d time.Duration, f func()) *time.Timer
 }
 
 func (mysql *Mysql) InitDefaults() {
 	mysql.maxRowLength = 1024
 	mysql.maxStoreRows = 10
+	mysql.maxQueryLength = 4096
+	mysql.maxTransactions = protos.DefaultMaxTransactions
+	mysql.transactionTimeout = TransactionTimeout
+	mysql.captureDirection = protos.CaptureBoth
 	mysql.Send_request = false
 	mysql.Send_response = false
 }
@@ -133,12 +232,41 @@ func (mysql *Mysql) setFromConfig(config config.Mysql) error {
 	if config.Max_rows != nil {
 		mysql.maxStoreRows = *config.Max_rows
 	}
+	if config.Max_query_length != nil {
+		mysql.maxQueryLength = *config.Max_query_length
+	}
+	if config.Max_transactions != nil {
+		mysql.maxTransactions = *config.Max_transactions
+	}
+	if config.Transaction_timeout != nil {
+		mysql.transactionTimeout = time.Duration(*config.Transaction_timeout) * time.Second
+	}
+	if config.Normalize_queries != nil {
+		mysql.normalizeQueries = *config.Normalize_queries
+	}
+	if config.Redact_queries != nil {
+		mysql.redactQueries = *config.Redact_queries
+	}
+	if config.Rows_sample != nil {
+		mysql.rowsSample = *config.Rows_sample
+	}
 	if config.Send_request != nil {
 		mysql.Send_request = *config.Send_request
 	}
 	if config.Send_response != nil {
 		mysql.Send_response = *config.Send_response
 	}
+	if config.Split_request_response != nil {
+		mysql.splitRequestResponse = *config.Split_request_response
+	}
+	direction, err := protos.ParseCaptureDirection(config.Capture_direction)
+	if err != nil {
+		return err
+	}
+	if direction != protos.CaptureBoth && mysql.splitRequestResponse {
+		return fmt.Errorf("capture_direction %s can't be used with split_request_response", direction)
+	}
+	mysql.captureDirection = direction
 	return nil
 }
 
@@ -157,7 +285,9 @@ func (mysql *Mysql) Init(test_mode bool, results chan common.MapStr) error {
 	}
 
 	mysql.transactionsMap = make(map[common.HashableTcpTuple]*MysqlTransaction, TransactionsHashSize)
+	mysql.transactionsOrder = protos.NewTransactionsOrder()
 	mysql.handleMysql = handleMysql
+	mysql.afterFunc = time.AfterFunc
 	mysql.results = results
 
 	return nil
@@ -191,7 +321,15 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 
 			logp.Debug("mysqldetailed", "MySQL Header: Packet length %d, Seq %d, Type=%d", m.PacketLength, m.Seq, m.Typ)
 
-			if m.Seq == 0 {
+			if m.Seq == 1 && s.handshakeResponse {
+				// client answering the handshake. Only the
+				// capabilities are of interest.
+				m.IsHandshakeResponse = true
+				m.IgnoreMessage = true
+				m.start = s.parseOffset
+				s.parseState = MysqlStateEatMessage
+
+			} else if m.Seq == 0 {
 				// starts Command Phase
 
 				if m.Typ == MYSQL_CMD_QUERY {
@@ -200,13 +338,52 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 					m.start = s.parseOffset
 					s.parseState = MysqlStateEatMessage
 
+				} else if m.Typ == MYSQL_CMD_STMT_PREPARE {
+					// only tracked, the statement is published when
+					// it is executed
+					logp.Debug("mysqldetailed", "Received COM_STMT_PREPARE")
+					m.IsStmtPrepare = true
+					m.IgnoreMessage = true
+					m.start = s.parseOffset
+					s.parseState = MysqlStateEatMessage
+
+				} else if m.Typ == MYSQL_CMD_STMT_EXECUTE && m.PacketLength >= 10 {
+					// published with the query of the statement
+					logp.Debug("mysqldetailed", "Received COM_STMT_EXECUTE")
+					m.IsRequest = true
+					m.IsStmtExecute = true
+					m.start = s.parseOffset
+					s.parseState = MysqlStateEatMessage
+
+				} else if m.Typ == MYSQL_CMD_STMT_CLOSE && m.PacketLength == 5 {
+					// no response is sent by the server
+					logp.Debug("mysqldetailed", "Received COM_STMT_CLOSE")
+					m.IsStmtClose = true
+					m.IgnoreMessage = true
+					m.start = s.parseOffset
+					s.parseState = MysqlStateEatMessage
+
+				} else if m.Typ == MYSQL_CMD_QUIT && m.PacketLength == 1 {
+					logp.Debug("mysqldetailed", "Received COM_QUIT")
+					m.IsRequest = true
+					m.IsQuit = true
+					m.start = s.parseOffset
+					s.parseState = MysqlStateEatMessage
+
+				} else if m.Typ == MYSQL_HANDSHAKE_V10 && m.PacketLength > 1 {
+					// initial handshake sent by the server
+					logp.Debug("mysqldetailed", "Received handshake")
+					m.IsHandshake = true
+					m.start = s.parseOffset
+					s.parseState = MysqlStateEatMessage
+
 				} else {
 					// ignore command
 					m.IgnoreMessage = true
 					s.parseState = MysqlStateEatMessage
 				}
 
-				if !s.isClient {
+				if !s.isClient && !m.IsHandshake {
 					s.isClient = true
 				}
 
@@ -214,7 +391,17 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 				// parse response
 				m.IsRequest = false
 
-				if uint8(hdr[4]) == 0x00 || uint8(hdr[4]) == 0xfe {
+				if uint8(hdr[4]) == 0x00 && s.stmtPrepareResponse &&
+					m.Seq == 1 && m.PacketLength == 12 {
+
+					// followed by the definitions of the parameters
+					// and of the columns, which are ignored
+					logp.Debug("mysqldetailed", "Received COM_STMT_PREPARE OK response")
+					m.IsStmtPrepareOK = true
+					m.IgnoreMessage = true
+					m.start = s.parseOffset
+					s.parseState = MysqlStateEatMessage
+				} else if uint8(hdr[4]) == 0x00 || uint8(hdr[4]) == 0xfe {
 					logp.Debug("mysqldetailed", "Received OK response")
 					m.start = s.parseOffset
 					s.parseState = MysqlStateEatMessage
@@ -224,9 +411,16 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 					m.start = s.parseOffset
 					s.parseState = MysqlStateEatMessage
 					m.IsError = true
+				} else if uint8(hdr[4]) == 0xfb {
+					// followed by the name of the file
+					logp.Debug("mysqldetailed", "Received LOCAL INFILE request")
+					m.start = s.parseOffset
+					s.parseState = MysqlStateEatMessage
+					m.IsLocalInfileRequest = true
 				} else if m.PacketLength == 1 {
 					logp.Debug("mysqldetailed", "Query response. Number of fields %d", uint8(hdr[4]))
 					m.NumberOfFields = int(hdr[4])
+					m.IsBinary = s.binaryRows
 					m.start = s.parseOffset
 					s.parseOffset += 5
 					s.parseState = MysqlStateEatFields
@@ -248,7 +442,32 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 				s.parseOffset += 4 //header
 				s.parseOffset += int(m.PacketLength)
 				m.end = s.parseOffset
-				if m.IsRequest {
+				if m.IsHandshake {
+					// string[NUL] server version
+					version := s.data[m.start+5 : m.end]
+					if i := bytes.IndexByte(version, 0); i >= 0 {
+						version = version[:i]
+					}
+					m.ServerVersion = string(version)
+				} else if m.IsQuit {
+					// nothing more to read
+				} else if m.IsHandshakeResponse {
+					// int<2> or int<4> capability flags
+					payload := s.data[m.start+4 : m.end]
+					if len(payload) >= 2 {
+						m.ClientCapabilities = uint32(payload[0]) | uint32(payload[1])<<8
+					}
+					if m.ClientCapabilities&CLIENT_PROTOCOL_41 != 0 && len(payload) >= 4 {
+						m.ClientCapabilities |= uint32(payload[2])<<16 | uint32(payload[3])<<24
+					}
+				} else if m.IsStmtPrepare {
+					m.Query = string(s.data[m.start+5 : m.end])
+				} else if m.IsStmtPrepareOK || m.IsStmtExecute || m.IsStmtClose {
+					// int<4> statement id
+					id := s.data[m.start+5 : m.start+9]
+					m.StatementId = uint32(id[0]) | uint32(id[1])<<8 |
+						uint32(id[2])<<16 | uint32(id[3])<<24
+				} else if m.IsRequest {
 					m.Query = string(s.data[m.start+5 : m.end])
 				} else if m.IsOK {
 					// affected rows
@@ -272,6 +491,15 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 						return false, false
 					}
 					m.InsertId = insertId
+
+					// int<2> status flags, int<2> warnings
+					if m.Typ == 0x00 && off+2 <= m.end {
+						m.StatusFlags = uint16(s.data[off]) | uint16(s.data[off+1])<<8
+						m.MoreResults = m.StatusFlags&SERVER_MORE_RESULTS_EXISTS != 0
+					}
+					if m.Typ == 0x00 && off+4 <= m.end {
+						m.Warnings = uint16(s.data[off+2]) | uint16(s.data[off+3])<<8
+					}
 				} else if m.IsError {
 					// int<1>header (0xff)
 					// int<2>error code
@@ -280,7 +508,13 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 					// string<EOF> error message
 					m.ErrorCode = uint16(s.data[m.start+6])<<8 | uint16(s.data[m.start+5])
 
-					m.ErrorInfo = string(s.data[m.start+8:m.start+13]) + ": " + string(s.data[m.start+13:])
+					if m.end >= m.start+13 && s.data[m.start+7] == '#' {
+						m.SqlState = string(s.data[m.start+8 : m.start+13])
+						m.ErrorInfo = m.SqlState + ": " + string(s.data[m.start+13:m.end])
+					} else {
+						// no sql state before protocol 4.1
+						m.ErrorInfo = string(s.data[m.start+7 : m.end])
+					}
 				}
 				logp.Debug("mysqldetailed", "Message complete. remaining=%d", len(s.data[s.parseOffset:]))
 				return true, true
@@ -367,7 +601,12 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 
 				if uint8(s.data[s.parseOffset]) == 0xfe {
 					logp.Debug("mysqldetailed", "Received EOF packet")
-					// EOF marker
+					// EOF marker, int<2> warnings, int<2> status flags
+					if m.PacketLength >= 5 {
+						m.Warnings = uint16(s.data[s.parseOffset+1]) | uint16(s.data[s.parseOffset+2])<<8
+						m.StatusFlags = uint16(s.data[s.parseOffset+3]) | uint16(s.data[s.parseOffset+4])<<8
+						m.MoreResults = m.StatusFlags&SERVER_MORE_RESULTS_EXISTS != 0
+					}
 					s.parseOffset += int(m.PacketLength)
 
 					if m.end == 0 {
@@ -402,8 +641,52 @@ func mysqlMessageParser(s *MysqlStream) (bool, bool) {
 	return true, false
 }
 
+// Connection phases tracked to find out if the compressed protocol
+// was negotiated.
+const (
+	mysqlPhaseUnknown = iota
+	mysqlPhaseHandshake
+	mysqlPhaseAuth
+)
+
 type mysqlPrivateData struct {
 	Data [2]*MysqlStream
+
+	phase     int
+	serverDir uint8
+
+	// compressed protocol state. compressedData holds the bytes of
+	// the incomplete compressed packets for each direction, up to
+	// tcp.MaxDataInStream like the streams.
+	compressed     bool
+	compressedData [2][]byte
+
+	// set when the connection is encrypted, after the SSL request
+	Tls *protos.TlsUpgrade
+
+	// state of the file sent by the client after a LOCAL INFILE
+	// request: the bytes of the current packet left to skip, and the
+	// beginning of the next header when it is split
+	localInfile       bool
+	localInfileDir    uint8
+	localInfileSkip   int
+	localInfileHeader []byte
+
+	// query of each prepared statement id, and the query of the
+	// COM_STMT_PREPARE waiting for its response
+	statements   map[uint32]string
+	preparing    bool
+	prepareDir   uint8
+	prepareQuery string
+
+	// set while the response to a COM_STMT_EXECUTE is expected
+	executing  bool
+	executeDir uint8
+
+	// in the response capture direction, the transaction of the last
+	// request, kept with the connection instead of the transactions
+	// waiting for their response
+	pending *MysqlTransaction
 }
 
 func (mysql *Mysql) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
@@ -420,17 +703,63 @@ func (mysql *Mysql) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
 		}
 	}
 
+	if priv.Tls != nil {
+		if priv.Tls.Received(pkt, dir) {
+			mysql.publishTlsUpgrade(priv.Tls, tcptuple)
+		}
+		return priv
+	}
+	if (priv.Data[dir] == nil || len(priv.Data[dir].data) == 0) &&
+		protos.IsTlsClientHello(pkt.Payload) {
+
+		logp.Debug("mysql", "TLS ClientHello received, the connection is encrypted")
+		priv.Tls = protos.NewTlsUpgrade(pkt, dir)
+		priv.Data = [2]*MysqlStream{}
+		return priv
+	}
+
+	payload := pkt.Payload
+	if priv.compressed {
+		var err error
+		payload, err = priv.decompress(dir, pkt.Payload)
+		if err != nil {
+			logp.Debug("mysql", "Failed to decompress MySQL packet: %s", err)
+			priv.compressedData[dir] = nil
+			priv.Data[dir] = nil
+			return priv
+		}
+		if len(priv.compressedData[dir]) > tcp.MaxDataInStream {
+			logp.Debug("mysql", "Compressed data too large, dropping TCP stream")
+			protos.Stats.CountTooLarge(protos.MysqlProtocol)
+			priv.compressedData[dir] = nil
+			priv.Data[dir] = nil
+			return priv
+		}
+		if len(payload) == 0 {
+			// wait for the rest of the compressed packet
+			return priv
+		}
+	}
+
+	if priv.localInfile && dir == priv.localInfileDir {
+		payload = priv.skipLocalInfile(payload)
+		if len(payload) == 0 {
+			return priv
+		}
+	}
+
 	if priv.Data[dir] == nil {
 		priv.Data[dir] = &MysqlStream{
 			tcptuple: tcptuple,
-			data:     pkt.Payload,
-			message:  &MysqlMessage{Ts: pkt.Ts},
+			data:     payload,
+			message:  &MysqlMessage{Ts: pkt.Ts, Link: pkt.Link},
 		}
 	} else {
 		// concatenate bytes
-		priv.Data[dir].data = append(priv.Data[dir].data, pkt.Payload...)
-		if len(priv.Data[dir].data) > tcp.TCP_MAX_DATA_IN_STREAM {
+		priv.Data[dir].data = append(priv.Data[dir].data, payload...)
+		if len(priv.Data[dir].data) > tcp.MaxDataInStream {
 			logp.Debug("mysql", "Stream data too large, dropping TCP stream")
+			protos.Stats.CountTooLarge(protos.MysqlProtocol)
 			priv.Data[dir] = nil
 			return priv
 		}
@@ -439,8 +768,12 @@ func (mysql *Mysql) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
 	stream := priv.Data[dir]
 	for len(stream.data) > 0 {
 		if stream.message == nil {
-			stream.message = &MysqlMessage{Ts: pkt.Ts}
+			stream.message = &MysqlMessage{Ts: pkt.Ts, Link: pkt.Link}
 		}
+		stream.handshakeResponse = priv.phase == mysqlPhaseHandshake &&
+			dir != priv.serverDir
+		stream.stmtPrepareResponse = priv.preparing && dir != priv.prepareDir
+		stream.binaryRows = priv.executing && dir != priv.executeDir
 
 		ok, complete := mysqlMessageParser(priv.Data[dir])
 		if !ok {
@@ -448,6 +781,8 @@ func (mysql *Mysql) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
 			// segment in it
 			priv.Data[dir] = nil
 			logp.Debug("mysql", "Ignore MySQL message. Drop tcp stream. Try parsing with the next segment")
+			protos.ReportParseError(protos.MysqlProtocol, tcptuple, pkt,
+				"Invalid MySQL packet")
 			return priv
 		}
 
@@ -455,12 +790,31 @@ func (mysql *Mysql) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
 			// all ok, ship it
 			msg := stream.data[stream.message.start:stream.message.end]
 
+			priv.trackPhase(dir, stream.message)
+			priv.trackStatements(dir, stream.message)
+			if stream.message.IsLocalInfileRequest {
+				// the client sends the file next, in packets the
+				// parser would take for responses
+				priv.localInfile = true
+				priv.localInfileDir = 1 - dir
+			}
+
 			if !stream.message.IgnoreMessage {
+				priv.trackTransaction(mysql, stream.message)
 				mysql.handleMysql(mysql, stream.message, tcptuple, dir, msg)
 			}
 
 			// and reset message
 			stream.PrepareForNewMessage()
+
+			if protos.IsTlsClientHello(stream.data) {
+				// the client doesn't wait for an answer to the SSL
+				// request, the ClientHello can be in the same segment
+				logp.Debug("mysql", "TLS ClientHello received, the connection is encrypted")
+				priv.Tls = protos.NewTlsUpgrade(pkt, dir)
+				priv.Data = [2]*MysqlStream{}
+				return priv
+			}
 		} else {
 			// wait for more data
 			break
@@ -469,21 +823,279 @@ func (mysql *Mysql) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
 	return priv
 }
 
+// skipLocalInfile drops the packets of the file sent by the client after
+// a LOCAL INFILE request, without buffering them. The file ends with an
+// empty packet, the data following it is returned.
+func (priv *mysqlPrivateData) skipLocalInfile(data []byte) []byte {
+	for len(data) > 0 {
+		if priv.localInfileSkip > 0 {
+			n := priv.localInfileSkip
+			if n > len(data) {
+				n = len(data)
+			}
+			data = data[n:]
+			priv.localInfileSkip -= n
+			continue
+		}
+
+		if len(priv.localInfileHeader) > 0 {
+			data = append(priv.localInfileHeader, data...)
+			priv.localInfileHeader = nil
+		}
+		if len(data) < 4 {
+			priv.localInfileHeader = append([]byte{}, data...)
+			return nil
+		}
+
+		// int<3> payload length, int<1> sequence id
+		length := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		data = data[4:]
+		if length == 0 {
+			logp.Debug("mysqldetailed", "End of the LOCAL INFILE data")
+			priv.localInfile = false
+			return data
+		}
+		priv.localInfileSkip = length
+	}
+	return nil
+}
+
+// trackTransaction gives the message the transaction of the last request
+// of the connection, in the response capture direction. Only the time of
+// the request is kept, so the transaction doesn't wait for its response
+// in the transactions map and is dropped with the connection.
+func (priv *mysqlPrivateData) trackTransaction(mysql *Mysql, m *MysqlMessage) {
+	if mysql.captureDirection != protos.CaptureResponse || m.IsQuit || m.IsHandshake {
+		return
+	}
+	if m.IsRequest {
+		priv.pending = &MysqlTransaction{Type: "mysql"}
+	}
+	m.transaction = priv.pending
+}
+
+// trackStatements keeps the query of the prepared statements of the
+// connection by statement id, from the COM_STMT_PREPARE request and its
+// OK response, until the statement is freed by a COM_STMT_CLOSE. The
+// COM_STMT_EXECUTE requests get the query of their statement.
+func (priv *mysqlPrivateData) trackStatements(dir uint8, m *MysqlMessage) {
+	switch {
+	case m.IsStmtPrepare:
+		priv.preparing = true
+		priv.prepareDir = dir
+		priv.prepareQuery = m.Query
+	case priv.preparing && dir != priv.prepareDir:
+		// the first response ends the prepare, the statement is
+		// not created on an error
+		if m.IsStmtPrepareOK {
+			priv.addStatement(m.StatementId, priv.prepareQuery)
+		}
+		priv.preparing = false
+		priv.prepareQuery = ""
+	case m.IsStmtExecute:
+		m.Query = priv.statements[m.StatementId]
+		priv.executing = true
+		priv.executeDir = dir
+	case priv.executing && dir != priv.executeDir && !m.MoreResults:
+		// the result sets of a procedure call are followed by an OK
+		priv.executing = false
+	case m.IsStmtClose:
+		logp.Debug("mysqldetailed", "Statement %d closed", m.StatementId)
+		delete(priv.statements, m.StatementId)
+	}
+}
+
+// addStatement tracks a prepared statement. When MAX_PREPARED_STATEMENTS
+// are already tracked, the one with the lowest id is dropped: the server
+// allocates the ids in increasing order, it is the oldest.
+func (priv *mysqlPrivateData) addStatement(id uint32, query string) {
+	if priv.statements == nil {
+		priv.statements = map[uint32]string{}
+	}
+	if _, exists := priv.statements[id]; !exists &&
+		len(priv.statements) >= MAX_PREPARED_STATEMENTS {
+
+		oldest := ^uint32(0)
+		for tracked := range priv.statements {
+			if tracked < oldest {
+				oldest = tracked
+			}
+		}
+		logp.Debug("mysql", "Too many prepared statements, dropping statement %d", oldest)
+		delete(priv.statements, oldest)
+	}
+	priv.statements[id] = query
+}
+
+// Follows the connection phase messages to detect when the client and
+// the server start using the compressed protocol.
+func (priv *mysqlPrivateData) trackPhase(dir uint8, m *MysqlMessage) {
+
+	switch {
+	case m.IsHandshake:
+		priv.phase = mysqlPhaseHandshake
+		priv.serverDir = dir
+		priv.compressed = false
+
+	case priv.phase == mysqlPhaseHandshake && m.IsHandshakeResponse:
+		if m.ClientCapabilities&CLIENT_SSL != 0 {
+			// the SSL request, the TLS handshake follows and the
+			// client sends the handshake response again, encrypted
+			logp.Debug("mysql", "SSL requested by the client")
+			priv.phase = mysqlPhaseUnknown
+		} else if m.ClientCapabilities&CLIENT_COMPRESS != 0 {
+			priv.phase = mysqlPhaseAuth
+		} else {
+			priv.phase = mysqlPhaseUnknown
+		}
+
+	case priv.phase == mysqlPhaseAuth && dir == priv.serverDir:
+		if m.IsOK && m.Typ == 0x00 {
+			// compression starts after the authentication OK
+			logp.Debug("mysql", "Compressed protocol enabled")
+			priv.compressed = true
+			priv.phase = mysqlPhaseUnknown
+		} else if m.IsError {
+			priv.phase = mysqlPhaseUnknown
+		}
+	}
+}
+
+// Strips the compressed protocol framing from the data received in
+// the given direction. It returns the uncompressed bytes of all the
+// complete compressed packets, and keeps the rest for the next call.
+func (priv *mysqlPrivateData) decompress(dir uint8, data []byte) ([]byte, error) {
+
+	buf := append(priv.compressedData[dir], data...)
+
+	var out []byte
+	for len(buf) >= MYSQL_COMPRESSED_HEADER_SIZE {
+		// int<3> compressed payload length
+		// int<1> compressed sequence id
+		// int<3> payload length before compression
+		length := int(buf[0]) | int(buf[1])<<8 | int(buf[2])<<16
+		uncompressedLength := int(buf[4]) | int(buf[5])<<8 | int(buf[6])<<16
+
+		if len(buf) < MYSQL_COMPRESSED_HEADER_SIZE+length {
+			break
+		}
+		payload := buf[MYSQL_COMPRESSED_HEADER_SIZE : MYSQL_COMPRESSED_HEADER_SIZE+length]
+		buf = buf[MYSQL_COMPRESSED_HEADER_SIZE+length:]
+
+		if uncompressedLength == 0 {
+			// sent as is, the payload was too small to compress
+			out = append(out, payload...)
+			continue
+		}
+
+		r, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		// no more than the announced length is inflated
+		inflated, err := ioutil.ReadAll(io.LimitReader(r, int64(uncompressedLength)+1))
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(inflated) != uncompressedLength {
+			return nil, fmt.Errorf("Uncompressed length is %d, expected %d",
+				len(inflated), uncompressedLength)
+		}
+		out = append(out, inflated...)
+	}
+
+	// copy the leftover, the input buffer belongs to the packet
+	priv.compressedData[dir] = append([]byte(nil), buf...)
+
+	return out, nil
+}
+
+// Called when there's a drop packet
 func (mysql *Mysql) GapInStream(tcptuple *common.TcpTuple, dir uint8,
 	private protos.ProtocolData) protos.ProtocolData {
 
-	// TODO
+	defer logp.Recover("GapInMysqlStream exception")
 
-	return private
+	if private == nil {
+		return private
+	}
+	mysqlData, ok := private.(mysqlPrivateData)
+	if !ok {
+		return private
+	}
+	// the compressed framing is lost as well
+	mysqlData.compressedData[dir] = nil
+
+	stream := mysqlData.Data[dir]
+	if stream == nil || stream.message == nil {
+		return mysqlData
+	}
+
+	// If the response was already partially parsed, send what we
+	// have to the next layer but mark it as truncated.
+	m := stream.message
+	if !m.IsRequest && !m.IgnoreMessage && stream.parseState != MysqlStateStart &&
+		stream.parseOffset > m.start {
+
+		logp.Debug("mysql", "Gap in the middle of a response, sending what we have")
+		m.IsTruncated = true
+		if m.end == 0 {
+			m.end = stream.parseOffset
+		}
+		m.Size = uint64(stream.parseOffset - m.start)
+		m.Notes = append(m.Notes, "Packet loss while capturing the response")
+
+		msg := stream.data[m.start:m.end]
+		mysqlData.trackTransaction(mysql, m)
+		mysql.handleMysql(mysql, m, tcptuple, dir, msg)
+	}
+
+	// drop the data in this direction, parsing will resume with
+	// the next segment
+	mysqlData.Data[dir] = nil
+	return mysqlData
 }
 
 func (mysql *Mysql) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 	private protos.ProtocolData) protos.ProtocolData {
 
-	// TODO
+	priv, ok := private.(mysqlPrivateData)
+	if ok && priv.Tls != nil && !priv.Tls.Published {
+		// closed before the ServerHello
+		mysql.publishTlsUpgrade(priv.Tls, tcptuple)
+	}
+
+	// No response will come for a request that is still waiting in
+	// the map, so publish it now instead of waiting for the timeout.
+	trans := mysql.transactionsMap[tcptuple.Hashable()]
+	if trans == nil || trans.Mysql == nil {
+		return private
+	}
+
+	logp.Debug("mysql", "Connection closed before the response, publishing the request")
+
+	if trans.timer != nil {
+		trans.timer.Stop()
+	}
+	mysql.removeTransaction(trans)
+
+	trans.Status = protos.CONNECTION_CLOSED_STATUS
+	mysql.publishMysqlTransaction(trans)
+
 	return private
 }
 
+// publishTlsUpgrade publishes the event of an encrypted connection, which
+// is not parsed.
+func (mysql *Mysql) publishTlsUpgrade(t *protos.TlsUpgrade, tcptuple *common.TcpTuple) {
+	cmdline := procs.ProcWatcher.FindProcessesTuple(tcptuple.IpPort())
+	event := t.Event("mysql", tcptuple, cmdline, t.ClientDir == tcp.TcpDirectionReverse)
+	if mysql.results != nil {
+		mysql.results <- event
+	}
+}
+
 func handleMysql(mysql *Mysql, m *MysqlMessage, tcptuple *common.TcpTuple,
 	dir uint8, raw_msg []byte) {
 
@@ -492,9 +1104,11 @@ func handleMysql(mysql *Mysql, m *MysqlMessage, tcptuple *common.TcpTuple,
 	m.CmdlineTuple = procs.ProcWatcher.FindProcessesTuple(tcptuple.IpPort())
 	m.Raw = raw_msg
 
-	if m.IsRequest {
+	if m.IsQuit || m.IsHandshake {
+		mysql.publishMysqlConnectionEvent(m)
+	} else if m.IsRequest {
 		mysql.receivedMysqlRequest(m)
-	} else {
+	} else if mysql.captureDirection != protos.CaptureRequest {
 		mysql.receivedMysqlResponse(m)
 	}
 }
@@ -504,19 +1118,34 @@ func (mysql *Mysql) receivedMysqlRequest(msg *MysqlMessage) {
 	// Add it to the HT
 	tuple := msg.TcpTuple
 
-	trans := mysql.transactionsMap[tuple.Hashable()]
-	if trans != nil {
-		if trans.Mysql != nil {
-			logp.Debug("mysql", "Two requests without a Response. Dropping old request: %s", trans.Mysql)
-		}
-	} else {
+	var trans *MysqlTransaction
+	switch mysql.captureDirection {
+	case protos.CaptureRequest:
+		// published right away, the responses are not waited for
 		trans = &MysqlTransaction{Type: "mysql", tuple: tuple}
-		mysql.transactionsMap[tuple.Hashable()] = trans
+	case protos.CaptureResponse:
+		// kept with the connection, not in the transactions map
+		trans = msg.transaction
+		if trans == nil {
+			return
+		}
+		trans.tuple = tuple
+	default:
+		trans = mysql.transactionsMap[tuple.Hashable()]
+		if trans != nil {
+			if trans.Mysql != nil {
+				logp.Debug("mysql", "Two requests without a Response. Dropping old request: %s", trans.Mysql)
+			}
+		} else {
+			trans = &MysqlTransaction{Type: "mysql", tuple: tuple}
+			mysql.transactionsMap[tuple.Hashable()] = trans
+		}
 	}
 
 	trans.ts = msg.Ts
 	trans.Ts = int64(trans.ts.UnixNano() / 1000) // transactions have microseconds resolution
 	trans.JsTs = msg.Ts
+	trans.link = msg.Link
 	trans.Src = common.Endpoint{
 		Ip:   msg.TcpTuple.Src_ip.String(),
 		Port: msg.TcpTuple.Src_port,
@@ -531,34 +1160,116 @@ func (mysql *Mysql) receivedMysqlRequest(msg *MysqlMessage) {
 		trans.Src, trans.Dst = trans.Dst, trans.Src
 	}
 
+	trans.Mysql = common.MapStr{}
+	trans.IsRequestTruncated = false
+	trans.Query = ""
+	trans.Method = ""
+	trans.Request_raw = ""
+	if mysql.captureDirection != protos.CaptureResponse {
+		mysql.setQuery(trans, msg.Query)
+	}
+
+	trans.results = nil
+	trans.Size = 0
+	trans.Path = ""
+	trans.Response_raw = ""
+
+	if mysql.captureDirection != protos.CaptureBoth {
+		if mysql.captureDirection == protos.CaptureRequest {
+			mysql.publishMysqlTransaction(trans)
+		}
+		return
+	}
+
+	if trans.timer != nil {
+		trans.timer.Stop()
+	}
+	trans.timer = mysql.afterFunc(mysql.transactionTimeout, func() { mysql.expireTransaction(trans) })
+
+	mysql.transactionsOrder.Add(trans)
+	mysql.evictTransactions()
+}
+
+// setQuery sets the query of the transaction and its method.
+func (mysql *Mysql) setQuery(trans *MysqlTransaction, query string) {
 	// Extract the method, by simply taking the first word and
-	// making it upper case.
-	query := strings.Trim(msg.Query, " \n\t")
-	index := strings.IndexAny(query, " \n\t")
+	// making it upper case. The comments before it are skipped.
+	query = strings.Trim(query, " \n\t")
+	comments, statement := extractComments(query)
+	index := strings.IndexAny(statement, " \n\t")
 	var method string
 	if index > 0 {
-		method = strings.ToUpper(query[:index])
+		method = strings.ToUpper(statement[:index])
 	} else {
-		method = strings.ToUpper(query)
+		method = strings.ToUpper(statement)
+	}
+
+	// the free text comments can hold values, they are not stored when
+	// the queries are redacted
+	addComments(trans.Mysql, comments, !(mysql.normalizeQueries && mysql.redactQueries))
+	if mysql.normalizeQueries {
+		normalized := normalizeQuery(query)
+		trans.Mysql["query_normalized"] = normalized
+		if mysql.redactQueries {
+			// the values are not stored
+			query = normalized
+		}
+	}
+
+	if mysql.maxQueryLength > 0 && len(query) > mysql.maxQueryLength {
+		query = truncateQuery(query, mysql.maxQueryLength)
+		trans.IsRequestTruncated = true
 	}
 
 	trans.Query = query
 	trans.Method = method
 
-	trans.Mysql = common.MapStr{}
-
 	// save Raw message
-	trans.Request_raw = msg.Query
+	trans.Request_raw = query
+}
 
-	if trans.timer != nil {
-		trans.timer.Stop()
+// truncateQuery cuts the query to at most max bytes, without splitting a
+// UTF-8 sequence, so that the published query stays a valid string.
+func truncateQuery(query string, max int) string {
+	end := max
+	for end > 0 && end > max-utf8.UTFMax && !utf8.RuneStart(query[end]) {
+		end--
+	}
+	if !utf8.RuneStart(query[end]) {
+		// not UTF-8, cut at the byte
+		end = max
+	}
+	return query[:end]
+}
+
+// evictTransactions publishes the oldest requests, without their
+// response, while more than maxTransactions are waiting.
+func (mysql *Mysql) evictTransactions() {
+	for mysql.maxTransactions > 0 && mysql.transactionsOrder.Len() > mysql.maxTransactions {
+		trans, ok := mysql.transactionsOrder.Oldest().(*MysqlTransaction)
+		if !ok {
+			break
+		}
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		mysql.removeTransaction(trans)
+
+		if trans.Mysql == nil {
+			continue
+		}
+		trans.Status = protos.OVERFLOW_STATUS
+		trans.Notes = append(trans.Notes, protos.OverflowNote)
+		mysql.publishMysqlTransaction(trans)
 	}
-	trans.timer = time.AfterFunc(TransactionTimeout, func() { mysql.expireTransaction(trans) })
 }
 
 func (mysql *Mysql) receivedMysqlResponse(msg *MysqlMessage) {
 	tuple := msg.TcpTuple
 	trans := mysql.transactionsMap[tuple.Hashable()]
+	if mysql.captureDirection == protos.CaptureResponse {
+		trans = msg.transaction
+	}
 	if trans == nil {
 		logp.Warn("Response from unknown transaction. Ignoring.")
 		return
@@ -569,47 +1280,209 @@ func (mysql *Mysql) receivedMysqlResponse(msg *MysqlMessage) {
 		return
 
 	}
-	// save json details
-	trans.Mysql.Update(common.MapStr{
+	if msg.IsLocalInfileRequest {
+		// the result follows the file sent by the client
+		trans.Mysql["local_infile"] = true
+		return
+	}
+
+	trans.results = append(trans.results, common.MapStr{
 		"affected_rows": msg.AffectedRows,
 		"insert_id":     msg.InsertId,
 		"num_rows":      msg.NumberOfRows,
 		"num_fields":    msg.NumberOfFields,
-		"iserror":       msg.IsError,
-		"error_code":    msg.ErrorCode,
-		"error_message": msg.ErrorInfo,
+		"warning_count": msg.Warnings,
 	})
-	trans.Size = msg.Size
-	trans.Path = msg.Tables
-
-	trans.ResponseTime = int32(msg.Ts.Sub(trans.ts).Nanoseconds() / 1e6) // resp_time in milliseconds
+	trans.Size += msg.Size
+	trans.Path = mergeTables(trans.Path, msg.Tables)
+	trans.Notes = append(trans.Notes, msg.Notes...)
 
 	// save Raw message
 	if len(msg.Raw) > 0 {
-		fields, rows := mysql.parseMysqlResponse(msg.Raw)
+		fields, rows := mysql.parseMysqlResponse(msg.Raw, msg.IsBinary)
+
+		if len(trans.Response_raw) > 0 {
+			trans.Response_raw += "\n"
+		}
+		trans.Response_raw += common.DumpInCSVFormat(fields, rows)
+
+		if mysql.rowsSample > 0 && len(rows) > 0 && trans.Mysql["rows_sample"] == nil {
+			trans.Mysql["rows_sample"] = mysql.sampleRows(fields, rows)
+		}
+	}
 
-		trans.Response_raw = common.DumpInCSVFormat(fields, rows)
+	if msg.MoreResults && !msg.IsError {
+		// the response to a query with several statements, wait for
+		// the result of the next one
+		logp.Debug("mysql", "More results follow")
+		return
+	}
+
+	// save json details, the rows and fields are counted over all the
+	// statements
+	var affectedRows uint64
+	var numRows, numFields, warnings int
+	for _, result := range trans.results {
+		affectedRows += result["affected_rows"].(uint64)
+		numRows += result["num_rows"].(int)
+		numFields += result["num_fields"].(int)
+		warnings += int(result["warning_count"].(uint16))
+	}
+	trans.Mysql.Update(common.MapStr{
+		"affected_rows": affectedRows,
+		"insert_id":     msg.InsertId,
+		"num_rows":      numRows,
+		"num_fields":    numFields,
+		"warning_count": warnings,
+		"has_warnings":  warnings > 0,
+		"iserror":       msg.IsError,
+		"error_code":    msg.ErrorCode,
+		"error_message": msg.ErrorInfo,
+	})
+	if len(trans.results) > 1 {
+		trans.Mysql["results"] = trans.results
+	}
+	if msg.IsError {
+		trans.Mysql["sql_state"] = msg.SqlState
+		trans.Mysql["error_class"] = mysqlErrorClass(msg.ErrorCode, msg.SqlState)
 	}
 
+	trans.ResponseTime = int32(msg.Ts.Sub(trans.ts).Nanoseconds() / 1e6) // resp_time in milliseconds
+
 	mysql.publishMysqlTransaction(trans)
 
 	logp.Debug("mysql", "Mysql transaction completed: %s", trans.Mysql)
 	logp.Debug("mysql", "%s", trans.Response_raw)
 
+	if mysql.captureDirection == protos.CaptureResponse {
+		// the next responses of the connection are ignored until
+		// its next request
+		trans.Mysql = nil
+		return
+	}
+
 	// remove from map
-	delete(mysql.transactionsMap, trans.tuple.Hashable())
+	mysql.removeTransaction(trans)
+	if trans.timer != nil {
+		trans.timer.Stop()
+	}
+}
+
+// mergeTables adds the tables of a result set to the comma separated
+// list of the tables of the transaction.
+func mergeTables(tables string, more string) string {
+	for _, table := range strings.Split(more, ", ") {
+		if len(table) == 0 {
+			continue
+		}
+		if len(tables) == 0 {
+			tables = table
+		} else if !strings.Contains(tables, table) {
+			tables += ", " + table
+		}
+	}
+	return tables
+}
+
+// Coarse classes for the well known error codes
+var mysqlErrorClasses = map[uint16]string{
+	1040: "too_many_connections",
+	1044: "access_denied",
+	1045: "access_denied",
+	1049: "no_such_database",
+	1054: "no_such_column",
+	1062: "duplicate_key",
+	1064: "syntax",
+	1142: "access_denied",
+	1143: "access_denied",
+	1146: "no_such_table",
+	1205: "lock_timeout",
+	1213: "deadlock",
+	1227: "access_denied",
+	1451: "foreign_key",
+	1452: "foreign_key",
+}
+
+// Coarse classes for the errors without a well known code, by the
+// first two characters of the SQL state.
+var mysqlSqlStateClasses = map[string]string{
+	"08": "connection",
+	"23": "integrity_constraint",
+	"28": "access_denied",
+	"40": "transaction_rollback",
+	"42": "syntax",
+}
+
+// Returns a coarse error class, useful for filtering, from the error
+// code or the SQL state of an ERR packet.
+func mysqlErrorClass(code uint16, sqlState string) string {
+	if class, exists := mysqlErrorClasses[code]; exists {
+		return class
+	}
+	if len(sqlState) >= 2 {
+		if class, exists := mysqlSqlStateClasses[sqlState[:2]]; exists {
+			return class
+		}
+	}
+	return "other"
+}
+
+// Flush publishes the requests still waiting for their response.
+func (mysql *Mysql) Flush() {
+	for key, trans := range mysql.transactionsMap {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		delete(mysql.transactionsMap, key)
+		mysql.transactionsOrder.Remove(trans)
+
+		if trans.Mysql == nil {
+			continue
+		}
+		trans.Status = protos.SHUTDOWN_STATUS
+		mysql.publishMysqlTransaction(trans)
+	}
+}
+
+// FlushStream publishes the request of the idle stream still waiting
+// for its response.
+func (mysql *Mysql) FlushStream(tcptuple *common.TcpTuple, private protos.ProtocolData) {
+	trans := mysql.transactionsMap[tcptuple.Hashable()]
+	if trans == nil || trans.Mysql == nil {
+		return
+	}
+
 	if trans.timer != nil {
 		trans.timer.Stop()
 	}
+	mysql.removeTransaction(trans)
+
+	trans.Status = protos.EXPIRED_STATUS
+	mysql.publishMysqlTransaction(trans)
+}
+
+// TransactionsInFlight returns the number of requests waiting for their
+// response.
+func (mysql *Mysql) TransactionsInFlight() int {
+	return len(mysql.transactionsMap)
 }
 
 func (mysql *Mysql) expireTransaction(trans *MysqlTransaction) {
 	// TODO: Here we need to PUBLISH an incomplete/timeout transaction
 	// remove from map
+	mysql.removeTransaction(trans)
+}
+
+func (mysql *Mysql) removeTransaction(trans *MysqlTransaction) {
 	delete(mysql.transactionsMap, trans.tuple.Hashable())
+	mysql.transactionsOrder.Remove(trans)
 }
 
-func (mysql *Mysql) parseMysqlResponse(data []byte) ([]string, [][]string) {
+// parseMysqlResponse returns the names of the fields and the rows of a
+// result set. The rows are in the binary protocol for the result sets of
+// the prepared statements, and are then decoded using the types of the
+// columns.
+func (mysql *Mysql) parseMysqlResponse(data []byte, binary bool) ([]string, [][]string) {
 
 	length := read_length(data, 0)
 	if length < 1 {
@@ -619,6 +1492,7 @@ func (mysql *Mysql) parseMysqlResponse(data []byte) ([]string, [][]string) {
 
 	fields := []string{}
 	rows := [][]string{}
+	columns := []mysqlColumn{}
 
 	if uint8(data[4]) == 0x00 {
 		// OK response
@@ -629,6 +1503,10 @@ func (mysql *Mysql) parseMysqlResponse(data []byte) ([]string, [][]string) {
 
 		// Read fields
 		for {
+			if len(data[offset:]) < 5 {
+				logp.Debug("mysql", "Response truncated while reading fields")
+				return fields, rows
+			}
 			length = read_length(data, offset)
 
 			if uint8(data[offset+4]) == 0xfe {
@@ -668,7 +1546,16 @@ func (mysql *Mysql) parseMysqlResponse(data []byte) ([]string, [][]string) {
 				return fields, rows
 			}
 
+			// int<lenenc> 0x0c, int<2> character set, int<4> column
+			// length, int<1> type, int<2> flags
+			var column mysqlColumn
+			if off+10 <= len(data) {
+				column.typ = data[off+7]
+				column.flags = uint16(data[off+8]) | uint16(data[off+9])<<8
+			}
+
 			fields = append(fields, string(name))
+			columns = append(columns, column)
 
 			offset += length + 4
 		}
@@ -678,6 +1565,10 @@ func (mysql *Mysql) parseMysqlResponse(data []byte) ([]string, [][]string) {
 			var row []string
 			var row_len int
 
+			if len(data[offset:]) < 5 {
+				logp.Debug("mysql", "Response truncated while reading rows")
+				break
+			}
 			if uint8(data[offset+4]) == 0xfe {
 				// EOF
 				offset += length + 4
@@ -685,30 +1576,30 @@ func (mysql *Mysql) parseMysqlResponse(data []byte) ([]string, [][]string) {
 			}
 
 			length = read_length(data, offset)
+			if offset+4+length > len(data) {
+				logp.Debug("mysql", "Response truncated while reading rows")
+				break
+			}
 			off := offset + 4 // skip length + packet number
-			start := off
-			for off < start+length {
-				var text []byte
-
-				if uint8(data[off]) == 0xfb {
-					text = []byte("NULL")
-					off++
-				} else {
-					var err error
-					var complete bool
-					text, off, complete, err = read_lstring(data, off)
-					if err != nil {
-						logp.Debug("mysql", "Error parsing rows: %s %b", err, complete)
-						// nevertheless, return what we have so far
-						return fields, rows
-					}
-				}
 
+			var values []string
+			var err error
+			if binary {
+				values, err = decodeBinaryRow(data[off:off+length], columns)
+			} else {
+				values, err = readTextRow(data, off, off+length)
+			}
+			if err != nil {
+				logp.Debug("mysql", "Error parsing rows: %s", err)
+				// nevertheless, return what we have so far
+				return fields, rows
+			}
+			for _, text := range values {
 				if row_len < mysql.maxRowLength {
 					if row_len+len(text) > mysql.maxRowLength {
 						text = text[:mysql.maxRowLength-row_len]
 					}
-					row = append(row, string(text))
+					row = append(row, text)
 					row_len += len(text)
 				}
 			}
@@ -724,6 +1615,49 @@ func (mysql *Mysql) parseMysqlResponse(data []byte) ([]string, [][]string) {
 	return fields, rows
 }
 
+// readTextRow reads the values of a row of the text protocol, between
+// start and end: length encoded strings, or 0xfb for the NULL values.
+func readTextRow(data []byte, start int, end int) ([]string, error) {
+	var values []string
+	for off := start; off < end; {
+		if uint8(data[off]) == 0xfb {
+			values = append(values, "NULL")
+			off++
+			continue
+		}
+		text, next, complete, err := read_lstring(data, off)
+		if err != nil {
+			return values, err
+		}
+		if !complete {
+			return values, errors.New("row truncated")
+		}
+		values = append(values, string(text))
+		off = next
+	}
+	return values, nil
+}
+
+// sampleRows returns the first rowsSample rows, as objects having the
+// names of the fields as keys. The cells are truncated like in the CSV, the
+// ones past maxRowLength are left out.
+func (mysql *Mysql) sampleRows(fields []string, rows [][]string) []common.MapStr {
+	sample := []common.MapStr{}
+	for _, row := range rows {
+		if len(sample) >= mysql.rowsSample {
+			break
+		}
+		object := common.MapStr{}
+		for i, cell := range row {
+			if i < len(fields) {
+				object[fields[i]] = cell
+			}
+		}
+		sample = append(sample, object)
+	}
+	return sample
+}
+
 func (mysql *Mysql) publishMysqlTransaction(t *MysqlTransaction) {
 
 	if mysql.results == nil {
@@ -735,28 +1669,101 @@ func (mysql *Mysql) publishMysqlTransaction(t *MysqlTransaction) {
 	event := common.MapStr{}
 	event["type"] = "mysql"
 
-	if t.Mysql["iserror"].(bool) {
+	if len(t.Status) > 0 {
+		event["status"] = t.Status
+	} else if iserror, _ := t.Mysql["iserror"].(bool); iserror {
 		event["status"] = common.ERROR_STATUS
 	} else {
 		event["status"] = common.OK_STATUS
 	}
 
-	event["responsetime"] = t.ResponseTime
-	if mysql.Send_request {
-		event["request"] = t.Request_raw
+	if mysql.captureDirection != protos.CaptureRequest {
+		event["responsetime"] = t.ResponseTime
+		event["bytes_out"] = t.Size
+		if mysql.Send_response {
+			event["response"] = t.Response_raw
+		}
 	}
-	if mysql.Send_response {
-		event["response"] = t.Response_raw
+	if mysql.captureDirection != protos.CaptureResponse {
+		if mysql.Send_request {
+			event["request"] = t.Request_raw
+		}
+		event["method"] = t.Method
+		event["query"] = t.Query
 	}
-	event["method"] = t.Method
-	event["query"] = t.Query
 	event["mysql"] = t.Mysql
 	event["path"] = t.Path
-	event["bytes_out"] = t.Size
+
+	if t.IsRequestTruncated {
+		event["is_request_truncated"] = true
+	}
+
+	if len(t.Notes) > 0 {
+		event["notes"] = t.Notes
+	}
 
 	event["timestamp"] = common.Time(t.ts)
 	event["src"] = &t.Src
 	event["dst"] = &t.Dst
+	t.link.AddFields(event)
+
+	if mysql.splitRequestResponse {
+		// the transactions published without their response have a
+		// status
+		for _, part := range protos.SplitTransaction(event, true, len(t.Status) == 0) {
+			mysql.results <- part
+		}
+		return
+	}
+
+	mysql.results <- event
+}
+
+// Publishes the connection lifecycle messages (the server handshake and
+// COM_QUIT), which don't have a request/response pair.
+func (mysql *Mysql) publishMysqlConnectionEvent(msg *MysqlMessage) {
+
+	if mysql.results == nil {
+		return
+	}
+
+	src := common.Endpoint{
+		Ip:   msg.TcpTuple.Src_ip.String(),
+		Port: msg.TcpTuple.Src_port,
+		Proc: string(msg.CmdlineTuple.Src),
+	}
+	dst := common.Endpoint{
+		Ip:   msg.TcpTuple.Dst_ip.String(),
+		Port: msg.TcpTuple.Dst_port,
+		Proc: string(msg.CmdlineTuple.Dst),
+	}
+
+	details := common.MapStr{}
+	if msg.IsHandshake {
+		details["command"] = "HANDSHAKE"
+		details["server_version"] = msg.ServerVersion
+
+		// the handshake is sent by the server, keep the client as source
+		if msg.Direction == tcp.TcpDirectionOriginal {
+			src, dst = dst, src
+		}
+	} else {
+		details["command"] = "QUIT"
+
+		if msg.Direction == tcp.TcpDirectionReverse {
+			src, dst = dst, src
+		}
+	}
+
+	event := common.MapStr{}
+	event["type"] = "mysql"
+	event["status"] = common.OK_STATUS
+	event["method"] = details["command"]
+	event["mysql"] = details
+	event["timestamp"] = common.Time(msg.Ts)
+	event["src"] = &src
+	event["dst"] = &dst
+	msg.Link.AddFields(event)
 
 	mysql.results <- event
 }
@@ -1,13 +1,21 @@
 package mysql
 
 import (
+	"bytes"
+	"compress/zlib"
 	"encoding/hex"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/johann8384/libbeat/common"
 	"github.com/johann8384/libbeat/logp"
 
+	"github.com/johann8384/packetbeat/config"
 	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/protostest"
+	"github.com/johann8384/packetbeat/protos/tcp"
 
 	"time"
 )
@@ -111,6 +119,9 @@ func TestMySQLParser_errorResponse(t *testing.T) {
 	if stream.message.IsOK {
 		t.Errorf("Failed to parse MySQL error esponse")
 	}
+	if stream.message.SqlState != "42S02" {
+		t.Errorf("Failed to parse the SQL state: %s", stream.message.SqlState)
+	}
 
 }
 
@@ -176,7 +187,7 @@ func TestMySQLParser_dataResponse(t *testing.T) {
 	if len(raw) == 0 {
 		t.Errorf("Empty raw data")
 	}
-	fields, rows := mysql.parseMysqlResponse(raw)
+	fields, rows := mysql.parseMysqlResponse(raw, false)
 	if len(fields) != stream.message.NumberOfFields {
 		t.Errorf("Failed to parse the fields")
 	}
@@ -185,6 +196,99 @@ func TestMySQLParser_dataResponse(t *testing.T) {
 	}
 }
 
+func TestParseMySQL_rowsSample(t *testing.T) {
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+	mysql.rowsSample = 2
+	mysql.maxRowLength = 14
+
+	query := "SELECT * FROM post"
+	req := append([]byte{byte(len(query) + 1), 0, 0, 0, MYSQL_CMD_QUERY}, query...)
+	resp, err := hex.DecodeString("0100000105" +
+		"2f00000203646566086d696e697477697404706f737404706f737407706f73745f69640269640c3f000b000000030342000000" +
+		"3b00000303646566086d696e697477697404706f737404706f73740d706f73745f757365726e616d6508757365726e616d650c2100f0000000fd0000000000" +
+		"3500000403646566086d696e697477697404706f737404706f73740a706f73745f7469746c65057469746c650c2100f0000000fd0000000000" +
+		"3300000503646566086d696e697477697404706f737404706f737409706f73745f626f647904626f64790c2100fdff0200fc1000000000" +
+		"3b00000603646566086d696e697477697404706f737404706f73740d706f73745f7075625f64617465087075625f646174650c3f00130000000c8000000000" +
+		"05000007fe00002100" +
+		"2e000008013109416e6f6e796d6f75730474657374086461736461730d0a13323031332d30372d32322031373a33343a3032" +
+		"46000009013209416e6f6e796d6f757312506f737465617a6120544f444f206c6973741270656e7472752063756d706172617475726913323031332d30372d32322031383a32393a3330" +
+		"2a00000a013309416e6f6e796d6f75730454657374047465737413323031332d30372d32322031383a33323a3130" +
+		"0500000bfe00002100")
+	if err != nil {
+		t.Errorf("Failed to decode hex string")
+	}
+
+	tuple := common.TcpTuple{Src_port: 3306}
+	tuple.ComputeHashebles()
+	var private protos.ProtocolData
+	private = mysql.Parse(&protos.Packet{Payload: req, Ts: time.Now()}, &tuple,
+		tcp.TcpDirectionOriginal, private)
+	mysql.Parse(&protos.Packet{Payload: resp, Ts: time.Now()}, &tuple,
+		tcp.TcpDirectionReverse, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mysql.results))
+	}
+	event := <-mysql.results
+
+	// the cells past the 14 bytes of a row are left out
+	expected := []common.MapStr{
+		{"post_id": "1", "post_username": "Anonymous", "post_title": "test"},
+		{"post_id": "2", "post_username": "Anonymous", "post_title": "Post"},
+	}
+	sample := event["mysql"].(common.MapStr)["rows_sample"]
+	if !reflect.DeepEqual(sample, expected) {
+		t.Errorf("Wrong sample of the rows: %v", sample)
+	}
+}
+
+func TestParseMySQL_localInfile(t *testing.T) {
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	query := "LOAD DATA LOCAL INFILE '/tmp/users.csv' INTO TABLE users"
+	req := append([]byte{byte(len(query) + 1), 0, 0, 0, MYSQL_CMD_QUERY}, query...)
+	file := "/tmp/users.csv"
+	infileRequest := append([]byte{byte(len(file) + 1), 0, 0, 1, 0xfb}, file...)
+	// the content would be taken for an OK and an ERR packet, it is split
+	// in the middle of the packet and of the header of the empty packet
+	content := "\x00,alice\n\xff,bob\n"
+	data := append([]byte{byte(len(content)), 0, 0, 2}, content...)
+	data = append(data, 0, 0, 0, 3)
+	ok := []byte{7, 0, 0, 4, 0, 2, 0, 2, 0, 0, 0}
+
+	tuple := common.TcpTuple{Src_port: 3306}
+	tuple.ComputeHashebles()
+	var private protos.ProtocolData
+	client := uint8(tcp.TcpDirectionOriginal)
+	server := uint8(tcp.TcpDirectionReverse)
+	private = mysql.Parse(&protos.Packet{Payload: req, Ts: time.Now()}, &tuple, client, private)
+	private = mysql.Parse(&protos.Packet{Payload: infileRequest, Ts: time.Now()}, &tuple, server, private)
+	private = mysql.Parse(&protos.Packet{Payload: data[:10], Ts: time.Now()}, &tuple, client, private)
+	private = mysql.Parse(&protos.Packet{Payload: data[10 : len(data)-2], Ts: time.Now()}, &tuple, client, private)
+	private = mysql.Parse(&protos.Packet{Payload: data[len(data)-2:], Ts: time.Now()}, &tuple, client, private)
+	if len(mysql.results) != 0 {
+		t.Fatalf("Expected the transaction to wait for the result")
+	}
+	mysql.Parse(&protos.Packet{Payload: ok, Ts: time.Now()}, &tuple, server, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mysql.results))
+	}
+	event := <-mysql.results
+	details := event["mysql"].(common.MapStr)
+	if details["local_infile"] != true {
+		t.Errorf("Expected the local_infile marker, got %v", details)
+	}
+	if details["affected_rows"] != uint64(2) || details["iserror"] != false {
+		t.Errorf("Wrong result: %v", details)
+	}
+	if event["status"] != common.OK_STATUS {
+		t.Errorf("Wrong status: %v", event["status"])
+	}
+}
+
 func TestMySQLParser_simpleUpdateResponse(t *testing.T) {
 	if testing.Verbose() {
 		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mysqldetailed"})
@@ -426,3 +530,1113 @@ func TestParseMySQL_splitResponse(t *testing.T) {
 		t.Errorf("handleMysql not called on the second run")
 	}
 }
+
+// Test that a gap in the middle of a result set publishes the partial
+// transaction and that parsing resumes with the next request.
+func TestParseMySQL_gapInResponse(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mysql", "mysqldetailed"})
+	}
+
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	ts, err := time.Parse(time.RFC3339, "2000-12-26T01:15:06+04:20")
+	if err != nil {
+		t.Errorf("Failed to get ts")
+	}
+	var tuple common.TcpTuple
+	var private protos.ProtocolData
+
+	// SELECT * FROM post
+	data, err := hex.DecodeString("130000000353454c454354202a2046524f4d20706f7374")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: ts}, &tuple, 0, private)
+
+	// first part of the result set, the rest is lost
+	data, err = hex.DecodeString(
+		"0100000105" +
+			"2f00000203646566086d696e697477697404706f737404706f737407706f73745f69640269640c3f000b000000030342000000" +
+			"3b00000303646566086d696e697477697404706f737404706f73740d706f73745f757365726e616d6508757365726e616d650c2100f0000000fd0000000000")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: ts}, &tuple, 1, private)
+	if len(mysql.results) != 0 {
+		t.Errorf("Transaction published before the response was complete")
+	}
+
+	private = mysql.GapInStream(&tuple, 1, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected the partial transaction to be published")
+	}
+	event := <-mysql.results
+	if event["query"] != "SELECT * FROM post" {
+		t.Errorf("Wrong query in the partial transaction: %s", event["query"])
+	}
+	notes, ok := event["notes"].([]string)
+	if !ok || len(notes) != 1 {
+		t.Errorf("Expected a note about the gap, got: %v", event["notes"])
+	}
+	if len(mysql.transactionsMap) != 0 {
+		t.Errorf("Partial transaction not removed from the map")
+	}
+
+	// the next request/response pair is parsed normally
+	data, err = hex.DecodeString(
+		"1c0000000355504441544520706f737420534554207469746c65203d20276127")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: ts}, &tuple, 0, private)
+
+	data, err = hex.DecodeString("0700000100010000000000")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	mysql.Parse(&protos.Packet{Payload: data, Ts: ts}, &tuple, 1, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected the next transaction to be published")
+	}
+	event = <-mysql.results
+	if event["query"] != "UPDATE post SET title = 'a'" {
+		t.Errorf("Wrong query after the gap: %s", event["query"])
+	}
+	if _, exists := event["notes"]; exists {
+		t.Errorf("Unexpected notes after the gap: %v", event["notes"])
+	}
+}
+
+// Test that a request without response is published when the
+// connection is closed.
+func TestParseMySQL_requestFollowedByFin(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mysql", "mysqldetailed"})
+	}
+
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	ts, err := time.Parse(time.RFC3339, "2000-12-26T01:15:06+04:20")
+	if err != nil {
+		t.Errorf("Failed to get ts")
+	}
+	var tuple common.TcpTuple
+	var private protos.ProtocolData
+
+	// SELECT * FROM post
+	data, err := hex.DecodeString("130000000353454c454354202a2046524f4d20706f7374")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: ts}, &tuple, 0, private)
+	if len(mysql.transactionsMap) != 1 {
+		t.Fatalf("Expected the request to be in the transactions map")
+	}
+	trans := mysql.transactionsMap[tuple.Hashable()]
+
+	private = mysql.ReceivedFin(&tuple, 0, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected the transaction to be published on FIN")
+	}
+	event := <-mysql.results
+	if event["status"] != protos.CONNECTION_CLOSED_STATUS {
+		t.Errorf("Wrong status: %s", event["status"])
+	}
+	if event["query"] != "SELECT * FROM post" {
+		t.Errorf("Wrong query: %s", event["query"])
+	}
+	if len(mysql.transactionsMap) != 0 {
+		t.Errorf("Transaction not removed from the map")
+	}
+	if trans.timer.Stop() {
+		t.Errorf("Transaction timer still running")
+	}
+
+	// the FIN in the other direction doesn't publish it again
+	mysql.ReceivedFin(&tuple, 1, private)
+	if len(mysql.results) != 0 {
+		t.Errorf("Transaction published twice")
+	}
+}
+
+func TestParseMySQL_maxTransactions(t *testing.T) {
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+	mysql.maxTransactions = 2
+
+	// SELECT * FROM post
+	data, err := hex.DecodeString("130000000353454c454354202a2046524f4d20706f7374")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	tuples := make([]common.TcpTuple, 3)
+	for i := range tuples {
+		tuples[i].Src_port = uint16(3306 + i)
+		tuples[i].ComputeHashebles()
+		mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuples[i],
+			tcp.TcpDirectionOriginal, nil)
+	}
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected the oldest request to be published, got %d events", len(mysql.results))
+	}
+	event := <-mysql.results
+	if event["status"] != protos.OVERFLOW_STATUS {
+		t.Errorf("Wrong status: %s", event["status"])
+	}
+	if event["src"].(*common.Endpoint).Port != 3306 {
+		t.Errorf("Expected the oldest request, got %v", event["src"])
+	}
+	if len(mysql.transactionsMap) != 2 || mysql.transactionsMap[tuples[0].Hashable()] != nil {
+		t.Errorf("Expected the oldest request to be removed from the map")
+	}
+}
+
+func TestParseMySQL_transactionTimeout(t *testing.T) {
+	mysql := MysqlModForTests()
+	mysql.transactionTimeout = 10 * time.Millisecond
+
+	// the expiry is run by the test, not by a timer goroutine
+	var timeout time.Duration
+	var expire func()
+	mysql.afterFunc = func(d time.Duration, f func()) *time.Timer {
+		timeout, expire = d, f
+		return time.NewTimer(time.Hour)
+	}
+
+	// SELECT * FROM post
+	data, err := hex.DecodeString("130000000353454c454354202a2046524f4d20706f7374")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	tuple := common.TcpTuple{Src_port: 3306}
+	tuple.ComputeHashebles()
+	mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple,
+		tcp.TcpDirectionOriginal, nil)
+	if mysql.TransactionsInFlight() != 1 {
+		t.Fatalf("Expected the request to wait for its response")
+	}
+
+	// the timers are shorter than the default of 10 seconds
+	if timeout != 10*time.Millisecond || expire == nil {
+		t.Fatalf("Expected a timer of 10ms, got %v", timeout)
+	}
+	expire()
+	if mysql.TransactionsInFlight() != 0 {
+		t.Errorf("Expected the request to expire")
+	}
+}
+
+// Test a query with two statements, answered by two OK packets
+func TestParseMySQL_multiStatements(t *testing.T) {
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	query := "UPDATE t SET a = 1; UPDATE u SET b = 2"
+	req := append([]byte{byte(len(query) + 1), 0, 0, 0, MYSQL_CMD_QUERY}, query...)
+	resp, err := hex.DecodeString(
+		// 1 affected row, status SERVER_MORE_RESULTS_EXISTS | autocommit
+		"07000001000100" + "0a00" + "0000" +
+			// 2 affected rows, status autocommit
+			"07000002000200" + "0200" + "0000")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+
+	tuple := common.TcpTuple{Src_port: 3306}
+	tuple.ComputeHashebles()
+	var private protos.ProtocolData
+	private = mysql.Parse(&protos.Packet{Payload: req, Ts: time.Now()}, &tuple,
+		tcp.TcpDirectionOriginal, private)
+	mysql.Parse(&protos.Packet{Payload: resp, Ts: time.Now()}, &tuple,
+		tcp.TcpDirectionReverse, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mysql.results))
+	}
+	event := <-mysql.results
+	details := event["mysql"].(common.MapStr)
+	if details["affected_rows"] != uint64(3) {
+		t.Errorf("Expected the affected rows of both statements, got %v", details["affected_rows"])
+	}
+	results, _ := details["results"].([]common.MapStr)
+	if len(results) != 2 {
+		t.Fatalf("Expected the results of both statements, got %v", details["results"])
+	}
+	if results[0]["affected_rows"] != uint64(1) || results[1]["affected_rows"] != uint64(2) {
+		t.Errorf("Wrong results: %v", results)
+	}
+	if mysql.TransactionsInFlight() != 0 {
+		t.Errorf("Expected the transaction to be completed")
+	}
+}
+
+func TestMySQLParser_quit(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mysqldetailed"})
+	}
+
+	message, err := hex.DecodeString("0100000001")
+	if err != nil {
+		t.Errorf("Failed to decode hex string")
+	}
+
+	stream := &MysqlStream{data: message, message: new(MysqlMessage)}
+
+	ok, complete := mysqlMessageParser(stream)
+
+	if !ok {
+		t.Errorf("Parsing returned error")
+	}
+	if !complete {
+		t.Errorf("Expecting a complete message")
+	}
+	if !stream.message.IsRequest || !stream.message.IsQuit {
+		t.Errorf("Failed to parse COM_QUIT")
+	}
+	if stream.message.IgnoreMessage {
+		t.Errorf("COM_QUIT should not be ignored")
+	}
+}
+
+func TestMySQLParser_handshake(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mysqldetailed"})
+	}
+
+	message, err := hex.DecodeString(
+		"5b0000000a352e352e34312d307562756e7475302e31342e30342e31002c00000061" +
+			"6263646566676800fff708020000000000000000000000000000696a6b6c6d6e6f70" +
+			"71727374006d7973716c5f6e61746976655f70617373776f726400")
+	if err != nil {
+		t.Errorf("Failed to decode hex string")
+	}
+
+	stream := &MysqlStream{data: message, message: new(MysqlMessage)}
+
+	ok, complete := mysqlMessageParser(stream)
+
+	if !ok {
+		t.Errorf("Parsing returned error")
+	}
+	if !complete {
+		t.Errorf("Expecting a complete message")
+	}
+	if !stream.message.IsHandshake || stream.message.IsRequest {
+		t.Errorf("Failed to parse the handshake")
+	}
+	if stream.message.ServerVersion != "5.5.41-0ubuntu0.14.04.1" {
+		t.Errorf("Failed to get the server version: %s", stream.message.ServerVersion)
+	}
+}
+
+func TestParseMySQL_quitEvent(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mysql", "mysqldetailed"})
+	}
+
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	data, err := hex.DecodeString("0100000001")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	var tuple common.TcpTuple
+	var private mysqlPrivateData
+
+	mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple, 0, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected a QUIT event")
+	}
+	event := <-mysql.results
+	details, ok := event["mysql"].(common.MapStr)
+	if !ok || details["command"] != "QUIT" {
+		t.Errorf("Wrong mysql details: %v", event["mysql"])
+	}
+	if len(mysql.transactionsMap) != 0 {
+		t.Errorf("COM_QUIT should not start a transaction")
+	}
+}
+
+func TestParseMySQL_compressionNegotiation(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mysql", "mysqldetailed"})
+	}
+
+	mysql := MysqlModForTests()
+
+	var tuple common.TcpTuple
+	var private protos.ProtocolData
+
+	// server handshake
+	data, err := hex.DecodeString(
+		"5b0000000a352e352e34312d307562756e7475302e31342e30342e31002c00000061" +
+			"6263646566676800fff708020000000000000000000000000000696a6b6c6d6e6f70" +
+			"71727374006d7973716c5f6e61746976655f70617373776f726400")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple, 1, private)
+
+	// handshake response asking for CLIENT_COMPRESS
+	data, err = hex.DecodeString(
+		"26000001a5a2030000000001210000000000000000000000000000000000000000" +
+			"000000726f6f740000")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple, 0, private)
+	if private.(mysqlPrivateData).compressed {
+		t.Errorf("Compression enabled before the authentication OK")
+	}
+
+	// authentication OK
+	data, err = hex.DecodeString("0700000200000002000000")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple, 1, private)
+	if !private.(mysqlPrivateData).compressed {
+		t.Errorf("Compression not enabled after the authentication OK")
+	}
+}
+
+func TestParseMySQL_compressedQuery(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mysql", "mysqldetailed"})
+	}
+
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	var tuple common.TcpTuple
+	private := mysqlPrivateData{compressed: true}
+
+	// SELECT * FROM post, compressed with zlib and split in two segments
+	query, err := hex.DecodeString("130000000353454c454354202a2046524f4d20706f7374")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	var deflated bytes.Buffer
+	w := zlib.NewWriter(&deflated)
+	w.Write(query)
+	w.Close()
+
+	data := []byte{
+		byte(deflated.Len()), byte(deflated.Len() >> 8), byte(deflated.Len() >> 16),
+		0,
+		byte(len(query)), 0, 0}
+	data = append(data, deflated.Bytes()...)
+
+	private = mysql.Parse(&protos.Packet{Payload: data[:10], Ts: time.Now()},
+		&tuple, 0, private).(mysqlPrivateData)
+	if len(mysql.transactionsMap) != 0 {
+		t.Errorf("Request parsed from an incomplete compressed packet")
+	}
+	private = mysql.Parse(&protos.Packet{Payload: data[10:], Ts: time.Now()},
+		&tuple, 0, private).(mysqlPrivateData)
+	if len(mysql.transactionsMap) != 1 {
+		t.Fatalf("Compressed request not parsed")
+	}
+
+	// OK response, sent uncompressed
+	data, err = hex.DecodeString("0b000001000000" + "0700000100000002000000")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple, 1, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected the transaction to be published")
+	}
+	event := <-mysql.results
+	if event["query"] != "SELECT * FROM post" {
+		t.Errorf("Wrong query: %s", event["query"])
+	}
+}
+
+func TestParseMySQL_longQueryTruncated(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mysql", "mysqldetailed"})
+	}
+
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	var tuple common.TcpTuple
+	var private protos.ProtocolData
+
+	query := "INSERT INTO post (title) VALUES ('" + strings.Repeat("a", 5000) + "')"
+	length := len(query) + 1
+	data := []byte{byte(length), byte(length >> 8), byte(length >> 16), 0, MYSQL_CMD_QUERY}
+	data = append(data, query...)
+
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple, 0, private)
+
+	data, err := hex.DecodeString("0700000100010000000000")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple, 1, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected the transaction to be published")
+	}
+	event := <-mysql.results
+	if event["query"] != query[:4096] {
+		t.Errorf("Query not truncated to 4096 bytes: %d", len(event["query"].(string)))
+	}
+	if event["method"] != "INSERT" {
+		t.Errorf("Wrong method: %s", event["method"])
+	}
+	if event["is_request_truncated"] != true {
+		t.Errorf("Truncation flag not set")
+	}
+}
+
+func TestParseMySQL_compressedTooLarge(t *testing.T) {
+	mysql := MysqlModForTests()
+	protos.Stats.Reset()
+	defer func(max int) { tcp.MaxDataInStream = max }(tcp.MaxDataInStream)
+	tcp.MaxDataInStream = 100
+
+	var tuple common.TcpTuple
+	var private protos.ProtocolData = mysqlPrivateData{compressed: true}
+
+	// the header of a compressed packet of 1000 bytes, which are never
+	// all received
+	data := append([]byte{0xe8, 0x03, 0, 0, 0, 0, 0}, make([]byte, 60)...)
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple, 0, private)
+	if len(private.(mysqlPrivateData).compressedData[0]) != len(data) {
+		t.Fatalf("Expected the incomplete compressed packet to be kept")
+	}
+	private = mysql.Parse(&protos.Packet{Payload: make([]byte, 60), Ts: time.Now()},
+		&tuple, 0, private)
+	if private.(mysqlPrivateData).compressedData[0] != nil {
+		t.Errorf("Expected the compressed data to be dropped past MaxDataInStream")
+	}
+	if counters := protos.Stats.Get()[protos.MysqlProtocol]; counters.TooLarge != 1 {
+		t.Errorf("Expected the stream counted as too large, got %d", counters.TooLarge)
+	}
+}
+
+func TestTruncateQuery(t *testing.T) {
+	// é is two bytes, € three
+	query := "SELECT 'aé€'"
+	for max, expected := range map[int]string{
+		9:  "SELECT 'a",
+		10: "SELECT 'a",
+		11: "SELECT 'aé",
+		12: "SELECT 'aé",
+		13: "SELECT 'aé",
+		14: "SELECT 'aé€",
+	} {
+		if truncated := truncateQuery(query, max); truncated != expected {
+			t.Errorf("Truncated to %d bytes: expected %q, got %q", max, expected, truncated)
+		}
+	}
+
+	// the bytes that are not UTF-8 are cut as they are
+	if truncated := truncateQuery("\x80\x80\x80\x80\x80", 4); truncated != "\x80\x80\x80\x80" {
+		t.Errorf("Expected the invalid bytes to be cut at the limit, got %q", truncated)
+	}
+}
+
+func TestParseMySQL_accessDeniedErrorClass(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mysql", "mysqldetailed"})
+	}
+
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	var tuple common.TcpTuple
+	var private protos.ProtocolData
+
+	// SELECT * FROM post
+	data, err := hex.DecodeString("130000000353454c454354202a2046524f4d20706f7374")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple, 0, private)
+
+	// ERROR 1045 (28000): Access denied for user 'root'@'localhost' (using password: YES)
+	data, err = hex.DecodeString(
+		"48000001ff15042332383030304163636573732064656e69656420666f72207573" +
+			"65722027726f6f742740276c6f63616c686f73742720287573696e672070617373" +
+			"776f72643a2059455329")
+	if err != nil {
+		t.Errorf("Failed to decode string")
+	}
+	mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple, 1, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected the transaction to be published")
+	}
+	event := <-mysql.results
+	details := event["mysql"].(common.MapStr)
+	if details["error_code"] != uint16(1045) {
+		t.Errorf("Wrong error code: %v", details["error_code"])
+	}
+	if details["sql_state"] != "28000" {
+		t.Errorf("Wrong SQL state: %v", details["sql_state"])
+	}
+	if details["error_class"] != "access_denied" {
+		t.Errorf("Wrong error class: %v", details["error_class"])
+	}
+	if details["error_message"] != "28000: Access denied for user 'root'@'localhost' (using password: YES)" {
+		t.Errorf("Wrong error message: %v", details["error_message"])
+	}
+}
+
+func TestParseMySQL_sslRequest(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mysql", "mysqldetailed"})
+	}
+
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	var tuple common.TcpTuple
+	var private protos.ProtocolData
+	ts := time.Now()
+
+	// server handshake
+	data, _ := hex.DecodeString(
+		"5b0000000a352e352e34312d307562756e7475302e31342e30342e31002c00000061" +
+			"6263646566676800fff708020000000000000000000000000000696a6b6c6d6e6f70" +
+			"71727374006d7973716c5f6e61746976655f70617373776f726400")
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: ts}, &tuple, 1, private)
+
+	// SSL request with CLIENT_SSL, followed by the TLS ClientHello in the
+	// same segment
+	data, _ = hex.DecodeString(
+		"20000001088a000000000001210000000000000000000000000000000000000000000000" +
+			"160301002f0100002b0303111111111111111111111111111111111111111111111111" +
+			"1111111111111111000002130101000000")
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: ts}, &tuple, 0, private)
+	if private.(mysqlPrivateData).Tls == nil {
+		t.Fatalf("TLS not detected after the SSL request")
+	}
+
+	// TLS 1.3 ServerHello, then encrypted data that is not parsed
+	data, _ = hex.DecodeString(
+		"16030100320200002e03032222222222222222222222222222222222222222222222" +
+			"222222222222222222001301000006002b00020304")
+	private = mysql.Parse(&protos.Packet{Payload: data, Ts: ts.Add(3 * time.Millisecond)},
+		&tuple, 1, private)
+	mysql.Parse(&protos.Packet{Payload: []byte{0x17, 3, 3, 0, 1, 0xaa}, Ts: ts},
+		&tuple, 0, private)
+
+	if len(mysql.results) != 2 {
+		t.Fatalf("Expected the handshake and the TLS events, got %d", len(mysql.results))
+	}
+	<-mysql.results
+	event := <-mysql.results
+	if event["tls"] != true || event["tls_version"] != "TLSv1.3" {
+		t.Errorf("Wrong TLS event: %v", event)
+	}
+	if event["responsetime"] != int32(3) {
+		t.Errorf("Wrong response time: %v", event["responsetime"])
+	}
+	if len(mysql.transactionsMap) != 0 {
+		t.Errorf("The encrypted data should not be parsed")
+	}
+}
+
+// Test that the requests without response are published when the
+// plugin is flushed on shutdown.
+func TestMySQL_flushPendingTransactions(t *testing.T) {
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"mysql", "mysqldetailed"})
+	}
+
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	queries := map[uint16]string{
+		// SELECT * FROM post
+		6512: "130000000353454c454354202a2046524f4d20706f7374",
+		// SELECT 1
+		6513: "090000000353454c4543542031",
+	}
+	for port, query := range queries {
+		tuple := common.TcpTuple{
+			Ip_length: 4,
+			Src_ip:    net.IPv4(192, 168, 0, 1), Dst_ip: net.IPv4(192, 168, 0, 2),
+			Src_port: port, Dst_port: 3306,
+		}
+		tuple.ComputeHashebles()
+
+		data, err := hex.DecodeString(query)
+		if err != nil {
+			t.Fatalf("Failed to decode string")
+		}
+		mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple, 0, nil)
+	}
+	if len(mysql.transactionsMap) != 2 {
+		t.Fatalf("Expected the requests to be in the transactions map")
+	}
+	timers := []*time.Timer{}
+	for _, trans := range mysql.transactionsMap {
+		timers = append(timers, trans.timer)
+	}
+
+	mysql.Flush()
+
+	if len(mysql.results) != 2 {
+		t.Fatalf("Expected the transactions to be published on flush, got %d", len(mysql.results))
+	}
+	published := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		event := <-mysql.results
+		if event["status"] != protos.SHUTDOWN_STATUS {
+			t.Errorf("Wrong status: %s", event["status"])
+		}
+		published[event["query"].(string)] = true
+	}
+	if !published["SELECT * FROM post"] || !published["SELECT 1"] {
+		t.Errorf("Wrong queries published: %v", published)
+	}
+	if len(mysql.transactionsMap) != 0 {
+		t.Errorf("Transactions not removed from the map")
+	}
+	for _, timer := range timers {
+		if timer.Stop() {
+			t.Errorf("Transaction timer still running")
+		}
+	}
+}
+
+// Test that only the request of the idle stream is published when the
+// stream is flushed before it is released.
+func TestMySQL_flushStream(t *testing.T) {
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	tuples := []common.TcpTuple{}
+	for _, port := range []uint16{6512, 6513} {
+		tuple := common.TcpTuple{
+			Ip_length: 4,
+			Src_ip:    net.IPv4(192, 168, 0, 1), Dst_ip: net.IPv4(192, 168, 0, 2),
+			Src_port: port, Dst_port: 3306,
+		}
+		tuple.ComputeHashebles()
+		tuples = append(tuples, tuple)
+
+		// SELECT 1
+		data, err := hex.DecodeString("090000000353454c4543542031")
+		if err != nil {
+			t.Fatalf("Failed to decode string")
+		}
+		mysql.Parse(&protos.Packet{Payload: data, Ts: time.Now()}, &tuple, 0, nil)
+	}
+
+	mysql.FlushStream(&tuples[0], nil)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected one transaction to be published, got %d", len(mysql.results))
+	}
+	event := <-mysql.results
+	if event["status"] != protos.EXPIRED_STATUS {
+		t.Errorf("Wrong status: %s", event["status"])
+	}
+	if _, exists := mysql.transactionsMap[tuples[0].Hashable()]; exists {
+		t.Errorf("Transaction not removed from the map")
+	}
+	if _, exists := mysql.transactionsMap[tuples[1].Hashable()]; !exists {
+		t.Errorf("Transaction of the other stream removed from the map")
+	}
+}
+
+func TestParseMySQL_replayedConnection(t *testing.T) {
+	results := make(chan common.MapStr, 10)
+	mysql := MysqlModForTests()
+	mysql.Init(true, results)
+	mysql.Ports = []int{3306}
+
+	// the query and the OK packet answering it are both split in two
+	// segments
+	update := "UPDATE users SET active = 1"
+	req := append([]byte{byte(len(update) + 1), 0, 0, 0, MYSQL_CMD_QUERY}, update...)
+	ok := []byte{7, 0, 0, 1, 0, 3, 0, 2, 0, 0, 0}
+
+	events, err := protostest.ReplayTcp(protos.MysqlProtocol, mysql, results,
+		protostest.Segment{Dir: protostest.ClientToServer, Payload: req[:10]},
+		protostest.Segment{Dir: protostest.ClientToServer, Payload: req[10:]},
+		protostest.Segment{Dir: protostest.ServerToClient, Payload: ok[:6]},
+		protostest.Segment{Dir: protostest.ServerToClient, Payload: ok[6:]},
+	)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected one event, got %d: %v", len(events), events)
+	}
+	event := events[0]
+	if event["query"] != update || event["method"] != "UPDATE" {
+		t.Errorf("Wrong query: %v %v", event["method"], event["query"])
+	}
+	if event["mysql"].(common.MapStr)["affected_rows"] != uint64(3) {
+		t.Errorf("Wrong result: %v", event["mysql"])
+	}
+	src := event["src"].(*common.Endpoint)
+	dst := event["dst"].(*common.Endpoint)
+	if src.Ip != protostest.ClientIp.String() || dst.Ip != protostest.ServerIp.String() || dst.Port != 3306 {
+		t.Errorf("Wrong endpoints: %v %v", src, dst)
+	}
+}
+
+func TestParseMySQL_okResponseWithWarnings(t *testing.T) {
+	// OK packet: 1 affected row, status flags 0x0002, 2 warnings
+	message, err := hex.DecodeString("0700000100010002000200")
+	if err != nil {
+		t.Fatalf("Failed to decode hex string")
+	}
+
+	stream := &MysqlStream{data: message, message: new(MysqlMessage)}
+	ok, complete := mysqlMessageParser(stream)
+	if !ok || !complete {
+		t.Fatalf("Expecting a complete message")
+	}
+	if stream.message.StatusFlags != 0x0002 {
+		t.Errorf("Wrong status flags: %#x", stream.message.StatusFlags)
+	}
+	if stream.message.Warnings != 2 {
+		t.Errorf("Wrong warning count: %d", stream.message.Warnings)
+	}
+
+	results := make(chan common.MapStr, 10)
+	mysql := MysqlModForTests()
+	mysql.Init(true, results)
+	mysql.Ports = []int{3306}
+
+	insert := "INSERT INTO users VALUES ('a very long name')"
+	req := append([]byte{byte(len(insert) + 1), 0, 0, 0, MYSQL_CMD_QUERY}, insert...)
+	events, err := protostest.ReplayTcp(protos.MysqlProtocol, mysql, results,
+		protostest.Segment{Dir: protostest.ClientToServer, Payload: req},
+		protostest.Segment{Dir: protostest.ServerToClient, Payload: message},
+	)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected one event, got %d: %v", len(events), events)
+	}
+	fields := events[0]["mysql"].(common.MapStr)
+	if fields["warning_count"] != 2 || fields["has_warnings"] != true {
+		t.Errorf("Wrong warnings: %v", fields)
+	}
+	if events[0]["status"] != common.OK_STATUS {
+		t.Errorf("Wrong status: %v", events[0]["status"])
+	}
+}
+
+func TestParseMySQL_parseErrorEvent(t *testing.T) {
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	parseErrors := make(chan common.MapStr, 10)
+	max := 1
+	err := protos.ParseErrors.Init(protos.ParseErrorsConfig{
+		Enabled:        true,
+		Max_per_minute: &max,
+	}, parseErrors)
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer protos.ParseErrors.Init(protos.ParseErrorsConfig{}, nil)
+	protos.Stats.Reset()
+	defer protos.Stats.Reset()
+
+	tuple := common.TcpTuple{
+		Src_ip: net.IPv4(192, 168, 0, 1), Src_port: 6512,
+		Dst_ip: net.IPv4(192, 168, 0, 2), Dst_port: 3306,
+	}
+	ts, err := time.Parse(time.RFC3339, "2000-12-26T01:15:06+04:20")
+	if err != nil {
+		t.Fatalf("Failed to get ts")
+	}
+
+	// too short to be a MySQL packet, on two streams in the same minute
+	for i := 0; i < 2; i++ {
+		private := mysql.Parse(&protos.Packet{Payload: []byte{1, 0}, Ts: ts}, &tuple, 0, nil)
+		if private.(mysqlPrivateData).Data[0] != nil {
+			t.Errorf("The malformed stream was not dropped")
+		}
+	}
+
+	if len(parseErrors) != 1 {
+		t.Fatalf("Expected one parse_error event, got %d", len(parseErrors))
+	}
+	event := <-parseErrors
+	if event["type"] != "parse_error" || event["status"] != common.ERROR_STATUS {
+		t.Errorf("Wrong event: %v", event)
+	}
+	details := event["parse_error"].(common.MapStr)
+	if details["protocol"] != "mysql" || details["reason"] != "Invalid MySQL packet" {
+		t.Errorf("Wrong parse_error: %v", details)
+	}
+	if dst := event["dst"].(*common.Endpoint); dst.Ip != "192.168.0.2" || dst.Port != 3306 {
+		t.Errorf("Wrong destination: %v", dst)
+	}
+	if protos.ParseErrors.Suppressed() != 1 {
+		t.Errorf("Expected the second event to be suppressed")
+	}
+	if counters := protos.Stats.Get()[protos.MysqlProtocol]; counters.ParseErrors != 2 {
+		t.Errorf("Expected 2 parse errors counted, got %d", counters.ParseErrors)
+	}
+	if len(mysql.results) != 0 {
+		t.Errorf("No transaction expected")
+	}
+}
+
+// Sends a query and its OK response in the given capture direction,
+// and returns the published events.
+func captureDirectionEvents(t *testing.T, direction string) ([]common.MapStr, int) {
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+	mysql.captureDirection = direction
+	mysql.Send_request = true
+	mysql.Send_response = true
+
+	query := "UPDATE post SET title = 'x'"
+	req := append([]byte{byte(len(query) + 1), 0, 0, 0, MYSQL_CMD_QUERY}, query...)
+	resp := []byte{7, 0, 0, 1, 0, 1, 0, 2, 0, 0, 0}
+
+	tuple := common.TcpTuple{Src_port: 3306}
+	tuple.ComputeHashebles()
+	ts := time.Now()
+	var private protos.ProtocolData
+	private = mysql.Parse(&protos.Packet{Payload: req, Ts: ts}, &tuple,
+		tcp.TcpDirectionOriginal, private)
+	inFlight := mysql.TransactionsInFlight()
+	mysql.Parse(&protos.Packet{Payload: resp, Ts: ts.Add(5 * time.Millisecond)}, &tuple,
+		tcp.TcpDirectionReverse, private)
+
+	if mysql.TransactionsInFlight() != 0 {
+		t.Errorf("Expected no transaction left, got %d", mysql.TransactionsInFlight())
+	}
+	events := []common.MapStr{}
+	for len(mysql.results) > 0 {
+		events = append(events, <-mysql.results)
+	}
+	return events, inFlight
+}
+
+func TestParseMySQL_captureBoth(t *testing.T) {
+	events, inFlight := captureDirectionEvents(t, protos.CaptureBoth)
+	if len(events) != 1 || inFlight != 1 {
+		t.Fatalf("Expected one event after one transaction in flight, got %d and %d",
+			len(events), inFlight)
+	}
+	event := events[0]
+	if event["method"] != "UPDATE" || event["responsetime"] != int32(5) ||
+		event["mysql"].(common.MapStr)["affected_rows"] != uint64(1) {
+		t.Errorf("Wrong event: %v", event)
+	}
+}
+
+func TestParseMySQL_captureRequest(t *testing.T) {
+	events, inFlight := captureDirectionEvents(t, protos.CaptureRequest)
+	if len(events) != 1 || inFlight != 0 {
+		t.Fatalf("Expected one event published on the request, got %d and %d in flight",
+			len(events), inFlight)
+	}
+	event := events[0]
+	if event["method"] != "UPDATE" || event["request"] != "UPDATE post SET title = 'x'" ||
+		event["status"] != common.OK_STATUS {
+		t.Errorf("Wrong event: %v", event)
+	}
+	for _, field := range []string{"responsetime", "response", "bytes_out"} {
+		if _, exists := event[field]; exists {
+			t.Errorf("Unexpected field %s in %v", field, event)
+		}
+	}
+	if _, exists := event["mysql"].(common.MapStr)["affected_rows"]; exists {
+		t.Errorf("Unexpected response fields: %v", event["mysql"])
+	}
+}
+
+func TestParseMySQL_captureResponse(t *testing.T) {
+	events, inFlight := captureDirectionEvents(t, protos.CaptureResponse)
+	if len(events) != 1 || inFlight != 0 {
+		t.Fatalf("Expected one event without transaction in flight, got %d and %d",
+			len(events), inFlight)
+	}
+	event := events[0]
+	if event["responsetime"] != int32(5) ||
+		event["mysql"].(common.MapStr)["affected_rows"] != uint64(1) {
+		t.Errorf("Wrong event: %v", event)
+	}
+	for _, field := range []string{"method", "query", "request"} {
+		if _, exists := event[field]; exists {
+			t.Errorf("Unexpected field %s in %v", field, event)
+		}
+	}
+}
+
+func TestParseMySQL_captureResponseWithoutRequest(t *testing.T) {
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+	mysql.captureDirection = protos.CaptureResponse
+
+	resp := []byte{7, 0, 0, 1, 0, 1, 0, 2, 0, 0, 0}
+	tuple := common.TcpTuple{Src_port: 3306}
+	tuple.ComputeHashebles()
+	var private protos.ProtocolData
+	for i := 0; i < 2; i++ {
+		private = mysql.Parse(&protos.Packet{Payload: resp, Ts: time.Now()}, &tuple,
+			tcp.TcpDirectionReverse, private)
+	}
+
+	if len(mysql.results) != 0 {
+		t.Errorf("Expected the responses without request to be ignored, got %d events",
+			len(mysql.results))
+	}
+}
+
+func TestMySQL_captureDirectionConfig(t *testing.T) {
+	var mysql Mysql
+	mysql.InitDefaults()
+	direction := "request"
+	split := true
+	err := mysql.setFromConfig(config.Mysql{Capture_direction: &direction})
+	if err != nil || mysql.captureDirection != protos.CaptureRequest {
+		t.Errorf("Expected the request direction, got %q and %v", mysql.captureDirection, err)
+	}
+	err = mysql.setFromConfig(config.Mysql{Capture_direction: &direction, Split_request_response: &split})
+	if err == nil {
+		t.Errorf("Expected an error with split_request_response")
+	}
+	direction = "none"
+	if err = mysql.setFromConfig(config.Mysql{Capture_direction: &direction}); err == nil {
+		t.Errorf("Expected an error for an unknown direction")
+	}
+}
+
+func TestParseMySQL_stmtClose(t *testing.T) {
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+
+	query := "SELECT name FROM users WHERE id = ?"
+	prepare := append([]byte{byte(len(query) + 1), 0, 0, 0, MYSQL_CMD_STMT_PREPARE}, query...)
+	// statement id 7, one column, one parameter, followed by the
+	// definitions which are ignored
+	prepareOK := []byte{12, 0, 0, 1, 0, 7, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0}
+	stmtClose := []byte{5, 0, 0, 0, MYSQL_CMD_STMT_CLOSE, 7, 0, 0, 0}
+
+	tuple := common.TcpTuple{Src_port: 3306}
+	tuple.ComputeHashebles()
+	var private protos.ProtocolData
+	client := uint8(tcp.TcpDirectionOriginal)
+	server := uint8(tcp.TcpDirectionReverse)
+	private = mysql.Parse(&protos.Packet{Payload: prepare, Ts: time.Now()}, &tuple, client, private)
+	private = mysql.Parse(&protos.Packet{Payload: prepareOK, Ts: time.Now()}, &tuple, server, private)
+
+	priv := private.(mysqlPrivateData)
+	if priv.statements[7] != query {
+		t.Fatalf("Expected statement 7 to be tracked, got %v", priv.statements)
+	}
+
+	private = mysql.Parse(&protos.Packet{Payload: stmtClose, Ts: time.Now()}, &tuple, client, private)
+	priv = private.(mysqlPrivateData)
+	if _, exists := priv.statements[7]; exists {
+		t.Errorf("Expected statement 7 to be freed, got %v", priv.statements)
+	}
+	if len(mysql.results) != 0 {
+		t.Errorf("Expected no event, got %d", len(mysql.results))
+	}
+}
+
+func TestMySQL_maxPreparedStatements(t *testing.T) {
+	priv := mysqlPrivateData{}
+	for id := uint32(1); id <= MAX_PREPARED_STATEMENTS+1; id++ {
+		priv.addStatement(id, "SELECT ?")
+	}
+	if len(priv.statements) != MAX_PREPARED_STATEMENTS {
+		t.Fatalf("Expected %d statements, got %d", MAX_PREPARED_STATEMENTS, len(priv.statements))
+	}
+	if _, exists := priv.statements[1]; exists {
+		t.Errorf("Expected the oldest statement to be dropped")
+	}
+	if _, exists := priv.statements[MAX_PREPARED_STATEMENTS+1]; !exists {
+		t.Errorf("Expected the newest statement to be tracked")
+	}
+}
+
+// columnDefinition returns the packet of the definition of a column of
+// the users table.
+func columnDefinition(seq byte, name string, typ byte) []byte {
+	var payload []byte
+	for _, s := range []string{"def", "test", "users", "users", name, name} {
+		payload = append(payload, byte(len(s)))
+		payload = append(payload, s...)
+	}
+	payload = append(payload, 0x0c, 33, 0, 0, 1, 0, 0, typ, 0, 0, 0, 0, 0)
+	return append([]byte{byte(len(payload)), 0, 0, seq}, payload...)
+}
+
+func TestParseMySQL_stmtExecuteBinaryRows(t *testing.T) {
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+	mysql.Send_response = true
+	mysql.rowsSample = 1
+
+	query := "SELECT id, name FROM users WHERE id = ?"
+	prepare := append([]byte{byte(len(query) + 1), 0, 0, 0, MYSQL_CMD_STMT_PREPARE}, query...)
+	prepareOK := []byte{12, 0, 0, 1, 0, 7, 0, 0, 0, 2, 0, 1, 0, 0, 0, 0}
+	// statement 7, no cursor, one iteration, the parameter is not sent
+	// as it doesn't matter here
+	execute := []byte{10, 0, 0, 0, MYSQL_CMD_STMT_EXECUTE, 7, 0, 0, 0, 0, 1, 0, 0, 0}
+
+	var response []byte
+	response = append(response, 1, 0, 0, 1, 2)
+	response = append(response, columnDefinition(2, "id", MYSQL_TYPE_LONG)...)
+	response = append(response, columnDefinition(3, "name", MYSQL_TYPE_VAR_STRING)...)
+	response = append(response, 5, 0, 0, 4, 0xfe, 0, 0, 2, 0)
+	// header, NULL bitmap, int<4> 42, string<lenenc> alice
+	response = append(response, 12, 0, 0, 5, 0, 0, 42, 0, 0, 0, 5, 'a', 'l', 'i', 'c', 'e')
+	response = append(response, 5, 0, 0, 6, 0xfe, 0, 0, 2, 0)
+
+	tuple := common.TcpTuple{Src_port: 3306}
+	tuple.ComputeHashebles()
+	var private protos.ProtocolData
+	client := uint8(tcp.TcpDirectionOriginal)
+	server := uint8(tcp.TcpDirectionReverse)
+	private = mysql.Parse(&protos.Packet{Payload: prepare, Ts: time.Now()}, &tuple, client, private)
+	private = mysql.Parse(&protos.Packet{Payload: prepareOK, Ts: time.Now()}, &tuple, server, private)
+	private = mysql.Parse(&protos.Packet{Payload: execute, Ts: time.Now()}, &tuple, client, private)
+	private = mysql.Parse(&protos.Packet{Payload: response, Ts: time.Now()}, &tuple, server, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mysql.results))
+	}
+	event := <-mysql.results
+	if event["query"] != query || event["method"] != "SELECT" {
+		t.Errorf("Wrong query: %v %v", event["method"], event["query"])
+	}
+	details := event["mysql"].(common.MapStr)
+	if details["num_rows"] != 1 || details["num_fields"] != 2 {
+		t.Errorf("Wrong result: %v", details)
+	}
+	sample := details["rows_sample"].([]common.MapStr)
+	if len(sample) != 1 || sample[0]["id"] != "42" || sample[0]["name"] != "alice" {
+		t.Errorf("Wrong rows: %v", sample)
+	}
+
+	// the next query is in the text protocol
+	priv := private.(mysqlPrivateData)
+	if priv.executing {
+		t.Errorf("Expected the execution to be done")
+	}
+}
@@ -0,0 +1,137 @@
+package mysql
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Replaces the literal values of the queries, so that the queries differing
+// only by their values are stored the same.
+const QueryPlaceholder = "?"
+
+// IN lists of placeholders, collapsed to a single one as their length
+// depends on the values as well
+var inListRegexp = regexp.MustCompile(`(?i)\b(IN) ?\( ?\?( ?, ?\?)* ?\)`)
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) ||
+		c == '_' || c == '$'
+}
+
+// skipQuoted returns the offset following the quoted string starting at
+// i. The quote is escaped by a backslash or by doubling it.
+func skipQuoted(query string, i int) int {
+	quote := query[i]
+	for i++; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// skipNumber returns the offset following the number starting at i, in
+// decimal, hexadecimal or scientific notation.
+func skipNumber(query string, i int) int {
+	if strings.HasPrefix(query[i:], "0x") || strings.HasPrefix(query[i:], "0X") {
+		for i += 2; i < len(query) && strings.IndexByte("0123456789abcdefABCDEF", query[i]) >= 0; i++ {
+		}
+		return i
+	}
+	for ; i < len(query) && (isDigit(query[i]) || query[i] == '.'); i++ {
+	}
+	if i+1 < len(query) && (query[i] == 'e' || query[i] == 'E') {
+		j := i + 1
+		if query[j] == '+' || query[j] == '-' {
+			j++
+		}
+		if j < len(query) && isDigit(query[j]) {
+			for i = j; i < len(query) && isDigit(query[i]); i++ {
+			}
+		}
+	}
+	return i
+}
+
+func appendSpace(out []byte) []byte {
+	if len(out) > 0 && out[len(out)-1] != ' ' {
+		out = append(out, ' ')
+	}
+	return out
+}
+
+// normalizeQuery replaces the string and number literals of the query by
+// placeholders, and the IN lists by a single placeholder. The comments are
+// removed and the whitespaces collapsed. The quoted identifiers are kept.
+func normalizeQuery(query string) string {
+	out := make([]byte, 0, len(query))
+	for i := 0; i < len(query); {
+		c := query[i]
+		identBefore := len(out) > 0 && isIdentifierChar(out[len(out)-1])
+
+		switch {
+		case c == '\'' || c == '"':
+			i = skipQuoted(query, i)
+			out = append(out, QueryPlaceholder...)
+
+		case (c == 'x' || c == 'X' || c == 'b' || c == 'B' || c == 'N') && !identBefore &&
+			i+1 < len(query) && query[i+1] == '\'':
+			// hexadecimal, bit value and national strings
+			i = skipQuoted(query, i+1)
+			out = append(out, QueryPlaceholder...)
+
+		case c == '`':
+			end := skipQuoted(query, i)
+			out = append(out, query[i:end]...)
+			i = end
+
+		case c == '#' || c == '-' && strings.HasPrefix(query[i:], "--") &&
+			(i+2 == len(query) || isSpace(query[i+2])):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 4
+			}
+			out = appendSpace(out)
+
+		case isSpace(c):
+			out = appendSpace(out)
+			i++
+
+		case isDigit(c) && !identBefore:
+			i = skipNumber(query, i)
+			out = append(out, QueryPlaceholder...)
+
+		default:
+			out = append(out, c)
+			i++
+		}
+	}
+
+	normalized := strings.TrimSpace(string(out))
+	return inListRegexp.ReplaceAllString(normalized, "$1 (?)")
+}
@@ -0,0 +1,74 @@
+package mysql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/tcp"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+	tests := []struct {
+		query      string
+		normalized string
+	}{
+		// numbers
+		{"SELECT * FROM post WHERE id = 42", "SELECT * FROM post WHERE id = ?"},
+		{"UPDATE t1 SET price = 3.5e-2, flags = 0x1f WHERE id=-7",
+			"UPDATE t1 SET price = ?, flags = ? WHERE id=-?"},
+		// strings
+		{"SELECT id FROM users WHERE name = 'O''Brien' AND city = \"Paris\"",
+			"SELECT id FROM users WHERE name = ? AND city = ?"},
+		{`INSERT INTO logs VALUES ('it\'s', X'ff')`, "INSERT INTO logs VALUES (?, ?)"},
+		// IN lists
+		{"SELECT * FROM post WHERE id IN (1, 2, 3)", "SELECT * FROM post WHERE id IN (?)"},
+		{"select * from post where tag in ('a','b')", "select * from post where tag in (?)"},
+		// identifiers, comments and whitespaces
+		{"SELECT `col 1` FROM t2 /* 12 */ WHERE\n\ta = 1 -- the answer",
+			"SELECT `col 1` FROM t2 WHERE a = ?"},
+	}
+
+	for _, test := range tests {
+		normalized := normalizeQuery(test.query)
+		if normalized != test.normalized {
+			t.Errorf("Normalizing %q: expected %q, got %q", test.query, test.normalized, normalized)
+		}
+	}
+}
+
+func TestParseMySQL_redactQueries(t *testing.T) {
+	mysql := MysqlModForTests()
+	mysql.results = make(chan common.MapStr, 10)
+	mysql.normalizeQueries = true
+	mysql.redactQueries = true
+	mysql.Send_request = true
+
+	query := "SELECT * FROM users WHERE email = 'alice@example.com'"
+	req := append([]byte{byte(len(query) + 1), 0, 0, 0, MYSQL_CMD_QUERY}, query...)
+	resp := []byte{7, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0}
+
+	tuple := common.TcpTuple{Src_port: 3306}
+	tuple.ComputeHashebles()
+	var private protos.ProtocolData
+	private = mysql.Parse(&protos.Packet{Payload: req, Ts: time.Now()}, &tuple,
+		tcp.TcpDirectionOriginal, private)
+	mysql.Parse(&protos.Packet{Payload: resp, Ts: time.Now()}, &tuple,
+		tcp.TcpDirectionReverse, private)
+
+	if len(mysql.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(mysql.results))
+	}
+	event := <-mysql.results
+	normalized := "SELECT * FROM users WHERE email = ?"
+	if event["mysql"].(common.MapStr)["query_normalized"] != normalized {
+		t.Errorf("Wrong normalized query: %v", event["mysql"])
+	}
+	if event["query"] != normalized || event["request"] != normalized {
+		t.Errorf("Expected the raw query to be replaced, got %v", event["query"])
+	}
+	if event["method"] != "SELECT" {
+		t.Errorf("Wrong method: %v", event["method"])
+	}
+}
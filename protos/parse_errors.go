@@ -0,0 +1,138 @@
+package protos
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+)
+
+// DefaultParseErrorsPerMinute is the default maximum number of parse_error
+// events published per minute.
+const DefaultParseErrorsPerMinute = 10
+
+type ParseErrorsConfig struct {
+	Enabled bool
+
+	// Maximum number of parse_error events published per minute, the
+	// others are only counted.
+	Max_per_minute *int
+}
+
+// ParseErrorReporter publishes an event when a plugin drops a stream it
+// could not parse, so that the unparsed traffic shows next to the
+// transactions. The events are rate limited, a capture of a protocol the
+// plugin doesn't understand would otherwise produce one by segment.
+type ParseErrorReporter struct {
+	Enabled      bool
+	MaxPerMinute int
+
+	lock        sync.Mutex
+	windowStart time.Time
+	published   int
+	suppressed  uint64
+
+	results chan common.MapStr
+}
+
+// Singleton of the ParseErrorReporter type, used by the plugins through
+// ReportParseError.
+var ParseErrors = new(ParseErrorReporter)
+
+// Init configures the events, published to results.
+func (reporter *ParseErrorReporter) Init(config ParseErrorsConfig, results chan common.MapStr) error {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	reporter.Enabled = config.Enabled
+	reporter.MaxPerMinute = DefaultParseErrorsPerMinute
+	if config.Max_per_minute != nil {
+		reporter.MaxPerMinute = *config.Max_per_minute
+	}
+	if reporter.MaxPerMinute <= 0 {
+		return fmt.Errorf("The max_per_minute of the parse errors must be positive, got %d",
+			reporter.MaxPerMinute)
+	}
+	reporter.windowStart = time.Time{}
+	reporter.published = 0
+	reporter.suppressed = 0
+	reporter.results = results
+	return nil
+}
+
+// Suppressed returns the number of events not published because of the
+// rate limit.
+func (reporter *ParseErrorReporter) Suppressed() uint64 {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	return reporter.suppressed
+}
+
+// allow tells whether an event can be published at ts. The windows of a
+// minute start with the first event past the previous one, and the
+// timestamps of the packets are used so that the reading of a file is
+// limited as a live capture.
+func (reporter *ParseErrorReporter) allow(ts time.Time) bool {
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+
+	if reporter.windowStart.IsZero() || ts.Before(reporter.windowStart) ||
+		ts.Sub(reporter.windowStart) >= time.Minute {
+
+		if reporter.suppressed > 0 {
+			logp.Info("%d parse_error events were not published because of the rate limit",
+				reporter.suppressed)
+			reporter.suppressed = 0
+		}
+		reporter.windowStart = ts
+		reporter.published = 0
+	}
+	if reporter.published >= reporter.MaxPerMinute {
+		reporter.suppressed++
+		return false
+	}
+	reporter.published++
+	return true
+}
+
+// Report publishes the parse_error event of a stream of the protocol,
+// dropped at the packet for the given reason.
+func (reporter *ParseErrorReporter) Report(proto Protocol, tcptuple *common.TcpTuple,
+	pkt *Packet, reason string) {
+
+	if !reporter.Enabled || reporter.results == nil || !reporter.allow(pkt.Ts) {
+		return
+	}
+
+	event := common.MapStr{
+		"type":      "parse_error",
+		"status":    common.ERROR_STATUS,
+		"timestamp": common.Time(pkt.Ts),
+		"parse_error": common.MapStr{
+			"protocol": proto.String(),
+			"reason":   reason,
+		},
+	}
+	if tcptuple != nil {
+		event["src"] = &common.Endpoint{
+			Ip:   tcptuple.Src_ip.String(),
+			Port: tcptuple.Src_port,
+		}
+		event["dst"] = &common.Endpoint{
+			Ip:   tcptuple.Dst_ip.String(),
+			Port: tcptuple.Dst_port,
+		}
+	}
+	pkt.Link.AddFields(event)
+	reporter.results <- event
+}
+
+// ReportParseError counts a stream of the protocol dropped because it
+// could not be parsed, and publishes its parse_error event when they are
+// enabled. It is called by all the plugins when they drop a stream.
+func ReportParseError(proto Protocol, tcptuple *common.TcpTuple, pkt *Packet, reason string) {
+	Stats.CountParseError(proto)
+	ParseErrors.Report(proto, tcptuple, pkt, reason)
+}
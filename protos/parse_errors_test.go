@@ -0,0 +1,52 @@
+package protos
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseErrors_rateLimit(t *testing.T) {
+	results := make(chan common.MapStr, 10)
+	reporter := new(ParseErrorReporter)
+	max := 2
+	assert.Nil(t, reporter.Init(ParseErrorsConfig{Enabled: true, Max_per_minute: &max}, results))
+
+	tuple := &common.TcpTuple{
+		Src_ip: net.IPv4(10, 0, 0, 1), Src_port: 5000,
+		Dst_ip: net.IPv4(10, 0, 0, 2), Dst_port: 6379,
+	}
+	start := time.Date(2015, 9, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		reporter.Report(RedisProtocol, tuple, &Packet{Ts: start.Add(time.Duration(i) * time.Second)}, "bad")
+	}
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, uint64(3), reporter.Suppressed())
+
+	// a new window
+	reporter.Report(RedisProtocol, tuple, &Packet{Ts: start.Add(time.Minute)}, "bad")
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, uint64(0), reporter.Suppressed())
+
+	event := <-results
+	assert.Equal(t, "parse_error", event["type"])
+	assert.Equal(t, common.MapStr{"protocol": "redis", "reason": "bad"}, event["parse_error"])
+	assert.Equal(t, &common.Endpoint{Ip: "10.0.0.1", Port: 5000}, event["src"])
+}
+
+func TestParseErrors_disabled(t *testing.T) {
+	results := make(chan common.MapStr, 10)
+	reporter := new(ParseErrorReporter)
+	assert.Nil(t, reporter.Init(ParseErrorsConfig{}, results))
+	assert.Equal(t, DefaultParseErrorsPerMinute, reporter.MaxPerMinute)
+
+	reporter.Report(HttpProtocol, nil, &Packet{Ts: time.Now()}, "bad")
+	assert.Equal(t, 0, len(results))
+
+	zero := 0
+	assert.NotNil(t, reporter.Init(ParseErrorsConfig{Max_per_minute: &zero}, results))
+}
@@ -1,6 +1,7 @@
 package pgsql
 
 import (
+	"encoding/hex"
 	"strings"
 	"time"
 
@@ -16,13 +17,17 @@ import (
 type PgsqlMessage struct {
 	start         int
 	end           int
+	Link          protos.Link
 	isSSLResponse bool
 	isSSLRequest  bool
 	toExport      bool
+	isExecute     bool
+	batch         int
 
 	Ts             time.Time
 	IsRequest      bool
 	Query          string
+	Params         []string
 	Size           uint64
 	Fields         []string
 	FieldsFormat   []byte
@@ -44,6 +49,7 @@ type PgsqlMessage struct {
 type PgsqlTransaction struct {
 	Type         string
 	tuple        common.TcpTuple
+	link         protos.Link
 	Src          common.Endpoint
 	Dst          common.Endpoint
 	ResponseTime int32
@@ -53,6 +59,9 @@ type PgsqlTransaction struct {
 	Query        string
 	Method       string
 	Size         uint64
+	extended     bool
+	batch        int
+	Status       string
 
 	Pgsql common.MapStr
 
@@ -72,9 +81,28 @@ type PgsqlStream struct {
 	seenSSLRequest    bool
 	expectSSLResponse bool
 
+	// Some message types are used by both the frontend and the backend
+	// with different meanings, like 'E' for Execute and ErrorResponse.
+	// The stream of the frontend is recognized by the messages only the
+	// frontend sends.
+	isFrontend bool
+
+	// the prepared statements and the portals of the extended query
+	// protocol, by name. The unnamed ones have an empty name.
+	statements map[string]string
+	portals    map[string]*pgsqlPortal
+
+	// number of Sync messages sent by the frontend
+	syncs int
+
 	message *PgsqlMessage
 }
 
+type pgsqlPortal struct {
+	query  string
+	params []string
+}
+
 const (
 	TransactionsHashSize = 2 ^ 16
 	TransactionTimeout   = 10 * 1e9
@@ -94,14 +122,18 @@ const (
 type Pgsql struct {
 
 	// config
-	Ports         []int
-	maxStoreRows  int
-	maxRowLength  int
-	Send_request  bool
-	Send_response bool
-
-	transactionsMap map[common.HashableTcpTuple][]*PgsqlTransaction
-	results         chan common.MapStr
+	Ports              []int
+	maxStoreRows       int
+	maxRowLength       int
+	maxParamLength     int
+	maxTransactions    int
+	transactionTimeout time.Duration
+	Send_request       bool
+	Send_response      bool
+
+	transactionsMap   map[common.HashableTcpTuple][]*PgsqlTransaction
+	transactionsOrder *protos.TransactionsOrder
+	results           chan common.MapStr
 
 	// function pointer for mocking
 	handlePgsql func(pgsql *Pgsql, m *PgsqlMessage, tcp *common.TcpTuple,
@@ -111,6 +143,9 @@ type Pgsql struct {
 func (pgsql *Pgsql) InitDefaults() {
 	pgsql.maxRowLength = 1024
 	pgsql.maxStoreRows = 10
+	pgsql.maxParamLength = 1024
+	pgsql.maxTransactions = protos.DefaultMaxTransactions
+	pgsql.transactionTimeout = TransactionTimeout
 	pgsql.Send_request = false
 	pgsql.Send_response = false
 }
@@ -125,6 +160,15 @@ func (pgsql *Pgsql) setFromConfig(config config.Pgsql) error {
 	if config.Max_rows != nil {
 		pgsql.maxStoreRows = *config.Max_rows
 	}
+	if config.Max_param_length != nil {
+		pgsql.maxParamLength = *config.Max_param_length
+	}
+	if config.Max_transactions != nil {
+		pgsql.maxTransactions = *config.Max_transactions
+	}
+	if config.Transaction_timeout != nil {
+		pgsql.transactionTimeout = time.Duration(*config.Transaction_timeout) * time.Second
+	}
 	if config.Send_request != nil {
 		pgsql.Send_request = *config.Send_request
 	}
@@ -149,6 +193,7 @@ func (pgsql *Pgsql) Init(test_mode bool, results chan common.MapStr) error {
 	}
 
 	pgsql.transactionsMap = make(map[common.HashableTcpTuple][]*PgsqlTransaction, TransactionsHashSize)
+	pgsql.transactionsOrder = protos.NewTransactionsOrder()
 	pgsql.handlePgsql = handlePgsql
 	pgsql.results = results
 
@@ -260,8 +305,9 @@ func (pgsql *Pgsql) pgsqlRowsParser(s *PgsqlStream) {
 		// read column value (byten)
 		column_value := []byte{}
 
-		if m.FieldsFormat[i] == 0 {
-			// field value in text format
+		if i >= len(m.FieldsFormat) || m.FieldsFormat[i] == 0 {
+			// field value in text format, which is also the default
+			// when the rows are not described
 			if column_length > 0 {
 				column_value = s.data[s.parseOffset : s.parseOffset+int(column_length)]
 			} else if column_length == -1 {
@@ -322,6 +368,165 @@ func pgsqlErrorParser(s *PgsqlStream) {
 	logp.Debug("pgsqldetailed", "%s %s %s", m.ErrorSeverity, m.ErrorCode, m.ErrorInfo)
 }
 
+// pgsqlParseParser reads the Parse message of the extended query
+// protocol, which creates a prepared statement.
+func pgsqlParseParser(s *PgsqlStream, body []byte) bool {
+	name, err := common.ReadString(body)
+	if err != nil {
+		return false
+	}
+	query, err := common.ReadString(body[len(name)+1:])
+	if err != nil {
+		return false
+	}
+	logp.Debug("pgsqldetailed", "Parse statement=%q query=%s", name, query)
+
+	// the unnamed statement is replaced by the next Parse
+	s.statements[name] = query
+	return true
+}
+
+// pgsqlBindParser reads the Bind message of the extended query protocol,
+// which creates a portal from a prepared statement and the values of its
+// parameters.
+func (pgsql *Pgsql) pgsqlBindParser(s *PgsqlStream, body []byte) bool {
+	portal, err := common.ReadString(body)
+	if err != nil {
+		return false
+	}
+	off := len(portal) + 1
+	statement, err := common.ReadString(body[off:])
+	if err != nil {
+		return false
+	}
+	off += len(statement) + 1
+
+	// the formats of the parameters: none for text only, one for all the
+	// parameters, or one per parameter
+	if len(body) < off+2 {
+		return false
+	}
+	formatCount := int(common.Bytes_Ntohs(body[off:]))
+	off += 2
+	if len(body) < off+2*formatCount+2 {
+		return false
+	}
+	formats := make([]uint16, formatCount)
+	for i := range formats {
+		formats[i] = common.Bytes_Ntohs(body[off:])
+		off += 2
+	}
+
+	paramCount := int(common.Bytes_Ntohs(body[off:]))
+	off += 2
+	params := make([]string, 0, paramCount)
+	for i := 0; i < paramCount; i++ {
+		if len(body) < off+4 {
+			return false
+		}
+		length := int32(common.Bytes_Ntohl(body[off:]))
+		off += 4
+		if length < 0 {
+			params = append(params, "NULL")
+			continue
+		}
+		if len(body) < off+int(length) {
+			return false
+		}
+		value := body[off : off+int(length)]
+		off += int(length)
+
+		binary := (formatCount == 1 && formats[0] == 1) ||
+			(formatCount > 1 && i < formatCount && formats[i] == 1)
+		params = append(params, pgsql.formatParam(value, binary))
+	}
+
+	query, exists := s.statements[statement]
+	if !exists {
+		logp.Debug("pgsql", "Bind of the unknown statement %q", statement)
+	}
+	logp.Debug("pgsqldetailed", "Bind portal=%q statement=%q params=%s",
+		portal, statement, params)
+
+	s.portals[portal] = &pgsqlPortal{query: query, params: params}
+	return true
+}
+
+// formatParam returns the value of a bound parameter in human readable
+// form, truncated to max_param_length.
+func (pgsql *Pgsql) formatParam(value []byte, binary bool) string {
+	var str string
+	if binary {
+		str = "\\x" + hex.EncodeToString(value)
+	} else {
+		str = string(value)
+	}
+	if pgsql.maxParamLength > 0 && len(str) > pgsql.maxParamLength {
+		str = str[:pgsql.maxParamLength]
+	}
+	return str
+}
+
+// pgsqlFrontendParser reads the messages of the extended query protocol.
+// It returns true if the message is an Execute, which is the request of
+// the transaction.
+func (pgsql *Pgsql) pgsqlFrontendParser(s *PgsqlStream, typ byte, body []byte) (bool, bool) {
+	if s.statements == nil {
+		s.statements = map[string]string{}
+		s.portals = map[string]*pgsqlPortal{}
+	}
+
+	switch typ {
+	case 'P':
+		return pgsqlParseParser(s, body), false
+
+	case 'B':
+		return pgsql.pgsqlBindParser(s, body), false
+
+	case 'E':
+		name, err := common.ReadString(body)
+		if err != nil {
+			return false, false
+		}
+		m := s.message
+		m.IsRequest = true
+		m.isExecute = true
+		m.batch = s.syncs
+		if portal, exists := s.portals[name]; exists {
+			m.Query = portal.query
+			m.Params = portal.params
+		} else {
+			logp.Debug("pgsql", "Execute of the unknown portal %q", name)
+		}
+		logp.Debug("pgsqldetailed", "Execute portal=%q query=%s", name, m.Query)
+		return true, true
+
+	case 'C':
+		// Close of a statement or of a portal
+		if len(body) < 1 {
+			return false, false
+		}
+		name, err := common.ReadString(body[1:])
+		if err != nil {
+			return false, false
+		}
+		if body[0] == 'S' {
+			delete(s.statements, name)
+		} else {
+			delete(s.portals, name)
+		}
+
+	case 'S':
+		// Sync ends the batch of messages, the unnamed portal is
+		// destroyed with the implicit transaction
+		s.syncs++
+		delete(s.portals, "")
+	}
+
+	// Describe and Flush don't change anything
+	return true, false
+}
+
 func isSpecialPgsqlCommand(data []byte) (bool, int) {
 
 	if len(data) < 8 {
@@ -371,6 +576,8 @@ func (pgsql *Pgsql) pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 				// read length
 				length := int(common.Bytes_Ntohl(s.data[s.parseOffset : s.parseOffset+4]))
 
+				s.isFrontend = true
+
 				// ignore command
 				if len(s.data[s.parseOffset:]) >= length {
 
@@ -413,8 +620,37 @@ func (pgsql *Pgsql) pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 
 				logp.Debug("pgsqldetailed", "Pgsql type %c, length=%d", typ, length)
 
-				if typ == 'Q' {
+				if typ == 'P' || typ == 'B' || (s.isFrontend &&
+					(typ == 'E' || typ == 'C' || typ == 'D' || typ == 'S' || typ == 'H')) {
+					// extended query protocol
+					if length < 4 {
+						logp.Debug("pgsql", "Invalid length %d for message %c", length, typ)
+						return false, false
+					}
+					if len(s.data[s.parseOffset:]) < length+1 {
+						// wait for more
+						logp.Debug("pgsqldetailed", "Wait for more data 0")
+						return true, false
+					}
+					s.isFrontend = true
+
+					body := s.data[s.parseOffset+5 : s.parseOffset+1+length]
+					m.start = s.parseOffset
+					s.parseOffset += 1 + length
+
+					ok, execute := pgsql.pgsqlFrontendParser(s, typ, body)
+					if !ok {
+						logp.Debug("pgsql", "Invalid message %c", typ)
+						return false, false
+					}
+					if execute {
+						m.end = s.parseOffset
+						m.toExport = true
+						return true, true
+					}
+				} else if typ == 'Q' {
 					// SimpleQuery
+					s.isFrontend = true
 					m.start = s.parseOffset
 					m.IsRequest = true
 
@@ -453,6 +689,16 @@ func (pgsql *Pgsql) pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 						return true, false
 					}
 
+				} else if typ == 'D' {
+					// DataRow without RowDescription, when the frontend
+					// of the extended query protocol doesn't describe
+					// the portal
+					m.start = s.parseOffset
+					m.IsRequest = false
+					m.IsOK = true
+					m.toExport = true
+					s.parseState = PgsqlGetDataState
+
 				} else if typ == 'I' {
 					// EmptyQueryResponse, appears as a response for empty queries
 					// substitutes CommandComplete
@@ -582,16 +828,19 @@ func (pgsql *Pgsql) pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 					return true, false
 				}
 
-			} else if typ == 'C' {
-				// CommandComplete
+			} else if typ == 'C' || typ == 's' {
+				// CommandComplete, or PortalSuspended when the Execute
+				// of the extended query protocol limits the rows
 
 				if len(s.data[s.parseOffset:]) >= length+1 {
 
 					// skip type
 					s.parseOffset += 1
 
-					name := string(s.data[s.parseOffset+4 : s.parseOffset+length-1]) //without \0
-					logp.Debug("pgsqldetailed", "CommandComplete length=%d, tag=%s", length, name)
+					if typ == 'C' {
+						name := string(s.data[s.parseOffset+4 : s.parseOffset+length-1]) //without \0
+						logp.Debug("pgsqldetailed", "CommandComplete length=%d, tag=%s", length, name)
+					}
 
 					s.parseOffset += length
 					m.end = s.parseOffset
@@ -622,6 +871,9 @@ func (pgsql *Pgsql) pgsqlMessageParser(s *PgsqlStream) (bool, bool) {
 
 type pgsqlPrivateData struct {
 	Data [2]*PgsqlStream
+
+	// set when the connection is encrypted, usually after a SSLRequest
+	Tls *protos.TlsUpgrade
 }
 
 func (pgsql *Pgsql) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
@@ -638,19 +890,35 @@ func (pgsql *Pgsql) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
 		}
 	}
 
+	if priv.Tls != nil {
+		if priv.Tls.Received(pkt, dir) {
+			pgsql.publishTlsUpgrade(priv.Tls, tcptuple)
+		}
+		return priv
+	}
+	if (priv.Data[dir] == nil || len(priv.Data[dir].data) == 0) &&
+		protos.IsTlsClientHello(pkt.Payload) {
+
+		logp.Debug("pgsql", "TLS ClientHello received, the connection is encrypted")
+		priv.Tls = protos.NewTlsUpgrade(pkt, dir)
+		priv.Data = [2]*PgsqlStream{}
+		return priv
+	}
+
 	if priv.Data[dir] == nil {
 		priv.Data[dir] = &PgsqlStream{
 			tcptuple: tcptuple,
 			data:     pkt.Payload,
-			message:  &PgsqlMessage{Ts: pkt.Ts},
+			message:  &PgsqlMessage{Ts: pkt.Ts, Link: pkt.Link},
 		}
 		logp.Debug("pgsqldetailed", "New stream created")
 	} else {
 		// concatenate bytes
 		priv.Data[dir].data = append(priv.Data[dir].data, pkt.Payload...)
 		logp.Debug("pgsqldetailed", "Len data: %d cap data: %d", len(priv.Data[dir].data), cap(priv.Data[dir].data))
-		if len(priv.Data[dir].data) > tcp.TCP_MAX_DATA_IN_STREAM {
+		if len(priv.Data[dir].data) > tcp.MaxDataInStream {
 			logp.Debug("pgsql", "Stream data too large, dropping TCP stream")
+			protos.Stats.CountTooLarge(protos.PgsqlProtocol)
 			priv.Data[dir] = nil
 			return priv
 		}
@@ -665,7 +933,7 @@ func (pgsql *Pgsql) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
 	for len(stream.data) > 0 {
 
 		if stream.message == nil {
-			stream.message = &PgsqlMessage{Ts: pkt.Ts}
+			stream.message = &PgsqlMessage{Ts: pkt.Ts, Link: pkt.Link}
 		}
 
 		ok, complete := pgsql.pgsqlMessageParser(priv.Data[dir])
@@ -674,6 +942,8 @@ func (pgsql *Pgsql) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
 			// segment in it
 			priv.Data[dir] = nil
 			logp.Debug("pgsql", "Ignore Postgresql message. Drop tcp stream. Try parsing with the next segment")
+			protos.ReportParseError(protos.PgsqlProtocol, tcptuple, pkt,
+				"Invalid PostgreSQL message")
 			return priv
 		}
 
@@ -757,10 +1027,24 @@ func (pgsql *Pgsql) GapInStream(tcptuple *common.TcpTuple, dir uint8,
 func (pgsql *Pgsql) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 	private protos.ProtocolData) protos.ProtocolData {
 
-	// TODO
+	priv, ok := private.(pgsqlPrivateData)
+	if ok && priv.Tls != nil && !priv.Tls.Published {
+		// closed before the ServerHello
+		pgsql.publishTlsUpgrade(priv.Tls, tcptuple)
+	}
 	return private
 }
 
+// publishTlsUpgrade publishes the event of an encrypted connection, which
+// is not parsed.
+func (pgsql *Pgsql) publishTlsUpgrade(t *protos.TlsUpgrade, tcptuple *common.TcpTuple) {
+	cmdline := procs.ProcWatcher.FindProcessesTuple(tcptuple.IpPort())
+	event := t.Event("pgsql", tcptuple, cmdline, t.ClientDir == tcp.TcpDirectionReverse)
+	if pgsql.results != nil {
+		pgsql.results <- event
+	}
+}
+
 var handlePgsql = func(pgsql *Pgsql, m *PgsqlMessage, tcptuple *common.TcpTuple,
 	dir uint8, raw_msg []byte) {
 
@@ -780,8 +1064,13 @@ func (pgsql *Pgsql) receivedPgsqlRequest(msg *PgsqlMessage) {
 	tuple := msg.TcpTuple
 
 	// parse the query, as it might contain a list of pgsql command
-	// separated by ';'
+	// separated by ';'. The prepared statements contain a single
+	// command, and the Execute needs a transaction even if the statement
+	// was prepared before the capture started.
 	queries := pgsqlQueryParser(msg.Query)
+	if msg.isExecute {
+		queries = []string{strings.TrimSpace(msg.Query)}
+	}
 
 	logp.Debug("pgsqldetailed", "Queries (%d) :%s", len(queries), queries)
 
@@ -791,7 +1080,7 @@ func (pgsql *Pgsql) receivedPgsqlRequest(msg *PgsqlMessage) {
 
 	for _, query := range queries {
 
-		trans := &PgsqlTransaction{Type: "pgsql", tuple: tuple}
+		trans := &PgsqlTransaction{Type: "pgsql", tuple: tuple, link: msg.Link}
 
 		trans.ts = msg.Ts
 		trans.Ts = int64(trans.ts.UnixNano() / 1000) // transactions have microseconds resolution
@@ -813,15 +1102,41 @@ func (pgsql *Pgsql) receivedPgsqlRequest(msg *PgsqlMessage) {
 		trans.Pgsql = common.MapStr{}
 		trans.Query = query
 		trans.Method = getQueryMethod(query)
+		if msg.isExecute {
+			trans.extended = true
+			trans.batch = msg.batch
+			trans.Pgsql["parameters"] = msg.Params
+		}
 
 		trans.Request_raw = query
 
 		if trans.timer != nil {
 			trans.timer.Stop()
 		}
-		trans.timer = time.AfterFunc(TransactionTimeout, func() { pgsql.expireTransaction(trans) })
+		trans.timer = time.AfterFunc(pgsql.transactionTimeout, func() { pgsql.expireTransaction(trans) })
 
 		pgsql.transactionsMap[tuple.Hashable()] = append(pgsql.transactionsMap[tuple.Hashable()], trans)
+		pgsql.transactionsOrder.Add(trans)
+	}
+
+	pgsql.evictTransactions()
+}
+
+// evictTransactions publishes the oldest queries, without their
+// response, while more than maxTransactions are waiting.
+func (pgsql *Pgsql) evictTransactions() {
+	for pgsql.maxTransactions > 0 && pgsql.transactionsOrder.Len() > pgsql.maxTransactions {
+		trans, ok := pgsql.transactionsOrder.Oldest().(*PgsqlTransaction)
+		if !ok {
+			break
+		}
+		pgsql.forgetTransaction(trans)
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+
+		trans.Status = protos.OVERFLOW_STATUS
+		pgsql.publishTransaction(trans)
 	}
 }
 
@@ -854,6 +1169,12 @@ func (pgsql *Pgsql) receivedPgsqlResponse(msg *PgsqlMessage) {
 	})
 	trans.Size = msg.Size
 
+	if msg.IsError && trans.extended {
+		// after an error the backend ignores the messages up to the
+		// next Sync, the other Executes of the batch get no response
+		pgsql.dropBatch(tuple, trans.batch)
+	}
+
 	trans.ResponseTime = int32(msg.Ts.Sub(trans.ts).Nanoseconds() / 1e6) // resp_time in milliseconds
 	trans.Response_raw = common.DumpInCSVFormat(msg.Fields, msg.Rows)
 
@@ -875,7 +1196,9 @@ func (pgsql *Pgsql) publishTransaction(t *PgsqlTransaction) {
 	event := common.MapStr{}
 
 	event["type"] = "pgsql"
-	if t.Pgsql["iserror"].(bool) {
+	if len(t.Status) > 0 {
+		event["status"] = t.Status
+	} else if iserror, _ := t.Pgsql["iserror"].(bool); iserror {
 		event["status"] = common.ERROR_STATUS
 	} else {
 		event["status"] = common.OK_STATUS
@@ -895,13 +1218,46 @@ func (pgsql *Pgsql) publishTransaction(t *PgsqlTransaction) {
 	event["timestamp"] = common.Time(t.ts)
 	event["src"] = &t.Src
 	event["dst"] = &t.Dst
+	t.link.AddFields(event)
 
 	pgsql.results <- event
 }
 
+// Flush publishes the queries still waiting for their response.
+func (pgsql *Pgsql) Flush() {
+	for key, transactions := range pgsql.transactionsMap {
+		for _, trans := range transactions {
+			if trans.timer != nil {
+				trans.timer.Stop()
+			}
+			trans.Status = protos.SHUTDOWN_STATUS
+			pgsql.publishTransaction(trans)
+		}
+		delete(pgsql.transactionsMap, key)
+	}
+	pgsql.transactionsOrder = protos.NewTransactionsOrder()
+}
+
+// TransactionsInFlight returns the number of queries waiting for their
+// response.
+func (pgsql *Pgsql) TransactionsInFlight() int {
+	count := 0
+	for _, transactions := range pgsql.transactionsMap {
+		count += len(transactions)
+	}
+	return count
+}
+
 func (pgsql *Pgsql) expireTransaction(trans *PgsqlTransaction) {
 	// TODO: Here we need to PUBLISH an incomplete/timeout transaction
 	// remove from map
+	pgsql.forgetTransaction(trans)
+}
+
+// forgetTransaction removes the transaction from the queries waiting for
+// their response on the connection.
+func (pgsql *Pgsql) forgetTransaction(trans *PgsqlTransaction) {
+	pgsql.transactionsOrder.Remove(trans)
 	for i, t := range pgsql.transactionsMap[trans.tuple.Hashable()] {
 		if t == trans {
 			pgsql.removeTransaction(trans.tuple, i)
@@ -913,10 +1269,23 @@ func (pgsql *Pgsql) expireTransaction(trans *PgsqlTransaction) {
 	}
 }
 
+func (pgsql *Pgsql) dropBatch(tuple common.TcpTuple, batch int) {
+	trans_list := pgsql.transactionsMap[tuple.Hashable()]
+	for len(trans_list) > 0 && trans_list[0].extended && trans_list[0].batch == batch {
+		trans := pgsql.removeTransaction(tuple, 0)
+		logp.Debug("pgsql", "Execute without response: %s", trans.Query)
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		trans_list = pgsql.transactionsMap[tuple.Hashable()]
+	}
+}
+
 func (pgsql *Pgsql) removeTransaction(tuple common.TcpTuple, index int) *PgsqlTransaction {
 
 	trans_list := pgsql.transactionsMap[tuple.Hashable()]
 	trans := trans_list[index]
+	pgsql.transactionsOrder.Remove(trans)
 	trans_list = append(trans_list[:index], trans_list[index+1:]...)
 	if len(trans_list) == 0 {
 		delete(pgsql.transactionsMap, trans.tuple.Hashable())
@@ -9,6 +9,8 @@ import (
 	"github.com/johann8384/libbeat/logp"
 
 	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func PgsqlModForTests() *Pgsql {
@@ -239,3 +241,78 @@ func TestPgsqlParser_errorResponse(t *testing.T) {
 		t.Error("Failed to parse error message")
 	}
 }
+
+// exchange sends the request data from the client and then the response
+// data from the server, on the same connection.
+func exchange(pgsql *Pgsql, requ string, resp string) {
+	var tuple common.TcpTuple
+	ts := time.Now()
+
+	requData, _ := hex.DecodeString(requ)
+	respData, _ := hex.DecodeString(resp)
+	private := pgsql.Parse(&protos.Packet{Ts: ts, Payload: requData}, &tuple, 0, nil)
+	pgsql.Parse(&protos.Packet{Ts: ts.Add(time.Millisecond), Payload: respData},
+		&tuple, 1, private)
+}
+
+// Test a query of the extended protocol: Parse, Bind with a text and a
+// binary parameter, Describe, Execute and Sync
+func TestPgsqlParser_extendedQuery(t *testing.T) {
+	pgsql := PgsqlModForTests()
+	pgsql.results = make(chan common.MapStr, 10)
+
+	exchange(pgsql,
+		"500000003c0053454c454354206e616d652046524f4d207573657273205748455245"+
+			"206964203d20243120414e4420616374697665203d202432000000420000001b00"+
+			"0000020000000100020000000234320000000101000044000000065000450000"+
+			"000900000000005300000004",
+		"31000000043200000004540000001d00016e616d6500000000000000000000"+
+			"19ffffffffffff0000440000000f000100000005616c696365430000000d53"+
+			"454c4543542031005a0000000549")
+
+	if len(pgsql.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(pgsql.results))
+	}
+	event := <-pgsql.results
+	assert.Equal(t, "SELECT name FROM users WHERE id = $1 AND active = $2",
+		event["query"])
+	assert.Equal(t, "SELECT", event["method"])
+	assert.Equal(t, common.OK_STATUS, event["status"])
+
+	details := event["pgsql"].(common.MapStr)
+	assert.Equal(t, []string{"42", "\\x01"}, details["parameters"])
+	assert.Equal(t, 1, details["num_rows"])
+	assert.Equal(t, 1, details["num_fields"])
+}
+
+// Test a named statement executed twice in the same batch, through the
+// unnamed portal
+func TestPgsqlParser_extendedStatementReuse(t *testing.T) {
+	pgsql := PgsqlModForTests()
+	pgsql.results = make(chan common.MapStr, 10)
+
+	exchange(pgsql,
+		"500000002b733100494e5345525420494e544f206c6f6720286d7367292056414c"+
+			"55455320282431290000004200000017007331000000000100000005666972"+
+			"737400004500000009000000000042000000120073310000000001ffffffff"+
+			"0000450000000900000000005300000004",
+		"31000000043200000004430000000f494e5345525420302031003200000004430000"+
+			"000f494e5345525420302031005a0000000549")
+
+	if len(pgsql.results) != 2 {
+		t.Fatalf("Expected two events, got %d", len(pgsql.results))
+	}
+	for _, params := range [][]string{{"first"}, {"NULL"}} {
+		event := <-pgsql.results
+		assert.Equal(t, "INSERT INTO log (msg) VALUES ($1)", event["query"])
+		assert.Equal(t, params, event["pgsql"].(common.MapStr)["parameters"])
+	}
+}
+
+func TestPgsqlParser_paramTruncation(t *testing.T) {
+	pgsql := PgsqlModForTests()
+	pgsql.maxParamLength = 4
+
+	assert.Equal(t, "abcd", pgsql.formatParam([]byte("abcdef"), false))
+	assert.Equal(t, "\\x01", pgsql.formatParam([]byte{1}, true))
+}
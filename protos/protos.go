@@ -5,6 +5,7 @@ import (
 
 	"github.com/johann8384/libbeat/common"
 	"github.com/johann8384/libbeat/logp"
+	"github.com/johann8384/packetbeat/observer"
 )
 
 // ProtocolData interface to represent an upper
@@ -15,9 +16,55 @@ type ProtocolData interface{}
 type Packet struct {
 	Ts      time.Time
 	Tuple   common.IpPortTuple
+	Link    Link
 	Payload []byte
 }
 
+// Link tells how the packets of a connection were carried below IP: their
+// VLAN tags, the tunnel they went through and the device that captured
+// them. The connections with the same addresses in different VLANs or
+// tunnels are different.
+type Link struct {
+	// number of VLAN tags, the id of the inner one and of the outer
+	// one of the double tagged frames
+	Vlans     int
+	Vlan      uint16
+	OuterVlan uint16
+
+	// set for the packets carried by VXLAN or GRE, with the VNI or the
+	// key of the innermost tunnel
+	Tunneled bool
+	TunnelId uint32
+
+	// set when the packets are captured on several devices
+	Device string
+}
+
+// Key returns the link without the capturing device, to look up the
+// connections: the two directions of a connection can be captured on
+// different devices.
+func (link Link) Key() Link {
+	link.Device = ""
+	return link
+}
+
+// AddFields adds the VLAN ids, the tunnel id and the capturing device to
+// an event of the connection.
+func (link *Link) AddFields(event common.MapStr) {
+	if link.Vlans > 0 {
+		event["vlan"] = link.Vlan
+	}
+	if link.Vlans > 1 {
+		event["outer_vlan"] = link.OuterVlan
+	}
+	if link.Tunneled {
+		event["tunnel_id"] = link.TunnelId
+	}
+	if len(link.Device) > 0 {
+		observer.SetInterface(event, link.Device)
+	}
+}
+
 // Functions to be exported by a protocol plugin
 type ProtocolPlugin interface {
 	// Called to initialize the Plugin
@@ -40,6 +87,69 @@ type ProtocolPlugin interface {
 		private ProtocolData) ProtocolData
 }
 
+// Functions to be exported by a protocol plugin that also
+// parses UDP datagrams.
+type UdpProtocolPlugin interface {
+	// Called for each UDP datagram sent to or from the
+	// configured ports.
+	ParseUdp(pkt *Packet)
+}
+
+// Functions to be exported by a protocol plugin that parses
+// ICMP messages, which have no ports.
+type IcmpProtocolPlugin interface {
+	// Called for each ICMPv4 or ICMPv6 message. The payload
+	// starts with the ICMP header.
+	ParseIcmp(pkt *Packet)
+
+	// Returns true if the ICMP messages are to be captured.
+	IcmpEnabled() bool
+}
+
+// Functions to be exported by a protocol plugin that keeps
+// transactions waiting for their response.
+type FlushableProtocolPlugin interface {
+	// Called on shutdown, after the capture is stopped, to
+	// publish the transactions still waiting for their response.
+	Flush()
+}
+
+// Functions to be exported by a protocol plugin that runs its own
+// goroutines.
+type StoppableProtocolPlugin interface {
+	// Called when the plugin is replaced or removed on a reload of the
+	// configuration, after Flush, to stop its goroutines.
+	Stop()
+}
+
+// Functions to be exported by a protocol plugin that keeps
+// transactions waiting for their response, by TCP stream.
+type StreamFlushableProtocolPlugin interface {
+	// Called before the state of an idle TCP stream is released, to
+	// publish its transactions still waiting for their response.
+	FlushStream(tcptuple *common.TcpTuple, private ProtocolData)
+}
+
+// Functions to be exported by a protocol plugin that keeps
+// transactions waiting for their response.
+type InFlightProtocolPlugin interface {
+	// Returns the number of transactions waiting for their
+	// response. Called while the decoding is paused.
+	TransactionsInFlight() int
+}
+
+// Status of the transactions published on shutdown, before their
+// response was received.
+const SHUTDOWN_STATUS = "Shutdown"
+
+// Status of the transactions published when their idle TCP stream is
+// released, before their response was received.
+const EXPIRED_STATUS = "Stream expired"
+
+// Status of the transactions for which the connection was closed
+// before the response was received.
+const CONNECTION_CLOSED_STATUS = "Connection closed"
+
 // Protocol identifier.
 type Protocol uint16
 
@@ -51,6 +161,11 @@ const (
 	RedisProtocol
 	PgsqlProtocol
 	ThriftProtocol
+	DnsProtocol
+	MongodbProtocol
+	MemcacheProtocol
+	TlsProtocol
+	IcmpProtocol
 )
 
 // Protocol names
@@ -61,6 +176,11 @@ var ProtocolNames = []string{
 	"redis",
 	"pgsql",
 	"thrift",
+	"dns",
+	"mongodb",
+	"memcache",
+	"tls",
+	"icmp",
 }
 
 func (p Protocol) String() string {
@@ -94,6 +214,10 @@ func (protos Protocols) Register(proto Protocol, plugin ProtocolPlugin) {
 	protos.protos[proto] = plugin
 }
 
+func (protos Protocols) Unregister(proto Protocol) {
+	delete(protos.protos, proto)
+}
+
 func init() {
 	logp.Debug("protos", "Initializing Protos")
 	Protos = Protocols{}
@@ -3,6 +3,8 @@ package protos
 import (
 	"testing"
 
+	"github.com/johann8384/libbeat/common"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,3 +18,27 @@ func TestProtocolNames(t *testing.T) {
 
 	assert.Equal(t, "impossible", Protocol(100).String())
 }
+
+func TestLink_addFields(t *testing.T) {
+	event := common.MapStr{}
+	link := Link{}
+	link.AddFields(event)
+	assert.Equal(t, common.MapStr{}, event)
+
+	link = Link{Vlans: 1, Vlan: 100, Tunneled: true}
+	link.AddFields(event)
+	assert.Equal(t, common.MapStr{"vlan": uint16(100), "tunnel_id": uint32(0)}, event)
+
+	event = common.MapStr{}
+	link = Link{Vlans: 2, Vlan: 20, OuterVlan: 10}
+	link.AddFields(event)
+	assert.Equal(t, common.MapStr{"vlan": uint16(20), "outer_vlan": uint16(10)}, event)
+
+	// the device is published by the observer, and doesn't tell the
+	// connections apart
+	event = common.MapStr{}
+	link = Link{Vlans: 1, Vlan: 20, Device: "eth1"}
+	link.AddFields(event)
+	assert.Equal(t, common.MapStr{"vlan": uint16(20), "observer.interface": "eth1"}, event)
+	assert.Equal(t, Link{Vlans: 1, Vlan: 20}, link.Key())
+}
@@ -0,0 +1,125 @@
+// Package protostest drives the protocol plugins with synthetic TCP
+// segments, so that their tests can go through the TCP reassembly and the
+// Parse calls without pcap files.
+package protostest
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/tcp"
+
+	"github.com/tsg/gopacket/layers"
+)
+
+// Directions of the segments.
+const (
+	ClientToServer = iota
+	ServerToClient
+)
+
+// Addresses of the replayed connections. Each replay gets its own client
+// port, so that it does not reuse the TCP stream of the previous one.
+var (
+	ClientIp = net.IPv4(192, 168, 0, 1)
+	ServerIp = net.IPv4(192, 168, 0, 2)
+
+	clientPort uint16 = 40000
+)
+
+// Segment is the payload sent in one direction of the connection. The
+// FIN flag closes the direction after the payload.
+type Segment struct {
+	Dir     int
+	Payload []byte
+	Ts      time.Time
+	Fin     bool
+
+	// Offset of the segment in the data sent in its direction, as told
+	// by its sequence number. The segments follow each other when it is
+	// zero, setting it replays retransmitted or out of order segments.
+	Offset *uint32
+}
+
+// ReplayTcp registers the plugin for the protocol, sends it the segments
+// of a connection to its first port, and returns the events it published
+// to results. The plugin must be initialized with results, buffered
+// enough for the events, and have at least a port.
+func ReplayTcp(proto protos.Protocol, plugin protos.ProtocolPlugin,
+	results chan common.MapStr, segments ...Segment) ([]common.MapStr, error) {
+
+	ports := plugin.GetPorts()
+	if len(ports) == 0 {
+		return nil, errors.New("the plugin has no port")
+	}
+	return ReplayTcpOnPort(proto, plugin, uint16(ports[0]), results, segments...)
+}
+
+// ReplayTcpOnPort is ReplayTcp with a connection to the given server port,
+// which can be one of no plugin.
+func ReplayTcpOnPort(proto protos.Protocol, plugin protos.ProtocolPlugin, port uint16,
+	results chan common.MapStr, segments ...Segment) ([]common.MapStr, error) {
+
+	previous := protos.Protos.Get(proto)
+	protos.Protos.Register(proto, plugin)
+	defer func() {
+		if previous != nil {
+			protos.Protos.Register(proto, previous)
+		} else {
+			protos.Protos.Unregister(proto)
+		}
+		tcp.TcpInit()
+	}()
+	if err := tcp.TcpInit(); err != nil {
+		return nil, err
+	}
+
+	clientPort++
+	client := common.NewIpPortTuple(4, ClientIp, clientPort, ServerIp, port)
+	server := common.NewIpPortTuple(4, ServerIp, port, ClientIp, clientPort)
+
+	// the initial sequence numbers are arbitrary
+	start := [2]uint32{1000, 5000}
+	sent := [2]uint32{}
+	for _, segment := range segments {
+		if segment.Dir != ClientToServer && segment.Dir != ServerToClient {
+			return nil, errors.New("unknown direction of a segment")
+		}
+
+		offset := sent[segment.Dir]
+		if segment.Offset != nil {
+			offset = *segment.Offset
+		}
+		if end := offset + uint32(len(segment.Payload)); end > sent[segment.Dir] {
+			sent[segment.Dir] = end
+		}
+
+		ts := segment.Ts
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		pkt := &protos.Packet{Ts: ts, Tuple: client, Payload: segment.Payload}
+		if segment.Dir == ServerToClient {
+			pkt.Tuple = server
+		}
+		tcphdr := &layers.TCP{
+			Seq: start[segment.Dir] + offset,
+			FIN: segment.Fin,
+		}
+		tcp.FollowTcp(tcphdr, pkt)
+	}
+
+	events := []common.MapStr{}
+	for {
+		select {
+		case event := <-results:
+			events = append(events, event)
+		default:
+			return events, nil
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package protostest
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/tcp"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder publishes an event for each payload and FIN it receives.
+type recorder struct {
+	results chan common.MapStr
+}
+
+func (rec *recorder) Init(test_mode bool, results chan common.MapStr) error {
+	rec.results = results
+	return nil
+}
+
+func (rec *recorder) GetPorts() []int {
+	return []int{7777}
+}
+
+func (rec *recorder) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
+	dir uint8, private protos.ProtocolData) protos.ProtocolData {
+
+	rec.results <- common.MapStr{"dir": dir, "payload": string(pkt.Payload),
+		"client_port": pkt.Tuple.Src_port}
+	return private
+}
+
+func (rec *recorder) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	rec.results <- common.MapStr{"dir": dir, "fin": true}
+	return private
+}
+
+func (rec *recorder) GapInStream(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+	return private
+}
+
+func offset(n uint32) *uint32 {
+	return &n
+}
+
+func TestReplayTcp_reassembly(t *testing.T) {
+	results := make(chan common.MapStr, 10)
+	rec := &recorder{}
+	rec.Init(true, results)
+
+	events, err := ReplayTcp(protos.HttpProtocol, rec, results,
+		Segment{Dir: ClientToServer, Payload: []byte("abc")},
+		// out of order, then retransmitted
+		Segment{Dir: ClientToServer, Payload: []byte("ghi"), Offset: offset(6)},
+		Segment{Dir: ClientToServer, Payload: []byte("def"), Offset: offset(3)},
+		Segment{Dir: ClientToServer, Payload: []byte("def"), Offset: offset(3)},
+		Segment{Dir: ServerToClient, Payload: []byte("ok"), Fin: true},
+	)
+	assert.Nil(t, err)
+
+	payloads := []interface{}{}
+	for _, event := range events {
+		payloads = append(payloads, event["payload"])
+	}
+	assert.Equal(t, []interface{}{"abc", "def", "ghi", "ok", nil}, payloads)
+
+	original := uint8(tcp.TcpDirectionOriginal)
+	reverse := uint8(tcp.TcpDirectionReverse)
+	if assert.Len(t, events, 5) {
+		assert.Equal(t, original, events[0]["dir"])
+		assert.Equal(t, reverse, events[3]["dir"])
+		assert.Equal(t, common.MapStr{"dir": reverse, "fin": true}, events[4])
+	}
+
+	// the plugin is unregistered afterwards
+	assert.Nil(t, protos.Protos.Get(protos.HttpProtocol))
+}
+
+func TestReplayTcp_newConnection(t *testing.T) {
+	results := make(chan common.MapStr, 10)
+	rec := &recorder{}
+	rec.Init(true, results)
+
+	first, err := ReplayTcp(protos.HttpProtocol, rec, results,
+		Segment{Dir: ClientToServer, Payload: []byte("a")})
+	assert.Nil(t, err)
+	second, err := ReplayTcp(protos.HttpProtocol, rec, results,
+		Segment{Dir: ClientToServer, Payload: []byte("b")})
+	assert.Nil(t, err)
+
+	if assert.Len(t, first, 1) && assert.Len(t, second, 1) {
+		assert.NotEqual(t, first[0]["client_port"], second[0]["client_port"])
+	}
+}
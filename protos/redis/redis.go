@@ -16,9 +16,10 @@ import (
 )
 
 type RedisMessage struct {
-	Ts            time.Time
-	NumberOfBulks int64
-	Bulks         []string
+	Ts    time.Time
+	Link  protos.Link
+	Kind  byte
+	Bulks []string
 
 	TcpTuple     common.TcpTuple
 	CmdlineTuple *common.CmdlineTuple
@@ -39,6 +40,7 @@ type RedisStream struct {
 
 	parseOffset   int
 	bytesReceived int
+	parser        respParser
 
 	message *RedisMessage
 }
@@ -46,6 +48,7 @@ type RedisStream struct {
 type RedisTransaction struct {
 	Type         string
 	tuple        common.TcpTuple
+	link         protos.Link
 	Src          common.Endpoint
 	Dst          common.Endpoint
 	ResponseTime int32
@@ -57,6 +60,7 @@ type RedisTransaction struct {
 	Path         string
 	Query        string
 	IsError      bool
+	Status       string
 	BytesOut     int
 	BytesIn      int
 
@@ -111,6 +115,7 @@ var RedisCommands = map[string]struct{}{
 	"GETRANGE":         struct{}{},
 	"GETSET":           struct{}{},
 	"HDEL":             struct{}{},
+	"HELLO":            struct{}{},
 	"HEXISTS":          struct{}{},
 	"HGET":             struct{}{},
 	"HGETALL":          struct{}{},
@@ -233,15 +238,23 @@ var RedisCommands = map[string]struct{}{
 const (
 	TransactionsHashSize = 2 ^ 16
 	TransactionTimeout   = 10 * 1e9
+
+	// The commands of a MULTI block kept for its event. A client that
+	// never sends EXEC, or an EXEC that is not captured, would otherwise
+	// grow the list for the life of the connection.
+	MaxQueuedCommands = 1000
 )
 
 type Redis struct {
 	// config
-	Ports         []int
-	Send_request  bool
-	Send_response bool
+	Ports              []int
+	Send_request       bool
+	Send_response      bool
+	maxTransactions    int
+	transactionTimeout time.Duration
 
-	transactionsMap map[common.HashableTcpTuple]*RedisTransaction
+	transactionsMap   map[common.HashableTcpTuple]*RedisTransaction
+	transactionsOrder *protos.TransactionsOrder
 
 	results chan common.MapStr
 }
@@ -249,6 +262,8 @@ type Redis struct {
 func (redis *Redis) InitDefaults() {
 	redis.Send_request = false
 	redis.Send_response = false
+	redis.maxTransactions = protos.DefaultMaxTransactions
+	redis.transactionTimeout = TransactionTimeout
 }
 
 func (redis *Redis) setFromConfig(config config.Redis) error {
@@ -261,6 +276,12 @@ func (redis *Redis) setFromConfig(config config.Redis) error {
 	if config.Send_response != nil {
 		redis.Send_response = *config.Send_response
 	}
+	if config.Max_transactions != nil {
+		redis.maxTransactions = *config.Max_transactions
+	}
+	if config.Transaction_timeout != nil {
+		redis.transactionTimeout = time.Duration(*config.Transaction_timeout) * time.Second
+	}
 	return nil
 }
 
@@ -275,6 +296,7 @@ func (redis *Redis) Init(test_mode bool, results chan common.MapStr) error {
 	}
 
 	redis.transactionsMap = make(map[common.HashableTcpTuple]*RedisTransaction, TransactionsHashSize)
+	redis.transactionsOrder = protos.NewTransactionsOrder()
 	redis.results = results
 
 	return nil
@@ -283,166 +305,62 @@ func (redis *Redis) Init(test_mode bool, results chan common.MapStr) error {
 func (stream *RedisStream) PrepareForNewMessage() {
 	stream.data = stream.data[stream.parseOffset:]
 	stream.parseOffset = 0
-	stream.message = &RedisMessage{Ts: stream.message.Ts}
+	stream.message = &RedisMessage{Ts: stream.message.Ts, Link: stream.message.Link}
 	stream.message.Bulks = []string{}
 }
 
 func redisMessageParser(s *RedisStream) (bool, bool) {
 
-	var err error
-	var value string
 	m := s.message
 
-	iserror := false
-
-	for s.parseOffset < len(s.data) {
-
-		if s.data[s.parseOffset] == '*' {
-			//Multi Bulk Message
-
-			found, line, off := readLine(s.data, s.parseOffset)
-			if !found {
-				logp.Debug("redis", "End of line not found, waiting for more data")
-				return true, false
-			}
-
-			if len(line) == 3 && line[1] == '-' && line[2] == '1' {
-				//NULL Multi Bulk
-				s.parseOffset = off
-				value = "nil"
-			} else {
-
-				m.NumberOfBulks, err = strconv.ParseInt(line[1:], 10, 64)
-
-				if err != nil {
-					logp.Err("Failed to read number of bulk messages: %s", err)
-					return false, false
-				}
-				s.parseOffset = off
-				m.Bulks = []string{}
-
-				continue
-			}
-
-		} else if s.data[s.parseOffset] == '$' {
-			old_offset := s.parseOffset
-			// Bulk Reply
-
-			found, line, off := readLine(s.data, s.parseOffset)
-			if !found {
-				logp.Debug("redis", "End of line not found, waiting for more data")
-				s.parseOffset = old_offset
-				return true, false
-			}
-
-			if len(line) == 3 && line[1] == '-' && line[2] == '1' {
-				// NULL Bulk Reply
-				value = "nil"
-				s.parseOffset = off
-			} else {
-				length, err := strconv.ParseInt(line[1:], 10, 64)
-				if err != nil {
-					logp.Err("Failed to read bulk message: %s", err)
-					return false, false
-				}
-
-				s.parseOffset = off
-
-				found, line, off = readLine(s.data, s.parseOffset)
-				if !found {
-					logp.Debug("redis", "End of line not found, waiting for more data")
-					s.parseOffset = old_offset
-					return true, false
-				}
-
-				if int64(len(line)) != length {
-					logp.Err("Wrong length of data: %d instead of %d", len(line), length)
-					return false, false
-				}
-				value = line
-				s.parseOffset = off
-			}
-
-		} else if s.data[s.parseOffset] == ':' {
-			// Integer reply
-			found, line, off := readLine(s.data, s.parseOffset)
-			if !found {
-				return true, false
-			}
-			n, err := strconv.ParseInt(line[1:], 10, 64)
-
-			if err != nil {
-				logp.Err("Failed to read integer reply: %s", err)
-				return false, false
-			}
-			value = strconv.Itoa(int(n))
-			s.parseOffset = off
-
-		} else if s.data[s.parseOffset] == '+' {
-			// Status Reply
-			found, line, off := readLine(s.data, s.parseOffset)
-			if !found {
-				return true, false
-			}
+	value, off, err := s.parser.read(s.data, s.parseOffset)
+	if err == errRespIncomplete {
+		logp.Debug("redis", "Incomplete message, waiting for more data")
+		s.parseOffset = off
+		return true, false
+	}
+	if err != nil {
+		logp.Err("Failed to parse Redis message: %s", err)
+		return false, false
+	}
+	s.parseOffset = off
 
-			value = line[1:]
-			s.parseOffset = off
-		} else if s.data[s.parseOffset] == '-' {
-			// Error Reply
-			found, line, off := readLine(s.data, s.parseOffset)
-			if !found {
-				return true, false
-			}
-			iserror = true
+	m.Kind = value.kind
+	m.Size = s.parseOffset
+	m.IsError = value.isError()
 
-			value = line[1:]
-			s.parseOffset = off
-		} else {
-			logp.Debug("redis", "Unexpected message starting with %s", s.data[s.parseOffset:])
-			return false, false
-		}
-
-		// add value
-		if m.NumberOfBulks > 0 {
-			m.NumberOfBulks = m.NumberOfBulks - 1
-			m.Bulks = append(m.Bulks, value)
-
-			if len(m.Bulks) == 1 {
-				logp.Debug("redis", "Value: %s", value)
-				// first word.
-				// check if it's a command
-				if isRedisCommand(value) {
-					logp.Debug("redis", "is request")
-					m.IsRequest = true
-					m.Method = value
-				}
-			}
+	if !value.isAggregate() || value.null {
+		m.Message = value.String()
+		return true, true
+	}
 
-			if len(m.Bulks) == 2 {
-				// second word. This is usually the path
-				if m.IsRequest {
-					m.Path = value
-				}
-			}
+	m.Bulks = value.elemStrings()
+	if value.kind == respMap {
+		m.Message = formatRespMap(m.Bulks)
+	} else {
+		m.Message = strings.Join(m.Bulks, " ")
+	}
 
-			if m.NumberOfBulks == 0 {
-				// the last bulk received
-				m.Message = strings.Join(m.Bulks, " ")
-				m.Size = s.parseOffset
-				return true, true
-			}
-		} else {
-			m.Message = value
-			m.Size = s.parseOffset
-			if iserror {
-				m.IsError = true
-			}
+	// the requests are arrays of bulk strings, starting with the command
+	if value.kind != respArray || len(value.elems) == 0 {
+		return true, true
+	}
+	for _, elem := range value.elems {
+		if elem.kind != respBulk || elem.null {
 			return true, true
 		}
+	}
+	if isRedisCommand(m.Bulks[0]) {
+		logp.Debug("redis", "is request")
+		m.IsRequest = true
+		m.Method = m.Bulks[0]
+		if len(m.Bulks) > 1 {
+			// the second word is usually the path
+			m.Path = m.Bulks[1]
+		}
+	}
 
-	} //end for
-
-	return true, false
+	return true, true
 }
 
 func readLine(data []byte, offset int) (bool, string, int) {
@@ -455,6 +373,34 @@ func readLine(data []byte, offset int) (bool, string, int) {
 
 type redisPrivateData struct {
 	Data [2]*RedisStream
+	Conn *redisConnection
+
+	// set when the connection is encrypted
+	Tls *protos.TlsUpgrade
+}
+
+// redisConnection is the state of a connection that spans several
+// commands.
+type redisConnection struct {
+	// the MULTI command, once confirmed by the server, collects the
+	// commands queued until EXEC or DISCARD
+	multi  *RedisTransaction
+	queued []string
+	// the commands of the block past MaxQueuedCommands
+	dropped int
+
+	// the channels and the patterns the client is subscribed to
+	subscriptions map[string]bool
+
+	// RESP2, unless RESP3 is negotiated with HELLO
+	protocolVersion int
+}
+
+func newRedisConnection() *redisConnection {
+	return &redisConnection{
+		subscriptions:   map[string]bool{},
+		protocolVersion: 2,
+	}
 }
 
 func (redis *Redis) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple, dir uint8,
@@ -471,17 +417,41 @@ func (redis *Redis) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple, dir uin
 		}
 	}
 
+	if priv.Conn == nil {
+		priv.Conn = newRedisConnection()
+	}
+
+	if priv.Tls != nil {
+		if priv.Tls.Received(pkt, dir) {
+			redis.publishTlsUpgrade(priv.Tls, tcptuple)
+		}
+		return priv
+	}
+	if (priv.Data[dir] == nil || len(priv.Data[dir].data) == 0) &&
+		protos.IsTlsClientHello(pkt.Payload) {
+
+		logp.Debug("redis", "TLS ClientHello received, the connection is encrypted")
+		priv.Tls = protos.NewTlsUpgrade(pkt, dir)
+		priv.Data = [2]*RedisStream{}
+		return priv
+	}
+
 	if priv.Data[dir] == nil {
 		priv.Data[dir] = &RedisStream{
 			tcptuple: tcptuple,
 			data:     pkt.Payload,
-			message:  &RedisMessage{Ts: pkt.Ts},
+			message:  &RedisMessage{Ts: pkt.Ts, Link: pkt.Link},
 		}
 	} else {
+		if len(priv.Data[dir].data) == 0 {
+			// a new message starts with this packet
+			priv.Data[dir].message.Ts = pkt.Ts
+		}
 		// concatenate bytes
 		priv.Data[dir].data = append(priv.Data[dir].data, pkt.Payload...)
-		if len(priv.Data[dir].data) > tcp.TCP_MAX_DATA_IN_STREAM {
+		if len(priv.Data[dir].data) > tcp.MaxDataInStream {
 			logp.Debug("redis", "Stream data too large, dropping TCP stream")
+			protos.Stats.CountTooLarge(protos.RedisProtocol)
 			priv.Data[dir] = nil
 			return priv
 		}
@@ -490,7 +460,7 @@ func (redis *Redis) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple, dir uin
 	stream := priv.Data[dir]
 	for len(stream.data) > 0 {
 		if stream.message == nil {
-			stream.message = &RedisMessage{Ts: pkt.Ts}
+			stream.message = &RedisMessage{Ts: pkt.Ts, Link: pkt.Link}
 		}
 
 		ok, complete := redisMessageParser(priv.Data[dir])
@@ -500,6 +470,8 @@ func (redis *Redis) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple, dir uin
 			// segment in it
 			priv.Data[dir] = nil
 			logp.Debug("redis", "Ignore Redis message. Drop tcp stream. Try parsing with the next segment")
+			protos.ReportParseError(protos.RedisProtocol, tcptuple, pkt,
+				"Invalid Redis message")
 			return priv
 		}
 
@@ -512,7 +484,7 @@ func (redis *Redis) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple, dir uin
 			}
 
 			// all ok, go to next level
-			redis.handleRedis(stream.message, tcptuple, dir)
+			redis.handleRedis(stream.message, tcptuple, dir, priv.Conn)
 
 			// and reset message
 			stream.PrepareForNewMessage()
@@ -531,7 +503,7 @@ func isRedisCommand(key string) bool {
 }
 
 func (redis *Redis) handleRedis(m *RedisMessage, tcptuple *common.TcpTuple,
-	dir uint8) {
+	dir uint8, conn *redisConnection) {
 
 	m.TcpTuple = *tcptuple
 	m.Direction = dir
@@ -539,9 +511,212 @@ func (redis *Redis) handleRedis(m *RedisMessage, tcptuple *common.TcpTuple,
 
 	if m.IsRequest {
 		redis.receivedRedisRequest(m)
+	} else if !redis.receivedPush(conn, m) {
+		redis.receivedRedisResponse(conn, m)
+	}
+}
+
+// receivedPush handles the replies that are pushed by the server, like
+// the messages delivered to the subscribed clients. It returns false if
+// the message is not one of them and is the response to a pending
+// request. RESP3 has a type for them, in RESP2 they are arrays.
+func (redis *Redis) receivedPush(conn *redisConnection, msg *RedisMessage) bool {
+	push := msg.Kind == respPush
+	if !push && (msg.Kind != respArray || conn.protocolVersion >= 3) {
+		return false
+	}
+	if len(msg.Bulks) == 0 {
+		return push
+	}
+
+	kind := strings.ToLower(msg.Bulks[0])
+	switch {
+	case len(msg.Bulks) >= 3 && (kind == "subscribe" || kind == "psubscribe" ||
+		kind == "unsubscribe" || kind == "punsubscribe"):
+		// a command with several channels gets a confirmation per
+		// channel, the first one is the response to the command
+		name := msg.Bulks[1]
+		if kind[0] == 'p' {
+			name = "pattern:" + name
+		}
+		if strings.HasSuffix(kind, "unsubscribe") {
+			delete(conn.subscriptions, name)
+		} else {
+			conn.subscriptions[name] = true
+		}
+		if msg.Bulks[2] == "0" {
+			// the client is not subscribed to anything anymore
+			conn.subscriptions = map[string]bool{}
+		}
+
+		trans := redis.transactionsMap[msg.TcpTuple.Hashable()]
+		pending := trans != nil && trans.Redis != nil &&
+			strings.HasSuffix(strings.ToLower(trans.Method), "subscribe")
+		return !pending
+
+	case kind == "message" && len(msg.Bulks) >= 3,
+		kind == "pmessage" && len(msg.Bulks) >= 4:
+		if !push && len(conn.subscriptions) == 0 {
+			// a reply that only looks like a message
+			return false
+		}
+		redis.publishPush(msg)
+		return true
+
+	case push:
+		redis.publishPush(msg)
+		return true
+	}
+
+	return false
+}
+
+// publishPush publishes a reply pushed by the server, like the delivery
+// of a message to a subscribed client. The source of the event is the
+// client, like for the commands.
+func (redis *Redis) publishPush(msg *RedisMessage) {
+	if notification := keyspaceNotification(msg); notification != nil {
+		redis.publishNotification(msg, notification)
+		return
+	}
+
+	trans := &RedisTransaction{
+		Type:   "redis",
+		tuple:  msg.TcpTuple,
+		link:   msg.Link,
+		Method: msg.Bulks[0],
+		Redis:  common.MapStr{},
+	}
+
+	switch strings.ToLower(trans.Method) {
+	case "message":
+		trans.Redis["channel"] = msg.Bulks[1]
+		trans.Path = msg.Bulks[1]
+		trans.Response_raw = msg.Bulks[2]
+	case "pmessage":
+		trans.Redis["pattern"] = msg.Bulks[1]
+		trans.Redis["channel"] = msg.Bulks[2]
+		trans.Path = msg.Bulks[2]
+		trans.Response_raw = msg.Bulks[3]
+	default:
+		// for example the invalidation of the keys cached by the client
+		if len(msg.Bulks) > 1 {
+			trans.Path = msg.Bulks[1]
+		}
+		trans.Redis["return_value"] = msg.Message
+		trans.Response_raw = msg.Message
+	}
+	trans.Query = strings.TrimSpace(strings.ToLower(trans.Method) + " " + trans.Path)
+	trans.BytesOut = msg.Size
+
+	trans.cmdline = msg.CmdlineTuple
+	trans.ts = msg.Ts
+	trans.Ts = int64(trans.ts.UnixNano() / 1000)
+	trans.JsTs = msg.Ts
+	trans.Src, trans.Dst = pushEndpoints(msg)
+
+	redis.publishTransaction(trans)
+}
+
+// pushEndpoints returns the client and the server of a reply pushed by
+// the server.
+func pushEndpoints(msg *RedisMessage) (common.Endpoint, common.Endpoint) {
+	src := common.Endpoint{
+		Ip:   msg.TcpTuple.Src_ip.String(),
+		Port: msg.TcpTuple.Src_port,
+		Proc: string(msg.CmdlineTuple.Src),
+	}
+	dst := common.Endpoint{
+		Ip:   msg.TcpTuple.Dst_ip.String(),
+		Port: msg.TcpTuple.Dst_port,
+		Proc: string(msg.CmdlineTuple.Dst),
+	}
+	if msg.Direction != tcp.TcpDirectionReverse {
+		// sent by the server
+		src, dst = dst, src
+	}
+	return src, dst
+}
+
+// keyspaceNotification decodes the message of a keyspace notification,
+// sent by the server on the __keyspace@<db>__:<key> channels with the
+// event as payload, and on the __keyevent@<db>__:<event> channels with
+// the key as payload. It returns nil for the other messages.
+func keyspaceNotification(msg *RedisMessage) common.MapStr {
+	var channel, payload string
+	switch strings.ToLower(msg.Bulks[0]) {
+	case "message":
+		if len(msg.Bulks) < 3 {
+			return nil
+		}
+		channel, payload = msg.Bulks[1], msg.Bulks[2]
+	case "pmessage":
+		if len(msg.Bulks) < 4 {
+			return nil
+		}
+		channel, payload = msg.Bulks[2], msg.Bulks[3]
+	default:
+		return nil
+	}
+
+	var kind string
+	switch {
+	case strings.HasPrefix(channel, "__keyspace@"):
+		kind = "keyspace"
+	case strings.HasPrefix(channel, "__keyevent@"):
+		kind = "keyevent"
+	default:
+		return nil
+	}
+	rest := channel[strings.IndexByte(channel, '@')+1:]
+	end := strings.Index(rest, "__:")
+	if end <= 0 {
+		return nil
+	}
+	db, err := strconv.Atoi(rest[:end])
+	if err != nil {
+		return nil
+	}
+	name := rest[end+len("__:"):]
+
+	notification := common.MapStr{
+		"kind":    kind,
+		"db":      db,
+		"channel": channel,
+	}
+	if kind == "keyspace" {
+		notification["key"] = name
+		notification["event"] = payload
 	} else {
-		redis.receivedRedisResponse(m)
+		notification["key"] = payload
+		notification["event"] = name
 	}
+	return notification
+}
+
+// publishNotification publishes a keyspace notification delivered to a
+// subscribed client as a redis_notification event, separate from the
+// other messages as it describes a change of the data, not the traffic
+// of the application.
+func (redis *Redis) publishNotification(msg *RedisMessage, notification common.MapStr) {
+	if redis.results == nil {
+		return
+	}
+
+	if strings.ToLower(msg.Bulks[0]) == "pmessage" {
+		notification["pattern"] = msg.Bulks[1]
+	}
+	src, dst := pushEndpoints(msg)
+	event := common.MapStr{
+		"type":               "redis_notification",
+		"status":             common.OK_STATUS,
+		"redis_notification": notification,
+		"timestamp":          common.Time(msg.Ts),
+		"src":                &src,
+		"dst":                &dst,
+	}
+	msg.Link.AddFields(event)
+	redis.results <- event
 }
 
 func (redis *Redis) receivedRedisRequest(msg *RedisMessage) {
@@ -558,6 +733,7 @@ func (redis *Redis) receivedRedisRequest(msg *RedisMessage) {
 		redis.transactionsMap[tuple.Hashable()] = trans
 	}
 
+	trans.link = msg.Link
 	trans.Redis = common.MapStr{}
 	trans.Method = msg.Method
 	trans.Path = msg.Path
@@ -586,17 +762,79 @@ func (redis *Redis) receivedRedisRequest(msg *RedisMessage) {
 	if trans.timer != nil {
 		trans.timer.Stop()
 	}
-	trans.timer = time.AfterFunc(TransactionTimeout, func() { redis.expireTransaction(trans) })
+	trans.timer = time.AfterFunc(redis.transactionTimeout, func() { redis.expireTransaction(trans) })
+
+	redis.transactionsOrder.Add(trans)
+	redis.evictTransactions()
+}
+
+// evictTransactions publishes the oldest commands, without their
+// response, while more than maxTransactions are waiting.
+func (redis *Redis) evictTransactions() {
+	for redis.maxTransactions > 0 && redis.transactionsOrder.Len() > redis.maxTransactions {
+		trans, ok := redis.transactionsOrder.Oldest().(*RedisTransaction)
+		if !ok {
+			break
+		}
+		redis.removeTransaction(trans)
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+
+		trans.Status = protos.OVERFLOW_STATUS
+		redis.publishTransaction(trans)
+	}
+}
 
+func (redis *Redis) removeTransaction(trans *RedisTransaction) {
+	delete(redis.transactionsMap, trans.tuple.Hashable())
+	redis.transactionsOrder.Remove(trans)
+}
+
+// Flush publishes the commands still waiting for their response.
+func (redis *Redis) Flush() {
+	for key, trans := range redis.transactionsMap {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		delete(redis.transactionsMap, key)
+		redis.transactionsOrder.Remove(trans)
+
+		trans.Status = protos.SHUTDOWN_STATUS
+		redis.publishTransaction(trans)
+	}
+}
+
+// FlushStream publishes the command of the idle stream still waiting for
+// its response.
+func (redis *Redis) FlushStream(tcptuple *common.TcpTuple, private protos.ProtocolData) {
+	trans := redis.transactionsMap[tcptuple.Hashable()]
+	if trans == nil || trans.Redis == nil {
+		return
+	}
+
+	if trans.timer != nil {
+		trans.timer.Stop()
+	}
+	redis.removeTransaction(trans)
+
+	trans.Status = protos.EXPIRED_STATUS
+	redis.publishTransaction(trans)
+}
+
+// TransactionsInFlight returns the number of requests waiting for their
+// response.
+func (redis *Redis) TransactionsInFlight() int {
+	return len(redis.transactionsMap)
 }
 
 func (redis *Redis) expireTransaction(trans *RedisTransaction) {
 
 	// remove from map
-	delete(redis.transactionsMap, trans.tuple.Hashable())
+	redis.removeTransaction(trans)
 }
 
-func (redis *Redis) receivedRedisResponse(msg *RedisMessage) {
+func (redis *Redis) receivedRedisResponse(conn *redisConnection, msg *RedisMessage) {
 
 	tuple := msg.TcpTuple
 	trans := redis.transactionsMap[tuple.Hashable()]
@@ -623,18 +861,86 @@ func (redis *Redis) receivedRedisResponse(msg *RedisMessage) {
 
 	trans.ResponseTime = int32(msg.Ts.Sub(trans.ts).Nanoseconds() / 1e6) // resp_time in milliseconds
 
-	redis.publishTransaction(trans)
-
-	logp.Debug("redis", "Redis transaction completed: %s", trans.Redis)
+	redis.completeTransaction(conn, trans, msg)
 
 	// remove from map
-	delete(redis.transactionsMap, trans.tuple.Hashable())
+	redis.removeTransaction(trans)
 	if trans.timer != nil {
 		trans.timer.Stop()
 	}
 
 }
 
+// completeTransaction publishes a command and its response, unless it
+// is part of a MULTI/EXEC block. The commands of the block are
+// published together, with the response of EXEC.
+func (redis *Redis) completeTransaction(conn *redisConnection,
+	trans *RedisTransaction, msg *RedisMessage) {
+
+	method := strings.ToUpper(trans.Method)
+	if method == "HELLO" && !trans.IsError {
+		if version, err := strconv.Atoi(trans.Path); err == nil {
+			logp.Debug("redis", "Protocol version %d negotiated", version)
+			conn.protocolVersion = version
+		}
+	}
+
+	switch {
+	case method == "MULTI" && !trans.IsError:
+		conn.multi = trans
+		conn.queued = []string{}
+		conn.dropped = 0
+		logp.Debug("redis", "MULTI block started")
+		return
+
+	case conn.multi == nil:
+		// not in a MULTI block
+
+	case method == "EXEC":
+		multi := conn.multi
+		conn.multi = nil
+
+		multi.Method = trans.Method
+		multi.IsError = trans.IsError
+		multi.Redis = common.MapStr{"commands": conn.queued}
+		if conn.dropped > 0 {
+			multi.Redis["commands_dropped"] = conn.dropped
+		}
+		for k, v := range trans.Redis {
+			multi.Redis[k] = v
+		}
+		parts := append([]string{multi.Query}, conn.queued...)
+		multi.Query = strings.Join(append(parts, trans.Query), "; ")
+		multi.Request_raw = multi.Query
+		multi.Response_raw = trans.Response_raw
+		multi.BytesIn += trans.BytesIn
+		multi.BytesOut += trans.BytesOut
+		multi.ResponseTime = int32(msg.Ts.Sub(multi.ts).Nanoseconds() / 1e6)
+		trans = multi
+
+	case method == "DISCARD":
+		logp.Debug("redis", "MULTI block discarded: %s", conn.queued)
+		conn.multi = nil
+		conn.queued = nil
+
+	default:
+		// queued, or refused if the command is invalid, in which case
+		// EXEC fails
+		if len(conn.queued) < MaxQueuedCommands {
+			conn.queued = append(conn.queued, trans.Query)
+		} else {
+			conn.dropped++
+		}
+		conn.multi.BytesIn += trans.BytesIn
+		conn.multi.BytesOut += trans.BytesOut
+		return
+	}
+
+	redis.publishTransaction(trans)
+
+	logp.Debug("redis", "Redis transaction completed: %s", trans.Redis)
+}
+
 func (redis *Redis) GapInStream(tcptuple *common.TcpTuple, dir uint8,
 	private protos.ProtocolData) protos.ProtocolData {
 
@@ -646,10 +952,24 @@ func (redis *Redis) GapInStream(tcptuple *common.TcpTuple, dir uint8,
 func (redis *Redis) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 	private protos.ProtocolData) protos.ProtocolData {
 
-	// TODO
+	priv, ok := private.(redisPrivateData)
+	if ok && priv.Tls != nil && !priv.Tls.Published {
+		// closed before the ServerHello
+		redis.publishTlsUpgrade(priv.Tls, tcptuple)
+	}
 	return private
 }
 
+// publishTlsUpgrade publishes the event of an encrypted connection, which
+// is not parsed.
+func (redis *Redis) publishTlsUpgrade(t *protos.TlsUpgrade, tcptuple *common.TcpTuple) {
+	cmdline := procs.ProcWatcher.FindProcessesTuple(tcptuple.IpPort())
+	event := t.Event("redis", tcptuple, cmdline, t.ClientDir == tcp.TcpDirectionReverse)
+	if redis.results != nil {
+		redis.results <- event
+	}
+}
+
 func (redis *Redis) publishTransaction(t *RedisTransaction) {
 
 	if redis.results == nil {
@@ -658,7 +978,9 @@ func (redis *Redis) publishTransaction(t *RedisTransaction) {
 
 	event := common.MapStr{}
 	event["type"] = "redis"
-	if !t.IsError {
+	if len(t.Status) > 0 {
+		event["status"] = t.Status
+	} else if !t.IsError {
 		event["status"] = common.OK_STATUS
 	} else {
 		event["status"] = common.ERROR_STATUS
@@ -680,6 +1002,7 @@ func (redis *Redis) publishTransaction(t *RedisTransaction) {
 	event["timestamp"] = common.Time(t.ts)
 	event["src"] = &t.Src
 	event["dst"] = &t.Dst
+	t.link.AddFields(event)
 
 	redis.results <- event
 }
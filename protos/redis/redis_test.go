@@ -2,9 +2,48 @@ package redis
 
 import (
 	"encoding/hex"
+	"net"
 	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
 )
 
+func RedisModForTests() *Redis {
+	var redis Redis
+	redis.Init(true, nil)
+	redis.results = make(chan common.MapStr, 10)
+	return &redis
+}
+
+func testTcpTuple() *common.TcpTuple {
+	t := &common.TcpTuple{
+		Ip_length: 4,
+		Src_ip:    net.IPv4(192, 168, 0, 1), Dst_ip: net.IPv4(192, 168, 0, 2),
+		Src_port: 6512, Dst_port: 6379,
+	}
+	t.ComputeHashebles()
+	return t
+}
+
+// converse feeds the messages to the parser, alternating between the
+// client and the server, one millisecond apart.
+func converse(redis *Redis, messages ...string) {
+	tcptuple := testTcpTuple()
+	ts := time.Now()
+
+	var private protos.ProtocolData
+	for i, msg := range messages {
+		private = redis.Parse(&protos.Packet{Ts: ts, Payload: []byte(msg)},
+			tcptuple, uint8(i%2), private)
+		ts = ts.Add(time.Millisecond)
+	}
+}
+
 func TestRedisParser_simpleRequest(t *testing.T) {
 
 	data := []byte(
@@ -88,3 +127,260 @@ func TestRedisParser_NilResult(t *testing.T) {
 		t.Errorf("Failed to parse Redis response: %s", stream.message.Message)
 	}
 }
+
+func TestRedis_subscribeMessages(t *testing.T) {
+
+	redis := RedisModForTests()
+	redis.Send_response = true
+	converse(redis,
+		"*3\r\n$9\r\nSUBSCRIBE\r\n$4\r\nnews\r\n$6\r\nalerts\r\n",
+		"*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n"+
+			"*3\r\n$9\r\nsubscribe\r\n$6\r\nalerts\r\n:2\r\n",
+		"",
+		"*3\r\n$7\r\nmessage\r\n$6\r\nalerts\r\n$4\r\nfire\r\n")
+
+	if len(redis.results) != 2 {
+		t.Fatalf("Expected two events, got %d", len(redis.results))
+	}
+
+	event := <-redis.results
+	assert.Equal(t, "SUBSCRIBE", event["method"])
+	assert.Equal(t, "news", event["resource"])
+	client := event["src"]
+
+	event = <-redis.results
+	assert.Equal(t, "MESSAGE", event["method"])
+	assert.Equal(t, "alerts", event["resource"])
+	assert.Equal(t, "fire", event["response"])
+	assert.Equal(t, uint64(0), event["bytes_in"])
+	assert.Equal(t, uint64(39), event["bytes_out"])
+	assert.Equal(t, "alerts", event["redis"].(common.MapStr)["channel"])
+
+	// like the commands, the event goes from the client to the server
+	assert.Equal(t, client, event["src"])
+}
+
+func TestRedis_multiExec(t *testing.T) {
+
+	redis := RedisModForTests()
+	converse(redis,
+		"*1\r\n$5\r\nMULTI\r\n", "+OK\r\n",
+		"*2\r\n$4\r\nINCR\r\n$1\r\na\r\n", "+QUEUED\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n", "+QUEUED\r\n",
+		"*1\r\n$4\r\nEXEC\r\n", "*2\r\n:1\r\n$1\r\nx\r\n")
+
+	if len(redis.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(redis.results))
+	}
+
+	event := <-redis.results
+	assert.Equal(t, common.OK_STATUS, event["status"])
+	assert.Equal(t, "EXEC", event["method"])
+	assert.Equal(t, "MULTI; INCR a; GET b; EXEC", event["query"])
+	assert.Equal(t, int32(7), event["responsetime"])
+	assert.Equal(t, uint64(15+21+20+14), event["bytes_in"])
+	assert.Equal(t, uint64(5+9+9+15), event["bytes_out"])
+
+	details := event["redis"].(common.MapStr)
+	assert.Equal(t, []string{"INCR a", "GET b"}, details["commands"])
+	assert.Equal(t, "1 x", details["return_value"])
+}
+
+func TestRedis_multiMaxQueued(t *testing.T) {
+
+	redis := RedisModForTests()
+	messages := []string{"*1\r\n$5\r\nMULTI\r\n", "+OK\r\n"}
+	for i := 0; i < MaxQueuedCommands+5; i++ {
+		messages = append(messages, "*2\r\n$4\r\nINCR\r\n$1\r\na\r\n", "+QUEUED\r\n")
+	}
+	converse(redis, append(messages, "*1\r\n$4\r\nEXEC\r\n", "*0\r\n")...)
+
+	if len(redis.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(redis.results))
+	}
+
+	details := (<-redis.results)["redis"].(common.MapStr)
+	assert.Equal(t, MaxQueuedCommands, len(details["commands"].([]string)))
+	assert.Equal(t, 5, details["commands_dropped"])
+}
+
+func TestRedis_multiDiscard(t *testing.T) {
+
+	redis := RedisModForTests()
+	converse(redis,
+		"*1\r\n$5\r\nMULTI\r\n", "+OK\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n", "+QUEUED\r\n",
+		"*1\r\n$7\r\nDISCARD\r\n", "+OK\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n", "$-1\r\n")
+
+	if len(redis.results) != 2 {
+		t.Fatalf("Expected two events, got %d", len(redis.results))
+	}
+
+	event := <-redis.results
+	assert.Equal(t, "DISCARD", event["method"])
+	assert.Nil(t, event["redis"].(common.MapStr)["commands"])
+
+	event = <-redis.results
+	assert.Equal(t, "GET", event["method"])
+}
+
+func TestRedisParser_resp3Map(t *testing.T) {
+
+	data := "%3\r\n+server\r\n$5\r\nredis\r\n+proto\r\n:3\r\n" +
+		"+modules\r\n*2\r\n,1.5\r\n#f\r\n"
+	stream := &RedisStream{data: []byte(data), message: new(RedisMessage)}
+
+	ok, complete := redisMessageParser(stream)
+
+	if !ok {
+		t.Errorf("Parsing returned error")
+	}
+	if !complete {
+		t.Errorf("Expecting a complete message")
+	}
+	assert.False(t, stream.message.IsRequest)
+	assert.Equal(t, len(data), stream.message.Size)
+	assert.Equal(t, "{server: redis, proto: 3, modules: [1.5 false]}",
+		stream.message.Message)
+
+	// all the elements are needed
+	stream = &RedisStream{data: []byte(data[:len(data)-4]), message: new(RedisMessage)}
+	ok, complete = redisMessageParser(stream)
+	assert.True(t, ok)
+	assert.False(t, complete)
+}
+
+// Test that a reply received one byte at a time is parsed incrementally,
+// the elements already decoded being kept.
+func TestRedisParser_incremental(t *testing.T) {
+
+	data := "|1\r\n+ttl\r\n:3600\r\n" +
+		"*3\r\n$3\r\nfoo\r\n%1\r\n+a\r\n*2\r\n:1\r\n:2\r\n_\r\n"
+	stream := &RedisStream{message: new(RedisMessage)}
+
+	for i := 0; i < len(data); i++ {
+		stream.data = append(stream.data, data[i])
+		ok, complete := redisMessageParser(stream)
+		if !ok {
+			t.Fatalf("Parsing returned error at byte %d", i)
+		}
+		if complete != (i == len(data)-1) {
+			t.Fatalf("Unexpected complete %v at byte %d", complete, i)
+		}
+		if i == len(data)-4 {
+			// the elements before the last one are not parsed again
+			assert.Equal(t, len(data)-3, stream.parseOffset)
+		}
+	}
+	assert.Equal(t, len(data), stream.message.Size)
+	assert.Equal(t, "foo {a: [1 2]} nil", stream.message.Message)
+	assert.Equal(t, 0, len(stream.parser.stack))
+}
+
+func TestRedisParser_tooLarge(t *testing.T) {
+
+	for _, data := range []string{
+		"$9223372036854775807\r\n",
+		"%4611686018427387904\r\n",
+		"*9223372036854775807\r\n",
+	} {
+		stream := &RedisStream{data: []byte(data), message: new(RedisMessage)}
+		ok, _ := redisMessageParser(stream)
+		assert.False(t, ok, "%q", data)
+	}
+}
+
+func TestRedis_resp3Push(t *testing.T) {
+
+	redis := RedisModForTests()
+	redis.Send_response = true
+	converse(redis,
+		"*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n",
+		"%1\r\n+proto\r\n:3\r\n",
+		"*2\r\n$9\r\nSUBSCRIBE\r\n$4\r\nnews\r\n",
+		">3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n",
+		"",
+		">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n=9\r\ntxt:hello\r\n")
+
+	if len(redis.results) != 3 {
+		t.Fatalf("Expected three events, got %d", len(redis.results))
+	}
+
+	event := <-redis.results
+	assert.Equal(t, "HELLO", event["method"])
+	assert.Equal(t, "{proto: 3}", event["redis"].(common.MapStr)["return_value"])
+
+	event = <-redis.results
+	assert.Equal(t, "SUBSCRIBE", event["method"])
+
+	event = <-redis.results
+	assert.Equal(t, "MESSAGE", event["method"])
+	assert.Equal(t, "news", event["redis"].(common.MapStr)["channel"])
+	assert.Equal(t, "hello", event["response"])
+}
+
+func TestRedis_tlsConnection(t *testing.T) {
+
+	redis := RedisModForTests()
+	clientHello, _ := hex.DecodeString(
+		"160301002f0100002b03031111111111111111111111111111111111111111111111" +
+			"111111111111111111000002130101000000")
+	serverHello, _ := hex.DecodeString(
+		"160301002c0200002803032222222222222222222222222222222222222222222222" +
+			"22222222222222222200c02f000000")
+	converse(redis, string(clientHello), string(serverHello),
+		"\x17\x03\x03\x00\x02ab")
+
+	if len(redis.results) != 1 {
+		t.Fatalf("Expected one event, got %d", len(redis.results))
+	}
+	event := <-redis.results
+	assert.Equal(t, "redis", event["type"])
+	assert.Equal(t, true, event["tls"])
+	assert.Equal(t, "TLSv1.2", event["tls_version"])
+}
+
+func TestRedis_keyspaceNotifications(t *testing.T) {
+
+	redis := RedisModForTests()
+	converse(redis,
+		"*2\r\n$10\r\nPSUBSCRIBE\r\n$10\r\n__key*__:*\r\n",
+		"*3\r\n$10\r\npsubscribe\r\n$10\r\n__key*__:*\r\n:1\r\n",
+		"",
+		"*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$22\r\n__keyspace@0__:user:42\r\n$3\r\nset\r\n"+
+			"*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$22\r\n__keyevent@3__:expired\r\n$7\r\nsession\r\n"+
+			"*4\r\n$8\r\npmessage\r\n$10\r\n__key*__:*\r\n$8\r\n__keyx__\r\n$4\r\ndata\r\n")
+
+	if len(redis.results) != 4 {
+		t.Fatalf("Expected four events, got %d", len(redis.results))
+	}
+
+	event := <-redis.results
+	assert.Equal(t, "PSUBSCRIBE", event["method"])
+
+	event = <-redis.results
+	assert.Equal(t, "redis_notification", event["type"])
+	assert.Equal(t, common.MapStr{
+		"kind":    "keyspace",
+		"db":      0,
+		"key":     "user:42",
+		"event":   "set",
+		"channel": "__keyspace@0__:user:42",
+		"pattern": "__key*__:*",
+	}, event["redis_notification"])
+
+	event = <-redis.results
+	assert.Equal(t, "redis_notification", event["type"])
+	notification := event["redis_notification"].(common.MapStr)
+	assert.Equal(t, "keyevent", notification["kind"])
+	assert.Equal(t, 3, notification["db"])
+	assert.Equal(t, "session", notification["key"])
+	assert.Equal(t, "expired", notification["event"])
+
+	// the other messages are published as before
+	event = <-redis.results
+	assert.Equal(t, "redis", event["type"])
+	assert.Equal(t, "PMESSAGE", event["method"])
+	assert.Equal(t, "__keyx__", event["resource"])
+}
@@ -0,0 +1,265 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Decoding of the values of the Redis protocol. RESP2 has the simple
+// strings, the errors, the integers, the bulk strings and the arrays.
+// RESP3, negotiated with HELLO 3, adds the null, the doubles, the
+// booleans, the big numbers, the blob errors, the verbatim strings, the
+// maps, the sets, the attributes and the pushes.
+
+const (
+	respArray     = '*'
+	respBulk      = '$'
+	respInteger   = ':'
+	respString    = '+'
+	respError     = '-'
+	respNull      = '_'
+	respDouble    = ','
+	respBoolean   = '#'
+	respBigNumber = '('
+	respBlobError = '!'
+	respVerbatim  = '='
+	respMap       = '%'
+	respSet       = '~'
+	respAttribute = '|'
+	respPush      = '>'
+)
+
+// The replies are nested, the limit protects the parser from the
+// malformed ones.
+const respMaxDepth = 64
+
+// The lengths of the bulk strings and the numbers of elements are at most
+// the 512MB proto-max-bulk-len of the server.
+const respMaxLength = 512 * 1024 * 1024
+
+var errRespIncomplete = errors.New("incomplete value")
+
+type respValue struct {
+	kind byte
+	null bool
+
+	// the scalar values
+	str string
+
+	// the elements of the aggregates, the keys and the values
+	// alternate in the maps
+	elems []respValue
+}
+
+func (v *respValue) isAggregate() bool {
+	switch v.kind {
+	case respArray, respMap, respSet, respPush:
+		return true
+	}
+	return false
+}
+
+func (v *respValue) isError() bool {
+	return v.kind == respError || v.kind == respBlobError
+}
+
+// String returns the value in human readable form. The nested arrays are
+// enclosed in brackets and the maps in braces.
+func (v *respValue) String() string {
+	if v.null {
+		return "nil"
+	}
+	if !v.isAggregate() {
+		return v.str
+	}
+	elems := v.elemStrings()
+	if v.kind == respMap {
+		return formatRespMap(elems)
+	}
+	return "[" + strings.Join(elems, " ") + "]"
+}
+
+func (v *respValue) elemStrings() []string {
+	elems := make([]string, len(v.elems))
+	for i := range v.elems {
+		elems[i] = v.elems[i].String()
+	}
+	return elems
+}
+
+func formatRespMap(elems []string) string {
+	pairs := make([]string, 0, len(elems)/2)
+	for i := 0; i+1 < len(elems); i += 2 {
+		pairs = append(pairs, elems[i]+": "+elems[i+1])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// respParser decodes a value split in several segments. The elements of
+// the aggregates already decoded are kept, so that each segment is
+// parsed once.
+type respParser struct {
+	// the aggregates being read, the innermost last
+	stack []respFrame
+}
+
+type respFrame struct {
+	value respValue
+
+	// number of elements of the aggregate
+	count int
+}
+
+// read decodes the value starting at offset and returns the offset of
+// the data following it. If the value is not entirely in data,
+// errRespIncomplete is returned with the offset following the elements
+// decoded, where the parsing resumes once more data is received.
+func (p *respParser) read(data []byte, offset int) (respValue, int, error) {
+	for {
+		if len(p.stack) > respMaxDepth {
+			return respValue{}, 0, errors.New("too many nested values")
+		}
+
+		v, count, off, err := readRespHeader(data, offset)
+		if err != nil {
+			return v, offset, err
+		}
+		offset = off
+		if count > 0 {
+			capacity := count
+			if capacity > len(data)-offset {
+				// each element takes at least a few bytes
+				capacity = len(data) - offset
+			}
+			v.elems = make([]respValue, 0, capacity)
+			p.stack = append(p.stack, respFrame{value: v, count: count})
+			continue
+		}
+
+		// the aggregates complete with this value
+		for len(p.stack) > 0 {
+			top := &p.stack[len(p.stack)-1]
+			if count >= 0 {
+				top.value.elems = append(top.value.elems, v)
+			}
+			if len(top.value.elems) < top.count {
+				break
+			}
+			v = top.value
+			count = 0
+			p.stack = p.stack[:len(p.stack)-1]
+			if v.kind == respAttribute {
+				// auxiliary data about the reply that follows, which
+				// is the actual value
+				count = -1
+			}
+		}
+		if len(p.stack) == 0 && count >= 0 {
+			return v, offset, nil
+		}
+	}
+}
+
+// readRespHeader decodes the value starting at offset, or the header of
+// the aggregate whose elements follow. It returns the number of elements
+// of the aggregate, 0 for the other values and -1 for an empty
+// attribute, and the offset of the data following what was decoded.
+func readRespHeader(data []byte, offset int) (respValue, int, int, error) {
+	var v respValue
+
+	found, line, off := readLine(data, offset)
+	if !found {
+		return v, 0, 0, errRespIncomplete
+	}
+	if len(line) == 0 {
+		return v, 0, 0, errors.New("empty line")
+	}
+	v.kind = line[0]
+	line = line[1:]
+
+	switch v.kind {
+	case respString, respError:
+		v.str = line
+
+	case respInteger, respBigNumber:
+		if _, err := strconv.ParseInt(line, 10, 64); err != nil &&
+			v.kind == respInteger {
+			return v, 0, 0, fmt.Errorf("invalid integer: %s", line)
+		}
+		v.str = line
+
+	case respDouble:
+		if _, err := strconv.ParseFloat(line, 64); err != nil &&
+			line != "inf" && line != "-inf" && line != "nan" {
+			return v, 0, 0, fmt.Errorf("invalid double: %s", line)
+		}
+		v.str = line
+
+	case respBoolean:
+		switch line {
+		case "t":
+			v.str = "true"
+		case "f":
+			v.str = "false"
+		default:
+			return v, 0, 0, fmt.Errorf("invalid boolean: %s", line)
+		}
+
+	case respNull:
+		v.null = true
+
+	case respBulk, respBlobError, respVerbatim:
+		length, err := strconv.Atoi(line)
+		if err != nil {
+			return v, 0, 0, fmt.Errorf("invalid length: %s", line)
+		}
+		if length < 0 {
+			// the null bulk string of RESP2
+			v.null = true
+			break
+		}
+		if length > respMaxLength {
+			return v, 0, 0, fmt.Errorf("bulk string too large: %d", length)
+		}
+		if len(data)-off < length+2 {
+			return v, 0, 0, errRespIncomplete
+		}
+		if data[off+length] != '\r' || data[off+length+1] != '\n' {
+			return v, 0, 0, errors.New("bulk string not terminated by CRLF")
+		}
+		v.str = string(data[off : off+length])
+		if v.kind == respVerbatim && len(v.str) >= 4 && v.str[3] == ':' {
+			// the format of the text, for example txt: or mkd:
+			v.str = v.str[4:]
+		}
+		off += length + 2
+
+	case respArray, respMap, respSet, respPush, respAttribute:
+		count, err := strconv.Atoi(line)
+		if err != nil {
+			return v, 0, 0, fmt.Errorf("invalid number of elements: %s", line)
+		}
+		if count < 0 {
+			// the null array of RESP2
+			v.null = true
+			break
+		}
+		if count > respMaxLength {
+			return v, 0, 0, fmt.Errorf("too many elements: %d", count)
+		}
+		if v.kind == respMap || v.kind == respAttribute {
+			count *= 2
+		}
+		if count == 0 && v.kind == respAttribute {
+			return v, -1, off, nil
+		}
+		return v, count, off, nil
+
+	default:
+		return v, 0, 0, fmt.Errorf("unexpected type byte %q", v.kind)
+	}
+
+	return v, 0, off, nil
+}
@@ -0,0 +1,114 @@
+package protos
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/johann8384/libbeat/common"
+)
+
+// Parts of a transaction published as separate events.
+const (
+	RequestPart  = "request"
+	ResponsePart = "response"
+)
+
+// What a plugin captures of the transactions, set by its capture_direction
+// option. With CaptureRequest, the requests are published without waiting
+// for their response. With CaptureResponse, only the time of the last
+// request of each connection is kept, for the response times.
+const (
+	CaptureBoth     = "both"
+	CaptureRequest  = "request"
+	CaptureResponse = "response"
+)
+
+// ParseCaptureDirection checks the capture_direction option of a plugin.
+// The default is CaptureBoth.
+func ParseCaptureDirection(value *string) (string, error) {
+	if value == nil {
+		return CaptureBoth, nil
+	}
+	switch *value {
+	case CaptureBoth, CaptureRequest, CaptureResponse:
+		return *value, nil
+	}
+	return "", fmt.Errorf("Expected capture_direction to be %s, %s or %s, got %s",
+		CaptureBoth, CaptureRequest, CaptureResponse, *value)
+}
+
+// NewTransactionId returns a random id, unique among the transactions of
+// all the shippers.
+func NewTransactionId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// SplitTransaction returns the events of the request and of the response
+// of a transaction, for the plugins publishing them separately. They
+// share the fields of the transaction and a transaction.id, and
+// transaction.part tells them apart. The request event doesn't have the
+// response field and the response event doesn't have the request field.
+// A transaction missing its request or its response gives a single event.
+func SplitTransaction(event common.MapStr, hasRequest bool, hasResponse bool) []common.MapStr {
+	id := NewTransactionId()
+	events := []common.MapStr{}
+	if hasRequest {
+		request := copyMapStr(event)
+		delete(request, "response")
+		request["transaction"] = common.MapStr{"id": id, "part": RequestPart}
+		events = append(events, request)
+	}
+	if hasResponse {
+		response := copyMapStr(event)
+		delete(response, "request")
+		response["transaction"] = common.MapStr{"id": id, "part": ResponsePart}
+		events = append(events, response)
+	}
+	return events
+}
+
+// TransactionFraction returns a number between 0 and 1 derived from the
+// transaction.id of a split event, the same for the request and the
+// response of the transaction. The samplers compare it to their rate
+// instead of drawing a random number for each event, so that both events
+// of a transaction are kept or dropped together. The events without a
+// transaction.id have none.
+func TransactionFraction(event common.MapStr) (float64, bool) {
+	var id interface{}
+	switch transaction := event["transaction"].(type) {
+	case common.MapStr:
+		id = transaction["id"]
+	case map[string]interface{}:
+		id = transaction["id"]
+	}
+	str, ok := id.(string)
+	if !ok || len(str) == 0 {
+		return 0, false
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(str))
+	// the 53 bits a float64 holds exactly
+	return float64(hash.Sum64()>>11) / (1 << 53), true
+}
+
+// copyMapStr copies the event and its nested maps, which the filters and
+// the anonymization modify in place.
+func copyMapStr(m common.MapStr) common.MapStr {
+	copied := common.MapStr{}
+	for key, value := range m {
+		switch value := value.(type) {
+		case common.MapStr:
+			copied[key] = copyMapStr(value)
+		case map[string]interface{}:
+			copied[key] = map[string]interface{}(copyMapStr(value))
+		default:
+			copied[key] = value
+		}
+	}
+	return copied
+}
@@ -0,0 +1,77 @@
+package protos
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitTransaction(t *testing.T) {
+	event := common.MapStr{
+		"type":     "http",
+		"request":  "GET / HTTP/1.1",
+		"response": "HTTP/1.1 200 OK",
+		"http":     common.MapStr{"code": 200},
+	}
+
+	events := SplitTransaction(event, true, true)
+	if assert.Len(t, events, 2) {
+		request, response := events[0], events[1]
+		assert.Equal(t, "GET / HTTP/1.1", request["request"])
+		_, exists := request["response"]
+		assert.False(t, exists)
+		assert.Equal(t, "HTTP/1.1 200 OK", response["response"])
+		_, exists = response["request"]
+		assert.False(t, exists)
+
+		requestId := request["transaction"].(common.MapStr)
+		responseId := response["transaction"].(common.MapStr)
+		assert.Len(t, requestId["id"], 32)
+		assert.Equal(t, requestId["id"], responseId["id"])
+		assert.Equal(t, RequestPart, requestId["part"])
+		assert.Equal(t, ResponsePart, responseId["part"])
+
+		// the nested maps are not shared
+		request["http"].(common.MapStr)["code"] = 0
+		assert.Equal(t, 200, response["http"].(common.MapStr)["code"])
+	}
+
+	// without response
+	events = SplitTransaction(event, true, false)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, RequestPart, events[0]["transaction"].(common.MapStr)["part"])
+	}
+}
+
+func TestTransactionFraction(t *testing.T) {
+	events := SplitTransaction(common.MapStr{"type": "http"}, true, true)
+	request, ok := TransactionFraction(events[0])
+	assert.True(t, ok)
+	response, _ := TransactionFraction(events[1])
+	assert.Equal(t, request, response)
+	assert.True(t, request >= 0 && request < 1)
+
+	_, ok = TransactionFraction(common.MapStr{"type": "http"})
+	assert.False(t, ok)
+
+	// spread over the transactions
+	below := 0
+	for i := 0; i < 10000; i++ {
+		event := SplitTransaction(common.MapStr{}, true, false)[0]
+		if fraction, _ := TransactionFraction(event); fraction < 0.1 {
+			below++
+		}
+	}
+	assert.True(t, below > 800 && below < 1200, "%d fractions below 0.1", below)
+}
+
+func TestNewTransactionId_unique(t *testing.T) {
+	ids := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := NewTransactionId()
+		assert.False(t, ids[id])
+		ids[id] = true
+	}
+}
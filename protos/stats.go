@@ -0,0 +1,102 @@
+package protos
+
+import (
+	"sync"
+
+	"github.com/johann8384/libbeat/common"
+)
+
+// Counters of the traffic handled by a protocol plugin.
+type ProtocolStats struct {
+	// packets passed to the plugin, matched by their ports
+	Packets uint64
+
+	// events published by the plugin
+	Transactions uint64
+
+	// streams dropped because the parser failed
+	ParseErrors uint64
+
+	// streams dropped because they buffered more than the
+	// maximum size of a message
+	TooLarge uint64
+}
+
+// ParseStats counts, by protocol, the packets given to the plugins, the
+// transactions they publish and the streams they drop. They tell how much
+// of a capture is understood by the plugins.
+type ParseStats struct {
+	lock      sync.Mutex
+	protocols map[Protocol]*ProtocolStats
+}
+
+// Singleton of the ParseStats type, updated by the plugins.
+var Stats = NewParseStats()
+
+func NewParseStats() *ParseStats {
+	return &ParseStats{protocols: map[Protocol]*ProtocolStats{}}
+}
+
+func (stats *ParseStats) update(proto Protocol, fn func(counters *ProtocolStats)) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	counters, exists := stats.protocols[proto]
+	if !exists {
+		counters = &ProtocolStats{}
+		stats.protocols[proto] = counters
+	}
+	fn(counters)
+}
+
+// CountPacket counts a packet passed to the plugin of the protocol.
+func (stats *ParseStats) CountPacket(proto Protocol) {
+	stats.update(proto, func(counters *ProtocolStats) { counters.Packets++ })
+}
+
+// CountParseError counts a stream dropped because it could not be parsed.
+func (stats *ParseStats) CountParseError(proto Protocol) {
+	stats.update(proto, func(counters *ProtocolStats) { counters.ParseErrors++ })
+}
+
+// CountTooLarge counts a stream dropped because of its size.
+func (stats *ParseStats) CountTooLarge(proto Protocol) {
+	stats.update(proto, func(counters *ProtocolStats) { counters.TooLarge++ })
+}
+
+// CountTransaction counts an event, by its type. The events of other
+// types than the protocols, like the flows, are not counted.
+func (stats *ParseStats) CountTransaction(event common.MapStr) {
+	name, ok := event["type"].(string)
+	if !ok {
+		return
+	}
+	for proto, protoName := range ProtocolNames {
+		if protoName == name && Protocol(proto) != UnknownProtocol {
+			stats.update(Protocol(proto), func(counters *ProtocolStats) {
+				counters.Transactions++
+			})
+			return
+		}
+	}
+}
+
+// Get returns a copy of the counters, by protocol.
+func (stats *ParseStats) Get() map[Protocol]ProtocolStats {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	res := map[Protocol]ProtocolStats{}
+	for proto, counters := range stats.protocols {
+		res[proto] = *counters
+	}
+	return res
+}
+
+// Reset sets all the counters back to zero.
+func (stats *ParseStats) Reset() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.protocols = map[Protocol]*ProtocolStats{}
+}
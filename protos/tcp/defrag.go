@@ -0,0 +1,311 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/tsg/gopacket"
+	"github.com/tsg/gopacket/layers"
+)
+
+// The fragments of an IP datagram are kept until all of them are
+// received, for at most this long, measured with the timestamps of the
+// packets.
+const IP_FRAGMENTS_EXPIRY = 30 * time.Second
+
+// At most this many datagrams are reassembled at the same time. The
+// oldest one is dropped to make room for a new one.
+const IP_MAX_FRAGMENTED_DATAGRAMS = 256
+
+// A datagram sent in more fragments is dropped.
+const IP_MAX_FRAGMENTS = 256
+
+// Size of the IPv6 fragment extension header
+const ipv6FragmentHeaderSize = 8
+
+// The fragments of a datagram share the addresses, the identification
+// and, for IPv4, the protocol.
+type fragmentKey struct {
+	src      string
+	dst      string
+	id       uint32
+	protocol layers.IPProtocol
+}
+
+type ipFragment struct {
+	offset int
+	data   []byte
+}
+
+type fragmentedDatagram struct {
+	ts        time.Time
+	fragments []ipFragment
+
+	// set once the last fragment is received
+	size int
+
+	// transport protocol, known from the first fragment for IPv6
+	protocol layers.IPProtocol
+}
+
+// complete returns the payload of the datagram once the fragments cover
+// it entirely.
+func (datagram *fragmentedDatagram) complete() ([]byte, bool) {
+	if datagram.size < 0 {
+		return nil, false
+	}
+
+	sort.Sort(byOffset(datagram.fragments))
+	covered := 0
+	for _, fragment := range datagram.fragments {
+		if fragment.offset > covered {
+			// still missing a fragment
+			return nil, false
+		}
+		if end := fragment.offset + len(fragment.data); end > covered {
+			covered = end
+		}
+	}
+	if covered < datagram.size {
+		return nil, false
+	}
+
+	payload := make([]byte, datagram.size)
+	for _, fragment := range datagram.fragments {
+		if fragment.offset >= datagram.size {
+			continue
+		}
+		copy(payload[fragment.offset:], fragment.data)
+	}
+	return payload, true
+}
+
+// received returns the end of the data received so far.
+func (datagram *fragmentedDatagram) received() int {
+	received := 0
+	for _, fragment := range datagram.fragments {
+		if end := fragment.offset + len(fragment.data); end > received {
+			received = end
+		}
+	}
+	return received
+}
+
+type byOffset []ipFragment
+
+func (f byOffset) Len() int           { return len(f) }
+func (f byOffset) Less(i, j int) bool { return f[i].offset < f[j].offset }
+func (f byOffset) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// defragmenter reassembles the fragmented IPv4 and IPv6 datagrams. Each
+// decoder has its own, it is not safe for concurrent use.
+type defragmenter struct {
+	datagrams map[fragmentKey]*fragmentedDatagram
+}
+
+func newDefragmenter() *defragmenter {
+	return &defragmenter{datagrams: make(map[fragmentKey]*fragmentedDatagram)}
+}
+
+// add keeps a fragment. It returns the payload of the datagram and its
+// transport protocol when the last missing fragment is received. The
+// protocol is only known from the first fragment for IPv6.
+func (defrag *defragmenter) add(key fragmentKey, ts time.Time, offset int, more bool,
+	protocol layers.IPProtocol, data []byte) ([]byte, layers.IPProtocol, bool) {
+
+	datagram := defrag.datagrams[key]
+	if datagram != nil && ts.Sub(datagram.ts) > IP_FRAGMENTS_EXPIRY {
+		logp.Debug("ip", "Fragments expired, dropping them")
+		delete(defrag.datagrams, key)
+		datagram = nil
+	}
+	if datagram == nil {
+		defrag.makeRoom(ts)
+		datagram = &fragmentedDatagram{ts: ts, size: -1}
+		defrag.datagrams[key] = datagram
+	}
+
+	if offset+len(data) > 0xffff || len(datagram.fragments) >= IP_MAX_FRAGMENTS {
+		logp.Debug("ip", "Too many fragments, dropping the datagram")
+		delete(defrag.datagrams, key)
+		return nil, 0, false
+	}
+
+	// a fragment past the end of the datagram, or a last fragment ending
+	// before data already received, is either forged or corrupted
+	end := offset + len(data)
+	if datagram.size >= 0 && (end > datagram.size || !more && end != datagram.size) {
+		logp.Debug("ip", "Fragment past the end of the datagram, ignoring it")
+		return nil, 0, false
+	}
+	if !more && end < datagram.received() {
+		logp.Debug("ip", "Last fragment before the data received, ignoring it")
+		return nil, 0, false
+	}
+
+	// the capture buffers are reused
+	datagram.fragments = append(datagram.fragments,
+		ipFragment{offset: offset, data: append([]byte{}, data...)})
+	if offset == 0 {
+		datagram.protocol = protocol
+	}
+	if !more {
+		datagram.size = end
+	}
+
+	payload, complete := datagram.complete()
+	if !complete {
+		return nil, 0, false
+	}
+	delete(defrag.datagrams, key)
+	return payload, datagram.protocol, true
+}
+
+// makeRoom drops the expired datagrams, or the oldest one, when the
+// limit is reached.
+func (defrag *defragmenter) makeRoom(ts time.Time) {
+	if len(defrag.datagrams) < IP_MAX_FRAGMENTED_DATAGRAMS {
+		return
+	}
+
+	var oldestKey fragmentKey
+	var oldest *fragmentedDatagram
+	for key, datagram := range defrag.datagrams {
+		if ts.Sub(datagram.ts) > IP_FRAGMENTS_EXPIRY {
+			delete(defrag.datagrams, key)
+			continue
+		}
+		if oldest == nil || datagram.ts.Before(oldest.ts) {
+			oldestKey, oldest = key, datagram
+		}
+	}
+	if len(defrag.datagrams) >= IP_MAX_FRAGMENTED_DATAGRAMS {
+		logp.Debug("ip", "Too many fragmented datagrams, dropping the oldest")
+		delete(defrag.datagrams, oldestKey)
+	}
+}
+
+// defragmentIPv4 keeps the fragment decoded in ip4. When the datagram is
+// complete, it returns it with the header of the last fragment, without
+// the fragmentation fields.
+func (decoder *DecoderStruct) defragmentIPv4(ts time.Time) ([]byte, bool) {
+	ip4 := &decoder.ip4
+
+	key := fragmentKey{
+		src:      string(ip4.SrcIP.To4()),
+		dst:      string(ip4.DstIP.To4()),
+		id:       uint32(ip4.Id),
+		protocol: ip4.Protocol,
+	}
+	payload, _, complete := decoder.defrag.add(key, ts, int(ip4.FragOffset)*8,
+		ip4.Flags&layers.IPv4MoreFragments != 0, ip4.Protocol, ip4.Payload)
+	if !complete {
+		return nil, false
+	}
+
+	header := len(ip4.Contents)
+	if header+len(payload) > 0xffff {
+		logp.Debug("ip", "Reassembled datagram too large")
+		return nil, false
+	}
+	datagram := make([]byte, header+len(payload))
+	copy(datagram, ip4.Contents)
+	binary.BigEndian.PutUint16(datagram[2:4], uint16(len(datagram)))
+	// clear the flags, but don't fragment, and the offset
+	binary.BigEndian.PutUint16(datagram[6:8], uint16(ip4.Flags&layers.IPv4DontFragment)<<13)
+	copy(datagram[header:], payload)
+	return datagram, true
+}
+
+// isIPv6Fragment returns true if the packet decoded in ip6 has a fragment
+// header, right after the IPv6 header and the hop-by-hop options.
+func (decoder *DecoderStruct) isIPv6Fragment() bool {
+	next := decoder.ip6.NextHeader
+	if decoder.ip6.HopByHop != nil {
+		next = decoder.ip6.HopByHop.NextHeader
+	}
+	return next == layers.IPProtocolIPv6Fragment &&
+		len(decoder.ip6.Payload) >= ipv6FragmentHeaderSize
+}
+
+// defragmentIPv6 keeps the fragment decoded in ip6. When the packet is
+// complete, it returns it with a new IPv6 header, without extension
+// headers.
+func (decoder *DecoderStruct) defragmentIPv6(ts time.Time) ([]byte, bool) {
+	ip6 := &decoder.ip6
+	fragment := ip6.Payload
+
+	offsetFlags := binary.BigEndian.Uint16(fragment[2:4])
+	key := fragmentKey{
+		src: string(ip6.SrcIP.To16()),
+		dst: string(ip6.DstIP.To16()),
+		id:  binary.BigEndian.Uint32(fragment[4:8]),
+	}
+	payload, protocol, complete := decoder.defrag.add(key, ts, int(offsetFlags>>3)*8,
+		offsetFlags&0x1 != 0, layers.IPProtocol(fragment[0]),
+		fragment[ipv6FragmentHeaderSize:])
+	if !complete {
+		return nil, false
+	}
+	if len(payload) > 0xffff {
+		logp.Debug("ip", "Reassembled packet too large")
+		return nil, false
+	}
+
+	datagram := make([]byte, 40+len(payload))
+	copy(datagram, ip6.Contents[:40])
+	binary.BigEndian.PutUint16(datagram[4:6], uint16(len(payload)))
+	datagram[6] = byte(protocol)
+	copy(datagram[40:], payload)
+	return datagram, true
+}
+
+// defragment returns true if the decoded packet is an IPv4 or IPv6
+// fragment. complete is true once all the fragments are received, the
+// layers are then decoded again from the reassembled datagram.
+func (decoder *DecoderStruct) defragment(ts time.Time) (fragmented bool, complete bool) {
+	var ipLayer gopacket.LayerType
+	for _, layerType := range decoder.decoded {
+		if layerType == layers.LayerTypeIPv4 || layerType == layers.LayerTypeIPv6 {
+			ipLayer = layerType
+		}
+	}
+
+	var datagram []byte
+	var parser *gopacket.DecodingLayerParser
+	switch ipLayer {
+	case layers.LayerTypeIPv4:
+		if decoder.ip4.Flags&layers.IPv4MoreFragments == 0 && decoder.ip4.FragOffset == 0 {
+			return false, false
+		}
+		logp.Debug("ip", "IPv4 fragment")
+		datagram, complete = decoder.defragmentIPv4(ts)
+		parser = decoder.ip4Parser
+
+	case layers.LayerTypeIPv6:
+		if !decoder.isIPv6Fragment() {
+			return false, false
+		}
+		logp.Debug("ip", "IPv6 fragment")
+		datagram, complete = decoder.defragmentIPv6(ts)
+		parser = decoder.ip6Parser
+
+	default:
+		return false, false
+	}
+	if !complete {
+		return true, false
+	}
+
+	err := parser.DecodeLayers(datagram, &decoder.decoded)
+	if err != nil {
+		if _, unsupported := err.(gopacket.UnsupportedLayerType); !unsupported {
+			logp.Debug("pcapread", "Decoding error of the reassembled datagram: %s", err)
+			return true, false
+		}
+	}
+	return true, true
+}
@@ -0,0 +1,208 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/udp"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tsg/gopacket"
+	"github.com/tsg/gopacket/layers"
+)
+
+// Records the datagrams passed by the UDP layer.
+type RecordingUdpProtocol struct {
+	TestProtocol
+	packets []protos.Packet
+}
+
+func (proto *RecordingUdpProtocol) ParseUdp(pkt *protos.Packet) {
+	packet := *pkt
+	packet.Payload = append([]byte{}, pkt.Payload...)
+	proto.packets = append(proto.packets, packet)
+}
+
+func defragTestDecoder(t *testing.T) (*DecoderStruct, *RecordingUdpProtocol) {
+	proto := &RecordingUdpProtocol{TestProtocol: TestProtocol{Ports: []int{5000}}}
+	protos.Protos.Register(protos.DnsProtocol, proto)
+	udp.UdpInit()
+
+	decoder, err := CreateDecoder(layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatalf("CreateDecoder: %s", err)
+	}
+	return decoder, proto
+}
+
+// UDP datagram from port 1234 to 5000, without checksum.
+func udpDatagram(payload string) []byte {
+	datagram := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(datagram[0:], 1234)
+	binary.BigEndian.PutUint16(datagram[2:], 5000)
+	binary.BigEndian.PutUint16(datagram[4:], uint16(len(datagram)))
+	copy(datagram[8:], payload)
+	return datagram
+}
+
+func ethernetFrame(etherType uint16, payload []byte) []byte {
+	frame := make([]byte, 14, 14+len(payload))
+	copy(frame[0:], []byte{0, 1, 2, 3, 4, 5, 0, 1, 2, 3, 4, 6})
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+	return append(frame, payload...)
+}
+
+// IPv4 fragment from 192.168.0.1 to 192.168.0.2, offset in bytes.
+func ipv4Fragment(id uint16, offset int, more bool, data []byte) []byte {
+	return ethernetFrame(0x0800, ipv4Packet(layers.IPProtocolUDP, id, offset, more, data))
+}
+
+func ipv4Packet(protocol layers.IPProtocol, id uint16, offset int, more bool, data []byte) []byte {
+	packet := make([]byte, 20, 20+len(data))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(20+len(data)))
+	binary.BigEndian.PutUint16(packet[4:], id)
+	flagsOffset := uint16(offset / 8)
+	if more {
+		flagsOffset |= 0x2000
+	}
+	binary.BigEndian.PutUint16(packet[6:], flagsOffset)
+	packet[8] = 64
+	packet[9] = byte(protocol)
+	copy(packet[12:], []byte{192, 168, 0, 1, 192, 168, 0, 2})
+	return append(packet, data...)
+}
+
+// IPv6 packet from fe80::1 to fe80::2 with a fragment header, offset in
+// bytes.
+func ipv6Fragment(id uint32, offset int, more bool, data []byte) []byte {
+	packet := make([]byte, 48, 48+len(data))
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:], uint16(8+len(data)))
+	packet[6] = byte(layers.IPProtocolIPv6Fragment)
+	packet[7] = 64
+	packet[8], packet[9], packet[23] = 0xfe, 0x80, 1
+	packet[24], packet[25], packet[39] = 0xfe, 0x80, 2
+
+	// fragment header
+	packet[40] = byte(layers.IPProtocolUDP)
+	offsetFlags := uint16(offset/8) << 3
+	if more {
+		offsetFlags |= 1
+	}
+	binary.BigEndian.PutUint16(packet[42:], offsetFlags)
+	binary.BigEndian.PutUint32(packet[44:], id)
+	return ethernetFrame(0x86dd, append(packet, data...))
+}
+
+func TestDecodePacketData_ipv4Fragments(t *testing.T) {
+	decoder, proto := defragTestDecoder(t)
+	ci := &gopacket.CaptureInfo{Timestamp: time.Now()}
+
+	datagram := udpDatagram("first fragment, then the second")
+	first := ipv4Fragment(0x1234, 0, true, datagram[:24])
+	second := ipv4Fragment(0x1234, 24, false, datagram[24:])
+
+	// received out of order
+	decoder.DecodePacketData(second, ci)
+	assert.Equal(t, 0, len(proto.packets))
+	decoder.DecodePacketData(first, ci)
+
+	if len(proto.packets) != 1 {
+		t.Fatalf("Expected one datagram, got %d", len(proto.packets))
+	}
+	packet := proto.packets[0]
+	assert.Equal(t, "first fragment, then the second", string(packet.Payload))
+	assert.Equal(t, "192.168.0.1", packet.Tuple.Src_ip.String())
+	assert.Equal(t, "192.168.0.2", packet.Tuple.Dst_ip.String())
+	assert.Equal(t, uint16(1234), packet.Tuple.Src_port)
+	assert.Equal(t, uint16(5000), packet.Tuple.Dst_port)
+	assert.Equal(t, 0, len(decoder.defrag.datagrams))
+
+	// a datagram that isn't fragmented
+	decoder.DecodePacketData(ipv4Fragment(0x1235, 0, false, udpDatagram("single")), ci)
+	assert.Equal(t, 2, len(proto.packets))
+	assert.Equal(t, "single", string(proto.packets[1].Payload))
+}
+
+func TestDecodePacketData_ipv6Fragments(t *testing.T) {
+	decoder, proto := defragTestDecoder(t)
+	ci := &gopacket.CaptureInfo{Timestamp: time.Now()}
+
+	datagram := udpDatagram("a UDP datagram sent in three IPv6 fragments")
+	decoder.DecodePacketData(ipv6Fragment(7, 0, true, datagram[:16]), ci)
+	decoder.DecodePacketData(ipv6Fragment(7, 32, false, datagram[32:]), ci)
+	decoder.DecodePacketData(ipv6Fragment(7, 16, true, datagram[16:32]), ci)
+
+	if len(proto.packets) != 1 {
+		t.Fatalf("Expected one datagram, got %d", len(proto.packets))
+	}
+	packet := proto.packets[0]
+	assert.Equal(t, "a UDP datagram sent in three IPv6 fragments", string(packet.Payload))
+	assert.Equal(t, "fe80::1", packet.Tuple.Src_ip.String())
+	assert.Equal(t, "fe80::2", packet.Tuple.Dst_ip.String())
+	assert.Equal(t, 16, packet.Tuple.Ip_length)
+	assert.Equal(t, uint16(5000), packet.Tuple.Dst_port)
+}
+
+func TestDefragmenter_limits(t *testing.T) {
+	defrag := newDefragmenter()
+	ts := time.Now()
+
+	for i := 0; i <= IP_MAX_FRAGMENTED_DATAGRAMS; i++ {
+		key := fragmentKey{id: uint32(i)}
+		_, _, complete := defrag.add(key, ts.Add(time.Duration(i)*time.Millisecond),
+			0, true, layers.IPProtocolUDP, []byte("12345678"))
+		assert.False(t, complete)
+	}
+	assert.Equal(t, IP_MAX_FRAGMENTED_DATAGRAMS, len(defrag.datagrams))
+
+	// the oldest datagram was dropped
+	_, exists := defrag.datagrams[fragmentKey{id: 0}]
+	assert.False(t, exists)
+
+	// the first fragment expired, the last one alone is not a datagram
+	_, _, complete := defrag.add(fragmentKey{id: 1}, ts.Add(IP_FRAGMENTS_EXPIRY+time.Second),
+		8, false, layers.IPProtocolUDP, []byte("12345678"))
+	assert.False(t, complete)
+
+	payload, protocol, complete := defrag.add(fragmentKey{id: 2}, ts,
+		8, false, layers.IPProtocolUDP, []byte("abcdefgh"))
+	assert.True(t, complete)
+	assert.Equal(t, layers.IPProtocolUDP, protocol)
+	assert.Equal(t, "12345678abcdefgh", string(payload))
+}
+
+func TestDefragmenter_craftedFragments(t *testing.T) {
+	defrag := newDefragmenter()
+	ts := time.Now()
+	key := fragmentKey{id: 1}
+
+	_, _, complete := defrag.add(key, ts, 16, false, layers.IPProtocolUDP, []byte("ijklmnop"))
+	assert.False(t, complete)
+
+	// past the end of the datagram, ignored
+	_, _, complete = defrag.add(key, ts, 16, true, layers.IPProtocolUDP, []byte("0123456789abcdef"))
+	assert.False(t, complete)
+
+	// a second last fragment ending before the data received, ignored
+	_, _, complete = defrag.add(key, ts, 0, false, layers.IPProtocolUDP, []byte("12345678"))
+	assert.False(t, complete)
+
+	_, _, complete = defrag.add(key, ts, 0, true, layers.IPProtocolUDP, []byte("12345678"))
+	assert.False(t, complete)
+	payload, _, complete := defrag.add(key, ts, 8, true, layers.IPProtocolUDP, []byte("abcdefgh"))
+	assert.True(t, complete)
+	assert.Equal(t, "12345678abcdefghijklmnop", string(payload))
+
+	// the last fragment received after data past its end
+	key = fragmentKey{id: 2}
+	_, _, complete = defrag.add(key, ts, 16, true, layers.IPProtocolUDP, []byte("ijklmnop"))
+	assert.False(t, complete)
+	_, _, complete = defrag.add(key, ts, 0, false, layers.IPProtocolUDP, []byte("12345678"))
+	assert.False(t, complete)
+	_, _, complete = defrag.add(key, ts, 8, true, layers.IPProtocolUDP, []byte("abcdefgh"))
+	assert.False(t, complete)
+}
@@ -0,0 +1,117 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/johann8384/packetbeat/protos"
+)
+
+// Set by TcpInit from the auto_detect option. The streams on the ports
+// of no plugin are then passed to the plugin whose signature matches the
+// beginning of their first segment.
+var AutoDetect bool
+
+// A signature tells whether the payload looks like the first message of
+// a connection of its protocol, as sent by the client or the server.
+type signature struct {
+	protocol protos.Protocol
+	matches  func(payload []byte) bool
+}
+
+var signatures = []signature{
+	{protos.HttpProtocol, isHttpStart},
+	{protos.MysqlProtocol, isMysqlHandshake},
+	{protos.PgsqlProtocol, isPgsqlStartup},
+	{protos.RedisProtocol, isRedisCommand},
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("HEAD "), []byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "),
+	[]byte("CONNECT "),
+}
+
+// detectProtocol returns the protocol of the first enabled plugin whose
+// signature matches the payload, or UnknownProtocol.
+func detectProtocol(payload []byte) protos.Protocol {
+	if len(payload) == 0 {
+		return protos.UnknownProtocol
+	}
+	for _, sig := range signatures {
+		if protos.Protos.Get(sig.protocol) == nil {
+			continue
+		}
+		if sig.matches(payload) {
+			return sig.protocol
+		}
+	}
+	return protos.UnknownProtocol
+}
+
+// isHttpStart matches a request line or a status line.
+func isHttpStart(payload []byte) bool {
+	line := payload
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	if bytes.HasPrefix(line, []byte("HTTP/1.")) {
+		return true
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(line, method) {
+			return bytes.Contains(line, []byte(" HTTP/1."))
+		}
+	}
+	return false
+}
+
+// isMysqlHandshake matches the initial handshake packet of the server,
+// of protocol version 10, followed by the server version.
+func isMysqlHandshake(payload []byte) bool {
+	if len(payload) < 6 {
+		return false
+	}
+	length := int(payload[0]) | int(payload[1])<<8 | int(payload[2])<<16
+	return length+4 >= len(payload) && length > 1 &&
+		payload[3] == 0 && payload[4] == 10 &&
+		bytes.IndexByte(payload[5:], 0) > 0
+}
+
+// isPgsqlStartup matches the startup message of protocol 3.0, or the
+// request of a TLS connection.
+func isPgsqlStartup(payload []byte) bool {
+	if len(payload) < 8 {
+		return false
+	}
+	length := binary.BigEndian.Uint32(payload[0:])
+	code := binary.BigEndian.Uint32(payload[4:])
+	switch code {
+	case 196608:
+		return int(length) >= len(payload)
+	case 80877103:
+		return length == 8
+	}
+	return false
+}
+
+// isRedisCommand matches a command sent as an array of bulk strings.
+func isRedisCommand(payload []byte) bool {
+	if len(payload) < 4 || payload[0] != '*' {
+		return false
+	}
+	i := 1
+	for i < len(payload) && payload[i] >= '0' && payload[i] <= '9' {
+		i++
+	}
+	return i > 1 && bytes.HasPrefix(payload[i:], []byte("\r\n$"))
+}
+
+// withAutoDetect extends the BPF filter to all the TCP packets, as the
+// protocols can be on any port.
+func withAutoDetect(filter string) string {
+	if len(filter) == 0 {
+		return filter
+	}
+	return filter + " or tcp"
+}
@@ -0,0 +1,73 @@
+package tcp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tsg/gopacket/layers"
+)
+
+func TestDetectProtocol(t *testing.T) {
+	for _, proto := range []protos.Protocol{protos.HttpProtocol, protos.MysqlProtocol,
+		protos.PgsqlProtocol, protos.RedisProtocol} {
+		previous := protos.Protos.Get(proto)
+		protos.Protos.Register(proto, &TestProtocol{})
+		if previous != nil {
+			defer protos.Protos.Register(proto, previous)
+		} else {
+			defer protos.Protos.Unregister(proto)
+		}
+	}
+
+	tests := []struct {
+		payload  string
+		protocol protos.Protocol
+	}{
+		{"GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n", protos.HttpProtocol},
+		{"HTTP/1.1 200 OK\r\n", protos.HttpProtocol},
+		{"GET /index.html\r\n", protos.UnknownProtocol},
+		{"\x0e\x00\x00\x00\x0a5.6.24\x00\x01\x00\x00\x00", protos.MysqlProtocol},
+		{"\x00\x00\x00\x08\x04\xd2\x16\x2f", protos.PgsqlProtocol},
+		{"\x00\x00\x00\x0d\x00\x03\x00\x00user\x00", protos.PgsqlProtocol},
+		{"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", protos.RedisProtocol},
+		{"*\r\n$3\r\n", protos.UnknownProtocol},
+		{"SSH-2.0-OpenSSH_6.6\r\n", protos.UnknownProtocol},
+		{"", protos.UnknownProtocol},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.protocol, detectProtocol([]byte(test.payload)), "%q", test.payload)
+	}
+
+	// only the enabled plugins are detected
+	protos.Protos.Unregister(protos.RedisProtocol)
+	assert.Equal(t, protos.UnknownProtocol, detectProtocol([]byte("*1\r\n$4\r\nPING\r\n")))
+}
+
+func TestFollowTcp_autoDetect(t *testing.T) {
+	proto, _, _ := reorderTestStream()
+	tuple := common.NewIpPortTuple(4,
+		net.ParseIP("192.168.0.1"), 6515,
+		net.ParseIP("192.168.0.2"), 9999)
+	defer delete(tcpStreamsMap, streamKey{tuple: tuple.Hashable()})
+	request := "GET / HTTP/1.1\r\n\r\n"
+
+	FollowTcp(&layers.TCP{Seq: 1},
+		&protos.Packet{Ts: time.Now(), Tuple: tuple, Payload: []byte(request)})
+	assert.Equal(t, 0, len(proto.payloads))
+
+	AutoDetect = true
+	defer func() { AutoDetect = false }()
+	FollowTcp(&layers.TCP{Seq: 1},
+		&protos.Packet{Ts: time.Now(), Tuple: tuple, Payload: []byte(request)})
+	assert.Equal(t, []string{request}, proto.payloads)
+}
+
+func TestWithAutoDetect(t *testing.T) {
+	assert.Equal(t, "", withAutoDetect(""))
+	assert.Equal(t, "tcp port 80 or tcp", withAutoDetect("tcp port 80"))
+}
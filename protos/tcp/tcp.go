@@ -2,22 +2,54 @@ package tcp
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/johann8384/libbeat/common"
 	"github.com/johann8384/libbeat/logp"
 
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/flows"
 	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/udp"
 
 	"github.com/tsg/gopacket"
 	"github.com/tsg/gopacket/layers"
 )
 
 const TCP_STREAM_EXPIRY = 10 * 1e9
+const TCP_REAPER_INTERVAL = 5 * 1e9
 const TCP_STREAM_HASH_SIZE = 2 ^ 16
 const TCP_MAX_DATA_IN_STREAM = 10 * 1e6
 
+// The segments received after a gap are kept until the missing data
+// arrives, up to this many per direction.
+const TCP_MAX_REORDER_SEGMENTS = 32
+
+// The missing data is considered lost when the first segment following it
+// was captured this long ago. The segments are then passed after a gap.
+const TCP_MAX_REORDER_DELAY = time.Second
+
+// Set by TcpInit from the tcp section of the configuration. The constants
+// above are the defaults.
+var (
+	// idle time after which the state of a stream is released
+	StreamExpiry time.Duration = TCP_STREAM_EXPIRY
+
+	// interval between two runs of the reaper of the idle streams
+	ReaperInterval time.Duration = TCP_REAPER_INTERVAL
+
+	// the protocol plugins drop the streams buffering more data
+	MaxDataInStream int = TCP_MAX_DATA_IN_STREAM
+)
+
+// Clock of the reaper. Replaced by the tests.
+var now = time.Now
+
+// Number of idle streams released since the start.
+var reapedStreams uint64
+
 const (
 	TcpDirectionReverse  = 0
 	TcpDirectionOriginal = 1
@@ -32,7 +64,14 @@ func GetId() uint32 {
 
 // Config
 
-var tcpStreamsMap = make(map[common.HashableIpPortTuple]*TcpStream, TCP_STREAM_HASH_SIZE)
+// The streams are identified by the tuple of their first packet and their
+// link, the streams of different VLANs or tunnels being apart.
+type streamKey struct {
+	tuple common.HashableIpPortTuple
+	link  protos.Link
+}
+
+var tcpStreamsMap = make(map[streamKey]*TcpStream, TCP_STREAM_HASH_SIZE)
 var tcpPortMap map[uint16]protos.Protocol
 
 func decideProtocol(tuple *common.IpPortTuple) protos.Protocol {
@@ -52,23 +91,32 @@ func decideProtocol(tuple *common.IpPortTuple) protos.Protocol {
 type TcpStream struct {
 	id       uint32
 	tuple    *common.IpPortTuple
-	timer    *time.Timer
+	link     protos.Link
+	lastSeen time.Time
 	protocol protos.Protocol
 	tcptuple common.TcpTuple
 
 	lastSeq [2]uint32
 
+	// segments waiting for the missing data, sorted by sequence number
+	reorder [2][]*tcpSegment
+
 	// protocols private data
 	Data protos.ProtocolData
 }
 
-func (stream *TcpStream) AddPacket(pkt *protos.Packet, tcphdr *layers.TCP, original_dir uint8) {
+// tcpSegment is a segment received out of order. The payload is copied,
+// the capture buffers are reused.
+type tcpSegment struct {
+	pkt protos.Packet
+	seq uint32
+	fin bool
+}
 
-	// create/reset timer
-	if stream.timer != nil {
-		stream.timer.Stop()
-	}
-	stream.timer = time.AfterFunc(TCP_STREAM_EXPIRY, func() { stream.Expire() })
+func (stream *TcpStream) AddPacket(pkt *protos.Packet, fin bool, original_dir uint8) {
+
+	// the idle streams are released by ReapStreams
+	stream.lastSeen = now()
 
 	mod := protos.Protos.Get(stream.protocol)
 	if mod == nil {
@@ -80,11 +128,95 @@ func (stream *TcpStream) AddPacket(pkt *protos.Packet, tcphdr *layers.TCP, origi
 		stream.Data = mod.Parse(pkt, &stream.tcptuple, original_dir, stream.Data)
 	}
 
-	if tcphdr.FIN {
+	if fin {
 		stream.Data = mod.ReceivedFin(&stream.tcptuple, original_dir, stream.Data)
 	}
 }
 
+// addSegment passes the segment to the protocol plugin, unless it was
+// already received. The part of the payload already received is cut.
+func (stream *TcpStream) addSegment(pkt *protos.Packet, seq uint32, fin bool, original_dir uint8) {
+	lastSeq := stream.lastSeq[original_dir]
+	end := seq + uint32(len(pkt.Payload))
+
+	if lastSeq != 0 && len(pkt.Payload) > 0 {
+		if TcpSeqBeforeEq(end, lastSeq) {
+			logp.Debug("tcp", "Ignoring what looks like a retrasmitted segment. pkt.seq=%v len=%v stream.seq=%v",
+				seq, len(pkt.Payload), lastSeq)
+			return
+		}
+		if TcpSeqBefore(seq, lastSeq) {
+			pkt.Payload = pkt.Payload[lastSeq-seq:]
+		}
+	}
+	stream.lastSeq[original_dir] = end
+
+	stream.AddPacket(pkt, fin, original_dir)
+}
+
+// bufferSegment keeps a segment received after a gap. The retransmitted
+// segments replace the one with the same sequence number. It returns false
+// if the reorder window is full.
+func (stream *TcpStream) bufferSegment(pkt *protos.Packet, seq uint32, fin bool, original_dir uint8) bool {
+	segments := stream.reorder[original_dir]
+
+	i := len(segments)
+	for i > 0 && TcpSeqBefore(seq, segments[i-1].seq) {
+		i--
+	}
+	retransmitted := i > 0 && segments[i-1].seq == seq
+	if retransmitted && len(pkt.Payload) <= len(segments[i-1].pkt.Payload) {
+		return true
+	}
+	if !retransmitted && len(segments) >= TCP_MAX_REORDER_SEGMENTS {
+		return false
+	}
+
+	segment := &tcpSegment{pkt: *pkt, seq: seq, fin: fin}
+	segment.pkt.Payload = append([]byte{}, pkt.Payload...)
+	if retransmitted {
+		segments[i-1] = segment
+		return true
+	}
+
+	segments = append(segments, nil)
+	copy(segments[i+1:], segments[i:])
+	segments[i] = segment
+	stream.reorder[original_dir] = segments
+	return true
+}
+
+// flushReorder passes the buffered segments that are now contiguous with
+// the data received.
+func (stream *TcpStream) flushReorder(original_dir uint8) {
+	for len(stream.reorder[original_dir]) > 0 {
+		segment := stream.reorder[original_dir][0]
+		if TcpSeqBefore(stream.lastSeq[original_dir], segment.seq) {
+			// still missing data
+			return
+		}
+		stream.reorder[original_dir] = stream.reorder[original_dir][1:]
+		stream.addSegment(&segment.pkt, segment.seq, segment.fin, original_dir)
+	}
+	stream.reorder[original_dir] = nil
+}
+
+// skipGaps gives up on the data missing before the buffered segments
+// captured at deadline or before. The gap is reported to the protocol
+// plugin, then the segments following it are passed.
+func (stream *TcpStream) skipGaps(original_dir uint8, deadline time.Time) {
+	for len(stream.reorder[original_dir]) > 0 {
+		segment := stream.reorder[original_dir][0]
+		if segment.pkt.Ts.After(deadline) {
+			return
+		}
+		logp.Debug("tcp", "Missing data before seq %d considered lost", segment.seq)
+		stream.GapInStream(original_dir)
+		stream.lastSeq[original_dir] = segment.seq
+		stream.flushReorder(original_dir)
+	}
+}
+
 func (stream *TcpStream) GapInStream(original_dir uint8) {
 	mod := protos.Protos.Get(stream.protocol)
 	stream.Data = mod.GapInStream(&stream.tcptuple, original_dir, stream.Data)
@@ -95,12 +227,68 @@ func (stream *TcpStream) Expire() {
 	logp.Debug("mem", "Tcp stream expired")
 
 	// de-register from dict
-	delete(tcpStreamsMap, stream.tuple.Hashable())
+	delete(tcpStreamsMap, streamKey{stream.tuple.Hashable(), stream.link})
 
 	// nullify to help the GC
 	stream.Data = nil
 }
 
+// flush gives the protocol plugin the chance to publish the transactions
+// of the stream still waiting for their response, before its state is
+// released.
+func (stream *TcpStream) flush() {
+	mod := protos.Protos.Get(stream.protocol)
+	if flushable, ok := mod.(protos.StreamFlushableProtocolPlugin); ok {
+		flushable.FlushStream(&stream.tcptuple, stream.Data)
+	}
+}
+
+// ReapStreams releases the state of the streams idle for longer than
+// StreamExpiry, after passing their buffered segments and flushing them.
+// It returns the number of streams still tracked. It must not run
+// concurrently with FollowTcp.
+func ReapStreams() int {
+	reaped := 0
+	for _, stream := range tcpStreamsMap {
+		if now().Sub(stream.lastSeen) < StreamExpiry {
+			continue
+		}
+		for _, dir := range []uint8{TcpDirectionReverse, TcpDirectionOriginal} {
+			stream.skipGaps(dir, now())
+		}
+		stream.flush()
+		stream.Expire()
+		reaped++
+	}
+	reapedStreams += uint64(reaped)
+
+	logp.Debug("tcp", "Streams: %d tracked, %d idle released", len(tcpStreamsMap), reaped)
+	return len(tcpStreamsMap)
+}
+
+// StartReaper runs ReapStreams every ReaperInterval. pause runs it while
+// the packets are not decoded.
+func StartReaper(pause func(func())) {
+	go func() {
+		ticker := time.NewTicker(ReaperInterval)
+		for _ = range ticker.C {
+			pause(func() { ReapStreams() })
+		}
+	}()
+}
+
+// Streams returns the number of streams tracked. It must not run
+// concurrently with FollowTcp.
+func Streams() int {
+	return len(tcpStreamsMap)
+}
+
+// ReapedStreams returns the number of idle streams released since the
+// start.
+func ReapedStreams() uint64 {
+	return reapedStreams
+}
+
 func TcpSeqBefore(seq1 uint32, seq2 uint32) bool {
 	return int32(seq1-seq2) < 0
 }
@@ -115,13 +303,19 @@ func FollowTcp(tcphdr *layers.TCP, pkt *protos.Packet) {
 	// protocol modules.
 	defer logp.Recover("FollowTcp exception")
 
-	stream, exists := tcpStreamsMap[pkt.Tuple.Hashable()]
+	stream, exists := tcpStreamsMap[streamKey{pkt.Tuple.Hashable(), pkt.Link.Key()}]
 	var original_dir uint8 = TcpDirectionOriginal
 	created := false
 	if !exists {
-		stream, exists = tcpStreamsMap[pkt.Tuple.RevHashable()]
+		stream, exists = tcpStreamsMap[streamKey{pkt.Tuple.RevHashable(), pkt.Link.Key()}]
 		if !exists {
 			protocol := decideProtocol(&pkt.Tuple)
+			if protocol == protos.UnknownProtocol && AutoDetect {
+				protocol = detectProtocol(pkt.Payload)
+				if protocol != protos.UnknownProtocol {
+					logp.Debug("tcp", "Detected %s on %s", protocol, pkt.Tuple.String())
+				}
+			}
 			if protocol == protos.UnknownProtocol {
 				// don't follow
 				return
@@ -129,43 +323,42 @@ func FollowTcp(tcphdr *layers.TCP, pkt *protos.Packet) {
 			logp.Debug("tcp", "Stream doesn't exists, creating new")
 
 			// create
-			stream = &TcpStream{id: GetId(), tuple: &pkt.Tuple, protocol: protocol}
+			stream = &TcpStream{id: GetId(), tuple: &pkt.Tuple, link: pkt.Link, protocol: protocol}
 			stream.tcptuple = common.TcpTupleFromIpPort(stream.tuple, stream.id)
-			tcpStreamsMap[pkt.Tuple.Hashable()] = stream
+			tcpStreamsMap[streamKey{pkt.Tuple.Hashable(), pkt.Link.Key()}] = stream
 			created = true
 		} else {
 			original_dir = TcpDirectionReverse
 		}
 	}
+	protos.Stats.CountPacket(stream.protocol)
+
 	tcp_start_seq := tcphdr.Seq
 	tcp_seq := tcp_start_seq + uint32(len(pkt.Payload))
 
 	logp.Debug("tcp", "pkt.start_seq=%v pkt.last_seq=%v stream.last_seq=%v (len=%d)",
 		tcp_start_seq, tcp_seq, stream.lastSeq[original_dir], len(pkt.Payload))
 
-	if len(pkt.Payload) > 0 &&
-		stream.lastSeq[original_dir] != 0 {
+	if !created && stream.lastSeq[original_dir] != 0 &&
+		TcpSeqBefore(stream.lastSeq[original_dir], tcp_start_seq) {
 
-		if TcpSeqBeforeEq(tcp_seq, stream.lastSeq[original_dir]) {
-
-			logp.Debug("tcp", "Ignoring what looks like a retrasmitted segment. pkt.seq=%v len=%v stream.seq=%v",
-				tcphdr.Seq, len(pkt.Payload), stream.lastSeq[original_dir])
+		logp.Debug("tcp", "Gap in tcp stream. last_seq: %d, seq: %d", stream.lastSeq[original_dir], tcp_start_seq)
+		if !stream.bufferSegment(pkt, tcp_start_seq, tcphdr.FIN, original_dir) {
+			logp.Debug("tcp", "Reorder window full, the missing data is lost")
+			stream.GapInStream(original_dir)
+			// drop stream
+			stream.Expire()
 			return
 		}
-
-		if TcpSeqBefore(stream.lastSeq[original_dir], tcp_start_seq) {
-			logp.Debug("tcp", "Gap in tcp stream. last_seq: %d, seq: %d", stream.lastSeq[original_dir], tcp_start_seq)
-			if !created {
-				stream.GapInStream(original_dir)
-				// drop stream
-				stream.Expire()
-				return
-			}
-		}
+	} else {
+		stream.addSegment(pkt, tcp_start_seq, tcphdr.FIN, original_dir)
+		stream.flushReorder(original_dir)
 	}
-	stream.lastSeq[original_dir] = tcp_seq
 
-	stream.AddPacket(pkt, tcphdr, original_dir)
+	deadline := pkt.Ts.Add(-TCP_MAX_REORDER_DELAY)
+	for _, dir := range []uint8{TcpDirectionReverse, TcpDirectionOriginal} {
+		stream.skipGaps(dir, deadline)
+	}
 }
 
 func PrintTcpMap() {
@@ -199,20 +392,114 @@ func buildPortsMap(plugins map[protos.Protocol]protos.ProtocolPlugin) (map[uint1
 	return res, nil
 }
 
+// BpfFilter returns the BPF filter matching the ports of the protocol
+// plugins, used unless the filter is set in the configuration.
 func BpfFilter() string {
+	filter := buildBpfFilter(protos.Protos.GetAll())
+	if AutoDetect {
+		filter = withAutoDetect(filter)
+	}
+	if config.ConfigSingleton.Interfaces.With_tunnels {
+		filter = withTunnels(filter)
+	}
+	if config.ConfigSingleton.Interfaces.With_vlans {
+		filter = withVlans(filter)
+	}
+	return filter
+}
 
-	res := []string{}
+// Ports of the plugins that can also parse UDP are matched for both
+// transports, the others only for TCP.
+func buildBpfFilter(plugins map[protos.Protocol]protos.ProtocolPlugin) string {
+	transports := map[int]string{}
 
-	for _, protoPlugin := range protos.Protos.GetAll() {
+	for _, protoPlugin := range plugins {
+		_, isUdp := protoPlugin.(protos.UdpProtocolPlugin)
 		for _, port := range protoPlugin.GetPorts() {
-			res = append(res, fmt.Sprintf("port %d", port))
+			if isUdp {
+				transports[port] = ""
+			} else if _, exists := transports[port]; !exists {
+				transports[port] = "tcp "
+			}
 		}
 	}
 
+	ports := []int{}
+	for port := range transports {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	res := []string{}
+	for _, port := range ports {
+		res = append(res, fmt.Sprintf("%sport %d", transports[port], port))
+	}
+	if icmpEnabled(plugins) {
+		res = append(res, "icmp", "icmp6")
+	}
+	if len(res) > 0 {
+		// only the first fragment of a datagram has the ports, the
+		// others are captured for the defragmenter: the IPv4 fragments
+		// have the MF flag or an offset, the IPv6 ones a fragment header
+		res = append(res, "(ip[6:2] & 0x3fff != 0)", "(ip6 and ip6[6] == 44)")
+	}
+
 	return strings.Join(res, " or ")
 }
 
+func icmpEnabled(plugins map[protos.Protocol]protos.ProtocolPlugin) bool {
+	for _, protoPlugin := range plugins {
+		if plugin, ok := protoPlugin.(protos.IcmpProtocolPlugin); ok && plugin.IcmpEnabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// ICMP messages have no ports, they are passed to the ICMP plugin if it
+// is enabled.
+func FollowIcmp(pkt *protos.Packet) {
+
+	// This Recover should catch all exceptions in
+	// protocol modules.
+	defer logp.Recover("FollowIcmp exception")
+
+	plugin, ok := protos.Protos.Get(protos.IcmpProtocol).(protos.IcmpProtocolPlugin)
+	if !ok || !plugin.IcmpEnabled() {
+		return
+	}
+	protos.Stats.CountPacket(protos.IcmpProtocol)
+
+	plugin.ParseIcmp(pkt)
+}
+
+func setFromConfig(config config.TcpConfig) {
+	StreamExpiry = TCP_STREAM_EXPIRY
+	if config.Stream_expiry != nil {
+		StreamExpiry = time.Duration(*config.Stream_expiry) * time.Second
+	}
+	ReaperInterval = TCP_REAPER_INTERVAL
+	if config.Reaper_interval != nil {
+		ReaperInterval = time.Duration(*config.Reaper_interval) * time.Second
+	}
+	MaxDataInStream = TCP_MAX_DATA_IN_STREAM
+	if config.Max_data_in_stream != nil {
+		MaxDataInStream = *config.Max_data_in_stream
+	}
+	AutoDetect = config.Auto_detect
+}
+
 func TcpInit() error {
+	setFromConfig(config.ConfigSingleton.Tcp)
+	logp.Debug("tcp", "Stream expiry: %v, reaper interval: %v, max data in stream: %d",
+		StreamExpiry, ReaperInterval, MaxDataInStream)
+	if ReaperInterval <= 0 {
+		return fmt.Errorf("The reaper interval must be positive")
+	}
+
+	// the streams of a previous capture are not continued
+	tcpStreamsMap = make(map[streamKey]*TcpStream, TCP_STREAM_HASH_SIZE)
+
 	var err error
 	tcpPortMap, err = buildPortsMap(protos.Protos.GetAll())
 	if err != nil {
@@ -227,12 +514,23 @@ func TcpInit() error {
 type DecoderStruct struct {
 	Parser *gopacket.DecodingLayerParser
 
+	// the device capturing the packets, set when there are several
+	Device string
+
+	// decode the reassembled IP datagrams and the encapsulated packets
+	ip4Parser *gopacket.DecodingLayerParser
+	ip6Parser *gopacket.DecodingLayerParser
+	ethParser *gopacket.DecodingLayerParser
+	defrag    *defragmenter
+
 	sll     layers.LinuxSLL
 	lo      layers.Loopback
 	eth     layers.Ethernet
+	dot1q   dot1q
 	ip4     layers.IPv4
 	ip6     layers.IPv6
 	tcp     layers.TCP
+	udp     layers.UDP
 	payload gopacket.Payload
 	decoded []gopacket.LayerType
 }
@@ -247,40 +545,81 @@ func CreateDecoder(datalink layers.LinkType) (*DecoderStruct, error) {
 	case layers.LinkTypeLinuxSLL:
 		d.Parser = gopacket.NewDecodingLayerParser(
 			layers.LayerTypeLinuxSLL,
-			&d.sll, &d.ip4, &d.ip6, &d.tcp, &d.payload)
+			&d.sll, &d.dot1q, &d.ip4, &d.ip6, &d.tcp, &d.udp, &d.payload)
 
 	case layers.LinkTypeEthernet:
 		d.Parser = gopacket.NewDecodingLayerParser(
 			layers.LayerTypeEthernet,
-			&d.eth, &d.ip4, &d.ip6, &d.tcp, &d.payload)
+			&d.eth, &d.dot1q, &d.ip4, &d.ip6, &d.tcp, &d.udp, &d.payload)
 
 	case layers.LinkTypeNull: // loopback on OSx
 		d.Parser = gopacket.NewDecodingLayerParser(
 			layers.LayerTypeLoopback,
-			&d.lo, &d.ip4, &d.ip6, &d.tcp, &d.payload)
+			&d.lo, &d.ip4, &d.ip6, &d.tcp, &d.udp, &d.payload)
 
 	default:
 		return nil, fmt.Errorf("Unsuported link type: %s", datalink.String())
 
 	}
 
+	d.ip4Parser = gopacket.NewDecodingLayerParser(
+		layers.LayerTypeIPv4,
+		&d.ip4, &d.ip6, &d.tcp, &d.udp, &d.payload)
+	d.ip6Parser = gopacket.NewDecodingLayerParser(
+		layers.LayerTypeIPv6,
+		&d.ip4, &d.ip6, &d.tcp, &d.udp, &d.payload)
+	d.ethParser = gopacket.NewDecodingLayerParser(
+		layers.LayerTypeEthernet,
+		&d.eth, &d.dot1q, &d.ip4, &d.ip6, &d.tcp, &d.udp, &d.payload)
+	d.defrag = newDefragmenter()
+
 	d.decoded = []gopacket.LayerType{}
 
 	return &d, nil
 }
 
 func (decoder *DecoderStruct) DecodePacketData(data []byte, ci *gopacket.CaptureInfo) {
+	decoder.decode(decoder.Parser, data, ci, nil)
+}
+
+// decode decodes the packet with the parser of its first layer. The
+// packets carried by VXLAN or GRE are decoded in turn, tunnels holds the
+// ids of the tunnels they went through, the outer one first.
+func (decoder *DecoderStruct) decode(parser *gopacket.DecodingLayerParser,
+	data []byte, ci *gopacket.CaptureInfo, tunnels []uint32) {
 
 	var err error
 	var packet protos.Packet
 
-	err = decoder.Parser.DecodeLayers(data, &decoder.decoded)
+	decoder.dot1q.ids = decoder.dot1q.ids[:0]
+
+	err = parser.DecodeLayers(data, &decoder.decoded)
 	if err != nil {
-		logp.Debug("pcapread", "Decoding error: %s", err)
+		// gopacket picks the application layer decoder for some
+		// well known UDP ports (e.g. DNS). These are decoded by
+		// the protocol modules, so the error can be ignored.
+		if _, unsupported := err.(gopacket.UnsupportedLayerType); !unsupported {
+			logp.Debug("pcapread", "Decoding error: %s", err)
+			return
+		}
+	}
+
+	if fragmented, complete := decoder.defragment(ci.Timestamp); fragmented && !complete {
+		// wait for the other fragments
 		return
 	}
 
+	if len(tunnels) < MAX_TUNNEL_DEPTH {
+		if inner, innerParser, id, ok := decoder.decapsulate(); ok {
+			logp.Debug("tunnel", "Encapsulated packet, tunnel id %d", id)
+			decoder.decode(innerParser, inner, ci, append(tunnels, id))
+			return
+		}
+	}
+
 	has_tcp := false
+	has_udp := false
+	has_icmp := false
 
 	for _, layerType := range decoder.decoded {
 		switch layerType {
@@ -291,6 +630,11 @@ func (decoder *DecoderStruct) DecodePacketData(data []byte, ci *gopacket.Capture
 			packet.Tuple.Dst_ip = decoder.ip4.DstIP
 			packet.Tuple.Ip_length = 4
 
+			if decoder.ip4.Protocol == layers.IPProtocolICMPv4 {
+				packet.Payload = decoder.ip4.Payload
+				has_icmp = true
+			}
+
 		case layers.LayerTypeIPv6:
 			logp.Debug("ip", "IPv6 packet")
 
@@ -298,6 +642,11 @@ func (decoder *DecoderStruct) DecodePacketData(data []byte, ci *gopacket.Capture
 			packet.Tuple.Dst_ip = decoder.ip6.DstIP
 			packet.Tuple.Ip_length = 16
 
+			if decoder.ip6.NextHeader == layers.IPProtocolICMPv6 {
+				packet.Payload = decoder.ip6.Payload
+				has_icmp = true
+			}
+
 		case layers.LayerTypeTCP:
 			logp.Debug("ip", "TCP packet")
 
@@ -306,11 +655,72 @@ func (decoder *DecoderStruct) DecodePacketData(data []byte, ci *gopacket.Capture
 
 			has_tcp = true
 
+		case layers.LayerTypeUDP:
+			logp.Debug("ip", "UDP packet")
+
+			packet.Tuple.Src_port = uint16(decoder.udp.SrcPort)
+			packet.Tuple.Dst_port = uint16(decoder.udp.DstPort)
+			packet.Payload = decoder.udp.Payload
+
+			has_udp = true
+
 		case gopacket.LayerTypePayload:
 			packet.Payload = decoder.payload
 		}
 	}
 
+	if ids := decoder.dot1q.ids; len(ids) > 0 {
+		logp.Debug("ip", "VLAN %v", ids)
+		packet.Link.Vlans = len(ids)
+		packet.Link.Vlan = ids[len(ids)-1]
+		if len(ids) > 1 {
+			packet.Link.OuterVlan = ids[0]
+		}
+	}
+	if len(tunnels) > 0 {
+		packet.Link.Tunneled = true
+		packet.Link.TunnelId = tunnels[len(tunnels)-1]
+	}
+	packet.Link.Device = decoder.Device
+
+	packet.Tuple.ComputeHashebles()
+
+	if flows.FlowAccounting.Enabled && packet.Tuple.Src_ip != nil {
+		size := ci.Length
+		if size == 0 {
+			size = len(data)
+		}
+		switch {
+		case has_tcp:
+			flows.FlowAccounting.Record("tcp", &packet.Tuple, packet.Link, size, ci.Timestamp)
+		case has_udp:
+			flows.FlowAccounting.Record("udp", &packet.Tuple, packet.Link, size, ci.Timestamp)
+		case has_icmp:
+			flows.FlowAccounting.Record("icmp", &packet.Tuple, packet.Link, size, ci.Timestamp)
+		}
+	}
+
+	if has_udp {
+		if len(packet.Payload) == 0 {
+			logp.Debug("pcapread", "Ignore empty UDP packet")
+			return
+		}
+
+		packet.Ts = ci.Timestamp
+
+		udp.FollowUdp(&packet)
+		return
+	}
+
+	if has_icmp {
+		logp.Debug("ip", "ICMP packet")
+
+		packet.Ts = ci.Timestamp
+
+		FollowIcmp(&packet)
+		return
+	}
+
 	if !has_tcp {
 		logp.Debug("pcapread", "No TCP header found in message")
 		return
@@ -324,6 +734,5 @@ func (decoder *DecoderStruct) DecodePacketData(data []byte, ci *gopacket.Capture
 
 	packet.Ts = ci.Timestamp
 
-	packet.Tuple.ComputeHashebles()
 	FollowTcp(&decoder.tcp, &packet)
 }
@@ -1,12 +1,16 @@
 package tcp
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/packetbeat/config"
 	"github.com/johann8384/packetbeat/protos"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tsg/gopacket/layers"
 )
 
 type TestProtocol struct {
@@ -36,6 +40,55 @@ func (proto *TestProtocol) GapInStream(tcptuple *common.TcpTuple, dir uint8,
 	return private
 }
 
+type TestUdpProtocol struct {
+	TestProtocol
+}
+
+func (proto *TestUdpProtocol) ParseUdp(pkt *protos.Packet) {
+}
+
+type TestIcmpProtocol struct {
+	TestProtocol
+	Enabled bool
+}
+
+func (proto *TestIcmpProtocol) ParseIcmp(pkt *protos.Packet) {
+}
+
+func (proto *TestIcmpProtocol) IcmpEnabled() bool {
+	return proto.Enabled
+}
+
+func Test_buildBpfFilter(t *testing.T) {
+
+	assert.Equal(t, "", buildBpfFilter(map[protos.Protocol]protos.ProtocolPlugin{}))
+
+	assert.Equal(t, "tcp port 80 or tcp port 3306 or tcp port 8080 or (ip[6:2] & 0x3fff != 0) or (ip6 and ip6[6] == 44)",
+		buildBpfFilter(map[protos.Protocol]protos.ProtocolPlugin{
+			protos.HttpProtocol:  &TestProtocol{Ports: []int{8080, 80, 8080}},
+			protos.MysqlProtocol: &TestProtocol{Ports: []int{3306}},
+		}))
+
+	// UDP capable protocols match both transports
+	assert.Equal(t, "port 53 or tcp port 80 or (ip[6:2] & 0x3fff != 0) or (ip6 and ip6[6] == 44)",
+		buildBpfFilter(map[protos.Protocol]protos.ProtocolPlugin{
+			protos.HttpProtocol: &TestProtocol{Ports: []int{80}},
+			protos.DnsProtocol:  &TestUdpProtocol{TestProtocol{Ports: []int{53}}},
+		}))
+
+	// ICMP has no ports
+	assert.Equal(t, "tcp port 80 or icmp or icmp6 or (ip[6:2] & 0x3fff != 0) or (ip6 and ip6[6] == 44)",
+		buildBpfFilter(map[protos.Protocol]protos.ProtocolPlugin{
+			protos.HttpProtocol: &TestProtocol{Ports: []int{80}},
+			protos.IcmpProtocol: &TestIcmpProtocol{Enabled: true},
+		}))
+	assert.Equal(t, "tcp port 80 or (ip[6:2] & 0x3fff != 0) or (ip6 and ip6[6] == 44)",
+		buildBpfFilter(map[protos.Protocol]protos.ProtocolPlugin{
+			protos.HttpProtocol: &TestProtocol{Ports: []int{80}},
+			protos.IcmpProtocol: &TestIcmpProtocol{Enabled: false},
+		}))
+}
+
 func Test_configToPortsMap(t *testing.T) {
 
 	type configTest struct {
@@ -114,3 +167,260 @@ func Test_configToPortsMap_negative(t *testing.T) {
 		assert.Contains(t, err.Error(), test.Err)
 	}
 }
+
+func TestStreamExpiry_configured(t *testing.T) {
+
+	// the reaper runs with a clock advanced by hand
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	expiry := 30
+	setFromConfig(config.TcpConfig{Stream_expiry: &expiry})
+	defer setFromConfig(config.TcpConfig{})
+	assert.Equal(t, 30*time.Second, StreamExpiry)
+
+	protos.Protos.Register(protos.HttpProtocol, &TestProtocol{Ports: []int{80}})
+	tcpPortMap = map[uint16]protos.Protocol{80: protos.HttpProtocol}
+
+	pkt := &protos.Packet{
+		Ts: time.Now(),
+		Tuple: common.NewIpPortTuple(4,
+			net.ParseIP("192.168.0.1"), 6512,
+			net.ParseIP("192.168.0.2"), 80),
+		Payload: []byte("GET / HTTP/1.1\r\n\r\n"),
+	}
+	FollowTcp(&layers.TCP{Seq: 1}, pkt)
+	_, exists := tcpStreamsMap[streamKey{tuple: pkt.Tuple.Hashable()}]
+	assert.True(t, exists)
+
+	// idle for longer than the default
+	clock = clock.Add(TCP_STREAM_EXPIRY + time.Second)
+	ReapStreams()
+	_, exists = tcpStreamsMap[streamKey{tuple: pkt.Tuple.Hashable()}]
+	assert.True(t, exists)
+
+	clock = clock.Add(20 * time.Second)
+	ReapStreams()
+	_, exists = tcpStreamsMap[streamKey{tuple: pkt.Tuple.Hashable()}]
+	assert.False(t, exists)
+}
+
+func TestStreamExpiry_defaults(t *testing.T) {
+	setFromConfig(config.TcpConfig{})
+
+	assert.Equal(t, time.Duration(TCP_STREAM_EXPIRY), StreamExpiry)
+	assert.Equal(t, time.Duration(TCP_REAPER_INTERVAL), ReaperInterval)
+	assert.Equal(t, int(TCP_MAX_DATA_IN_STREAM), MaxDataInStream)
+}
+
+// Records the payloads passed by the TCP layer.
+type RecordingProtocol struct {
+	TestProtocol
+	payloads []string
+	links    []protos.Link
+	gaps     int
+	fins     int
+	flushed  int
+}
+
+func (proto *RecordingProtocol) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
+	dir uint8, private protos.ProtocolData) protos.ProtocolData {
+	proto.payloads = append(proto.payloads, string(pkt.Payload))
+	proto.links = append(proto.links, pkt.Link)
+	return private
+}
+
+func (proto *RecordingProtocol) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+	proto.fins++
+	return private
+}
+
+func (proto *RecordingProtocol) GapInStream(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+	proto.gaps++
+	return private
+}
+
+func (proto *RecordingProtocol) FlushStream(tcptuple *common.TcpTuple,
+	private protos.ProtocolData) {
+	proto.flushed++
+}
+
+// resetStreams forgets the streams created by a test.
+func resetStreams() {
+	tcpStreamsMap = make(map[streamKey]*TcpStream, TCP_STREAM_HASH_SIZE)
+}
+
+func reorderTestStream() (*RecordingProtocol, func(seq uint32, payload string, fin bool), common.IpPortTuple) {
+	proto := &RecordingProtocol{TestProtocol: TestProtocol{Ports: []int{80}}}
+	protos.Protos.Register(protos.HttpProtocol, proto)
+	tcpPortMap = map[uint16]protos.Protocol{80: protos.HttpProtocol}
+
+	tuple := common.NewIpPortTuple(4,
+		net.ParseIP("192.168.0.1"), 6513,
+		net.ParseIP("192.168.0.2"), 80)
+	send := func(seq uint32, payload string, fin bool) {
+		// the decoder reuses its buffers
+		data := []byte(payload)
+		FollowTcp(&layers.TCP{Seq: seq, FIN: fin},
+			&protos.Packet{Ts: time.Now(), Tuple: tuple, Payload: data})
+		for i := range data {
+			data[i] = 'x'
+		}
+	}
+	return proto, send, tuple
+}
+
+func TestFollowTcp_reorder(t *testing.T) {
+	proto, send, tuple := reorderTestStream()
+	defer delete(tcpStreamsMap, streamKey{tuple: tuple.Hashable()})
+
+	send(1000, "aaa", false)
+	send(1006, "ccc", false)
+	send(1009, "", true)
+	assert.Equal(t, []string{"aaa"}, proto.payloads)
+	assert.Equal(t, 0, proto.fins)
+
+	// the missing segment, retransmitted with the beginning of the next one
+	send(1003, "bbbc", false)
+	assert.Equal(t, []string{"aaa", "bbbc", "cc"}, proto.payloads)
+	assert.Equal(t, 1, proto.fins)
+	assert.Equal(t, 0, proto.gaps)
+
+	// retransmission
+	send(1003, "bbb", false)
+	assert.Equal(t, 3, len(proto.payloads))
+}
+
+func TestFollowTcp_devices(t *testing.T) {
+	proto, _, tuple := reorderTestStream()
+	defer resetStreams()
+
+	// the directions of the connection are captured on different devices
+	FollowTcp(&layers.TCP{Seq: 1000},
+		&protos.Packet{Ts: time.Now(), Tuple: tuple, Payload: []byte("GET"),
+			Link: protos.Link{Device: "eth0"}})
+	reverse := common.NewIpPortTuple(4,
+		tuple.Dst_ip, tuple.Dst_port, tuple.Src_ip, tuple.Src_port)
+	FollowTcp(&layers.TCP{Seq: 5000},
+		&protos.Packet{Ts: time.Now(), Tuple: reverse, Payload: []byte("200"),
+			Link: protos.Link{Device: "eth1"}})
+
+	assert.Equal(t, []string{"GET", "200"}, proto.payloads)
+	assert.Equal(t, []protos.Link{{Device: "eth0"}, {Device: "eth1"}}, proto.links)
+	assert.Equal(t, 1, len(tcpStreamsMap))
+}
+
+func TestFollowTcp_reorderWindowFull(t *testing.T) {
+	proto, send, tuple := reorderTestStream()
+	defer delete(tcpStreamsMap, streamKey{tuple: tuple.Hashable()})
+
+	send(1000, "aaa", false)
+	for i := 0; i < TCP_MAX_REORDER_SEGMENTS; i++ {
+		send(uint32(2000+10*i), "lost", false)
+	}
+	assert.Equal(t, 0, proto.gaps)
+	_, exists := tcpStreamsMap[streamKey{tuple: tuple.Hashable()}]
+	assert.True(t, exists)
+
+	send(3000, "more", false)
+	assert.Equal(t, 1, proto.gaps)
+	assert.Equal(t, []string{"aaa"}, proto.payloads)
+	_, exists = tcpStreamsMap[streamKey{tuple: tuple.Hashable()}]
+	assert.False(t, exists)
+}
+
+func TestFollowTcp_reorderRetransmits(t *testing.T) {
+	proto, send, tuple := reorderTestStream()
+	defer delete(tcpStreamsMap, streamKey{tuple: tuple.Hashable()})
+
+	send(1000, "aaa", false)
+	for i := 0; i < TCP_MAX_REORDER_SEGMENTS+1; i++ {
+		send(1006, "ccc", false)
+	}
+	assert.Equal(t, 0, proto.gaps)
+
+	send(1003, "bbb", false)
+	assert.Equal(t, []string{"aaa", "bbb", "ccc"}, proto.payloads)
+}
+
+func TestFollowTcp_reorderDelay(t *testing.T) {
+	proto, _, tuple := reorderTestStream()
+	defer delete(tcpStreamsMap, streamKey{tuple: tuple.Hashable()})
+
+	ts := time.Now()
+	send := func(tuple common.IpPortTuple, ts time.Time, seq uint32, payload string) {
+		FollowTcp(&layers.TCP{Seq: seq},
+			&protos.Packet{Ts: ts, Tuple: tuple, Payload: []byte(payload)})
+	}
+	response := common.NewIpPortTuple(4, tuple.Dst_ip, tuple.Dst_port, tuple.Src_ip, tuple.Src_port)
+
+	send(tuple, ts, 1000, "aaa")
+	send(tuple, ts, 1006, "ccc")
+	send(tuple, ts.Add(TCP_MAX_REORDER_DELAY/2), 1012, "eee")
+	send(response, ts.Add(TCP_MAX_REORDER_DELAY/2), 5000, "resp")
+	assert.Equal(t, 0, proto.gaps)
+
+	// the first gap is given up, the second one is still waited for
+	send(response, ts.Add(TCP_MAX_REORDER_DELAY), 5004, "resp")
+	assert.Equal(t, 1, proto.gaps)
+	assert.Equal(t, []string{"aaa", "resp", "resp", "ccc"}, proto.payloads)
+
+	send(tuple, ts.Add(TCP_MAX_REORDER_DELAY), 1009, "ddd")
+	assert.Equal(t, 1, proto.gaps)
+	assert.Equal(t, []string{"aaa", "resp", "resp", "ccc", "ddd", "eee"}, proto.payloads)
+}
+
+func TestReapStreams_reorder(t *testing.T) {
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	proto, send, tuple := reorderTestStream()
+	defer delete(tcpStreamsMap, streamKey{tuple: tuple.Hashable()})
+
+	send(1000, "aaa", false)
+	send(1006, "ccc", false)
+
+	clock = clock.Add(StreamExpiry)
+	ReapStreams()
+	assert.Equal(t, 1, proto.gaps)
+	assert.Equal(t, []string{"aaa", "ccc"}, proto.payloads)
+	assert.Equal(t, 1, proto.flushed)
+	_, exists := tcpStreamsMap[streamKey{tuple: tuple.Hashable()}]
+	assert.False(t, exists)
+}
+
+func TestReapStreams(t *testing.T) {
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	proto, send, tuple := reorderTestStream()
+	idle := common.NewIpPortTuple(4,
+		net.ParseIP("192.168.0.3"), 6514,
+		net.ParseIP("192.168.0.2"), 80)
+	defer delete(tcpStreamsMap, streamKey{tuple: tuple.Hashable()})
+	defer delete(tcpStreamsMap, streamKey{tuple: idle.Hashable()})
+
+	FollowTcp(&layers.TCP{Seq: 1},
+		&protos.Packet{Ts: clock, Tuple: idle, Payload: []byte("GET / HTTP/1.1")})
+	streams := Streams()
+	reaped := ReapedStreams()
+
+	// the other stream stays active
+	clock = clock.Add(StreamExpiry / 2)
+	send(1000, "GET / HTTP/1.1", false)
+	assert.Equal(t, streams+1, ReapStreams())
+
+	clock = clock.Add(StreamExpiry / 2)
+	assert.Equal(t, streams, ReapStreams())
+	assert.Equal(t, 1, proto.flushed)
+	assert.Equal(t, reaped+1, ReapedStreams())
+	_, exists := tcpStreamsMap[streamKey{tuple: idle.Hashable()}]
+	assert.False(t, exists)
+	_, exists = tcpStreamsMap[streamKey{tuple: tuple.Hashable()}]
+	assert.True(t, exists)
+}
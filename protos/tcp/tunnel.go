@@ -0,0 +1,120 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/tsg/gopacket"
+	"github.com/tsg/gopacket/layers"
+)
+
+// UDP port of VXLAN, assigned by IANA.
+const VXLAN_PORT = 4789
+
+// The tunnels inside tunnels are decoded up to this depth.
+const MAX_TUNNEL_DEPTH = 2
+
+// Ethernet type of the Ethernet frames carried by GRE, like NVGRE.
+const ethernetTypeTransparentBridging layers.EthernetType = 0x6558
+
+// GRE flags, in the first byte of the header.
+const (
+	greChecksumPresent = 0x80
+	greRoutingPresent  = 0x40
+	greKeyPresent      = 0x20
+	greSeqPresent      = 0x10
+)
+
+// decapsulate returns the packet carried by the decoded VXLAN or GRE
+// packet, the parser of its first layer and the id of the tunnel: the VNI
+// of VXLAN or the key of GRE, 0 when there is none.
+func (decoder *DecoderStruct) decapsulate() (inner []byte, parser *gopacket.DecodingLayerParser, id uint32, ok bool) {
+	var ipProtocol layers.IPProtocol
+	var ipPayload []byte
+	hasUdp := false
+	for _, layerType := range decoder.decoded {
+		switch layerType {
+		case layers.LayerTypeIPv4:
+			ipProtocol, ipPayload = decoder.ip4.Protocol, decoder.ip4.Payload
+		case layers.LayerTypeIPv6:
+			ipProtocol, ipPayload = decoder.ip6.NextHeader, decoder.ip6.Payload
+		case layers.LayerTypeUDP:
+			hasUdp = true
+		}
+	}
+
+	if hasUdp && decoder.udp.DstPort == VXLAN_PORT {
+		inner, id, ok = decodeVxlan(decoder.udp.Payload)
+		return inner, decoder.ethParser, id, ok
+	}
+	if !hasUdp && ipProtocol == layers.IPProtocolGRE {
+		var protocol layers.EthernetType
+		protocol, inner, id, ok = decodeGre(ipPayload)
+		if !ok {
+			return nil, nil, 0, false
+		}
+		switch protocol {
+		case layers.EthernetTypeIPv4:
+			return inner, decoder.ip4Parser, id, true
+		case layers.EthernetTypeIPv6:
+			return inner, decoder.ip6Parser, id, true
+		case ethernetTypeTransparentBridging:
+			return inner, decoder.ethParser, id, true
+		}
+		logp.Debug("tunnel", "Unsupported GRE protocol: %v", protocol)
+	}
+	return nil, nil, 0, false
+}
+
+// decodeVxlan returns the Ethernet frame and the VNI of a VXLAN packet.
+func decodeVxlan(data []byte) (frame []byte, vni uint32, ok bool) {
+	// the I flag tells that the VNI is valid
+	if len(data) < 8 || data[0]&0x08 == 0 {
+		return nil, 0, false
+	}
+	vni = binary.BigEndian.Uint32(data[4:8]) >> 8
+	return data[8:], vni, true
+}
+
+// decodeGre returns the protocol, the payload and the key of a GRE
+// packet. The version 1 of PPTP and the source routes are not supported.
+func decodeGre(data []byte) (protocol layers.EthernetType, payload []byte, key uint32, ok bool) {
+	if len(data) < 4 {
+		return 0, nil, 0, false
+	}
+	flags := data[0]
+	version := data[1] & 0x7
+	if version != 0 || flags&greRoutingPresent != 0 {
+		return 0, nil, 0, false
+	}
+	protocol = layers.EthernetType(binary.BigEndian.Uint16(data[2:4]))
+
+	offset := 4
+	if flags&greChecksumPresent != 0 {
+		offset += 4
+	}
+	if flags&greKeyPresent != 0 {
+		if len(data) < offset+4 {
+			return 0, nil, 0, false
+		}
+		key = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+	}
+	if flags&greSeqPresent != 0 {
+		offset += 4
+	}
+	if len(data) < offset {
+		return 0, nil, 0, false
+	}
+	return protocol, data[offset:], key, true
+}
+
+// withTunnels extends the BPF filter to the VXLAN and GRE packets.
+func withTunnels(filter string) string {
+	if len(filter) == 0 {
+		return filter
+	}
+	return fmt.Sprintf("%s or udp port %d or proto gre", filter, VXLAN_PORT)
+}
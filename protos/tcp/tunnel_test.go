@@ -0,0 +1,138 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tsg/gopacket"
+	"github.com/tsg/gopacket/layers"
+)
+
+// VXLAN packet carrying the Ethernet frame, in a UDP datagram from port
+// 50000 to 4789.
+func vxlanDatagram(vni uint32, frame []byte) []byte {
+	datagram := make([]byte, 16, 16+len(frame))
+	binary.BigEndian.PutUint16(datagram[0:], 50000)
+	binary.BigEndian.PutUint16(datagram[2:], VXLAN_PORT)
+	binary.BigEndian.PutUint16(datagram[4:], uint16(16+len(frame)))
+	datagram[8] = 0x08
+	binary.BigEndian.PutUint32(datagram[12:], vni<<8)
+	return append(datagram, frame...)
+}
+
+// GRE packet with a key, carrying a packet of the given ethernet type.
+func grePacket(key uint32, etherType uint16, payload []byte) []byte {
+	packet := make([]byte, 8, 8+len(payload))
+	packet[0] = greKeyPresent
+	binary.BigEndian.PutUint16(packet[2:], etherType)
+	binary.BigEndian.PutUint32(packet[4:], key)
+	return append(packet, payload...)
+}
+
+func tunnelTestDecoder(t *testing.T) (*DecoderStruct, *RecordingProtocol, func()) {
+	proto, _, _ := reorderTestStream()
+	resetStreams()
+
+	decoder, err := CreateDecoder(layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatalf("CreateDecoder: %s", err)
+	}
+	return decoder, proto, resetStreams
+}
+
+func TestDecodePacketData_vxlan(t *testing.T) {
+	decoder, proto, cleanup := tunnelTestDecoder(t)
+	defer cleanup()
+	ci := &gopacket.CaptureInfo{Timestamp: time.Now()}
+
+	request := "GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	inner := ethernetFrame(0x0800,
+		ipv4Packet(layers.IPProtocolTCP, 1, 0, false, tcpPacket(1000, request)))
+	decoder.DecodePacketData(ethernetFrame(0x0800,
+		ipv4Packet(layers.IPProtocolUDP, 2, 0, false, vxlanDatagram(5001, inner))), ci)
+
+	assert.Equal(t, []string{request}, proto.payloads)
+	assert.Equal(t, protos.Link{Tunneled: true, TunnelId: 5001}, proto.links[0])
+
+	// the I flag is not set, the datagram is not decapsulated
+	notVxlan := vxlanDatagram(5002, ethernetFrame(0x0800,
+		ipv4Packet(layers.IPProtocolTCP, 3, 0, false, tcpPacket(1000+uint32(len(request)), "x"))))
+	notVxlan[8] = 0
+	decoder.DecodePacketData(ethernetFrame(0x0800,
+		ipv4Packet(layers.IPProtocolUDP, 4, 0, false, notVxlan)), ci)
+	assert.Equal(t, 1, len(proto.payloads))
+}
+
+func TestDecodePacketData_gre(t *testing.T) {
+	decoder, proto, cleanup := tunnelTestDecoder(t)
+	defer cleanup()
+	ci := &gopacket.CaptureInfo{Timestamp: time.Now()}
+
+	// IP in GRE
+	ip := ipv4Packet(layers.IPProtocolTCP, 1, 0, false, tcpPacket(1000, "GET / HTTP/1.1"))
+	decoder.DecodePacketData(ethernetFrame(0x0800,
+		ipv4Packet(layers.IPProtocolGRE, 2, 0, false, grePacket(7, 0x0800, ip))), ci)
+	assert.Equal(t, []string{"GET / HTTP/1.1"}, proto.payloads)
+
+	// Ethernet in GRE
+	frame := ethernetFrame(0x0800,
+		ipv4Packet(layers.IPProtocolTCP, 3, 0, false, tcpPacket(1014, "\r\n\r\n")))
+	decoder.DecodePacketData(ethernetFrame(0x0800,
+		ipv4Packet(layers.IPProtocolGRE, 4, 0, false, grePacket(8, 0x6558, frame))), ci)
+	assert.Equal(t, []string{"GET / HTTP/1.1", "\r\n\r\n"}, proto.payloads)
+	assert.Equal(t, []protos.Link{
+		{Tunneled: true, TunnelId: 7},
+		{Tunneled: true, TunnelId: 8},
+	}, proto.links)
+}
+
+// Test that the same addresses in two tunnels are two streams.
+func TestDecodePacketData_tunnelStreams(t *testing.T) {
+	decoder, proto, cleanup := tunnelTestDecoder(t)
+	defer cleanup()
+	ci := &gopacket.CaptureInfo{Timestamp: time.Now()}
+
+	for _, vni := range []uint32{5001, 5002} {
+		inner := ethernetFrame(0x0800,
+			ipv4Packet(layers.IPProtocolTCP, 1, 0, false, tcpPacket(1000, "GET / HTTP/1.1")))
+		decoder.DecodePacketData(ethernetFrame(0x0800,
+			ipv4Packet(layers.IPProtocolUDP, 2, 0, false, vxlanDatagram(vni, inner))), ci)
+	}
+
+	// the second segment is not taken for a retransmission
+	assert.Equal(t, []string{"GET / HTTP/1.1", "GET / HTTP/1.1"}, proto.payloads)
+	assert.Equal(t, 2, len(tcpStreamsMap))
+}
+
+func TestDecodeGre(t *testing.T) {
+	protocol, payload, key, ok := decodeGre([]byte{0, 0, 0x08, 0x00, 0x45})
+	assert.True(t, ok)
+	assert.Equal(t, layers.EthernetTypeIPv4, protocol)
+	assert.Equal(t, []byte{0x45}, payload)
+	assert.Equal(t, uint32(0), key)
+
+	// checksum, key and sequence number
+	protocol, payload, key, ok = decodeGre([]byte{0xb0, 0, 0x86, 0xdd,
+		0, 0, 0, 0, 0, 0, 0, 9, 0, 0, 0, 1, 0x60})
+	assert.True(t, ok)
+	assert.Equal(t, layers.EthernetTypeIPv6, protocol)
+	assert.Equal(t, []byte{0x60}, payload)
+	assert.Equal(t, uint32(9), key)
+
+	// truncated key
+	_, _, _, ok = decodeGre([]byte{0x20, 0, 0x08, 0x00, 0})
+	assert.False(t, ok)
+
+	// PPTP
+	_, _, _, ok = decodeGre([]byte{0x30, 0x81, 0x88, 0x0b, 0, 0, 0, 0, 0, 0, 0, 0})
+	assert.False(t, ok)
+}
+
+func TestWithTunnels(t *testing.T) {
+	assert.Equal(t, "", withTunnels(""))
+	assert.Equal(t, "tcp port 80 or udp port 4789 or proto gre", withTunnels("tcp port 80"))
+}
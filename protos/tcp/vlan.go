@@ -0,0 +1,52 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tsg/gopacket"
+	"github.com/tsg/gopacket/layers"
+)
+
+// Ethernet types of the outer tag of the double tagged (QinQ) frames.
+// 0x9100 was used before 802.1ad.
+const (
+	ethernetTypeQinQ       layers.EthernetType = 0x88a8
+	ethernetTypeQinQLegacy layers.EthernetType = 0x9100
+)
+
+func init() {
+	// gopacket only knows the 802.1Q ethernet type. The outer tag of
+	// the QinQ frames has the same format.
+	layers.EthernetTypeMetadata[ethernetTypeQinQ] = layers.EthernetTypeMetadata[layers.EthernetTypeDot1Q]
+	layers.EthernetTypeMetadata[ethernetTypeQinQLegacy] = layers.EthernetTypeMetadata[layers.EthernetTypeDot1Q]
+}
+
+// dot1q decodes the VLAN tags. The gopacket layer doesn't check the
+// length of the tag. The ids of the tags of a frame are kept in ids, the
+// outer one first.
+type dot1q struct {
+	layers.Dot1Q
+	ids []uint16
+}
+
+func (d *dot1q) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		df.SetTruncated()
+		return errors.New("VLAN tag too short")
+	}
+	err := d.Dot1Q.DecodeFromBytes(data, df)
+	if err != nil {
+		return err
+	}
+	d.ids = append(d.ids, d.VLANIdentifier)
+	return nil
+}
+
+// withVlans extends the BPF filter to the frames with VLAN tags.
+func withVlans(filter string) string {
+	if len(filter) == 0 {
+		return filter
+	}
+	return fmt.Sprintf("%s or (vlan and (%s))", filter, filter)
+}
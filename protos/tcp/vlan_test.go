@@ -0,0 +1,71 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tsg/gopacket"
+	"github.com/tsg/gopacket/layers"
+)
+
+// VLAN tag, followed by a frame of the given ethernet type.
+func vlanTag(id uint16, etherType uint16, payload []byte) []byte {
+	tag := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint16(tag[0:], id)
+	binary.BigEndian.PutUint16(tag[2:], etherType)
+	return append(tag, payload...)
+}
+
+// TCP segment from port 6513 to 80, with the PSH and ACK flags.
+func tcpPacket(seq uint32, payload string) []byte {
+	segment := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(segment[0:], 6513)
+	binary.BigEndian.PutUint16(segment[2:], 80)
+	binary.BigEndian.PutUint32(segment[4:], seq)
+	segment[12] = 5 << 4
+	segment[13] = 0x18
+	binary.BigEndian.PutUint16(segment[14:], 8192)
+	return append(segment, payload...)
+}
+
+func TestDecodePacketData_vlan(t *testing.T) {
+	proto, _, _ := reorderTestStream()
+	defer resetStreams()
+
+	decoder, err := CreateDecoder(layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatalf("CreateDecoder: %s", err)
+	}
+	ci := &gopacket.CaptureInfo{Timestamp: time.Now()}
+
+	ip := ipv4Packet(layers.IPProtocolTCP, 1, 0, false, tcpPacket(1000, "GET / HTTP/1.1"))
+	decoder.DecodePacketData(ethernetFrame(0x8100, vlanTag(100, 0x0800, ip)), ci)
+
+	assert.Equal(t, []string{"GET / HTTP/1.1"}, proto.payloads)
+	assert.Equal(t, []uint16{100}, decoder.dot1q.ids)
+	assert.Equal(t, protos.Link{Vlans: 1, Vlan: 100}, proto.links[0])
+	assert.Equal(t, "192.168.0.1", decoder.ip4.SrcIP.String())
+	assert.Equal(t, layers.TCPPort(80), decoder.tcp.DstPort)
+
+	// double tagged, the outer tag first
+	ip = ipv4Packet(layers.IPProtocolTCP, 2, 0, false, tcpPacket(1014, "\r\n\r\n"))
+	decoder.DecodePacketData(ethernetFrame(0x88a8,
+		vlanTag(10, 0x8100, vlanTag(20, 0x0800, ip))), ci)
+
+	assert.Equal(t, []string{"GET / HTTP/1.1", "\r\n\r\n"}, proto.payloads)
+	assert.Equal(t, []uint16{10, 20}, decoder.dot1q.ids)
+	assert.Equal(t, protos.Link{Vlans: 2, Vlan: 20, OuterVlan: 10}, proto.links[1])
+
+	// truncated tag
+	decoder.DecodePacketData(ethernetFrame(0x8100, []byte{0, 100}), ci)
+	assert.Equal(t, 2, len(proto.payloads))
+}
+
+func TestWithVlans(t *testing.T) {
+	assert.Equal(t, "", withVlans(""))
+	assert.Equal(t, "tcp port 80 or (vlan and (tcp port 80))", withVlans("tcp port 80"))
+}
@@ -20,7 +20,8 @@ import (
 )
 
 type ThriftMessage struct {
-	Ts time.Time
+	Ts   time.Time
+	Link protos.Link
 
 	TcpTuple     common.TcpTuple
 	CmdlineTuple *common.CmdlineTuple
@@ -62,12 +63,27 @@ type ThriftStream struct {
 	// traffic in this direction. Used to skip large responses.
 	skipInput bool
 
+	// id of the previous field of the message, the compact protocol
+	// encodes the field ids as deltas
+	lastFieldId uint16
+
+	conn *thriftConnection
+
 	message *ThriftMessage
 }
 
+// thriftConnection holds the transport and the protocol used on the
+// connection, which are detected from the first messages.
+type thriftConnection struct {
+	detected      bool
+	transportType byte
+	protocolType  byte
+}
+
 type ThriftTransaction struct {
 	Type         string
 	tuple        common.TcpTuple
+	link         protos.Link
 	Src          common.Endpoint
 	Dst          common.Endpoint
 	ResponseTime int32
@@ -75,6 +91,7 @@ type ThriftTransaction struct {
 	JsTs         time.Time
 	ts           time.Time
 	cmdline      *common.CmdlineTuple
+	Status       string
 
 	Request *ThriftMessage
 	Reply   *ThriftMessage
@@ -98,6 +115,10 @@ const (
 	ThriftTypeMask    = 0x000000ff
 )
 
+// Separates the service name from the method name in the messages of the
+// TMultiplexedProtocol.
+const ThriftMultiplexedSeparator = ":"
+
 // Thrift types
 const (
 	ThriftTypeStop   = 0
@@ -149,11 +170,14 @@ type Thrift struct {
 	ObfuscateStrings       bool
 	Send_request           bool
 	Send_response          bool
+	maxTransactions        int
+	transactionTimeout     time.Duration
 
 	TransportType byte
 	ProtocolType  byte
 
-	transMap map[common.HashableTcpTuple]*ThriftTransaction
+	transMap          map[common.HashableTcpTuple]*ThriftTransaction
+	transactionsOrder *protos.TransactionsOrder
 
 	PublishQueue chan *ThriftTransaction
 	results      chan common.MapStr
@@ -173,6 +197,8 @@ func (thrift *Thrift) InitDefaults() {
 	thrift.ObfuscateStrings = false
 	thrift.Send_request = false
 	thrift.Send_response = false
+	thrift.maxTransactions = protos.DefaultMaxTransactions
+	thrift.transactionTimeout = TransactionTimeout
 }
 
 func (thrift *Thrift) readConfig(config config.Thrift) error {
@@ -203,6 +229,8 @@ func (thrift *Thrift) readConfig(config config.Thrift) error {
 		switch *config.Protocol_type {
 		case "binary":
 			thrift.ProtocolType = ThriftTBinary
+		case "compact":
+			thrift.ProtocolType = ThriftTCompact
 		default:
 			return fmt.Errorf("Protocol type `%s` not known", config.Protocol_type)
 		}
@@ -226,6 +254,12 @@ func (thrift *Thrift) readConfig(config config.Thrift) error {
 	if config.Send_response != nil {
 		thrift.Send_response = *config.Send_response
 	}
+	if config.Max_transactions != nil {
+		thrift.maxTransactions = *config.Max_transactions
+	}
+	if config.Transaction_timeout != nil {
+		thrift.transactionTimeout = time.Duration(*config.Transaction_timeout) * time.Second
+	}
 
 	return nil
 }
@@ -246,6 +280,7 @@ func (thrift *Thrift) Init(test_mode bool, results chan common.MapStr) error {
 	}
 
 	thrift.transMap = make(map[common.HashableTcpTuple]*ThriftTransaction, TransactionsHashSize)
+	thrift.transactionsOrder = protos.NewTransactionsOrder()
 
 	if !test_mode {
 		thrift.PublishQueue = make(chan *ThriftTransaction, 1000)
@@ -265,6 +300,10 @@ func (thrift *Thrift) readMessageBegin(s *ThriftStream) (bool, bool) {
 	var ok, complete bool
 	var offset, off int
 
+	if thrift.isCompact(s) {
+		return thrift.readCompactMessageBegin(s)
+	}
+
 	m := s.message
 
 	if len(s.data[s.parseOffset:]) < 9 {
@@ -330,6 +369,8 @@ func (thrift *Thrift) readMessageBegin(s *ThriftStream) (bool, bool) {
 		s.parseOffset = offset + 4
 	}
 
+	splitMultiplexedMethod(m)
+
 	if m.Type == ThriftMsgTypeCall || m.Type == ThriftMsgTypeOneway {
 		m.IsRequest = true
 	} else {
@@ -339,6 +380,74 @@ func (thrift *Thrift) readMessageBegin(s *ThriftStream) (bool, bool) {
 	return true, true
 }
 
+// splitMultiplexedMethod separates the service name that the
+// TMultiplexedProtocol adds in front of the method name, like
+// `Calculator:add`.
+func splitMultiplexedMethod(m *ThriftMessage) {
+	idx := strings.Index(m.Method, ThriftMultiplexedSeparator)
+	if idx <= 0 {
+		return
+	}
+	m.Service = m.Method[:idx]
+	m.Method = m.Method[idx+len(ThriftMultiplexedSeparator):]
+}
+
+func (thrift *Thrift) isCompact(s *ThriftStream) bool {
+	if s.conn != nil {
+		return s.conn.protocolType == ThriftTCompact
+	}
+	return thrift.ProtocolType == ThriftTCompact
+}
+
+// messageProtocol returns the protocol of the message starting at data,
+// if it begins with the version of the binary or of the compact protocol.
+func messageProtocol(data []byte) (protocol byte, found bool) {
+	if len(data) < 2 {
+		return 0, false
+	}
+	if common.Bytes_Ntohs(data[:2]) == ThriftVersion1>>16 {
+		return ThriftTBinary, true
+	}
+	if data[0] == ThriftCompactProtocolId &&
+		data[1]&ThriftCompactVersionMask == ThriftCompactVersion1 {
+		return ThriftTCompact, true
+	}
+	return 0, false
+}
+
+// detectTransport finds whether the connection uses the framed transport
+// and which protocol from the beginning of the message. Until it is
+// recognized, e.g. for the binary protocol without the version, the
+// configured transport and protocol are used.
+func (thrift *Thrift) detectTransport(s *ThriftStream) (complete bool) {
+	conn := s.conn
+	if conn.detected {
+		return true
+	}
+	if len(s.data) < 6 {
+		return false
+	}
+
+	if protocol, found := messageProtocol(s.data); found {
+		conn.transportType = ThriftTSocket
+		conn.protocolType = protocol
+		conn.detected = true
+	} else if protocol, found := messageProtocol(s.data[4:]); found {
+		conn.transportType = ThriftTFramed
+		conn.protocolType = protocol
+		conn.detected = true
+	} else {
+		conn.transportType = thrift.TransportType
+		conn.protocolType = thrift.ProtocolType
+	}
+
+	if conn.detected {
+		logp.Debug("thrift", "Detected transport %d and protocol %d",
+			conn.transportType, conn.protocolType)
+	}
+	return true
+}
+
 // Functions to decode simple types
 // They all have the same signature, returning the string value and the
 // number of bytes consumed (off).
@@ -371,19 +480,18 @@ func (thrift *Thrift) readString(data []byte) (value string, ok bool, complete b
 
 func (thrift *Thrift) readAndQuoteString(data []byte) (value string, ok bool, complete bool, off int) {
 	value, ok, complete, off = thrift.readString(data)
+	return thrift.quoteString(value), ok, complete, off
+}
+
+func (thrift *Thrift) quoteString(value string) string {
 	if value == "" {
-		value = `""`
+		return `""`
 	} else if thrift.ObfuscateStrings {
-		value = `"*"`
-	} else {
-		if utf8.ValidString(value) {
-			value = strconv.Quote(value)
-		} else {
-			value = hex.EncodeToString([]byte(value))
-		}
+		return `"*"`
+	} else if utf8.ValidString(value) {
+		return strconv.Quote(value)
 	}
-
-	return value, ok, complete, off
+	return hex.EncodeToString([]byte(value))
 }
 
 func (thrift *Thrift) readBool(data []byte) (value string, ok bool, complete bool, off int) {
@@ -670,6 +778,10 @@ func (thrift *Thrift) readField(s *ThriftStream) (ok bool, complete bool, field
 
 	var off int
 
+	if thrift.isCompact(s) {
+		return thrift.readCompactField(s)
+	}
+
 	field = new(ThriftField)
 
 	if len(s.data) == 0 {
@@ -716,7 +828,13 @@ func (thrift *Thrift) messageParser(s *ThriftStream) (bool, bool) {
 		switch s.parseState {
 		case ThriftStartState:
 			m.start = s.parseOffset
-			if thrift.TransportType == ThriftTFramed {
+			if s.conn == nil {
+				s.conn = &thriftConnection{}
+			}
+			if !thrift.detectTransport(s) {
+				return true, false
+			}
+			if s.conn.transportType == ThriftTFramed {
 				// read I32
 				if len(s.data) < 4 {
 					return true, false
@@ -756,7 +874,9 @@ func (thrift *Thrift) messageParser(s *ThriftStream) (bool, bool) {
 					if method != nil {
 						m.Params = thrift.formatStruct(m.fields, true, method.Params)
 
-						m.Service = method.Service.Name
+						if len(m.Service) == 0 {
+							m.Service = method.Service.Name
+						}
 					} else {
 						m.Params = thrift.formatStruct(m.fields, false, nil)
 					}
@@ -801,12 +921,16 @@ func (stream *ThriftStream) PrepareForNewMessage(flush bool) {
 	}
 	logp.Debug("thrift", "remaining data: [%s]", stream.data)
 	stream.parseOffset = 0
+	stream.lastFieldId = 0
 	stream.message = nil
 	stream.parseState = ThriftStartState
 }
 
 type thriftPrivateData struct {
 	Data [2]*ThriftStream
+
+	// shared by the streams of both directions
+	Conn *thriftConnection
 }
 
 func (thrift *Thrift) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple, dir uint8,
@@ -823,13 +947,18 @@ func (thrift *Thrift) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple, dir u
 		}
 	}
 
+	if priv.Conn == nil {
+		priv.Conn = &thriftConnection{}
+	}
+
 	stream := priv.Data[dir]
 
 	if stream == nil {
 		stream = &ThriftStream{
 			tcptuple: tcptuple,
 			data:     pkt.Payload,
-			message:  &ThriftMessage{Ts: pkt.Ts},
+			conn:     priv.Conn,
+			message:  &ThriftMessage{Ts: pkt.Ts, Link: pkt.Link},
 		}
 		priv.Data[dir] = stream
 	} else {
@@ -839,8 +968,9 @@ func (thrift *Thrift) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple, dir u
 		}
 		// concatenate bytes
 		stream.data = append(stream.data, pkt.Payload...)
-		if len(stream.data) > tcp.TCP_MAX_DATA_IN_STREAM {
+		if len(stream.data) > tcp.MaxDataInStream {
 			logp.Debug("thrift", "Stream data too large, dropping TCP stream")
+			protos.Stats.CountTooLarge(protos.ThriftProtocol)
 			priv.Data[dir] = nil
 			return priv
 		}
@@ -848,7 +978,7 @@ func (thrift *Thrift) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple, dir u
 
 	for len(stream.data) > 0 {
 		if stream.message == nil {
-			stream.message = &ThriftMessage{Ts: pkt.Ts}
+			stream.message = &ThriftMessage{Ts: pkt.Ts, Link: pkt.Link}
 		}
 
 		ok, complete := thrift.messageParser(priv.Data[dir])
@@ -858,6 +988,8 @@ func (thrift *Thrift) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple, dir u
 			// segment in it
 			priv.Data[dir] = nil
 			logp.Debug("thrift", "Ignore Thrift message. Drop tcp stream. Try parsing with the next segment")
+			protos.ReportParseError(protos.ThriftProtocol, tcptuple, pkt,
+				"Invalid Thrift message")
 			return priv
 		}
 
@@ -918,12 +1050,14 @@ func (thrift *Thrift) receivedRequest(msg *ThriftMessage) {
 	trans := thrift.transMap[tuple.Hashable()]
 	if trans != nil {
 		logp.Debug("thrift", "Two requests without reply, assuming the old one is oneway")
+		thrift.transactionsOrder.Remove(trans)
 		thrift.PublishQueue <- trans
 	}
 
 	trans = &ThriftTransaction{
 		Type:  "thrift",
 		tuple: tuple,
+		link:  msg.Link,
 	}
 	thrift.transMap[tuple.Hashable()] = trans
 
@@ -949,8 +1083,29 @@ func (thrift *Thrift) receivedRequest(msg *ThriftMessage) {
 	if trans.timer != nil {
 		trans.timer.Stop()
 	}
-	trans.timer = time.AfterFunc(TransactionTimeout, func() { thrift.expireTransaction(trans) })
+	trans.timer = time.AfterFunc(thrift.transactionTimeout, func() { thrift.expireTransaction(trans) })
+
+	thrift.transactionsOrder.Add(trans)
+	thrift.evictTransactions()
+}
+
+// evictTransactions publishes the oldest requests, without their reply,
+// while more than maxTransactions are waiting.
+func (thrift *Thrift) evictTransactions() {
+	for thrift.maxTransactions > 0 && thrift.transactionsOrder.Len() > thrift.maxTransactions {
+		trans, ok := thrift.transactionsOrder.Oldest().(*ThriftTransaction)
+		if !ok {
+			break
+		}
+		thrift.transactionsOrder.Remove(trans)
+		delete(thrift.transMap, trans.tuple.Hashable())
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
 
+		trans.Status = protos.OVERFLOW_STATUS
+		thrift.PublishQueue <- trans
+	}
 }
 
 func (thrift *Thrift) receivedReply(msg *ThriftMessage) {
@@ -980,6 +1135,7 @@ func (thrift *Thrift) receivedReply(msg *ThriftMessage) {
 
 	// remove from map
 	thrift.transMap[tuple.Hashable()] = nil
+	thrift.transactionsOrder.Remove(trans)
 	if trans.timer != nil {
 		trans.timer.Stop()
 	}
@@ -994,6 +1150,7 @@ func (thrift *Thrift) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 			logp.Debug("thrift", "FIN and had only one transaction. Assuming one way")
 			thrift.PublishQueue <- trans
 			delete(thrift.transMap, trans.tuple.Hashable())
+			thrift.transactionsOrder.Remove(trans)
 			if trans.timer != nil {
 				trans.timer.Stop()
 			}
@@ -1016,7 +1173,9 @@ func (thrift *Thrift) publishTransactions() {
 		event := common.MapStr{}
 
 		event["type"] = "thrift"
-		if t.Reply != nil && t.Reply.HasException {
+		if len(t.Status) > 0 {
+			event["status"] = t.Status
+		} else if t.Reply != nil && t.Reply.HasException {
 			event["status"] = common.ERROR_STATUS
 		} else {
 			event["status"] = common.OK_STATUS
@@ -1065,6 +1224,7 @@ func (thrift *Thrift) publishTransactions() {
 		event["timestamp"] = common.Time(t.ts)
 		event["src"] = &t.Src
 		event["dst"] = &t.Dst
+		t.link.AddFields(event)
 
 		if thrift.results != nil {
 			thrift.results <- event
@@ -1074,8 +1234,49 @@ func (thrift *Thrift) publishTransactions() {
 	}
 }
 
+// TransactionsInFlight returns the number of requests waiting for their
+// reply.
+func (thrift *Thrift) TransactionsInFlight() int {
+	count := 0
+	for _, trans := range thrift.transMap {
+		if trans != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// Flush publishes the requests still waiting for their reply.
+func (thrift *Thrift) Flush() {
+	for key, trans := range thrift.transMap {
+		delete(thrift.transMap, key)
+		if trans == nil {
+			continue
+		}
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		thrift.transactionsOrder.Remove(trans)
+
+		if trans.Request == nil {
+			continue
+		}
+		trans.Status = protos.SHUTDOWN_STATUS
+		thrift.PublishQueue <- trans
+	}
+}
+
+// Stop ends the goroutine publishing the transactions, once the ones
+// queued are published.
+func (thrift *Thrift) Stop() {
+	if thrift.PublishQueue != nil {
+		close(thrift.PublishQueue)
+	}
+}
+
 func (thrift *Thrift) expireTransaction(trans *ThriftTransaction) {
 	// TODO - also publish?
 	// remove from map
 	delete(thrift.transMap, trans.tuple.Hashable())
+	thrift.transactionsOrder.Remove(trans)
 }
@@ -0,0 +1,468 @@
+package thrift
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/johann8384/libbeat/logp"
+)
+
+// The compact protocol encodes the integers as variable length zigzag
+// integers, packs the field ids as deltas with the types, and the sizes of
+// the short collections with the types of their elements.
+
+const (
+	ThriftCompactProtocolId  = 0x82
+	ThriftCompactVersion1    = 1
+	ThriftCompactVersionMask = 0x1f
+	ThriftCompactTypeShift   = 5
+)
+
+// Thrift compact protocol types
+const (
+	ThriftCompactTypeStop      = 0
+	ThriftCompactTypeBoolTrue  = 1
+	ThriftCompactTypeBoolFalse = 2
+	ThriftCompactTypeByte      = 3
+	ThriftCompactTypeI16       = 4
+	ThriftCompactTypeI32       = 5
+	ThriftCompactTypeI64       = 6
+	ThriftCompactTypeDouble    = 7
+	ThriftCompactTypeBinary    = 8
+	ThriftCompactTypeList      = 9
+	ThriftCompactTypeSet       = 10
+	ThriftCompactTypeMap       = 11
+	ThriftCompactTypeStruct    = 12
+)
+
+// Types of the binary protocol, indexed by compact type.
+var thriftCompactTypes = []byte{
+	ThriftTypeStop,
+	ThriftTypeBool,
+	ThriftTypeBool,
+	ThriftTypeByte,
+	ThriftTypeI16,
+	ThriftTypeI32,
+	ThriftTypeI64,
+	ThriftTypeDouble,
+	ThriftTypeString,
+	ThriftTypeList,
+	ThriftTypeSet,
+	ThriftTypeMap,
+	ThriftTypeStruct,
+}
+
+func readVarint(data []byte) (value uint64, ok bool, complete bool, off int) {
+	value, off = binary.Uvarint(data)
+	if off == 0 {
+		return 0, true, false, 0 // ok, not complete
+	}
+	if off < 0 {
+		return 0, false, false, 0 // overflow
+	}
+	return value, true, true, off
+}
+
+func readZigzag(data []byte) (value int64, ok bool, complete bool, off int) {
+	u, ok, complete, off := readVarint(data)
+	if !ok || !complete {
+		return 0, ok, complete, 0
+	}
+	return int64(u>>1) ^ -int64(u&1), true, true, off
+}
+
+func (thrift *Thrift) readCompactMessageBegin(s *ThriftStream) (bool, bool) {
+	m := s.message
+	data := s.data[s.parseOffset:]
+
+	if len(data) < 2 {
+		return true, false // ok, not complete
+	}
+	if data[0] != ThriftCompactProtocolId {
+		logp.Debug("thrift", "Unexpected protocol id: %d", data[0])
+		return false, false
+	}
+	m.Version = uint32(data[1] & ThriftCompactVersionMask)
+	if m.Version != ThriftCompactVersion1 {
+		logp.Debug("thrift", "Unexpected compact protocol version: %d", m.Version)
+		return false, false
+	}
+	m.Type = uint32(data[1] >> ThriftCompactTypeShift)
+	offset := 2
+
+	seqId, ok, complete, off := readVarint(data[offset:])
+	if !ok {
+		return false, false
+	}
+	if !complete {
+		return true, false
+	}
+	m.SeqId = uint32(seqId)
+	offset += off
+
+	m.Method, ok, complete, off = thrift.readCompactString(data[offset:])
+	if !ok {
+		return false, false // not ok, not complete
+	}
+	if !complete {
+		logp.Debug("thriftdetailed", "Method name not complete")
+		return true, false // ok, not complete
+	}
+	offset += off
+
+	logp.Debug("thriftdetailed", "method = %s", m.Method)
+
+	s.parseOffset += offset
+
+	splitMultiplexedMethod(m)
+	m.IsRequest = m.Type == ThriftMsgTypeCall || m.Type == ThriftMsgTypeOneway
+
+	return true, true
+}
+
+// readCompactString caps the returned value to StringMaxSize but returns the
+// off to the end of it.
+func (thrift *Thrift) readCompactString(data []byte) (value string, ok bool, complete bool, off int) {
+	sz, ok, complete, off := readVarint(data)
+	if !ok || !complete {
+		return "", ok, complete, 0
+	}
+	if sz > uint64(len(data[off:])) {
+		if sz > math.MaxInt32 {
+			return "", false, false, 0
+		}
+		return "", true, false, 0 // ok, not complete
+	}
+
+	end := off + int(sz)
+	if int(sz) > thrift.StringMaxSize {
+		value = string(data[off:off+thrift.StringMaxSize]) + "..."
+	} else {
+		value = string(data[off:end])
+	}
+	return value, true, true, end
+}
+
+func (thrift *Thrift) readCompactAndQuoteString(data []byte) (value string, ok bool, complete bool, off int) {
+	value, ok, complete, off = thrift.readCompactString(data)
+	return thrift.quoteString(value), ok, complete, off
+}
+
+// readCompactBool reads the booleans of the collections. The booleans of the
+// fields are encoded in the type of the field.
+func (thrift *Thrift) readCompactBool(data []byte) (value string, ok bool, complete bool, off int) {
+	if len(data) < 1 {
+		return "", true, false, 0
+	}
+	if data[0] == ThriftCompactTypeBoolTrue {
+		value = "true"
+	} else {
+		value = "false"
+	}
+	return value, true, true, 1
+}
+
+func (thrift *Thrift) readCompactInteger(data []byte) (value string, ok bool, complete bool, off int) {
+	i64, ok, complete, off := readZigzag(data)
+	if !ok || !complete {
+		return "", ok, complete, 0
+	}
+	return strconv.FormatInt(i64, 10), true, true, off
+}
+
+func (thrift *Thrift) readCompactDouble(data []byte) (value string, ok bool, complete bool, off int) {
+	if len(data) < 8 {
+		return "", true, false, 0
+	}
+
+	// unlike the binary protocol, in little endian
+	bits := binary.LittleEndian.Uint64(data[:8])
+	double := math.Float64frombits(bits)
+	value = strconv.FormatFloat(double, 'f', -1, 64)
+
+	return value, true, true, 8
+}
+
+// Common implementation for lists and sets (they share the same compact repr).
+func (thrift *Thrift) readCompactListOrSet(data []byte) (value string, ok bool, complete bool, off int) {
+	if len(data) < 1 {
+		return "", true, false, 0
+	}
+	type_ := data[0] & 0x0f
+	sz := uint64(data[0] >> 4)
+	offset := 1
+
+	if sz == 15 {
+		// larger lists have their size after the type
+		var bytesRead int
+		sz, ok, complete, bytesRead = readVarint(data[offset:])
+		if !ok || !complete {
+			return "", ok, complete, 0
+		}
+		offset += bytesRead
+	}
+	if sz > uint64(len(data)) {
+		// every element takes at least a byte
+		if sz > math.MaxInt32 {
+			logp.Debug("thrift", "List/Set too big: %d", sz)
+			return "", false, false, 0
+		}
+		return "", true, false, 0
+	}
+
+	funcReader, typeFound := thrift.compactReadersByType(type_)
+	if !typeFound {
+		logp.Debug("thrift", "Field type %d not known", type_)
+		return "", false, false, 0
+	}
+
+	fields := []string{}
+	for i := 0; i < int(sz); i++ {
+		value, ok, complete, bytesRead := funcReader(data[offset:])
+		if !ok {
+			return "", false, false, 0
+		}
+		if !complete {
+			return "", true, false, 0
+		}
+
+		if i < thrift.CollectionMaxSize {
+			fields = append(fields, value)
+		} else if i == thrift.CollectionMaxSize {
+			fields = append(fields, "...")
+		}
+		offset += bytesRead
+	}
+
+	return strings.Join(fields, ", "), true, true, offset
+}
+
+func (thrift *Thrift) readCompactSet(data []byte) (value string, ok bool, complete bool, off int) {
+	value, ok, complete, off = thrift.readCompactListOrSet(data)
+	if value != "" {
+		value = "{" + value + "}"
+	}
+	return value, ok, complete, off
+}
+
+func (thrift *Thrift) readCompactList(data []byte) (value string, ok bool, complete bool, off int) {
+	value, ok, complete, off = thrift.readCompactListOrSet(data)
+	if value != "" {
+		value = "[" + value + "]"
+	}
+	return value, ok, complete, off
+}
+
+func (thrift *Thrift) readCompactMap(data []byte) (value string, ok bool, complete bool, off int) {
+	sz, ok, complete, offset := readVarint(data)
+	if !ok || !complete {
+		return "", ok, complete, 0
+	}
+	if sz == 0 {
+		// the types are omitted
+		return "{}", true, true, offset
+	}
+	if sz > uint64(len(data)) {
+		if sz > math.MaxInt32 {
+			logp.Debug("thrift", "Map too big: %d", sz)
+			return "", false, false, 0
+		}
+		return "", true, false, 0
+	}
+	if len(data[offset:]) < 1 {
+		return "", true, false, 0
+	}
+	type_key := data[offset] >> 4
+	type_value := data[offset] & 0x0f
+	offset += 1
+
+	funcReaderKey, typeFound := thrift.compactReadersByType(type_key)
+	if !typeFound {
+		logp.Debug("thrift", "Field type %d not known", type_key)
+		return "", false, false, 0
+	}
+
+	funcReaderValue, typeFound := thrift.compactReadersByType(type_value)
+	if !typeFound {
+		logp.Debug("thrift", "Field type %d not known", type_value)
+		return "", false, false, 0
+	}
+
+	fields := []string{}
+	for i := 0; i < int(sz); i++ {
+		key, ok, complete, bytesRead := funcReaderKey(data[offset:])
+		if !ok {
+			return "", false, false, 0
+		}
+		if !complete {
+			return "", true, false, 0
+		}
+		offset += bytesRead
+
+		value, ok, complete, bytesRead := funcReaderValue(data[offset:])
+		if !ok {
+			return "", false, false, 0
+		}
+		if !complete {
+			return "", true, false, 0
+		}
+		offset += bytesRead
+
+		if i < thrift.CollectionMaxSize {
+			fields = append(fields, key+": "+value)
+		} else if i == thrift.CollectionMaxSize {
+			fields = append(fields, "...")
+		}
+	}
+
+	return "{" + strings.Join(fields, ", ") + "}", true, true, offset
+}
+
+// readCompactFieldHeader reads the compact type and the id of a field. The
+// id is encoded as a delta from the id of the previous field when it is
+// small, or follows the type.
+func readCompactFieldHeader(data []byte, lastId uint16) (type_ byte, id uint16,
+	ok bool, complete bool, off int) {
+
+	if len(data) < 1 {
+		return 0, 0, true, false, 0
+	}
+	type_ = data[0] & 0x0f
+	if type_ == ThriftCompactTypeStop {
+		return type_, 0, true, true, 1
+	}
+	if int(type_) >= len(thriftCompactTypes) {
+		logp.Debug("thrift", "Field type %d not known", type_)
+		return 0, 0, false, false, 0
+	}
+
+	delta := uint16(data[0] >> 4)
+	if delta != 0 {
+		return type_, lastId + delta, true, true, 1
+	}
+
+	i16, ok, complete, bytesRead := readZigzag(data[1:])
+	if !ok || !complete {
+		return 0, 0, ok, complete, 0
+	}
+	return type_, uint16(i16), true, true, 1 + bytesRead
+}
+
+// readCompactFieldValue reads the value of a field of the given compact type.
+func (thrift *Thrift) readCompactFieldValue(type_ byte, data []byte) (value string, ok bool, complete bool, off int) {
+	switch type_ {
+	case ThriftCompactTypeBoolTrue:
+		return "true", true, true, 0
+	case ThriftCompactTypeBoolFalse:
+		return "false", true, true, 0
+	}
+
+	funcReader, typeFound := thrift.compactReadersByType(type_)
+	if !typeFound {
+		logp.Debug("thrift", "Field type %d not known", type_)
+		return "", false, false, 0
+	}
+	return funcReader(data)
+}
+
+func (thrift *Thrift) readCompactStruct(data []byte) (value string, ok bool, complete bool, off int) {
+
+	var bytesRead int
+	var type_ byte
+	var lastId uint16
+	offset := 0
+	fields := []ThriftField{}
+
+	// Loop until hitting a STOP or reaching the maximum number of elements
+	// we follow in a stream (at which point, we assume we interpreted something
+	// wrong).
+	for i := 0; ; i++ {
+		var field ThriftField
+
+		if i >= thrift.DropAfterNStructFields {
+			logp.Debug("thrift", "Too many fields in struct. Dropping as error")
+			return "", false, false, 0
+		}
+
+		type_, field.Id, ok, complete, bytesRead = readCompactFieldHeader(data[offset:], lastId)
+		if !ok {
+			return "", false, false, 0
+		}
+		if !complete {
+			return "", true, false, 0
+		}
+		offset += bytesRead
+		if type_ == ThriftCompactTypeStop {
+			return thrift.formatStruct(fields, false, []*string{}), true, true, offset
+		}
+		field.Type = thriftCompactTypes[type_]
+
+		field.Value, ok, complete, bytesRead = thrift.readCompactFieldValue(type_, data[offset:])
+		if !ok {
+			return "", false, false, 0
+		}
+		if !complete {
+			return "", true, false, 0
+		}
+		fields = append(fields, field)
+		offset += bytesRead
+		lastId = field.Id
+	}
+}
+
+func (thrift *Thrift) compactReadersByType(type_ byte) (func_ ThriftFieldReader, exists bool) {
+	switch type_ {
+	case ThriftCompactTypeBoolTrue, ThriftCompactTypeBoolFalse:
+		return thrift.readCompactBool, true
+	case ThriftCompactTypeByte:
+		return thrift.readByte, true
+	case ThriftCompactTypeI16, ThriftCompactTypeI32, ThriftCompactTypeI64:
+		return thrift.readCompactInteger, true
+	case ThriftCompactTypeDouble:
+		return thrift.readCompactDouble, true
+	case ThriftCompactTypeBinary:
+		return thrift.readCompactAndQuoteString, true
+	case ThriftCompactTypeList:
+		return thrift.readCompactList, true
+	case ThriftCompactTypeSet:
+		return thrift.readCompactSet, true
+	case ThriftCompactTypeMap:
+		return thrift.readCompactMap, true
+	case ThriftCompactTypeStruct:
+		return thrift.readCompactStruct, true
+	default:
+		return nil, false
+	}
+}
+
+func (thrift *Thrift) readCompactField(s *ThriftStream) (ok bool, complete bool, field *ThriftField) {
+
+	type_, id, ok, complete, off := readCompactFieldHeader(s.data[s.parseOffset:], s.lastFieldId)
+	if !ok {
+		return false, false, nil
+	}
+	if !complete {
+		return true, false, nil // ok, not complete
+	}
+	offset := s.parseOffset + off
+	if type_ == ThriftCompactTypeStop {
+		s.parseOffset = offset
+		return true, true, nil // done
+	}
+
+	field = &ThriftField{Type: thriftCompactTypes[type_], Id: id}
+	field.Value, ok, complete, off = thrift.readCompactFieldValue(type_, s.data[offset:])
+	if !ok {
+		return false, false, nil
+	}
+	if !complete {
+		return true, false, nil
+	}
+	offset += off
+
+	s.parseOffset = offset
+	s.lastFieldId = id
+	return true, false, field
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/johann8384/libbeat/common"
 	"github.com/johann8384/libbeat/logp"
@@ -749,6 +750,42 @@ func TestThrift_Parse_OneWayCallWithFin(t *testing.T) {
 	}
 }
 
+func TestThrift_Parse_OneWayCallWithFlush(t *testing.T) {
+
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"thrift", "thriftdetailed"})
+	}
+
+	var thrift Thrift
+	thrift.Init(true, nil)
+	thrift.TransportType = ThriftTFramed
+
+	thrift.PublishQueue = make(chan *ThriftTransaction, 10)
+
+	tcptuple := testTcpTuple()
+
+	req := createTestPacket(t, "0000001080010001000000037a69700000000000")
+
+	var private thriftPrivateData
+	thrift.Parse(req, tcptuple, 0, private)
+	timer := thrift.transMap[tcptuple.Hashable()].timer
+	thrift.Flush()
+
+	trans := expectThriftTransaction(t, thrift)
+	if trans.Request.Method != "zip" ||
+		trans.Reply != nil ||
+		trans.Status != protos.SHUTDOWN_STATUS {
+
+		t.Error("Bad result:", trans)
+	}
+	if thrift.TransactionsInFlight() != 0 || thrift.transactionsOrder.Len() != 0 {
+		t.Error("Transaction not removed on flush")
+	}
+	if timer.Stop() {
+		t.Error("Transaction timer still running")
+	}
+}
+
 func TestThrift_Parse_OneWayCall2Requests(t *testing.T) {
 
 	if testing.Verbose() {
@@ -1054,3 +1091,125 @@ func TestThrift_ExceptionName(t *testing.T) {
 		t.Error("Bad result:", trans)
 	}
 }
+
+func TestThrift_compactMessageParser(t *testing.T) {
+
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"thrift", "thriftdetailed"})
+	}
+
+	var thrift Thrift
+	thrift.InitDefaults()
+
+	// test(1: true, 2: "hi", 3: [1, -1], 4: {"a": 300}, 5: (1: -2),
+	//      20: 1.5, 100: -1), the last field id is not encoded as a delta
+	data, _ := hex.DecodeString("8221050474657374" +
+		"11" + "18026869" + "19250201" + "1b018601" + "61d804" +
+		"1c140300" + "f7000000000000f83f" + "06c80101" + "00")
+	stream := ThriftStream{data: data, message: new(ThriftMessage),
+		conn: &thriftConnection{}}
+	ok, complete := thrift.messageParser(&stream)
+	m := stream.message
+	if !ok || !complete {
+		t.Error("Bad result:", ok, complete)
+	}
+	if stream.conn.protocolType != ThriftTCompact ||
+		stream.conn.transportType != ThriftTSocket {
+		t.Error("Bad protocol detected:", stream.conn)
+	}
+	if !m.IsRequest || m.Method != "test" || m.SeqId != 5 ||
+		m.Params != `(1: true, 2: "hi", 3: [1, -1], 4: {"a": 300}, 5: (1: -2), 20: 1.5, 100: -1)` {
+		t.Error("Bad result:", m)
+	}
+}
+
+func TestThrift_ParseCompactMultiplexed(t *testing.T) {
+
+	if testing.Verbose() {
+		logp.LogInit(logp.LOG_DEBUG, "", false, true, []string{"thrift", "thriftdetailed"})
+	}
+
+	var thrift Thrift
+	thrift.Init(true, nil)
+
+	thrift.PublishQueue = make(chan *ThriftTransaction, 10)
+
+	tcptuple := testTcpTuple()
+
+	// framed, Calculator:add(1: 1, 2: 2) returns 3
+	req := createTestPacket(t, "00000017"+"8221010e"+
+		"43616c63756c61746f723a616464"+"1502"+"1504"+"00")
+	repl := createTestPacket(t, "0000000b"+"82410103616464"+"050006"+"00")
+
+	var private protos.ProtocolData = thriftPrivateData{}
+	private = thrift.Parse(req, tcptuple, 0, private)
+	conn := private.(thriftPrivateData).Conn
+	if conn.transportType != ThriftTFramed || conn.protocolType != ThriftTCompact {
+		t.Error("Bad transport detected:", conn)
+	}
+	thrift.Parse(repl, tcptuple, 1, private)
+
+	trans := expectThriftTransaction(t, thrift)
+	if trans.Request.Method != "add" ||
+		trans.Request.Service != "Calculator" ||
+		trans.Request.Params != "(1: 1, 2: 2)" ||
+		trans.Reply.ReturnValue != "3" ||
+		trans.Request.FrameSize != 0x17 {
+
+		t.Error("Bad result:", trans)
+	}
+}
+
+func TestThrift_multiplexedMethod(t *testing.T) {
+	var thrift Thrift
+	thrift.InitDefaults()
+
+	// binary protocol, Calculator:ping()
+	data, _ := hex.DecodeString("800100010000000f43616c63756c61746f723a70696e670000000000")
+	stream := ThriftStream{data: data, message: new(ThriftMessage)}
+	ok, complete := thrift.messageParser(&stream)
+	m := stream.message
+	if !ok || !complete {
+		t.Error("Bad result:", ok, complete)
+	}
+	if m.Method != "ping" || m.Service != "Calculator" {
+		t.Error("Bad result:", m)
+	}
+}
+
+func TestThrift_Stop(t *testing.T) {
+	var thrift Thrift
+	thrift.Init(true, nil)
+	thrift.TransportType = ThriftTFramed
+
+	thrift.PublishQueue = make(chan *ThriftTransaction, 10)
+	thrift.results = make(chan common.MapStr, 10)
+	stopped := make(chan struct{})
+	go func() {
+		thrift.publishTransactions()
+		close(stopped)
+	}()
+
+	req := createTestPacket(t, "0000001e8001000100000003616464000000000800010000000108"+
+		"00020000000100")
+	var private thriftPrivateData
+	thrift.Parse(req, testTcpTuple(), 0, private)
+
+	// the request waiting for its reply is published before the
+	// goroutine ends
+	thrift.Flush()
+	thrift.Stop()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("The publisher goroutine didn't stop")
+	}
+	if len(thrift.results) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(thrift.results))
+	}
+	event := <-thrift.results
+	if event["method"] != "add" || event["status"] != protos.SHUTDOWN_STATUS {
+		t.Error("Bad result:", event)
+	}
+}
@@ -0,0 +1,307 @@
+package tls
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// Parsing of the TLS records and of the handshake messages sent in
+// clear, before the ChangeCipherSpec.
+
+const tlsRecordHeaderSize = 5
+
+// Record content types
+const (
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+)
+
+// Handshake message types
+const (
+	handshakeClientHello     = 1
+	handshakeServerHello     = 2
+	handshakeCertificate     = 11
+	handshakeServerHelloDone = 14
+)
+
+// Extension types
+const (
+	extensionServerName        = 0
+	extensionALPN              = 16
+	extensionSupportedVersions = 43
+)
+
+var errIncomplete = errors.New("incomplete message")
+
+var cipherSuiteNames = map[uint16]string{
+	0x0005: "TLS_RSA_WITH_RC4_128_SHA",
+	0x000a: "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	0x002f: "TLS_RSA_WITH_AES_128_CBC_SHA",
+	0x0033: "TLS_DHE_RSA_WITH_AES_128_CBC_SHA",
+	0x0035: "TLS_RSA_WITH_AES_256_CBC_SHA",
+	0x0039: "TLS_DHE_RSA_WITH_AES_256_CBC_SHA",
+	0x003c: "TLS_RSA_WITH_AES_128_CBC_SHA256",
+	0x003d: "TLS_RSA_WITH_AES_256_CBC_SHA256",
+	0x009c: "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	0x009d: "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	0x009e: "TLS_DHE_RSA_WITH_AES_128_GCM_SHA256",
+	0x009f: "TLS_DHE_RSA_WITH_AES_256_GCM_SHA384",
+	0x1301: "TLS_AES_128_GCM_SHA256",
+	0x1302: "TLS_AES_256_GCM_SHA384",
+	0x1303: "TLS_CHACHA20_POLY1305_SHA256",
+	0x1304: "TLS_AES_128_CCM_SHA256",
+	0x1305: "TLS_AES_128_CCM_8_SHA256",
+	0xc009: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	0xc00a: "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	0xc013: "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	0xc014: "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	0xc023: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+	0xc027: "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+	0xc02b: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	0xc02c: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	0xc02f: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	0xc030: "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	0xcca8: "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	0xcca9: "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+}
+
+func cipherSuiteString(suite uint16) string {
+	if name, exists := cipherSuiteNames[suite]; exists {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", suite)
+}
+
+var alertNames = map[uint8]string{
+	0:   "close_notify",
+	10:  "unexpected_message",
+	20:  "bad_record_mac",
+	40:  "handshake_failure",
+	42:  "bad_certificate",
+	43:  "unsupported_certificate",
+	44:  "certificate_revoked",
+	45:  "certificate_expired",
+	46:  "certificate_unknown",
+	47:  "illegal_parameter",
+	48:  "unknown_ca",
+	49:  "access_denied",
+	50:  "decode_error",
+	51:  "decrypt_error",
+	70:  "protocol_version",
+	71:  "insufficient_security",
+	80:  "internal_error",
+	86:  "inappropriate_fallback",
+	90:  "user_canceled",
+	109: "missing_extension",
+	112: "unrecognized_name",
+	116: "certificate_required",
+	120: "no_application_protocol",
+}
+
+func alertString(description uint8) string {
+	if name, exists := alertNames[description]; exists {
+		return name
+	}
+	return fmt.Sprintf("%d", description)
+}
+
+// reader reads the big endian integers and the length prefixed vectors
+// of the handshake messages.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = errors.New("message too short")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *reader) uint16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<8 | int(b[1])
+}
+
+func (r *reader) uint24() int {
+	b := r.bytes(3)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+// vector returns the content of a vector with a length of lenSize bytes.
+func (r *reader) vector(lenSize int) *reader {
+	var n int
+	switch lenSize {
+	case 1:
+		n = r.uint8()
+	case 2:
+		n = r.uint16()
+	default:
+		n = r.uint24()
+	}
+	return &reader{data: r.bytes(n), err: r.err}
+}
+
+// readRecord returns the content type and the fragment of the record at
+// the start of data, and the size of the record.
+func readRecord(data []byte) (uint8, []byte, int, error) {
+	if len(data) < tlsRecordHeaderSize {
+		return 0, nil, 0, errIncomplete
+	}
+	if data[1] != 3 {
+		return 0, nil, 0, fmt.Errorf("not a TLS record, version %d.%d", data[1], data[2])
+	}
+	length := int(data[3])<<8 | int(data[4])
+	if len(data) < tlsRecordHeaderSize+length {
+		return 0, nil, 0, errIncomplete
+	}
+	size := tlsRecordHeaderSize + length
+	return data[0], data[tlsRecordHeaderSize:size], size, nil
+}
+
+// readHandshake returns the type and the body of the handshake message at
+// the start of data, and the size of the message. The messages can be
+// split in several records.
+func readHandshake(data []byte) (uint8, []byte, int, error) {
+	if len(data) < 4 {
+		return 0, nil, 0, errIncomplete
+	}
+	length := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	if len(data) < 4+length {
+		return 0, nil, 0, errIncomplete
+	}
+	return data[0], data[4 : 4+length], 4 + length, nil
+}
+
+type clientHello struct {
+	version    uint16
+	serverName string
+	alpn       []string
+	versions   []uint16
+}
+
+func parseClientHello(body []byte) (*clientHello, error) {
+	r := &reader{data: body}
+	hello := &clientHello{version: uint16(r.uint16())}
+	r.bytes(32) // random
+	r.vector(1) // session id
+	r.vector(2) // cipher suites
+	r.vector(1) // compression methods
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) == 0 {
+		// no extensions
+		return hello, nil
+	}
+
+	extensions := r.vector(2)
+	for len(extensions.data) > 0 && extensions.err == nil {
+		typ := extensions.uint16()
+		ext := extensions.vector(2)
+
+		switch typ {
+		case extensionServerName:
+			names := ext.vector(2)
+			for len(names.data) > 0 && names.err == nil {
+				nameType := names.uint8()
+				name := names.vector(2)
+				if nameType == 0 && name.err == nil {
+					hello.serverName = string(name.data)
+				}
+			}
+		case extensionALPN:
+			protocols := ext.vector(2)
+			for len(protocols.data) > 0 && protocols.err == nil {
+				proto := protocols.vector(1)
+				if proto.err == nil {
+					hello.alpn = append(hello.alpn, string(proto.data))
+				}
+			}
+		case extensionSupportedVersions:
+			versions := ext.vector(1)
+			for len(versions.data) >= 2 {
+				hello.versions = append(hello.versions, uint16(versions.uint16()))
+			}
+		}
+	}
+	return hello, extensions.err
+}
+
+type serverHello struct {
+	version     uint16
+	cipherSuite uint16
+	alpn        string
+}
+
+func parseServerHello(body []byte) (*serverHello, error) {
+	r := &reader{data: body}
+	hello := &serverHello{version: uint16(r.uint16())}
+	r.bytes(32) // random
+	r.vector(1) // session id
+	hello.cipherSuite = uint16(r.uint16())
+	r.uint8() // compression method
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) == 0 {
+		return hello, nil
+	}
+
+	extensions := r.vector(2)
+	for len(extensions.data) > 0 && extensions.err == nil {
+		typ := extensions.uint16()
+		ext := extensions.vector(2)
+
+		switch typ {
+		case extensionALPN:
+			proto := ext.vector(2).vector(1)
+			if proto.err == nil {
+				hello.alpn = string(proto.data)
+			}
+		case extensionSupportedVersions:
+			// TLS 1.3 keeps the version of TLS 1.2 in the
+			// header, the actual version is in the extension
+			if version := ext.uint16(); ext.err == nil {
+				hello.version = uint16(version)
+			}
+		}
+	}
+	return hello, extensions.err
+}
+
+// parseCertificate returns the certificate of the server, the first of
+// the chain.
+func parseCertificate(body []byte) (*x509.Certificate, error) {
+	r := &reader{data: body}
+	chain := r.vector(3)
+	cert := chain.vector(3)
+	if cert.err != nil {
+		return nil, cert.err
+	}
+	return x509.ParseCertificate(cert.data)
+}
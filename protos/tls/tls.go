@@ -0,0 +1,366 @@
+package tls
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/procs"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/tcp"
+)
+
+// The handshake, with the certificates of the server, fits in this many
+// bytes. The connections sending more are not analyzed further.
+const MaxHandshakeSize = 256 * 1024
+
+type tlsStream struct {
+	// the bytes not parsed into records yet
+	data []byte
+
+	// the handshake messages, which can be split in several records
+	handshake []byte
+
+	// set after the ChangeCipherSpec, the rest is encrypted
+	encrypted bool
+}
+
+// tlsConnection is the state of a connection, until the end of the
+// handshake sent in clear.
+type tlsConnection struct {
+	streams [2]*tlsStream
+
+	ts        time.Time
+	clientDir uint8
+	link      protos.Link
+
+	client      *clientHello
+	server      *serverHello
+	serverTs    time.Time
+	certificate *x509.Certificate
+	alert       string
+
+	// set once the event is published, the rest of the connection is
+	// ignored
+	done bool
+
+	// status of the event, if published before the end of the handshake
+	status string
+}
+
+type Tls struct {
+	// config
+	Ports []int
+
+	// the connections whose handshake is not published yet
+	pending map[*tlsConnection]common.TcpTuple
+
+	results chan common.MapStr
+}
+
+func (tls *Tls) InitDefaults() {
+}
+
+func (tls *Tls) setFromConfig(config config.Tls) error {
+
+	tls.Ports = config.Ports
+	return nil
+}
+
+func (tls *Tls) GetPorts() []int {
+	return tls.Ports
+}
+
+func (tls *Tls) Init(test_mode bool, results chan common.MapStr) error {
+	tls.InitDefaults()
+	if !test_mode {
+		tls.setFromConfig(config.ConfigSingleton.Protocols.Tls)
+	}
+
+	tls.pending = make(map[*tlsConnection]common.TcpTuple)
+	tls.results = results
+
+	return nil
+}
+
+func (tls *Tls) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
+	dir uint8, private protos.ProtocolData) protos.ProtocolData {
+
+	defer logp.Recover("ParseTls exception")
+
+	conn, ok := private.(*tlsConnection)
+	if !ok || conn == nil {
+		conn = &tlsConnection{ts: pkt.Ts, clientDir: dir, link: pkt.Link}
+		tls.pending[conn] = *tcptuple
+	}
+	if conn.done {
+		return conn
+	}
+
+	stream := conn.streams[dir]
+	if stream == nil {
+		stream = &tlsStream{}
+		conn.streams[dir] = stream
+	}
+	stream.data = append(stream.data, pkt.Payload...)
+	if len(stream.data)+len(stream.handshake) > MaxHandshakeSize {
+		logp.Debug("tls", "Handshake too large, ignoring the connection")
+		tls.publishHandshake(conn, tcptuple)
+		return conn
+	}
+
+	for !conn.done {
+		typ, fragment, size, err := readRecord(stream.data)
+		if err == errIncomplete {
+			// wait for more data
+			break
+		}
+		if err != nil {
+			logp.Debug("tls", "Ignoring the connection: %s", err)
+			conn.done = true
+			delete(tls.pending, conn)
+			break
+		}
+		stream.data = stream.data[size:]
+
+		switch typ {
+		case recordHandshake:
+			if stream.encrypted {
+				// the Finished message
+				break
+			}
+			stream.handshake = append(stream.handshake, fragment...)
+			tls.parseHandshakes(conn, stream, dir, pkt.Ts)
+
+		case recordChangeCipherSpec:
+			stream.encrypted = true
+			if dir != conn.clientDir {
+				// the server ends the handshake
+				tls.publishHandshake(conn, tcptuple)
+			}
+
+		case recordAlert:
+			if !stream.encrypted && len(fragment) == 2 {
+				conn.alert = alertString(fragment[1])
+				logp.Debug("tls", "Alert %s", conn.alert)
+				tls.publishHandshake(conn, tcptuple)
+			}
+
+		case recordApplicationData:
+			tls.publishHandshake(conn, tcptuple)
+		}
+
+		if conn.server != nil && conn.server.version >= 0x0304 {
+			// with TLS 1.3, the rest of the handshake is encrypted
+			tls.publishHandshake(conn, tcptuple)
+		}
+	}
+
+	if len(stream.data) == 0 {
+		// release the buffer of the segment
+		stream.data = nil
+	}
+	return conn
+}
+
+func (tls *Tls) parseHandshakes(conn *tlsConnection, stream *tlsStream,
+	dir uint8, ts time.Time) {
+
+	for len(stream.handshake) > 0 {
+		typ, body, size, err := readHandshake(stream.handshake)
+		if err == errIncomplete {
+			// the message continues in the next record
+			return
+		}
+		stream.handshake = stream.handshake[size:]
+
+		switch typ {
+		case handshakeClientHello:
+			hello, err := parseClientHello(body)
+			if err != nil {
+				logp.Debug("tls", "Invalid ClientHello: %s", err)
+				continue
+			}
+			conn.client = hello
+			conn.clientDir = dir
+			conn.ts = ts
+
+		case handshakeServerHello:
+			hello, err := parseServerHello(body)
+			if err != nil {
+				logp.Debug("tls", "Invalid ServerHello: %s", err)
+				continue
+			}
+			conn.server = hello
+			conn.serverTs = ts
+			if conn.client == nil {
+				// the capture started after the ClientHello
+				conn.clientDir = 1 - dir
+			}
+
+		case handshakeCertificate:
+			if conn.certificate != nil {
+				break
+			}
+			cert, err := parseCertificate(body)
+			if err != nil {
+				logp.Debug("tls", "Invalid certificate: %s", err)
+				continue
+			}
+			conn.certificate = cert
+
+		case handshakeServerHelloDone:
+			// the server is done, the client answers with its keys
+			stream.handshake = nil
+			return
+		}
+	}
+}
+
+func (tls *Tls) GapInStream(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	conn, ok := private.(*tlsConnection)
+	if !ok || conn == nil {
+		return private
+	}
+
+	// the record boundaries are lost
+	logp.Debug("tls", "Gap in the handshake")
+	tls.publishHandshake(conn, tcptuple)
+	return conn
+}
+
+func (tls *Tls) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+
+	conn, ok := private.(*tlsConnection)
+	if !ok || conn == nil {
+		return private
+	}
+
+	tls.publishHandshake(conn, tcptuple)
+	return conn
+}
+
+// Flush publishes the handshakes not complete yet.
+func (tls *Tls) Flush() {
+	for conn, tcptuple := range tls.pending {
+		conn.status = protos.SHUTDOWN_STATUS
+		tls.publishHandshake(conn, &tcptuple)
+	}
+}
+
+// FlushStream publishes the handshake of the idle stream, if not complete
+// yet.
+func (tls *Tls) FlushStream(tcptuple *common.TcpTuple, private protos.ProtocolData) {
+	conn, ok := private.(*tlsConnection)
+	if !ok || conn == nil || conn.done {
+		return
+	}
+	conn.status = protos.EXPIRED_STATUS
+	tls.publishHandshake(conn, tcptuple)
+}
+
+// publishHandshake publishes the event of the connection, once. The
+// parsing stops there.
+func (tls *Tls) publishHandshake(conn *tlsConnection, tcptuple *common.TcpTuple) {
+	if conn.done {
+		return
+	}
+	conn.done = true
+	conn.streams = [2]*tlsStream{}
+	delete(tls.pending, conn)
+
+	if conn.client == nil && conn.server == nil {
+		// nothing known about the connection
+		return
+	}
+
+	if tls.results == nil {
+		return
+	}
+
+	cmdline := procs.ProcWatcher.FindProcessesTuple(tcptuple.IpPort())
+	src := &common.Endpoint{
+		Ip:   tcptuple.Src_ip.String(),
+		Port: tcptuple.Src_port,
+		Proc: string(cmdline.Src),
+	}
+	dst := &common.Endpoint{
+		Ip:   tcptuple.Dst_ip.String(),
+		Port: tcptuple.Dst_port,
+		Proc: string(cmdline.Dst),
+	}
+	if conn.clientDir == tcp.TcpDirectionReverse {
+		src, dst = dst, src
+	}
+
+	details := common.MapStr{}
+	event := common.MapStr{
+		"type":          "tls",
+		"status":        common.OK_STATUS,
+		"tls":           true,
+		"tls_handshake": details,
+		"timestamp":     common.Time(conn.ts),
+		"src":           src,
+		"dst":           dst,
+	}
+	conn.link.AddFields(event)
+
+	if conn.client != nil {
+		if conn.client.serverName != "" {
+			details["server_name"] = conn.client.serverName
+			event["resource"] = conn.client.serverName
+		}
+		if len(conn.client.alpn) > 0 {
+			details["client_alpn"] = conn.client.alpn
+		}
+		versions := conn.client.versions
+		if len(versions) == 0 {
+			versions = []uint16{conn.client.version}
+		}
+		names := make([]string, len(versions))
+		for i, version := range versions {
+			names[i] = protos.TlsVersionString(version)
+		}
+		details["client_versions"] = names
+	}
+
+	if conn.server != nil {
+		event["tls_version"] = protos.TlsVersionString(conn.server.version)
+		details["cipher"] = cipherSuiteString(conn.server.cipherSuite)
+		if conn.server.alpn != "" {
+			details["alpn"] = conn.server.alpn
+		}
+		if conn.client != nil {
+			event["responsetime"] = int32(conn.serverTs.Sub(conn.ts).Nanoseconds() / 1e6)
+		}
+	}
+
+	if cert := conn.certificate; cert != nil {
+		certificate := common.MapStr{
+			"subject":    cert.Subject.CommonName,
+			"issuer":     cert.Issuer.CommonName,
+			"not_before": common.Time(cert.NotBefore),
+			"not_after":  common.Time(cert.NotAfter),
+		}
+		if len(cert.DNSNames) > 0 {
+			certificate["san"] = cert.DNSNames
+		}
+		details["certificate"] = certificate
+	}
+
+	if conn.alert != "" {
+		event["status"] = common.ERROR_STATUS
+		details["alert"] = conn.alert
+	}
+	if conn.status != "" {
+		event["status"] = conn.status
+	}
+
+	tls.results <- event
+}
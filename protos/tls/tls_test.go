@@ -0,0 +1,201 @@
+package tls
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The handshake of a client connecting to example.com. The server
+// answers with TLS 1.2, its certificate is issued by Example CA.
+const (
+	clientHelloHex = "" +
+		"16030300600100005c0303111111111111111111111111111111111111111111" +
+		"1111111111111111111111000004c02f13010100002f00000010000e00000b65" +
+		"78616d706c652e636f6d0010000e000c02683208687474702f312e31002b0005" +
+		"0403040303"
+
+	serverHandshakeHex = "" +
+		"160303018b020000310303222222222222222222222222222222222222222222" +
+		"222222222222222222222200c02f0000090010000500030268320b00014e0001" +
+		"4b000148308201443081eba003020102020102300a06082a8648ce3d04030230" +
+		"15311330110603550403130a4578616d706c65204341301e170d323030313031" +
+		"3030303030305a170d3330303130313030303030305a30163114301206035504" +
+		"03130b6578616d706c652e636f6d3059301306072a8648ce3d020106082a8648" +
+		"ce3d03010703420004bb23d04e31e5bb10fb4be4a5529a4454a35c6bffd9a135" +
+		"f45336ba5a02d319c2ced93bc37ea638aca848c001ff0b2192f6269754a1bf13" +
+		"b5867437a6cfab6ec3a32b302930270603551d110420301e820b6578616d706c" +
+		"652e636f6d820f7777772e6578616d706c652e636f6d300a06082a8648ce3d04" +
+		"030203480030450221009ae673287f44cde0587445b06b4e6083c3e51197d72b" +
+		"f68b0b462c0524ef04ed022048f5a02ecb7ace8ef6a71c640ad21522a29e7b11" +
+		"c0cee90bae528f5db1b3e0890e000000"
+
+	serverHello13Hex = "" +
+		"16030300320200002e0303222222222222222222222222222222222222222222" +
+		"2222222222222222222222001301000006002b00020304"
+
+	alertHex = "" +
+		"15030300020228"
+)
+
+func TlsModForTests() *Tls {
+	var tls Tls
+	tls.Init(true, nil)
+	tls.results = make(chan common.MapStr, 10)
+	return &tls
+}
+
+func testTcpTuple() *common.TcpTuple {
+	t := &common.TcpTuple{
+		Ip_length: 4,
+		Src_ip:    net.IPv4(192, 168, 0, 1), Dst_ip: net.IPv4(192, 168, 0, 2),
+		Src_port: 6512, Dst_port: 443,
+	}
+	t.ComputeHashebles()
+	return t
+}
+
+type segment struct {
+	dir     uint8
+	payload string
+}
+
+// exchange feeds the hex encoded segments to the parser, one millisecond
+// apart.
+func exchange(t *testing.T, tls *Tls, segments ...segment) protos.ProtocolData {
+	tcptuple := testTcpTuple()
+	ts := time.Now()
+
+	var private protos.ProtocolData
+	for _, seg := range segments {
+		payload, err := hex.DecodeString(seg.payload)
+		if err != nil {
+			t.Fatalf("Failed to decode hex string: %s", err)
+		}
+		private = tls.Parse(&protos.Packet{Ts: ts, Payload: payload},
+			tcptuple, seg.dir, private)
+		ts = ts.Add(time.Millisecond)
+	}
+	return private
+}
+
+func expectEvent(t *testing.T, tls *Tls) common.MapStr {
+	select {
+	case event := <-tls.results:
+		return event
+	default:
+		t.Fatal("No event published")
+	}
+	return nil
+}
+
+func TestTls_handshake12(t *testing.T) {
+	tls := TlsModForTests()
+
+	// the records of the server are split across segments
+	exchange(t, tls,
+		segment{0, clientHelloHex},
+		segment{1, serverHandshakeHex[:150]},
+		segment{1, serverHandshakeHex[150:500]},
+		segment{1, serverHandshakeHex[500:]},
+		segment{0, "140303000101"},
+		segment{1, "140303000101"})
+
+	event := expectEvent(t, tls)
+	assert.Equal(t, "tls", event["type"])
+	assert.Equal(t, common.OK_STATUS, event["status"])
+	assert.Equal(t, "example.com", event["resource"])
+	assert.Equal(t, "TLSv1.2", event["tls_version"])
+	// the ServerHello is complete in the third segment
+	assert.Equal(t, int32(3), event["responsetime"])
+
+	details := event["tls_handshake"].(common.MapStr)
+	assert.Equal(t, "example.com", details["server_name"])
+	assert.Equal(t, []string{"h2", "http/1.1"}, details["client_alpn"])
+	assert.Equal(t, []string{"TLSv1.3", "TLSv1.2"}, details["client_versions"])
+	assert.Equal(t, "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", details["cipher"])
+	assert.Equal(t, "h2", details["alpn"])
+
+	cert := details["certificate"].(common.MapStr)
+	assert.Equal(t, "example.com", cert["subject"])
+	assert.Equal(t, "Example CA", cert["issuer"])
+	assert.Equal(t, []string{"example.com", "www.example.com"}, cert["san"])
+	assert.Equal(t,
+		common.Time(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)),
+		cert["not_after"])
+
+	// the client sent the ClientHello in the reverse direction of the
+	// tuple, it is the destination of the tuple
+	src := event["src"].(*common.Endpoint)
+	assert.Equal(t, uint16(443), src.Port)
+
+	// the rest of the connection is ignored
+	exchange(t, tls, segment{0, "170303000400000000"})
+	assert.Equal(t, 0, len(tls.results))
+}
+
+func TestTls_handshake13(t *testing.T) {
+	tls := TlsModForTests()
+
+	exchange(t, tls,
+		segment{0, clientHelloHex},
+		segment{1, serverHello13Hex + "140303000101"})
+
+	event := expectEvent(t, tls)
+	assert.Equal(t, "TLSv1.3", event["tls_version"])
+
+	details := event["tls_handshake"].(common.MapStr)
+	assert.Equal(t, "TLS_AES_128_GCM_SHA256", details["cipher"])
+	assert.Nil(t, details["certificate"])
+	assert.Equal(t, 0, len(tls.results))
+}
+
+func TestTls_alert(t *testing.T) {
+	tls := TlsModForTests()
+
+	exchange(t, tls,
+		segment{0, clientHelloHex},
+		segment{1, alertHex})
+
+	event := expectEvent(t, tls)
+	assert.Equal(t, common.ERROR_STATUS, event["status"])
+	assert.Nil(t, event["tls_version"])
+
+	details := event["tls_handshake"].(common.MapStr)
+	assert.Equal(t, "handshake_failure", details["alert"])
+}
+
+func TestTls_notTls(t *testing.T) {
+	tls := TlsModForTests()
+
+	private := exchange(t, tls,
+		segment{0, "474554202f20485454502f312e310d0a0d0a"})
+
+	conn := private.(*tlsConnection)
+	assert.True(t, conn.done)
+	assert.Equal(t, 0, len(tls.results))
+	assert.Equal(t, 0, len(tls.pending))
+}
+
+// Test that the handshake not complete yet is published when the plugin
+// is flushed on shutdown.
+func TestTls_flush(t *testing.T) {
+	tls := TlsModForTests()
+
+	exchange(t, tls, segment{0, clientHelloHex})
+	assert.Equal(t, 0, len(tls.results))
+
+	tls.Flush()
+
+	event := expectEvent(t, tls)
+	assert.Equal(t, protos.SHUTDOWN_STATUS, event["status"])
+	assert.NotNil(t, event["tls_handshake"].(common.MapStr)["client_versions"])
+	assert.Equal(t, 0, len(tls.pending))
+}
@@ -0,0 +1,179 @@
+package protos
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+)
+
+// Detection of the connections switching to TLS, after the SSL requests
+// of MySQL and PostgreSQL or from the start like Redis behind a TLS
+// proxy. The analyzers can't parse the encrypted data, they publish a
+// single event for the connection instead.
+
+const (
+	tlsRecordHandshake      = 22
+	tlsHandshakeClientHello = 1
+	tlsHandshakeServerHello = 2
+
+	tlsExtensionSupportedVersions = 0x002b
+)
+
+// The ServerHello is waited for up to this size.
+const tlsMaxServerHelloSize = 16 * 1024
+
+var tlsVersionNames = map[uint16]string{
+	0x0300: "SSLv3",
+	0x0301: "TLSv1.0",
+	0x0302: "TLSv1.1",
+	0x0303: "TLSv1.2",
+	0x0304: "TLSv1.3",
+}
+
+// TlsVersionString returns the name of a TLS protocol version, like
+// TLSv1.2.
+func TlsVersionString(version uint16) string {
+	if name, exists := tlsVersionNames[version]; exists {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// IsTlsClientHello returns true if data starts with the TLS record of
+// a ClientHello.
+func IsTlsClientHello(data []byte) bool {
+	return len(data) >= 6 &&
+		data[0] == tlsRecordHandshake &&
+		data[1] == 3 && data[2] <= 4 &&
+		data[5] == tlsHandshakeClientHello
+}
+
+// ParseTlsServerHello returns the version negotiated by the ServerHello
+// at the start of data. ok is false if data doesn't start with a
+// ServerHello, more is true if the ServerHello is not complete.
+func ParseTlsServerHello(data []byte) (version string, ok bool, more bool) {
+	if len(data) < 6 {
+		return "", false, len(data) == 0 || data[0] == tlsRecordHandshake
+	}
+	if data[0] != tlsRecordHandshake || data[5] != tlsHandshakeServerHello {
+		return "", false, false
+	}
+	recordLen := int(data[3])<<8 | int(data[4])
+	if len(data) < 5+recordLen {
+		return "", false, true
+	}
+	hello := data[5 : 5+recordLen]
+
+	// handshake type, length, version and random
+	if len(hello) < 4+2+32+1 {
+		return "", false, false
+	}
+	negotiated := uint16(hello[4])<<8 | uint16(hello[5])
+
+	// TLS 1.3 keeps the version of TLS 1.2 in the header, the actual
+	// version is in the supported_versions extension
+	off := 4 + 2 + 32
+	off += 1 + int(hello[off]) // session id
+	off += 2 + 1               // cipher suite and compression method
+	if off+2 <= len(hello) {
+		end := off + 2 + (int(hello[off])<<8 | int(hello[off+1]))
+		off += 2
+		for off+4 <= end && end <= len(hello) {
+			typ := uint16(hello[off])<<8 | uint16(hello[off+1])
+			length := int(hello[off+2])<<8 | int(hello[off+3])
+			off += 4
+			if typ == tlsExtensionSupportedVersions && length == 2 && off+2 <= end {
+				negotiated = uint16(hello[off])<<8 | uint16(hello[off+1])
+			}
+			off += length
+		}
+	}
+
+	return TlsVersionString(negotiated), true, false
+}
+
+// TlsUpgrade is the state of a connection that switched to TLS. It
+// waits for the ServerHello to learn the negotiated version.
+type TlsUpgrade struct {
+	// time and direction of the ClientHello
+	Ts        time.Time
+	ClientDir uint8
+	Link      Link
+
+	// time of the ServerHello
+	ResponseTs time.Time
+	Version    string
+
+	// set once the event of the connection is published
+	Published bool
+
+	serverData []byte
+}
+
+// NewTlsUpgrade starts following the connection at the packet of its
+// ClientHello.
+func NewTlsUpgrade(pkt *Packet, clientDir uint8) *TlsUpgrade {
+	return &TlsUpgrade{Ts: pkt.Ts, ClientDir: clientDir, Link: pkt.Link}
+}
+
+// Received takes the data of the connection following the ClientHello.
+// It returns true once the ServerHello is parsed, or is known to be
+// missing, and the event can be published.
+func (t *TlsUpgrade) Received(pkt *Packet, dir uint8) bool {
+	if t.Published || dir == t.ClientDir {
+		return false
+	}
+
+	t.serverData = append(t.serverData, pkt.Payload...)
+	version, ok, more := ParseTlsServerHello(t.serverData)
+	if more && len(t.serverData) < tlsMaxServerHelloSize {
+		return false
+	}
+	if ok {
+		t.Version = version
+	}
+	t.ResponseTs = pkt.Ts
+	t.serverData = nil
+	return true
+}
+
+// Event returns the event published for the connection and marks it
+// as published. The client is the source of the event, reverse tells
+// if the client is the destination of the tuple.
+func (t *TlsUpgrade) Event(typ string, tuple *common.TcpTuple,
+	cmdline *common.CmdlineTuple, reverse bool) common.MapStr {
+
+	t.Published = true
+
+	src := &common.Endpoint{
+		Ip:   tuple.Src_ip.String(),
+		Port: tuple.Src_port,
+		Proc: string(cmdline.Src),
+	}
+	dst := &common.Endpoint{
+		Ip:   tuple.Dst_ip.String(),
+		Port: tuple.Dst_port,
+		Proc: string(cmdline.Dst),
+	}
+	if reverse {
+		src, dst = dst, src
+	}
+
+	event := common.MapStr{
+		"type":      typ,
+		"status":    common.OK_STATUS,
+		"tls":       true,
+		"timestamp": common.Time(t.Ts),
+		"src":       src,
+		"dst":       dst,
+	}
+	if t.Version != "" {
+		event["tls_version"] = t.Version
+	}
+	if !t.ResponseTs.IsZero() {
+		event["responsetime"] = int32(t.ResponseTs.Sub(t.Ts).Nanoseconds() / 1e6)
+	}
+	t.Link.AddFields(event)
+	return event
+}
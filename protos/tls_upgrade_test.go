@@ -0,0 +1,48 @@
+package protos
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTlsServerHello(t *testing.T) {
+	tls12, _ := hex.DecodeString(
+		"160301002c0200002803032222222222222222222222222222222222222222222222" +
+			"22222222222222222200c02f000000")
+	tls13, _ := hex.DecodeString(
+		"16030100320200002e03032222222222222222222222222222222222222222222222" +
+			"222222222222222222001301000006002b00020304")
+
+	version, ok, more := ParseTlsServerHello(tls12)
+	assert.Equal(t, "TLSv1.2", version)
+	assert.True(t, ok)
+	assert.False(t, more)
+
+	version, ok, _ = ParseTlsServerHello(tls13)
+	assert.Equal(t, "TLSv1.3", version)
+	assert.True(t, ok)
+
+	_, ok, more = ParseTlsServerHello(tls13[:20])
+	assert.False(t, ok)
+	assert.True(t, more)
+
+	_, ok, more = ParseTlsServerHello([]byte("+OK\r\n"))
+	assert.False(t, ok)
+	assert.False(t, more)
+}
+
+func TestTlsUpgrade_serverHelloSplit(t *testing.T) {
+	serverHello, _ := hex.DecodeString(
+		"160301002c0200002803032222222222222222222222222222222222222222222222" +
+			"22222222222222222200c02f000000")
+
+	ts := time.Now()
+	upgrade := NewTlsUpgrade(&Packet{Ts: ts}, 0)
+	assert.False(t, upgrade.Received(&Packet{Ts: ts, Payload: []byte{0x16, 3, 1}}, 0))
+	assert.False(t, upgrade.Received(&Packet{Ts: ts, Payload: serverHello[:10]}, 1))
+	assert.True(t, upgrade.Received(&Packet{Ts: ts, Payload: serverHello[10:]}, 1))
+	assert.Equal(t, "TLSv1.2", upgrade.Version)
+}
@@ -0,0 +1,78 @@
+package protos
+
+import (
+	"container/list"
+	"sync"
+)
+
+// By default, the plugins keep this many transactions waiting for their
+// response, by protocol. The oldest are published when there are more,
+// like when a port scan sends requests that are never answered.
+const DefaultMaxTransactions = 10000
+
+// Status of the transactions published before their response was
+// received, because there were too many transactions waiting.
+const OVERFLOW_STATUS = "Overflow"
+
+// Note added to the transactions published because there were too many
+// transactions waiting, for the protocols having notes.
+const OverflowNote = "Too many transactions waiting for their response, published without it"
+
+// TransactionsOrder keeps the transactions waiting for their response in
+// the order they were added, to find the oldest when there are too many.
+// The transactions are the pointers stored by the plugin. It is safe for
+// concurrent use, the transactions are removed by their expiry timers.
+type TransactionsOrder struct {
+	lock     sync.Mutex
+	list     *list.List
+	elements map[interface{}]*list.Element
+}
+
+func NewTransactionsOrder() *TransactionsOrder {
+	return &TransactionsOrder{
+		list:     list.New(),
+		elements: map[interface{}]*list.Element{},
+	}
+}
+
+// Add appends the transaction, or moves it last if it is already there,
+// like when a new request reuses the transaction of its connection.
+func (order *TransactionsOrder) Add(trans interface{}) {
+	order.lock.Lock()
+	defer order.lock.Unlock()
+
+	if element, exists := order.elements[trans]; exists {
+		order.list.MoveToBack(element)
+		return
+	}
+	order.elements[trans] = order.list.PushBack(trans)
+}
+
+func (order *TransactionsOrder) Remove(trans interface{}) {
+	order.lock.Lock()
+	defer order.lock.Unlock()
+
+	if element, exists := order.elements[trans]; exists {
+		order.list.Remove(element)
+		delete(order.elements, trans)
+	}
+}
+
+// Oldest returns the transaction added first, or nil. The transaction
+// can be removed by its timer before Len is called again.
+func (order *TransactionsOrder) Oldest() interface{} {
+	order.lock.Lock()
+	defer order.lock.Unlock()
+
+	if element := order.list.Front(); element != nil {
+		return element.Value
+	}
+	return nil
+}
+
+func (order *TransactionsOrder) Len() int {
+	order.lock.Lock()
+	defer order.lock.Unlock()
+
+	return order.list.Len()
+}
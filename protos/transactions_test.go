@@ -0,0 +1,46 @@
+package protos
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionsOrder(t *testing.T) {
+	order := NewTransactionsOrder()
+	assert.Nil(t, order.Oldest())
+
+	a, b := new(int), new(int)
+	order.Add(a)
+	order.Add(b)
+	order.Add(a)
+	assert.Equal(t, 2, order.Len())
+	assert.Equal(t, b, order.Oldest())
+
+	order.Remove(b)
+	order.Remove(b)
+	assert.Equal(t, a, order.Oldest())
+}
+
+// The expiry timers remove the transactions while the parser adds others.
+func TestTransactionsOrder_concurrent(t *testing.T) {
+	order := NewTransactionsOrder()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				trans := new(int)
+				order.Add(trans)
+				order.Oldest()
+				order.Remove(trans)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 0, order.Len())
+	assert.Nil(t, order.Oldest())
+}
@@ -0,0 +1,74 @@
+package udp
+
+import (
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/protos"
+)
+
+var udpPortMap map[uint16]protos.Protocol
+
+func decideProtocol(tuple *common.IpPortTuple) protos.Protocol {
+	protocol, exists := udpPortMap[tuple.Src_port]
+	if exists {
+		return protocol
+	}
+
+	protocol, exists = udpPortMap[tuple.Dst_port]
+	if exists {
+		return protocol
+	}
+
+	return protos.UnknownProtocol
+}
+
+// UDP has no streams, so each datagram is passed as it is to the
+// plugin registered for its ports.
+func FollowUdp(pkt *protos.Packet) {
+
+	// This Recover should catch all exceptions in
+	// protocol modules.
+	defer logp.Recover("FollowUdp exception")
+
+	protocol := decideProtocol(&pkt.Tuple)
+	if protocol == protos.UnknownProtocol {
+		// don't follow
+		return
+	}
+
+	plugin, ok := protos.Protos.Get(protocol).(protos.UdpProtocolPlugin)
+	if !ok {
+		logp.Debug("udp", "Ignoring protocol for which we have no UDP module loaded: %s", protocol)
+		return
+	}
+	protos.Stats.CountPacket(protocol)
+
+	plugin.ParseUdp(pkt)
+}
+
+// Only the plugins that can parse UDP are added to the map. Duplicate
+// ports are already reported by the tcp module.
+func buildPortsMap(plugins map[protos.Protocol]protos.ProtocolPlugin) map[uint16]protos.Protocol {
+	var res = map[uint16]protos.Protocol{}
+
+	for proto, protoPlugin := range plugins {
+		if _, ok := protoPlugin.(protos.UdpProtocolPlugin); !ok {
+			continue
+		}
+
+		for _, port := range protoPlugin.GetPorts() {
+			res[uint16(port)] = proto
+		}
+	}
+
+	return res
+}
+
+func UdpInit() error {
+	udpPortMap = buildPortsMap(protos.Protos.GetAll())
+
+	logp.Debug("udp", "Port map: %v", udpPortMap)
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package udp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type TestProtocol struct {
+	Ports []int
+}
+
+func (proto *TestProtocol) Init(test_mode bool, results chan common.MapStr) error {
+	return nil
+}
+
+func (proto *TestProtocol) GetPorts() []int {
+	return proto.Ports
+}
+
+func (proto *TestProtocol) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
+	dir uint8, private protos.ProtocolData) protos.ProtocolData {
+	return private
+}
+
+func (proto *TestProtocol) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+	return private
+}
+
+func (proto *TestProtocol) GapInStream(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+	return private
+}
+
+type TestUdpProtocol struct {
+	TestProtocol
+	packets []*protos.Packet
+}
+
+func (proto *TestUdpProtocol) ParseUdp(pkt *protos.Packet) {
+	proto.packets = append(proto.packets, pkt)
+}
+
+func Test_buildPortsMapOnlyUdp(t *testing.T) {
+
+	ports := buildPortsMap(map[protos.Protocol]protos.ProtocolPlugin{
+		protos.HttpProtocol: &TestProtocol{Ports: []int{80, 8080}},
+		protos.DnsProtocol:  &TestUdpProtocol{TestProtocol: TestProtocol{Ports: []int{53}}},
+	})
+
+	assert.Equal(t, map[uint16]protos.Protocol{53: protos.DnsProtocol}, ports)
+}
+
+func Test_FollowUdp(t *testing.T) {
+
+	dns := &TestUdpProtocol{TestProtocol: TestProtocol{Ports: []int{53}}}
+	protos.Protos.Register(protos.DnsProtocol, dns)
+	UdpInit()
+
+	request := &protos.Packet{
+		Tuple: common.NewIpPortTuple(4,
+			net.ParseIP("192.168.0.1"), 34567,
+			net.ParseIP("192.168.0.2"), 53),
+		Payload: []byte("request"),
+	}
+	FollowUdp(request)
+
+	response := &protos.Packet{
+		Tuple: common.NewIpPortTuple(4,
+			net.ParseIP("192.168.0.2"), 53,
+			net.ParseIP("192.168.0.1"), 34567),
+		Payload: []byte("response"),
+	}
+	FollowUdp(response)
+
+	other := &protos.Packet{
+		Tuple: common.NewIpPortTuple(4,
+			net.ParseIP("192.168.0.1"), 34567,
+			net.ParseIP("192.168.0.2"), 123),
+		Payload: []byte("ntp"),
+	}
+	FollowUdp(other)
+
+	assert.Equal(t, []*protos.Packet{request, response}, dns.packets)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/filters"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/pipeline"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/tcp"
+	"github.com/johann8384/packetbeat/protos/udp"
+	"github.com/johann8384/packetbeat/sniffer"
+)
+
+// Reloads the configuration file while the sniffer runs. The protocol
+// plugins whose settings changed are replaced by new ones, the TCP
+// streams in progress are kept. The filters are loaded again. The other
+// changes are only logged, they need a restart.
+type configReloader struct {
+	configfile string
+
+	// applies the command line flags
+	override func(*config.Config)
+
+	// set when the BPF filter is built from the ports of the plugins
+	bpfGenerated bool
+
+	results chan common.MapStr
+	runner  *FilterRunner
+
+	// the options of the protocols used by the processors, like their
+	// retention
+	options []*pipeline.Options
+}
+
+func (reloader *configReloader) Reload() error {
+	filecontent, err := ioutil.ReadFile(reloader.configfile)
+	if err != nil {
+		return err
+	}
+	filecontent = config.ExpandEnv(filecontent)
+	var loaded config.Config
+	if err = yaml.Unmarshal(filecontent, &loaded); err != nil {
+		return fmt.Errorf("YAML config parsing failed on %s: %v", reloader.configfile, err)
+	}
+	reloader.override(&loaded)
+	if reloader.bpfGenerated {
+		loaded.Interfaces.Bpf_filter = config.ConfigSingleton.Interfaces.Bpf_filter
+	}
+
+	changes := config.Diff(&config.ConfigSingleton, &loaded)
+	if changes.Empty() {
+		logp.Info("No change in the configuration")
+		return nil
+	}
+	for _, section := range changes.Restart {
+		logp.Warn("Changes to %s need a restart, ignored", section)
+	}
+
+	var order []filters.FilterPlugin
+	var onError string
+	if changes.Contains("filter") {
+		if reloader.runner == nil {
+			logp.Warn("Filters were disabled at startup, enabling them needs a restart")
+		} else {
+			order, err = LoadConfiguredFilters(loaded.Filter)
+			if err != nil {
+				return fmt.Errorf("Error loading filters plugins: %v", err)
+			}
+			onError, err = LoadFiltersOnError(loaded.Filter)
+			if err != nil {
+				return fmt.Errorf("Error loading filters plugins: %v", err)
+			}
+			workers, err := LoadFiltersWorkers(loaded.Filter)
+			if err != nil {
+				return fmt.Errorf("Error loading filters plugins: %v", err)
+			}
+			if workers != reloader.runner.Workers {
+				logp.Warn("Changes to the filters workers need a restart, ignored")
+			}
+			queueSize, err := LoadFiltersQueueSize(loaded.Filter)
+			if err != nil {
+				return fmt.Errorf("Error loading filters plugins: %v", err)
+			}
+			queuePolicy, err := LoadFiltersQueuePolicy(loaded.Filter)
+			if err != nil {
+				return fmt.Errorf("Error loading filters plugins: %v", err)
+			}
+			if queueSize != reloader.runner.QueueSize() ||
+				queuePolicy != reloader.runner.QueuePolicy() {
+				logp.Warn("Changes to the filters queue need a restart, ignored")
+			}
+		}
+	}
+
+	if changes.Contains("protocols") {
+		for _, options := range reloader.options {
+			if err := options.Validate(loaded.Protocols.Option(options.Field)); err != nil {
+				return err
+			}
+		}
+		sniffer.PauseDecoding(func() {
+			err = reloader.reloadProtocols(&loaded.Protocols, changes)
+		})
+		if err != nil {
+			return err
+		}
+		for _, options := range reloader.options {
+			options.Set(loaded.Protocols.Option(options.Field))
+		}
+	}
+
+	if order != nil {
+		reloader.runner.SetOrder(order)
+		reloader.runner.SetOnError(onError)
+		config.ConfigSingleton.Filter = loaded.Filter
+		logp.Info("Filters plugins order: %v", order)
+	}
+
+	return nil
+}
+
+// reloadProtocols replaces the plugins of the changed protocols, and
+// removes the ones disabled. The running plugins are kept if the new ones
+// can't be initialized. It is called while the decoding is paused.
+func (reloader *configReloader) reloadProtocols(protocols *config.Protocols,
+	changes config.Changes) error {
+
+	previousConfig := config.ConfigSingleton.Protocols
+	previousPlugins := map[protos.Protocol]protos.ProtocolPlugin{}
+	for proto, plugin := range protos.Protos.GetAll() {
+		previousPlugins[proto] = plugin
+	}
+
+	// the plugins replaced or disabled, and the ones replacing them
+	retired := map[protos.Protocol]protos.ProtocolPlugin{}
+	started := map[protos.Protocol]protos.ProtocolPlugin{}
+
+	restore := func() {
+		stopProtocols(started)
+		config.ConfigSingleton.Protocols = previousConfig
+		for proto := range EnabledProtocolPlugins {
+			protos.Protos.Unregister(proto)
+		}
+		for proto, plugin := range previousPlugins {
+			protos.Protos.Register(proto, plugin)
+		}
+	}
+
+	config.ConfigSingleton.Protocols = *protocols
+	for proto, plugin := range EnabledProtocolPlugins {
+		if !changes.Contains("protocols." + proto.String()) {
+			continue
+		}
+		if previous, exists := previousPlugins[proto]; exists {
+			retired[proto] = previous
+		}
+		if !protocols.IsEnabled(proto.String()) {
+			protos.Protos.Unregister(proto)
+			logp.Info("Disabled the %s plugin", proto)
+			continue
+		}
+
+		// a new plugin of the same type reads its settings again
+		newPlugin := reflect.New(reflect.TypeOf(plugin).Elem()).Interface().(protos.ProtocolPlugin)
+		if err := newPlugin.Init(false, reloader.results); err != nil {
+			restore()
+			return fmt.Errorf("Initializing plugin %s failed: %v", proto, err)
+		}
+		started[proto] = newPlugin
+		protos.Protos.Register(proto, newPlugin)
+		logp.Info("Reloaded the %s plugin", proto)
+	}
+
+	if err := tcp.TcpInit(); err != nil {
+		restore()
+		tcp.TcpInit()
+		return err
+	}
+	udp.UdpInit()
+
+	// the transactions waiting in the previous plugins are published
+	// before they are dropped
+	stopProtocols(retired)
+
+	if reloader.bpfGenerated && tcp.BpfFilter() != config.ConfigSingleton.Interfaces.Bpf_filter {
+		logp.Warn("The ports changed, capturing them needs a restart. BPF filter: %s",
+			config.ConfigSingleton.Interfaces.Bpf_filter)
+	}
+
+	return nil
+}
+
+// stopProtocols publishes the transactions waiting in the plugins, and
+// stops their goroutines.
+func stopProtocols(plugins map[protos.Protocol]protos.ProtocolPlugin) {
+	flushProtocols(plugins)
+	for _, plugin := range plugins {
+		if stoppable, ok := plugin.(protos.StoppableProtocolPlugin); ok {
+			stoppable.Stop()
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/thrift"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A running plugin recording the calls made when it is retired.
+type retiredPlugin struct {
+	protos.ProtocolPlugin
+	ports   []int
+	flushed bool
+	stopped bool
+}
+
+func (plugin *retiredPlugin) GetPorts() []int { return plugin.ports }
+func (plugin *retiredPlugin) Flush()          { plugin.flushed = true }
+func (plugin *retiredPlugin) Stop()           { plugin.stopped = true }
+
+func reloadThrift(thriftConfig config.Thrift,
+	running map[protos.Protocol]protos.ProtocolPlugin) error {
+
+	previousConfig := config.ConfigSingleton
+	defer func() {
+		config.ConfigSingleton = previousConfig
+		for proto := range protos.Protos.GetAll() {
+			protos.Protos.Unregister(proto)
+		}
+	}()
+	for proto, plugin := range running {
+		protos.Protos.Register(proto, plugin)
+	}
+
+	reloader := configReloader{results: make(chan common.MapStr, 10)}
+	protocols := config.Protocols{Thrift: thriftConfig}
+	err := reloader.reloadProtocols(&protocols,
+		config.Changes{Reloadable: []string{"protocols.thrift"}})
+
+	// the goroutine of the new plugin isn't left running
+	if plugin, ok := protos.Protos.GetAll()[protos.ThriftProtocol].(*thrift.Thrift); ok {
+		plugin.Stop()
+	}
+	return err
+}
+
+func TestReloadProtocols_disabled(t *testing.T) {
+	disabled := false
+	previous := &retiredPlugin{}
+	err := reloadThrift(config.Thrift{Enabled: &disabled},
+		map[protos.Protocol]protos.ProtocolPlugin{protos.ThriftProtocol: previous})
+
+	assert.Nil(t, err)
+	assert.True(t, previous.flushed)
+	assert.True(t, previous.stopped)
+}
+
+func TestReloadProtocols_replaced(t *testing.T) {
+	previous := &retiredPlugin{ports: []int{9090}}
+	unchanged := &retiredPlugin{ports: []int{80}}
+	err := reloadThrift(config.Thrift{Ports: []int{9091}},
+		map[protos.Protocol]protos.ProtocolPlugin{
+			protos.ThriftProtocol: previous,
+			protos.HttpProtocol:   unchanged,
+		})
+
+	assert.Nil(t, err)
+	assert.True(t, previous.flushed)
+	assert.True(t, previous.stopped)
+	assert.False(t, unchanged.flushed)
+	assert.False(t, unchanged.stopped)
+}
+
+// Test that the running plugins are kept, and not flushed, when the new
+// ones can't be used.
+func TestReloadProtocols_restored(t *testing.T) {
+	previous := &retiredPlugin{ports: []int{9090}}
+	err := reloadThrift(config.Thrift{Ports: []int{80}},
+		map[protos.Protocol]protos.ProtocolPlugin{
+			protos.ThriftProtocol: previous,
+			protos.HttpProtocol:   &retiredPlugin{ports: []int{80}},
+		})
+
+	assert.NotNil(t, err)
+	assert.False(t, previous.flushed)
+	assert.False(t, previous.stopped)
+}
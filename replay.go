@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/sniffer"
+)
+
+// transactionsInFlight returns, by protocol, the transactions still
+// waiting for their response.
+func transactionsInFlight(plugins map[protos.Protocol]protos.ProtocolPlugin) map[protos.Protocol]int {
+	inFlight := map[protos.Protocol]int{}
+	sniffer.PauseDecoding(func() {
+		for proto, plugin := range plugins {
+			if counter, ok := plugin.(protos.InFlightProtocolPlugin); ok {
+				inFlight[proto] = counter.TransactionsInFlight()
+			}
+		}
+	})
+	return inFlight
+}
+
+// printParseStats writes, after replaying a file with -stats, how much of
+// the traffic was understood by each active protocol.
+func printParseStats(w io.Writer, packets int, plugins map[protos.Protocol]protos.ProtocolPlugin,
+	stats map[protos.Protocol]protos.ProtocolStats, inFlight map[protos.Protocol]int) {
+
+	names := []string{}
+	byName := map[string]protos.Protocol{}
+	for proto := range plugins {
+		names = append(names, proto.String())
+		byName[proto.String()] = proto
+	}
+	sort.Strings(names)
+
+	matched := 0
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "protocol\tpackets\ttransactions\tin flight\tparse errors\ttoo large\t")
+	for _, name := range names {
+		counters := stats[byName[name]]
+		matched += int(counters.Packets)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t\n", name, counters.Packets,
+			counters.Transactions, inFlight[byName[name]], counters.ParseErrors,
+			counters.TooLarge)
+	}
+
+	fmt.Fprintf(w, "Packets read: %d, matched to a protocol: %d, not matched: %d\n",
+		packets, matched, packets-matched)
+	tw.Flush()
+}
@@ -0,0 +1,229 @@
+// Package responsetimes computes the percentiles of the response times of
+// the transactions, by protocol and method, and periodically publishes
+// them as metrics events, so that the latencies can be followed without
+// aggregating all the transactions.
+package responsetimes
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/johann8384/packetbeat/protos"
+)
+
+// DefaultPeriod between two reports.
+const DefaultPeriod = 60 * time.Second
+
+// The response times are counted in buckets growing by this factor, so
+// that the percentiles are within 1% of the real ones, whatever the
+// number of transactions.
+const bucketGrowth = 1.02
+
+// At most this many methods are followed by protocol. The others are
+// counted together, under OtherMethod.
+const (
+	MaxMethods  = 100
+	OtherMethod = "other"
+)
+
+// Percentiles published, by name of their field.
+var percentiles = []struct {
+	name     string
+	quantile float64
+}{
+	{"p50", 0.50},
+	{"p95", 0.95},
+	{"p99", 0.99},
+}
+
+// Status of the transactions published before their response was
+// received. Their response time is not measured.
+var noResponseStatus = map[string]bool{
+	protos.OVERFLOW_STATUS:          true,
+	protos.SHUTDOWN_STATUS:          true,
+	protos.EXPIRED_STATUS:           true,
+	protos.CONNECTION_CLOSED_STATUS: true,
+}
+
+type ResponseTimesConfig struct {
+	Enabled bool
+
+	// Interval between the reports, in seconds.
+	Period *int
+}
+
+type seriesKey struct {
+	protocol string
+	method   string
+}
+
+// histogram counts the response times by bucket. The bucket i holds the
+// times in ]bucketGrowth^(i-1), bucketGrowth^i] milliseconds, the bucket 0
+// the times of 1 millisecond or less.
+type histogram struct {
+	count   uint64
+	buckets map[int]uint64
+}
+
+type ResponseTimes struct {
+	Enabled bool
+	Period  time.Duration
+
+	lock    sync.Mutex
+	series  map[seriesKey]*histogram
+	methods map[string]int
+	start   time.Time
+
+	results chan common.MapStr
+}
+
+// Init configures the reports, published to results.
+func (rt *ResponseTimes) Init(config ResponseTimesConfig, results chan common.MapStr) error {
+	rt.Enabled = config.Enabled
+	rt.Period = DefaultPeriod
+	if config.Period != nil {
+		rt.Period = time.Duration(*config.Period) * time.Second
+	}
+	if rt.Period <= 0 {
+		return fmt.Errorf("The period of the response times must be positive")
+	}
+
+	rt.series = map[seriesKey]*histogram{}
+	rt.methods = map[string]int{}
+	rt.start = time.Now()
+	rt.results = results
+	return nil
+}
+
+// Start publishes the percentiles every Period.
+func (rt *ResponseTimes) Start() {
+	if !rt.Enabled {
+		return
+	}
+	logp.Info("Response times reported every %v", rt.Period)
+
+	go func() {
+		ticker := time.NewTicker(rt.Period)
+		for now := range ticker.C {
+			rt.Report(now)
+		}
+	}()
+}
+
+func bucket(responseTime float64) int {
+	if responseTime <= 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log(responseTime) / math.Log(bucketGrowth)))
+}
+
+// bucketValue is the value whose relative error is the same to both ends
+// of the bucket.
+func bucketValue(i int) float64 {
+	if i == 0 {
+		return 1
+	}
+	return 2 * math.Pow(bucketGrowth, float64(i)) / (bucketGrowth + 1)
+}
+
+func (h *histogram) add(responseTime float64) {
+	h.count++
+	h.buckets[bucket(responseTime)]++
+}
+
+func (h *histogram) quantile(q float64) float64 {
+	indexes := make([]int, 0, len(h.buckets))
+	for i := range h.buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	var seen uint64
+	for _, i := range indexes {
+		seen += h.buckets[i]
+		if seen >= rank {
+			return bucketValue(i)
+		}
+	}
+	return bucketValue(indexes[len(indexes)-1])
+}
+
+// Record counts the response time of a transaction event. The events
+// without response time, like the flows, and the transactions published
+// without their response are ignored.
+func (rt *ResponseTimes) Record(event common.MapStr) {
+	responseTime, ok := event["responsetime"].(int32)
+	if !ok {
+		return
+	}
+	if status, _ := event["status"].(string); noResponseStatus[status] {
+		return
+	}
+	// the split transactions are counted once, with their request
+	if trans, ok := event["transaction"].(common.MapStr); ok && trans["part"] == "response" {
+		return
+	}
+	protocol, _ := event["type"].(string)
+	method, _ := event["method"].(string)
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	key := seriesKey{protocol, method}
+	h := rt.series[key]
+	if h == nil {
+		if rt.methods[protocol] >= MaxMethods {
+			key.method = OtherMethod
+			h = rt.series[key]
+		}
+		if h == nil {
+			h = &histogram{buckets: map[int]uint64{}}
+			rt.series[key] = h
+			rt.methods[protocol]++
+		}
+	}
+	h.add(float64(responseTime))
+}
+
+// Report publishes the percentiles of the response times recorded since
+// the previous report, and starts a new interval.
+func (rt *ResponseTimes) Report(now time.Time) {
+	rt.lock.Lock()
+	events := []common.MapStr{}
+	for key, h := range rt.series {
+		metrics := common.MapStr{
+			"protocol":   key.protocol,
+			"method":     key.method,
+			"count":      h.count,
+			"start_time": common.Time(rt.start),
+		}
+		for _, p := range percentiles {
+			metrics[p.name] = h.quantile(p.quantile)
+		}
+		events = append(events, common.MapStr{
+			"type":      "metrics",
+			"status":    common.OK_STATUS,
+			"timestamp": common.Time(now),
+			"metrics":   metrics,
+		})
+	}
+	rt.series = map[seriesKey]*histogram{}
+	rt.methods = map[string]int{}
+	rt.start = now
+	rt.lock.Unlock()
+
+	logp.Debug("responsetimes", "Reporting %d series", len(events))
+	if rt.results == nil {
+		return
+	}
+	for _, event := range events {
+		rt.results <- event
+	}
+}
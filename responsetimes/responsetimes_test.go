@@ -0,0 +1,126 @@
+package responsetimes
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/johann8384/packetbeat/pipeline"
+	"github.com/johann8384/packetbeat/protos"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newResponseTimes(t *testing.T) (*ResponseTimes, chan common.MapStr) {
+	results := make(chan common.MapStr, 1000)
+	rt := new(ResponseTimes)
+	assert.Nil(t, rt.Init(ResponseTimesConfig{Enabled: true}, results))
+	return rt, results
+}
+
+func transaction(protocol string, method string, responseTime int32) common.MapStr {
+	return common.MapStr{
+		"type":         protocol,
+		"method":       method,
+		"responsetime": responseTime,
+	}
+}
+
+func reported(results chan common.MapStr) map[string]common.MapStr {
+	series := map[string]common.MapStr{}
+	for len(results) > 0 {
+		event := <-results
+		metrics := event["metrics"].(common.MapStr)
+		series[fmt.Sprintf("%s %s", metrics["protocol"], metrics["method"])] = metrics
+	}
+	return series
+}
+
+func assertWithin(t *testing.T, expected float64, actual interface{}, tolerance float64, name string) {
+	value := actual.(float64)
+	if math.Abs(value-expected) > expected*tolerance {
+		t.Errorf("%s: expected %v within %v%%, got %v", name, expected, tolerance*100, value)
+	}
+}
+
+func TestResponseTimes_percentiles(t *testing.T) {
+	rt, results := newResponseTimes(t)
+
+	// 1 to 10000 ms, in a random order
+	for _, i := range rand.Perm(10000) {
+		rt.Record(transaction("http", "GET", int32(i+1)))
+	}
+	// a few fast POSTs
+	for i := 0; i < 10; i++ {
+		rt.Record(transaction("http", "POST", 3))
+	}
+	rt.Record(common.MapStr{"type": "flow"})
+
+	rt.Report(time.Now())
+	series := reported(results)
+	assert.Len(t, series, 2)
+
+	get := series["http GET"]
+	assert.Equal(t, uint64(10000), get["count"])
+	assertWithin(t, 5000, get["p50"], 0.01, "p50")
+	assertWithin(t, 9500, get["p95"], 0.01, "p95")
+	assertWithin(t, 9900, get["p99"], 0.01, "p99")
+
+	post := series["http POST"]
+	assert.Equal(t, uint64(10), post["count"])
+	assertWithin(t, 3, post["p99"], 0.01, "p99")
+
+	// the next interval starts empty
+	rt.Report(time.Now())
+	assert.Len(t, reported(results), 0)
+}
+
+func TestResponseTimes_boundedMethods(t *testing.T) {
+	rt, results := newResponseTimes(t)
+
+	for i := 0; i < MaxMethods+50; i++ {
+		rt.Record(transaction("http", fmt.Sprintf("M%d", i), 10))
+	}
+	rt.Report(time.Now())
+
+	series := reported(results)
+	assert.Len(t, series, MaxMethods+1)
+	assert.Equal(t, uint64(50), series["http other"]["count"])
+}
+
+func TestResponseTimes_withoutResponse(t *testing.T) {
+	rt, results := newResponseTimes(t)
+
+	rt.Record(transaction("http", "GET", 20))
+	for _, status := range []string{protos.OVERFLOW_STATUS, protos.SHUTDOWN_STATUS,
+		protos.EXPIRED_STATUS, protos.CONNECTION_CLOSED_STATUS} {
+
+		event := transaction("http", "GET", 0)
+		event["status"] = status
+		rt.Record(event)
+	}
+	rt.Report(time.Now())
+
+	assert.Equal(t, uint64(1), reported(results)["http GET"]["count"])
+}
+
+func TestResponseTimes_queue(t *testing.T) {
+	rt, results := newResponseTimes(t)
+
+	published := make(chan common.MapStr, 10)
+	queue := pipeline.Chain{pipeline.Update(rt.Record)}.Queue(published)
+	queue <- transaction("mysql", "SELECT", 12)
+
+	select {
+	case event := <-published:
+		assert.Equal(t, "SELECT", event["method"])
+	case <-time.After(time.Second):
+		t.Fatal("the event was not forwarded")
+	}
+	rt.Report(time.Now())
+	assert.Equal(t, uint64(1), reported(results)["mysql SELECT"]["count"])
+}
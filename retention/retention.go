@@ -0,0 +1,50 @@
+// Package retention tags the events of the protocols with the name of
+// their retention policy, so that the outputs or an ingest pipeline can
+// route them to indices kept for a shorter or a longer time, like the
+// verbose Redis transactions for a few days and the HTTP ones for months.
+package retention
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/packetbeat/pipeline"
+)
+
+// The policy names end up in the index names, which are lowercase.
+var policyName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Retention holds the policy names, by protocol name. They are replaced
+// with Set when the configuration is reloaded.
+type Retention struct {
+	*pipeline.Options
+}
+
+// New creates the retention from the policies, by protocol name.
+func New(policies map[string]interface{}) (*Retention, error) {
+	retention := &Retention{pipeline.NewOptions("Retention", checkPolicy)}
+	if err := retention.Set(policies); err != nil {
+		return nil, err
+	}
+	return retention, nil
+}
+
+// checkPolicy checks the name of the policy of a protocol.
+func checkPolicy(protocol string, value interface{}) error {
+	policy, _ := value.(string)
+	if !policyName.MatchString(policy) {
+		return fmt.Errorf("Invalid retention %q for %s, expected lowercase letters, digits, - and _",
+			policy, protocol)
+	}
+	return nil
+}
+
+// AddRetention sets the retention field of the event to the policy of its
+// protocol, given by its type. The events of the protocols without a
+// policy and the other events, like the flows, are left unchanged.
+func (retention *Retention) AddRetention(event common.MapStr) {
+	if policy, exists := retention.Lookup(event); exists {
+		event["retention"] = policy
+	}
+}
@@ -0,0 +1,47 @@
+package retention
+
+import (
+	"testing"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetention_addRetention(t *testing.T) {
+	retention, err := New(map[string]interface{}{"redis": "short", "http": "logs-90d"})
+	assert.Nil(t, err)
+
+	events := []common.MapStr{
+		{"type": "redis"},
+		{"type": "mysql"},
+		{"type": "flow"},
+	}
+	for _, event := range events {
+		retention.AddRetention(event)
+	}
+
+	assert.Equal(t, []common.MapStr{
+		{"type": "redis", "retention": "short"},
+		{"type": "mysql"},
+		{"type": "flow"},
+	}, events)
+}
+
+func TestRetention_setPolicies(t *testing.T) {
+	retention, err := New(nil)
+	assert.Nil(t, err)
+
+	event := common.MapStr{"type": "http"}
+	retention.AddRetention(event)
+	assert.Nil(t, event["retention"])
+
+	assert.Nil(t, retention.Set(map[string]interface{}{"http": "long"}))
+	retention.AddRetention(event)
+	assert.Equal(t, "long", event["retention"])
+
+	for _, policy := range []interface{}{"", "Short", "a b", "-x", "logs*", 1} {
+		_, err := New(map[string]interface{}{"http": policy})
+		assert.NotNil(t, err, "policy %v", policy)
+	}
+}
@@ -12,10 +12,17 @@ import yaml
 SECTIONS = [
     ("event", "Event"),
     ("http", "Http"),
+    ("websocket", "WebSocket"),
     ("mysql", "Mysql"),
     ("pgsql", "PostgreSQL"),
     ("thrift", "Thrift-RPC"),
     ("redis", "Redis"),
+    ("dns", "DNS"),
+    ("mongodb", "MongoDB"),
+    ("memcache", "Memcache"),
+    ("tls_handshake", "TLS handshake"),
+    ("icmp", "ICMP"),
+    ("flow", "Flow"),
     ("measurements", "Measurements"),
     ("env", "Environmental"),
     ("raw", "Raw")]
@@ -90,7 +90,7 @@ def fill_field_properties(properties, field, defaults):
             field[key] = defaults[key]
 
     if field.get("index") == "analyzed":
-        properties[field["name"]] = {
+        mapping = {
             "type": field["type"],
             "index": "analyzed",
             "norms": {
@@ -99,22 +99,32 @@ def fill_field_properties(properties, field, defaults):
         }
 
     elif field.get("type") == "geo_point":
-        properties[field["name"]] = {
+        mapping = {
             "type": "geo_point"
         }
 
     elif field.get("type") == "date":
-        properties[field["name"]] = {
+        mapping = {
             "type": "date"
         }
 
     elif field.get("ignore_above") == 0:
-        properties[field["name"]] = {
+        mapping = {
             "type": field["type"],
             "index": field["index"],
             "doc_values": field["doc_values"]
         }
 
+    else:
+        return
+
+    # dotted names are mapped as fields of nested objects
+    path = field["name"].split(".")
+    for name in path[:-1]:
+        obj = properties.setdefault(name, {"properties": {}})
+        properties = obj["properties"]
+    properties[path[-1]] = mapping
+
 if __name__ == "__main__":
     if len(sys.argv) != 3:
         print "Usage: %s fields.yml template.json" % sys.argv[0]
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/libbeat/logp"
+	"github.com/johann8384/libbeat/outputs"
+
+	"github.com/johann8384/packetbeat/protos"
+)
+
+// On shutdown, the in-flight transactions and the queued events are given
+// this much time to be published.
+const shutdownTimeout = 5 * time.Second
+
+// With -golden, the events are compared once none was published for this
+// long, after the queues are drained.
+const goldenIdleTime = 200 * time.Millisecond
+
+// The default flush interval of the Elasticsearch output, which sends the
+// events in bulk.
+const defaultOutputFlushInterval = 1000 * time.Millisecond
+
+// flushProtocols publishes the transactions waiting for their response.
+// It is called once the capture is stopped.
+func flushProtocols(plugins map[protos.Protocol]protos.ProtocolPlugin) {
+	for proto, plugin := range plugins {
+		flushable, ok := plugin.(protos.FlushableProtocolPlugin)
+		if !ok {
+			continue
+		}
+		logp.Debug("main", "Flushing the %s transactions", proto)
+		flushable.Flush()
+	}
+}
+
+// drainQueues waits for the queues, in the order of the pipeline, to be
+// empty. It returns false if the deadline is reached first.
+func drainQueues(deadline time.Time, queues ...chan common.MapStr) bool {
+	for _, queue := range queues {
+		for len(queue) > 0 {
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return true
+}
+
+// outputFlushInterval returns the longest time an output keeps the events
+// before sending them.
+func outputFlushInterval(configs map[string]outputs.MothershipConfig) time.Duration {
+	var interval time.Duration
+	for _, output := range configs {
+		if !output.Enabled {
+			continue
+		}
+		outputInterval := defaultOutputFlushInterval
+		if output.Flush_interval != nil {
+			outputInterval = time.Duration(*output.Flush_interval) * time.Millisecond
+		}
+		if outputInterval > interval {
+			interval = outputInterval
+		}
+	}
+	return interval
+}
+
+// drainEvents publishes the in-flight transactions and waits, up to
+// shutdownTimeout, for the events to be sent by the outputs.
+func drainEvents(plugins map[protos.Protocol]protos.ProtocolPlugin,
+	outputConfigs map[string]outputs.MothershipConfig, queues ...chan common.MapStr) {
+
+	deadline := time.Now().Add(shutdownTimeout)
+
+	flushProtocols(plugins)
+	if !drainQueues(deadline, queues...) {
+		logp.Warn("Timeout draining the events, some are lost")
+		return
+	}
+
+	// the outputs send the last events on their next flush
+	wait := outputFlushInterval(outputConfigs)
+	if remaining := deadline.Sub(time.Now()); wait > remaining {
+		wait = remaining
+	}
+	time.Sleep(wait)
+}
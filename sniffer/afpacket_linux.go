@@ -45,6 +45,13 @@ func (h *AfpacketHandle) SetBPFFilter(expr string) (_ error) {
 	return h.TPacket.SetBPFFilter(expr)
 }
 
+// SetFanout joins the fanout group, in which the packets are shared among
+// the sockets by a hash of their flow, so that the packets of a TCP stream
+// are read by the same shipper.
+func (h *AfpacketHandle) SetFanout(group uint16) error {
+	return h.TPacket.SetFanout(afpacket.FanoutHash, group)
+}
+
 func (h *AfpacketHandle) Close() {
 	h.TPacket.Close()
 }
@@ -0,0 +1,52 @@
+// +build linux
+
+package sniffer
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAfpacket_readLoopback(t *testing.T) {
+	frame_size, block_size, num_blocks, err := afpacketComputeSize(8, 16436, os.Getpagesize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, err := NewAfpacketHandle("lo", frame_size, block_size, num_blocks,
+		100*time.Millisecond)
+	if err != nil {
+		t.Skipf("af_packet is not available: %v", err)
+	}
+	defer handle.Close()
+
+	if err := handle.SetBPFFilter("udp and port 47809"); err != nil {
+		t.Fatalf("SetBPFFilter failed: %v", err)
+	}
+
+	conn, err := net.Dial("udp", "127.0.0.1:47809")
+	if err != nil {
+		t.Fatalf("Failed to open the UDP socket: %v", err)
+	}
+	defer conn.Close()
+
+	payload := []byte("packetbeat af_packet test")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn.Write(payload)
+
+		data, ci, err := handle.ReadPacketData()
+		if err != nil {
+			continue
+		}
+		if bytes.Contains(data, payload) {
+			if ci.CaptureLength != len(data) {
+				t.Errorf("Capture length %d for %d bytes", ci.CaptureLength, len(data))
+			}
+			return
+		}
+	}
+	t.Fatal("The UDP packet sent on the loopback was not read from the ring")
+}
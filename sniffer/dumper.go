@@ -0,0 +1,174 @@
+package sniffer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/johann8384/libbeat/logp"
+
+	"github.com/tsg/gopacket"
+	"github.com/tsg/gopacket/layers"
+	"github.com/tsg/gopacket/pcapgo"
+)
+
+const (
+	dumpSnaplen          = 65535
+	pcapFileHeaderSize   = 24
+	pcapPacketHeaderSize = 16
+
+	// the suffix of the rotated files, sorting in chronological order
+	dumpTimeFormat = "20060102-150405.000000"
+)
+
+// the suffix of the rotated files, with a counter when several are rotated
+// in the same microsecond
+var rotatedSuffix = regexp.MustCompile(`^\.\d{8}-\d{6}\.\d{6}(-\d+)?$`)
+
+// dumpWriter writes the captured packets to a libpcap file. The file is
+// rotated when it reaches maxSize bytes or when it is older than interval,
+// by renaming it with the current time as suffix. Only the last maxFiles
+// files are kept, including the one being written. A zero value disables
+// the corresponding limit.
+type dumpWriter struct {
+	path     string
+	linktype layers.LinkType
+	maxSize  int64
+	maxFiles int
+	interval time.Duration
+
+	file   *os.File
+	writer *pcapgo.Writer
+	size   int64
+	opened time.Time
+}
+
+func newDumpWriter(path string, linktype layers.LinkType,
+	maxSize int64, maxFiles int, interval time.Duration) (*dumpWriter, error) {
+
+	dumper := &dumpWriter{
+		path:     path,
+		linktype: linktype,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		interval: interval,
+	}
+	err := dumper.open()
+	if err != nil {
+		return nil, err
+	}
+	return dumper, nil
+}
+
+func (dumper *dumpWriter) open() error {
+	file, err := os.Create(dumper.path)
+	if err != nil {
+		return err
+	}
+
+	dumper.writer = pcapgo.NewWriter(file)
+	err = dumper.writer.WriteFileHeader(dumpSnaplen, dumper.linktype)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	dumper.file = file
+	dumper.size = pcapFileHeaderSize
+	dumper.opened = time.Now()
+	return nil
+}
+
+func (dumper *dumpWriter) WritePacketData(data []byte, ci gopacket.CaptureInfo) error {
+	if dumper.needsRotation(len(data)) {
+		err := dumper.rotate()
+		if err != nil {
+			return fmt.Errorf("Rotating %s failed: %v", dumper.path, err)
+		}
+	}
+
+	err := dumper.writer.WritePacket(ci, data)
+	if err != nil {
+		return err
+	}
+	dumper.size += int64(pcapPacketHeaderSize + len(data))
+	return nil
+}
+
+func (dumper *dumpWriter) needsRotation(length int) bool {
+	if dumper.size == pcapFileHeaderSize {
+		// never leave an empty file behind
+		return false
+	}
+	if dumper.maxSize > 0 &&
+		dumper.size+int64(pcapPacketHeaderSize+length) > dumper.maxSize {
+		return true
+	}
+	if dumper.interval > 0 && time.Since(dumper.opened) >= dumper.interval {
+		return true
+	}
+	return false
+}
+
+func (dumper *dumpWriter) rotate() error {
+	err := dumper.file.Close()
+	if err != nil {
+		return err
+	}
+
+	rotated := dumper.path + "." + time.Now().Format(dumpTimeFormat)
+	for i := 1; fileExists(rotated); i++ {
+		rotated = fmt.Sprintf("%s.%s-%d", dumper.path, time.Now().Format(dumpTimeFormat), i)
+	}
+	err = os.Rename(dumper.path, rotated)
+	if err != nil {
+		return err
+	}
+	logp.Debug("sniffer", "Rotated the dump file to %s", rotated)
+
+	dumper.removeOldFiles()
+
+	return dumper.open()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// removeOldFiles deletes the oldest rotated files beyond maxFiles.
+func (dumper *dumpWriter) removeOldFiles() {
+	if dumper.maxFiles <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(dumper.path + ".*")
+	if err != nil {
+		logp.Warn("Listing the rotated dump files failed: %v", err)
+		return
+	}
+	// the other files sharing the prefix, like dump.pcap.gz, are kept
+	rotated := []string{}
+	for _, path := range matches {
+		if rotatedSuffix.MatchString(path[len(dumper.path):]) {
+			rotated = append(rotated, path)
+		}
+	}
+	sort.Strings(rotated)
+
+	// the file being written counts as one
+	for len(rotated) > dumper.maxFiles-1 {
+		err = os.Remove(rotated[0])
+		if err != nil {
+			logp.Warn("Removing %s failed: %v", rotated[0], err)
+		}
+		rotated = rotated[1:]
+	}
+}
+
+func (dumper *dumpWriter) Close() error {
+	return dumper.file.Close()
+}
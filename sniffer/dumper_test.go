@@ -0,0 +1,153 @@
+package sniffer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsg/gopacket"
+	"github.com/tsg/gopacket/layers"
+)
+
+func writePackets(t *testing.T, dumper *dumpWriter, count int) {
+	data := make([]byte, 100)
+	for i := 0; i < count; i++ {
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+		err := dumper.WritePacketData(data, ci)
+		if err != nil {
+			t.Fatalf("Writing packet %d failed: %v", i, err)
+		}
+	}
+}
+
+func dumpFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDumpWriter_rotateBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.pcap")
+
+	// room for the file header and three packets
+	dumper, err := newDumpWriter(path, layers.LinkTypeEthernet, 24+3*116, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePackets(t, dumper, 20)
+	dumper.Close()
+
+	files := dumpFiles(t, dir)
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 files, got %v", files)
+	}
+	for _, file := range files[1:] {
+		if !strings.HasPrefix(file, path+".") {
+			t.Errorf("Unexpected name for a rotated file: %s", file)
+		}
+		suffix := strings.TrimPrefix(file, path+".")
+		if _, err := time.Parse(dumpTimeFormat, suffix[:len(dumpTimeFormat)]); err != nil {
+			t.Errorf("Expected a timestamp suffix in %s: %v", file, err)
+		}
+	}
+
+	// 20 packets are 6 full files and 2 packets in the current one
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 24+2*116 {
+		t.Errorf("Unexpected size of the current file: %d", info.Size())
+	}
+	info, err = os.Stat(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 24+3*116 {
+		t.Errorf("Unexpected size of the rotated file: %d", info.Size())
+	}
+}
+
+func TestDumpWriter_rotateByTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.pcap")
+
+	dumper, err := newDumpWriter(path, layers.LinkTypeEthernet, 0, 0, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePackets(t, dumper, 4)
+	dumper.Close()
+
+	// a new file for each packet, none deleted
+	if files := dumpFiles(t, dir); len(files) != 4 {
+		t.Errorf("Expected 4 files, got %v", files)
+	}
+}
+
+func TestDumpWriter_noRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.pcap")
+
+	dumper, err := newDumpWriter(path, layers.LinkTypeEthernet, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePackets(t, dumper, 20)
+	dumper.Close()
+
+	if files := dumpFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected a single file, got %v", files)
+	}
+}
+
+func TestDumpWriter_keepOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.pcap")
+
+	// files sharing the prefix, not written by the dumper
+	others := []string{path + ".gz", path + ".bak", path + ".20150124-140605.071000.gz"}
+	for _, other := range others {
+		if err := ioutil.WriteFile(other, []byte("keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dumper, err := newDumpWriter(path, layers.LinkTypeEthernet, 24+116, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePackets(t, dumper, 5)
+	dumper.Close()
+
+	for _, other := range others {
+		if _, err := os.Stat(other); err != nil {
+			t.Errorf("Expected %s to be kept: %v", other, err)
+		}
+	}
+	if files := dumpFiles(t, dir); len(files) != 2+len(others) {
+		t.Errorf("Expected 2 dump files, got %v", files)
+	}
+}
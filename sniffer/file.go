@@ -0,0 +1,175 @@
+package sniffer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/tsg/gopacket"
+	"github.com/tsg/gopacket/layers"
+)
+
+// Name of the file to read the packets from the standard input.
+const stdinFile = "-"
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Magic numbers of the files with timestamps in microseconds and in
+// nanoseconds, written in the byte order of the capturing host.
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+)
+
+// Largest packet libpcap captures, larger lengths are from corrupted
+// files.
+const maxPacketSize = 262144
+
+// packetFile reads the packets in one of the file formats.
+type packetFile interface {
+	gopacket.PacketDataSource
+
+	// Returns the link type of the last packet read, or of the
+	// first packet before any is read.
+	LinkType() layers.LinkType
+}
+
+// fileHandle reads the packets of a libpcap or pcapng file, or of the
+// standard input when the file is "-". Gzipped files are uncompressed on
+// the fly.
+type fileHandle struct {
+	packetFile
+	file *os.File
+}
+
+func openFile(name string) (*fileHandle, error) {
+	handle := &fileHandle{}
+	if name == stdinFile {
+		handle.file = os.Stdin
+	} else {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		handle.file = file
+	}
+
+	err := handle.open()
+	if err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return handle, nil
+}
+
+func (handle *fileHandle) open() error {
+	reader := bufio.NewReader(handle.file)
+	magic, err := reader.Peek(len(gzipMagic))
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(magic, gzipMagic) {
+		gzipped, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		reader = bufio.NewReader(gzipped)
+	}
+
+	magic, err = reader.Peek(4)
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(magic) == pcapngSectionHeader {
+		handle.packetFile, err = newPcapngReader(reader)
+	} else {
+		handle.packetFile, err = newPcapReader(reader)
+	}
+	return err
+}
+
+func (handle *fileHandle) Close() {
+	if handle.file != os.Stdin {
+		handle.file.Close()
+	}
+}
+
+// pcapReader reads the libpcap files.
+type pcapReader struct {
+	reader   io.Reader
+	order    binary.ByteOrder
+	nanosecs bool
+	linkType layers.LinkType
+}
+
+func newPcapReader(reader io.Reader) (*pcapReader, error) {
+	var header [pcapFileHeaderSize]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return nil, fmt.Errorf("Reading the file header failed: %v", err)
+	}
+
+	handle := &pcapReader{reader: reader}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(header[0:4]) {
+		case pcapMagicMicro:
+			handle.order = order
+		case pcapMagicNano:
+			handle.order = order
+			handle.nanosecs = true
+		}
+	}
+	if handle.order == nil {
+		return nil, fmt.Errorf("Not a libpcap file, magic %x", header[0:4])
+	}
+
+	handle.linkType = layers.LinkType(handle.order.Uint32(header[20:24]))
+	return handle, nil
+}
+
+func (handle *pcapReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	var ci gopacket.CaptureInfo
+	var header [pcapPacketHeaderSize]byte
+
+	_, err := io.ReadFull(handle.reader, header[:])
+	if err == io.ErrUnexpectedEOF {
+		// a truncated last packet, like in a capture still being written
+		return nil, ci, io.EOF
+	}
+	if err != nil {
+		return nil, ci, err
+	}
+
+	secs := int64(handle.order.Uint32(header[0:4]))
+	fraction := int64(handle.order.Uint32(header[4:8]))
+	if !handle.nanosecs {
+		fraction *= int64(time.Microsecond)
+	}
+	ci.Timestamp = time.Unix(secs, fraction)
+	ci.CaptureLength = int(handle.order.Uint32(header[8:12]))
+	ci.Length = int(handle.order.Uint32(header[12:16]))
+
+	if ci.CaptureLength > maxPacketSize {
+		return nil, ci, fmt.Errorf("Invalid packet length %d", ci.CaptureLength)
+	}
+
+	data := make([]byte, ci.CaptureLength)
+	_, err = io.ReadFull(handle.reader, data)
+	if err == io.ErrUnexpectedEOF {
+		return nil, ci, io.EOF
+	}
+	if err != nil {
+		return nil, ci, err
+	}
+	return data, ci, nil
+}
+
+func (handle *pcapReader) LinkType() layers.LinkType {
+	return handle.linkType
+}
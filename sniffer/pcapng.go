@@ -0,0 +1,230 @@
+package sniffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tsg/gopacket"
+	"github.com/tsg/gopacket/layers"
+)
+
+// Types of the pcapng blocks read. The other blocks, like the
+// statistics, are skipped.
+const (
+	pcapngSectionHeader        = 0x0a0d0d0a
+	pcapngInterfaceDescription = 0x00000001
+	pcapngEnhancedPacket       = 0x00000006
+)
+
+// Written in the section header, in the byte order of the section.
+const pcapngByteOrderMagic uint32 = 0x1a2b3c4d
+
+// Options of the interface descriptions.
+const (
+	pcapngOptionEnd      = 0
+	pcapngOptionTsresol  = 9
+	pcapngOptionTsoffset = 14
+)
+
+// Blocks larger than this are from corrupted files.
+const pcapngMaxBlockSize = 16 * 1024 * 1024
+
+// Sizes of the block header and of the fixed fields of the blocks.
+const (
+	pcapngBlockHeaderSize          = 8
+	pcapngBlockTrailerSize         = 4
+	pcapngInterfaceFieldsSize      = 8
+	pcapngEnhancedPacketFieldsSize = 20
+)
+
+type pcapngInterface struct {
+	linkType layers.LinkType
+
+	// the timestamps are counted in units per second, since the
+	// offset in seconds
+	unitsPerSecond uint64
+	offset         int64
+}
+
+func (iface *pcapngInterface) timestamp(high uint32, low uint32) time.Time {
+	units := uint64(high)<<32 | uint64(low)
+	fraction := units % iface.unitsPerSecond
+	var nanos uint64
+	if iface.unitsPerSecond <= uint64(time.Second) {
+		nanos = fraction * uint64(time.Second) / iface.unitsPerSecond
+	} else {
+		nanos = fraction / (iface.unitsPerSecond / uint64(time.Second))
+	}
+	return time.Unix(int64(units/iface.unitsPerSecond)+iface.offset, int64(nanos))
+}
+
+// pcapngReader reads the pcapng files, as written by Wireshark. Each
+// packet has the link type of the interface it was captured on.
+type pcapngReader struct {
+	reader     io.Reader
+	order      binary.ByteOrder
+	interfaces []pcapngInterface
+	linkType   layers.LinkType
+}
+
+func newPcapngReader(reader io.Reader) (*pcapngReader, error) {
+	ng := &pcapngReader{reader: reader}
+
+	// the packets are preceded by the description of their interface
+	for len(ng.interfaces) == 0 {
+		blockType, _, err := ng.readBlock()
+		if err != nil {
+			return nil, fmt.Errorf("Reading the interfaces failed: %v", err)
+		}
+		if blockType == pcapngEnhancedPacket {
+			return nil, errors.New("Packet captured on an unknown interface")
+		}
+	}
+	ng.linkType = ng.interfaces[0].linkType
+	return ng, nil
+}
+
+// readBlock reads the next block. The section headers and the interface
+// descriptions are handled here, the bodies of the other blocks are
+// returned.
+func (ng *pcapngReader) readBlock() (uint32, []byte, error) {
+	var header [pcapngBlockHeaderSize]byte
+	_, err := io.ReadFull(ng.reader, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// the type of the section headers reads the same in both orders,
+	// the order of the section is given by its first field
+	var body []byte
+	if binary.BigEndian.Uint32(header[0:4]) == pcapngSectionHeader {
+		var magic [4]byte
+		_, err = io.ReadFull(ng.reader, magic[:])
+		if err != nil {
+			return 0, nil, err
+		}
+		switch pcapngByteOrderMagic {
+		case binary.LittleEndian.Uint32(magic[:]):
+			ng.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic[:]):
+			ng.order = binary.BigEndian
+		default:
+			return 0, nil, fmt.Errorf("Invalid byte order magic %x", magic)
+		}
+		// the interfaces are numbered by section
+		ng.interfaces = nil
+		body = magic[:]
+	}
+
+	blockType := ng.order.Uint32(header[0:4])
+	length := ng.order.Uint32(header[4:8])
+	minLength := uint32(pcapngBlockHeaderSize + len(body) + pcapngBlockTrailerSize)
+	if length < minLength || length%4 != 0 || length > pcapngMaxBlockSize {
+		return 0, nil, fmt.Errorf("Invalid block length %d", length)
+	}
+
+	rest := make([]byte, length-minLength+pcapngBlockTrailerSize)
+	_, err = io.ReadFull(ng.reader, rest)
+	if err != nil {
+		return 0, nil, err
+	}
+	body = append(body, rest[:len(rest)-pcapngBlockTrailerSize]...)
+
+	if blockType == pcapngInterfaceDescription {
+		err = ng.addInterface(body)
+	}
+	return blockType, body, err
+}
+
+func (ng *pcapngReader) addInterface(body []byte) error {
+	if len(body) < pcapngInterfaceFieldsSize {
+		return errors.New("Interface description too short")
+	}
+	iface := pcapngInterface{
+		linkType:       layers.LinkType(ng.order.Uint16(body[0:2])),
+		unitsPerSecond: uint64(time.Second / time.Microsecond),
+	}
+
+	options := body[pcapngInterfaceFieldsSize:]
+	for len(options) >= 4 {
+		code := ng.order.Uint16(options[0:2])
+		length := int(ng.order.Uint16(options[2:4]))
+		if code == pcapngOptionEnd || 4+length > len(options) {
+			break
+		}
+		value := options[4 : 4+length]
+
+		switch {
+		case code == pcapngOptionTsresol && length == 1:
+			// a negative power of 10, or of 2 with the high bit set
+			exponent := uint(value[0] & 0x7f)
+			if value[0]&0x80 == 0 && exponent <= 19 {
+				iface.unitsPerSecond = 1
+				for i := uint(0); i < exponent; i++ {
+					iface.unitsPerSecond *= 10
+				}
+			} else if value[0]&0x80 != 0 && exponent <= 63 {
+				iface.unitsPerSecond = 1 << exponent
+			} else {
+				return fmt.Errorf("Invalid timestamps resolution %x", value[0])
+			}
+		case code == pcapngOptionTsoffset && length == 8:
+			iface.offset = int64(ng.order.Uint64(value))
+		}
+
+		// the values are padded to 32 bits
+		next := 4 + (length+3)/4*4
+		if next > len(options) {
+			break
+		}
+		options = options[next:]
+	}
+
+	ng.interfaces = append(ng.interfaces, iface)
+	return nil
+}
+
+func (ng *pcapngReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	var ci gopacket.CaptureInfo
+
+	for {
+		blockType, body, err := ng.readBlock()
+		if err == io.ErrUnexpectedEOF {
+			// a truncated last block, like in a capture still being written
+			return nil, ci, io.EOF
+		}
+		if err != nil {
+			return nil, ci, err
+		}
+		if blockType != pcapngEnhancedPacket {
+			continue
+		}
+
+		if len(body) < pcapngEnhancedPacketFieldsSize {
+			return nil, ci, errors.New("Enhanced packet block too short")
+		}
+		index := ng.order.Uint32(body[0:4])
+		if index >= uint32(len(ng.interfaces)) {
+			return nil, ci, fmt.Errorf("Packet captured on an unknown interface %d", index)
+		}
+		iface := &ng.interfaces[index]
+
+		ci.Timestamp = iface.timestamp(ng.order.Uint32(body[4:8]), ng.order.Uint32(body[8:12]))
+		ci.CaptureLength = int(ng.order.Uint32(body[12:16]))
+		ci.Length = int(ng.order.Uint32(body[16:20]))
+		data := body[pcapngEnhancedPacketFieldsSize:]
+		if ci.CaptureLength > len(data) {
+			return nil, ci, fmt.Errorf("Invalid packet length %d", ci.CaptureLength)
+		}
+
+		ng.linkType = iface.linkType
+		return data[:ci.CaptureLength], ci, nil
+	}
+}
+
+func (ng *pcapngReader) LinkType() layers.LinkType {
+	return ng.linkType
+}
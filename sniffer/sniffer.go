@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,16 +21,42 @@ import (
 
 type SnifferSetup struct {
 	pcapHandle     *pcap.Handle
+	fileHandle     *fileHandle
+	fileDecoders   map[layers.LinkType]*tcp.DecoderStruct
 	afpacketHandle *AfpacketHandle
 	pfringHandle   *PfringHandle
 	config         *config.InterfacesConfig
 	isAlive        bool
-	dumper         *pcap.Dumper
+	dumper         *dumpWriter
+	packets        int
+	stats          *captureStatsRegistry
+
+	// When capturing on more than one device, each of them gets its
+	// own sniffer, running in its own goroutine.
+	devices []*SnifferSetup
 
 	Decoder    *tcp.DecoderStruct
 	DataSource gopacket.PacketDataSource
 }
 
+// DefaultSnaplen captures the packets whole.
+const DefaultSnaplen = 65535
+
+// openLive opens the libpcap handle of a device. It is replaced by the
+// tests.
+var openLive = pcap.OpenLive
+
+// newAfpacketHandle opens the af_packet ring of a device. It is replaced
+// by the tests.
+var newAfpacketHandle = NewAfpacketHandle
+
+// How often the libpcap counters are read.
+const statsPeriod = 10 * time.Second
+
+// The packets captured on all the devices are decoded one at a time,
+// because the TCP streams are shared.
+var decodeLock sync.Mutex
+
 // Computes the block_size and the num_blocks in such a way that the
 // allocated mmap buffer is close to but smaller than target_size_mb.
 // The restriction is that the block_size must be divisible by both the
@@ -78,11 +105,11 @@ func (sniffer *SnifferSetup) setFromConfig(config *config.InterfacesConfig) erro
 		}
 	}
 	if sniffer.config.Snaplen == 0 {
-		if sniffer.config.Devices[0] == "any" || sniffer.config.Devices[0] == "lo" {
-			sniffer.config.Snaplen = 16436
-		} else {
-			sniffer.config.Snaplen = 1514
-		}
+		sniffer.config.Snaplen = DefaultSnaplen
+	}
+	promiscuous := true
+	if sniffer.config.Promiscuous != nil {
+		promiscuous = *sniffer.config.Promiscuous
 	}
 
 	if sniffer.config.Type == "autodetect" || sniffer.config.Type == "" {
@@ -91,75 +118,45 @@ func (sniffer *SnifferSetup) setFromConfig(config *config.InterfacesConfig) erro
 
 	logp.Debug("sniffer", "Sniffer type: %s devices: %s", sniffer.config.Type, sniffer.config.Devices)
 
+	if len(sniffer.config.File) == 0 && len(sniffer.config.Devices) > 1 {
+		return sniffer.setupDevices()
+	}
+
 	switch sniffer.config.Type {
 	case "pcap":
 		if len(sniffer.config.File) > 0 {
-			sniffer.pcapHandle, err = pcap.OpenOffline(sniffer.config.File)
-			if err != nil {
-				return err
-			}
-		} else {
-			if len(sniffer.config.Devices) > 1 {
-				return fmt.Errorf("Pcap sniffer only supports one device. You can use 'any' if you want")
-			}
-			sniffer.pcapHandle, err = pcap.OpenLive(
-				sniffer.config.Devices[0],
-				int32(sniffer.config.Snaplen),
-				true,
-				500*time.Millisecond)
-			if err != nil {
-				return err
-			}
-			err = sniffer.pcapHandle.SetBPFFilter(sniffer.config.Bpf_filter)
+			sniffer.fileHandle, err = openFile(sniffer.config.File)
 			if err != nil {
 				return err
 			}
+			sniffer.DataSource = gopacket.PacketDataSource(sniffer.fileHandle)
+			break
 		}
 
-		sniffer.DataSource = gopacket.PacketDataSource(sniffer.pcapHandle)
-
-	case "af_packet":
-		if sniffer.config.Buffer_size_mb == 0 {
-			sniffer.config.Buffer_size_mb = 24
-		}
-
-		if len(sniffer.config.Devices) > 1 {
-			return fmt.Errorf("Afpacket sniffer only supports one device. You can use 'any' if you want")
-		}
-
-		frame_size, block_size, num_blocks, err := afpacketComputeSize(
-			sniffer.config.Buffer_size_mb,
-			sniffer.config.Snaplen,
-			os.Getpagesize())
+		err = sniffer.openPcap(promiscuous)
 		if err != nil {
 			return err
 		}
 
-		sniffer.afpacketHandle, err = NewAfpacketHandle(
-			sniffer.config.Devices[0],
-			frame_size,
-			block_size,
-			num_blocks,
-			500*time.Millisecond)
-		if err != nil {
-			return err
+	case "af_packet":
+		group := sniffer.config.Fanout_group
+		if group != nil && (*group < 0 || *group > 0xffff) {
+			return fmt.Errorf("fanout_group must be between 0 and 65535, got %d", *group)
 		}
-
-		err = sniffer.afpacketHandle.SetBPFFilter(sniffer.config.Bpf_filter)
+		err = sniffer.openAfpacket()
 		if err != nil {
-			return fmt.Errorf("SetBPFFilter failed: %s", err)
+			// libpcap is available everywhere, while af_packet needs
+			// Linux and the CAP_NET_RAW capability
+			logp.Warn("Failed to open the af_packet sniffer, falling back to pcap: %v", err)
+			sniffer.config.Type = "pcap"
+			return sniffer.openPcap(promiscuous)
 		}
 
-		sniffer.DataSource = gopacket.PacketDataSource(sniffer.afpacketHandle)
 	case "pfring":
-		if len(sniffer.config.Devices) > 1 {
-			return fmt.Errorf("Afpacket sniffer only supports one device. You can use 'any' if you want")
-		}
-
 		sniffer.pfringHandle, err = NewPfringHandle(
 			sniffer.config.Devices[0],
 			sniffer.config.Snaplen,
-			true)
+			promiscuous)
 
 		if err != nil {
 			return err
@@ -184,33 +181,142 @@ func (sniffer *SnifferSetup) setFromConfig(config *config.InterfacesConfig) erro
 	return nil
 }
 
+// openPcap opens the libpcap handle of the device.
+func (sniffer *SnifferSetup) openPcap(promiscuous bool) error {
+	var err error
+	sniffer.pcapHandle, err = openLive(
+		sniffer.config.Devices[0],
+		int32(sniffer.config.Snaplen),
+		promiscuous,
+		500*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	err = sniffer.pcapHandle.SetBPFFilter(sniffer.config.Bpf_filter)
+	if err != nil {
+		return err
+	}
+
+	sniffer.DataSource = gopacket.PacketDataSource(sniffer.pcapHandle)
+	return nil
+}
+
+// openAfpacket opens the memory mapped ring of the device, and joins the
+// fanout group when one is configured.
+func (sniffer *SnifferSetup) openAfpacket() error {
+	if sniffer.config.Buffer_size_mb == 0 {
+		sniffer.config.Buffer_size_mb = 24
+	}
+
+	frame_size, block_size, num_blocks, err := afpacketComputeSize(
+		sniffer.config.Buffer_size_mb,
+		sniffer.config.Snaplen,
+		os.Getpagesize())
+	if err != nil {
+		return err
+	}
+
+	handle, err := newAfpacketHandle(
+		sniffer.config.Devices[0],
+		frame_size,
+		block_size,
+		num_blocks,
+		500*time.Millisecond)
+	if err != nil {
+		return err
+	}
+
+	err = handle.SetBPFFilter(sniffer.config.Bpf_filter)
+	if err != nil {
+		handle.Close()
+		return fmt.Errorf("SetBPFFilter failed: %s", err)
+	}
+
+	if sniffer.config.Fanout_group != nil {
+		err = handle.SetFanout(uint16(*sniffer.config.Fanout_group))
+		if err != nil {
+			handle.Close()
+			return fmt.Errorf("SetFanout failed: %s", err)
+		}
+	}
+
+	sniffer.afpacketHandle = handle
+	sniffer.DataSource = gopacket.PacketDataSource(handle)
+	return nil
+}
+
+// setupDevices opens a sniffer for each of the configured devices.
+func (sniffer *SnifferSetup) setupDevices() error {
+	for _, device := range sniffer.config.Devices {
+		deviceConfig := *sniffer.config
+		deviceConfig.Device = device
+		deviceConfig.Devices = []string{device}
+
+		deviceSniffer := new(SnifferSetup)
+		err := deviceSniffer.setFromConfig(&deviceConfig)
+		if err != nil {
+			sniffer.Close()
+			return fmt.Errorf("Device %s: %v", device, err)
+		}
+		sniffer.devices = append(sniffer.devices, deviceSniffer)
+	}
+	return nil
+}
+
 func (sniffer *SnifferSetup) Reopen() error {
 	var err error
 
 	if sniffer.config.Type != "pcap" || sniffer.config.File == "" {
 		return fmt.Errorf("Reopen is only possible for files")
 	}
+	if sniffer.config.File == stdinFile {
+		return fmt.Errorf("The standard input can't be read again")
+	}
 
-	sniffer.pcapHandle.Close()
-	sniffer.pcapHandle, err = pcap.OpenOffline(sniffer.config.File)
+	sniffer.fileHandle.Close()
+	sniffer.fileHandle, err = openFile(sniffer.config.File)
 	if err != nil {
 		return err
 	}
 
-	sniffer.DataSource = gopacket.PacketDataSource(sniffer.pcapHandle)
+	sniffer.DataSource = gopacket.PacketDataSource(sniffer.fileHandle)
 
 	return nil
 }
 
 func (sniffer *SnifferSetup) Datalink() layers.LinkType {
+	if len(sniffer.devices) > 0 {
+		return sniffer.devices[0].Datalink()
+	}
+	if sniffer.fileHandle != nil {
+		return sniffer.fileHandle.LinkType()
+	}
 	if sniffer.config.Type == "pcap" {
 		return sniffer.pcapHandle.LinkType()
 	}
 	return layers.LinkTypeEthernet
 }
 
+// dumpLinkType returns the link type of the dump file. A pcap file has a
+// single link type, so all the devices must have the same.
+func (sniffer *SnifferSetup) dumpLinkType() (layers.LinkType, error) {
+	linkType := sniffer.Datalink()
+	for _, device := range sniffer.devices {
+		if device.Datalink() != linkType {
+			return linkType, fmt.Errorf("The packets of %s (%s) and %s (%s) can't be dumped "+
+				"in the same file, their link types differ",
+				sniffer.devices[0].config.Device, linkType,
+				device.config.Device, device.Datalink())
+		}
+	}
+	return linkType, nil
+}
+
 func (sniffer *SnifferSetup) Init(test_mode bool, events chan common.MapStr) error {
-	config.ConfigSingleton.Interfaces.Bpf_filter = tcp.BpfFilter()
+	if len(config.ConfigSingleton.Interfaces.Bpf_filter) == 0 {
+		config.ConfigSingleton.Interfaces.Bpf_filter = tcp.BpfFilter()
+	}
+	logp.Info("BPF filter: %s", config.ConfigSingleton.Interfaces.Bpf_filter)
 
 	var err error
 	if !test_mode {
@@ -224,25 +330,96 @@ func (sniffer *SnifferSetup) Init(test_mode bool, events chan common.MapStr) err
 	if err != nil {
 		return fmt.Errorf("Error creating decoder: %v", err)
 	}
+	for _, device := range sniffer.devices {
+		// the devices can have different link types
+		device.Decoder, err = tcp.CreateDecoder(device.Datalink())
+		if err != nil {
+			return fmt.Errorf("Error creating decoder for %s: %v", device.config.Device, err)
+		}
+		// the events tell which device captured their packets
+		device.Decoder.Device = device.config.Device
+	}
 
 	if sniffer.config.Dumpfile != "" {
-		p, err := pcap.OpenDead(sniffer.Datalink(), 65535)
+		linkType, err := sniffer.dumpLinkType()
 		if err != nil {
 			return err
 		}
-		sniffer.dumper, err = p.NewDumper(sniffer.config.Dumpfile)
+		sniffer.dumper, err = newDumpWriter(sniffer.config.Dumpfile,
+			linkType,
+			int64(sniffer.config.Dump_max_size_mb)*1024*1024,
+			sniffer.config.Dump_max_files,
+			time.Duration(sniffer.config.Dump_rotate_every_min)*time.Minute)
 		if err != nil {
 			return err
 		}
 	}
 
+	if sniffer.config.Type == "pcap" && len(sniffer.config.File) == 0 {
+		if sniffer.config.Drop_warning_percent == 0 {
+			sniffer.config.Drop_warning_percent = 1
+		}
+		sniffer.stats = newCaptureStatsRegistry(sniffer.config.Drop_warning_percent)
+		if len(sniffer.config.Stats_address) > 0 {
+			go serveCaptureStats(sniffer.config.Stats_address, sniffer.stats)
+		}
+	}
+
 	sniffer.isAlive = true
+	for _, device := range sniffer.devices {
+		device.dumper = sniffer.dumper
+		device.isAlive = true
+	}
 
 	return nil
 }
 
 func (sniffer *SnifferSetup) Run() error {
-	counter := 0
+	var err error
+
+	if sniffer.stats != nil {
+		go sniffer.pollStats(statsPeriod)
+	}
+
+	if len(sniffer.devices) > 0 {
+		err = sniffer.runDevices()
+	} else {
+		err = sniffer.capture()
+	}
+
+	logp.Info("Input finish. Processed %d packets. Have a nice day!", sniffer.Packets())
+
+	if sniffer.dumper != nil {
+		sniffer.dumper.Close()
+	}
+
+	return err
+}
+
+// runDevices captures on all the devices at the same time and returns
+// when all of them are done. The first error stops the others.
+func (sniffer *SnifferSetup) runDevices() error {
+	errors := make(chan error, len(sniffer.devices))
+	for _, device := range sniffer.devices {
+		go func(device *SnifferSetup) {
+			errors <- device.capture()
+		}(device)
+	}
+
+	var ret_error error
+	for _ = range sniffer.devices {
+		err := <-errors
+		if err != nil && ret_error == nil {
+			ret_error = err
+			sniffer.Stop()
+		}
+	}
+	sniffer.isAlive = false
+
+	return ret_error
+}
+
+func (sniffer *SnifferSetup) capture() error {
 	loopCount := 1
 	var lastPktTime *time.Time = nil
 	var ret_error error
@@ -302,33 +479,112 @@ func (sniffer *SnifferSetup) Run() error {
 					logp.Warn("Time in pcap went backwards: %d", sleep)
 				}
 			}
+			// the packets keep the time of the capture, the events
+			// are dated by the timestamps section of the configuration
 			_lastPktTime := ci.Timestamp
 			lastPktTime = &_lastPktTime
-			ci.Timestamp = time.Now() // overwrite what we get from the pcap
 		}
-		counter++
+		sniffer.packets++
+		logp.Debug("sniffer", "Packet number: %d", sniffer.packets)
 
-		if sniffer.dumper != nil {
-			sniffer.dumper.WritePacketData(data, ci)
+		if sniffer.fileHandle != nil {
+			decoder, err := sniffer.fileDecoder()
+			if err != nil {
+				logp.Debug("sniffer", "Ignoring packet %d: %v", sniffer.packets, err)
+				continue
+			}
+			sniffer.Decoder = decoder
 		}
-		logp.Debug("sniffer", "Packet number: %d", counter)
 
-		sniffer.Decoder.DecodePacketData(data, &ci)
+		sniffer.decode(data, &ci)
+	}
+
+	return ret_error
+}
+
+// fileDecoder returns the decoder for the link type of the last packet
+// read from the file, as the pcapng files can mix interfaces of several
+// types.
+func (sniffer *SnifferSetup) fileDecoder() (*tcp.DecoderStruct, error) {
+	linkType := sniffer.fileHandle.LinkType()
+	decoder, exists := sniffer.fileDecoders[linkType]
+	if exists {
+		return decoder, nil
 	}
 
-	logp.Info("Input finish. Processed %d packets. Have a nice day!", counter)
+	decoder, err := tcp.CreateDecoder(linkType)
+	if err != nil {
+		return nil, err
+	}
+	if sniffer.fileDecoders == nil {
+		sniffer.fileDecoders = map[layers.LinkType]*tcp.DecoderStruct{}
+	}
+	sniffer.fileDecoders[linkType] = decoder
+	return decoder, nil
+}
+
+func (sniffer *SnifferSetup) decode(data []byte, ci *gopacket.CaptureInfo) {
+	decodeLock.Lock()
+	defer decodeLock.Unlock()
 
 	if sniffer.dumper != nil {
-		sniffer.dumper.Close()
+		err := sniffer.dumper.WritePacketData(data, *ci)
+		if err != nil {
+			logp.Err("Error writing the dump file: %v", err)
+		}
 	}
+	sniffer.Decoder.DecodePacketData(data, ci)
+}
 
-	return ret_error
+// PauseDecoding runs fn between two packets, while the protocol plugins
+// are not called. The capture goes on, the packets wait in the buffers.
+func PauseDecoding(fn func()) {
+	decodeLock.Lock()
+	defer decodeLock.Unlock()
+
+	fn()
+}
+
+// CaptureStats returns the last libpcap counters of each device. It is
+// empty unless live traffic is captured with the pcap sniffer type.
+func (sniffer *SnifferSetup) CaptureStats() map[string]CaptureStats {
+	devices := map[string]CaptureStats{}
+	if sniffer.stats == nil {
+		return devices
+	}
+
+	sniffer.stats.Lock()
+	defer sniffer.stats.Unlock()
+	for device, stats := range sniffer.stats.devices {
+		devices[device] = stats
+	}
+	return devices
+}
+
+// Packets returns the number of packets captured, on all the devices.
+func (sniffer *SnifferSetup) Packets() int {
+	packets := sniffer.packets
+	for _, device := range sniffer.devices {
+		packets += device.packets
+	}
+	return packets
 }
 
 func (sniffer *SnifferSetup) Close() error {
+	if len(sniffer.devices) > 0 {
+		for _, device := range sniffer.devices {
+			device.Close()
+		}
+		return nil
+	}
+
 	switch sniffer.config.Type {
 	case "pcap":
-		sniffer.pcapHandle.Close()
+		if sniffer.fileHandle != nil {
+			sniffer.fileHandle.Close()
+		} else {
+			sniffer.pcapHandle.Close()
+		}
 	case "af_packet":
 		sniffer.afpacketHandle.Close()
 	case "pfring":
@@ -339,6 +595,9 @@ func (sniffer *SnifferSetup) Close() error {
 
 func (sniffer *SnifferSetup) Stop() error {
 	sniffer.isAlive = false
+	for _, device := range sniffer.devices {
+		device.Stop()
+	}
 	return nil
 }
 
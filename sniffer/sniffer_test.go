@@ -1,7 +1,26 @@
 package sniffer
 
 import (
+	"errors"
+	"io"
+	"net"
 	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+
+	"github.com/johann8384/packetbeat/config"
+	"github.com/johann8384/packetbeat/pipeline"
+	"github.com/johann8384/packetbeat/protos"
+	"github.com/johann8384/packetbeat/protos/http"
+	"github.com/johann8384/packetbeat/protos/tcp"
+	"github.com/johann8384/packetbeat/protos/udp"
+	"github.com/johann8384/packetbeat/timestamps"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tsg/gopacket"
+	"github.com/tsg/gopacket/layers"
+	"github.com/tsg/gopacket/pcap"
 )
 
 func TestSniffer_afpacketComputeSize(t *testing.T) {
@@ -49,3 +68,464 @@ func TestSniffer_afpacketComputeSize(t *testing.T) {
 		t.Error("Bad result", frame_size, block_size, num_blocks)
 	}
 }
+
+type packetsSource struct {
+	packets [][]byte
+}
+
+func (source *packetsSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(source.packets) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := source.packets[0]
+	source.packets = source.packets[1:]
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+	return data, ci, nil
+}
+
+type udpCollector struct {
+	results chan common.MapStr
+}
+
+func (collector *udpCollector) Init(test_mode bool, results chan common.MapStr) error {
+	return nil
+}
+
+func (collector *udpCollector) GetPorts() []int {
+	return []int{9999}
+}
+
+func (collector *udpCollector) Parse(pkt *protos.Packet, tcptuple *common.TcpTuple,
+	dir uint8, private protos.ProtocolData) protos.ProtocolData {
+	return private
+}
+
+func (collector *udpCollector) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+	return private
+}
+
+func (collector *udpCollector) GapInStream(tcptuple *common.TcpTuple, dir uint8,
+	private protos.ProtocolData) protos.ProtocolData {
+	return private
+}
+
+func (collector *udpCollector) ParseUdp(pkt *protos.Packet) {
+	collector.results <- common.MapStr{"src": pkt.Tuple.Src_ip.String()}
+}
+
+func udpPacket(t *testing.T, src string) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(src).To4(),
+		DstIP:    net.ParseIP("10.0.0.1").To4(),
+	}
+	udp := &layers.UDP{SrcPort: 34567, DstPort: 9999}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload("hello"))
+	if err != nil {
+		t.Fatalf("Failed to build the packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func tcpPacket(t *testing.T, src string, srcPort uint16, dst string, dstPort uint16,
+	seq uint32, payload string) []byte {
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(src).To4(),
+		DstIP:    net.ParseIP(dst).To4(),
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		ACK:     true,
+		PSH:     true,
+		Window:  1024,
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: false}
+	err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatalf("Failed to build the packet: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func deviceForTests(t *testing.T, packets ...[]byte) *SnifferSetup {
+	decoder, err := tcp.CreateDecoder(layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatalf("Failed to create the decoder: %v", err)
+	}
+	return &SnifferSetup{
+		config:     &config.InterfacesConfig{Type: "pcap", Loop: 1},
+		DataSource: &packetsSource{packets: packets},
+		Decoder:    decoder,
+		isAlive:    true,
+	}
+}
+
+func TestSniffer_multipleDevices(t *testing.T) {
+	collector := &udpCollector{results: make(chan common.MapStr, 10)}
+	protos.Protos.Register(protos.DnsProtocol, collector)
+	udp.UdpInit()
+
+	sniffer := &SnifferSetup{
+		config: &config.InterfacesConfig{Type: "pcap"},
+		devices: []*SnifferSetup{
+			deviceForTests(t, udpPacket(t, "192.168.1.1"), udpPacket(t, "192.168.1.1")),
+			deviceForTests(t, udpPacket(t, "192.168.2.1")),
+		},
+		isAlive: true,
+	}
+
+	err := sniffer.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if sniffer.IsAlive() {
+		t.Error("Expected the sniffer to stop after all devices are done")
+	}
+	if sniffer.Packets() != 3 {
+		t.Errorf("Expected 3 packets, got %d", sniffer.Packets())
+	}
+
+	sources := map[string]int{}
+	for len(collector.results) > 0 {
+		event := <-collector.results
+		sources[event["src"].(string)]++
+	}
+	if sources["192.168.1.1"] != 2 || sources["192.168.2.1"] != 1 {
+		t.Errorf("Expected packets from both devices, got %v", sources)
+	}
+}
+
+func TestSniffer_dumpLinkType(t *testing.T) {
+	device := func(name string, file string) *SnifferSetup {
+		handle, err := openFile(file)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", file, err)
+		}
+		return &SnifferSetup{
+			config:     &config.InterfacesConfig{Device: name},
+			fileHandle: handle,
+		}
+	}
+
+	// Ethernet on both
+	sniffer := &SnifferSetup{
+		config: &config.InterfacesConfig{Type: "pcap"},
+		devices: []*SnifferSetup{
+			device("eth0", "../tests/pcaps/http_post.pcap"),
+			device("eth1", "../tests/pcaps/http_post.pcap"),
+		},
+	}
+	linkType, err := sniffer.dumpLinkType()
+	assert.Nil(t, err)
+	assert.Equal(t, layers.LinkTypeEthernet, linkType)
+
+	// Linux cooked next to Ethernet
+	sniffer.devices = append(sniffer.devices, device("any", "../tests/pcaps/http_minitwit.pcap"))
+	_, err = sniffer.dumpLinkType()
+	assert.NotNil(t, err)
+}
+
+func TestSniffer_stopAllDevices(t *testing.T) {
+	sniffer := &SnifferSetup{
+		config: &config.InterfacesConfig{Type: "pcap"},
+		devices: []*SnifferSetup{
+			deviceForTests(t),
+			deviceForTests(t),
+		},
+		isAlive: true,
+	}
+
+	sniffer.Stop()
+
+	for _, device := range sniffer.devices {
+		if device.IsAlive() {
+			t.Error("Expected all devices to be stopped")
+		}
+	}
+}
+
+func TestSniffer_parseStats(t *testing.T) {
+	events := make(chan common.MapStr, 10)
+	httpMod := &http.Http{}
+	httpMod.Init(true, pipeline.Chain{pipeline.Update(protos.Stats.CountTransaction)}.Queue(events))
+	httpMod.Ports = []int{80}
+	protos.Protos.Register(protos.HttpProtocol, httpMod)
+	defer protos.Protos.Unregister(protos.HttpProtocol)
+	protos.Protos.Unregister(protos.DnsProtocol)
+	if err := tcp.TcpInit(); err != nil {
+		t.Fatal(err)
+	}
+	udp.UdpInit()
+	protos.Stats.Reset()
+
+	sniffer := deviceForTests(t,
+		// one transaction
+		tcpPacket(t, "10.0.0.2", 34567, "10.0.0.1", 80, 1000,
+			"GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		tcpPacket(t, "10.0.0.1", 80, "10.0.0.2", 34567, 5000,
+			"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"),
+		// a request waiting for its response
+		tcpPacket(t, "10.0.0.2", 34567, "10.0.0.1", 80, 1047,
+			"GET /other.html HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		// not HTTP
+		tcpPacket(t, "10.0.0.3", 34568, "10.0.0.1", 80, 2000,
+			"HELLO HELLO HELLO\r\n\r\n"),
+		// no plugin for this port
+		udpPacket(t, "10.0.0.4"))
+
+	if err := sniffer.Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if sniffer.Packets() != 5 {
+		t.Errorf("Expected 5 packets, got %d", sniffer.Packets())
+	}
+
+	// the events are counted before they are forwarded
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a transaction")
+	}
+
+	stats := protos.Stats.Get()
+	expected := protos.ProtocolStats{Packets: 4, Transactions: 1, ParseErrors: 1}
+	if stats[protos.HttpProtocol] != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats[protos.HttpProtocol])
+	}
+	if len(stats) != 1 {
+		t.Errorf("Expected only HTTP packets to be matched, got %v", stats)
+	}
+	if httpMod.TransactionsInFlight() != 1 {
+		t.Errorf("Expected 1 transaction in flight, got %d", httpMod.TransactionsInFlight())
+	}
+}
+
+// replayFile reads a file through the HTTP plugin and returns the events,
+// without the fields depending on the time of the replay.
+// replayFile returns the events of the file, without their timestamp
+// and response time.
+func replayFile(t *testing.T, name string) []common.MapStr {
+	res := replayEvents(t, name)
+	for _, event := range res {
+		delete(event, "timestamp")
+		delete(event, "responsetime")
+	}
+	return res
+}
+
+func replayEvents(t *testing.T, name string) []common.MapStr {
+	events := make(chan common.MapStr, 100)
+	httpMod := &http.Http{}
+	httpMod.Init(true, events)
+	httpMod.Ports = []int{80, 8080, 8000, 5000, 8002}
+	protos.Protos.Register(protos.HttpProtocol, httpMod)
+	defer protos.Protos.Unregister(protos.HttpProtocol)
+	if err := tcp.TcpInit(); err != nil {
+		t.Fatal(err)
+	}
+
+	sniffer := &SnifferSetup{}
+	err := sniffer.setFromConfig(&config.InterfacesConfig{File: name, TopSpeed: true, Loop: 1})
+	if err != nil {
+		t.Fatalf("Opening %s failed: %v", name, err)
+	}
+	defer sniffer.Close()
+	sniffer.Decoder, err = tcp.CreateDecoder(sniffer.Datalink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sniffer.isAlive = true
+	if err = sniffer.Run(); err != nil {
+		t.Fatalf("Replaying %s failed: %v", name, err)
+	}
+
+	res := []common.MapStr{}
+	for len(events) > 0 {
+		res = append(res, <-events)
+	}
+	return res
+}
+
+type filePacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+func readFile(t *testing.T, name string) []filePacket {
+	handle, err := openFile(name)
+	if err != nil {
+		t.Fatalf("Opening %s failed: %v", name, err)
+	}
+	defer handle.Close()
+
+	packets := []filePacket{}
+	for {
+		data, ci, err := handle.ReadPacketData()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("Reading %s failed: %v", name, err)
+		}
+		packets = append(packets, filePacket{data, ci})
+	}
+}
+
+func TestSniffer_gzippedFile(t *testing.T) {
+	plain := readFile(t, "../tests/pcaps/http_post.pcap")
+	assert.Equal(t, plain, readFile(t, "../tests/pcaps/http_post.pcap.gz"))
+
+	events := replayFile(t, "../tests/pcaps/http_post.pcap.gz")
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "POST", events[0]["method"])
+		assert.Equal(t, "/register", events[0]["path"])
+	}
+	assert.Equal(t, events, replayFile(t, "../tests/pcaps/http_post.pcap"))
+}
+
+func TestSniffer_replayTimestamps(t *testing.T) {
+	packets := readFile(t, "../tests/pcaps/http_post.pcap")
+	first := packets[0].ci.Timestamp
+	last := packets[len(packets)-1].ci.Timestamp
+
+	events := replayEvents(t, "../tests/pcaps/http_post.pcap")
+	if len(events) == 0 {
+		t.Fatal("No events replayed")
+	}
+	for _, event := range events {
+		ts := time.Time(event["timestamp"].(common.Time))
+		if ts.Before(first) || ts.After(last) {
+			t.Errorf("Expected the time of the capture, between %v and %v, got %v",
+				first, last, ts)
+		}
+	}
+
+	// the capture is older than max_age
+	stamps, err := timestamps.New(timestamps.TimestampsConfig{Mode: timestamps.ModeMaxAge})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		assert.False(t, stamps.StampEvent(event))
+	}
+	assert.Equal(t, uint64(len(events)), stamps.Dropped())
+
+	stamps, err = timestamps.New(timestamps.TimestampsConfig{Mode: timestamps.ModeIngest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	assert.True(t, stamps.StampEvent(events[0]))
+	assert.False(t, time.Time(events[0]["timestamp"].(common.Time)).Before(start))
+}
+
+func TestSniffer_pcapngFile(t *testing.T) {
+	packets := readFile(t, "../tests/pcaps/http_two_interfaces.pcapng")
+	if assert.Len(t, packets, 2) {
+		assert.Equal(t, time.Unix(1430000000, 250000000), packets[0].ci.Timestamp)
+		assert.Equal(t, time.Unix(1430000000, 300000000), packets[1].ci.Timestamp)
+		assert.Equal(t, len(packets[0].data), packets[0].ci.CaptureLength)
+	}
+
+	// the request is on an Ethernet interface, the response on a
+	// Linux cooked one
+	events := replayFile(t, "../tests/pcaps/http_two_interfaces.pcapng")
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "/pcapng.html", events[0]["path"])
+		assert.Equal(t, "OK", events[0]["status"])
+	}
+}
+
+func TestSniffer_openLiveOptions(t *testing.T) {
+	type openArgs struct {
+		device  string
+		snaplen int32
+		promisc bool
+	}
+	var opened []openArgs
+	defer func(orig func(string, int32, bool, time.Duration) (*pcap.Handle, error)) {
+		openLive = orig
+	}(openLive)
+	openLive = func(device string, snaplen int32, promisc bool,
+		timeout time.Duration) (*pcap.Handle, error) {
+
+		opened = append(opened, openArgs{device, snaplen, promisc})
+		return nil, errors.New("no capture in the tests")
+	}
+
+	// defaults
+	sniffer := new(SnifferSetup)
+	assert.NotNil(t, sniffer.setFromConfig(&config.InterfacesConfig{Device: "eth0"}))
+
+	// configured
+	promiscuous := false
+	sniffer = new(SnifferSetup)
+	assert.NotNil(t, sniffer.setFromConfig(&config.InterfacesConfig{
+		Device:      "eth1",
+		Snaplen:     256,
+		Promiscuous: &promiscuous,
+	}))
+
+	assert.Equal(t, []openArgs{
+		{"eth0", DefaultSnaplen, true},
+		{"eth1", 256, false},
+	}, opened)
+}
+
+func TestSniffer_afpacketFallback(t *testing.T) {
+	var opened []string
+	defer func(orig func(string, int32, bool, time.Duration) (*pcap.Handle, error)) {
+		openLive = orig
+	}(openLive)
+	openLive = func(device string, snaplen int32, promisc bool,
+		timeout time.Duration) (*pcap.Handle, error) {
+
+		opened = append(opened, device)
+		return nil, errors.New("no capture in the tests")
+	}
+	defer func(orig func(string, int, int, int, time.Duration) (*AfpacketHandle, error)) {
+		newAfpacketHandle = orig
+	}(newAfpacketHandle)
+	newAfpacketHandle = func(device string, snaplen int, block_size int, num_blocks int,
+		timeout time.Duration) (*AfpacketHandle, error) {
+
+		return nil, errors.New("af_packet unavailable")
+	}
+
+	interfaces := &config.InterfacesConfig{Device: "eth0", Type: "af_packet"}
+	sniffer := new(SnifferSetup)
+	assert.NotNil(t, sniffer.setFromConfig(interfaces))
+	assert.Equal(t, "pcap", interfaces.Type)
+	assert.Equal(t, []string{"eth0"}, opened)
+
+	// a bad fanout group is an error, not a fallback
+	group := 70000
+	interfaces = &config.InterfacesConfig{Device: "eth1", Type: "af_packet", Fanout_group: &group}
+	err := new(SnifferSetup).setFromConfig(interfaces)
+	assert.Contains(t, err.Error(), "fanout_group")
+	assert.Equal(t, []string{"eth0"}, opened)
+}
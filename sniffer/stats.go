@@ -0,0 +1,122 @@
+package sniffer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/johann8384/libbeat/logp"
+)
+
+// CaptureStats are the counters reported by libpcap for a device.
+type CaptureStats struct {
+	Received  int `json:"received"`
+	Dropped   int `json:"dropped"`
+	IfDropped int `json:"if_dropped"`
+}
+
+// captureStatsRegistry keeps the last counters of each device and serves
+// them as JSON.
+type captureStatsRegistry struct {
+	sync.Mutex
+	devices map[string]CaptureStats
+
+	// percentage of dropped packets, over a polling period, above which
+	// a warning is logged
+	dropWarning float64
+}
+
+func newCaptureStatsRegistry(dropWarning float64) *captureStatsRegistry {
+	return &captureStatsRegistry{
+		devices:     map[string]CaptureStats{},
+		dropWarning: dropWarning,
+	}
+}
+
+// update stores the new counters of the device and warns when too many
+// packets were dropped since the previous update.
+func (registry *captureStatsRegistry) update(device string, stats CaptureStats) {
+	registry.Lock()
+	previous := registry.devices[device]
+	registry.devices[device] = stats
+	registry.Unlock()
+
+	received := stats.Received - previous.Received
+	dropped := stats.Dropped - previous.Dropped + stats.IfDropped - previous.IfDropped
+	if received <= 0 || dropped <= 0 {
+		return
+	}
+	rate := 100 * float64(dropped) / float64(received)
+	if rate >= registry.dropWarning {
+		logp.Warn("Device %s dropped %d of %d packets (%.2f%%), the transactions might be incomplete",
+			device, dropped, received, rate)
+	}
+}
+
+func (registry *captureStatsRegistry) total() CaptureStats {
+	var total CaptureStats
+	for _, stats := range registry.devices {
+		total.Received += stats.Received
+		total.Dropped += stats.Dropped
+		total.IfDropped += stats.IfDropped
+	}
+	return total
+}
+
+func (registry *captureStatsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	registry.Lock()
+	body, err := json.Marshal(map[string]interface{}{
+		"devices": registry.devices,
+		"total":   registry.total(),
+	})
+	registry.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// serveCaptureStats exposes the counters on the /stats path of the address.
+func serveCaptureStats(address string, registry *captureStatsRegistry) {
+	mux := http.NewServeMux()
+	mux.Handle("/stats", registry)
+
+	logp.Info("Serving the capture statistics on http://%s/stats", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		logp.Err("Serving the capture statistics failed: %v", err)
+	}
+}
+
+// pollStats periodically reads the libpcap counters of the live pcap
+// handles, until the sniffer is stopped.
+func (sniffer *SnifferSetup) pollStats(period time.Duration) {
+	sniffers := sniffer.devices
+	if len(sniffers) == 0 {
+		sniffers = []*SnifferSetup{sniffer}
+	}
+
+	for sniffer.isAlive {
+		time.Sleep(period)
+
+		for _, device := range sniffers {
+			if device.pcapHandle == nil || len(device.config.File) > 0 {
+				continue
+			}
+			stats, err := device.pcapHandle.Stats()
+			if err != nil {
+				logp.Debug("sniffer", "Reading the stats of %s failed: %v", device.config.Device, err)
+				continue
+			}
+			sniffer.stats.update(device.config.Device, CaptureStats{
+				Received:  stats.PacketsReceived,
+				Dropped:   stats.PacketsDropped,
+				IfDropped: stats.PacketsIfDropped,
+			})
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package sniffer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureStats_handler(t *testing.T) {
+	registry := newCaptureStatsRegistry(1)
+	registry.update("eth0", CaptureStats{Received: 1000, Dropped: 10, IfDropped: 1})
+	registry.update("eth1", CaptureStats{Received: 500, Dropped: 0, IfDropped: 0})
+
+	req, err := http.NewRequest("GET", "/stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var res map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatalf("Invalid JSON %s: %v", w.Body.String(), err)
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"devices": map[string]interface{}{
+			"eth0": map[string]interface{}{
+				"received":   float64(1000),
+				"dropped":    float64(10),
+				"if_dropped": float64(1),
+			},
+			"eth1": map[string]interface{}{
+				"received":   float64(500),
+				"dropped":    float64(0),
+				"if_dropped": float64(0),
+			},
+		},
+		"total": map[string]interface{}{
+			"received":   float64(1500),
+			"dropped":    float64(10),
+			"if_dropped": float64(1),
+		},
+	}, res)
+}
+
+func TestCaptureStats_updateKeepsLastCounters(t *testing.T) {
+	registry := newCaptureStatsRegistry(1)
+	registry.update("any", CaptureStats{Received: 10})
+	registry.update("any", CaptureStats{Received: 20, Dropped: 5})
+
+	assert.Equal(t, CaptureStats{Received: 20, Dropped: 5}, registry.devices["any"])
+	assert.Equal(t, CaptureStats{Received: 20, Dropped: 5}, registry.total())
+}
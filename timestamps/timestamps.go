@@ -0,0 +1,98 @@
+// Package timestamps chooses the timestamp of the published events. The
+// events carry the time their packets were captured, which is in the past
+// when an old pcap file is read, so the events land in old daily indices.
+// The events can get the time they are published instead, or be dropped
+// when they are too old.
+package timestamps
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+)
+
+// Modes of the timestamps.
+const (
+	// The events keep the time of the capture.
+	ModeCapture = "capture"
+
+	// The events get the time they are published.
+	ModeIngest = "ingest"
+
+	// The events keep the time of the capture, but the events older than
+	// max_age are dropped.
+	ModeMaxAge = "max_age"
+)
+
+// DefaultMaxAge of the events, in seconds.
+const DefaultMaxAge = 24 * 60 * 60
+
+type TimestampsConfig struct {
+	// capture, ingest or max_age. Default is capture.
+	Mode string
+
+	// Age in seconds above which the events are dropped, in the max_age
+	// mode.
+	Max_age *int
+}
+
+type Timestamps struct {
+	mode   string
+	maxAge time.Duration
+
+	// clock of the ingest time, replaced by the tests
+	now func() time.Time
+
+	lock    sync.Mutex
+	dropped uint64
+}
+
+// New creates the timestamps policy from the configuration.
+func New(config TimestampsConfig) (*Timestamps, error) {
+	stamps := &Timestamps{
+		mode:   config.Mode,
+		maxAge: DefaultMaxAge * time.Second,
+		now:    time.Now,
+	}
+	switch config.Mode {
+	case "":
+		stamps.mode = ModeCapture
+	case ModeCapture, ModeIngest, ModeMaxAge:
+	default:
+		return nil, fmt.Errorf("unknown timestamps mode: %s", config.Mode)
+	}
+	if config.Max_age != nil {
+		if *config.Max_age <= 0 {
+			return nil, fmt.Errorf("timestamps max_age must be positive, got %d", *config.Max_age)
+		}
+		stamps.maxAge = time.Duration(*config.Max_age) * time.Second
+	}
+	return stamps, nil
+}
+
+// Dropped returns the number of events dropped for being too old.
+func (stamps *Timestamps) Dropped() uint64 {
+	stamps.lock.Lock()
+	defer stamps.lock.Unlock()
+	return stamps.dropped
+}
+
+// StampEvent sets the timestamp of the event according to the mode. It
+// returns false when the event has to be dropped.
+func (stamps *Timestamps) StampEvent(event common.MapStr) bool {
+	switch stamps.mode {
+	case ModeIngest:
+		event["timestamp"] = common.Time(stamps.now())
+	case ModeMaxAge:
+		ts, ok := event["timestamp"].(common.Time)
+		if ok && stamps.now().Sub(time.Time(ts)) > stamps.maxAge {
+			stamps.lock.Lock()
+			stamps.dropped++
+			stamps.lock.Unlock()
+			return false
+		}
+	}
+	return true
+}
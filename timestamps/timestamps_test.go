@@ -0,0 +1,85 @@
+package timestamps
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johann8384/libbeat/common"
+	"github.com/johann8384/packetbeat/pipeline"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var now = time.Date(2015, time.June, 10, 12, 0, 0, 0, time.UTC)
+
+func newTimestamps(t *testing.T, config TimestampsConfig) *Timestamps {
+	stamps, err := New(config)
+	assert.Nil(t, err)
+	stamps.now = func() time.Time { return now }
+	return stamps
+}
+
+func captured(ago time.Duration) common.MapStr {
+	return common.MapStr{"timestamp": common.Time(now.Add(-ago))}
+}
+
+func TestTimestamps_config(t *testing.T) {
+	_, err := New(TimestampsConfig{Mode: "wallclock"})
+	assert.NotNil(t, err)
+
+	zero := 0
+	_, err = New(TimestampsConfig{Mode: ModeMaxAge, Max_age: &zero})
+	assert.NotNil(t, err)
+
+	stamps, err := New(TimestampsConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, ModeCapture, stamps.mode)
+	assert.Equal(t, DefaultMaxAge*time.Second, stamps.maxAge)
+}
+
+func TestTimestamps_capture(t *testing.T) {
+	stamps := newTimestamps(t, TimestampsConfig{Mode: ModeCapture})
+
+	event := captured(30 * 24 * time.Hour)
+	assert.True(t, stamps.StampEvent(event))
+	assert.Equal(t, common.Time(now.Add(-30*24*time.Hour)), event["timestamp"])
+}
+
+func TestTimestamps_ingest(t *testing.T) {
+	stamps := newTimestamps(t, TimestampsConfig{Mode: ModeIngest})
+
+	event := captured(30 * 24 * time.Hour)
+	assert.True(t, stamps.StampEvent(event))
+	assert.Equal(t, common.Time(now), event["timestamp"])
+}
+
+func TestTimestamps_maxAge(t *testing.T) {
+	maxAge := 3600
+	stamps := newTimestamps(t, TimestampsConfig{Mode: ModeMaxAge, Max_age: &maxAge})
+
+	recent := captured(10 * time.Minute)
+	assert.True(t, stamps.StampEvent(recent))
+	assert.Equal(t, common.Time(now.Add(-10*time.Minute)), recent["timestamp"])
+
+	assert.False(t, stamps.StampEvent(captured(2*time.Hour)))
+	assert.Equal(t, uint64(1), stamps.Dropped())
+}
+
+func TestTimestamps_queue(t *testing.T) {
+	maxAge := 3600
+	stamps := newTimestamps(t, TimestampsConfig{Mode: ModeMaxAge, Max_age: &maxAge})
+
+	results := make(chan common.MapStr, 10)
+	queue := pipeline.Chain{stamps.StampEvent}.Queue(results)
+	queue <- captured(2 * time.Hour)
+	queue <- captured(time.Minute)
+
+	select {
+	case event := <-results:
+		assert.Equal(t, common.Time(now.Add(-time.Minute)), event["timestamp"])
+	case <-time.After(time.Second):
+		t.Fatal("the recent event was not forwarded")
+	}
+	assert.Equal(t, uint64(1), stamps.Dropped())
+	assert.Equal(t, 0, len(results))
+}